@@ -0,0 +1,47 @@
+package app
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// acceptLimiter returns a limiter pacing accepts of new connections according
+// to limits. Returns nil if accept rate isn't limited.
+func (l TunnelLimits) acceptLimiter() *rate.Limiter {
+	if l.AcceptRate == 0 {
+		return nil
+	}
+	burst := l.AcceptBurst
+	if burst == 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(l.AcceptRate), burst)
+}
+
+// updateAcceptRate replaces accept limiter if accept rate settings change
+// between given limits
+func (t *Tunnel) updateAcceptRate(old, new TunnelLimits) {
+	if old.AcceptRate != new.AcceptRate || old.AcceptBurst != new.AcceptBurst {
+		t.acceptLimiter.Store(new.acceptLimiter())
+	}
+}
+
+// paceAccept waits until tunnel is allowed to accept another connection.
+// Returns false if tunnel was shut down meanwhile.
+func (t *Tunnel) paceAccept() bool {
+	l := t.acceptLimiter.Load().(*rate.Limiter)
+	if l == nil {
+		return true
+	}
+	r := l.Reserve()
+	timer := time.NewTimer(r.Delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-t.shutdown:
+		r.Cancel()
+		return false
+	}
+}
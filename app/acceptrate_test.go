@@ -0,0 +1,43 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptRate(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{AcceptRate: 4}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+	}
+	deadline := start.Add(5 * time.Second)
+	for len(tunnel.Connections()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connections to be accepted, got %+v", tunnel.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The first connection is accepted right away, the rest 250ms apart
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected accepts to be paced, all connections accepted in %v", elapsed)
+	}
+
+	if err := (TunnelLimits{AcceptRate: -1}).validate(); err == nil {
+		t.Errorf("Expected negative accept rate to be rejected")
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import "fmt"
+
+// Actions of access rules
+const (
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessRule allows or denies connections matching it to reach upstream
+type AccessRule struct {
+	// AccessAllow or AccessDeny
+	Action string    `json:"action"`
+	Match  MatchRule `json:"match,omitempty"`
+}
+
+// AccessRules decide which connections reach upstream. Connection is allowed
+// or denied by the first rule it matches, connections matching none are
+// allowed (a final deny rule matching everything turns rules into an allow
+// list). Rules are checked once PROXY header or TLS handshake of connection
+// is read, before upstream is dialed.
+type AccessRules []AccessRule
+
+// validate checks rules for errors
+func (r AccessRules) validate() error {
+	_, err := r.set()
+	return err
+}
+
+// equal tells whether two sets of rules are the same
+func (r AccessRules) equal(other AccessRules) bool {
+	if len(r) != len(other) {
+		return false
+	}
+	for i := range r {
+		if r[i].Action != other[i].Action || !r[i].Match.equal(other[i].Match) {
+			return false
+		}
+	}
+	return true
+}
+
+// accessRule is a rule with its match parsed
+type accessRule struct {
+	deny bool
+	rule *ruleMatcher
+}
+
+// accessSet is a parsed set of access rules
+type accessSet struct {
+	rules []accessRule
+}
+
+// set parses rules. Returns nil if there are none.
+func (r AccessRules) set() (*accessSet, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	result := new(accessSet)
+	for i, v := range r {
+		if v.Action != AccessAllow && v.Action != AccessDeny {
+			return nil, fmt.Errorf("Unknown action %q of access rule %d", v.Action, i+1)
+		}
+		rule, err := v.Match.matcher()
+		if err != nil {
+			return nil, withContext(err, "Access rule %d", i+1)
+		}
+		result.rules = append(result.rules, accessRule{
+			deny: v.Action == AccessDeny,
+			rule: rule,
+		})
+	}
+	return result, nil
+}
+
+// check returns an error if a connection is denied. Safe to call on nil set.
+func (s *accessSet) check(meta connectionMeta) error {
+	if s == nil {
+		return nil
+	}
+	for i, r := range s.rules {
+		if !r.rule.match(meta) {
+			continue
+		}
+		if r.deny {
+			return fmt.Errorf("Denied by access rule %d", i+1)
+		}
+		return nil
+	}
+	return nil
+}
+
+// UpdateAccess changes access rules of a tunnel. Active connections the new
+// rules deny are closed.
+func (t *Tunnel) UpdateAccess(rules AccessRules) error {
+	set, err := rules.set()
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateAccess <- set:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// enforceAccess closes active connections access rules deny. Must be called
+// on the tunnel goroutine.
+func (t *Tunnel) enforceAccess(activeConnections *connectionRegistry) {
+	for _, conn := range activeConnections.all() {
+		err := t.access.check(conn.meta())
+		if err == nil {
+			continue
+		}
+		// Forwarders don't report completion of a cancelled connection, so
+		// it's forgotten right away
+		activeConnections.remove(conn)
+		conn.Close()
+		t.logf(LogInfo, "Connection %d at %q closed: %v", conn.ID(), t.listenAt, err)
+		t.connectionClosed(conn, CloseRejected, loadCounters(&conn.counters), err)
+	}
+}
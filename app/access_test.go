@@ -0,0 +1,77 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessRules(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{
+			Settings: TunnelSettings{ProxyProtocol: true},
+			Access: AccessRules{
+				{Action: AccessDeny, Match: MatchRule{Sources: []string{"203.0.113.0/24"}}},
+			},
+		})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	dial := func(source string) net.Conn {
+		conn, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		conn.Write([]byte("PROXY TCP4 " + source + " 127.0.0.1 50000 443\r\n"))
+		return conn
+	}
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	allowed := dial("198.51.100.7")
+	defer allowed.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tunnel.Connections()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Allowed connection wasn't forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if source := tunnel.Connections()[0].Source; source != "198.51.100.7:50000" {
+		t.Errorf("Expected connection to tell its original source, got %q", source)
+	}
+
+	denied := dial("203.0.113.5")
+	defer denied.Close()
+	if !closed(denied) {
+		t.Fatalf("Expected connection from denied source to be closed")
+	}
+	if c := tunnel.Stats().Closed; c[CloseRejected] != 1 {
+		t.Errorf("Expected denied connection to be counted, got %v", c)
+	}
+
+	// New rules close active connections they deny
+	if err := tunnel.UpdateAccess(AccessRules{
+		{Action: AccessAllow, Match: MatchRule{Sources: []string{"203.0.113.0/24"}}},
+		{Action: AccessDeny},
+	}); err != nil {
+		t.Fatalf("Failed to update access rules: %v", err)
+	}
+	if !closed(allowed) {
+		t.Fatalf("Expected connection denied by new rules to be closed")
+	}
+	if len(tunnel.Connections()) != 0 {
+		t.Errorf("Expected no active connections, got %+v", tunnel.Connections())
+	}
+
+	if err := tunnel.UpdateAccess(AccessRules{{Action: "maybe"}}); err == nil {
+		t.Errorf("Expected unknown action to be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddressError is returned for malformed listening or destination addresses
+type AddressError struct {
+	Address string
+	// What exactly is wrong with the address
+	Reason string
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("Invalid address %q: %s", e.Address, e.Reason)
+}
+
+// address is a host and port specification broken into parts
+type address struct {
+	// Host name or IP address without zone (empty for wildcard)
+	host string
+	// Nil if host is not an IP address
+	ip net.IP
+	// IPv6 zone (e.g. interface name of a link-local address)
+	zone string
+	port int
+}
+
+// parseAddress parses host and port specification. IPv6 addresses must be
+// enclosed in brackets if port is given (e.g. "[fe80::1%eth0]:80"). If
+// defaultPort is not empty, port could be omitted and bare IPv6 addresses
+// are accepted too.
+func parseAddress(spec, defaultPort string) (address, error) {
+	fail := func(format string, args ...interface{}) (address, error) {
+		return address{}, &AddressError{Address: spec, Reason: fmt.Sprintf(format, args...)}
+	}
+	if spec == "" {
+		return fail("address is empty")
+	}
+
+	var host, port string
+	bracketed := strings.HasPrefix(spec, "[")
+	switch {
+	case bracketed:
+		end := strings.Index(spec, "]")
+		if end < 0 {
+			return fail("missing closing bracket")
+		}
+		host, port = spec[1:end], spec[end+1:]
+		if port != "" && port[0] != ':' {
+			return fail("unexpected %q after closing bracket", port)
+		}
+		port = strings.TrimPrefix(port, ":")
+		if port == "" && spec[end+1:] == "" {
+			port = defaultPort
+		}
+	case strings.Count(spec, ":") > 1:
+		if defaultPort == "" || net.ParseIP(strings.SplitN(spec, "%", 2)[0]) == nil {
+			return fail("IPv6 address must be enclosed in brackets (e.g. \"[::1]:80\")")
+		}
+		host, port = spec, defaultPort
+	case strings.Contains(spec, ":"):
+		i := strings.Index(spec, ":")
+		host, port = spec[:i], spec[i+1:]
+	default:
+		host, port = spec, defaultPort
+	}
+
+	var result address
+	result.host = host
+	if i := strings.Index(host, "%"); i >= 0 {
+		result.host, result.zone = host[:i], host[i+1:]
+		if result.zone == "" {
+			return fail("zone is empty")
+		}
+	}
+	result.ip = net.ParseIP(result.host)
+	switch {
+	case bracketed && (result.ip == nil || !strings.Contains(result.host, ":")):
+		return fail("%q is not an IPv6 address", result.host)
+	case result.zone != "" && (result.ip == nil || result.ip.To4() != nil):
+		return fail("zone is only allowed in IPv6 addresses")
+	case result.ip == nil && !validHostName(result.host):
+		return fail("invalid host name %q", result.host)
+	}
+
+	if port == "" {
+		return fail("missing port")
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		if n < 0 || n > 65535 {
+			return fail("port %d is out of range", n)
+		}
+		result.port = n
+	} else if n, err := net.LookupPort("tcp", port); err == nil {
+		result.port = n
+	} else {
+		return fail("unknown port %q", port)
+	}
+	return result, nil
+}
+
+// validHostName tells whether a given string could be a host name. Empty
+// host stands for all local addresses.
+func validHostName(host string) bool {
+	for _, c := range host {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// String returns address in a form understood by net.Dial and net.Listen
+func (a address) String() string {
+	host := a.host
+	if a.zone != "" {
+		host += "%" + a.zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.port))
+}
+
+// validateAddresses checks listening and destination addresses of a tunnel
+func validateAddresses(listenAt ListenAt, connectTo ConnectTo) error {
+	if isPortRange(string(listenAt)) {
+		return validatePortRanges(listenAt, connectTo)
+	}
+	if _, err := parseAddress(string(listenAt), ""); err != nil {
+		return err
+	}
+	_, err := parseAddress(string(connectTo), "")
+	return err
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := []struct {
+		spec        string
+		defaultPort string
+		// Normalized address or a part of error message
+		expected string
+	}{
+		{"127.0.0.1:80", "", "127.0.0.1:80"},
+		{":8080", "", ":8080"},
+		{"backend:http", "", "backend:80"},
+		{"[::1]:80", "", "[::1]:80"},
+		{"[fe80::1%eth0]:80", "", "[fe80::1%eth0]:80"},
+		{"[::1]", "53", "[::1]:53"},
+		{"::1", "53", "[::1]:53"},
+		{"fe80::1%eth0", "53", "[fe80::1%eth0]:53"},
+		{"resolver", "53", "resolver:53"},
+		{"", "", "address is empty"},
+		{"::1:80", "", "must be enclosed in brackets"},
+		{"[::1:80", "", "missing closing bracket"},
+		{"[::1]80", "", "after closing bracket"},
+		{"[::1]", "", "missing port"},
+		{"[::1]:", "53", "missing port"},
+		{"[127.0.0.1]:80", "", "not an IPv6 address"},
+		{"[fe80::1%]:80", "", "zone is empty"},
+		{"10.0.0.1%eth0:80", "", "zone is only allowed in IPv6"},
+		{"back end:80", "", "invalid host name"},
+		{"backend:65536", "", "out of range"},
+		{"backend:nosuchservice", "", "unknown port"},
+	}
+	for _, c := range cases {
+		addr, err := parseAddress(c.spec, c.defaultPort)
+		if err != nil {
+			if _, ok := err.(*AddressError); !ok || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("%q: expected %q, got error %v", c.spec, c.expected, err)
+			}
+			continue
+		}
+		if addr.String() != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.spec, c.expected, addr.String())
+		}
+	}
+}
@@ -0,0 +1,1137 @@
+package app
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// adminServer serves HTTP API to inspect and manage tunnels at runtime.
+//
+// Callers authenticate with tokens passed as "Authorization: Bearer <token>"
+// header. Operator tokens grant access to everything. Tunnels are partitioned
+// into tenant namespaces and a tenant token only grants access to tunnels of
+// that tenant. If no operator tokens are configured, requests without a token
+// coming from loopback addresses are served with operator privileges.
+//
+// Each caller (operator or tenant) is only allowed to make a limited number of
+// requests per second. Requests changing runtime state and requests that were
+// refused are recorded to audit log.
+type adminServer struct {
+	manager *TunnelManager
+	audit   *log.Logger
+	// Requests to a local server (e.g. over a unix socket) are served with
+	// operator privileges without a token
+	local bool
+
+	limitersMu *sync.Mutex
+	limiters   map[caller]*rate.Limiter
+	// Failed authentication attempts by remote IP address, guarded by
+	// limitersMu
+	failures map[string]*authFailures
+}
+
+// authFailures tracks failed authentication attempts of a remote address
+type authFailures struct {
+	limiter *rate.Limiter
+	// Requests from the address are refused without checking their tokens
+	// until then
+	blockedUntil time.Time
+	last         time.Time
+}
+
+// maxAuthFailureAddresses is the number of remote addresses failed
+// authentication attempts are tracked for before the ones that have been
+// quiet long enough are forgotten
+const maxAuthFailureAddresses = 4096
+
+// maxAdminRequestBody is the maximum size of admin API request body
+const maxAdminRequestBody = 64 * 1024
+
+func newAdminServer(manager *TunnelManager, audit *log.Logger) *adminServer {
+	return &adminServer{
+		manager: manager,
+		audit:   audit,
+
+		limitersMu: new(sync.Mutex),
+		limiters:   make(map[caller]*rate.Limiter),
+		failures:   make(map[string]*authFailures),
+	}
+}
+
+// AdminOptions are the parameters admin API is served with
+type AdminOptions struct {
+	// Address to serve admin API at. Empty value disables admin API.
+	Address string
+	// Paths to PEM encoded certificate and private key. If set, admin API is
+	// served over TLS.
+	CertFile string
+	KeyFile  string
+	// Path to PEM encoded CA certificates. If set, clients are required to
+	// present a certificate signed by one of them (mutual TLS).
+	ClientCAFile string
+	// Path to a file to append audit log records to. If empty, audit log
+	// records are written to the standard logger.
+	AuditLogPath string
+}
+
+// caller identifies on whose behalf an admin API request is made
+type caller struct {
+	// Name of a tenant or empty string for the operator
+	tenant string
+}
+
+func (c caller) isOperator() bool {
+	return c.tenant == ""
+}
+
+// checkSpec returns an error if a tunnel spec asks for something only
+// operator is allowed to (nil for operator)
+func (c caller) checkSpec(spec TunnelSpec) error {
+	if c.isOperator() {
+		return nil
+	}
+	if spec.RecordDir != "" {
+		return errRecordingForbidden
+	}
+	for _, hop := range spec.Via {
+		if hop.KeyFile != "" {
+			return errKeyFileForbidden
+		}
+	}
+	return nil
+}
+
+// pinLimits keeps worker pool and identity group of limits a caller sets to a
+// tunnel the ones it has (current). Tenants leave them empty to keep them and
+// aren't allowed to change them, operator could set anything.
+func (c caller) pinLimits(limits *TunnelLimits, current TunnelLimits) error {
+	if c.isOperator() {
+		return nil
+	}
+	if limits.WorkerPool == "" {
+		limits.WorkerPool = current.WorkerPool
+	}
+	if limits.IdentityGroup == "" {
+		limits.IdentityGroup = current.IdentityGroup
+	}
+	if limits.WorkerPool != current.WorkerPool ||
+		limits.IdentityGroup != current.IdentityGroup {
+		return errSharingForbidden
+	}
+	return nil
+}
+
+// canAccess returns true if caller is allowed to see and manage resources of
+// a given tenant
+func (c caller) canAccess(tenant string) bool {
+	return c.isOperator() || c.tenant == tenant
+}
+
+// startAdminServer starts serving admin API until graceful shutdown is
+// requested.
+func startAdminServer(opts AdminOptions, manager *TunnelManager, gs *gracefulShutdown) error {
+	address := opts.Address
+	tlsConfig, err := adminTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	} else if !isLoopback(l.Addr()) {
+		log.Printf("Warning: admin API at %q is exposed beyond localhost without TLS, "+
+			"tokens are sent in plain text", address)
+	}
+
+	audit := log.New(os.Stderr, "Admin API audit: ", log.LstdFlags)
+	var auditFile *os.File
+	if opts.AuditLogPath != "" {
+		auditFile, err = os.OpenFile(opts.AuditLogPath,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		audit = log.New(auditFile, "", log.LstdFlags)
+	}
+
+	server := &http.Server{
+		Handler: newAdminServer(manager, audit),
+	}
+
+	gs.waitGroup.Add(1)
+	go func() {
+		defer gs.waitGroup.Done()
+		log.Printf("Serving admin API at %q", address)
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin API server at %q failed: %v", address, err)
+		}
+		if auditFile != nil {
+			auditFile.Close()
+		}
+	}()
+
+	go func() {
+		<-gs.quit
+		server.Close()
+	}()
+
+	return nil
+}
+
+// statusRecorder remembers status code of a response for audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends buffered data to the client. Required for streaming responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = recorder
+
+	// Request body is read in advance so that we could put it into audit log
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminRequestBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "Request body is too large")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	admin, tenantTokens := s.manager.credentials()
+	c, ok := caller{}, true
+	defer func() {
+		s.auditRequest(r, c, ok, body, recorder.status)
+	}()
+	if !s.local {
+		address := addrIP(r.RemoteAddr).String()
+		if s.blocked(address) {
+			ok = false
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "Too many failed attempts")
+			return
+		}
+		c, ok = authenticate(r, admin.Tokens, tenantTokens)
+		if !ok {
+			s.authFailed(address, admin)
+			writeError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+	}
+	if !s.allow(c, admin) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+	s.route(w, r, c)
+}
+
+func (s *adminServer) route(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.URL.Path == "/metrics" {
+		s.handleMetrics(w, r, c)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == r.URL.Path {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch {
+	case path == "tunnels":
+		s.handleTunnels(w, r, c)
+	case strings.HasPrefix(path, "tunnels/") && strings.Contains(path, "/connections/") &&
+		strings.HasSuffix(path, "/boost"):
+		spec := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/boost")
+		i := strings.LastIndex(spec, "/connections/")
+		s.handleConnectionBoost(w, r, c, ListenAt(spec[:i]),
+			spec[i+len("/connections/"):])
+	case strings.HasPrefix(path, "tunnels/") && strings.Contains(path, "/connections/") &&
+		strings.HasSuffix(path, "/limit"):
+		spec := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/limit")
+		i := strings.LastIndex(spec, "/connections/")
+		s.handleConnectionLimit(w, r, c, ListenAt(spec[:i]),
+			spec[i+len("/connections/"):])
+	case strings.HasPrefix(path, "tunnels/") && strings.Contains(path, "/connections/"):
+		spec := strings.TrimPrefix(path, "tunnels/")
+		i := strings.LastIndex(spec, "/connections/")
+		s.handleConnection(w, r, c, ListenAt(spec[:i]), spec[i+len("/connections/"):])
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/connections"):
+		listenAt := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/connections")
+		s.handleConnections(w, r, c, ListenAt(listenAt))
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/profile"):
+		listenAt := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/profile")
+		s.handleTunnelProfile(w, r, c, ListenAt(listenAt))
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/draining"):
+		listenAt := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/draining")
+		s.handleTunnelDraining(w, r, c, ListenAt(listenAt))
+	case strings.HasPrefix(path, "tunnels/") && strings.HasSuffix(path, "/limits"):
+		listenAt := strings.TrimSuffix(strings.TrimPrefix(path, "tunnels/"), "/limits")
+		s.handleTunnelLimits(w, r, c, ListenAt(listenAt))
+	case strings.HasPrefix(path, "tunnels/"):
+		s.handleTunnel(w, r, c, ListenAt(strings.TrimPrefix(path, "tunnels/")))
+	case path == "profiles":
+		s.handleProfiles(w, r, c)
+	case strings.HasPrefix(path, "profiles/"):
+		s.handleProfile(w, r, c, strings.TrimPrefix(path, "profiles/"))
+	case path == "events":
+		s.handleEvents(w, r, c)
+	case path == "limit":
+		s.handleGlobalLimit(w, r, c)
+	case path == "workerPools":
+		s.handleWorkerPools(w, r, c)
+	case path == "osLimits":
+		s.handleOSLimits(w, r, c)
+	case path == "tenants":
+		s.handleTenants(w, r, c)
+	case strings.HasPrefix(path, "tenants/") && strings.HasSuffix(path, "/limit"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "tenants/"), "/limit")
+		s.handleTenantLimit(w, r, c, name)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// adminTLSConfig builds TLS configuration according to options. Returns nil if
+// TLS is not enabled.
+func adminTLSConfig(opts AdminOptions) (*tls.Config, error) {
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		if opts.ClientCAFile != "" {
+			return nil, fmt.Errorf("Client certificate verification requires TLS " +
+				"certificate and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	result := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if opts.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %q", opts.ClientCAFile)
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return result, nil
+}
+
+// authenticate figures out who makes a request given operator tokens and a
+// map of tenant tokens to tenant names. Returns false if request doesn't carry
+// a valid token and is not allowed to proceed without one.
+func authenticate(r *http.Request, operatorTokens []string,
+	tenantTokens map[string]string) (caller, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		// Without operator tokens configured, we trust local requests
+		if len(operatorTokens) == 0 && isLoopbackRequest(r) {
+			return caller{}, true
+		}
+		return caller{}, false
+	}
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return caller{}, false
+	}
+	token := strings.TrimPrefix(header, prefix)
+
+	for _, t := range operatorTokens {
+		if constantTimeEqual(t, token) {
+			return caller{}, true
+		}
+	}
+	for t, tenant := range tenantTokens {
+		if constantTimeEqual(t, token) {
+			return caller{tenant: tenant}, true
+		}
+	}
+	return caller{}, false
+}
+
+// requestRate returns request rate limit and burst admin API callers are
+// allowed
+func (a AdminConfigJSON) requestRate() (rate.Limit, int) {
+	limit := rate.Limit(a.RequestRate)
+	if limit == 0 {
+		limit = DefaultAdminRequestRate
+	}
+	burst := a.RequestBurst
+	if burst == 0 {
+		burst = DefaultAdminRequestBurst
+	}
+	return limit, burst
+}
+
+// allow returns true if caller haven't exceeded its request rate limit
+func (s *adminServer) allow(c caller, admin AdminConfigJSON) bool {
+	limit, burst := admin.requestRate()
+
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	l, ok := s.limiters[c]
+	if !ok || l.Limit() != limit || l.Burst() != burst {
+		l = rate.NewLimiter(limit, burst)
+		s.limiters[c] = l
+	}
+	return l.Allow()
+}
+
+// blocked tells whether requests from a remote address are refused for
+// failing authentication too often
+func (s *adminServer) blocked(address string) bool {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	f, ok := s.failures[address]
+	return ok && time.Now().Before(f.blockedUntil)
+}
+
+// authFailed counts a failed authentication attempt from a remote address
+// against request rate limit. Once an address exceeds it, its requests are
+// refused until it's back within the rate.
+func (s *adminServer) authFailed(address string, admin AdminConfigJSON) {
+	limit, burst := admin.requestRate()
+	now := time.Now()
+
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	if len(s.failures) >= maxAuthFailureAddresses {
+		// Addresses whose limiters have refilled are as good as new
+		refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+		for k, f := range s.failures {
+			if now.Sub(f.last) > refill {
+				delete(s.failures, k)
+			}
+		}
+	}
+	f, ok := s.failures[address]
+	if !ok || f.limiter.Limit() != limit || f.limiter.Burst() != burst {
+		f = &authFailures{limiter: rate.NewLimiter(limit, burst)}
+		s.failures[address] = f
+	}
+	f.last = now
+	if delay := f.limiter.ReserveN(now, 1).DelayFrom(now); delay > 0 {
+		f.blockedUntil = now.Add(delay)
+	}
+}
+
+// auditRequest records a request to audit log if it changes runtime state or
+// was refused.
+func (s *adminServer) auditRequest(r *http.Request, c caller, authenticated bool,
+	body []byte, status int) {
+	if r.Method == http.MethodGet && status < http.StatusBadRequest {
+		return
+	}
+
+	who := "operator"
+	if !authenticated {
+		who = "unauthenticated caller"
+	} else if !c.isOperator() {
+		who = fmt.Sprintf("tenant %q", c.tenant)
+	}
+
+	compact := new(bytes.Buffer)
+	if json.Compact(compact, body) != nil {
+		compact.Reset()
+		fmt.Fprintf(compact, "%q", body)
+	}
+
+	s.audit.Printf("%s from %s: %s %s %s -> %d", who, r.RemoteAddr, r.Method,
+		r.URL.Path, compact, status)
+}
+
+func isLoopbackRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+func (s *adminServer) handleTunnels(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method == http.MethodPut {
+		s.handleApply(w, r, c)
+		return
+	}
+	if r.Method == http.MethodPost {
+		s.handleCreateTunnel(w, r, c)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	result := make([]TunnelInfo, 0)
+	for _, t := range s.manager.ListTunnels() {
+		if c.canAccess(t.Tenant) {
+			result = append(result, t)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleApply makes tunnels visible to the caller match the ones in request
+func (s *adminServer) handleApply(w http.ResponseWriter, r *http.Request, c caller) {
+	var desired []TunnelSpec
+	if err := unmarshalStrictReader(r, &desired); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for i := range desired {
+		if err := c.checkSpec(desired[i]); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		if err := s.pinSpec(c, &desired[i]); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	var report ChangeReport
+	var err error
+	if c.isOperator() {
+		report, err = s.manager.Apply(desired)
+	} else {
+		report, err = s.manager.ApplyTenant(c.tenant, desired)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleCreateTunnel starts a tunnel outside of configuration, which lasts
+// until deleted
+func (s *adminServer) handleCreateTunnel(w http.ResponseWriter, r *http.Request, c caller) {
+	var spec TunnelSpec
+	if err := unmarshalStrictReader(r, &spec); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.checkSpec(spec); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := s.pinSpec(c, &spec); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if !c.isOperator() {
+		if spec.Tenant != "" && spec.Tenant != c.tenant {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf(
+				"Tunnel %q can't be assigned to another tenant", spec.ListenAt))
+			return
+		}
+		spec.Tenant = c.tenant
+	}
+	info, err := s.manager.CreateTunnel(spec)
+	if err != nil {
+		status := http.StatusBadRequest
+		if _, ok := err.(*ListenConflictError); ok {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *adminServer) handleTunnel(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	t, ok := s.findTunnel(c, listenAt)
+	if !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, t)
+		return
+	}
+	if err := s.manager.DeleteTunnel(listenAt); err == errTunnelConfigured {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleTunnelLimits(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	t, ok := s.findTunnel(c, listenAt)
+	if !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	var limits TunnelLimits
+	if err := unmarshalStrictReader(r, &limits); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := c.pinLimits(&limits, t.Limits); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := s.manager.UpdateTunnelLimits(listenAt, limits); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleConnections(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut &&
+		r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if _, ok := s.findTunnel(c, listenAt); !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	expression := r.URL.Query().Get("filter")
+	filter, err := ParseConnectionFilter(expression)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		all, err := s.manager.ListConnections(listenAt)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		result := make([]ConnectionInfo, 0, len(all))
+		for _, conn := range all {
+			if filter.Match(conn) {
+				result = append(result, conn)
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	// Acting on all connections by mistake is too easy without this
+	if expression == "" {
+		writeError(w, http.StatusBadRequest, "Filter is required to act on connections in bulk")
+		return
+	}
+	var ids []uint64
+	if r.Method == http.MethodPut {
+		var body struct {
+			Limit *Limit `json:"limit"`
+		}
+		if err := unmarshalStrictReader(r, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ids, err = s.manager.UpdateConnectionLimits(listenAt, filter, body.Limit)
+	} else {
+		ids, err = s.manager.CloseConnections(listenAt, filter)
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Connections []uint64 `json:"connections"`
+	}{ids})
+}
+
+func (s *adminServer) handleConnection(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt, connection string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(connection, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errConnectionNotFound.Error())
+		return
+	}
+	if _, ok := s.findTunnel(c, listenAt); !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	if err := s.manager.CloseConnection(listenAt, id); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleTunnelDraining(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if _, ok := s.findTunnel(c, listenAt); !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	var body struct {
+		Draining bool `json:"draining"`
+	}
+	if err := unmarshalStrictReader(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.manager.SetTunnelDraining(listenAt, body.Draining); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleTunnelProfile(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	t, ok := s.findTunnel(c, listenAt)
+	if !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	var body struct {
+		Profile string `json:"profile"`
+	}
+	if err := unmarshalStrictReader(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.pinProfile(c, body.Profile, t.Limits); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := s.manager.ApplyProfile(listenAt, body.Profile); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleProfiles(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	result := s.manager.ListProfiles()
+	if result == nil {
+		result = make([]ProfileInfo, 0)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *adminServer) handleProfile(w http.ResponseWriter, r *http.Request, c caller,
+	name string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// Profiles are shared by all tenants
+	if !c.isOperator() {
+		writeError(w, http.StatusForbidden, "Only operator is allowed to change profiles")
+		return
+	}
+	var limits TunnelLimits
+	if err := unmarshalStrictReader(r, &limits); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.manager.PutProfile(name, limits); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleConnectionLimit(w http.ResponseWriter, r *http.Request, c caller,
+	listenAt ListenAt, connection string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(connection, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errConnectionNotFound.Error())
+		return
+	}
+	if _, ok := s.findTunnel(c, listenAt); !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	var body struct {
+		Limit *Limit `json:"limit"`
+	}
+	if err := unmarshalStrictReader(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.manager.UpdateConnectionLimit(listenAt, id, body.Limit); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleConnectionBoost(w http.ResponseWriter, r *http.Request,
+	c caller, listenAt ListenAt, connection string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(connection, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errConnectionNotFound.Error())
+		return
+	}
+	if _, ok := s.findTunnel(c, listenAt); !ok {
+		writeError(w, http.StatusNotFound, errTunnelNotFound.Error())
+		return
+	}
+	var body struct {
+		Limit    Limit    `json:"limit"`
+		Duration Duration `json:"duration"`
+	}
+	if err := unmarshalStrictReader(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = s.manager.BoostConnection(listenAt, id, body.Limit, time.Duration(body.Duration))
+	if ErrorKind(err) == ErrLimitInvalid {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleTenants(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	result := make([]TenantInfo, 0)
+	for _, t := range s.manager.ListTenants() {
+		if c.canAccess(t.Name) {
+			result = append(result, t)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *adminServer) handleTenantLimit(w http.ResponseWriter, r *http.Request, c caller,
+	name string) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// Tenants are not allowed to raise their own aggregate limits
+	if !c.isOperator() {
+		writeError(w, http.StatusForbidden, "Only operator is allowed to change tenant limits")
+		return
+	}
+	var body struct {
+		Limit Limit `json:"limit"`
+	}
+	if err := unmarshalStrictReader(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.manager.UpdateTenantLimit(name, body.Limit); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGlobalLimit shows or changes bandwidth limit of all tunnels together
+func (s *adminServer) handleGlobalLimit(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !c.isOperator() {
+		writeError(w, http.StatusForbidden, "Only operator is allowed to access global limit")
+		return
+	}
+	var body struct {
+		Limit Limit `json:"limit"`
+	}
+	if r.Method == http.MethodGet {
+		body.Limit = s.manager.GlobalLimit()
+		writeJSON(w, http.StatusOK, body)
+		return
+	}
+	if err := unmarshalStrictReader(r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.manager.UpdateGlobalLimit(body.Limit); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWorkerPools lists worker pools
+func (s *adminServer) handleWorkerPools(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !c.isOperator() {
+		writeError(w, http.StatusForbidden, "Only operator is allowed to access worker pools")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.manager.WorkerPools())
+}
+
+// handleOSLimits reports limits of the operating system and how tunnels fit
+// into them
+func (s *adminServer) handleOSLimits(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !c.isOperator() {
+		writeError(w, http.StatusForbidden, "Only operator is allowed to access OS limits")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.manager.OSLimits())
+}
+
+// eventStreamKeepAlive is how often a comment is sent to an idle event stream
+// to keep intermediate proxies from closing it
+const eventStreamKeepAlive = 30 * time.Second
+
+// handleEvents streams tunnel and connection events visible to the caller as
+// server-sent events. Stream resumes after an event given by "cursor" query
+// parameter or "Last-Event-ID" header. Without either, only new events are
+// streamed.
+func (s *adminServer) handleEvents(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+	var after uint64
+	if cursor != "" {
+		var err error
+		if after, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid cursor %q", cursor))
+			return
+		}
+	}
+
+	sub, err := s.manager.Subscribe(after)
+	if err != nil {
+		writeError(w, http.StatusGone, err.Error())
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				if err := sub.Err(); err != nil {
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", mustMarshal(struct {
+						Error string `json:"error"`
+					}{
+						Error: err.Error(),
+					}))
+					flusher.Flush()
+				}
+				return
+			}
+			if !c.canAccess(e.Tenant) {
+				continue
+			}
+			_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Cursor, e.Type,
+				mustMarshal(e))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// mustMarshal encodes a value that is known to be serializable to JSON
+func mustMarshal(v interface{}) []byte {
+	result, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// findTunnel looks for a tunnel visible to a given caller
+func (s *adminServer) findTunnel(c caller, listenAt ListenAt) (TunnelInfo, bool) {
+	for _, t := range s.manager.ListTunnels() {
+		if t.ListenAt == listenAt && c.canAccess(t.Tenant) {
+			return t, true
+		}
+	}
+	return TunnelInfo{}, false
+}
+
+// pinSpec keeps worker pool and identity group of a tunnel a caller applies
+// (see pinLimits) in its limits, profile and schedule
+func (s *adminServer) pinSpec(c caller, spec *TunnelSpec) error {
+	if c.isOperator() {
+		return nil
+	}
+	var current TunnelLimits
+	if t, ok := s.findTunnel(c, spec.ListenAt); ok {
+		current = t.Limits
+	}
+	if spec.Profile != "" {
+		if err := s.pinProfile(c, spec.Profile, current); err != nil {
+			return err
+		}
+	} else if err := c.pinLimits(&spec.Limits, current); err != nil {
+		return err
+	}
+	for i := range spec.Schedule {
+		if err := c.pinLimits(&spec.Schedule[i].Limits, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinProfile checks that a profile a caller applies to a tunnel keeps its
+// worker pool and identity group (current limits). Unknown profiles are left
+// for the manager to reject.
+func (s *adminServer) pinProfile(c caller, name string, current TunnelLimits) error {
+	if c.isOperator() {
+		return nil
+	}
+	for _, p := range s.manager.ListProfiles() {
+		if p.Name == name && (p.Limits.WorkerPool != current.WorkerPool ||
+			p.Limits.IdentityGroup != current.IdentityGroup) {
+			return errSharingForbidden
+		}
+	}
+	return nil
+}
+
+func unmarshalStrictReader(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{
+		Error: message,
+	})
+}
+
+// constantTimeEqual compares secrets without leaking their contents through
+// timing.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
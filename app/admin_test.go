@@ -0,0 +1,370 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdminTenantIsolation(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.start()
+	configUpdate <- ConfigurationJSON{
+		Tenants: map[string]TenantConfigJSON{
+			"a": {Token: "ta", Limit: 1000},
+			"b": {Token: "tb"},
+		},
+		Tunnels: map[ListenAt]TunnelConfigJSON{
+			"127.0.0.1:0": {ConnectTo: "127.0.0.1:1", Tenant: "a"},
+			"localhost:0": {ConnectTo: "127.0.0.1:1", Tenant: "b"},
+		},
+	}
+
+	audit := log.New(ioutil.Discard, "", 0)
+	server := httptest.NewServer(newAdminServer(manager, audit))
+	defer server.Close()
+
+	request := func(method, path, token, body string) int {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cases := []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{"GET", "/v1/tunnels/127.0.0.1:0", "", "", http.StatusOK},
+		{"GET", "/v1/tunnels/127.0.0.1:0", "ta", "", http.StatusOK},
+		{"GET", "/v1/tunnels/127.0.0.1:0", "tb", "", http.StatusNotFound},
+		{"GET", "/v1/tunnels", "bad", "", http.StatusUnauthorized},
+		{"PUT", "/v1/tunnels/localhost:0/limits", "ta", `{"tunnelLimit": 1}`, http.StatusNotFound},
+		{"PUT", "/v1/tunnels/localhost:0/limits", "tb", `{"tunnelLimit": 1}`, http.StatusNoContent},
+		{"POST", "/v1/tunnels", "tb", `{"listenAt": "localhost:0", "connectTo": "127.0.0.1:1", "recordDir": "/tmp"}`, http.StatusForbidden},
+		{"POST", "/v1/tunnels", "tb", `{"listenAt": "localhost:0", "connectTo": "127.0.0.1:1", "via": [{"type": "ssh", "address": "127.0.0.1:22", "keyFile": "/root/.ssh/id_ed25519"}]}`, http.StatusForbidden},
+		{"PUT", "/v1/tunnels", "tb", `[{"listenAt": "localhost:0", "connectTo": "127.0.0.1:1", "via": [{"type": "ssh", "address": "127.0.0.1:22", "keyFile": "/root/.ssh/id_ed25519"}]}]`, http.StatusForbidden},
+		{"PUT", "/v1/tunnels/localhost:0/draining", "ta", `{"draining": true}`, http.StatusNotFound},
+		{"PUT", "/v1/tunnels/localhost:0/draining", "tb", `{"draining": true}`, http.StatusNoContent},
+		{"DELETE", "/v1/tunnels/localhost:0/connections/1", "tb", "", http.StatusNotFound},
+		{"DELETE", "/v1/tunnels/localhost:0/connections", "tb", "", http.StatusBadRequest},
+		{"DELETE", "/v1/tunnels/localhost:0/connections?filter=age%3E1m", "tb", "", http.StatusOK},
+		{"GET", "/v1/tunnels/localhost:0/connections?filter=color%3Dred", "tb", "", http.StatusBadRequest},
+		{"PUT", "/v1/tenants/a/limit", "ta", `{"limit": "1Mbps"}`, http.StatusForbidden},
+		{"PUT", "/v1/tenants/a/limit", "", `{"limit": "1Mbps"}`, http.StatusNoContent},
+		{"GET", "/v1/limit", "ta", "", http.StatusForbidden},
+		{"PUT", "/v1/limit", "ta", `{"limit": "10Mbps"}`, http.StatusForbidden},
+		{"PUT", "/v1/limit", "", `{"limit": "10Mbps"}`, http.StatusNoContent},
+		{"GET", "/v1/limit", "", "", http.StatusOK},
+		{"GET", "/v1/workerPools", "ta", "", http.StatusForbidden},
+		{"GET", "/v1/workerPools", "", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		if status := request(c.method, c.path, c.token, c.body); status != c.status {
+			t.Errorf("%s %s with token %q: expected %d, got %d", c.method, c.path,
+				c.token, c.status, status)
+		}
+	}
+
+	if limit := manager.GlobalLimit(); limit != Limit(1250000) {
+		t.Errorf("Global limit was not updated: %v", limit)
+	}
+
+	// Once operator tokens are configured, local requests without a token are
+	// no longer trusted
+	configUpdate <- ConfigurationJSON{
+		Admin: AdminConfigJSON{
+			Tokens:       []string{"op"},
+			RequestRate:  0.001,
+			RequestBurst: 3,
+		},
+		Tenants: map[string]TenantConfigJSON{
+			"a": {Token: "ta", Limit: 125000},
+		},
+	}
+	cases = []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{"GET", "/v1/tenants", "", "", http.StatusUnauthorized},
+		{"GET", "/v1/tenants", "op", "", http.StatusOK},
+		{"GET", "/v1/tenants", "ta", "", http.StatusOK},
+		{"GET", "/v1/tenants", "op", "", http.StatusOK},
+		{"GET", "/v1/tenants", "op", "", http.StatusOK},
+		// Operator has exhausted its burst, while tenant still has some requests
+		// left
+		{"GET", "/v1/tenants", "op", "", http.StatusTooManyRequests},
+		{"GET", "/v1/tenants", "ta", "", http.StatusOK},
+		// Failed attempts of an address count against the same rate, once it's
+		// exceeded even valid tokens from the address are refused
+		{"GET", "/v1/tenants", "bad", "", http.StatusUnauthorized},
+		{"GET", "/v1/tenants", "bad", "", http.StatusUnauthorized},
+		{"GET", "/v1/tenants", "bad", "", http.StatusUnauthorized},
+		{"GET", "/v1/tenants", "ta", "", http.StatusTooManyRequests},
+	}
+	for _, c := range cases {
+		if status := request(c.method, c.path, c.token, c.body); status != c.status {
+			t.Errorf("%s %s with token %q: expected %d, got %d", c.method, c.path,
+				c.token, c.status, status)
+		}
+	}
+
+	for _, tenant := range manager.ListTenants() {
+		if tenant.Name == "a" && tenant.Limit != Limit(125000) {
+			t.Errorf("Tenant limit was not updated: %v", tenant)
+		}
+	}
+}
+
+func TestAdminTenantSharing(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.start()
+	assigned := TunnelLimits{WorkerPool: "b", IdentityGroup: "clients"}
+	configUpdate <- ConfigurationJSON{
+		Tenants:        map[string]TenantConfigJSON{"b": {Token: "tb"}},
+		WorkerPools:    map[string]WorkerPoolConfigJSON{"a": {}, "b": {}},
+		IdentityGroups: map[string]IdentityGroupConfigJSON{"clients": {By: IdentityIP, Limit: 1000}},
+		Profiles:       map[string]TunnelLimits{"plain": {TunnelLimit: 1000}},
+		Tunnels: map[ListenAt]TunnelConfigJSON{
+			"localhost:0": {ConnectTo: "127.0.0.1:1", Tenant: "b", TunnelLimits: assigned},
+		},
+	}
+
+	audit := log.New(ioutil.Discard, "", 0)
+	server := httptest.NewServer(newAdminServer(manager, audit))
+	defer server.Close()
+
+	// Tenants could neither leave worker pool and identity group operator
+	// assigned to their tunnels nor use another team's ones
+	cases := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/v1/tunnels/localhost:0/limits", `{"tunnelLimit": 1}`, http.StatusNoContent},
+		{"PUT", "/v1/tunnels/localhost:0/limits", `{"workerPool": "a"}`, http.StatusForbidden},
+		{"PUT", "/v1/tunnels/localhost:0/limits", `{"identityGroup": "other"}`, http.StatusForbidden},
+		{"PUT", "/v1/tunnels/localhost:0/profile", `{"profile": "plain"}`, http.StatusForbidden},
+		{"PUT", "/v1/tunnels", `[{"listenAt": "localhost:0", "connectTo": "127.0.0.1:1", "schedule": [{"from": "00:00", "to": "00:00", "limits": {"workerPool": "a"}}]}]`, http.StatusForbidden},
+		{"POST", "/v1/tunnels", `{"listenAt": "127.0.0.1:0", "connectTo": "127.0.0.1:1", "limits": {"workerPool": "b"}}`, http.StatusForbidden},
+		{"PUT", "/v1/tunnels", `[{"listenAt": "localhost:0", "connectTo": "127.0.0.1:1"}]`, http.StatusOK},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, server.URL+c.path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer tb")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s %s: expected %d, got %d", c.method, c.path, c.body, c.status,
+				resp.StatusCode)
+		}
+	}
+	for _, info := range manager.ListTunnels() {
+		if info.Limits.WorkerPool != assigned.WorkerPool ||
+			info.Limits.IdentityGroup != assigned.IdentityGroup {
+			t.Errorf("Expected tunnel to keep its worker pool and identity group, got %v",
+				info.Limits)
+		}
+	}
+}
+
+// issueCertificate creates a certificate signed by a parent (self-signed if
+// parent is nil) and writes it along with its key to PEM files in a directory
+func issueCertificate(t *testing.T, dir, name string, template *x509.Certificate,
+	parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey,
+		signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	result, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	result.Leaf, _ = x509.ParseCertificate(der)
+	return result
+}
+
+func TestAdminTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := issueCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	issueCertificate(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := issueCertificate(t, dir, "client", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	stranger := issueCertificate(t, dir, "stranger", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	if _, err := adminTLSConfig(AdminOptions{
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}); err == nil {
+		t.Errorf("Expected client CA without server certificate to be rejected")
+	}
+	config, err := adminTLSConfig(AdminOptions{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to configure TLS: %v", err)
+	}
+
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.start()
+	configUpdate <- ConfigurationJSON{
+		Admin: AdminConfigJSON{Tokens: []string{"op"}},
+	}
+
+	server := httptest.NewUnstartedServer(
+		newAdminServer(manager, log.New(ioutil.Discard, "", 0)))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	request := func(cert *tls.Certificate, token string) (int, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		httpClient := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		req, err := http.NewRequest("GET", server.URL+"/v1/tunnels", nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if _, err := request(nil, "op"); err == nil {
+		t.Errorf("Expected client without certificate to be rejected")
+	}
+	if _, err := request(&stranger, "op"); err == nil {
+		t.Errorf("Expected certificate of unknown CA to be rejected")
+	}
+	// Loopback clients aren't trusted without a token once tokens are
+	// configured, even with a valid certificate
+	if status, err := request(&client, ""); err != nil ||
+		status != http.StatusUnauthorized {
+		t.Errorf("Expected request without token to be unauthorized, got %d (%v)",
+			status, err)
+	}
+	if status, err := request(&client, "op"); err != nil || status != http.StatusOK {
+		t.Errorf("Expected operator request to succeed, got %d (%v)", status, err)
+	}
+}
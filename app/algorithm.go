@@ -0,0 +1,36 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+)
+
+// Limiting algorithms (see limiter.Algorithm)
+const (
+	// AlgorithmTokenBucket lets traffic through in bursts as long as it fits
+	// into limits on average
+	AlgorithmTokenBucket = string(limiter.TokenBucket)
+	// AlgorithmLeakyBucket paces traffic at a constant rate ignoring
+	// configured bursts
+	AlgorithmLeakyBucket = string(limiter.LeakyBucket)
+	// AlgorithmFairQueue splits tunnel limit equally among active connections
+	AlgorithmFairQueue = string(limiter.FairQueue)
+	// AlgorithmFairShare guarantees each active connection an equal share of
+	// tunnel limit and lets busy connections use what others leave unused
+	AlgorithmFairShare = string(limiter.FairShare)
+	// AlgorithmSlidingWindow lets traffic through in bursts, but caps what a
+	// connection transfers within any second to what its limits allow
+	AlgorithmSlidingWindow = string(limiter.SlidingWindow)
+)
+
+// validateAlgorithm checks limiting algorithm of limits for errors
+func (l TunnelLimits) validateAlgorithm() error {
+	switch l.Algorithm {
+	case AlgorithmTokenBucket, AlgorithmLeakyBucket, AlgorithmFairQueue,
+		AlgorithmFairShare, AlgorithmSlidingWindow:
+		return nil
+	default:
+		return fmt.Errorf("Unknown limiting algorithm %q", l.Algorithm)
+	}
+}
@@ -0,0 +1,32 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSwitchAlgorithm(t *testing.T) {
+	if _, err := NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{Algorithm: "random"},
+		TunnelOptions{}); ErrorKind(err) != ErrLimitInvalid {
+		t.Errorf("Expected unknown algorithm to be rejected, got %v", err)
+	}
+
+	upstream := startUppercaseUpstream(t)
+	defer upstream.Close()
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{})
+	defer tunnel.Shutdown()
+	defer client.Close()
+
+	tunnel.UpdateLimits(TunnelLimits{TunnelLimit: 100000, Algorithm: AlgorithmFairQueue})
+	tunnel.UpdateLimits(TunnelLimits{TunnelLimit: 100000, Algorithm: AlgorithmLeakyBucket})
+
+	// Connection survives switching
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := client.Read(buf); err != nil || string(buf) != "HELLO" {
+		t.Errorf("Expected connection to keep forwarding, got %q (%v)", buf, err)
+	}
+}
@@ -0,0 +1,464 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// TunnelSpec is a desired state of a tunnel
+type TunnelSpec struct {
+	ListenAt  ListenAt     `json:"listenAt"`
+	ConnectTo ConnectTo    `json:"connectTo"`
+	Limits    TunnelLimits `json:"limits"`
+	Tenant    string       `json:"tenant,omitempty"`
+	// Name of a profile to take limits from instead of Limits
+	Profile string `json:"profile,omitempty"`
+	TunnelSettings
+	Exemptions
+	UpstreamTLS *UpstreamTLS `json:"upstreamTLS,omitempty"`
+	// Hops upstream connections are made through
+	Via []Hop `json:"via,omitempty"`
+	// Rules switching limits by time of day
+	Schedule Schedule `json:"schedule,omitempty"`
+	// Classes splitting tunnel limit between connections
+	Classes LimitClasses `json:"classes,omitempty"`
+	// Rules deciding which connections reach upstream
+	Access AccessRules `json:"access,omitempty"`
+	// Rules telling priorities of connections
+	Priorities PriorityRules `json:"priorities,omitempty"`
+	// Aggregate limits of connections from subnets
+	Subnets SubnetLimits `json:"subnets,omitempty"`
+	// Aggregate limits of connections to backends connectTo resolves to
+	Backends BackendLimits `json:"backends,omitempty"`
+	// Windows tunnel accepts connections in (always if nil)
+	Active *ActiveWindows `json:"active,omitempty"`
+	// Name tunnel is registered as in service registries (not registered if
+	// empty)
+	Service string `json:"service,omitempty"`
+}
+
+// TunnelFailure describes a tunnel that could not be brought to its desired
+// state
+type TunnelFailure struct {
+	ListenAt ListenAt `json:"listenAt"`
+	Error    string   `json:"error"`
+}
+
+// ChangeReport describes changes made to running tunnels in order to match
+// desired state. Tunnels that had to be recreated because of changed
+// destination are reported as updated.
+type ChangeReport struct {
+	Created   []ListenAt      `json:"created"`
+	Updated   []ListenAt      `json:"updated"`
+	Deleted   []ListenAt      `json:"deleted"`
+	Unchanged []ListenAt      `json:"unchanged"`
+	Failed    []TunnelFailure `json:"failed"`
+}
+
+// Apply makes the set of running tunnels match a desired one: tunnels missing
+// from desired set are shut down, new ones are created and existing ones are
+// updated. Changes last until next configuration reload.
+//
+// Returns an error without changing anything if desired set is invalid.
+func (m *TunnelManager) Apply(desired []TunnelSpec) (ChangeReport, error) {
+	return m.apply(desired, func(string) bool { return true })
+}
+
+// ApplyTenant is like Apply, but only affects tunnels of a given tenant.
+// Desired tunnels are assigned to the tenant.
+func (m *TunnelManager) ApplyTenant(tenant string, desired []TunnelSpec) (ChangeReport, error) {
+	scoped := make([]TunnelSpec, len(desired))
+	for i, spec := range desired {
+		if spec.Tenant != "" && spec.Tenant != tenant {
+			return ChangeReport{}, fmt.Errorf("Tunnel %q can't be assigned to another tenant",
+				spec.ListenAt)
+		}
+		spec.Tenant = tenant
+		scoped[i] = spec
+	}
+	return m.apply(scoped, func(t string) bool { return t == tenant })
+}
+
+func (m *TunnelManager) apply(desired []TunnelSpec,
+	inScope func(tenant string) bool) (ChangeReport, error) {
+	var report ChangeReport
+	var err error
+	if !m.do(func() {
+		if err = m.validateSpecs(desired, inScope); err != nil {
+			return
+		}
+		report = m.reconcile(desired, inScope)
+	}) {
+		return ChangeReport{}, fmt.Errorf("Tunnel manager is shutting down")
+	}
+	if err == nil {
+		log.Printf("Applied desired tunnels: %v", report)
+	}
+	return report, err
+}
+
+// validateSpecs checks desired tunnels for errors. Must be called on the
+// manager goroutine.
+func (m *TunnelManager) validateSpecs(desired []TunnelSpec, inScope func(string) bool) error {
+	// Tunnels that keep running regardless of desired state
+	var outOfScope []ListenAt
+	for k, v := range m.tunnels {
+		if !inScope(v.tenant) || v.ephemeral {
+			outOfScope = append(outOfScope, k.listenAt)
+		}
+	}
+	sortListenAts(outOfScope)
+
+	seen := make(map[ListenAt]bool)
+	var listenAts []ListenAt
+	for _, spec := range desired {
+		if err := m.validateSpec(spec); err != nil {
+			return err
+		}
+		if seen[spec.ListenAt] {
+			return fmt.Errorf("Tunnel %q is specified more than once", spec.ListenAt)
+		}
+		seen[spec.ListenAt] = true
+		if _, t, ok := m.findTunnel(spec.ListenAt); ok && (!inScope(t.tenant) || t.ephemeral) {
+			return fmt.Errorf("Tunnel %q is already in use", spec.ListenAt)
+		}
+		for pattern, g := range m.onDemand {
+			if g.ports.conflicts(spec.ListenAt) {
+				return &ListenConflictError{ListenAt: spec.ListenAt, Other: pattern}
+			}
+		}
+		if err := listenConflict(spec.ListenAt, listenAts); err != nil {
+			return err
+		}
+		if err := listenConflict(spec.ListenAt, outOfScope); err != nil {
+			return err
+		}
+		listenAts = append(listenAts, spec.ListenAt)
+	}
+	return nil
+}
+
+// validateSpec checks an individual tunnel for errors. Must be called on the
+// manager goroutine.
+func (m *TunnelManager) validateSpec(spec TunnelSpec) error {
+	if spec.ListenAt == "" || spec.ConnectTo == "" {
+		return fmt.Errorf("Both listenAt and connectTo are required (%q, %q)",
+			spec.ListenAt, spec.ConnectTo)
+	}
+	if err := validateAddresses(spec.ListenAt, spec.ConnectTo); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Limits.validate(); err != nil {
+		return withContext(err, "Tunnel %q", spec.ListenAt)
+	}
+	if err := spec.Schedule.validate(); err != nil {
+		return withContext(err, "Tunnel %q", spec.ListenAt)
+	}
+	if err := spec.TunnelSettings.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Exemptions.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Classes.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Access.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Priorities.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Subnets.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Backends.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := spec.Active.validate(); err != nil {
+		return withContext(err, "Tunnel %q", spec.ListenAt)
+	}
+	if err := spec.UpstreamTLS.validate(spec.ConnectTo); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := validateHops(spec.Via); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if err := validateService(spec.Service); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", spec.ListenAt, err)
+	}
+	if _, ok := m.profiles[spec.Profile]; spec.Profile != "" && !ok {
+		return fmt.Errorf("Tunnel %q uses unknown profile %q", spec.ListenAt, spec.Profile)
+	}
+	if _, ok := m.tenants[spec.Tenant]; spec.Tenant != "" && !ok {
+		return fmt.Errorf("Tunnel %q belongs to unknown tenant %q", spec.ListenAt,
+			spec.Tenant)
+	}
+	return nil
+}
+
+// reconcile makes running tunnels for which inScope returns true match desired
+// ones. Must be called on the manager goroutine.
+func (m *TunnelManager) reconcile(desired []TunnelSpec,
+	inScope func(tenant string) bool) ChangeReport {
+	report := ChangeReport{
+		Created:   make([]ListenAt, 0),
+		Updated:   make([]ListenAt, 0),
+		Deleted:   make([]ListenAt, 0),
+		Unchanged: make([]ListenAt, 0),
+		Failed:    make([]TunnelFailure, 0),
+	}
+
+	desiredByListenAt := make(map[ListenAt]TunnelSpec)
+	for _, spec := range desired {
+		desiredByListenAt[spec.ListenAt] = spec
+	}
+
+	// Sweep existing tunnels to shutdown ones that are no longer desired or
+	// have to be recreated because of changed destination
+	recreated := make(map[ListenAt]bool)
+	for k, v := range m.tunnels {
+		// On-demand tunnels come and go along with their port ranges, ones
+		// made by CreateTunnel last until deleted
+		if !inScope(v.tenant) || v.onDemand != "" || v.ephemeral {
+			continue
+		}
+		spec, ok := desiredByListenAt[k.listenAt]
+		if ok && k.connectTo == spec.ConnectTo {
+			continue
+		}
+		m.stopTunnel(k, v)
+		if ok {
+			recreated[k.listenAt] = true
+		} else {
+			report.Deleted = append(report.Deleted, k.listenAt)
+		}
+	}
+
+	sorted := make([]TunnelSpec, len(desired))
+	copy(sorted, desired)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ListenAt < sorted[j].ListenAt
+	})
+
+	// Update or create desired tunnels
+	for _, spec := range sorted {
+		key := tunnelKey{
+			listenAt:  spec.ListenAt,
+			connectTo: spec.ConnectTo,
+		}
+		shared := m.sharedLimiters(spec.Tenant)
+		limits := m.resolveLimits(spec)
+		t, ok := m.tunnels[key]
+		if ok && t.ephemeral {
+			report.Failed = append(report.Failed, TunnelFailure{
+				ListenAt: spec.ListenAt,
+				Error:    fmt.Sprintf("Tunnel %q is already in use", spec.ListenAt),
+			})
+			continue
+		}
+		if ok {
+			changed := false
+			if t.lastLimits != limits || !t.schedule.equal(spec.Schedule) {
+				t.lastLimits = limits
+				t.schedule = spec.Schedule
+				m.applyLimits(t)
+				changed = true
+			}
+			if t.profile != spec.Profile {
+				t.profile = spec.Profile
+				changed = true
+			}
+			if !sameLimiters(t.lastShared, shared) {
+				t.tunnel.UpdateSharedLimiters(shared)
+				t.lastShared = shared
+				changed = true
+			}
+			if !t.exemptions.equal(spec.Exemptions) {
+				// Exemptions are validated beforehand
+				t.tunnel.UpdateExemptions(spec.Exemptions)
+				t.exemptions = spec.Exemptions
+				changed = true
+			}
+			if !t.classes.equal(spec.Classes) {
+				// Classes are validated beforehand
+				t.tunnel.UpdateClasses(spec.Classes)
+				t.classes = spec.Classes
+				changed = true
+			}
+			if t.settings != spec.TunnelSettings {
+				t.tunnel.UpdateSettings(spec.TunnelSettings)
+				t.settings = spec.TunnelSettings
+				changed = true
+			}
+			if !t.access.equal(spec.Access) {
+				// Access rules are validated beforehand
+				t.tunnel.UpdateAccess(spec.Access)
+				t.access = spec.Access
+				changed = true
+			}
+			if !t.priorities.equal(spec.Priorities) {
+				// Priority rules are validated beforehand
+				t.tunnel.UpdatePriorities(spec.Priorities)
+				t.priorities = spec.Priorities
+				changed = true
+			}
+			if !t.subnets.equal(spec.Subnets) {
+				// Subnet limits are validated beforehand
+				t.tunnel.UpdateSubnetLimits(spec.Subnets)
+				t.subnets = spec.Subnets
+				changed = true
+			}
+			if !t.backends.equal(spec.Backends) {
+				// Backend limits are validated beforehand
+				t.tunnel.UpdateBackendLimits(spec.Backends)
+				t.backends = spec.Backends
+				changed = true
+			}
+			if !t.active.equal(spec.Active) {
+				t.active = spec.Active
+				m.applyWindows(t)
+				changed = true
+			}
+			if !t.upstreamTLS.equal(spec.UpstreamTLS) {
+				// Upstream TLS settings are validated beforehand
+				t.tunnel.UpdateUpstreamTLS(spec.UpstreamTLS)
+				t.upstreamTLS = spec.UpstreamTLS
+				changed = true
+			}
+			if !hopsEqual(t.via, spec.Via) {
+				// Hops are validated beforehand
+				t.tunnel.UpdateVia(spec.Via)
+				t.via = spec.Via
+				changed = true
+			}
+			if t.tenant != spec.Tenant || t.service != spec.Service {
+				t.tenant = spec.Tenant
+				t.tunnel.setTenant(spec.Tenant)
+				t.service = spec.Service
+				m.register(key, t)
+				changed = true
+			}
+			if changed {
+				m.publishTunnelEvent(EventTunnelUpdated, key, t)
+				report.Updated = append(report.Updated, spec.ListenAt)
+			} else {
+				report.Unchanged = append(report.Unchanged, spec.ListenAt)
+			}
+			continue
+		}
+
+		if _, err := m.startTunnel(spec, nil); err != nil {
+			log.Printf("Failed to create tunnel for %q: %v", key, err)
+			report.Failed = append(report.Failed, TunnelFailure{
+				ListenAt: spec.ListenAt,
+				Error:    err.Error(),
+			})
+			continue
+		}
+		if recreated[spec.ListenAt] {
+			report.Updated = append(report.Updated, spec.ListenAt)
+		} else {
+			report.Created = append(report.Created, spec.ListenAt)
+		}
+	}
+
+	sortListenAts(report.Deleted)
+	return report
+}
+
+// startTunnel creates a tunnel according to a validated spec. If listener is
+// not nil, tunnel takes it over instead of listening on its own. Must be
+// called on the manager goroutine.
+func (m *TunnelManager) startTunnel(spec TunnelSpec,
+	listener net.Listener) (*dispatchTunnel, error) {
+	key := tunnelKey{
+		listenAt:  spec.ListenAt,
+		connectTo: spec.ConnectTo,
+	}
+	shared := m.sharedLimiters(spec.Tenant)
+	limits := m.resolveLimits(spec)
+	applied := spec.Schedule.limits(time.Now(), limits)
+	quota := m.persistence.claimQuota(spec.ListenAt)
+	tunnel, err := NewTunnel(spec.ListenAt, spec.ConnectTo, applied, TunnelOptions{
+		Events:         m.events,
+		Tenant:         spec.Tenant,
+		Exemptions:     spec.Exemptions,
+		Classes:        spec.Classes,
+		Access:         spec.Access,
+		Settings:       spec.TunnelSettings,
+		Priorities:     spec.Priorities,
+		Subnets:        spec.Subnets,
+		Backends:       spec.Backends,
+		UpstreamTLS:    spec.UpstreamTLS,
+		Via:            spec.Via,
+		IdentityGroups: m.identityGroups,
+		WorkerPools:    m.workerPools,
+		Dials:          m.dials,
+		Resolvers:      m.resolvers,
+		Listener:       listener,
+		Quota:          quota,
+	})
+	if err != nil {
+		m.persistence.retireQuota(spec.ListenAt, quota)
+		return nil, err
+	}
+	tunnel.UpdateSharedLimiters(shared)
+	tunnel.addCounters(m.persistence.claim(spec.ListenAt))
+	t := &dispatchTunnel{
+		tunnel:      tunnel,
+		lastLimits:  limits,
+		lastShared:  shared,
+		tenant:      spec.Tenant,
+		profile:     spec.Profile,
+		exemptions:  spec.Exemptions,
+		classes:     spec.Classes,
+		access:      spec.Access,
+		settings:    spec.TunnelSettings,
+		priorities:  spec.Priorities,
+		subnets:     spec.Subnets,
+		backends:    spec.Backends,
+		upstreamTLS: spec.UpstreamTLS,
+		via:         spec.Via,
+
+		appliedLimits: applied,
+		schedule:      spec.Schedule,
+		active:        spec.Active,
+		service:       spec.Service,
+	}
+	m.applyWindows(t)
+	m.tunnels[key] = t
+	if t.service != "" {
+		m.register(key, t)
+	}
+	m.publishTunnelEvent(EventTunnelCreated, key, t)
+	return t, nil
+}
+
+// stopTunnel shuts down a running tunnel keeping its counters. Must be called
+// on the manager goroutine.
+func (m *TunnelManager) stopTunnel(key tunnelKey, t *dispatchTunnel) {
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelShutdownTimeout)
+	defer cancel()
+	if err := t.tunnel.ShutdownContext(ctx); err != nil {
+		log.Print(err)
+	}
+	stats := t.tunnel.Stats()
+	m.persistence.retire(key.listenAt, stats.Counters)
+	m.persistence.retireQuota(key.listenAt, stats.Quota)
+	delete(m.tunnels, key)
+	if t.service != "" {
+		m.registries.Deregister(key.listenAt)
+	}
+	m.publishTunnelEvent(EventTunnelDeleted, key, t)
+}
+
+func sortListenAts(s []ListenAt) {
+	sort.Slice(s, func(i, j int) bool {
+		return s[i] < s[j]
+	})
+}
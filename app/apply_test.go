@@ -0,0 +1,155 @@
+package app
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	manager := newTunnelManager(make(chan ConfigurationJSON), persistence, gs)
+	manager.start()
+
+	report, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1"},
+		{ListenAt: "localhost:0", ConnectTo: "127.0.0.1:1"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	if !reflect.DeepEqual(report.Created, []ListenAt{"127.0.0.1:0", "localhost:0"}) {
+		t.Errorf("Unexpected report: %v", report)
+	}
+
+	report, err = manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:2"},
+		{ListenAt: "[::1]:0", ConnectTo: "127.0.0.1:1", Limits: TunnelLimits{TunnelLimit: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	expected := ChangeReport{
+		Created:   []ListenAt{"[::1]:0"},
+		Updated:   []ListenAt{"127.0.0.1:0"},
+		Deleted:   []ListenAt{"localhost:0"},
+		Unchanged: []ListenAt{},
+		Failed:    []TunnelFailure{},
+	}
+	if len(report.Failed) == 1 && report.Failed[0].ListenAt == "[::1]:0" {
+		// No IPv6 in this environment
+		expected.Created = []ListenAt{}
+		expected.Failed = report.Failed
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected %v, got %v", expected, report)
+	}
+
+	_, err = manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:2"},
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:3"},
+	})
+	if err == nil {
+		t.Errorf("Expected duplicate tunnels to be rejected")
+	}
+
+	_, err = manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:32167", ConnectTo: "127.0.0.1:2"},
+		{ListenAt: ":32167", ConnectTo: "127.0.0.1:3"},
+	})
+	if _, ok := err.(*ListenConflictError); !ok {
+		t.Errorf("Expected tunnels listening at the same address to be rejected, got %v", err)
+	}
+}
+
+func TestApplyProfiles(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	manager := newTunnelManager(make(chan ConfigurationJSON), persistence, gs)
+	manager.start()
+
+	gold := TunnelLimits{TunnelLimit: 1000, ConnectionLimit: 100}
+	if err = manager.PutProfile("gold", gold); err != nil {
+		t.Fatalf("Failed to define profile: %v", err)
+	}
+	if _, err = manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1", Profile: "silver"},
+	}); err == nil {
+		t.Errorf("Expected unknown profile to be rejected")
+	}
+	if _, err = manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1", Profile: "gold",
+			TunnelSettings: TunnelSettings{RecordDir: "records"}},
+		{ListenAt: "localhost:0", ConnectTo: "127.0.0.1:1"},
+	}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+
+	limitsOf := func(listenAt ListenAt) TunnelLimits {
+		for _, info := range manager.ListTunnels() {
+			if info.ListenAt == listenAt {
+				return info.Limits
+			}
+		}
+		t.Fatalf("Tunnel %q not found", listenAt)
+		return TunnelLimits{}
+	}
+	if limitsOf("127.0.0.1:0") != gold {
+		t.Errorf("Expected tunnel to take limits from profile")
+	}
+	// Settings aren't limits, so tunnels using a profile keep their own
+	for _, info := range manager.ListTunnels() {
+		if info.ListenAt == "127.0.0.1:0" && info.RecordDir != "records" {
+			t.Errorf("Expected tunnel to keep its settings, got %+v", info.TunnelSettings)
+		}
+	}
+
+	// Tunnels using a profile follow its changes
+	if err = manager.ApplyProfile("localhost:0", "gold"); err != nil {
+		t.Fatalf("Failed to apply profile: %v", err)
+	}
+	platinum := TunnelLimits{TunnelLimit: 2000}
+	if err = manager.PutProfile("gold", platinum); err != nil {
+		t.Fatalf("Failed to change profile: %v", err)
+	}
+	if limitsOf("127.0.0.1:0") != platinum || limitsOf("localhost:0") != platinum {
+		t.Errorf("Expected tunnels to follow profile change")
+	}
+	profiles := manager.ListProfiles()
+	if len(profiles) != 1 || profiles[0].Tunnels != 2 {
+		t.Errorf("Unexpected profiles: %v", profiles)
+	}
+
+	// Limits set directly detach tunnel from its profile
+	own := TunnelLimits{TunnelLimit: 10}
+	if err = manager.UpdateTunnelLimits("localhost:0", own); err != nil {
+		t.Fatalf("Failed to update limits: %v", err)
+	}
+	if err = manager.PutProfile("gold", gold); err != nil {
+		t.Fatalf("Failed to change profile: %v", err)
+	}
+	if limitsOf("localhost:0") != own || limitsOf("127.0.0.1:0") != gold {
+		t.Errorf("Expected only tunnels using profile to follow its change")
+	}
+}
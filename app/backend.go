@@ -0,0 +1,140 @@
+package app
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
+)
+
+// BackendLimit caps aggregate bandwidth of all connections of a tunnel to one
+// of the backends its connectTo resolves to
+type BackendLimit struct {
+	// IP address of the backend
+	Backend string `json:"backend"`
+	Limit   Limit  `json:"limit"`
+}
+
+// BackendLimits are limits of backends of a tunnel. Connections to backends
+// not listed are only subject to tunnel limits.
+type BackendLimits []BackendLimit
+
+// validate checks backend limits for errors
+func (b BackendLimits) validate() error {
+	_, err := b.set()
+	return err
+}
+
+// equal tells whether two sets of backend limits are the same
+func (b BackendLimits) equal(other BackendLimits) bool {
+	if len(b) != len(other) {
+		return false
+	}
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// backendLimit is a limiter shared by connections to a backend
+type backendLimit struct {
+	// Backend IP address in canonical form
+	backend string
+	limiter *rate.Limiter
+}
+
+// backendSet maps backend IP addresses in canonical form to their limits
+type backendSet map[string]*backendLimit
+
+// set parses backend limits. Returns nil if there are none.
+func (b BackendLimits) set() (backendSet, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	result := make(backendSet, len(b))
+	for _, v := range b {
+		ip := net.ParseIP(v.Backend)
+		if ip == nil {
+			return nil, fmt.Errorf("Backend %q is not an IP address", v.Backend)
+		}
+		if v.Limit <= 0 {
+			return nil, fmt.Errorf("Limit of backend %q must be positive", v.Backend)
+		}
+		backend := ip.String()
+		if _, ok := result[backend]; ok {
+			return nil, fmt.Errorf("Backend %q is limited more than once", v.Backend)
+		}
+		result[backend] = &backendLimit{
+			backend: backend,
+			limiter: limiter.CreateLimiter(rate.Limit(v.Limit)),
+		}
+	}
+	return result, nil
+}
+
+// match returns limit of a backend connection was dialed to (nil if there's
+// none). Safe to call on nil set.
+func (s backendSet) match(upstream net.Addr) *backendLimit {
+	if s == nil || upstream == nil {
+		return nil
+	}
+	ip := addrIP(upstream.String())
+	if ip == nil {
+		return nil
+	}
+	return s[ip.String()]
+}
+
+// inherit makes backends of a set share limiters of the same backends of an
+// old one, so that changing a limit doesn't reset its bucket
+func (s backendSet) inherit(old backendSet) {
+	for backend, l := range s {
+		if inherited, ok := old[backend]; ok {
+			inherited.limiter.SetLimit(l.limiter.Limit())
+			l.limiter = inherited.limiter
+		}
+	}
+}
+
+// UpdateBackendLimits changes limits of backends of a tunnel. Active
+// connections become subject to new limits right away.
+func (t *Tunnel) UpdateBackendLimits(limits BackendLimits) error {
+	set, err := limits.set()
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateBackends <- set:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// applyBackend makes connection share the limiter of the backend it was
+// dialed to. Must be called on the tunnel goroutine.
+func (t *Tunnel) applyBackend(conn *Connection) {
+	var upstream net.Addr
+	if conn.egress != nil {
+		upstream = conn.egress.RemoteAddr()
+	}
+	backend := t.backends.match(upstream)
+	if backend == conn.backend {
+		return
+	}
+	if !t.updateConnectionShared(conn, conn.identity, conn.class, conn.priorityLevel,
+		conn.subnet, backend) {
+		return
+	}
+	conn.backend = backend
+	if backend == nil {
+		conn.backendName.Store("")
+	} else {
+		conn.backendName.Store(backend.backend)
+		t.logf(LogDebug, "Connection %d at %q shares limit of backend %s", conn.ID(),
+			t.listenAt, backend.backend)
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendLimits(t *testing.T) {
+	set, err := BackendLimits{
+		{Backend: "10.0.0.1", Limit: 5000},
+		{Backend: "2001:db8::0:1", Limit: 1000},
+	}.set()
+	if err != nil {
+		t.Fatalf("Failed to parse backend limits: %v", err)
+	}
+	cases := []struct {
+		upstream string
+		expected string
+	}{
+		{"10.0.0.1", "10.0.0.1"},
+		{"10.0.0.2", ""},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		upstream := &net.TCPAddr{IP: net.ParseIP(c.upstream), Port: 80}
+		backend := ""
+		if limit := set.match(upstream); limit != nil {
+			backend = limit.backend
+		}
+		if backend != c.expected {
+			t.Errorf("Expected %s to match backend %q, got %q", c.upstream, c.expected,
+				backend)
+		}
+	}
+
+	updated, err := BackendLimits{{Backend: "10.0.0.1", Limit: 3000}}.set()
+	if err != nil {
+		t.Fatalf("Failed to parse backend limits: %v", err)
+	}
+	updated.inherit(set)
+	if updated["10.0.0.1"].limiter != set["10.0.0.1"].limiter {
+		t.Errorf("Expected updated backend to keep its limiter")
+	}
+	if limit := updated["10.0.0.1"].limiter.Limit(); limit != 3000 {
+		t.Errorf("Expected inherited limiter to have limit 3000, got %v", limit)
+	}
+
+	invalid := []BackendLimits{
+		{{Backend: "legacy.example.com", Limit: 1000}},
+		{{Backend: "10.0.0.0/8", Limit: 1000}},
+		{{Backend: "10.0.0.1", Limit: 0}},
+		{{Backend: "10.0.0.1", Limit: 1000}, {Backend: "10.0.0.1", Limit: 2000}},
+	}
+	for _, limits := range invalid {
+		if err := limits.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", limits)
+		}
+	}
+}
+
+func TestTunnelBackendLimits(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{
+			Backends: BackendLimits{{Backend: "127.0.0.1", Limit: 1000}},
+		})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	waitBackend := func(expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			connections := tunnel.Connections()
+			if len(connections) == 1 && connections[0].Backend == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected connection to backend %q, got %+v", expected,
+					connections)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitBackend("127.0.0.1")
+
+	if err := tunnel.UpdateBackendLimits(nil); err != nil {
+		t.Fatalf("Failed to update backend limits: %v", err)
+	}
+	waitBackend("")
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// MaxListenBacklog is the maximum listen backlog of a tunnel. Kernel caps it
+// to net.core.somaxconn.
+const MaxListenBacklog = 65535
+
+// MaxAcceptQueue is the maximum number of accepted connections waiting for a
+// tunnel to handle them
+const MaxAcceptQueue = 65536
+
+// validateBacklog checks backlog settings of limits for errors
+func (l TunnelLimits) validateBacklog() error {
+	if l.ListenBacklog < 0 || l.ListenBacklog > MaxListenBacklog {
+		return fmt.Errorf("Listen backlog must be between 0 and %d", MaxListenBacklog)
+	}
+	if l.AcceptQueue < 0 || l.AcceptQueue > MaxAcceptQueue {
+		return fmt.Errorf("Accept queue must be between 0 and %d", MaxAcceptQueue)
+	}
+	return nil
+}
+
+// setListenBacklog changes backlog of a listening socket by listening on it
+// again, which Linux allows
+func setListenBacklog(l net.Listener, backlog int) error {
+	if r, ok := l.(*rangeListener); ok {
+		for _, l := range r.listeners {
+			if err := setListenBacklog(l, backlog); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("Listener doesn't support changing its backlog")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// applyListenBacklog makes tunnel listening socket use listen backlog of given
+// limits unless it already does. Zero backlog stands for net.core.somaxconn.
+// Must be called on the tunnel goroutine.
+func (t *Tunnel) applyListenBacklog(limits TunnelLimits) {
+	if limits.ListenBacklog == t.listenBacklog {
+		return
+	}
+	backlog := limits.ListenBacklog
+	if backlog == 0 {
+		backlog = MaxListenBacklog
+	}
+	if err := setListenBacklog(t.listener.Inner(), backlog); err != nil {
+		t.logf(LogWarn, "Failed to set listen backlog of tunnel at %q: %v", t.listenAt, err)
+		return
+	}
+	t.listenBacklog = limits.ListenBacklog
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptBacklog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	if err := setListenBacklog(l, 16); err != nil {
+		t.Errorf("Failed to set listen backlog: %v", err)
+	}
+
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	limits := TunnelLimits{ListenBacklog: 16, AcceptQueue: 4}
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		limits, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	limits.ListenBacklog = 0
+	tunnel.UpdateLimits(limits)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tunnel.Connections()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connections to be accepted, got %+v", tunnel.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, invalid := range []TunnelLimits{{ListenBacklog: -1},
+		{ListenBacklog: MaxListenBacklog + 1}, {AcceptQueue: -1},
+		{AcceptQueue: MaxAcceptQueue + 1}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+)
+
+// Ways to choose among upstream addresses connectTo resolves to
+const (
+	// BalanceDefault dials addresses in the order resolver returns them
+	BalanceDefault = ""
+	// BalanceSourceIP picks an address by a hash of client IP address, so
+	// that reconnecting clients land on the same upstream as long as the set
+	// of addresses stays the same. Other addresses are tried if it fails.
+	BalanceSourceIP = "sourceIP"
+)
+
+// validateBalance checks balancing mode of settings for errors
+func (s TunnelSettings) validateBalance() error {
+	switch s.Balance {
+	case BalanceDefault, BalanceSourceIP:
+		return nil
+	default:
+		return fmt.Errorf("Unknown balancing mode %q", s.Balance)
+	}
+}
+
+// stickyOrder returns addresses in the order a client with a given address
+// should try them in
+func stickyOrder(client net.Addr, addrs []string) []string {
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+	if len(sorted) < 2 {
+		return sorted
+	}
+	ip := client.String()
+	if tcpAddr, ok := client.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP.String()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	first := int(h.Sum32() % uint32(len(sorted)))
+	return append(sorted[first:], sorted[:first]...)
+}
+
+// dialSticky dials upstream address chosen by client IP address, falling back
+// to other addresses connectTo resolves to
+func (c *Connection) dialSticky(ctx context.Context) (net.Conn, error) {
+	addrs, err := c.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddrs(ctx, stickyOrder(c.ingress.RemoteAddr(), addrs))
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStickyOrder(t *testing.T) {
+	addrs := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	rotated := []string{"10.0.0.3:80", "10.0.0.1:80", "10.0.0.2:80"}
+	firsts := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		client := &net.TCPAddr{IP: net.IPv4(192, 168, 0, byte(i)), Port: 1000 + i}
+		order := stickyOrder(client, addrs)
+		if len(order) != len(addrs) {
+			t.Fatalf("Expected all addresses to be tried, got %v", order)
+		}
+		// Resolver could return addresses in any order, client port changes
+		// on reconnect
+		again := stickyOrder(&net.TCPAddr{IP: client.IP, Port: 2000 + i}, rotated)
+		if order[0] != again[0] {
+			t.Errorf("Expected client %v to stick to %q, got %q", client.IP, order[0], again[0])
+		}
+		firsts[order[0]] = true
+	}
+	if len(firsts) != len(addrs) {
+		t.Errorf("Expected clients to be spread over all upstreams, got %v", firsts)
+	}
+}
+
+func TestStickyTunnel(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Addr().String())
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(net.JoinHostPort("localhost", port)),
+		TunnelLimits{}, TunnelOptions{Settings: TunnelSettings{Balance: BalanceSourceIP}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	for len(tunnel.Connections()) == 0 {
+		if closed := tunnel.Stats().Closed; closed[CloseDialFailure] != 0 {
+			t.Fatalf("Expected one of upstream addresses to work")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dialed := tunnel.Connections()[0].Upstream; dialed != upstream.Addr().String() {
+		t.Errorf("Expected connection to %q, got %q", upstream.Addr(), dialed)
+	}
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// Bandwidth tests clients could ask for with a preamble
+const (
+	// TestEcho sends everything client sends back to it
+	TestEcho = "echo"
+	// TestDiscard reads and drops everything client sends
+	TestDiscard = "discard"
+	// TestSource sends data to client as fast as it reads it
+	TestSource = "source"
+)
+
+// testChunkSize is the size of writes source test makes
+const testChunkSize = 32 * 1024
+
+// startBandwidthTest starts a responder running a given bandwidth test and
+// returns a connection to be used in place of an upstream one
+func startBandwidthTest(mode string) net.Conn {
+	egress, responder := net.Pipe()
+	go func() {
+		defer responder.Close()
+		switch mode {
+		case TestEcho:
+			io.Copy(responder, responder)
+		case TestDiscard:
+			io.Copy(ioutil.Discard, responder)
+		case TestSource:
+			go io.Copy(ioutil.Discard, responder)
+			chunk := make([]byte, testChunkSize)
+			for {
+				if _, err := responder.Write(chunk); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return egress
+}
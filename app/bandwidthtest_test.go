@@ -0,0 +1,60 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBandwidthTest(t *testing.T) {
+	upstream, received := startRecordingUpstream(t, 5)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{Settings: TunnelSettings{BandwidthTest: true}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte(TestPreambleMagic + TestEcho + "\nhello"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "hello" {
+		t.Fatalf("Expected data to be echoed, got %q, %v", reply, err)
+	}
+
+	client, err = net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte(TestPreambleMagic + TestSource + "\n"))
+	if _, err := io.ReadFull(client, make([]byte, testChunkSize)); err != nil {
+		t.Fatalf("Expected data from source test, got %v", err)
+	}
+
+	select {
+	case data := <-received:
+		t.Errorf("Expected upstream not to be connected, got %q", data)
+	default:
+	}
+
+	// Unknown tests are rejected
+	client, err = net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte(TestPreambleMagic + "chargen\n"))
+	if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected connection asking for unknown test to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// connectionBoost is a temporary limit of a connection
+type connectionBoost struct {
+	until time.Time
+	// Own limit connection had before the boost (nil if it was subject to the
+	// tunnel connection limit)
+	previous *Limit
+}
+
+type connectionBoostRequest struct {
+	id       uint64
+	limit    Limit
+	duration time.Duration
+	done     chan error
+}
+
+// BoostConnection moves an active connection to a different limit for a given
+// time, after which connection gets the limit it had before. Boosting a boosted
+// connection again replaces the boost. Changing limit of a connection with
+// UpdateConnectionLimit ends its boost.
+func (t *Tunnel) BoostConnection(id uint64, limit Limit, duration time.Duration) error {
+	if limit < 0 {
+		return invalidLimit("Boost limit must not be negative")
+	}
+	if duration <= 0 {
+		return invalidLimit("Boost duration must be positive")
+	}
+	done := make(chan error, 1)
+	select {
+	case t.boostConnection <- connectionBoostRequest{
+		id:       id,
+		limit:    limit,
+		duration: duration,
+		done:     done,
+	}:
+		return <-done
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// boost applies a boost to one of active connections. Must be called on the
+// tunnel goroutine.
+func (t *Tunnel) boost(activeConnections *connectionRegistry,
+	request connectionBoostRequest) error {
+	conn := activeConnections.find(request.id)
+	if conn == nil {
+		return errConnectionNotFound
+	}
+	boost := conn.boost
+	if boost == nil {
+		boost = new(connectionBoost)
+		if limit, own := t.listener.ConnectionLimit(conn.ingress); own {
+			previous := Limit(limit)
+			boost.previous = &previous
+		}
+	}
+	if !t.listener.UpdateConnectionLimit(conn.ingress, int(request.limit)) {
+		return errConnectionNotFound
+	}
+	boost.until = time.Now().Add(request.duration)
+	conn.boost = boost
+	t.logf(LogInfo, "Connection %d at %q boosted to %v for %v", conn.ID(), t.listenAt,
+		request.limit, request.duration)
+	return nil
+}
+
+// endBoosts reverts limits of connections whose boosts have expired. Returns
+// a channel receiving when the next boost expires (nil if there is none). Must
+// be called on the tunnel goroutine.
+func (t *Tunnel) endBoosts(activeConnections *connectionRegistry,
+	now time.Time) <-chan time.Time {
+	var next time.Time
+	for _, conn := range activeConnections.all() {
+		if conn.boost == nil {
+			continue
+		}
+		if conn.boost.until.After(now) {
+			if next.IsZero() || conn.boost.until.Before(next) {
+				next = conn.boost.until
+			}
+			continue
+		}
+		previous := conn.boost.previous
+		conn.boost = nil
+		if previous != nil {
+			t.listener.UpdateConnectionLimit(conn.ingress, int(*previous))
+		} else {
+			t.listener.ResetConnectionLimit(conn.ingress)
+		}
+		t.logf(LogInfo, "Connection %d at %q boost ended, limit reverted to %s", conn.ID(),
+			t.listenAt, describeLimit(previous))
+	}
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(next.Sub(now))
+}
+
+// describeLimit describes own limit of a connection for the log
+func describeLimit(limit *Limit) string {
+	if limit == nil {
+		return "tunnel connection limit"
+	}
+	return fmt.Sprint(*limit)
+}
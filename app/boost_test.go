@@ -0,0 +1,71 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitConnectionLimit waits for the only connection of a tunnel to get a given
+// limit
+func waitConnectionLimit(t *testing.T, tunnel *Tunnel, limit Limit, own bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns := tunnel.Connections()
+		if len(conns) == 1 && conns[0].Limit == limit && conns[0].OwnLimit == own {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection limit %v (own: %v), got %+v", limit, own, conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBoostConnection(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{ConnectionLimit: 1000}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	waitConnectionLimit(t, tunnel, 1000, false)
+	id := tunnel.Connections()[0].ID
+
+	own := Limit(2000)
+	if err := tunnel.UpdateConnectionLimit(id, &own); err != nil {
+		t.Fatalf("Failed to update connection limit: %v", err)
+	}
+	if err := tunnel.BoostConnection(id, 50000, 300*time.Millisecond); err != nil {
+		t.Fatalf("Failed to boost connection: %v", err)
+	}
+	waitConnectionLimit(t, tunnel, 50000, true)
+	// Boost ends with the own limit connection had before
+	waitConnectionLimit(t, tunnel, 2000, true)
+
+	if err := tunnel.BoostConnection(id, 50000, 300*time.Millisecond); err != nil {
+		t.Fatalf("Failed to boost connection: %v", err)
+	}
+	if err := tunnel.UpdateConnectionLimit(id, nil); err != nil {
+		t.Fatalf("Failed to reset connection limit: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	waitConnectionLimit(t, tunnel, 1000, false)
+
+	if err := tunnel.BoostConnection(id, -2, time.Second); ErrorKind(err) != ErrLimitInvalid {
+		t.Errorf("Expected negative boost to be rejected, got %v", err)
+	}
+	if err := tunnel.BoostConnection(id, 50000, 0); ErrorKind(err) != ErrLimitInvalid {
+		t.Errorf("Expected zero boost duration to be rejected, got %v", err)
+	}
+	if err := tunnel.BoostConnection(id+1, 50000, time.Second); err != errConnectionNotFound {
+		t.Errorf("Expected unknown connection not to be found, got %v", err)
+	}
+}
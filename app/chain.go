@@ -0,0 +1,317 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Hop is an intermediate node upstream connections are made through
+type Hop struct {
+	// One of HopSOCKS5, HopHTTP or HopSSH
+	Type string `json:"type"`
+	// Address of a hop (host:port)
+	Address string `json:"address"`
+	// User to authenticate to SSH hop as, its private key file and SHA-256
+	// fingerprint of hop host key as printed by "ssh-keygen -l" (e.g.
+	// "SHA256:...")
+	User    string `json:"user,omitempty"`
+	KeyFile string `json:"keyFile,omitempty"`
+	HostKey string `json:"hostKey,omitempty"`
+}
+
+// Key files are read from throttle host, so only operator could use them
+var errKeyFileForbidden = errors.New("Only operator is allowed to use SSH key files")
+
+// Hop types
+const (
+	// HopSOCKS5 is a SOCKS5 proxy without authentication
+	HopSOCKS5 = "socks5"
+	// HopHTTP is an HTTP proxy supporting CONNECT method
+	HopHTTP = "http"
+	// HopSSH is an SSH server allowing TCP forwarding (e.g. a bastion host)
+	HopSSH = "ssh"
+)
+
+// hopHandshakeTimeout limits time a handshake with a single hop could take
+const hopHandshakeTimeout = 10 * time.Second
+
+// hopsEqual tells whether two chains of hops are the same
+func hopsEqual(a, b []Hop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateHops checks chain of hops for errors
+func validateHops(hops []Hop) error {
+	_, err := newHopChain(hops)
+	return err
+}
+
+// hopChain is a chain of hops ready to dial through
+type hopChain struct {
+	hops []Hop
+	// SSH client configurations of SSH hops (nil for other hops)
+	sshConfigs []*ssh.ClientConfig
+}
+
+// newHopChain prepares a chain of hops to dial through. Returns nil if there
+// are no hops.
+func newHopChain(hops []Hop) (*hopChain, error) {
+	if len(hops) == 0 {
+		return nil, nil
+	}
+	result := &hopChain{
+		hops:       hops,
+		sshConfigs: make([]*ssh.ClientConfig, len(hops)),
+	}
+	for i, hop := range hops {
+		if _, err := parseAddress(hop.Address, ""); err != nil {
+			return nil, fmt.Errorf("Invalid hop: %v", err)
+		}
+		switch hop.Type {
+		case HopSOCKS5, HopHTTP:
+		case HopSSH:
+			config, err := hop.sshConfig()
+			if err != nil {
+				return nil, err
+			}
+			result.sshConfigs[i] = config
+		default:
+			return nil, fmt.Errorf("Unknown hop type %q", hop.Type)
+		}
+	}
+	return result, nil
+}
+
+// sshConfig creates configuration of SSH client connecting to a hop
+func (h Hop) sshConfig() (*ssh.ClientConfig, error) {
+	if h.User == "" || h.KeyFile == "" || h.HostKey == "" {
+		return nil, fmt.Errorf("SSH hop %q requires user, key file and host key", h.Address)
+	}
+	pem, err := ioutil.ReadFile(h.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key of SSH hop %q: %v", h.Address, err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse key of SSH hop %q: %v", h.Address, err)
+	}
+	hostKey := h.HostKey
+	return &ssh.ClientConfig{
+		User: h.User,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != hostKey {
+				return fmt.Errorf("Unexpected host key %s of SSH hop %q", fingerprint, hostname)
+			}
+			return nil
+		},
+		Timeout: hopHandshakeTimeout,
+	}, nil
+}
+
+// dial connects to a target through all hops of a chain
+func (c *hopChain) dial(ctx context.Context, target string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.hops[0].Address)
+	if err != nil {
+		return nil, err
+	}
+	var closers []io.Closer
+	for i, hop := range c.hops {
+		next := target
+		if i+1 < len(c.hops) {
+			next = c.hops[i+1].Address
+		}
+		var closer io.Closer
+		conn, closer, err = c.connect(ctx, i, conn, next)
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		if err != nil {
+			for j := len(closers) - 1; j >= 0; j-- {
+				closers[j].Close()
+			}
+			return nil, fmt.Errorf("Hop %q: %v", hop.Address, err)
+		}
+	}
+	if len(closers) == 0 {
+		return conn, nil
+	}
+	return &chainedConn{Conn: conn, closers: closers}, nil
+}
+
+// connect makes i-th hop connected with conn connect to the next address.
+// Returns connection to the next address and something to close along with
+// it (if any). On failure conn is closed or returned as a closer.
+func (c *hopChain) connect(ctx context.Context, i int, conn net.Conn,
+	next string) (net.Conn, io.Closer, error) {
+	deadline := time.Now().Add(hopHandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	hop := c.hops[i]
+	switch hop.Type {
+	case HopSSH:
+		conn.SetDeadline(deadline)
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, hop.Address, c.sshConfigs[i])
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		client := ssh.NewClient(sshConn, chans, reqs)
+		nextConn, err := client.Dial("tcp", next)
+		return nextConn, client, err
+	case HopHTTP:
+		conn.SetDeadline(deadline)
+		nextConn, err := connectHTTP(conn, next)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return nextConn, nil, nil
+	default:
+		conn.SetDeadline(deadline)
+		if err := connectSOCKS5(conn, next); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil, nil
+	}
+}
+
+// connectSOCKS5 asks SOCKS5 proxy connected with conn to connect to a given
+// address
+func connectSOCKS5(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port %q", portString)
+	}
+
+	// Greeting offering "no authentication" method only
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy refused authentication method")
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name %q is too long", host)
+		}
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, 1)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy failed to connect to %q (code %d)", address, header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addrLen = int(length[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy replied with unknown address type %d", header[3])
+	}
+	// Bound address and port aren't needed
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// connectHTTP asks HTTP proxy connected with conn to connect to a given
+// address
+func connectHTTP(conn net.Conn, address string) (net.Conn, error) {
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n",
+		address, address); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy failed to connect to %q: %s", address, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// Target spoke first and proxy passed it along with its response
+		prefix, _ := r.Peek(r.Buffered())
+		return &prefixedConn{Conn: conn, prefix: prefix}, nil
+	}
+	return conn, nil
+}
+
+// chainedConn is a connection made through hops that have to be closed along
+// with it
+type chainedConn struct {
+	net.Conn
+	closers []io.Closer
+}
+
+// Close is an implementation of net.Conn.Close
+func (c *chainedConn) Close() error {
+	err := c.Conn.Close()
+	if err == io.EOF {
+		// SSH channel has already been closed by the other side
+		err = nil
+	}
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i].Close()
+	}
+	return err
+}
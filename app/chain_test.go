@@ -0,0 +1,275 @@
+package app
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveHops accepts connections and relays each of them to an address
+// returned by handshake
+func serveHops(t *testing.T, handshake func(net.Conn) (net.Conn, error)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := handshake(conn)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+// startSOCKS5 starts a minimal SOCKS5 proxy
+func startSOCKS5(t *testing.T) net.Listener {
+	return serveHops(t, func(conn net.Conn) (net.Conn, error) {
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return nil, err
+		}
+		conn.Write([]byte{5, 0})
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		var host string
+		switch header[3] {
+		case 1:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			name := make([]byte, length[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return nil, fmt.Errorf("Unsupported address type")
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		target, err := net.Dial("tcp", net.JoinHostPort(host,
+			strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return nil, err
+		}
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return target, nil
+	})
+}
+
+// startHTTPProxy starts a minimal HTTP proxy supporting CONNECT method
+func startHTTPProxy(t *testing.T) net.Listener {
+	return serveHops(t, func(conn net.Conn) (net.Conn, error) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != "CONNECT" {
+			return nil, fmt.Errorf("Unexpected request")
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return nil, err
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return target, nil
+	})
+}
+
+// startSSH starts an SSH server allowing TCP forwarding to a client with a
+// given key. Returns server host key fingerprint.
+func startSSH(t *testing.T, clientKey ssh.PublicKey) (net.Listener, string) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("Failed to create host key signer: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, fmt.Errorf("Unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					var payload struct {
+						Host       string
+						Port       uint32
+						OriginHost string
+						OriginPort uint32
+					}
+					if newChannel.ChannelType() != "direct-tcpip" ||
+						ssh.Unmarshal(newChannel.ExtraData(), &payload) != nil {
+						newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+						continue
+					}
+					target, err := net.Dial("tcp", net.JoinHostPort(payload.Host,
+						strconv.Itoa(int(payload.Port))))
+					if err != nil {
+						newChannel.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					channel, requests, _ := newChannel.Accept()
+					go ssh.DiscardRequests(requests)
+					go func() {
+						defer channel.Close()
+						defer target.Close()
+						go io.Copy(target, channel)
+						io.Copy(channel, target)
+					}()
+				}
+			}()
+		}
+	}()
+	return l, ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+// writeClientKey generates an SSH client key and writes it to a temporary
+// file
+func writeClientKey(t *testing.T) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	f, err := ioutil.TempFile("", "key")
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	public, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to convert client key: %v", err)
+	}
+	return f.Name(), public
+}
+
+func TestValidateHops(t *testing.T) {
+	cases := []struct {
+		name  string
+		hops  []Hop
+		valid bool
+	}{
+		{"none", nil, true},
+		{"socks5", []Hop{{Type: HopSOCKS5, Address: "proxy:1080"}}, true},
+		{"no port", []Hop{{Type: HopHTTP, Address: "proxy"}}, false},
+		{"unknown type", []Hop{{Type: "smtp", Address: "proxy:25"}}, false},
+		{"ssh without key", []Hop{{Type: HopSSH, Address: "bastion:22", User: "u",
+			HostKey: "SHA256:x"}}, false},
+	}
+	for _, c := range cases {
+		if err := validateHops(c.hops); (err == nil) != c.valid {
+			t.Errorf("%s: unexpected validation result %v", c.name, err)
+		}
+	}
+}
+
+func TestTunnelVia(t *testing.T) {
+	upstream, received := startRecordingUpstream(t, 5)
+	defer upstream.Close()
+	socks := startSOCKS5(t)
+	defer socks.Close()
+	httpProxy := startHTTPProxy(t)
+	defer httpProxy.Close()
+	keyFile, clientKey := writeClientKey(t)
+	defer os.Remove(keyFile)
+	bastion, hostKey := startSSH(t, clientKey)
+	defer bastion.Close()
+
+	hops := []Hop{
+		{Type: HopSOCKS5, Address: socks.Addr().String()},
+		{Type: HopHTTP, Address: httpProxy.Addr().String()},
+		{Type: HopSSH, Address: bastion.Addr().String(), User: "throttle", KeyFile: keyFile,
+			HostKey: hostKey},
+	}
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{Via: hops})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+	select {
+	case data := <-received:
+		if data != "hello" {
+			t.Errorf("Expected upstream to receive client data, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Upstream received nothing through hops")
+	}
+
+	// Wrong host key makes SSH hop fail
+	hops[2].HostKey = "SHA256:unknown"
+	if err := tunnel.UpdateVia(hops); err != nil {
+		t.Fatalf("Failed to update hops: %v", err)
+	}
+	client, err = net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected connection through untrusted SSH hop to fail, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseDialFailure] != 1 {
+		t.Errorf("Expected dial failure, got %v", closed)
+	}
+}
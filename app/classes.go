@@ -0,0 +1,321 @@
+package app
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
+)
+
+// LimitClass is a share of tunnel limit given to connections matching a rule.
+// Classes use their guaranteed share at least and borrow bandwidth other
+// classes don't use up to their ceiling, like HTB classes do.
+type LimitClass struct {
+	Name string `json:"name"`
+	// Fraction of tunnel limit guaranteed to the class
+	Share float64 `json:"share"`
+	// Fraction of tunnel limit class could use borrowing from other classes
+	// (whole tunnel limit if zero)
+	Ceil  float64    `json:"ceil,omitempty"`
+	Match ClassMatch `json:"match,omitempty"`
+}
+
+// ClassMatch tells which connections belong to a class. All of specified
+// conditions must hold, empty match takes all connections.
+type ClassMatch struct {
+	// Conditions on clients and connection metadata (see MatchRule)
+	Clients     []string `json:"clients,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	ServerNames []string `json:"serverNames,omitempty"`
+	Identities  []string `json:"identities,omitempty"`
+	// Labels connection must have (see Admission)
+	Labels Labels `json:"labels,omitempty"`
+	// Recent traffic pattern of connection (see ConnectionInfo.Traffic)
+	Traffic limiter.TrafficClass `json:"traffic,omitempty"`
+}
+
+// rule returns conditions of a match other than traffic pattern
+func (m ClassMatch) rule() MatchRule {
+	return MatchRule{
+		Clients:     m.Clients,
+		Sources:     m.Sources,
+		ServerNames: m.ServerNames,
+		Identities:  m.Identities,
+		Labels:      m.Labels,
+	}
+}
+
+// LimitClasses split tunnel limit between classes of connections. Connection
+// belongs to the first class it matches, connections matching none are only
+// limited by tunnel limit. Classes have no effect on tunnels without a limit.
+type LimitClasses []LimitClass
+
+// classHungryRatio is the fraction of its guaranteed share a class has to use
+// to get a part of bandwidth other classes leave unused
+const classHungryRatio = 0.9
+
+func (c LimitClass) ceil() float64 {
+	if c.Ceil == 0 {
+		return 1
+	}
+	return c.Ceil
+}
+
+func (c LimitClass) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("Limit class must have a name")
+	}
+	if !(c.Share > 0 && c.Share <= 1) {
+		return fmt.Errorf("Share of limit class %q must be within (0, 1]", c.Name)
+	}
+	if c.Ceil != 0 && !(c.Ceil >= c.Share && c.Ceil <= 1) {
+		return fmt.Errorf("Ceiling of limit class %q must be within [share, 1]", c.Name)
+	}
+	switch c.Match.Traffic {
+	case "", limiter.TrafficIdle, limiter.TrafficInteractive, limiter.TrafficBulk:
+	default:
+		return fmt.Errorf("Limit class %q matches unknown traffic %q", c.Name,
+			c.Match.Traffic)
+	}
+	return nil
+}
+
+// validate checks classes for errors
+func (l LimitClasses) validate() error {
+	_, err := l.set()
+	return err
+}
+
+// equal tells whether two sets of classes are the same
+func (l LimitClasses) equal(other LimitClasses) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for i := range l {
+		a, b := l[i], other[i]
+		if a.Name != b.Name || a.Share != b.Share || a.Ceil != b.Ceil ||
+			!a.Match.rule().equal(b.Match.rule()) || a.Match.Traffic != b.Match.Traffic {
+			return false
+		}
+	}
+	return true
+}
+
+// limitClass is a class with its rules parsed and a limiter shared by its
+// connections
+type limitClass struct {
+	LimitClass
+	index   int
+	rule    *ruleMatcher
+	limiter *rate.Limiter
+}
+
+// name returns name of a class. Safe to call on nil class.
+func (c *limitClass) name() string {
+	if c == nil {
+		return ""
+	}
+	return c.Name
+}
+
+// classSet is a parsed set of limit classes
+type classSet struct {
+	classes []*limitClass
+}
+
+// set parses classes. Returns nil if there are none.
+func (l LimitClasses) set() (*classSet, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	result := new(classSet)
+	names := make(map[string]bool, len(l))
+	var shares float64
+	for i, c := range l {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Duplicate limit class %q", c.Name)
+		}
+		names[c.Name] = true
+		shares += c.Share
+		rule, err := c.Match.rule().matcher()
+		if err != nil {
+			return nil, withContext(err, "Limit class %q", c.Name)
+		}
+		class := &limitClass{
+			LimitClass: c,
+			index:      i,
+			rule:       rule,
+			limiter:    rate.NewLimiter(rate.Inf, limiter.MaxBurstSize),
+		}
+		result.classes = append(result.classes, class)
+	}
+	// Allow for rounding errors of shares like 0.7 + 0.2 + 0.1
+	if shares > 1+1e-9 {
+		return nil, fmt.Errorf("Shares of limit classes add up to more than 1")
+	}
+	return result, nil
+}
+
+// match returns the first class a connection belongs to or nil if there's
+// none. Safe to call on nil set.
+func (s *classSet) match(meta connectionMeta, traffic limiter.TrafficClass) *limitClass {
+	if s == nil {
+		return nil
+	}
+	for _, c := range s.classes {
+		if c.Match.Traffic != "" && c.Match.Traffic != traffic {
+			continue
+		}
+		if c.rule.match(meta) {
+			return c
+		}
+	}
+	return nil
+}
+
+// balanceShares returns limits of classes given tunnel limit, current rates of
+// classes and rate of connections belonging to none. Each class gets its
+// guaranteed share. Classes using (almost) all of it share what's left in
+// proportion to their shares up to their ceilings.
+func balanceShares(total float64, classes LimitClasses, used []float64,
+	unclassified float64) []float64 {
+	limits := make([]float64, len(classes))
+	spare := total - unclassified
+	var hungry []int
+	for i, c := range classes {
+		guarantee := c.Share * total
+		limits[i] = guarantee
+		if used[i] >= classHungryRatio*guarantee {
+			hungry = append(hungry, i)
+			spare -= guarantee
+		} else {
+			spare -= used[i]
+		}
+	}
+	for spare > 0 && len(hungry) > 0 {
+		var shares, given float64
+		for _, i := range hungry {
+			shares += classes[i].Share
+		}
+		var next []int
+		for _, i := range hungry {
+			extra := spare * classes[i].Share / shares
+			if ceil := classes[i].ceil() * total; limits[i]+extra >= ceil {
+				extra = math.Max(ceil-limits[i], 0)
+			} else {
+				next = append(next, i)
+			}
+			limits[i] += extra
+			given += extra
+		}
+		spare -= given
+		if len(next) == len(hungry) {
+			break
+		}
+		hungry = next
+	}
+	return limits
+}
+
+// ClassStats describes traffic of a limit class
+type ClassStats struct {
+	Name string `json:"name"`
+	// Limit class currently has (zero if tunnel isn't limited)
+	Limit       Limit `json:"limit"`
+	Connections int   `json:"connections"`
+	// Bytes per second class forwarded over the last second
+	Rate float64 `json:"rate"`
+}
+
+// UpdateClasses changes limit classes of a tunnel. Active connections are
+// reclassified right away.
+func (t *Tunnel) UpdateClasses(classes LimitClasses) error {
+	set, err := classes.set()
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateClasses <- set:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// applyClass moves connection to the class it currently matches (its traffic
+// pattern might have changed). Must be called on the tunnel goroutine.
+func (t *Tunnel) applyClass(conn *Connection) {
+	var traffic limiter.TrafficClass
+	if limConn, ok := conn.ingress.(*limiter.LimitedConnection); ok {
+		traffic = limConn.TrafficPattern().Class
+	}
+	class := t.classes.match(conn.meta(), traffic)
+	if class == conn.class {
+		return
+	}
+	if !t.updateConnectionShared(conn, conn.identity, class, conn.priorityLevel,
+		conn.subnet, conn.backend) {
+		return
+	}
+	conn.class = class
+	conn.className.Store(class.name())
+	if class != nil {
+		t.logf(LogDebug, "Connection %d at %q belongs to limit class %q", conn.ID(),
+			t.listenAt, class.Name)
+	}
+}
+
+// balanceClasses reclassifies connections and splits tunnel limit between
+// classes according to their current rates. Must be called on the tunnel
+// goroutine.
+func (t *Tunnel) balanceClasses(activeConnections *connectionRegistry) {
+	if t.classes == nil {
+		t.classStats.Store([]ClassStats(nil))
+		return
+	}
+	config := make(LimitClasses, len(t.classes.classes))
+	stats := make([]ClassStats, len(t.classes.classes))
+	used := make([]float64, len(t.classes.classes))
+	for i, c := range t.classes.classes {
+		config[i] = c.LimitClass
+		stats[i].Name = c.Name
+	}
+	var unclassified float64
+	for _, conn := range activeConnections.all() {
+		t.applyClass(conn)
+		current := conn.meter.throughput().Rate1s
+		if conn.class == nil {
+			unclassified += current
+			continue
+		}
+		used[conn.class.index] += current
+		stats[conn.class.index].Connections++
+		stats[conn.class.index].Rate += current
+	}
+	total := float64(t.tunnelLimit(t.currentLimits))
+	if total <= 0 {
+		for _, c := range t.classes.classes {
+			c.limiter.SetLimit(rate.Inf)
+		}
+		t.classStats.Store(stats)
+		return
+	}
+	for i, limit := range balanceShares(total, config, used, unclassified) {
+		if limit < 1 {
+			limit = 1
+		}
+		t.classes.classes[i].limiter.SetLimit(rate.Limit(limit))
+		stats[i].Limit = Limit(limit)
+	}
+	t.classStats.Store(stats)
+}
+
+// loadClassStats returns the latest snapshot of class stats
+func (t *Tunnel) loadClassStats() []ClassStats {
+	stats, _ := t.classStats.Load().([]ClassStats)
+	return stats
+}
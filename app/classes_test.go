@@ -0,0 +1,139 @@
+package app
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+)
+
+func TestBalanceShares(t *testing.T) {
+	classes := LimitClasses{
+		{Name: "bulk", Share: 0.7},
+		{Name: "interactive", Share: 0.3},
+	}
+	capped := LimitClasses{
+		{Name: "bulk", Share: 0.7, Ceil: 0.8},
+		{Name: "interactive", Share: 0.3},
+	}
+	cases := []struct {
+		name         string
+		classes      LimitClasses
+		used         []float64
+		unclassified float64
+		expected     []float64
+	}{
+		{"both busy", classes, []float64{2000, 500}, 0, []float64{700, 300}},
+		{"one idle", classes, []float64{700, 0}, 0, []float64{1000, 300}},
+		{"one light", classes, []float64{700, 100}, 0, []float64{900, 300}},
+		{"ceiling", capped, []float64{700, 0}, 0, []float64{800, 300}},
+		{"unclassified", classes, []float64{700, 0}, 200, []float64{800, 300}},
+	}
+	for _, c := range cases {
+		limits := balanceShares(1000, c.classes, c.used, c.unclassified)
+		for i := range limits {
+			if math.Abs(limits[i]-c.expected[i]) > 1e-6 {
+				t.Errorf("%s: expected limits %v, got %v", c.name, c.expected, limits)
+				break
+			}
+		}
+	}
+}
+
+func TestLimitClasses(t *testing.T) {
+	set, err := LimitClasses{
+		{Name: "office", Share: 0.2, Match: ClassMatch{Clients: []string{"10.0.0.0/8"}}},
+		{Name: "vip", Share: 0.2, Match: ClassMatch{Labels: Labels{"plan": "vip"}}},
+		{Name: "bulk", Share: 0.5, Match: ClassMatch{Traffic: limiter.TrafficBulk}},
+	}.set()
+	if err != nil {
+		t.Fatalf("Failed to parse classes: %v", err)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1000}
+	office := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	cases := []struct {
+		client   net.Addr
+		labels   Labels
+		traffic  limiter.TrafficClass
+		expected string
+	}{
+		{office, Labels{"plan": "vip"}, limiter.TrafficBulk, "office"},
+		{client, Labels{"plan": "vip"}, limiter.TrafficBulk, "vip"},
+		{client, Labels{"plan": "free"}, limiter.TrafficBulk, "bulk"},
+		{client, nil, limiter.TrafficInteractive, ""},
+	}
+	for _, c := range cases {
+		if class := set.match(connectionMeta{client: c.client, source: c.client,
+			labels: c.labels}, c.traffic); class.name() != c.expected {
+			t.Errorf("Expected %v %v %v to be in class %q, got %q", c.client, c.labels,
+				c.traffic, c.expected, class.name())
+		}
+	}
+
+	invalid := []LimitClasses{
+		{{Share: 0.5}},
+		{{Name: "a", Share: 0}},
+		{{Name: "a", Share: 0.5, Ceil: 0.4}},
+		{{Name: "a", Share: 0.6}, {Name: "b", Share: 0.6}},
+		{{Name: "a", Share: 0.1}, {Name: "a", Share: 0.1}},
+		{{Name: "a", Share: 0.1, Match: ClassMatch{Clients: []string{"office"}}}},
+		{{Name: "a", Share: 0.1, Match: ClassMatch{Traffic: "video"}}},
+	}
+	for _, classes := range invalid {
+		if err := classes.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", classes)
+		}
+	}
+}
+
+func TestTunnelClasses(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{TunnelLimit: 1000}, TunnelOptions{
+			Classes: LimitClasses{{Name: "local", Share: 0.5,
+				Match: ClassMatch{Clients: []string{"127.0.0.1"}}}},
+		})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		classes := tunnel.Stats().Classes
+		if len(connections) == 1 && connections[0].Class == "local" &&
+			len(classes) == 1 && classes[0].Connections == 1 {
+			if classes[0].Limit != 500 {
+				t.Errorf("Expected idle class to have its guaranteed share, got %+v",
+					classes[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection to be classified, got %+v and %+v",
+				connections, classes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := tunnel.UpdateClasses(nil); err != nil {
+		t.Fatalf("Failed to update classes: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for tunnel.Connections()[0].Class != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection to leave removed class")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// clientHelloTimeout is how long tunnel waits for the rest of TLS ClientHello
+// once client started sending it
+const clientHelloTimeout = time.Second
+
+const (
+	tlsRecordHeaderSize = 5
+	// Maximum length of plaintext TLS record
+	maxTLSRecordSize   = 1 << 14
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 0x01
+	tlsExtServerName   = 0x0000
+	tlsServerNameHost  = 0x00
+)
+
+// peekServerName reads TLS ClientHello if client starts with one and records
+// server name it asks for (SNI). Data read is kept to be forwarded first, so
+// TLS handshake goes on between client and upstream as is.
+func (c *Connection) peekServerName() error {
+	if err := c.fillPending(tlsRecordHeaderSize, preambleTimeout); err != nil {
+		return ignoreShortRead(err)
+	}
+	header := c.pending[:tlsRecordHeaderSize]
+	size := int(binary.BigEndian.Uint16(header[3:]))
+	if header[0] != tlsRecordHandshake || size > maxTLSRecordSize {
+		return nil
+	}
+	if err := c.fillPending(tlsRecordHeaderSize+size, clientHelloTimeout); err != nil {
+		return ignoreShortRead(err)
+	}
+	c.serverName = parseServerName(c.pending[tlsRecordHeaderSize : tlsRecordHeaderSize+size])
+	return nil
+}
+
+// fillPending reads from client until there are at least n bytes of pending
+// data or it stops sending for a given time
+func (c *Connection) fillPending(n int, timeout time.Duration) error {
+	if len(c.pending) >= n {
+		return nil
+	}
+	c.ingress.SetReadDeadline(time.Now().Add(timeout))
+	defer c.ingress.SetReadDeadline(time.Time{})
+	buf := make([]byte, n-len(c.pending))
+	read, err := io.ReadFull(c.ingress, buf)
+	c.pending = append(c.pending, buf[:read]...)
+	return err
+}
+
+// ignoreShortRead returns nil if client simply didn't send enough data, which
+// is left for forwarding to deal with
+func ignoreShortRead(err error) error {
+	if isTimeout(err) || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+// parseServerName returns host name requested by SNI extension of
+// ClientHello in a TLS handshake record. Returns empty string if there's none
+// or record isn't a ClientHello fitting in it.
+func parseServerName(record []byte) string {
+	r := &tlsReader{data: record}
+	if r.uint8() != tlsClientHello {
+		return ""
+	}
+	hello := r.next(r.uint24())
+	hello.next(2 + 32)         // Version and random
+	hello.next(hello.uint8())  // Session ID
+	hello.next(hello.uint16()) // Cipher suites
+	hello.next(hello.uint8())  // Compression methods
+	extensions := hello.next(hello.uint16())
+	for !extensions.failed && len(extensions.data) > 0 {
+		kind := extensions.uint16()
+		extension := extensions.next(extensions.uint16())
+		if kind != tlsExtServerName {
+			continue
+		}
+		names := extension.next(extension.uint16())
+		for !names.failed && len(names.data) > 0 {
+			nameType := names.uint8()
+			name := names.next(names.uint16())
+			if nameType == tlsServerNameHost && !name.failed {
+				return string(name.data)
+			}
+		}
+	}
+	return ""
+}
+
+// tlsReader reads big-endian fields of a TLS message. Reading past the end
+// fails the reader and yields zeroes.
+type tlsReader struct {
+	data   []byte
+	failed bool
+}
+
+// next returns a reader of the following n bytes and skips them
+func (r *tlsReader) next(n int) *tlsReader {
+	if r.failed || n > len(r.data) {
+		r.failed = true
+		return &tlsReader{failed: true}
+	}
+	result := &tlsReader{data: r.data[:n]}
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *tlsReader) uint8() int {
+	return r.uint(1)
+}
+
+func (r *tlsReader) uint16() int {
+	return r.uint(2)
+}
+
+func (r *tlsReader) uint24() int {
+	return r.uint(3)
+}
+
+func (r *tlsReader) uint(size int) int {
+	var result int
+	for _, b := range r.next(size).data {
+		result = result<<8 | int(b)
+	}
+	return result
+}
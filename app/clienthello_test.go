@@ -0,0 +1,45 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestPeekServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: "db.example.com"}).Handshake()
+
+	conn := NewConnection(server, "127.0.0.1:1", new(TunnelCounters))
+	if err := conn.peekServerName(); err != nil {
+		t.Fatalf("Failed to inspect ClientHello: %v", err)
+	}
+	if conn.serverName != "db.example.com" {
+		t.Errorf("Expected server name to be read from ClientHello, got %q",
+			conn.serverName)
+	}
+	if len(conn.pending) == 0 || conn.pending[0] != tlsRecordHandshake {
+		t.Errorf("Expected ClientHello to be kept for upstream")
+	}
+
+	// Other protocols are forwarded as is
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	defer server2.Close()
+	go client2.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	conn = NewConnection(server2, "127.0.0.1:1", new(TunnelCounters))
+	if err := conn.peekServerName(); err != nil {
+		t.Fatalf("Failed to inspect connection: %v", err)
+	}
+	if conn.serverName != "" || !bytes.HasPrefix([]byte("GET / HTTP/1.0"), conn.pending) {
+		t.Errorf("Expected plain text to be kept as is, got %q %q", conn.serverName,
+			conn.pending)
+	}
+
+	if name := parseServerName([]byte{tlsClientHello, 0, 0, 200, 3, 3}); name != "" {
+		t.Errorf("Expected truncated ClientHello to have no server name, got %q", name)
+	}
+}
@@ -3,13 +3,14 @@ package app
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // ListenAt is a type for listening specifications compatible with net.Listen
@@ -45,6 +46,15 @@ func (x *ConnectTo) UnmarshalJSON(data []byte) error {
 // Limit is a bandwidth limit expressed in bytes per second.
 type Limit int64
 
+const (
+	// Unlimited limit doesn't throttle traffic: connections never wait for it
+	Unlimited Limit = 0
+	// Blocked limit pauses traffic until it's changed: connections stay open,
+	// but nothing is read from them. Only tunnel and connection limits (including
+	// limits of individual connections) could be blocked.
+	Blocked Limit = -1
+)
+
 // uom stands for Unit Of Measurement. Units are BITS per second, not bytes
 var uomSuffixes = []struct {
 	unit string
@@ -56,6 +66,11 @@ var uomSuffixes = []struct {
 	{unit: "Kbps", mul: 1000, div: 8},
 	{unit: "Mbps", mul: 1000 * 1000, div: 8},
 	{unit: "Gbps", mul: 1000 * 1000 * 1000, div: 8},
+	// tc style bit units
+	{unit: "kbit", mul: 1000, div: 8},
+	{unit: "mbit", mul: 1000 * 1000, div: 8},
+	{unit: "gbit", mul: 1000 * 1000 * 1000, div: 8},
+	{unit: "bit", mul: 1, div: 8},
 	// tcptrack, on the other hand, uses <prefix>bytes per second where prefix
 	// is a power of 2, that's why I'm using powers of 1024 for bytes-per-second
 	// units
@@ -79,6 +94,90 @@ func parseSuffix(s string) (string, int64, int64) {
 	return s, 1, 1
 }
 
+// ParseLimit parses a bandwidth limit given as a number of bytes per second
+// optionally followed by a unit of bandwidth (e.g. "10Mbps", "100mbit" or
+// "1.5GBps"), an amount of data per second (e.g. "10MiB/s"), "unlimited" or
+// "blocked"
+func ParseLimit(s string) (Limit, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "unlimited":
+		return Unlimited, nil
+	case "blocked":
+		return Blocked, nil
+	}
+	numberString, mul, div := strings.TrimSpace(s), float64(1), float64(1)
+	if strings.HasSuffix(numberString, "/s") {
+		numberString = strings.TrimSuffix(numberString, "/s")
+		for _, v := range dataSizeSuffixes {
+			if strings.HasSuffix(numberString, v.unit) {
+				numberString, mul = strings.TrimSuffix(numberString, v.unit), v.mul
+				break
+			}
+		}
+	} else {
+		var m, d int64
+		numberString, m, d = parseSuffix(numberString)
+		mul, div = float64(m), float64(d)
+	}
+	number, err := strconv.ParseFloat(numberString, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, invalidLimit("Failed to parse %q", s)
+	}
+	if number < 0 {
+		return 0, invalidLimit("Negative values are not accepted as a bandwidth limit (%q)", s)
+	}
+	bytesPerSecond := number * mul / div
+	if bytesPerSecond >= math.MaxInt64 {
+		return 0, invalidLimit("Bandwidth limit %q is too large", s)
+	}
+	if bytesPerSecond > 0 && bytesPerSecond < 1 {
+		// Would be truncated to zero, which means unlimited
+		return 0, invalidLimit("Bandwidth limit %q is less than 1B/s", s)
+	}
+	return Limit(bytesPerSecond), nil
+}
+
+// limitUnits are units String picks from for limits, the largest first
+var limitUnits = []struct {
+	unit string
+	// Bytes per second in a unit times 8 (so that bits fit too)
+	bits int64
+}{
+	{"GiB/s", 8 * 1024 * 1024 * 1024},
+	{"Gbps", 1000 * 1000 * 1000},
+	{"MiB/s", 8 * 1024 * 1024},
+	{"Mbps", 1000 * 1000},
+	{"KiB/s", 8 * 1024},
+	{"Kbps", 1000},
+}
+
+// String formats a limit in the largest unit it's a whole number of (e.g.
+// "10MiB/s" or "100Mbps"). ParseLimit accepts the result.
+func (x Limit) String() string {
+	if x == Blocked {
+		return "blocked"
+	}
+	if x > 0 && int64(x) <= math.MaxInt64/8 {
+		bits := int64(x) * 8
+		for _, v := range limitUnits {
+			if bits%v.bits == 0 {
+				return fmt.Sprintf("%d%s", bits/v.bits, v.unit)
+			}
+		}
+	}
+	return fmt.Sprintf("%dB/s", int64(x))
+}
+
+// Set is an implementation of flag.Value for Limit
+func (x *Limit) Set(s string) error {
+	limit, err := ParseLimit(s)
+	if err != nil {
+		return err
+	}
+	*x = limit
+	return nil
+}
+
 // UnmarshalJSON is an implementation of json.Unmarshaler for Limit
 func (x *Limit) UnmarshalJSON(data []byte) error {
 	var bytesPerSecond int64
@@ -94,20 +193,14 @@ func (x *Limit) UnmarshalJSON(data []byte) error {
 			return err
 		}
 
-		numberString, mul, div := parseSuffix(s)
-		bytesPerSecond, err = strconv.ParseInt(numberString, 10, 64)
+		limit, err := ParseLimit(s)
 		if err != nil {
-			return fmt.Errorf("Failed to parse %q", s)
-		}
-		bytesPerSecond *= mul
-		bytesPerSecond /= div
-
-		if bytesPerSecond < 0 {
-			return fmt.Errorf("Negative values are not accepted as a bandwidth limit (%q)", s)
+			return err
 		}
+		bytesPerSecond = int64(limit)
 	}
 
-	if bytesPerSecond < 0 {
+	if bytesPerSecond < 0 && Limit(bytesPerSecond) != Blocked {
 		return fmt.Errorf("Negative values are not accepted as a bandwidth limit (%q)", bytesPerSecond)
 	}
 
@@ -115,18 +208,447 @@ func (x *Limit) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// dataSizeSuffixes are units of amounts of data. Following bandwidth units,
+// kilobytes are powers of 1024.
+var dataSizeSuffixes = []struct {
+	unit string
+	mul  float64
+}{
+	{"KiB", 1024},
+	{"MiB", 1024 * 1024},
+	{"GiB", 1024 * 1024 * 1024},
+	{"TiB", 1024 * 1024 * 1024 * 1024},
+	{"KB", 1024},
+	{"MB", 1024 * 1024},
+	{"GB", 1024 * 1024 * 1024},
+	{"TB", 1024 * 1024 * 1024 * 1024},
+	{"B", 1},
+}
+
+// parseDataSize parses an amount of data like "10MiB" or "1024"
+func parseDataSize(s string) (float64, error) {
+	number, mul := s, float64(1)
+	for _, v := range dataSizeSuffixes {
+		if strings.HasSuffix(s, v.unit) {
+			number, mul = strings.TrimSuffix(s, v.unit), v.mul
+			break
+		}
+	}
+	result, err := strconv.ParseFloat(number, 64)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("Invalid amount of data %q", s)
+	}
+	return result * mul, nil
+}
+
+// DataSize is an amount of data in bytes represented in JSON either as a
+// number or as a string with a unit (e.g. "50GiB")
+type DataSize int64
+
+// UnmarshalJSON is an implementation of json.Unmarshaler for DataSize
+func (x *DataSize) UnmarshalJSON(data []byte) error {
+	var bytes int64
+	if err := json.Unmarshal(data, &bytes); err == nil {
+		*x = DataSize(bytes)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	size, err := parseDataSize(s)
+	if err != nil {
+		return err
+	}
+	*x = DataSize(size)
+	return nil
+}
+
+// Duration is a time.Duration represented in JSON as a string accepted by
+// time.ParseDuration (e.g. "1.5s")
+type Duration time.Duration
+
+// UnmarshalJSON is an implementation of json.Unmarshaler for Duration
+func (x *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("Negative values are not accepted as a duration (%q)", s)
+	}
+	*x = Duration(d)
+	return nil
+}
+
+// MarshalJSON is an implementation of json.Marshaler for Duration
+func (x Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(x).String())
+}
+
 // ConfigurationJSON encapsulates application confituration as defined in
 // configuration file
 type ConfigurationJSON struct {
-	Tunnels map[ListenAt]TunnelConfigJSON `json:"tunnels"`
+	// Version of configuration format. See CurrentConfigVersion.
+	Version int                         `json:"version"`
+	Admin   AdminConfigJSON             `json:"admin"`
+	Tenants map[string]TenantConfigJSON `json:"tenants,omitempty"`
+	// Reusable sets of tunnel limits
+	Profiles map[string]TunnelLimits `json:"profiles,omitempty"`
+	// Groups sharing per-client limits across tunnels
+	IdentityGroups map[string]IdentityGroupConfigJSON `json:"identityGroups,omitempty"`
+	// Budgets of goroutines and memory shared by connections of tunnels
+	WorkerPools map[string]WorkerPoolConfigJSON `json:"workerPools,omitempty"`
+	// URLs notified about events
+	Webhooks map[string]WebhookConfigJSON `json:"webhooks,omitempty"`
+	// Sinks usage of tunnels is exported to
+	Exports map[string]ExportConfigJSON `json:"exports,omitempty"`
+	// Service registries tunnels having a service name are registered in
+	Registries map[string]RegistryConfigJSON `json:"registries,omitempty"`
+	Tunnels    map[ListenAt]TunnelConfigJSON `json:"tunnels"`
+	// DNS forwarding tunnels
+	DNS map[ListenAt]DNSConfigJSON `json:"dns,omitempty"`
+	// Bandwidth limit of all tunnels together (unlimited if zero)
+	GlobalLimit Limit `json:"globalLimit,omitempty"`
+	// Number of simultaneous upstream dials of all tunnels together
+	// (unlimited if zero)
+	MaxDials int `json:"maxDials,omitempty"`
+	// Port ranges tunnels are created for on first connection, e.g.
+	// "0.0.0.0:30000-30099". Destination may be a port range of the same size.
+	OnDemand map[ListenAt]TunnelConfigJSON `json:"onDemand,omitempty"`
 }
 
 // TunnelConfigJSON encapsulates configuration of an individual tunnel as
 // defined in configuration file
 type TunnelConfigJSON struct {
-	ConnectTo       ConnectTo `json:"connectTo"`
-	TunnelLimit     Limit     `json:"tunnelLimit"`
-	ConnectionLimit Limit     `json:"connectionLimit"`
+	ConnectTo ConnectTo `json:"connectTo"`
+	TunnelLimits
+	// Name of a tenant this tunnel belongs to. Tunnels without a tenant are
+	// only visible to the operator.
+	Tenant string `json:"tenant,omitempty"`
+	// Name of a profile tunnel takes its limits from. Tunnels using a profile
+	// must not specify limits of their own.
+	Profile string `json:"profile,omitempty"`
+	TunnelSettings
+	Exemptions
+	// If set, traffic to upstream is encrypted with TLS
+	UpstreamTLS *UpstreamTLS `json:"upstreamTLS,omitempty"`
+	// Hops upstream connections are made through, in order
+	Via []Hop `json:"via,omitempty"`
+	// Rules switching limits by time of day
+	Schedule Schedule `json:"schedule,omitempty"`
+	// Classes splitting tunnel limit between connections
+	Classes LimitClasses `json:"classes,omitempty"`
+	// Rules deciding which connections reach upstream
+	Access AccessRules `json:"access,omitempty"`
+	// Rules telling priorities of connections
+	Priorities PriorityRules `json:"priorities,omitempty"`
+	// Aggregate limits of connections from subnets
+	Subnets SubnetLimits `json:"subnets,omitempty"`
+	// Aggregate limits of connections to backends connectTo resolves to
+	Backends BackendLimits `json:"backends,omitempty"`
+	// Windows tunnel accepts connections in (always if nil)
+	Active *ActiveWindows `json:"active,omitempty"`
+	// Name tunnel is registered as in service registries (not registered if
+	// empty)
+	Service string `json:"service,omitempty"`
+}
+
+// AdminConfigJSON encapsulates configuration of admin API
+type AdminConfigJSON struct {
+	// Tokens granting operator privileges. If there are none, requests made
+	// from loopback addresses without a token are served with operator
+	// privileges.
+	Tokens []string `json:"tokens,omitempty"`
+	// Number of requests per second each caller is allowed to make and the
+	// number of requests it is allowed to make in a burst. Zero values stand
+	// for DefaultAdminRequestRate and DefaultAdminRequestBurst.
+	RequestRate  float64 `json:"requestRate,omitempty"`
+	RequestBurst int     `json:"requestBurst,omitempty"`
+}
+
+// DefaultAdminRequestRate is the default number of admin API requests per
+// second each caller is allowed to make
+const DefaultAdminRequestRate = 10
+
+// DefaultAdminRequestBurst is the default number of admin API requests each
+// caller is allowed to make in a burst
+const DefaultAdminRequestBurst = 20
+
+// String is an implementation of fmt.Stringer that keeps tokens out of logs
+func (a AdminConfigJSON) String() string {
+	return fmt.Sprintf("{tokens: %d, requestRate: %v, requestBurst: %v}",
+		len(a.Tokens), a.RequestRate, a.RequestBurst)
+}
+
+// spec returns specification of a tunnel listening at a given address as
+// defined by this configuration
+func (c TunnelConfigJSON) spec(listenAt ListenAt) TunnelSpec {
+	return TunnelSpec{
+		ListenAt:       listenAt,
+		ConnectTo:      c.ConnectTo,
+		Limits:         c.TunnelLimits,
+		Tenant:         c.Tenant,
+		Profile:        c.Profile,
+		Exemptions:     c.Exemptions,
+		UpstreamTLS:    c.UpstreamTLS,
+		TunnelSettings: c.TunnelSettings,
+		Via:            c.Via,
+		Schedule:       c.Schedule,
+		Classes:        c.Classes,
+		Access:         c.Access,
+		Priorities:     c.Priorities,
+		Subnets:        c.Subnets,
+		Backends:       c.Backends,
+		Active:         c.Active,
+		Service:        c.Service,
+	}
+}
+
+// equal tells whether two tunnel configurations are the same
+func (c TunnelConfigJSON) equal(other TunnelConfigJSON) bool {
+	return c.ConnectTo == other.ConnectTo && c.TunnelLimits == other.TunnelLimits &&
+		c.Tenant == other.Tenant && c.Profile == other.Profile &&
+		c.TunnelSettings == other.TunnelSettings &&
+		c.Exemptions.equal(other.Exemptions) && c.UpstreamTLS.equal(other.UpstreamTLS) &&
+		hopsEqual(c.Via, other.Via) && c.Schedule.equal(other.Schedule) &&
+		c.Classes.equal(other.Classes) && c.Access.equal(other.Access) &&
+		c.Priorities.equal(other.Priorities) && c.Subnets.equal(other.Subnets) &&
+		c.Backends.equal(other.Backends) &&
+		c.Active.equal(other.Active) && c.Service == other.Service
+}
+
+// TenantConfigJSON encapsulates configuration of a tenant - a namespace of
+// tunnels managed by a single team.
+type TenantConfigJSON struct {
+	// Token tenant uses to authenticate to admin API
+	Token string `json:"token"`
+	// Aggregate bandwidth limit of all tunnels belonging to the tenant
+	Limit Limit `json:"limit"`
+}
+
+// String is an implementation of fmt.Stringer that keeps token out of logs
+func (t TenantConfigJSON) String() string {
+	return fmt.Sprintf("{limit: %v}", t.Limit)
+}
+
+// validate checks configuration for inconsistencies that can't be detected
+// while parsing JSON
+func (c ConfigurationJSON) validate() error {
+	if c.Admin.RequestRate < 0 || c.Admin.RequestBurst < 0 {
+		return fmt.Errorf("Admin API request rate and burst must not be negative")
+	}
+	if c.GlobalLimit < 0 {
+		return fmt.Errorf("Global limit must not be negative")
+	}
+	if c.MaxDials < 0 {
+		return fmt.Errorf("Maximum number of dials must not be negative")
+	}
+	tokens := make(map[string]string)
+	for _, token := range c.Admin.Tokens {
+		if token == "" {
+			return fmt.Errorf("Admin token must not be empty")
+		}
+		tokens[token] = ""
+	}
+	for name, tenant := range c.Tenants {
+		if name == "" {
+			return fmt.Errorf("Tenant name must not be empty")
+		}
+		if tenant.Limit < 0 {
+			return fmt.Errorf("Limit of tenant %q must not be negative", name)
+		}
+		if tenant.Token == "" {
+			return fmt.Errorf("Tenant %q has no token", name)
+		}
+		if other, ok := tokens[tenant.Token]; ok {
+			if other == "" {
+				return fmt.Errorf("Tenant %q shares the token with operator", name)
+			}
+			return fmt.Errorf("Tenants %q and %q share the same token", other, name)
+		}
+		tokens[tenant.Token] = name
+	}
+	for name, group := range c.IdentityGroups {
+		if name == "" {
+			return fmt.Errorf("Identity group name must not be empty")
+		}
+		if err := group.validate(); err != nil {
+			return fmt.Errorf("Identity group %q: %v", name, err)
+		}
+	}
+	for name, pool := range c.WorkerPools {
+		if name == "" {
+			return fmt.Errorf("Worker pool name must not be empty")
+		}
+		if err := pool.validate(); err != nil {
+			return fmt.Errorf("Worker pool %q: %v", name, err)
+		}
+	}
+	for name, webhook := range c.Webhooks {
+		if name == "" {
+			return fmt.Errorf("Webhook name must not be empty")
+		}
+		if err := webhook.validate(); err != nil {
+			return fmt.Errorf("Webhook %q: %v", name, err)
+		}
+	}
+	for name, export := range c.Exports {
+		if name == "" {
+			return fmt.Errorf("Export name must not be empty")
+		}
+		if err := export.validate(); err != nil {
+			return fmt.Errorf("Export %q: %v", name, err)
+		}
+	}
+	for name, registry := range c.Registries {
+		if name == "" {
+			return fmt.Errorf("Registry name must not be empty")
+		}
+		if err := registry.validate(); err != nil {
+			return fmt.Errorf("Registry %q: %v", name, err)
+		}
+	}
+	for name, limits := range c.Profiles {
+		if err := validateProfile(name, limits); err != nil {
+			return err
+		}
+		if _, ok := c.IdentityGroups[limits.IdentityGroup]; limits.IdentityGroup != "" && !ok {
+			return fmt.Errorf("Profile %q uses unknown identity group %q", name,
+				limits.IdentityGroup)
+		}
+		if _, ok := c.WorkerPools[limits.WorkerPool]; limits.WorkerPool != "" && !ok {
+			return fmt.Errorf("Profile %q uses unknown worker pool %q", name, limits.WorkerPool)
+		}
+	}
+	for listenAt, tunnel := range c.Tunnels {
+		if err := validateAddresses(listenAt, tunnel.ConnectTo); err != nil {
+			return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+		}
+		if err := c.validateTunnel(listenAt, tunnel); err != nil {
+			return err
+		}
+	}
+	patterns := make([]ListenAt, 0, len(c.OnDemand))
+	for pattern, tunnel := range c.OnDemand {
+		if err := validateOnDemand(pattern, tunnel); err != nil {
+			return fmt.Errorf("On-demand tunnels %q: %v", pattern, err)
+		}
+		if err := c.validateTunnel(pattern, tunnel); err != nil {
+			return err
+		}
+		patterns = append(patterns, pattern)
+	}
+	for listenAt, dns := range c.DNS {
+		if _, err := parseAddress(string(listenAt), ""); err != nil {
+			return fmt.Errorf("DNS tunnel %q: %v", listenAt, err)
+		}
+		if err := dns.validate(); err != nil {
+			return fmt.Errorf("DNS tunnel %q: %v", listenAt, err)
+		}
+	}
+	// DNS tunnels listen for TCP as well
+	listenAts := make([]ListenAt, 0, len(c.Tunnels)+len(c.DNS))
+	for listenAt := range c.Tunnels {
+		listenAts = append(listenAts, listenAt)
+	}
+	for listenAt := range c.DNS {
+		if _, ok := c.Tunnels[listenAt]; ok {
+			return fmt.Errorf("Tunnel and DNS tunnel %q listen at the same address", listenAt)
+		}
+		listenAts = append(listenAts, listenAt)
+	}
+	sortListenAts(listenAts)
+	for i, listenAt := range listenAts {
+		if err := listenConflict(listenAt, listenAts[:i]); err != nil {
+			return err
+		}
+	}
+	sortListenAts(patterns)
+	for i, pattern := range patterns {
+		// Validated above
+		ports, _ := parsePortRange(string(pattern))
+		for _, other := range patterns[:i] {
+			if otherPorts, _ := parsePortRange(string(other)); ports.overlaps(otherPorts) {
+				return &ListenConflictError{ListenAt: pattern, Other: other}
+			}
+		}
+		for _, listenAt := range listenAts {
+			if ports.conflicts(listenAt) {
+				return &ListenConflictError{ListenAt: listenAt, Other: pattern}
+			}
+		}
+	}
+	return nil
+}
+
+// validateTunnel checks settings of a tunnel or a port range of on-demand
+// tunnels other than addresses
+func (c ConfigurationJSON) validateTunnel(listenAt ListenAt, tunnel TunnelConfigJSON) error {
+	if tunnel.Profile != "" {
+		if _, ok := c.Profiles[tunnel.Profile]; !ok {
+			return fmt.Errorf("Tunnel %q uses unknown profile %q", listenAt, tunnel.Profile)
+		}
+		if tunnel.TunnelLimits != (TunnelLimits{}) {
+			return fmt.Errorf("Tunnel %q specifies both a profile and limits", listenAt)
+		}
+	} else if err := tunnel.TunnelLimits.validate(); err != nil {
+		return withContext(err, "Tunnel %q", listenAt)
+	}
+	if err := tunnel.Schedule.validate(); err != nil {
+		return withContext(err, "Tunnel %q", listenAt)
+	}
+	if err := tunnel.TunnelSettings.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Exemptions.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Classes.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Access.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Priorities.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Subnets.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Backends.validate(); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := tunnel.Active.validate(); err != nil {
+		return withContext(err, "Tunnel %q", listenAt)
+	}
+	if err := tunnel.UpstreamTLS.validate(tunnel.ConnectTo); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := validateHops(tunnel.Via); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if err := validateService(tunnel.Service); err != nil {
+		return fmt.Errorf("Tunnel %q: %v", listenAt, err)
+	}
+	if group := tunnel.IdentityGroup; group != "" {
+		if _, ok := c.IdentityGroups[group]; !ok {
+			return fmt.Errorf("Tunnel %q uses unknown identity group %q", listenAt, group)
+		}
+	}
+	if pool := tunnel.WorkerPool; pool != "" {
+		if _, ok := c.WorkerPools[pool]; !ok {
+			return fmt.Errorf("Tunnel %q uses unknown worker pool %q", listenAt, pool)
+		}
+	}
+	if _, ok := c.Tenants[tunnel.Tenant]; tunnel.Tenant != "" && !ok {
+		return fmt.Errorf("Tunnel %q belongs to unknown tenant %q", listenAt, tunnel.Tenant)
+	}
+	return nil
 }
 
 // LoadAndWatch loads configuration from a given path, pushes it onto a
@@ -141,6 +663,14 @@ func LoadAndWatch(path string, configUpdate chan<- ConfigurationJSON, gs *gracef
 
 	configUpdate <- initial
 
+	Watch(path, configUpdate, gs)
+	return nil
+}
+
+// Watch starts listening for SIGUSR2 signals to reload configuration from a
+// given path until quit channel gets closed. Upon each SIGUSR2 configuration
+// is reloaded and sent to configUpdate.
+func Watch(path string, configUpdate chan<- ConfigurationJSON, gs *gracefulShutdown) {
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGUSR2)
 
@@ -163,23 +693,25 @@ func LoadAndWatch(path string, configUpdate chan<- ConfigurationJSON, gs *gracef
 			}
 		}
 	}()
-
-	return nil
 }
 
 func load(path string) (ConfigurationJSON, error) {
-	contents, err := ioutil.ReadFile(path)
+	raw, err := readConfiguration(path)
 	if err != nil {
 		log.Printf("Failed to read configuration file at %q: %v\n", path, err)
 		return ConfigurationJSON{}, err
 	}
 
-	temp := new(ConfigurationJSON)
-
-	if err = json.Unmarshal(contents, temp); err != nil {
+	result, err := parseRawConfiguration(raw)
+	if err != nil {
 		log.Printf("Failed to parse configuration file at %q: %v\n", path, err)
 		return ConfigurationJSON{}, err
 	}
 
-	return *temp, nil
+	if err = result.validate(); err != nil {
+		log.Printf("Invalid configuration file at %q: %v\n", path, err)
+		return ConfigurationJSON{}, err
+	}
+
+	return result, nil
 }
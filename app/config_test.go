@@ -19,4 +19,54 @@ func TestUnmarshalLimit(t *testing.T) {
 	if err != nil || limit != Limit(1) {
 		t.Errorf("Failed to unmarshal '8bps': %v %v", err, limit)
 	}
+	err = json.Unmarshal([]byte("-1"), &limit)
+	if err != nil || limit != Blocked {
+		t.Errorf("Failed to unmarshal '-1': %v %v", err, limit)
+	}
+	if err := json.Unmarshal([]byte("-2"), &limit); err == nil {
+		t.Errorf("Expected '-2' to be rejected")
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		s     string
+		limit Limit
+	}{
+		{"1000", 1000},
+		{"10MiB/s", 10 * 1024 * 1024},
+		{"100mbit", 100 * 1000 * 1000 / 8},
+		{"1.5GBps", 1536 * 1024 * 1024},
+		{"8Mbps", 1000 * 1000},
+		{"512B/s", 512},
+		{" 8bps ", 1},
+		{"0", 0},
+		{"unlimited", Unlimited},
+		{"Blocked", Blocked},
+	}
+	for _, c := range cases {
+		limit, err := ParseLimit(c.s)
+		if err != nil || limit != c.limit {
+			t.Errorf("Expected %q to be %d, got %d (%v)", c.s, c.limit, limit, err)
+		}
+	}
+	for _, s := range []string{"fast", "-1Mbps", "1e30GBps", "NaN", "10MiB",
+		" 7bps ", "1bps", "0.5B/s"} {
+		if _, err := ParseLimit(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+
+	for _, c := range []struct {
+		limit Limit
+		s     string
+	}{{0, "0B/s"}, {1000, "8Kbps"}, {10 * 1024 * 1024, "10MiB/s"},
+		{12500000, "100Mbps"}, {1000001, "1000001B/s"}, {Blocked, "blocked"}} {
+		if s := c.limit.String(); s != c.s {
+			t.Errorf("Expected %d to be formatted as %q, got %q", c.limit, c.s, s)
+		}
+		if limit, err := ParseLimit(c.s); err != nil || limit != c.limit {
+			t.Errorf("Expected %q to parse back to %d, got %d (%v)", c.s, c.limit, limit, err)
+		}
+	}
 }
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"time"
+)
+
+// belowMaxConnections tells whether tunnel could serve one more connection
+// given the number of active ones. Connections dialing upstream or waiting for
+// a dial count as well. Must be called on the tunnel goroutine.
+func (t *Tunnel) belowMaxConnections(active int, dials *dialScheduler) bool {
+	max := t.currentLimits.MaxConnections
+	return max == 0 || active+dials.pending() < max
+}
+
+// queueConnection starts a connection if tunnel could serve one more, makes it
+// wait for other connections to end or rejects it. Returns connections left
+// waiting. Must be called on the tunnel goroutine.
+func (t *Tunnel) queueConnection(conn *Connection, waiting []*Connection, active int,
+	dials *dialScheduler) []*Connection {
+	if t.belowMaxConnections(active, dials) {
+		t.startConnection(conn, dials)
+		return waiting
+	}
+	if len(waiting) < t.currentLimits.ConnectionQueue {
+		t.logf(LogDebug, "Connection %d at %q waits for other connections to end",
+			conn.ID(), t.listenAt)
+		return append(waiting, conn)
+	}
+	t.logf(LogWarn, "Rejected connection at %q since it has too many connections",
+		t.listenAt)
+	t.countClose(CloseRejected)
+	conn.Close()
+	t.notifyClosed(conn, CloseRejected, TunnelCounters{}, nil)
+	return waiting
+}
+
+// startConnection dials upstream for an accepted connection. Must be called
+// on the tunnel goroutine.
+func (t *Tunnel) startConnection(conn *Connection, dials *dialScheduler) {
+	if err := dials.recentFailure(time.Now(), conn.connectTo, t.currentLimits); err != nil {
+		t.dialFailed(conn, err)
+	} else if !dials.submit(conn, t.currentLimits) {
+		t.logf(LogWarn, "Rejected connection at %q since too many connections wait "+
+			"for upstream", t.listenAt)
+		t.countClose(CloseRejected)
+		conn.Close()
+		t.notifyClosed(conn, CloseRejected, TunnelCounters{}, nil)
+	}
+}
+
+// admitWaiting starts connections waiting for the number of connections to
+// drop below maximum as long as they fit and returns the ones left waiting.
+// Must be called on the tunnel goroutine.
+func (t *Tunnel) admitWaiting(waiting []*Connection, active int,
+	dials *dialScheduler) []*Connection {
+	for len(waiting) > 0 && t.belowMaxConnections(active, dials) {
+		conn := waiting[0]
+		waiting[0] = nil
+		waiting = waiting[1:]
+		t.logf(LogDebug, "Connection %d at %q no longer waits for other connections to end",
+			conn.ID(), t.listenAt)
+		t.startConnection(conn, dials)
+	}
+	return waiting
+}
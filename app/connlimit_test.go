@@ -0,0 +1,72 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaxConnections(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{MaxConnections: 1, ConnectionQueue: 1}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		return conn
+	}
+	waitConnections := func(n int) []ConnectionInfo {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			connections := tunnel.Connections()
+			if len(connections) == n {
+				return connections
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d connections, got %+v", n, connections)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first := dial()
+	defer first.Close()
+	firstID := waitConnections(1)[0].ID
+
+	waiting := dial()
+	defer waiting.Close()
+	refused := dial()
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection beyond queue to be refused, got %v", err)
+	}
+	if connections := waitConnections(1); connections[0].ID != firstID {
+		t.Fatalf("Expected only the first connection to be served, got %+v", connections)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseRejected] != 1 {
+		t.Errorf("Expected refused connection to be counted, got %v", closed)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		if len(connections) == 1 && connections[0].ID != firstID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected waiting connection to be served, got %+v", connections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// startControlServer serves admin API over a unix socket at a given path until
+// graceful shutdown is requested. Access to the socket is restricted to the
+// owner by file permissions, so every request made over it is served with
+// operator privileges.
+func startControlServer(path string, manager *TunnelManager, gs *gracefulShutdown) error {
+	// Socket left behind by a previous run that didn't shut down gracefully
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%q exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	handler := newAdminServer(manager, log.New(os.Stderr, "Control socket audit: ", log.LstdFlags))
+	handler.local = true
+	server := &http.Server{
+		Handler: handler,
+	}
+
+	gs.waitGroup.Add(1)
+	go func() {
+		defer gs.waitGroup.Done()
+		log.Printf("Serving control socket at %q", path)
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("Control socket server at %q failed: %v", path, err)
+		}
+	}()
+
+	go func() {
+		<-gs.quit
+		// Closing unix listener removes socket file
+		server.Close()
+	}()
+
+	return nil
+}
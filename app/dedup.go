@@ -0,0 +1,182 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxReconnectDelay is the maximum time connections could be held for to
+// coalesce reconnects
+const MaxReconnectDelay = 10 * time.Second
+
+// validateDedup checks duplicate connection guard settings of limits for
+// errors
+func (l TunnelLimits) validateDedup() error {
+	if l.MaxDuplicateConnections < 0 {
+		return fmt.Errorf("Maximum number of duplicate connections must not be negative")
+	}
+	if l.MaxClientConnections < 0 {
+		return fmt.Errorf("Maximum number of client connections must not be negative")
+	}
+	if l.ReconnectDelay < 0 || time.Duration(l.ReconnectDelay) > MaxReconnectDelay {
+		return fmt.Errorf("Reconnect delay must be between 0 and %v", MaxReconnectDelay)
+	}
+	return nil
+}
+
+// pairKey identifies connections of a client IP address to a destination
+type pairKey struct {
+	ip        string
+	connectTo ConnectTo
+}
+
+func connectionPair(conn *Connection) pairKey {
+	return pairKey{
+		ip:        addrIP(conn.ingress.RemoteAddr().String()).String(),
+		connectTo: conn.connectTo,
+	}
+}
+
+// pairState tracks connections of a client to a destination
+type pairState struct {
+	// Connections started or held, which haven't ended yet
+	connections int
+	// Time the latest connection was let through
+	started time.Time
+	// Connection held until reconnect delay passes (nil if there is none)
+	held *Connection
+}
+
+// Outcomes of admitting a connection by dedupGuard
+type dedupDecision int
+
+const (
+	dedupStart dedupDecision = iota
+	dedupHold
+	dedupReject
+	dedupRejectClient
+)
+
+// dedupGuard keeps track of connections of every client to every
+// destination, so that a client reconnecting in a loop can't flood upstream
+// through the tunnel. Owned by the tunnel goroutine.
+type dedupGuard struct {
+	pairs map[pairKey]*pairState
+	// Number of connections started or held by client IP address
+	clients map[string]int
+	// Receives pairs whose held connection could start
+	released chan pairKey
+	// Closed once guard is stopped
+	done chan struct{}
+}
+
+func newDedupGuard() *dedupGuard {
+	return &dedupGuard{
+		pairs:    make(map[pairKey]*pairState),
+		clients:  make(map[string]int),
+		released: make(chan pairKey),
+		done:     make(chan struct{}),
+	}
+}
+
+// admit decides whether a connection starts, is held until reconnect delay
+// since the previous connection of the same client to the same destination
+// passes or is rejected. A held connection supersedes the one held before it,
+// which is returned to be closed, so it doesn't count towards client limits.
+func (g *dedupGuard) admit(conn *Connection, now time.Time,
+	limits TunnelLimits) (dedupDecision, *Connection) {
+	key := connectionPair(conn)
+	pair, ok := g.pairs[key]
+	if !ok {
+		pair = new(pairState)
+		g.pairs[key] = pair
+	}
+	var superseded *Connection
+	if pair.held != nil {
+		// Held connection stops counting once it's closed
+		superseded = pair.held
+		pair.held = nil
+	} else if limits.MaxClientConnections > 0 &&
+		g.clients[key.ip] >= limits.MaxClientConnections {
+		return dedupRejectClient, nil
+	} else if limits.MaxDuplicateConnections > 0 &&
+		pair.connections >= limits.MaxDuplicateConnections {
+		return dedupReject, nil
+	}
+	pair.connections++
+	g.clients[key.ip]++
+	conn.deduplicated = true
+
+	delay := time.Duration(limits.ReconnectDelay)
+	if superseded != nil || (delay > 0 && now.Sub(pair.started) < delay) {
+		if superseded == nil {
+			g.release(key, pair.started.Add(delay).Sub(now))
+		}
+		pair.held = conn
+		return dedupHold, superseded
+	}
+	pair.started = now
+	return dedupStart, nil
+}
+
+// release lets held connection of a pair start after a given time
+func (g *dedupGuard) release(key pairKey, after time.Duration) {
+	time.AfterFunc(after, func() {
+		select {
+		case g.released <- key:
+		case <-g.done:
+		}
+	})
+}
+
+// ready returns held connection of a pair whose reconnect delay has passed
+// (nil if it has been closed meanwhile)
+func (g *dedupGuard) ready(key pairKey, now time.Time) *Connection {
+	pair, ok := g.pairs[key]
+	if !ok || pair.held == nil {
+		return nil
+	}
+	conn := pair.held
+	pair.held = nil
+	pair.started = now
+	return conn
+}
+
+// ended forgets a connection that is closed
+func (g *dedupGuard) ended(conn *Connection) {
+	if !conn.deduplicated {
+		return
+	}
+	conn.deduplicated = false
+	key := connectionPair(conn)
+	if pair, ok := g.pairs[key]; ok {
+		pair.connections--
+	}
+	if g.clients[key.ip]--; g.clients[key.ip] <= 0 {
+		delete(g.clients, key.ip)
+	}
+}
+
+// prune forgets pairs that have no connections and whose reconnect delay has
+// passed
+func (g *dedupGuard) prune(now time.Time, limits TunnelLimits) {
+	for key, pair := range g.pairs {
+		delay := time.Duration(limits.ReconnectDelay)
+		if pair.connections == 0 && now.Sub(pair.started) >= delay {
+			delete(g.pairs, key)
+		}
+	}
+}
+
+// stop returns held connections and stops releasing them
+func (g *dedupGuard) stop() []*Connection {
+	close(g.done)
+	var result []*Connection
+	for _, pair := range g.pairs {
+		if pair.held != nil {
+			result = append(result, pair.held)
+			pair.held = nil
+		}
+	}
+	return result
+}
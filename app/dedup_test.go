@@ -0,0 +1,126 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startGuardedTunnel creates a tunnel with given limits and returns a function
+// connecting to it and one waiting for a given number of its connections
+func startGuardedTunnel(t *testing.T, upstream net.Listener,
+	limits TunnelLimits) (*Tunnel, func() net.Conn, func(int)) {
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()), limits,
+		TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		return conn
+	}
+	wait := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(tunnel.Connections()) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d connections, got %+v", n, tunnel.Connections())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return tunnel, dial, wait
+}
+
+func TestMaxDuplicateConnections(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, dial, wait := startGuardedTunnel(t, upstream,
+		TunnelLimits{MaxDuplicateConnections: 1})
+	defer tunnel.Shutdown()
+
+	first := dial()
+	defer first.Close()
+	wait(1)
+	refused := dial()
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected duplicate connection to be refused, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseRejected] != 1 {
+		t.Errorf("Expected refused connection to be counted, got %v", closed)
+	}
+
+	// Client could connect again once its connection ends
+	first.Close()
+	wait(0)
+	second := dial()
+	defer second.Close()
+	wait(1)
+}
+
+func TestReconnectDelay(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	delay := 300 * time.Millisecond
+	tunnel, dial, wait := startGuardedTunnel(t, upstream,
+		TunnelLimits{ReconnectDelay: Duration(delay)})
+	defer tunnel.Shutdown()
+
+	start := time.Now()
+	first := dial()
+	defer first.Close()
+	wait(1)
+	first.Close()
+	wait(0)
+
+	// Reconnect storm only gets the last connection through once delay passes
+	superseded := dial()
+	defer superseded.Close()
+	last := dial()
+	defer last.Close()
+	superseded.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := superseded.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected superseded connection to be closed, got %v", err)
+	}
+	wait(1)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Expected reconnect to be held for %v, it took %v", delay, elapsed)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseSuperseded] != 1 {
+		t.Errorf("Expected superseded connection to be counted, got %v", closed)
+	}
+}
+
+func TestMaxClientConnections(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, dial, wait := startGuardedTunnel(t, upstream,
+		TunnelLimits{MaxClientConnections: 2})
+	defer tunnel.Shutdown()
+
+	first := dial()
+	defer first.Close()
+	second := dial()
+	defer second.Close()
+	wait(2)
+	refused := dial()
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection beyond client limit to be refused, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseRejected] != 1 {
+		t.Errorf("Expected refused connection to be counted, got %v", closed)
+	}
+
+	first.Close()
+	wait(1)
+	third := dial()
+	defer third.Close()
+	wait(2)
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMaxDials is the number of simultaneous dials to upstream a tunnel
+// makes unless limited otherwise
+const DefaultMaxDials = 64
+
+// DefaultDialQueue is the number of connections allowed to wait for a dial
+// slot unless limited otherwise
+const DefaultDialQueue = 1024
+
+// maxDials returns the number of simultaneous dials allowed by limits
+func (l TunnelLimits) maxDials() int {
+	if l.MaxDials == 0 {
+		return DefaultMaxDials
+	}
+	return l.MaxDials
+}
+
+// dialQueue returns the number of connections allowed by limits to wait for a
+// dial slot
+func (l TunnelLimits) dialQueue() int {
+	if l.DialQueue == 0 {
+		return DefaultDialQueue
+	}
+	return l.DialQueue
+}
+
+type dialResult struct {
+	conn   *Connection
+	egress net.Conn
+	err    error
+	// Set if client sent an invalid preamble or PROXY header or it's denied
+	// access (upstream isn't dialed then)
+	rejectErr error
+}
+
+// dialScheduler dials upstream for accepted connections, bounding the number
+// of simultaneous dials and queueing connections waiting for a dial slot.
+// Owned by the tunnel goroutine.
+type dialScheduler struct {
+	dialing map[*Connection]struct{}
+	queue   []*Connection
+	// Receives outcomes of dials
+	results chan dialResult
+	// Closed once scheduler is stopped
+	done chan struct{}
+	// The most recent dial failure, destination of the dial and the time it
+	// happened at (zero if the most recent dial succeeded)
+	failure  error
+	failedTo ConnectTo
+	failedAt time.Time
+}
+
+func newDialScheduler() *dialScheduler {
+	return &dialScheduler{
+		dialing: make(map[*Connection]struct{}),
+		results: make(chan dialResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// submit starts dialing upstream for a connection or queues it if there are
+// too many dials in flight already. Returns false if queue is full.
+func (s *dialScheduler) submit(conn *Connection, limits TunnelLimits) bool {
+	if len(s.dialing) < limits.maxDials() {
+		s.start(conn)
+		return true
+	}
+	if len(s.queue) < limits.dialQueue() {
+		s.queue = append(s.queue, conn)
+		return true
+	}
+	return false
+}
+
+// pending returns the number of connections dialing or waiting for a dial
+func (s *dialScheduler) pending() int {
+	return len(s.dialing) + len(s.queue)
+}
+
+// complete forgets a finished dial and starts queued ones that fit into
+// limits now
+func (s *dialScheduler) complete(conn *Connection, limits TunnelLimits) {
+	delete(s.dialing, conn)
+	s.fill(limits)
+}
+
+// fill starts queued dials that fit into limits
+func (s *dialScheduler) fill(limits TunnelLimits) {
+	for len(s.queue) > 0 && len(s.dialing) < limits.maxDials() {
+		conn := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.start(conn)
+	}
+}
+
+// recentFailure returns an error if a dial to a given destination failed
+// recently enough for its outcome to be reused according to limits
+func (s *dialScheduler) recentFailure(now time.Time, connectTo ConnectTo,
+	limits TunnelLimits) error {
+	if s.failure == nil || s.failedTo != connectTo || limits.DialFailureCache == 0 ||
+		now.Sub(s.failedAt) >= time.Duration(limits.DialFailureCache) {
+		return nil
+	}
+	return withContext(s.failure, "Upstream failed %v ago",
+		now.Sub(s.failedAt).Round(time.Millisecond))
+}
+
+// dialed records the outcome of a dial to a given destination. If dial failed
+// and failures are cached, queued connections to the same destination are
+// given up on and returned.
+func (s *dialScheduler) dialed(now time.Time, connectTo ConnectTo, err error,
+	limits TunnelLimits) []*Connection {
+	if err == nil {
+		if s.failedTo == connectTo {
+			s.failure = nil
+		}
+		return nil
+	}
+	s.failure = err
+	s.failedTo = connectTo
+	s.failedAt = now
+	if limits.DialFailureCache == 0 {
+		return nil
+	}
+	var result []*Connection
+	queue := s.queue[:0]
+	for _, conn := range s.queue {
+		if conn.connectTo == connectTo {
+			result = append(result, conn)
+		} else {
+			queue = append(queue, conn)
+		}
+	}
+	for i := len(queue); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = queue
+	return result
+}
+
+func (s *dialScheduler) start(conn *Connection) {
+	s.dialing[conn] = struct{}{}
+	go func() {
+		var result dialResult
+		result.rejectErr = conn.readMetadata()
+		if result.rejectErr == nil && conn.testMode != "" {
+			result.egress = startBandwidthTest(conn.testMode)
+		} else if result.rejectErr == nil {
+			result.egress, result.err = conn.dial()
+			if result.err == nil {
+				if err := conn.greetClient(); err != nil {
+					// Forwarding notices client is gone
+					log.Printf("Connection %d: %v", conn.ID(), err)
+				}
+				if conn.recordDir != "" {
+					if err := conn.startRecording(result.egress.RemoteAddr()); err != nil {
+						log.Printf("Connection %d: %v", conn.ID(), err)
+					}
+				}
+			}
+		}
+		result.conn = conn
+		egress := result.egress
+		select {
+		case s.results <- result:
+		case <-s.done:
+			if egress != nil {
+				egress.Close()
+			}
+			if conn.recorder != nil {
+				conn.recorder.close()
+			}
+		}
+	}()
+}
+
+// stop aborts dials in flight, closes client connections of dialing and
+// queued connections and returns them
+func (s *dialScheduler) stop() []*Connection {
+	close(s.done)
+	result := make([]*Connection, 0, len(s.dialing)+len(s.queue))
+	for conn := range s.dialing {
+		// Dial goroutine owns egress, so only ingress is closed here
+		conn.ctxCancel()
+		conn.ingress.Close()
+		result = append(result, conn)
+	}
+	for _, conn := range s.queue {
+		conn.Close()
+		result = append(result, conn)
+	}
+	return result
+}
+
+// DialGate bounds the number of simultaneous upstream dials of all tunnels
+// sharing it, so that a slow backend can't pile up dials across tunnels.
+// Dials beyond the limit wait for a slot in dial goroutines of their tunnels.
+// Safe for concurrent use.
+type DialGate struct {
+	mu *sync.Mutex
+	// Zero if dials are not limited
+	limit    int
+	inFlight int
+	// Dials waiting for a slot in order they came in, each is granted one by
+	// closing its channel
+	waiting []chan struct{}
+}
+
+// NewDialGate creates a DialGate letting through a given number of dials at
+// once (unlimited if zero)
+func NewDialGate(limit int) *DialGate {
+	return &DialGate{
+		mu:    new(sync.Mutex),
+		limit: limit,
+	}
+}
+
+// SetLimit changes the number of dials let through at once. Dials waiting
+// for a slot get one if it fits into the new limit, dials in flight over it
+// are let finish.
+func (g *DialGate) SetLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = limit
+	g.grant()
+}
+
+// InFlight returns the number of dials in flight and waiting for a slot
+func (g *DialGate) InFlight() (dialing, waiting int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inFlight, len(g.waiting)
+}
+
+// acquire takes a dial slot, waiting for one until ctx is done
+func (g *DialGate) acquire(ctx context.Context) error {
+	g.mu.Lock()
+	if len(g.waiting) == 0 && g.fits() {
+		g.inFlight++
+		g.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{})
+	g.waiting = append(g.waiting, granted)
+	g.mu.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, ch := range g.waiting {
+		if ch == granted {
+			g.waiting = append(g.waiting[:i], g.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// Slot was granted concurrently, so it's passed on
+	g.inFlight--
+	g.grant()
+	return ctx.Err()
+}
+
+// release returns a dial slot taken by acquire
+func (g *DialGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight--
+	g.grant()
+}
+
+// fits tells whether one more dial fits into the limit
+func (g *DialGate) fits() bool {
+	return g.limit == 0 || g.inFlight < g.limit
+}
+
+// grant hands slots that fit into the limit to waiting dials
+func (g *DialGate) grant() {
+	for len(g.waiting) > 0 && g.fits() {
+		g.inFlight++
+		close(g.waiting[0])
+		g.waiting[0] = nil
+		g.waiting = g.waiting[1:]
+	}
+}
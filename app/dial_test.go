@@ -0,0 +1,167 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialQueue(t *testing.T) {
+	// Upstream never completes TLS handshake, so dials stay in flight
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{MaxDials: 1, DialQueue: 1},
+		TunnelOptions{UpstreamTLS: &UpstreamTLS{Verify: VerifyNone}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	// The last connection doesn't fit into the queue
+	clients[2].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clients[2].Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected connection beyond dial queue to be closed, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseRejected] != 1 {
+		t.Errorf("Expected one rejected connection, got %v", closed)
+	}
+
+	tunnel.Shutdown()
+	for _, client := range clients[:2] {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+			t.Errorf("Expected dialing and queued connections to be closed on shutdown, got %v",
+				err)
+		}
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseTunnelShutdown] != 2 {
+		t.Errorf("Expected two connections closed by shutdown, got %v", closed)
+	}
+}
+
+func TestDialFailureCache(t *testing.T) {
+	upstream := startUpstream(t)
+	connectTo := ConnectTo(upstream.Addr().String())
+	upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", connectTo,
+		TunnelLimits{DialFailureCache: Duration(time.Minute)}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	dialFailures := func() int64 {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if n := tunnel.Stats().Closed[CloseDialFailure]; n > 0 {
+				return n
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return 0
+	}
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	if n := dialFailures(); n != 1 {
+		t.Fatalf("Expected dial to fail, got %d failures", n)
+	}
+
+	// Upstream is back, but tunnel doesn't know it yet
+	upstream, err = net.Listen("tcp", string(connectTo))
+	if err != nil {
+		t.Skipf("Failed to listen at the same address again: %v", err)
+	}
+	defer upstream.Close()
+	client, err = net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected connection to fail right away, got %v", err)
+	}
+	if n := tunnel.Stats().Closed[CloseDialFailure]; n != 2 {
+		t.Errorf("Expected cached failure to be counted as dial failure, got %d", n)
+	}
+	if connections := tunnel.Connections(); len(connections) != 0 {
+		t.Errorf("Expected no connections to upstream, got %+v", connections)
+	}
+}
+
+// waitDials waits until a given number of dials is in flight and waiting for
+// a slot of a dial gate
+func waitDials(t *testing.T, gate *DialGate, dialing, waiting int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d, w := gate.InFlight()
+		if d == dialing && w == waiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d dials in flight and %d waiting, got %d and %d",
+				dialing, waiting, d, w)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialGate(t *testing.T) {
+	// Upstream never completes TLS handshake, so dials stay in flight
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	gate := NewDialGate(1)
+	var tunnels []*Tunnel
+	for i := 0; i < 3; i++ {
+		tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+			TunnelLimits{}, TunnelOptions{
+				UpstreamTLS: &UpstreamTLS{Verify: VerifyNone},
+				Dials:       gate,
+			})
+		if err != nil {
+			t.Fatalf("Failed to create tunnel: %v", err)
+		}
+		defer tunnel.Shutdown()
+		tunnels = append(tunnels, tunnel)
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+	}
+	waitDials(t, gate, 1, 2)
+
+	// Waiting dial gives up once its tunnel shuts down
+	tunnels[2].Shutdown()
+	waitDials(t, gate, 1, 1)
+
+	// Raised limit lets the waiting dial through
+	gate.SetLimit(2)
+	waitDials(t, gate, 2, 0)
+
+	// Tunnel accepts connections while its dial is waiting
+	gate.SetLimit(1)
+	client, err := net.Dial("tcp", tunnels[0].listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	waitDials(t, gate, 2, 1)
+
+	// Dials that fail release their slots
+	upstream.Close()
+	waitDials(t, gate, 0, 0)
+}
@@ -0,0 +1,625 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of service registries tunnels could be registered in
+const (
+	// Consul agent HTTP API
+	RegistryConsul = "consul"
+	// etcd v3 JSON gateway. Keys are attached to a lease that expires unless
+	// throttle keeps it alive.
+	RegistryEtcd = "etcd"
+	// URL registrations are POSTed to as JSON
+	RegistryCallback = "callback"
+)
+
+// RegistryConfigJSON configures a service registry addresses of tunnels
+// having a service name are registered in
+type RegistryConfigJSON struct {
+	// RegistryConsul, RegistryEtcd or RegistryCallback
+	Type string `json:"type"`
+	// Consul agent (e.g. "http://127.0.0.1:8500"), etcd gateway (e.g.
+	// "http://127.0.0.1:2379") or callback URL
+	URL string `json:"url"`
+	// Consul ACL token or etcd auth token
+	Token string `json:"token,omitempty"`
+	// If set, callback requests carry HMAC-SHA256 of their body keyed with it
+	// in WebhookSignatureHeader
+	Secret string `json:"secret,omitempty"`
+	// Prefix of etcd keys (DefaultEtcdPrefix if empty)
+	Prefix string `json:"prefix,omitempty"`
+	// Host registered for tunnels listening at wildcard addresses (host name
+	// of the machine if empty)
+	Advertise string `json:"advertise,omitempty"`
+}
+
+// DefaultEtcdPrefix is the prefix of etcd keys unless configured otherwise.
+// Keys are followed by service name and address, e.g.
+// "/throttle/services/db/10.0.0.5:41234".
+const DefaultEtcdPrefix = "/throttle/services/"
+
+// registryTimeout is how long a registry is given to respond
+const registryTimeout = 10 * time.Second
+
+// etcdLeaseTTL is the lifetime of etcd keys unless their lease is kept alive,
+// which happens every registryRefreshInterval
+const etcdLeaseTTL = 30
+
+var registryRefreshInterval = 10 * time.Second
+
+// registryRetryDelay is the delay before registrations that failed are
+// retried
+var registryRetryDelay = 5 * time.Second
+
+// maxServiceName is the longest service name accepted (DNS label limit)
+const maxServiceName = 63
+
+// String is an implementation of fmt.Stringer that keeps secrets out of logs
+func (c RegistryConfigJSON) String() string {
+	return fmt.Sprintf("{type: %s, url: %s, prefix: %q, advertise: %q}", c.Type, c.URL,
+		c.Prefix, c.Advertise)
+}
+
+func (c RegistryConfigJSON) validate() error {
+	switch c.Type {
+	case RegistryConsul, RegistryEtcd, RegistryCallback:
+	default:
+		return fmt.Errorf("Unknown registry type %q", c.Type)
+	}
+	if err := (WebhookConfigJSON{URL: c.URL}).validate(); err != nil {
+		return err
+	}
+	if c.Secret != "" && c.Type != RegistryCallback {
+		return fmt.Errorf("Only callbacks sign their requests")
+	}
+	if c.Prefix != "" && c.Type != RegistryEtcd {
+		return fmt.Errorf("Only etcd keys have a prefix")
+	}
+	return nil
+}
+
+// validateService checks name of a service tunnel is registered as
+func validateService(name string) error {
+	if len(name) > maxServiceName {
+		return fmt.Errorf("Service name %q is longer than %d characters", name,
+			maxServiceName)
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') &&
+			c != '-' && c != '_' && c != '.' {
+			return fmt.Errorf("Service name %q may only contain letters, digits, "+
+				"'-', '_' and '.'", name)
+		}
+	}
+	return nil
+}
+
+// Registration is the address of a tunnel registered as an instance of a
+// service
+type Registration struct {
+	Service  string   `json:"service"`
+	ListenAt ListenAt `json:"listenAt"`
+	Tenant   string   `json:"tenant,omitempty"`
+	// Host and port clients reach the tunnel at
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// address returns host and port of a registration
+func (r Registration) address() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// newRegistration describes a tunnel listening at a given address registered
+// as a service. Host of listenAt is kept, port is the one tunnel actually
+// listens at (the first one of a port range).
+func newRegistration(service string, listenAt ListenAt, tenant string,
+	addr net.Addr) Registration {
+	result := Registration{
+		Service:  service,
+		ListenAt: listenAt,
+		Tenant:   tenant,
+	}
+	address := listenAt
+	if ports, err := parsePortRange(string(listenAt)); err == nil {
+		address = ListenAt(ports.port(ports.first))
+	}
+	if a, err := parseListenAddress(address); err == nil {
+		result.Host = a.host
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		result.Port = tcpAddr.Port
+	}
+	return result
+}
+
+// advertised returns registration as a registry publishes it: tunnels
+// listening at wildcard addresses are published at the advertised host
+func (c RegistryConfigJSON) advertised(r Registration) Registration {
+	ip := net.ParseIP(r.Host)
+	if r.Host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return r
+	}
+	r.Host = c.Advertise
+	if r.Host == "" {
+		r.Host, _ = os.Hostname()
+	}
+	return r
+}
+
+// registryBackend registers addresses in a particular kind of registry
+type registryBackend interface {
+	register(ctx context.Context, r Registration) error
+	deregister(ctx context.Context, r Registration) error
+	// refresh keeps registrations alive. Returns false if registry lost them,
+	// so that they have to be made again.
+	refresh(ctx context.Context) (bool, error)
+}
+
+// Registries keep addresses of tunnels registered in configured service
+// registries. Safe for concurrent use.
+type Registries struct {
+	mu         *sync.Mutex
+	client     *http.Client
+	registries map[string]*registry
+	// Registrations of all tunnels by their listening addresses, which
+	// registries configured later start with
+	current map[ListenAt]Registration
+}
+
+// registry keeps registrations up to date in a single registry on a goroutine
+// of its own
+type registry struct {
+	name    string
+	config  RegistryConfigJSON
+	backend registryBackend
+	mu      *sync.Mutex
+	desired map[ListenAt]Registration
+	// Signalled when desired registrations change
+	changed chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewRegistries creates an empty set of service registries
+func NewRegistries() *Registries {
+	return &Registries{
+		mu:         new(sync.Mutex),
+		client:     &http.Client{Timeout: registryTimeout},
+		registries: make(map[string]*registry),
+		current:    make(map[ListenAt]Registration),
+	}
+}
+
+// Configure replaces the set of registries. Registries whose configuration
+// changed are restarted: addresses are deregistered from the old one and
+// registered in the new one.
+func (r *Registries) Configure(config map[string]RegistryConfigJSON) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, reg := range r.registries {
+		if c, ok := config[name]; !ok || c != reg.config {
+			reg.stop()
+			delete(r.registries, name)
+		}
+	}
+	for name, c := range config {
+		if _, ok := r.registries[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		reg := &registry{
+			name:    name,
+			config:  c,
+			backend: newRegistryBackend(c, r.client),
+			mu:      new(sync.Mutex),
+			desired: make(map[ListenAt]Registration),
+			changed: make(chan struct{}, 1),
+			ctx:     ctx,
+			cancel:  cancel,
+			done:    make(chan struct{}),
+		}
+		for listenAt, v := range r.current {
+			reg.desired[listenAt] = c.advertised(v)
+		}
+		go reg.run()
+		r.registries[name] = reg
+	}
+}
+
+// Close deregisters all addresses and stops all registries
+func (r *Registries) Close() {
+	r.Configure(nil)
+}
+
+// config returns configuration of all registries
+func (r *Registries) config() map[string]RegistryConfigJSON {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.registries) == 0 {
+		return nil
+	}
+	result := make(map[string]RegistryConfigJSON, len(r.registries))
+	for name, reg := range r.registries {
+		result[name] = reg.config
+	}
+	return result
+}
+
+// Register registers address of a tunnel in all registries replacing its
+// previous registration, if any
+func (r *Registries) Register(reg Registration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current[reg.ListenAt] = reg
+	for _, v := range r.registries {
+		v.set(reg.ListenAt, v.config.advertised(reg))
+	}
+}
+
+// Deregister removes address of a tunnel listening at a given address from
+// all registries
+func (r *Registries) Deregister(listenAt ListenAt) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.current[listenAt]; !ok {
+		return
+	}
+	delete(r.current, listenAt)
+	for _, v := range r.registries {
+		v.remove(listenAt)
+	}
+}
+
+func (reg *registry) set(listenAt ListenAt, r Registration) {
+	reg.mu.Lock()
+	reg.desired[listenAt] = r
+	reg.mu.Unlock()
+	reg.notify()
+}
+
+func (reg *registry) remove(listenAt ListenAt) {
+	reg.mu.Lock()
+	delete(reg.desired, listenAt)
+	reg.mu.Unlock()
+	reg.notify()
+}
+
+func (reg *registry) notify() {
+	select {
+	case reg.changed <- struct{}{}:
+	default:
+	}
+}
+
+// stop deregisters all addresses and waits for registry goroutine to exit
+func (reg *registry) stop() {
+	reg.cancel()
+	<-reg.done
+}
+
+// run makes registrations match desired ones whenever they change, retrying
+// failed ones, until registry is stopped. Registrations are removed then.
+func (reg *registry) run() {
+	defer close(reg.done)
+	refresh := time.NewTicker(registryRefreshInterval)
+	defer refresh.Stop()
+	applied := make(map[ListenAt]Registration)
+	for {
+		var retry <-chan time.Time
+		reg.mu.Lock()
+		desired := make(map[ListenAt]Registration, len(reg.desired))
+		for k, v := range reg.desired {
+			desired[k] = v
+		}
+		reg.mu.Unlock()
+		if !reg.sync(reg.ctx, applied, desired) {
+			retry = time.After(registryRetryDelay)
+		}
+
+		select {
+		case <-reg.changed:
+		case <-retry:
+		case <-refresh.C:
+			ok, err := reg.backend.refresh(reg.ctx)
+			if err != nil {
+				log.Printf("Failed to refresh registrations in registry %q: %v", reg.name, err)
+			}
+			if !ok {
+				applied = make(map[ListenAt]Registration)
+			}
+		case <-reg.ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+			reg.sync(ctx, applied, nil)
+			cancel()
+			return
+		}
+	}
+}
+
+// sync deregisters applied registrations that are not desired and registers
+// desired ones that are not applied yet. Returns false if some of them
+// failed.
+func (reg *registry) sync(ctx context.Context, applied,
+	desired map[ListenAt]Registration) bool {
+	result := true
+	for listenAt, r := range applied {
+		if d, ok := desired[listenAt]; ok && d == r {
+			continue
+		}
+		if err := reg.backend.deregister(ctx, r); err != nil {
+			log.Printf("Failed to deregister %s at %s from registry %q: %v", r.Service,
+				r.address(), reg.name, err)
+			result = false
+			continue
+		}
+		log.Printf("Deregistered %s at %s from registry %q", r.Service, r.address(), reg.name)
+		delete(applied, listenAt)
+	}
+	for listenAt, r := range desired {
+		if _, ok := applied[listenAt]; ok {
+			continue
+		}
+		if err := reg.backend.register(ctx, r); err != nil {
+			if ctx.Err() != nil {
+				// Registry is being stopped, and the registration may have got
+				// through nevertheless
+				applied[listenAt] = r
+				return false
+			}
+			log.Printf("Failed to register %s at %s in registry %q: %v", r.Service,
+				r.address(), reg.name, err)
+			result = false
+			continue
+		}
+		log.Printf("Registered %s at %s in registry %q", r.Service, r.address(), reg.name)
+		applied[listenAt] = r
+	}
+	return result
+}
+
+func newRegistryBackend(c RegistryConfigJSON, client *http.Client) registryBackend {
+	switch c.Type {
+	case RegistryConsul:
+		return &consulRegistry{config: c, client: client}
+	case RegistryEtcd:
+		return &etcdRegistry{config: c, client: client}
+	default:
+		return &callbackRegistry{config: c, client: client}
+	}
+}
+
+// consulRegistry registers addresses as services of a Consul agent along
+// with TCP health checks, so that Consul removes them by itself if throttle
+// goes away without deregistering them
+type consulRegistry struct {
+	config RegistryConfigJSON
+	client *http.Client
+}
+
+// id returns ID of a service instance
+func (c *consulRegistry) id(r Registration) string {
+	return "throttle-" + r.Service + "-" + r.address()
+}
+
+func (c *consulRegistry) register(ctx context.Context, r Registration) error {
+	meta := map[string]string{"listenAt": string(r.ListenAt)}
+	if r.Tenant != "" {
+		meta["tenant"] = r.Tenant
+	}
+	return c.put(ctx, "/v1/agent/service/register", map[string]interface{}{
+		"ID":      c.id(r),
+		"Name":    r.Service,
+		"Address": r.Host,
+		"Port":    r.Port,
+		"Tags":    []string{"throttle"},
+		"Meta":    meta,
+		"Check": map[string]string{
+			"TCP":                            r.address(),
+			"Interval":                       "10s",
+			"DeregisterCriticalServiceAfter": "1m",
+		},
+	})
+}
+
+func (c *consulRegistry) deregister(ctx context.Context, r Registration) error {
+	return c.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(c.id(r)), nil)
+}
+
+func (c *consulRegistry) refresh(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (c *consulRegistry) put(ctx context.Context, path string, body interface{}) error {
+	req, err := newRegistryRequest(ctx, http.MethodPut, c.config.URL, path, body)
+	if err != nil {
+		return err
+	}
+	if c.config.Token != "" {
+		req.Header.Set("X-Consul-Token", c.config.Token)
+	}
+	return doRequest(c.client, req)
+}
+
+// etcdRegistry puts addresses as JSON encoded registrations under keys
+// attached to a lease it keeps alive
+type etcdRegistry struct {
+	config RegistryConfigJSON
+	client *http.Client
+	// Lease keys are attached to (empty until granted)
+	lease string
+}
+
+// etcdID is a 64-bit ID, which etcd gateway encodes as a string
+type etcdID string
+
+// UnmarshalJSON is an implementation of json.Unmarshaler for etcdID
+func (id *etcdID) UnmarshalJSON(data []byte) error {
+	*id = etcdID(strings.Trim(string(data), `"`))
+	return nil
+}
+
+func (e *etcdRegistry) key(r Registration) string {
+	prefix := e.config.Prefix
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	return prefix + r.Service + "/" + r.address()
+}
+
+func (e *etcdRegistry) register(ctx context.Context, r Registration) error {
+	if e.lease == "" {
+		var granted struct {
+			ID etcdID `json:"ID"`
+		}
+		if err := e.post(ctx, "/v3/lease/grant", map[string]interface{}{"TTL": etcdLeaseTTL},
+			&granted); err != nil {
+			return err
+		}
+		if granted.ID == "" {
+			return fmt.Errorf("etcd granted no lease")
+		}
+		e.lease = string(granted.ID)
+	}
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return e.post(ctx, "/v3/kv/put", map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(e.key(r))),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": e.lease,
+	}, nil)
+}
+
+func (e *etcdRegistry) deregister(ctx context.Context, r Registration) error {
+	return e.post(ctx, "/v3/kv/deleterange", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.key(r))),
+	}, nil)
+}
+
+// refresh keeps the lease alive. Keys are lost along with the lease once it
+// expires.
+func (e *etcdRegistry) refresh(ctx context.Context) (bool, error) {
+	if e.lease == "" {
+		return true, nil
+	}
+	var kept struct {
+		Result struct {
+			TTL etcdID `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := e.post(ctx, "/v3/lease/keepalive", map[string]string{"ID": e.lease},
+		&kept); err != nil {
+		return true, err
+	}
+	if kept.Result.TTL == "" || kept.Result.TTL == "0" {
+		e.lease = ""
+		return false, fmt.Errorf("etcd lease has expired")
+	}
+	return true, nil
+}
+
+func (e *etcdRegistry) post(ctx context.Context, path string, body, result interface{}) error {
+	req, err := newRegistryRequest(ctx, http.MethodPost, e.config.URL, path, body)
+	if err != nil {
+		return err
+	}
+	if e.config.Token != "" {
+		req.Header.Set("Authorization", e.config.Token)
+	}
+	if result == nil {
+		return doRequest(e.client, req)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Server responded with %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// callbackRegistry POSTs registrations to a URL along with the action taken
+// ("register" or "deregister")
+type callbackRegistry struct {
+	config RegistryConfigJSON
+	client *http.Client
+}
+
+func (c *callbackRegistry) register(ctx context.Context, r Registration) error {
+	return c.post(ctx, "register", r)
+}
+
+func (c *callbackRegistry) deregister(ctx context.Context, r Registration) error {
+	return c.post(ctx, "deregister", r)
+}
+
+func (c *callbackRegistry) refresh(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (c *callbackRegistry) post(ctx context.Context, action string, r Registration) error {
+	body, err := json.Marshal(struct {
+		Action string `json:"action"`
+		Registration
+	}{action, r})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader,
+			WebhookConfigJSON{Secret: c.config.Secret}.sign(body))
+	}
+	return doRequest(c.client, req)
+}
+
+// newRegistryRequest creates a request to a path of registry API with a JSON
+// body (none if nil)
+func newRegistryRequest(ctx context.Context, method, base, path string,
+	body interface{}) (*http.Request, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(base, "/")+path,
+		bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
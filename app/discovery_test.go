@@ -0,0 +1,166 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryConfigValidation(t *testing.T) {
+	cases := []struct {
+		config RegistryConfigJSON
+		ok     bool
+	}{
+		{RegistryConfigJSON{Type: RegistryConsul, URL: "http://127.0.0.1:8500"}, true},
+		{RegistryConfigJSON{Type: RegistryEtcd, URL: "http://etcd:2379", Prefix: "/x/"}, true},
+		{RegistryConfigJSON{Type: RegistryCallback, URL: "https://ci", Secret: "s"}, true},
+		{RegistryConfigJSON{Type: "zookeeper", URL: "http://zk"}, false},
+		{RegistryConfigJSON{Type: RegistryConsul, URL: "consul:8500"}, false},
+		{RegistryConfigJSON{Type: RegistryConsul, URL: "http://c", Secret: "s"}, false},
+		{RegistryConfigJSON{Type: RegistryCallback, URL: "http://c", Prefix: "/"}, false},
+	}
+	for _, c := range cases {
+		if err := c.config.validate(); (err == nil) != c.ok {
+			t.Errorf("%v: unexpected error %v", c.config, err)
+		}
+	}
+	if validateService("db-1.primary") != nil || validateService("db/1") == nil {
+		t.Errorf("Unexpected validation of service names")
+	}
+}
+
+func TestRegistrationAddress(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4zero, Port: 41234}
+	r := newRegistration("db", ":0", "acme", addr)
+	if r.Host != "" || r.Port != 41234 {
+		t.Errorf("Unexpected registration %+v", r)
+	}
+	if a := (RegistryConfigJSON{Advertise: "10.0.0.7"}).advertised(r); a.Host != "10.0.0.7" {
+		t.Errorf("Expected wildcard address to be advertised, got %+v", a)
+	}
+	r = newRegistration("db", "127.0.0.1:0", "", addr)
+	if a := (RegistryConfigJSON{Advertise: "10.0.0.7"}).advertised(r); a.Host != "127.0.0.1" {
+		t.Errorf("Expected specific address to be kept, got %+v", a)
+	}
+}
+
+// registryRequest is a request made to a fake registry
+type registryRequest struct {
+	method, path string
+	body         map[string]interface{}
+}
+
+func fakeRegistry(t *testing.T, respond func(path string) string) (*httptest.Server,
+	chan registryRequest) {
+	requests := make(chan registryRequest, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		req := registryRequest{method: r.Method, path: r.URL.Path}
+		if data, _ := ioutil.ReadAll(r.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &req.body); err != nil {
+				t.Errorf("Failed to decode request to %s: %v", r.URL.Path, err)
+			}
+		}
+		requests <- req
+		w.Write([]byte(respond(r.URL.Path)))
+	}))
+	return server, requests
+}
+
+func nextRegistryRequest(t *testing.T, requests chan registryRequest) registryRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Registry wasn't called")
+	}
+	return registryRequest{}
+}
+
+func TestConsulRegistry(t *testing.T) {
+	server, requests := fakeRegistry(t, func(string) string { return "" })
+	defer server.Close()
+
+	registries := NewRegistries()
+	registries.Register(Registration{Service: "db", ListenAt: "127.0.0.1:41234",
+		Host: "127.0.0.1", Port: 41234})
+	// Registries configured later register existing tunnels
+	registries.Configure(map[string]RegistryConfigJSON{
+		"consul": {Type: RegistryConsul, URL: server.URL},
+	})
+	r := nextRegistryRequest(t, requests)
+	if r.method != http.MethodPut || r.path != "/v1/agent/service/register" ||
+		r.body["Name"] != "db" || r.body["Address"] != "127.0.0.1" ||
+		r.body["Port"] != float64(41234) {
+		t.Errorf("Unexpected registration %+v", r)
+	}
+
+	// Closing registries deregisters everything
+	registries.Close()
+	r = nextRegistryRequest(t, requests)
+	if r.method != http.MethodPut ||
+		r.path != "/v1/agent/service/deregister/throttle-db-127.0.0.1:41234" {
+		t.Errorf("Unexpected deregistration %+v", r)
+	}
+}
+
+func TestEtcdRegistry(t *testing.T) {
+	defer func(interval time.Duration) {
+		registryRefreshInterval = interval
+	}(registryRefreshInterval)
+	registryRefreshInterval = 50 * time.Millisecond
+
+	mu := new(sync.Mutex)
+	leases := 0
+	server, requests := fakeRegistry(t, func(path string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch path {
+		case "/v3/lease/grant":
+			leases++
+			return `{"ID":"` + string(rune('0'+leases)) + `","TTL":"30"}`
+		case "/v3/lease/keepalive":
+			// The first lease expires
+			if leases == 1 {
+				return `{"result":{"ID":"1"}}`
+			}
+			return `{"result":{"ID":"2","TTL":"30"}}`
+		}
+		return "{}"
+	})
+	defer server.Close()
+
+	registries := NewRegistries()
+	defer registries.Close()
+	registries.Configure(map[string]RegistryConfigJSON{
+		"etcd": {Type: RegistryEtcd, URL: server.URL},
+	})
+	registries.Register(Registration{Service: "db", ListenAt: "127.0.0.1:41234",
+		Host: "127.0.0.1", Port: 41234})
+
+	for _, lease := range []string{"1", "2"} {
+		if r := nextRegistryRequest(t, requests); r.path != "/v3/lease/grant" {
+			t.Fatalf("Expected lease to be granted, got %+v", r)
+		}
+		r := nextRegistryRequest(t, requests)
+		key, _ := base64.StdEncoding.DecodeString(r.body["key"].(string))
+		value, _ := base64.StdEncoding.DecodeString(r.body["value"].(string))
+		if r.path != "/v3/kv/put" || string(key) != "/throttle/services/db/127.0.0.1:41234" ||
+			r.body["lease"] != lease || !strings.Contains(string(value), `"port":41234`) {
+			t.Errorf("Unexpected put %+v", r)
+		}
+		// Keys are put again once their lease expires
+		for lease == "1" {
+			if r := nextRegistryRequest(t, requests); r.path == "/v3/lease/keepalive" {
+				break
+			}
+		}
+	}
+}
@@ -1,12 +1,66 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
 )
 
+var errTunnelNotFound = errors.New("Tunnel not found")
+var errTenantNotFound = errors.New("Tenant not found")
+
+// tunnelShutdownTimeout is how long manager waits for connections of tunnels
+// it shuts down to stop before closing them forcibly
+const tunnelShutdownTimeout = 10 * time.Second
+
 type dispatchTunnel struct {
-	tunnel     *Tunnel
+	tunnel *Tunnel
+	// Limits of tunnel's own (or of its profile)
 	lastLimits TunnelLimits
+	lastShared []*rate.Limiter
+	tenant     string
+	// Name of a profile tunnel limits come from. Empty if tunnel has limits of
+	// its own.
+	profile     string
+	exemptions  Exemptions
+	classes     LimitClasses
+	access      AccessRules
+	settings    TunnelSettings
+	priorities  PriorityRules
+	subnets     SubnetLimits
+	backends    BackendLimits
+	upstreamTLS *UpstreamTLS
+	via         []Hop
+	// Port range pattern tunnel was created on demand for. Empty for tunnels
+	// that are created right away.
+	onDemand ListenAt
+	// Tunnel was made by CreateTunnel rather than configuration
+	ephemeral bool
+	// Name tunnel is registered as in service registries (not registered if
+	// empty)
+	service  string
+	schedule Schedule
+	// Limits tunnel runs with, which may come from its schedule
+	appliedLimits TunnelLimits
+	// Windows tunnel accepts connections in (nil if always) and whether it's
+	// suspended outside of them
+	active    *ActiveWindows
+	suspended suspension
+}
+
+type dispatchTenant struct {
+	config TenantConfigJSON
+	// Aggregate limiter shared by all tenant tunnels. Nil if tenant bandwidth
+	// is not limited.
+	limiter *rate.Limiter
 }
 
 type tunnelKey struct {
@@ -14,63 +68,694 @@ type tunnelKey struct {
 	connectTo ConnectTo
 }
 
-func dispatch(configUpdate <-chan ConfigurationJSON, gs *gracefulShutdown) {
-	gs.waitGroup.Add(1)
-	defer gs.waitGroup.Done()
+// TunnelInfo describes a running tunnel
+type TunnelInfo struct {
+	ListenAt  ListenAt     `json:"listenAt"`
+	ConnectTo ConnectTo    `json:"connectTo"`
+	Tenant    string       `json:"tenant,omitempty"`
+	Profile   string       `json:"profile,omitempty"`
+	Limits    TunnelLimits `json:"limits"`
+	TunnelSettings
+	Exemptions
+	UpstreamTLS *UpstreamTLS `json:"upstreamTLS,omitempty"`
+	Via         []Hop        `json:"via,omitempty"`
+	Stats       TunnelStats  `json:"stats"`
+	// Tunnel rejects new connections
+	Draining bool `json:"draining,omitempty"`
+	// Port range tunnel was created on demand for
+	OnDemand ListenAt `json:"onDemand,omitempty"`
+	// Tunnel was made by CreateTunnel and lasts until deleted
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// Address tunnel listens at if listenAt has zero port
+	Address string `json:"address,omitempty"`
+	// Name tunnel is registered as in service registries
+	Service  string   `json:"service,omitempty"`
+	Schedule Schedule `json:"schedule,omitempty"`
+	// Limits tunnel runs with instead of Limits because of its schedule
+	ScheduledLimits *TunnelLimits  `json:"scheduledLimits,omitempty"`
+	Classes         LimitClasses   `json:"classes,omitempty"`
+	Access          AccessRules    `json:"access,omitempty"`
+	Priorities      PriorityRules  `json:"priorities,omitempty"`
+	Subnets         SubnetLimits   `json:"subnets,omitempty"`
+	Backends        BackendLimits  `json:"backends,omitempty"`
+	Active          *ActiveWindows `json:"active,omitempty"`
+	// Tunnel is outside of its active windows
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+// TenantInfo describes a tenant and aggregate activity of its tunnels
+type TenantInfo struct {
+	Name    string      `json:"name"`
+	Limit   Limit       `json:"limit"`
+	Tunnels int         `json:"tunnels"`
+	Stats   TunnelStats `json:"stats"`
+}
+
+// TunnelManager starts, updates and shuts down tunnels according to
+// configuration and serves runtime requests to inspect and alter them. Tunnels
+// and tenants are owned by the manager goroutine, everyone else talks to it via
+// channels.
+type TunnelManager struct {
+	configUpdate <-chan ConfigurationJSON
+	requests     chan func()
+	persistence  *statePersistence
+	gs           *gracefulShutdown
+	events       *EventBus
+
+	admin    AdminConfigJSON
+	tunnels  map[tunnelKey]*dispatchTunnel
+	tenants  map[string]*dispatchTenant
+	profiles map[string]TunnelLimits
+	// Shared by all tunnels
+	identityGroups *IdentityGroups
+	workerPools    *WorkerPools
+	webhooks       *Webhooks
+	exports        *Exports
+	registries     *Registries
+	dials          *DialGate
+	resolvers      *Resolvers
+	dns            map[ListenAt]*DNSTunnel
+	// Limiter shared by all tunnels. Nil if their total bandwidth is not
+	// limited.
+	globalLimit   Limit
+	globalLimiter *rate.Limiter
+	// Port ranges tunnels are created for on first connection
+	onDemand map[ListenAt]*onDemandGroup
+	// Limits of the operating system read at startup
+	osLimits OSLimits
+}
+
+// newTunnelManager creates a TunnelManager that applies configuration coming
+// from configUpdate channel. Call start() to get it running.
+func newTunnelManager(configUpdate <-chan ConfigurationJSON,
+	persistence *statePersistence, gs *gracefulShutdown) *TunnelManager {
+	events := NewEventBus(DefaultEventHistory)
+	m := &TunnelManager{
+		configUpdate: configUpdate,
+		requests:     make(chan func()),
+		persistence:  persistence,
+		gs:           gs,
+		events:       events,
+
+		tunnels:  make(map[tunnelKey]*dispatchTunnel),
+		tenants:  make(map[string]*dispatchTenant),
+		profiles: make(map[string]TunnelLimits),
+
+		identityGroups: NewIdentityGroups(),
+		workerPools:    NewWorkerPools(),
+		webhooks:       NewWebhooks(events),
+		dials:          NewDialGate(0),
+		resolvers:      NewResolvers(),
+		dns:            make(map[ListenAt]*DNSTunnel),
+		onDemand:       make(map[ListenAt]*onDemandGroup),
+	}
+	m.exports = NewExports(m.usage)
+	m.registries = NewRegistries()
+	return m
+}
+
+func (m *TunnelManager) start() {
+	m.gs.waitGroup.Add(1)
+	go m.run()
+}
+
+func (m *TunnelManager) run() {
+	defer m.gs.waitGroup.Done()
+
+	// Schedules switch limits at minute boundaries
+	scheduleTimer := time.NewTimer(untilNextMinute(time.Now()))
+	defer scheduleTimer.Stop()
+
+	// Nil channel blocks forever which is exactly what we need if state
+	// persistence is disabled.
+	var saveTick <-chan time.Time
+	var snapshot chan os.Signal
+	if m.persistence.enabled() {
+		ticker := time.NewTicker(m.persistence.interval)
+		defer ticker.Stop()
+		saveTick = ticker.C
 
-	tunnels := make(map[tunnelKey]*dispatchTunnel)
+		// SIGUSR1 makes us save a state snapshot immediately
+		snapshot = make(chan os.Signal, 1)
+		signal.Notify(snapshot, syscall.SIGUSR1)
+		defer signal.Stop(snapshot)
+	}
 
 	for {
 		select {
-		case config := <-configUpdate:
+		case config := <-m.configUpdate:
 			log.Printf("Configuration update: %v", config)
-			// Sweep existing tunnels to shutdown ones that are no longer present in
-			// configuration:
-			survivors := make(map[tunnelKey]*dispatchTunnel)
-			for k, v := range tunnels {
-				configTunnel, ok := config.Tunnels[k.listenAt]
-				if ok && k.connectTo == configTunnel.ConnectTo {
-					survivors[k] = v
-				} else {
-					v.tunnel.Shutdown()
+			m.applyConfiguration(config)
+		case f := <-m.requests:
+			f()
+		case <-scheduleTimer.C:
+			m.applySchedules()
+			scheduleTimer.Reset(untilNextMinute(time.Now()))
+		case <-saveTick:
+			m.persistence.save(m)
+		case <-snapshot:
+			m.persistence.save(m)
+			log.Printf("Saved runtime state snapshot to %q", m.persistence.path)
+		case <-m.gs.quit:
+			ctx, cancel := context.WithTimeout(context.Background(), tunnelShutdownTimeout)
+			for _, v := range m.tunnels {
+				if err := v.tunnel.ShutdownContext(ctx); err != nil {
+					log.Print(err)
 				}
 			}
-
-			tunnels = survivors
-
-			// Sweep the map and update configuration for tunnels that need it
-			for k, v := range config.Tunnels {
-				tunnelKey := tunnelKey{
-					listenAt:  k,
-					connectTo: v.ConnectTo,
-				}
-				rateLimits := TunnelLimits{
-					TunnelLimit:     Limit(v.TunnelLimit),
-					ConnectionLimit: Limit(v.ConnectionLimit),
-				}
-				t, ok := tunnels[tunnelKey]
-				if ok {
-					if t.lastLimits != rateLimits {
-						t.tunnel.UpdateLimits(rateLimits)
-						t.lastLimits = rateLimits
-					}
-				} else {
-					t, err := NewTunnel(tunnelKey.listenAt, tunnelKey.connectTo, rateLimits)
-					if err != nil {
-						log.Printf("Failed to create tunnel for %q: %v", tunnelKey, err)
-					} else {
-						tunnels[tunnelKey] = &dispatchTunnel{
-							tunnel:     t,
-							lastLimits: rateLimits,
-						}
-					}
-				}
+			cancel()
+			for _, t := range m.dns {
+				t.Shutdown()
 			}
-		case <-gs.quit:
-			for _, v := range tunnels {
-				v.tunnel.Shutdown()
+			for _, g := range m.onDemand {
+				for _, l := range g.listeners {
+					l.Close()
+				}
 			}
+			m.persistence.save(m)
+			m.webhooks.Close()
+			m.exports.Close()
+			m.registries.Close()
 			return
 		} // select
 	} // for
 }
+
+func (m *TunnelManager) applyConfiguration(config ConfigurationJSON) {
+	m.admin = config.Admin
+
+	// Profiles are replaced as a whole. Tunnels using them get updated below.
+	m.profiles = make(map[string]TunnelLimits)
+	for name, limits := range config.Profiles {
+		m.profiles[name] = limits
+	}
+
+	m.identityGroups.Configure(config.IdentityGroups)
+	m.workerPools.Configure(config.WorkerPools)
+	m.webhooks.Configure(config.Webhooks)
+	m.exports.Configure(config.Exports)
+	m.registries.Configure(config.Registries)
+
+	// Global limiter and tenants go first, so that tunnels get attached to up to date tenant
+	// limiters.
+	for name := range m.tenants {
+		if _, ok := config.Tenants[name]; !ok {
+			delete(m.tenants, name)
+		}
+	}
+	for name, v := range config.Tenants {
+		t, ok := m.tenants[name]
+		if !ok {
+			m.tenants[name] = &dispatchTenant{
+				config:  v,
+				limiter: newTenantLimiter(v.Limit),
+			}
+			continue
+		}
+		if t.config.Limit != v.Limit {
+			t.limiter = newTenantLimiter(v.Limit)
+		}
+		t.config = v
+	}
+
+	if config.GlobalLimit != m.globalLimit {
+		m.setGlobalLimit(config.GlobalLimit)
+	}
+	m.dials.SetLimit(config.MaxDials)
+
+	specs := make([]TunnelSpec, 0, len(config.Tunnels))
+	for k, v := range config.Tunnels {
+		specs = append(specs, v.spec(k))
+	}
+	// Ports of ranges that are going away may be taken by regular tunnels and
+	// vice versa
+	m.pruneOnDemand(config.OnDemand)
+	report := m.reconcile(specs, func(string) bool { return true })
+	m.applyOnDemand(config.OnDemand)
+	m.applyDNS(config.DNS)
+	log.Printf("Configuration applied: %v", report)
+	for _, warning := range m.checkOSLimits().Warnings {
+		log.Printf("Warning: %s", warning)
+	}
+}
+
+// applyDNS starts and stops DNS tunnels to match configuration. Tunnels whose
+// configuration changed are restarted.
+func (m *TunnelManager) applyDNS(config map[ListenAt]DNSConfigJSON) {
+	for listenAt, t := range m.dns {
+		if c, ok := config[listenAt]; !ok || c != t.Config() {
+			t.Shutdown()
+			delete(m.dns, listenAt)
+		}
+	}
+	for listenAt, c := range config {
+		if _, ok := m.dns[listenAt]; ok {
+			continue
+		}
+		t, err := NewDNSTunnel(listenAt, c)
+		if err != nil {
+			log.Printf("Failed to start DNS tunnel at %q: %v", listenAt, err)
+			continue
+		}
+		m.dns[listenAt] = t
+	}
+}
+
+// DNSInfo describes a DNS tunnel
+type DNSInfo struct {
+	ListenAt ListenAt `json:"listenAt"`
+	DNSConfigJSON
+	Stats DNSStats `json:"stats"`
+}
+
+// ListDNS returns DNS tunnels ordered by their listening specification
+func (m *TunnelManager) ListDNS() []DNSInfo {
+	var result []DNSInfo
+	m.do(func() {
+		for listenAt, t := range m.dns {
+			result = append(result, DNSInfo{
+				ListenAt:      listenAt,
+				DNSConfigJSON: t.Config(),
+				Stats:         t.Stats(),
+			})
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ListenAt < result[j].ListenAt
+	})
+	return result
+}
+
+// sharedLimiters returns limiters to be shared by all tunnels of a given
+// tenant.
+func (m *TunnelManager) sharedLimiters(tenant string) []*rate.Limiter {
+	var result []*rate.Limiter
+	if m.globalLimiter != nil {
+		result = append(result, m.globalLimiter)
+	}
+	if t, ok := m.tenants[tenant]; ok && t.limiter != nil {
+		result = append(result, t.limiter)
+	}
+	return result
+}
+
+func newTenantLimiter(limit Limit) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	return limiter.CreateLimiter(rate.Limit(limit))
+}
+
+func sameLimiters(a, b []*rate.Limiter) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// do executes f on the manager goroutine and waits for it to complete. Returns
+// false if manager is shutting down and f wasn't executed.
+func (m *TunnelManager) do(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case m.requests <- func() {
+		f()
+		close(done)
+	}:
+	case <-m.gs.quit:
+		return false
+	}
+	<-done
+	return true
+}
+
+// doContext is like do, but gives up waiting for the manager goroutine once
+// context is cancelled
+func (m *TunnelManager) doContext(ctx context.Context, f func()) bool {
+	done := make(chan struct{})
+	select {
+	case m.requests <- func() {
+		f()
+		close(done)
+	}:
+	case <-m.gs.quit:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+	<-done
+	return true
+}
+
+// findTunnel returns running tunnel listening at a given spec. Must be called
+// on the manager goroutine.
+func (m *TunnelManager) findTunnel(listenAt ListenAt) (tunnelKey, *dispatchTunnel, bool) {
+	for k, v := range m.tunnels {
+		if k.listenAt == listenAt {
+			return k, v, true
+		}
+	}
+	return tunnelKey{}, nil, false
+}
+
+// ListTunnels returns information on all running tunnels ordered by listening
+// specification.
+func (m *TunnelManager) ListTunnels() []TunnelInfo {
+	var result []TunnelInfo
+	m.do(func() {
+		for k, v := range m.tunnels {
+			result = append(result, m.tunnelInfo(k, v))
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ListenAt < result[j].ListenAt
+	})
+	return result
+}
+
+// tunnelInfo describes a running tunnel. Must be called on the manager
+// goroutine.
+func (m *TunnelManager) tunnelInfo(k tunnelKey, v *dispatchTunnel) TunnelInfo {
+	result := TunnelInfo{
+		ListenAt:       k.listenAt,
+		ConnectTo:      k.connectTo,
+		Tenant:         v.tenant,
+		Profile:        v.profile,
+		Limits:         v.lastLimits,
+		Exemptions:     v.exemptions,
+		TunnelSettings: v.settings,
+		UpstreamTLS:    v.upstreamTLS,
+		Via:            v.via,
+		Stats:          v.tunnel.Stats(),
+		Draining:       v.tunnel.Draining(),
+		OnDemand:       v.onDemand,
+		Ephemeral:      v.ephemeral,
+		Service:        v.service,
+		Schedule:       v.schedule,
+		Classes:        v.classes,
+		Access:         v.access,
+		Priorities:     v.priorities,
+		Subnets:        v.subnets,
+		Backends:       v.backends,
+		Active:         v.active,
+		Suspended:      v.suspended != notSuspended,
+	}
+	if a, err := parseListenAddress(k.listenAt); err == nil && a.port == 0 {
+		result.Address = v.tunnel.Addr().String()
+	}
+	if v.appliedLimits != v.lastLimits {
+		scheduled := v.appliedLimits
+		result.ScheduledLimits = &scheduled
+	}
+	return result
+}
+
+// UpdateTunnelLimits changes limits of a running tunnel. Tunnel stops following
+// its profile, if any. The change lasts until configuration sets different
+// limits for the tunnel.
+func (m *TunnelManager) UpdateTunnelLimits(listenAt ListenAt, limits TunnelLimits) error {
+	err := errTunnelNotFound
+	m.do(func() {
+		if k, t, ok := m.findTunnel(listenAt); ok {
+			t.lastLimits = limits
+			m.applyLimits(t)
+			t.profile = ""
+			m.publishTunnelEvent(EventTunnelUpdated, k, t)
+			err = nil
+		}
+	})
+	return err
+}
+
+// ListConnections returns active connections of a tunnel
+func (m *TunnelManager) ListConnections(listenAt ListenAt) ([]ConnectionInfo, error) {
+	var tunnel *Tunnel
+	m.do(func() {
+		if _, t, ok := m.findTunnel(listenAt); ok {
+			tunnel = t.tunnel
+		}
+	})
+	if tunnel == nil {
+		return nil, errTunnelNotFound
+	}
+	return tunnel.Connections(), nil
+}
+
+// UpdateConnectionLimit moves an active connection of a tunnel to a different
+// per-connection limit without interrupting it. Nil limit makes connection
+// subject to the tunnel connection limit again.
+func (m *TunnelManager) UpdateConnectionLimit(listenAt ListenAt, id uint64,
+	limit *Limit) error {
+	var tunnel *Tunnel
+	m.do(func() {
+		if _, t, ok := m.findTunnel(listenAt); ok {
+			tunnel = t.tunnel
+		}
+	})
+	if tunnel == nil {
+		return errTunnelNotFound
+	}
+	// Tunnel is asked outside of the manager goroutine, so that manager is not
+	// held up by a busy tunnel
+	return tunnel.UpdateConnectionLimit(id, limit)
+}
+
+// BoostConnection moves an active connection of a tunnel to a different limit
+// for a given time, after which connection gets the limit it had before
+func (m *TunnelManager) BoostConnection(listenAt ListenAt, id uint64, limit Limit,
+	duration time.Duration) error {
+	var tunnel *Tunnel
+	m.do(func() {
+		if _, t, ok := m.findTunnel(listenAt); ok {
+			tunnel = t.tunnel
+		}
+	})
+	if tunnel == nil {
+		return errTunnelNotFound
+	}
+	return tunnel.BoostConnection(id, limit, duration)
+}
+
+// CloseConnection forcibly closes an active connection of a tunnel
+func (m *TunnelManager) CloseConnection(listenAt ListenAt, id uint64) error {
+	var tunnel *Tunnel
+	m.do(func() {
+		if _, t, ok := m.findTunnel(listenAt); ok {
+			tunnel = t.tunnel
+		}
+	})
+	if tunnel == nil {
+		return errTunnelNotFound
+	}
+	return tunnel.CloseConnection(id)
+}
+
+// CloseConnections forcibly closes active connections of a tunnel matching a
+// filter. Returns identifiers of closed connections.
+func (m *TunnelManager) CloseConnections(listenAt ListenAt,
+	filter *ConnectionFilter) ([]uint64, error) {
+	return m.forMatchingConnections(listenAt, filter, func(t *Tunnel, id uint64) error {
+		return t.CloseConnection(id)
+	})
+}
+
+// UpdateConnectionLimits moves active connections of a tunnel matching a filter
+// to a different per-connection limit. Returns identifiers of updated
+// connections.
+func (m *TunnelManager) UpdateConnectionLimits(listenAt ListenAt, filter *ConnectionFilter,
+	limit *Limit) ([]uint64, error) {
+	return m.forMatchingConnections(listenAt, filter, func(t *Tunnel, id uint64) error {
+		return t.UpdateConnectionLimit(id, limit)
+	})
+}
+
+// forMatchingConnections calls a function for every active connection of a
+// tunnel matching a filter. Returns identifiers of connections the function
+// succeeded for.
+func (m *TunnelManager) forMatchingConnections(listenAt ListenAt, filter *ConnectionFilter,
+	f func(t *Tunnel, id uint64) error) ([]uint64, error) {
+	var tunnel *Tunnel
+	m.do(func() {
+		if _, t, ok := m.findTunnel(listenAt); ok {
+			tunnel = t.tunnel
+		}
+	})
+	if tunnel == nil {
+		return nil, errTunnelNotFound
+	}
+	result := make([]uint64, 0)
+	for _, c := range tunnel.Connections() {
+		if !filter.Match(c) {
+			continue
+		}
+		// Connection might have completed since it was listed
+		if err := f(tunnel, c.ID); err == nil {
+			result = append(result, c.ID)
+		} else if err != errConnectionNotFound && err != ErrTunnelClosed {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// SetTunnelDraining makes a tunnel reject new connections while letting active
+// ones run to completion, or makes it accept connections again
+func (m *TunnelManager) SetTunnelDraining(listenAt ListenAt, draining bool) error {
+	err := errTunnelNotFound
+	m.do(func() {
+		if k, t, ok := m.findTunnel(listenAt); ok {
+			if t.tunnel.Draining() != draining {
+				t.tunnel.SetDraining(draining)
+				m.publishTunnelEvent(EventTunnelUpdated, k, t)
+			}
+			err = nil
+		}
+	})
+	return err
+}
+
+// ListTenants returns information on all configured tenants ordered by name.
+func (m *TunnelManager) ListTenants() []TenantInfo {
+	var result []TenantInfo
+	m.do(func() {
+		for name, v := range m.tenants {
+			info := TenantInfo{
+				Name:  name,
+				Limit: v.config.Limit,
+			}
+			for _, t := range m.tunnels {
+				if t.tenant == name {
+					info.Tunnels++
+					info.Stats = info.Stats.Add(t.tunnel.Stats())
+				}
+			}
+			result = append(result, info)
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// UpdateTenantLimit changes aggregate bandwidth limit of a tenant. The change
+// lasts until configuration sets a different limit for the tenant.
+func (m *TunnelManager) UpdateTenantLimit(name string, limit Limit) error {
+	if limit < 0 {
+		return invalidLimit("Tenant limit must not be negative")
+	}
+	err := errTenantNotFound
+	m.do(func() {
+		tenant, ok := m.tenants[name]
+		if !ok {
+			return
+		}
+		err = nil
+		if tenant.config.Limit == limit {
+			return
+		}
+		tenant.config.Limit = limit
+		tenant.limiter = newTenantLimiter(limit)
+		shared := m.sharedLimiters(name)
+		for _, t := range m.tunnels {
+			if t.tenant == name {
+				t.tunnel.UpdateSharedLimiters(shared)
+				t.lastShared = shared
+			}
+		}
+	})
+	return err
+}
+
+// GlobalLimit returns bandwidth limit of all tunnels together (zero if
+// unlimited)
+func (m *TunnelManager) GlobalLimit() Limit {
+	var result Limit
+	m.do(func() {
+		result = m.globalLimit
+	})
+	return result
+}
+
+// WorkerPools returns configured worker pools along with resources their
+// connections use
+func (m *TunnelManager) WorkerPools() []WorkerPoolInfo {
+	return m.workerPools.Info()
+}
+
+// UpdateGlobalLimit changes bandwidth limit of all tunnels together. The
+// change lasts until configuration sets a different limit.
+func (m *TunnelManager) UpdateGlobalLimit(limit Limit) error {
+	if limit < 0 {
+		return invalidLimit("Global limit must not be negative")
+	}
+	m.do(func() {
+		if limit != m.globalLimit {
+			m.setGlobalLimit(limit)
+			m.updateSharedLimiters()
+		}
+	})
+	return nil
+}
+
+// setGlobalLimit replaces the limiter shared by all tunnels. Tunnels are
+// attached to it by updateSharedLimiters or reconcile. Must be called on the
+// manager goroutine.
+func (m *TunnelManager) setGlobalLimit(limit Limit) {
+	log.Printf("Global limit changed to %v", limit)
+	m.globalLimit = limit
+	m.globalLimiter = newTenantLimiter(limit)
+}
+
+// updateSharedLimiters attaches all tunnels to up to date shared limiters.
+// Must be called on the manager goroutine.
+func (m *TunnelManager) updateSharedLimiters() {
+	for _, t := range m.tunnels {
+		shared := m.sharedLimiters(t.tenant)
+		if !sameLimiters(t.lastShared, shared) {
+			t.tunnel.UpdateSharedLimiters(shared)
+			t.lastShared = shared
+		}
+	}
+}
+
+// Subscribe returns a subscription to tunnel and connection events published
+// after an event with a given cursor (zero means new events only).
+func (m *TunnelManager) Subscribe(after uint64) (*Subscription, error) {
+	return m.events.Subscribe(after)
+}
+
+// publishTunnelEvent publishes an event about a given tunnel. Must be called on
+// the manager goroutine.
+func (m *TunnelManager) publishTunnelEvent(eventType EventType, key tunnelKey,
+	t *dispatchTunnel) {
+	m.events.Publish(Event{
+		Type:     eventType,
+		ListenAt: key.listenAt,
+		Tenant:   t.tenant,
+		Tunnel: &TunnelEvent{
+			ConnectTo: key.connectTo,
+			Limits:    t.lastLimits,
+			Draining:  t.tunnel.Draining(),
+		},
+	})
+}
+
+// credentials returns admin API configuration and a map of tenant tokens to
+// tenant names.
+func (m *TunnelManager) credentials() (AdminConfigJSON, map[string]string) {
+	var admin AdminConfigJSON
+	tenants := make(map[string]string)
+	m.do(func() {
+		admin = m.admin
+		for name, v := range m.tenants {
+			tenants[v.config.Token] = name
+		}
+	})
+	return admin, tenants
+}
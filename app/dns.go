@@ -0,0 +1,309 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
+)
+
+// DNSConfigJSON encapsulates configuration of a DNS forwarding tunnel. DNS
+// tunnels forward queries both over UDP and over TCP.
+type DNSConfigJSON struct {
+	// Resolver queries are forwarded to (port 53 if omitted)
+	Resolver string `json:"resolver"`
+	// Bandwidth limit of all queries and responses together (unlimited if
+	// zero)
+	Limit Limit `json:"limit,omitempty"`
+	// Number of queries a single client (by IP address) is allowed to make
+	// per second (unlimited if zero). Every TCP connection counts as a query.
+	QueryRate float64 `json:"queryRate,omitempty"`
+}
+
+// validate checks DNS tunnel configuration for errors
+func (c DNSConfigJSON) validate() error {
+	if c.Resolver == "" {
+		return fmt.Errorf("DNS resolver must be specified")
+	}
+	if _, err := parseAddress(c.Resolver, "53"); err != nil {
+		return fmt.Errorf("Invalid DNS resolver: %v", err)
+	}
+	if c.Limit < 0 || c.QueryRate < 0 {
+		return fmt.Errorf("DNS limits must not be negative")
+	}
+	return nil
+}
+
+// resolver returns resolver address with a port
+func (c DNSConfigJSON) resolver() string {
+	addr, err := parseAddress(c.Resolver, "53")
+	if err != nil {
+		return c.Resolver
+	}
+	return addr.String()
+}
+
+// dnsTimeout is how long DNS tunnel waits for a resolver to respond to a UDP
+// query
+const dnsTimeout = 5 * time.Second
+
+// maxDNSQueries limits the number of UDP queries forwarded simultaneously.
+// Queries beyond that are dropped, so clients retry them.
+const maxDNSQueries = 1024
+
+// dnsHeaderSize is the size of DNS message header
+const dnsHeaderSize = 12
+
+// DNSStats holds numbers of UDP queries handled by a DNS tunnel and traffic
+// forwarded by it over both UDP and TCP
+type DNSStats struct {
+	// Queries answered by resolver
+	Forwarded int64 `json:"forwarded"`
+	// Queries refused because client exceeded its query rate
+	Refused int64 `json:"refused"`
+	// Queries dropped or left unanswered by resolver
+	Failed   int64          `json:"failed"`
+	Counters TunnelCounters `json:"counters"`
+}
+
+// DNSTunnel forwards DNS queries to a resolver limiting bandwidth and query
+// rate of clients
+type DNSTunnel struct {
+	listenAt ListenAt
+	config   DNSConfigJSON
+	udp      net.PacketConn
+	// Forwards queries over TCP
+	tcp *Tunnel
+	// Nil if bandwidth isn't limited
+	limiter  *rate.Limiter
+	queries  *queryLimiter
+	inflight chan struct{}
+	// Updated atomically. Counters only account UDP traffic.
+	stats     DNSStats
+	waitGroup *sync.WaitGroup
+}
+
+// NewDNSTunnel creates a DNS forwarding tunnel listening at a given address
+// both for UDP and TCP
+func NewDNSTunnel(listenAt ListenAt, config DNSConfigJSON) (*DNSTunnel, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenPacket("udp", string(listenAt))
+	if err != nil {
+		return nil, &Error{Kind: ErrListenFailed, Err: err}
+	}
+	t := &DNSTunnel{
+		listenAt:  listenAt,
+		config:    config,
+		udp:       udp,
+		queries:   newQueryLimiter(config.QueryRate),
+		inflight:  make(chan struct{}, maxDNSQueries),
+		waitGroup: new(sync.WaitGroup),
+	}
+	if config.Limit > 0 {
+		t.limiter = limiter.CreateLimiter(rate.Limit(config.Limit))
+	}
+	// TCP socket listens at the port UDP one got in case it was picked by the
+	// system
+	t.tcp, err = NewTunnel(ListenAt(udp.LocalAddr().String()), ConnectTo(config.resolver()),
+		TunnelLimits{}, TunnelOptions{Admit: t.admit})
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	if t.limiter != nil {
+		t.tcp.UpdateSharedLimiters([]*rate.Limiter{t.limiter})
+	}
+	t.waitGroup.Add(1)
+	go t.serve()
+	log.Printf("DNS tunnel at %q forwards queries to %q", listenAt, config.resolver())
+	return t, nil
+}
+
+// Addr returns address tunnel listens at
+func (t *DNSTunnel) Addr() net.Addr {
+	return t.udp.LocalAddr()
+}
+
+// Config returns configuration of a tunnel
+func (t *DNSTunnel) Config() DNSConfigJSON {
+	return t.config
+}
+
+// Stats returns current statistics of a tunnel. Safe to call concurrently.
+func (t *DNSTunnel) Stats() DNSStats {
+	return DNSStats{
+		Forwarded: atomic.LoadInt64(&t.stats.Forwarded),
+		Refused:   atomic.LoadInt64(&t.stats.Refused),
+		Failed:    atomic.LoadInt64(&t.stats.Failed),
+		Counters:  loadCounters(&t.stats.Counters).Add(t.tcp.Stats().Counters),
+	}
+}
+
+// Shutdown stops tunnel, waiting for queries in flight to complete
+func (t *DNSTunnel) Shutdown() {
+	t.udp.Close()
+	t.tcp.Shutdown()
+	t.waitGroup.Wait()
+	log.Printf("DNS tunnel at %q shut down", t.listenAt)
+}
+
+// admit rejects TCP connections of clients exceeding their query rate
+func (t *DNSTunnel) admit(ctx context.Context, client net.Addr) Admission {
+	return Admission{Reject: !t.queries.allow(client, time.Now())}
+}
+
+// serve reads UDP queries until tunnel is shut down
+func (t *DNSTunnel) serve() {
+	defer t.waitGroup.Done()
+	buf := make([]byte, math.MaxUint16)
+	for {
+		n, client, err := t.udp.ReadFrom(buf)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return
+		}
+		// Responses and garbage are ignored
+		if n < dnsHeaderSize || buf[2]&0x80 != 0 {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		if !t.queries.allow(client, time.Now()) {
+			atomic.AddInt64(&t.stats.Refused, 1)
+			t.udp.WriteTo(refuseQuery(query), client)
+			continue
+		}
+		select {
+		case t.inflight <- struct{}{}:
+		default:
+			atomic.AddInt64(&t.stats.Failed, 1)
+			continue
+		}
+		t.waitGroup.Add(1)
+		go func() {
+			defer t.waitGroup.Done()
+			defer func() { <-t.inflight }()
+			if err := t.forward(query, client); err != nil {
+				atomic.AddInt64(&t.stats.Failed, 1)
+				return
+			}
+			atomic.AddInt64(&t.stats.Forwarded, 1)
+		}()
+	}
+}
+
+// forward sends a query to resolver and its response back to client
+func (t *DNSTunnel) forward(query []byte, client net.Addr) error {
+	t.wait(len(query))
+	conn, err := net.DialTimeout("udp", t.config.resolver(), dnsTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.stats.Counters.IngressBytes, int64(len(query)))
+	response := make([]byte, math.MaxUint16)
+	n, err := conn.Read(response)
+	if err != nil {
+		return err
+	}
+	t.wait(n)
+	if _, err := t.udp.WriteTo(response[:n], client); err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.stats.Counters.EgressBytes, int64(n))
+	return nil
+}
+
+// wait waits for bandwidth limit to allow n more bytes
+func (t *DNSTunnel) wait(n int) {
+	if t.limiter == nil {
+		return
+	}
+	// Messages bigger than the burst are let through right away rather than
+	// dropped
+	if r := t.limiter.ReserveN(time.Now(), n); r.OK() {
+		time.Sleep(r.Delay())
+	}
+}
+
+// refuseQuery returns a response refusing a given query (header only, with
+// REFUSED response code)
+func refuseQuery(query []byte) []byte {
+	response := make([]byte, dnsHeaderSize)
+	// Identifier
+	copy(response, query[:2])
+	// QR set, opcode and RD kept
+	response[2] = 0x80 | query[2]&0x79
+	// REFUSED
+	response[3] = 5
+	return response
+}
+
+// queryLimiter limits the rate of queries made by each client
+type queryLimiter struct {
+	mu      *sync.Mutex
+	rate    float64
+	clients map[string]*clientQueries
+	pruned  time.Time
+}
+
+type clientQueries struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// queryLimiterIdle is how long query limiter remembers clients that made no
+// queries
+const queryLimiterIdle = time.Minute
+
+func newQueryLimiter(queryRate float64) *queryLimiter {
+	return &queryLimiter{
+		mu:      new(sync.Mutex),
+		rate:    queryRate,
+		clients: make(map[string]*clientQueries),
+	}
+}
+
+// allow tells whether a client is allowed to make a query at a given moment
+func (q *queryLimiter) allow(client net.Addr, now time.Time) bool {
+	if q.rate == 0 {
+		return true
+	}
+	key := client.String()
+	if ip := addrIP(key); ip != nil {
+		key = ip.String()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.pruned) >= queryLimiterIdle {
+		for k, c := range q.clients {
+			if now.Sub(c.seen) >= queryLimiterIdle {
+				delete(q.clients, k)
+			}
+		}
+		q.pruned = now
+	}
+	c, ok := q.clients[key]
+	if !ok {
+		c = &clientQueries{
+			limiter: rate.NewLimiter(rate.Limit(q.rate), int(math.Ceil(q.rate))),
+		}
+		q.clients[key] = c
+	}
+	c.seen = now
+	return c.limiter.AllowN(now, 1)
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startResolver starts a fake DNS resolver answering UDP queries with the
+// query itself marked as a response and echoing data sent over TCP
+func startResolver(t *testing.T) (net.PacketConn, net.Listener) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80
+			udp.WriteTo(buf[:n], addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return udp, tcp
+}
+
+func TestDNSTunnel(t *testing.T) {
+	udp, tcp := startResolver(t)
+	defer udp.Close()
+	defer tcp.Close()
+	tunnel, err := NewDNSTunnel("127.0.0.1:0", DNSConfigJSON{
+		Resolver:  udp.LocalAddr().String(),
+		QueryRate: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create DNS tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("udp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	query := []byte("\x12\x34\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00question")
+	response := make([]byte, 512)
+	for i, rcode := range []byte{0, 5} {
+		client.Write(query)
+		n, err := client.Read(response)
+		if err != nil || n < dnsHeaderSize || response[0] != 0x12 || response[1] != 0x34 ||
+			response[2]&0x80 == 0 || response[3]&0x0f != rcode {
+			t.Fatalf("Query %d: expected response with code %d, got %q, %v", i, rcode,
+				response[:n], err)
+		}
+	}
+
+	// Client has exceeded its query rate over TCP as well
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("\x00\x02hi"))
+	if n, err := conn.Read(make([]byte, 4)); err == nil {
+		t.Errorf("Expected TCP connection to be rejected, got %d bytes", n)
+	}
+
+	stats := tunnel.Stats()
+	if stats.Forwarded != 1 || stats.Refused != 1 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+var errTunnelConfigured = errors.New("Tunnel comes from configuration and can't be deleted")
+
+// CreateTunnel starts a tunnel outside of configuration: configuration
+// reloads and Apply leave it alone until DeleteTunnel shuts it down, and it
+// isn't restored after restart. If spec listens at zero port (e.g.
+// "127.0.0.1:0"), tunnel gets an ephemeral port and is known by the address
+// it was assigned, which returned info tells.
+func (m *TunnelManager) CreateTunnel(spec TunnelSpec) (TunnelInfo, error) {
+	return m.CreateTunnelContext(context.Background(), spec)
+}
+
+// CreateTunnelContext is like CreateTunnel, but the tunnel lasts until a
+// given context is cancelled: it's shut down then as if by DeleteTunnel,
+// closing its listener and connections.
+func (m *TunnelManager) CreateTunnelContext(ctx context.Context,
+	spec TunnelSpec) (TunnelInfo, error) {
+	var result TunnelInfo
+	var t *dispatchTunnel
+	var err error
+	if !m.doContext(ctx, func() {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if result, err = m.createTunnel(spec); err == nil {
+			_, t, _ = m.findTunnel(result.ListenAt)
+		}
+	}) {
+		if ctx.Err() != nil {
+			return TunnelInfo{}, ctx.Err()
+		}
+		return TunnelInfo{}, fmt.Errorf("Tunnel manager is shutting down")
+	}
+	if err != nil {
+		return TunnelInfo{}, err
+	}
+	log.Printf("Created tunnel at %q", result.ListenAt)
+	if ctx.Done() != nil {
+		go m.deleteOnCancel(ctx, t)
+	}
+	return result, nil
+}
+
+// deleteOnCancel shuts an ephemeral tunnel down once context is cancelled
+// unless it's deleted before that
+func (m *TunnelManager) deleteOnCancel(ctx context.Context, t *dispatchTunnel) {
+	select {
+	case <-ctx.Done():
+	case <-t.tunnel.shutdown:
+		return
+	case <-m.gs.quit:
+		return
+	}
+	m.do(func() {
+		// Another tunnel could be listening at the same address by now
+		for k, v := range m.tunnels {
+			if v == t {
+				m.stopTunnel(k, t)
+				log.Printf("Deleted tunnel at %q since its context is done", k.listenAt)
+				return
+			}
+		}
+	})
+}
+
+// DeleteTunnel shuts down a tunnel started by CreateTunnel
+func (m *TunnelManager) DeleteTunnel(listenAt ListenAt) error {
+	err := errTunnelNotFound
+	m.do(func() {
+		k, t, ok := m.findTunnel(listenAt)
+		if !ok {
+			return
+		}
+		if !t.ephemeral {
+			err = errTunnelConfigured
+			return
+		}
+		m.stopTunnel(k, t)
+		err = nil
+	})
+	return err
+}
+
+// createTunnel starts a tunnel outside of configuration. Must be called on
+// the manager goroutine.
+func (m *TunnelManager) createTunnel(spec TunnelSpec) (TunnelInfo, error) {
+	if err := m.validateSpec(spec); err != nil {
+		return TunnelInfo{}, err
+	}
+	var listener net.Listener
+	// Port ranges are validated above and never have zero port
+	if addr, err := parseListenAddress(spec.ListenAt); err == nil && addr.port == 0 {
+		// Port is picked first, so that tunnel is known by it from the start
+		l, err := net.Listen("tcp", string(spec.ListenAt))
+		if err != nil {
+			return TunnelInfo{}, &Error{Kind: ErrListenFailed, Err: err}
+		}
+		listener = l
+		host := addr.host
+		if addr.zone != "" {
+			host += "%" + addr.zone
+		}
+		spec.ListenAt = ListenAt(net.JoinHostPort(host,
+			strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	}
+	if err := m.checkListenAt(spec.ListenAt); err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return TunnelInfo{}, err
+	}
+	t, err := m.startTunnel(spec, listener)
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return TunnelInfo{}, err
+	}
+	t.ephemeral = true
+	return m.tunnelInfo(tunnelKey{listenAt: spec.ListenAt, connectTo: spec.ConnectTo}, t),
+		nil
+}
+
+// checkListenAt returns an error if a new tunnel can't listen at a given
+// address because of running tunnels or on-demand port ranges. Must be called
+// on the manager goroutine.
+func (m *TunnelManager) checkListenAt(listenAt ListenAt) error {
+	if _, _, ok := m.findTunnel(listenAt); ok {
+		return fmt.Errorf("Tunnel %q is already in use", listenAt)
+	}
+	for pattern, g := range m.onDemand {
+		if g.ports.conflicts(listenAt) {
+			return &ListenConflictError{ListenAt: listenAt, Other: pattern}
+		}
+	}
+	running := make([]ListenAt, 0, len(m.tunnels))
+	for k := range m.tunnels {
+		running = append(running, k.listenAt)
+	}
+	sortListenAts(running)
+	return listenConflict(listenAt, running)
+}
+
+// register keeps registration of a tunnel in service registries up to date
+// with its service name and tenant. Must be called on the manager goroutine.
+func (m *TunnelManager) register(key tunnelKey, t *dispatchTunnel) {
+	if t.service == "" {
+		m.registries.Deregister(key.listenAt)
+		return
+	}
+	m.registries.Register(newRegistration(t.service, key.listenAt, t.tenant,
+		t.tunnel.Addr()))
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEphemeralTunnels(t *testing.T) {
+	type callback struct {
+		Action string `json:"action"`
+		Registration
+	}
+	callbacks := make(chan callback, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		var c callback
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			t.Errorf("Failed to decode callback: %v", err)
+		}
+		callbacks <- c
+	}))
+	defer server.Close()
+
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.start()
+	configUpdate <- ConfigurationJSON{
+		Version: CurrentConfigVersion,
+		Registries: map[string]RegistryConfigJSON{
+			"ci": {Type: RegistryCallback, URL: server.URL},
+		},
+		Tunnels: map[ListenAt]TunnelConfigJSON{
+			"127.0.0.1:0": {ConnectTo: "127.0.0.1:1"},
+		},
+	}
+
+	info, err := manager.CreateTunnel(TunnelSpec{
+		ListenAt:  "127.0.0.1:0",
+		ConnectTo: "127.0.0.1:1",
+		Service:   "db",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	_, port, _ := net.SplitHostPort(string(info.ListenAt))
+	if !info.Ephemeral || port == "0" || port == "" {
+		t.Fatalf("Expected tunnel to get an ephemeral port, got %+v", info)
+	}
+	conn, err := net.Dial("tcp", string(info.ListenAt))
+	if err != nil {
+		t.Fatalf("Tunnel doesn't listen at %q: %v", info.ListenAt, err)
+	}
+	conn.Close()
+
+	select {
+	case c := <-callbacks:
+		if c.Action != "register" || c.Service != "db" || c.ListenAt != info.ListenAt ||
+			c.Host != "127.0.0.1" || port != strconv.Itoa(c.Port) {
+			t.Errorf("Unexpected registration %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Tunnel wasn't registered")
+	}
+
+	// Configured tunnel listening at zero port reports its address, but can't
+	// be deleted
+	for _, v := range manager.ListTunnels() {
+		if v.ListenAt == "127.0.0.1:0" && v.Address == "" {
+			t.Errorf("Expected address of configured tunnel to be reported")
+		}
+	}
+	if err := manager.DeleteTunnel("127.0.0.1:0"); err != errTunnelConfigured {
+		t.Errorf("Expected configured tunnel not to be deleted, got %v", err)
+	}
+
+	// Applying desired tunnels leaves ephemeral ones alone
+	if _, err := manager.Apply(nil); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: info.ListenAt, ConnectTo: "127.0.0.1:1"},
+	}); err == nil {
+		t.Errorf("Expected address of ephemeral tunnel to be in use")
+	}
+	if tunnels := manager.ListTunnels(); len(tunnels) != 1 || tunnels[0].ListenAt != info.ListenAt {
+		t.Errorf("Expected only ephemeral tunnel to be left, got %+v", tunnels)
+	}
+
+	if err := manager.DeleteTunnel(info.ListenAt); err != nil {
+		t.Fatalf("Failed to delete tunnel: %v", err)
+	}
+	select {
+	case c := <-callbacks:
+		if c.Action != "deregister" || c.ListenAt != info.ListenAt {
+			t.Errorf("Unexpected deregistration %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Tunnel wasn't deregistered")
+	}
+	if err := manager.DeleteTunnel(info.ListenAt); err != errTunnelNotFound {
+		t.Errorf("Expected deleted tunnel to be gone, got %v", err)
+	}
+}
+
+func TestEphemeralTunnelContext(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.start()
+	configUpdate <- ConfigurationJSON{Version: CurrentConfigVersion}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	info, err := manager.CreateTunnelContext(ctx, TunnelSpec{
+		ListenAt:  "127.0.0.1:0",
+		ConnectTo: "127.0.0.1:1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.ListTunnels()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Tunnel wasn't deleted with its context")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := net.Dial("tcp", string(info.ListenAt)); err == nil {
+		t.Errorf("Expected tunnel to stop listening at %q", info.ListenAt)
+	}
+
+	if _, err := manager.CreateTunnelContext(ctx, TunnelSpec{
+		ListenAt:  "127.0.0.1:0",
+		ConnectTo: "127.0.0.1:1",
+	}); err == nil {
+		t.Errorf("Expected tunnel not to be created with cancelled context")
+	}
+}
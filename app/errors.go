@@ -0,0 +1,75 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of failures embedders could tell apart with ErrorKind (or errors.Is)
+var (
+	// ErrListenFailed is the kind of errors returned when a tunnel can't
+	// listen at its address (see also ListenConflictError)
+	ErrListenFailed = errors.New("Failed to listen")
+	// ErrDialTimeout is the kind of errors connections fail with when
+	// upstream doesn't accept connection (or complete TLS handshake) in time
+	ErrDialTimeout = errors.New("Upstream dial timed out")
+	// ErrTunnelClosed is returned by operations on a tunnel that was shut down
+	ErrTunnelClosed = errors.New("Tunnel is closed")
+	// ErrLimitInvalid is the kind of errors returned when limits are rejected
+	ErrLimitInvalid = errors.New("Invalid limits")
+)
+
+// Error is a failure of a particular kind with its underlying cause
+type Error struct {
+	// One of ErrListenFailed, ErrDialTimeout or ErrLimitInvalid
+	Kind error
+	Err  error
+}
+
+// Error returns message of the underlying cause
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is tells whether error is of a given kind (used by errors.Is)
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// ErrorKind returns the kind of an error returned by this package (one of Err*
+// variables) or nil if it's not known
+func ErrorKind(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	case *ListenConflictError:
+		return ErrListenFailed
+	case nil:
+		return nil
+	}
+	switch err {
+	case ErrListenFailed, ErrDialTimeout, ErrTunnelClosed, ErrLimitInvalid:
+		return err
+	}
+	return nil
+}
+
+// invalidLimit returns an error of ErrLimitInvalid kind
+func invalidLimit(format string, args ...interface{}) error {
+	return &Error{Kind: ErrLimitInvalid, Err: fmt.Errorf(format, args...)}
+}
+
+// withContext prefixes message of an error with a context (e.g. a tunnel it's
+// about) keeping its kind
+func withContext(err error, format string, args ...interface{}) error {
+	wrapped := fmt.Errorf(format+": %v", append(args, err)...)
+	if kind := ErrorKind(err); kind != nil {
+		return &Error{Kind: kind, Err: wrapped}
+	}
+	return wrapped
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"net"
+	"testing"
+)
+
+// timeoutError is a net.Error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorKinds(t *testing.T) {
+	_, err := NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{TunnelLimit: -2},
+		TunnelOptions{})
+	if ErrorKind(err) != ErrLimitInvalid {
+		t.Errorf("Expected negative limit to be rejected as invalid, got %v", err)
+	}
+	_, err = ParseLimit("fast")
+	if ErrorKind(withContext(err, "Tunnel %q", ":8080")) != ErrLimitInvalid {
+		t.Errorf("Expected unparsable limit to be invalid, got %v", err)
+	}
+
+	tunnel, err := NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	_, err = NewTunnel(ListenAt(tunnel.listener.Addr().String()), "127.0.0.1:1",
+		TunnelLimits{}, TunnelOptions{})
+	if ErrorKind(err) != ErrListenFailed {
+		t.Errorf("Expected occupied address to fail listening, got %v", err)
+	}
+	_, err = NewTunnel("127.0.0.1:99999", "127.0.0.1:1", TunnelLimits{}, TunnelOptions{})
+	if ErrorKind(err) != ErrListenFailed {
+		t.Errorf("Expected invalid port to fail listening, got %v", err)
+	}
+
+	tunnel.Shutdown()
+	if err := tunnel.CloseConnection(1); err != ErrTunnelClosed {
+		t.Errorf("Expected closed tunnel error, got %v", err)
+	}
+	if err := tunnel.UpdateExemptions(Exemptions{}); err != ErrTunnelClosed {
+		t.Errorf("Expected closed tunnel error, got %v", err)
+	}
+
+	var timeout net.Error = timeoutError{}
+	err = dialError(timeout, timeout)
+	if ErrorKind(err) != ErrDialTimeout || err.(*Error).Unwrap() != timeout {
+		t.Errorf("Expected dial timeout wrapping its cause, got %#v", err)
+	}
+	if ErrorKind(dialError(errTunnelNotFound, errTunnelNotFound)) != nil {
+		t.Errorf("Expected other dial errors to be passed as is")
+	}
+}
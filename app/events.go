@@ -0,0 +1,216 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// EventType tells what has happened
+type EventType string
+
+// Types of events published by tunnels and tunnel manager
+const (
+	EventTunnelCreated    EventType = "tunnelCreated"
+	EventTunnelUpdated    EventType = "tunnelUpdated"
+	EventTunnelDeleted    EventType = "tunnelDeleted"
+	EventConnectionOpened EventType = "connectionOpened"
+	EventConnectionFailed EventType = "connectionFailed"
+	// Connection was moved to a different limit
+	EventConnectionUpdated EventType = "connectionUpdated"
+	EventConnectionClosed  EventType = "connectionClosed"
+	// Tunnel lost its listening socket and retries listening
+	EventListenerFailed EventType = "listenerFailed"
+	// Tunnel is listening again after losing its listening socket
+	EventListenerRestored EventType = "listenerRestored"
+	// Tunnel failed to listen again the number of times its ListenRetries
+	// allow
+	EventListenRetriesExhausted EventType = "listenRetriesExhausted"
+	EventQuotaExhausted         EventType = "quotaExhausted"
+	// Tunnel used most of its limit for a minute
+	EventTunnelSaturated EventType = "tunnelSaturated"
+)
+
+// Event describes a change in the set of tunnels or their connections
+type Event struct {
+	// Cursor is a sequence number of an event. Cursors start with 1 and are
+	// reset when application restarts.
+	Cursor   uint64    `json:"cursor"`
+	Time     time.Time `json:"time"`
+	Type     EventType `json:"type"`
+	ListenAt ListenAt  `json:"listenAt"`
+	Tenant   string    `json:"tenant,omitempty"`
+	// Set for tunnel events
+	Tunnel *TunnelEvent `json:"tunnel,omitempty"`
+	// Set for connection events
+	Connection *ConnectionEvent `json:"connection,omitempty"`
+}
+
+// TunnelEvent holds details of tunnel events
+type TunnelEvent struct {
+	ConnectTo ConnectTo    `json:"connectTo"`
+	Limits    TunnelLimits `json:"limits"`
+	Draining  bool         `json:"draining,omitempty"`
+	// Reason of a listener failure for listenerFailed and
+	// listenRetriesExhausted events
+	Error string `json:"error,omitempty"`
+}
+
+// ConnectionEvent holds details of connection events
+type ConnectionEvent struct {
+	ID     uint64 `json:"id"`
+	Client string `json:"client"`
+	// Labels attached to connection upon admission
+	Labels Labels `json:"labels,omitempty"`
+	// Reason of a failure for connections that failed or completed abnormally
+	Error string `json:"error,omitempty"`
+	// Connection's own limit for connectionUpdated events. Absent if
+	// connection got back to the tunnel connection limit.
+	Limit *Limit `json:"limit,omitempty"`
+	// Why connection ended for connectionClosed and connectionFailed events
+	Reason CloseReason `json:"reason,omitempty"`
+	// Side that ended the connection for connectionClosed events
+	ClosedBy ConnectionSide `json:"closedBy,omitempty"`
+	// Bytes forwarded in each direction for connectionClosed events
+	IngressBytes int64 `json:"ingressBytes,omitempty"`
+	EgressBytes  int64 `json:"egressBytes,omitempty"`
+}
+
+// ErrCursorExpired is returned when subscribing after an event that is no
+// longer retained (or is unknown, e.g. because application was restarted).
+// Subscriber should rebuild its model from scratch and subscribe to new
+// events.
+var ErrCursorExpired = errors.New("Event cursor has expired")
+
+// ErrSubscriberLagging is reported by a subscription that was closed because
+// subscriber didn't keep up with events. Subscriber could resume by
+// subscribing after the last event it has received.
+var ErrSubscriberLagging = errors.New("Subscriber didn't keep up with events")
+
+// DefaultEventHistory is the number of recent events retained for resuming
+// subscriptions
+const DefaultEventHistory = 4096
+
+// subscriptionBuffer is the number of events that could be waiting for a
+// subscriber to receive them before it is considered lagging
+const subscriptionBuffer = 256
+
+// EventBus delivers events to subscribers and retains a number of recent
+// events, so that subscribers could resume after a disconnect without missing
+// anything.
+type EventBus struct {
+	mu          *sync.Mutex
+	historySize int
+	history     []Event
+	lastCursor  uint64
+	subscribers map[*Subscription]struct{}
+}
+
+// NewEventBus creates an EventBus retaining given number of recent events
+func NewEventBus(historySize int) *EventBus {
+	return &EventBus{
+		mu:          new(sync.Mutex),
+		historySize: historySize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns cursor and time to an event and delivers it to subscribers.
+// Never blocks. Safe to call on nil EventBus (does nothing).
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastCursor++
+	e.Cursor = b.lastCursor
+	e.Time = time.Now()
+
+	b.history = append(b.history, e)
+	if len(b.history) > 2*b.historySize {
+		// Trimming in bulk keeps publishing cost amortized constant
+		b.history = append([]Event(nil), b.history[len(b.history)-b.historySize:]...)
+	}
+
+	for s := range b.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			b.drop(s, ErrSubscriberLagging)
+		}
+	}
+}
+
+// Subscribe returns a subscription delivering events published after an event
+// with a given cursor. Zero cursor subscribes to new events only. Returns
+// ErrCursorExpired if events following a given cursor are no longer retained.
+func (b *EventBus) Subscribe(after uint64) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	if after != 0 {
+		if after > b.lastCursor {
+			return nil, ErrCursorExpired
+		}
+		if after < b.lastCursor {
+			if len(b.history) == 0 || b.history[0].Cursor > after+1 {
+				return nil, ErrCursorExpired
+			}
+			replay = b.history[after+1-b.history[0].Cursor:]
+		}
+	}
+
+	s := &Subscription{
+		bus:    b,
+		events: make(chan Event, len(replay)+subscriptionBuffer),
+	}
+	for _, e := range replay {
+		s.events <- e
+	}
+	b.subscribers[s] = struct{}{}
+	return s, nil
+}
+
+// drop removes subscription and closes its channel. Must be called with mu
+// locked.
+func (b *EventBus) drop(s *Subscription, err error) {
+	if _, ok := b.subscribers[s]; !ok {
+		return
+	}
+	delete(b.subscribers, s)
+	s.err = err
+	close(s.events)
+}
+
+// Subscription is a stream of events delivered by EventBus
+type Subscription struct {
+	bus    *EventBus
+	events chan Event
+	err    error
+}
+
+// Events returns a channel events are delivered to. Channel gets closed when
+// subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns the reason subscription was closed for by EventBus (e.g.
+// ErrSubscriberLagging). Returns nil if subscription is active or was closed
+// by subscriber. Only valid after events channel is closed.
+func (s *Subscription) Err() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.err
+}
+
+// Close stops delivering events to a subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.drop(s, nil)
+}
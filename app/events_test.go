@@ -0,0 +1,61 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestEventBusResume(t *testing.T) {
+	bus := NewEventBus(2)
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: EventTunnelCreated})
+	}
+
+	// Only events retained in history could be resumed after
+	sub, err := bus.Subscribe(3)
+	if err != nil {
+		t.Fatalf("Failed to subscribe after retained event: %v", err)
+	}
+	for _, expected := range []uint64{4, 5} {
+		if e := <-sub.Events(); e.Cursor != expected {
+			t.Errorf("Expected event %d, got %d", expected, e.Cursor)
+		}
+	}
+	bus.Publish(Event{Type: EventTunnelDeleted})
+	if e := <-sub.Events(); e.Cursor != 6 || e.Type != EventTunnelDeleted {
+		t.Errorf("Unexpected live event: %v", e)
+	}
+	sub.Close()
+	if _, ok := <-sub.Events(); ok || sub.Err() != nil {
+		t.Errorf("Expected subscription to be closed without error")
+	}
+
+	// History is trimmed to twice its size at most
+	for i := 0; i < 10; i++ {
+		bus.Publish(Event{Type: EventTunnelCreated})
+	}
+	if _, err = bus.Subscribe(1); err != ErrCursorExpired {
+		t.Errorf("Expected old cursor to be expired, got %v", err)
+	}
+	if _, err = bus.Subscribe(100); err != ErrCursorExpired {
+		t.Errorf("Expected unknown cursor to be expired, got %v", err)
+	}
+}
+
+func TestEventBusLaggingSubscriber(t *testing.T) {
+	bus := NewEventBus(DefaultEventHistory)
+	sub, err := bus.Subscribe(0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	for i := 0; i < subscriptionBuffer+1; i++ {
+		bus.Publish(Event{Type: EventConnectionOpened})
+	}
+	received := 0
+	for range sub.Events() {
+		received++
+	}
+	if received != subscriptionBuffer || sub.Err() != ErrSubscriberLagging {
+		t.Errorf("Expected lagging subscriber to be dropped after %d events, got %d (%v)",
+			subscriptionBuffer, received, sub.Err())
+	}
+}
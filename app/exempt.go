@@ -0,0 +1,116 @@
+package app
+
+import (
+	"fmt"
+	"net"
+)
+
+// Exemptions list clients and upstreams whose connections bypass throttling
+// on a tunnel entirely (e.g. monitoring probes or health checkers). Traffic of
+// exempt connections is still accounted in stats.
+type Exemptions struct {
+	// IP addresses or CIDRs of clients
+	ExemptClients []string `json:"exemptClients,omitempty"`
+	// IP addresses or CIDRs of upstreams (destination might resolve to
+	// several addresses)
+	ExemptUpstreams []string `json:"exemptUpstreams,omitempty"`
+}
+
+// validate checks exemptions for errors
+func (e Exemptions) validate() error {
+	_, err := e.matcher()
+	return err
+}
+
+// equal tells whether two sets of exemptions are the same
+func (e Exemptions) equal(other Exemptions) bool {
+	return sameStrings(e.ExemptClients, other.ExemptClients) &&
+		sameStrings(e.ExemptUpstreams, other.ExemptUpstreams)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// exemptionMatcher tells whether a connection is exempt from throttling
+type exemptionMatcher struct {
+	clients   []*net.IPNet
+	upstreams []*net.IPNet
+}
+
+// matcher parses exemptions
+func (e Exemptions) matcher() (*exemptionMatcher, error) {
+	result := new(exemptionMatcher)
+	for _, v := range e.ExemptClients {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exempt client: %v", err)
+		}
+		result.clients = append(result.clients, network)
+	}
+	for _, v := range e.ExemptUpstreams {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid exempt upstream: %v", err)
+		}
+		result.upstreams = append(result.upstreams, network)
+	}
+	return result, nil
+}
+
+// match tells whether a connection from a given client to a given upstream is
+// exempt
+func (m *exemptionMatcher) match(client, upstream net.Addr) bool {
+	return containsAddr(m.clients, client.String()) ||
+		containsAddr(m.upstreams, upstream.String())
+}
+
+// containsAddr tells whether host of an address belongs to one of networks
+func containsAddr(networks []*net.IPNet, addr string) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetwork parses a CIDR or a single IP address (which is treated as a
+// network of one address)
+func parseNetwork(s string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(s)
+	if err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor a CIDR", s)
+	}
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// addrIP returns IP address of a "host:port" network address or nil if host is
+// not an IP address
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
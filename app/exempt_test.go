@@ -0,0 +1,44 @@
+package app
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExemptions(t *testing.T) {
+	e := Exemptions{
+		ExemptClients:   []string{"10.0.0.0/8", "192.168.1.1"},
+		ExemptUpstreams: []string{"::1"},
+	}
+	m, err := e.matcher()
+	if err != nil {
+		t.Fatalf("Failed to parse exemptions: %v", err)
+	}
+
+	addr := func(s string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", s, err)
+		}
+		return a
+	}
+	cases := []struct {
+		client, upstream string
+		exempt           bool
+	}{
+		{"10.1.2.3:1000", "127.0.0.1:80", true},
+		{"192.168.1.1:1000", "127.0.0.1:80", true},
+		{"192.168.1.2:1000", "127.0.0.1:80", false},
+		{"192.168.1.2:1000", "[::1]:80", true},
+	}
+	for _, c := range cases {
+		if m.match(addr(c.client), addr(c.upstream)) != c.exempt {
+			t.Errorf("Expected connection from %v to %v to be exempt: %v", c.client,
+				c.upstream, c.exempt)
+		}
+	}
+
+	if err := (Exemptions{ExemptClients: []string{"monitoring"}}).validate(); err == nil {
+		t.Errorf("Expected hostname to be rejected")
+	}
+}
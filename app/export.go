@@ -0,0 +1,423 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExportConfigJSON configures periodic export of tunnel usage records to a
+// sink. Exactly one of sinks must be set.
+type ExportConfigJSON struct {
+	// How often traffic of tunnels is sampled into records
+	// (DefaultExportInterval if zero)
+	Interval Duration `json:"interval,omitempty"`
+	// How often records are written out, starting a new part (file, object
+	// or request) of the sink if its name changes (Interval if zero).
+	// Parts start at multiples of it since the Unix epoch.
+	Rotate Duration `json:"rotate,omitempty"`
+	// Name of this node in records and part names (host name if empty)
+	Node string `json:"node,omitempty"`
+
+	File *FileSinkJSON `json:"file,omitempty"`
+	HTTP *HTTPSinkJSON `json:"http,omitempty"`
+	S3   *S3SinkJSON   `json:"s3,omitempty"`
+}
+
+// UsageRecord is traffic forwarded by a tunnel within an interval. Records
+// are exported as JSON lines.
+type UsageRecord struct {
+	Node      string    `json:"node"`
+	ListenAt  ListenAt  `json:"listenAt"`
+	ConnectTo ConnectTo `json:"connectTo"`
+	Tenant    string    `json:"tenant,omitempty"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	TunnelCounters
+}
+
+// DefaultExportInterval is how often usage is sampled unless configured
+// otherwise
+const DefaultExportInterval = Duration(time.Minute)
+
+// exportTimeout is how long a sink is given to store a part
+const exportTimeout = time.Minute
+
+// maxPendingRecords is the number of records kept while sink is failing.
+// Older records are dropped beyond that.
+const maxPendingRecords = 100000
+
+// Placeholders of part name templates. Times are those of part start in UTC.
+var exportPlaceholders = []string{"{node}", "{tenant}", "{date}", "{hour}", "{time}"}
+
+// exportSink stores parts made of usage records
+type exportSink interface {
+	// template returns template of part names. Records whose names differ
+	// are stored in separate parts.
+	template() string
+	write(ctx context.Context, name string, data []byte) error
+}
+
+func (c ExportConfigJSON) validate() error {
+	if c.Interval < 0 || c.Rotate < 0 {
+		return errors.New("Interval and rotation must not be negative")
+	}
+	if c.Rotate != 0 && c.Rotate < c.interval() {
+		return errors.New("Rotation must not be shorter than interval")
+	}
+	sinks := 0
+	var err error
+	if c.File != nil {
+		sinks++
+		err = c.File.validate()
+	}
+	if c.HTTP != nil {
+		sinks++
+		err = c.HTTP.validate()
+	}
+	if c.S3 != nil {
+		sinks++
+		err = c.S3.validate()
+	}
+	if sinks != 1 {
+		return errors.New("Exactly one of file, http and s3 sinks must be set")
+	}
+	return err
+}
+
+// equal tells whether two export configurations are the same
+func (c ExportConfigJSON) equal(other ExportConfigJSON) bool {
+	if c.Interval != other.Interval || c.Rotate != other.Rotate || c.Node != other.Node {
+		return false
+	}
+	return ((c.File == nil && other.File == nil) ||
+		(c.File != nil && other.File != nil && *c.File == *other.File)) &&
+		((c.HTTP == nil && other.HTTP == nil) ||
+			(c.HTTP != nil && other.HTTP != nil && *c.HTTP == *other.HTTP)) &&
+		((c.S3 == nil && other.S3 == nil) ||
+			(c.S3 != nil && other.S3 != nil && *c.S3 == *other.S3))
+}
+
+// String is an implementation of fmt.Stringer that keeps secrets out of logs
+func (c ExportConfigJSON) String() string {
+	sink := "none"
+	switch {
+	case c.File != nil:
+		sink = "file " + c.File.Path
+	case c.HTTP != nil:
+		sink = "http " + c.HTTP.URL
+	case c.S3 != nil:
+		sink = "s3 " + c.S3.Endpoint + "/" + c.S3.Bucket
+	}
+	return fmt.Sprintf("{interval: %v, rotate: %v, node: %s, sink: %s}",
+		time.Duration(c.Interval), time.Duration(c.Rotate), c.Node, sink)
+}
+
+func (c ExportConfigJSON) interval() Duration {
+	if c.Interval == 0 {
+		return DefaultExportInterval
+	}
+	return c.Interval
+}
+
+func (c ExportConfigJSON) rotate() Duration {
+	if c.Rotate == 0 {
+		return c.interval()
+	}
+	return c.Rotate
+}
+
+func (c ExportConfigJSON) node() string {
+	if c.Node != "" {
+		return c.Node
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+func (c ExportConfigJSON) sink(client *http.Client) exportSink {
+	switch {
+	case c.File != nil:
+		return c.File
+	case c.HTTP != nil:
+		return &httpSink{config: *c.HTTP, client: client}
+	default:
+		return &s3Sink{config: *c.S3, client: client}
+	}
+}
+
+// validateTemplate checks that a part name template only uses known
+// placeholders
+func validateTemplate(template string) error {
+	rest := template
+	for _, p := range exportPlaceholders {
+		rest = strings.Replace(rest, p, "", -1)
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("Template %q has unknown placeholders (expected %s)", template,
+			strings.Join(exportPlaceholders, ", "))
+	}
+	return nil
+}
+
+// expandTemplate returns name of the part a record starting at a given time
+// goes to
+func expandTemplate(template string, node string, tenant string, start time.Time) string {
+	start = start.UTC()
+	return strings.NewReplacer(
+		"{node}", node,
+		"{tenant}", tenant,
+		"{date}", start.Format("2006-01-02"),
+		"{hour}", start.Format("15"),
+		"{time}", start.Format("20060102T150405Z"),
+	).Replace(template)
+}
+
+// usageSample is traffic forwarded by a tunnel since it started
+type usageSample struct {
+	listenAt  ListenAt
+	connectTo ConnectTo
+	tenant    string
+	counters  TunnelCounters
+}
+
+// usageSource returns current usage of all tunnels. Returns false if it
+// couldn't be sampled before context got cancelled.
+type usageSource func(ctx context.Context) ([]usageSample, bool)
+
+// Exports periodically write usage of tunnels to configured sinks. Safe for
+// concurrent use.
+type Exports struct {
+	mu      *sync.Mutex
+	usage   usageSource
+	client  *http.Client
+	exports map[string]*export
+}
+
+// export samples usage and writes it to a single sink on a goroutine of its
+// own
+type export struct {
+	name   string
+	config ExportConfigJSON
+	node   string
+	sink   exportSink
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Counters of tunnels at the last sample, time of the sample and records
+	// yet to be written. Owned by the export goroutine.
+	last    map[tunnelKey]TunnelCounters
+	sampled time.Time
+	pending []UsageRecord
+}
+
+// NewExports creates an empty set of exports sampling usage from a given
+// source
+func NewExports(usage usageSource) *Exports {
+	return &Exports{
+		mu:      new(sync.Mutex),
+		usage:   usage,
+		client:  &http.Client{Timeout: exportTimeout},
+		exports: make(map[string]*export),
+	}
+}
+
+// Configure replaces the set of exports. Exports whose configuration changed
+// are restarted, writing out records they have sampled so far.
+func (e *Exports) Configure(config map[string]ExportConfigJSON) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for name, x := range e.exports {
+		if c, ok := config[name]; !ok || !c.equal(x.config) {
+			x.stop()
+			delete(e.exports, name)
+		}
+	}
+	for name, c := range config {
+		if _, ok := e.exports[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		x := &export{
+			name:   name,
+			config: c,
+			node:   c.node(),
+			sink:   c.sink(e.client),
+			ctx:    ctx,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		go x.run(e.usage)
+		e.exports[name] = x
+	}
+}
+
+// Close stops all exports
+func (e *Exports) Close() {
+	e.Configure(nil)
+}
+
+// config returns configuration of all exports
+func (e *Exports) config() map[string]ExportConfigJSON {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.exports) == 0 {
+		return nil
+	}
+	result := make(map[string]ExportConfigJSON, len(e.exports))
+	for name, x := range e.exports {
+		result[name] = x.config
+	}
+	return result
+}
+
+// stop stops export and waits for its goroutine to exit
+func (x *export) stop() {
+	x.cancel()
+	<-x.done
+}
+
+// run samples usage every interval and writes records out every rotation
+// period until export is stopped
+func (x *export) run(usage usageSource) {
+	defer close(x.done)
+	interval := time.Duration(x.config.interval())
+	rotate := time.Duration(x.config.rotate())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	x.sample(usage, time.Now())
+	partStart := time.Now().Truncate(rotate)
+	for {
+		select {
+		case now := <-ticker.C:
+			x.sample(usage, now)
+			if now.Sub(partStart) >= rotate {
+				x.flush(x.ctx, partStart)
+				partStart = now.Truncate(rotate)
+			}
+		case <-x.ctx.Done():
+			// Records sampled so far are written out, traffic since the last
+			// sample isn't exported
+			ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+			x.flush(ctx, partStart)
+			cancel()
+			return
+		}
+	}
+}
+
+// sample turns traffic of tunnels since the last sample into pending records.
+// The first sample of a tunnel only serves as a baseline.
+func (x *export) sample(usage usageSource, now time.Time) {
+	samples, ok := usage(x.ctx)
+	if !ok {
+		return
+	}
+	last := make(map[tunnelKey]TunnelCounters, len(samples))
+	for _, s := range samples {
+		key := tunnelKey{listenAt: s.listenAt, connectTo: s.connectTo}
+		last[key] = s.counters
+		if x.last == nil {
+			continue
+		}
+		prev, ok := x.last[key]
+		if !ok {
+			continue
+		}
+		if s.counters.IngressBytes < prev.IngressBytes ||
+			s.counters.EgressBytes < prev.EgressBytes {
+			// Tunnel was restarted with its counters reset
+			prev = TunnelCounters{}
+		}
+		delta := TunnelCounters{
+			IngressBytes: s.counters.IngressBytes - prev.IngressBytes,
+			EgressBytes:  s.counters.EgressBytes - prev.EgressBytes,
+		}
+		if delta.total() == 0 {
+			continue
+		}
+		x.pending = append(x.pending, UsageRecord{
+			Node:           x.node,
+			ListenAt:       s.listenAt,
+			ConnectTo:      s.connectTo,
+			Tenant:         s.tenant,
+			From:           x.sampled,
+			To:             now,
+			TunnelCounters: delta,
+		})
+	}
+	x.last = last
+	x.sampled = now
+	if dropped := len(x.pending) - maxPendingRecords; dropped > 0 {
+		log.Printf("Export %q dropped %d records it failed to write", x.name, dropped)
+		x.pending = append([]UsageRecord(nil), x.pending[dropped:]...)
+	}
+}
+
+// flush writes pending records to parts of the sink. Records of parts that
+// failed to be written are kept to be retried with the next part.
+func (x *export) flush(ctx context.Context, partStart time.Time) {
+	if len(x.pending) == 0 {
+		return
+	}
+	template := x.sink.template()
+	parts := make(map[string][]UsageRecord)
+	for _, r := range x.pending {
+		name := expandTemplate(template, x.node, r.Tenant, partStart)
+		parts[name] = append(parts[name], r)
+	}
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failed []UsageRecord
+	for _, name := range names {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, r := range parts[name] {
+			encoder.Encode(r)
+		}
+		if err := x.sink.write(ctx, name, buf.Bytes()); err != nil {
+			log.Printf("Export %q failed to write %d records: %v", x.name,
+				len(parts[name]), err)
+			failed = append(failed, parts[name]...)
+		}
+	}
+	x.pending = failed
+}
+
+// usage returns current usage of all tunnels sampled on the manager goroutine
+func (m *TunnelManager) usage(ctx context.Context) ([]usageSample, bool) {
+	var result []usageSample
+	ok := m.doContext(ctx, func() {
+		result = make([]usageSample, 0, len(m.tunnels))
+		for k, v := range m.tunnels {
+			result = append(result, usageSample{
+				listenAt:  k.listenAt,
+				connectTo: k.connectTo,
+				tenant:    v.tenant,
+				counters:  loadCounters(v.tunnel.counters),
+			})
+		}
+	})
+	return result, ok
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExportConfigValidation(t *testing.T) {
+	s3 := &S3SinkJSON{Endpoint: "https://s3.example.com", Region: "eu-west-1",
+		Bucket: "usage", AccessKey: "AK", SecretKey: "SK"}
+	valid := []ExportConfigJSON{
+		{File: &FileSinkJSON{Path: "/var/log/throttle/{tenant}/{date}.jsonl"}},
+		{HTTP: &HTTPSinkJSON{URL: "https://collector.example.com/usage"}},
+		{S3: s3, Rotate: Duration(time.Hour)},
+	}
+	for _, c := range valid {
+		if err := c.validate(); err != nil {
+			t.Errorf("Expected %v to be valid, got %v", c, err)
+		}
+	}
+	invalid := []ExportConfigJSON{
+		{},
+		{File: &FileSinkJSON{Path: "usage.jsonl"}, S3: s3},
+		{File: &FileSinkJSON{Path: "usage-{month}.jsonl"}},
+		{File: &FileSinkJSON{Path: "usage.jsonl"}, Interval: Duration(time.Hour),
+			Rotate: Duration(time.Minute)},
+		{HTTP: &HTTPSinkJSON{URL: "collector.example.com"}},
+		{S3: &S3SinkJSON{Endpoint: s3.Endpoint, Region: "eu-west-1", Bucket: "usage",
+			Key: "usage.jsonl", AccessKey: "AK", SecretKey: "SK"}},
+		{S3: &S3SinkJSON{Endpoint: s3.Endpoint, Bucket: "usage"}},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected %v to be rejected", c)
+		}
+	}
+	if strings.Contains(ExportConfigJSON{S3: s3}.String(), "SK") {
+		t.Errorf("Expected secret key to be kept out of %v", ExportConfigJSON{S3: s3})
+	}
+}
+
+func TestExportToFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle-export")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mu := new(sync.Mutex)
+	var bytes int64
+	usage := func(ctx context.Context) ([]usageSample, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		bytes += 100
+		return []usageSample{
+			{listenAt: ":8080", connectTo: "10.0.0.1:80", tenant: "acme",
+				counters: TunnelCounters{IngressBytes: bytes}},
+			{listenAt: ":8081", connectTo: "10.0.0.1:81", tenant: "globex",
+				counters: TunnelCounters{EgressBytes: bytes}},
+			{listenAt: ":8082", connectTo: "10.0.0.1:82", tenant: "idle"},
+		}, true
+	}
+	exports := NewExports(usage)
+	exports.Configure(map[string]ExportConfigJSON{
+		"local": {
+			Interval: Duration(10 * time.Millisecond),
+			Node:     "node1",
+			File:     &FileSinkJSON{Path: filepath.Join(dir, "{node}", "{tenant}.jsonl")},
+		},
+	})
+	time.Sleep(100 * time.Millisecond)
+	exports.Close()
+
+	for _, tenant := range []string{"acme", "globex"} {
+		f, err := os.Open(filepath.Join(dir, "node1", tenant+".jsonl"))
+		if err != nil {
+			t.Fatalf("Expected records of %q to be exported: %v", tenant, err)
+		}
+		defer f.Close()
+		var total int64
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var r UsageRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatalf("Failed to decode record %q: %v", scanner.Text(), err)
+			}
+			if r.Node != "node1" || r.Tenant != tenant || !r.To.After(r.From) {
+				t.Errorf("Unexpected record %+v", r)
+			}
+			total += r.total()
+		}
+		if total == 0 || total%100 != 0 {
+			t.Errorf("Expected records of %q to add up to multiples of samples, got %d",
+				tenant, total)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "node1", "idle.jsonl")); err == nil {
+		t.Errorf("Expected tunnel without traffic to have no records")
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215",
+		"us-east-1", "iam")
+	expected := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("Expected signing key %s, got %x", expected, key)
+	}
+
+	type upload struct {
+		method, path, auth, body string
+	}
+	uploads := make(chan upload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		uploads <- upload{r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization"),
+			string(body)}
+	}))
+	defer server.Close()
+
+	sink := ExportConfigJSON{S3: &S3SinkJSON{Endpoint: server.URL, Region: "eu-west-1",
+		Bucket: "usage", Key: "{tenant}/{time}.jsonl", AccessKey: "AK", SecretKey: "SK"},
+	}.sink(http.DefaultClient)
+	name := expandTemplate(sink.template(), "node1", "acme corp",
+		time.Date(2021, 3, 6, 12, 0, 0, 0, time.UTC))
+	if err := sink.write(context.Background(), name, []byte("{}\n")); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	u := <-uploads
+	if u.method != http.MethodPut || u.path != "/usage/acme%20corp/20210306T120000Z.jsonl" ||
+		u.body != "{}\n" {
+		t.Errorf("Unexpected upload %+v", u)
+	}
+	if !strings.HasPrefix(u.auth, "AWS4-HMAC-SHA256 Credential=AK/") ||
+		!strings.Contains(u.auth, "/eu-west-1/s3/aws4_request, SignedHeaders=") {
+		t.Errorf("Unexpected authorization %q", u.auth)
+	}
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"math"
+	"time"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+)
+
+// Fairness holds exponentially weighted moving averages of Jain's fairness
+// index of throughput of tunnel connections over several windows. Index
+// ranges from 1 (connections get equal throughput) down to 1/n (one of n
+// connections takes everything).
+type Fairness struct {
+	Index1s  float64 `json:"1s"`
+	Index10s float64 `json:"10s"`
+	Index1m  float64 `json:"1m"`
+}
+
+// fairnessSample is what a connection transferred and waited for by the
+// previous fairness sample
+type fairnessSample struct {
+	total  int64
+	waited int64
+}
+
+// jainIndex returns Jain's fairness index of given throughputs: square of
+// their sum divided by their number times the sum of their squares. No
+// throughputs at all are considered fair.
+func jainIndex(rates []float64) float64 {
+	var sum, squares float64
+	for _, r := range rates {
+		sum += r
+		squares += r * r
+	}
+	if squares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(rates)) * squares)
+}
+
+// fairnessMeter averages fairness of tunnel connections sampled every
+// meterInterval. Owned by the tunnel goroutine.
+type fairnessMeter struct {
+	lastSample time.Time
+	indices    [len(meterWindows)]float64
+}
+
+// sample takes throughput of connections competing for tunnel limit since the
+// previous sample and updates averages. Connections compete if they forwarded
+// data or waited for limiters, so connections starved by limiters count while
+// idle ones don't. Exempt connections aren't subject to tunnel limit and are
+// left out.
+func (t *Tunnel) sampleFairness(now time.Time, activeConnections *connectionRegistry) {
+	m := &t.fairnessMeter
+	var rates []float64
+	for _, conn := range activeConnections.all() {
+		current := fairnessSample{total: loadCounters(&conn.counters).total()}
+		if limConn, ok := conn.ingress.(*limiter.LimitedConnection); ok {
+			current.waited = limConn.Waits().Time
+		}
+		last := conn.fairnessLast
+		conn.fairnessLast = current
+		if t.listener.ConnectionExempt(conn.ingress) {
+			continue
+		}
+		if current.total > last.total || current.waited > last.waited {
+			rates = append(rates, float64(current.total-last.total))
+		}
+	}
+	index := jainIndex(rates)
+	if m.lastSample.IsZero() {
+		for i := range m.indices {
+			m.indices[i] = index
+		}
+	} else if elapsed := now.Sub(m.lastSample); elapsed > 0 {
+		for i, window := range meterWindows {
+			alpha := 1 - math.Exp(-float64(elapsed)/float64(window))
+			m.indices[i] += alpha * (index - m.indices[i])
+		}
+	}
+	m.lastSample = now
+	t.fairness.Store(Fairness{
+		Index1s:  m.indices[0],
+		Index10s: m.indices[1],
+		Index1m:  m.indices[2],
+	})
+}
+
+// loadFairness returns the latest fairness averages (nil until the first
+// sample)
+func (t *Tunnel) loadFairness() *Fairness {
+	fairness, ok := t.fairness.Load().(Fairness)
+	if !ok {
+		return nil
+	}
+	return &fairness
+}
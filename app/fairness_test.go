@@ -0,0 +1,63 @@
+package app
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestJainIndex(t *testing.T) {
+	for _, c := range []struct {
+		rates    []float64
+		expected float64
+	}{
+		{nil, 1},
+		{[]float64{100}, 1},
+		{[]float64{100, 100, 100}, 1},
+		{[]float64{100, 0, 0, 0}, 0.25},
+		{[]float64{300, 100}, 0.8},
+	} {
+		if index := jainIndex(c.rates); math.Abs(index-c.expected) > 1e-9 {
+			t.Errorf("Expected index of %v to be %v, got %v", c.rates, c.expected, index)
+		}
+	}
+}
+
+func TestTunnelFairness(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, busy := startTunnelConnection(t, upstream, TunnelOptions{})
+	defer tunnel.Shutdown()
+	defer busy.Close()
+	idle, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer idle.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				busy.Write(make([]byte, 100))
+			}
+		}
+	}()
+
+	// Idle connection doesn't compete for bandwidth, so the only busy one
+	// gets it all fairly
+	time.Sleep(2500 * time.Millisecond)
+	fairness := tunnel.Stats().Fairness
+	if fairness == nil {
+		t.Fatalf("Expected fairness to be sampled")
+	}
+	if fairness.Index1s != 1 || fairness.Index1m != 1 {
+		t.Errorf("Expected a single busy connection to be treated fairly, got %+v",
+			*fairness)
+	}
+}
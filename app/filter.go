@@ -0,0 +1,332 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnectionFilter selects tunnel connections matching an expression like
+// "src=10.0.0.0/8 and rate>1MiB/s and age>5m". Comparisons could be combined
+// with "and", "or", "not" and parentheses. Supported fields are:
+//
+//	id       connection identifier
+//	src      client address, compared with an IP address or a CIDR
+//	upstream upstream address, compared with an IP address or a CIDR
+//	class    traffic class (idle, interactive or bulk)
+//	rate     throughput averaged over 10 seconds (e.g. 1MiB/s or 8Mbps)
+//	limit    per-connection limit currently in effect (0 means unlimited)
+//	bytes    bytes forwarded in both directions (e.g. 10MiB)
+//	age      time since connection was opened (e.g. 5m)
+type ConnectionFilter struct {
+	expression string
+	match      func(c ConnectionInfo, now time.Time) bool
+}
+
+// ParseConnectionFilter parses a filter expression. Empty expression matches
+// all connections.
+func ParseConnectionFilter(expression string) (*ConnectionFilter, error) {
+	result := &ConnectionFilter{
+		expression: expression,
+		match: func(ConnectionInfo, time.Time) bool {
+			return true
+		},
+	}
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return result, nil
+	}
+	p := &filterParser{tokens: tokens}
+	result.match, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q in filter", p.tokens[p.pos])
+	}
+	return result, nil
+}
+
+// Match tells whether a connection matches the filter
+func (f *ConnectionFilter) Match(c ConnectionInfo) bool {
+	return f.match(c, time.Now())
+}
+
+// String returns filter expression
+func (f *ConnectionFilter) String() string {
+	return f.expression
+}
+
+type filterMatcher func(c ConnectionInfo, now time.Time) bool
+
+// filterOperators are comparison operators ordered so that longer ones are
+// tried first
+var filterOperators = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// tokenizeFilter splits filter expression into words, parentheses and
+// comparison operators
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case strings.IndexByte("!<>=", c) >= 0:
+			op := ""
+			for _, v := range filterOperators {
+				if strings.HasPrefix(s[i:], v) {
+					op = v
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("Unexpected %q in filter", s[i:])
+			}
+			tokens = append(tokens, op)
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t()!<>=", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// filterParser is a recursive descent parser of filter expressions. "and"
+// binds tighter than "or".
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// next returns the next token or empty string if there are no more tokens
+func (p *filterParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+// peek returns the next token without consuming it
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) parseOr() (filterMatcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c ConnectionInfo, now time.Time) bool {
+			return l(c, now) || right(c, now)
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterMatcher, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c ConnectionInfo, now time.Time) bool {
+			return l(c, now) && right(c, now)
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterMatcher, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(c ConnectionInfo, now time.Time) bool {
+			return !inner(c, now)
+		}, nil
+	case "(":
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("Missing \")\" in filter")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterMatcher, error) {
+	field := p.next()
+	op := p.next()
+	value := p.next()
+	if field == "" || op == "" || value == "" {
+		return nil, fmt.Errorf("Incomplete comparison in filter")
+	}
+	if !isFilterOperator(op) {
+		return nil, fmt.Errorf("Expected comparison operator after %q in filter, got %q",
+			field, op)
+	}
+
+	switch field {
+	case "src":
+		return addressComparison(op, value, func(c ConnectionInfo) string {
+			return c.Client
+		})
+	case "upstream":
+		return addressComparison(op, value, func(c ConnectionInfo) string {
+			return c.Upstream
+		})
+	case "class":
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("Field %q only supports = and !=", field)
+		}
+		return func(c ConnectionInfo, now time.Time) bool {
+			return (string(c.Traffic.Class) == value) == (op == "=")
+		}, nil
+	case "id":
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid connection identifier %q in filter", value)
+		}
+		return numericComparison(op, float64(id), func(c ConnectionInfo, now time.Time) float64 {
+			return float64(c.ID)
+		}), nil
+	case "rate", "limit":
+		rate, err := parseFilterRate(value)
+		if err != nil {
+			return nil, err
+		}
+		if field == "rate" {
+			return numericComparison(op, rate, func(c ConnectionInfo, now time.Time) float64 {
+				return c.Stats.Throughput.Rate10s
+			}), nil
+		}
+		return numericComparison(op, rate, func(c ConnectionInfo, now time.Time) float64 {
+			return float64(c.Limit)
+		}), nil
+	case "bytes":
+		size, err := parseFilterSize(value)
+		if err != nil {
+			return nil, err
+		}
+		return numericComparison(op, size, func(c ConnectionInfo, now time.Time) float64 {
+			return float64(c.Stats.Counters.total())
+		}), nil
+	case "age":
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid duration %q in filter", value)
+		}
+		return numericComparison(op, float64(age), func(c ConnectionInfo, now time.Time) float64 {
+			return float64(now.Sub(c.Opened))
+		}), nil
+	}
+	return nil, fmt.Errorf("Unknown filter field %q", field)
+}
+
+func isFilterOperator(s string) bool {
+	for _, v := range filterOperators {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// numericComparison returns a matcher comparing a connection property with a
+// given value
+func numericComparison(op string, value float64,
+	property func(c ConnectionInfo, now time.Time) float64) filterMatcher {
+	return func(c ConnectionInfo, now time.Time) bool {
+		v := property(c, now)
+		switch op {
+		case "=":
+			return v == value
+		case "!=":
+			return v != value
+		case "<":
+			return v < value
+		case "<=":
+			return v <= value
+		case ">":
+			return v > value
+		default:
+			return v >= value
+		}
+	}
+}
+
+// addressComparison returns a matcher checking whether host of an address
+// belongs to a given CIDR or equals to a given IP address
+func addressComparison(op, value string,
+	address func(c ConnectionInfo) string) (filterMatcher, error) {
+	if op != "=" && op != "!=" {
+		return nil, fmt.Errorf("Address fields only support = and !=")
+	}
+	network, err := parseNetwork(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address in filter: %v", err)
+	}
+	return func(c ConnectionInfo, now time.Time) bool {
+		ip := addrIP(address(c))
+		return (ip != nil && network.Contains(ip)) == (op == "=")
+	}, nil
+}
+
+// parseFilterSize parses an amount of data like "10MiB" or "1024"
+func parseFilterSize(s string) (float64, error) {
+	result, err := parseDataSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("%v in filter", err)
+	}
+	return result, nil
+}
+
+// parseFilterRate parses a rate either as an amount of data per second (e.g.
+// "1MiB/s") or in units of bandwidth limits (e.g. "8Mbps")
+func parseFilterRate(s string) (float64, error) {
+	if strings.HasSuffix(s, "/s") {
+		return parseFilterSize(strings.TrimSuffix(s, "/s"))
+	}
+	number, mul, div := parseSuffix(s)
+	result, err := strconv.ParseFloat(number, 64)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("Invalid rate %q in filter", s)
+	}
+	return result * float64(mul) / float64(div), nil
+}
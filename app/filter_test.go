@@ -0,0 +1,68 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+)
+
+func TestConnectionFilter(t *testing.T) {
+	conn := ConnectionInfo{
+		ID:       42,
+		Client:   "10.1.2.3:50000",
+		Upstream: "[::1]:8080",
+		Opened:   time.Now().Add(-10 * time.Minute),
+		Limit:    1024 * 1024,
+		Stats: TunnelStats{
+			Counters:   TunnelCounters{IngressBytes: 1024, EgressBytes: 1024},
+			Throughput: Throughput{Rate10s: 2 * 1024 * 1024},
+		},
+		Traffic: TrafficPattern{Class: limiter.TrafficBulk},
+	}
+
+	cases := []struct {
+		expression string
+		match      bool
+	}{
+		{"", true},
+		{"src=10.0.0.0/8 and rate>1MiB/s and age>5m", true},
+		{"src=10.1.2.3", true},
+		{"src!=10.0.0.0/8", false},
+		{"upstream=::1", true},
+		{"rate>16Mbps", true},
+		{"rate>17Mbps", false},
+		{"limit=1MiB/s and bytes>=2KiB and bytes<3KB", true},
+		{"class=interactive or id=42", true},
+		{"class=interactive or id=43", false},
+		{"not (class=bulk and age<1m)", true},
+		{"not class=bulk", false},
+		{"id=1 or id=2 and id=3 or id=42", true},
+	}
+	for _, c := range cases {
+		filter, err := ParseConnectionFilter(c.expression)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", c.expression, err)
+			continue
+		}
+		if filter.Match(conn) != c.match {
+			t.Errorf("Expected %q to match %v, got %v", c.expression, c.match, !c.match)
+		}
+	}
+
+	for _, expression := range []string{
+		"src",
+		"src=",
+		"src>10.0.0.0/8",
+		"rate>fast",
+		"age>5 minutes",
+		"color=red",
+		"(id=1",
+		"id=1 id=2",
+		"id!1",
+	} {
+		if _, err := ParseConnectionFilter(expression); err == nil {
+			t.Errorf("Expected %q to be rejected", expression)
+		}
+	}
+}
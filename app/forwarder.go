@@ -3,10 +3,10 @@ package app
 import (
 	"context"
 	"io"
-	"log"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -14,18 +14,68 @@ import (
 // Forwarder is the machinery to forward traffic between a pair of two net.Conn
 // while limiting the bandwidth with a set of rate.Limiter
 type Forwarder struct {
-	from net.Conn
-	to   net.Conn
+	from     net.Conn
+	to       net.Conn
+	counters []*int64
+	// Set by Run if forwarding ended because writing failed rather than
+	// because reading did
+	writeEnded bool
+	// Set by Run if forwarding ended because context got cancelled and
+	// whether data read by then was dropped
+	cancelled bool
+	dropped   bool
+	// Time data was last read, set by Run
+	lastRead time.Time
+	// Time small reads are held for to be batched with following ones (zero
+	// forwards every read right away)
+	coalesce time.Duration
+	// Recording forwarded data is appended to (if any) and its direction
+	recorder  *recorder
+	direction byte
+	// Called once data is read for the first time (if set)
+	firstRead func()
+	// Simulated network impairment (impairment) forwarded chunks are subject
+	// to. Nil if there's none.
+	impairment *atomic.Value
 }
 
-// CreateForwarder creates Forwarder structure based on required arguments
-func CreateForwarder(from net.Conn, to net.Conn) Forwarder {
+// CreateForwarder creates Forwarder structure based on required arguments.
+// Number of bytes successfully forwarded is atomically added to each of given
+// counters.
+func CreateForwarder(from net.Conn, to net.Conn, counters ...*int64) Forwarder {
 	return Forwarder{
-		from: from,
-		to:   to,
+		from:     from,
+		to:       to,
+		counters: counters,
 	}
 }
 
+// SetCoalesceDelay makes forwarder hold reads smaller than CoalesceSize for up
+// to a given time, so that data trickling in is forwarded in fewer, bigger
+// writes. Zero disables coalescing. Must be called before Run.
+func (f *Forwarder) SetCoalesceDelay(d time.Duration) {
+	f.coalesce = d
+}
+
+// setRecorder makes forwarder append data it forwards to a recording. Must be
+// called before Run.
+func (f *Forwarder) setRecorder(r *recorder, direction byte) {
+	f.recorder = r
+	f.direction = direction
+}
+
+// setImpairment makes forwarder delay, drop or reset chunks it forwards as an
+// impairment stored in a given value tells, e.g. to simulate a WAN link. The
+// impairment could be changed while forwarder runs. Must be called before
+// Run.
+func (f *Forwarder) setImpairment(impairment *atomic.Value) {
+	f.impairment = impairment
+}
+
+// CoalesceSize is the amount of data coalescing forwarder collects before
+// forwarding it without waiting for more
+const CoalesceSize = 16 * 1024
+
 // BufSize is a buffer size to use for connection forwarding
 const BufSize = 64 * 1024
 
@@ -48,6 +98,7 @@ func (f *Forwarder) Run(ctx context.Context) error {
 	var nr int
 	var nw int
 	var err error
+	var readAt time.Time
 	var exit = false
 	for !exit {
 		go func() {
@@ -56,6 +107,14 @@ func (f *Forwarder) Run(ctx context.Context) error {
 			// in case of slow producers.
 			f.from.SetReadDeadline(time.Now().Add(NetPollInterval))
 			nr, err = f.from.Read(buf)
+			if nr > 0 && f.firstRead != nil {
+				f.firstRead()
+				f.firstRead = nil
+			}
+			if f.coalesce > 0 && err == nil && nr > 0 && nr < CoalesceSize {
+				nr, err = f.coalesceReads(buf, nr)
+			}
+			readAt = time.Now()
 			netOpDone <- struct{}{}
 		}()
 
@@ -64,16 +123,46 @@ func (f *Forwarder) Run(ctx context.Context) error {
 			if err != nil && !isTimeout(err) {
 				if isConnectionClosed(err) {
 					err = nil
-				} else {
-					log.Printf("Failed to read from conn: %v", err)
 				}
 				exit = true
 			}
 		case <-ctx.Done():
+			// Interrupt the read, so that nothing reads from the connection once
+			// Run returns
+			f.from.SetReadDeadline(time.Now())
+			<-netOpDone
+			if nr > 0 {
+				f.dropped = true
+				nr = 0
+			}
 			err = nil
 			exit = true
+			f.cancelled = true
 		} // select
 
+		if nr > 0 {
+			f.lastRead = readAt
+		}
+		if nr > 0 && f.impairment != nil {
+			imp, _ := f.impairment.Load().(impairment)
+			switch {
+			case !f.hold(ctx, readAt.Add(imp.delay())):
+				nr = 0
+				err = nil
+				exit = true
+				f.cancelled = true
+				f.dropped = true
+			case imp.resets():
+				resetOnClose(f.from)
+				resetOnClose(f.to)
+				nr = 0
+				err = errSimulatedReset
+				exit = true
+			case imp.drops():
+				nr = 0
+			}
+		}
+
 		if nr > 0 {
 			go func() {
 				nw, err = f.to.Write(buf[0:nr])
@@ -82,27 +171,74 @@ func (f *Forwarder) Run(ctx context.Context) error {
 
 			select {
 			case <-netOpDone:
+				if nw > 0 {
+					for _, counter := range f.counters {
+						atomic.AddInt64(counter, int64(nw))
+					}
+					if f.recorder != nil {
+						f.recorder.record(f.direction, buf[:nw])
+					}
+				}
 				if err != nil {
 					if isConnectionClosed(err) {
 						err = nil
-					} else {
-						log.Printf("Failed to write to conn: %v", err)
 					}
+					f.writeEnded = true
 					exit = true
 				}
 				if nw != nr {
 					err = io.ErrShortWrite
+					f.writeEnded = true
 					exit = true
 				}
 			case <-ctx.Done():
+				f.to.SetWriteDeadline(time.Now())
+				<-netOpDone
 				err = nil
 				exit = true
+				f.cancelled = true
+				f.dropped = nw != nr
 			} // select
 		} // if nr > 0
 	} // for
 	return err
 }
 
+// hold waits until a given time. Returns false if context got cancelled
+// meanwhile.
+func (f *Forwarder) hold(ctx context.Context, until time.Time) bool {
+	wait := time.Until(until)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// coalesceReads keeps reading into a buffer already holding n bytes until
+// there is CoalesceSize of data or coalescing delay elapses. Returns the total
+// amount of data in the buffer.
+func (f *Forwarder) coalesceReads(buf []byte, n int) (int, error) {
+	f.from.SetReadDeadline(time.Now().Add(f.coalesce))
+	for n < CoalesceSize {
+		m, err := f.from.Read(buf[n:CoalesceSize])
+		n += m
+		if err != nil {
+			if isTimeout(err) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
 // isTimeout returns true if given error is network timeout
 func isTimeout(err error) bool {
 	if opErr, ok := err.(net.Error); ok {
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwarderCoalescing(t *testing.T) {
+	client, from := net.Pipe()
+	to, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	f := CreateForwarder(from, to)
+	f.SetCoalesceDelay(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Run(ctx)
+
+	go func() {
+		for _, chunk := range []string{"a", "b", "c"} {
+			client.Write([]byte(chunk))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := upstream.Read(buf)
+	if err != nil || string(buf[:n]) != "abc" {
+		t.Errorf("Expected small reads to be forwarded in a single write, got %q, %v",
+			buf[:n], err)
+	}
+}
+
+func TestForwarderDelay(t *testing.T) {
+	client, from := net.Pipe()
+	to, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	delay := new(atomic.Value)
+	delay.Store(impairment{latency: 100 * time.Millisecond})
+	f := CreateForwarder(from, to)
+	f.setImpairment(delay)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Run(ctx)
+
+	buf := make([]byte, 16)
+	forward := func() time.Duration {
+		start := time.Now()
+		go client.Write([]byte("a"))
+		upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := upstream.Read(buf); err != nil {
+			t.Fatalf("Failed to receive forwarded data: %v", err)
+		}
+		return time.Since(start)
+	}
+	if elapsed := forward(); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected chunk to be delayed by 100ms, got %v", elapsed)
+	}
+	delay.Store(impairment{})
+	if elapsed := forward(); elapsed >= 100*time.Millisecond {
+		t.Errorf("Expected chunk to be forwarded right away once delay is removed, "+
+			"got %v", elapsed)
+	}
+}
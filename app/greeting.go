@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// greetingTimeout limits time sending a greeting could take
+const greetingTimeout = 10 * time.Second
+
+// expandGreeting substitutes placeholders in a greeting with addresses of a
+// connection between client and tunnel:
+//
+//	{clientIP}   client IP address
+//	{clientPort} client port
+//	{localIP}    tunnel IP address client connected to
+//	{localPort}  tunnel port client connected to
+func expandGreeting(greeting string, client, local net.Addr) []byte {
+	clientIP, clientPort := splitAddr(client)
+	localIP, localPort := splitAddr(local)
+	return []byte(strings.NewReplacer(
+		"{clientIP}", clientIP,
+		"{clientPort}", clientPort,
+		"{localIP}", localIP,
+		"{localPort}", localPort,
+	).Replace(greeting))
+}
+
+// splitAddr returns host and port of an address (empty if it has none)
+func splitAddr(addr net.Addr) (string, string) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", ""
+	}
+	return host, port
+}
+
+// greet sends a greeting to a connection
+func greet(conn net.Conn, greeting []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(greetingTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(greeting)
+	return err
+}
+
+// greetUpstream sends upstream greeting of a connection (if any) to upstream
+func (c *Connection) greetUpstream(egress net.Conn) error {
+	if c.upstreamGreeting == "" {
+		return nil
+	}
+	greeting := expandGreeting(c.upstreamGreeting, c.ingress.RemoteAddr(), c.ingress.LocalAddr())
+	if err := greet(egress, greeting); err != nil {
+		return fmt.Errorf("Failed to send greeting to upstream: %v", err)
+	}
+	return nil
+}
+
+// greetClient sends client greeting of a connection (if any) to client
+func (c *Connection) greetClient() error {
+	if c.clientGreeting == "" {
+		return nil
+	}
+	greeting := expandGreeting(c.clientGreeting, c.ingress.RemoteAddr(), c.ingress.LocalAddr())
+	if err := greet(c.ingress, greeting); err != nil {
+		return fmt.Errorf("Failed to send greeting to client: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGreetings(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{Settings: TunnelSettings{
+			UpstreamGreeting: "FROM {clientIP} {clientPort} TO {localPort}\n",
+			ClientGreeting:   "WELCOME\n",
+		}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("hello"))
+
+	conn, err := upstream.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	_, clientPort, _ := net.SplitHostPort(client.LocalAddr().String())
+	_, localPort, _ := net.SplitHostPort(tunnel.listener.Addr().String())
+	expected := fmt.Sprintf("FROM 127.0.0.1 %s TO %s\n", clientPort, localPort)
+	if err != nil || greeting != expected {
+		t.Fatalf("Expected upstream greeting %q, got %q, %v", expected, greeting, err)
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(reader, data); err != nil || string(data) != "hello" {
+		t.Errorf("Expected client data after greeting, got %q, %v", data, err)
+	}
+
+	reply := make([]byte, len("WELCOME\n"))
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "WELCOME\n" {
+		t.Errorf("Expected client greeting, got %q, %v", reply, err)
+	}
+}
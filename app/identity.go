@@ -0,0 +1,181 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
+)
+
+// Ways to tell clients apart in an identity group
+const (
+	// IdentityIP identifies clients by their IP address
+	IdentityIP = "ip"
+	// IdentityLabelPrefix followed by a label name identifies clients by the
+	// value of a label attached to their connections upon admission (e.g.
+	// "label:user" for a user or a certificate subject found by Admit hook).
+	// Connections without such label are not grouped.
+	IdentityLabelPrefix = "label:"
+)
+
+// IdentityGroupConfigJSON encapsulates configuration of an identity group:
+// every client identity gets a single limit shared by its connections to all
+// tunnels using the group
+type IdentityGroupConfigJSON struct {
+	// How clients are identified: IdentityIP or IdentityLabelPrefix followed by
+	// a label name
+	By string `json:"by"`
+	// Combined bandwidth limit of all connections of a single client
+	Limit Limit `json:"limit"`
+}
+
+// validate checks identity group configuration for errors
+func (c IdentityGroupConfigJSON) validate() error {
+	if c.By != IdentityIP {
+		label := strings.TrimPrefix(c.By, IdentityLabelPrefix)
+		if label == c.By || !labelNameRe.MatchString(label) {
+			return fmt.Errorf("Unknown client identity %q", c.By)
+		}
+	}
+	if c.Limit <= 0 {
+		return fmt.Errorf("Identity group limit must be positive")
+	}
+	return nil
+}
+
+// identify returns identity of a client connected from a given address with
+// given labels. Returns empty string if client can't be identified.
+func (c IdentityGroupConfigJSON) identify(client net.Addr, labels Labels) string {
+	if c.By == IdentityIP {
+		if ip := addrIP(client.String()); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+	return labels[strings.TrimPrefix(c.By, IdentityLabelPrefix)]
+}
+
+// identityGroup holds limiters of clients that currently have connections
+type identityGroup struct {
+	config   IdentityGroupConfigJSON
+	limiters map[string]*identityLimiter
+}
+
+type identityLimiter struct {
+	limiter     *rate.Limiter
+	connections int
+}
+
+// identityLease is a limiter given to a connection by an identity group
+type identityLease struct {
+	groups   *IdentityGroups
+	group    *identityGroup
+	identity string
+	limiter  *rate.Limiter
+}
+
+// IdentityGroups is a set of named identity groups shared by tunnels. Limits
+// of clients are kept while they have connections to any tunnel using their
+// group. Safe for concurrent use.
+type IdentityGroups struct {
+	mu     *sync.Mutex
+	groups map[string]*identityGroup
+}
+
+// NewIdentityGroups creates an empty set of identity groups
+func NewIdentityGroups() *IdentityGroups {
+	return &IdentityGroups{
+		mu:     new(sync.Mutex),
+		groups: make(map[string]*identityGroup),
+	}
+}
+
+// Configure replaces the set of groups. Groups that keep identifying clients
+// the same way keep their limiters, so that connections made before and after
+// the change share the same limits.
+func (g *IdentityGroups) Configure(config map[string]IdentityGroupConfigJSON) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	groups := make(map[string]*identityGroup, len(config))
+	for name, c := range config {
+		group, ok := g.groups[name]
+		if !ok || group.config.By != c.By {
+			group = &identityGroup{limiters: make(map[string]*identityLimiter)}
+		}
+		if group.config.Limit != c.Limit {
+			for _, l := range group.limiters {
+				l.limiter.SetLimit(rate.Limit(c.Limit))
+			}
+		}
+		group.config = c
+		groups[name] = group
+	}
+	g.groups = groups
+}
+
+// config returns configuration of all groups
+func (g *IdentityGroups) config() map[string]IdentityGroupConfigJSON {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.groups) == 0 {
+		return nil
+	}
+	result := make(map[string]IdentityGroupConfigJSON, len(g.groups))
+	for name, group := range g.groups {
+		result[name] = group.config
+	}
+	return result
+}
+
+// acquire returns a limiter shared by connections of a client with given
+// address and labels in a named group. Returns nil if there's no such group
+// or client can't be identified. Lease must be released once connection ends.
+func (g *IdentityGroups) acquire(name string, client net.Addr, labels Labels) *identityLease {
+	if g == nil || name == "" {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[name]
+	if !ok {
+		return nil
+	}
+	identity := group.config.identify(client, labels)
+	if identity == "" {
+		return nil
+	}
+	l, ok := group.limiters[identity]
+	if !ok {
+		l = &identityLimiter{limiter: limiter.CreateLimiter(rate.Limit(group.config.Limit))}
+		group.limiters[identity] = l
+	}
+	l.connections++
+	return &identityLease{
+		groups:   g,
+		group:    group,
+		identity: identity,
+		limiter:  l.limiter,
+	}
+}
+
+// release gives a limiter back to its group. Limiter is forgotten once no
+// connections of a client are left. Safe to call on nil lease.
+func (l *identityLease) release() {
+	if l == nil {
+		return
+	}
+	l.groups.mu.Lock()
+	defer l.groups.mu.Unlock()
+	if il, ok := l.group.limiters[l.identity]; ok {
+		il.connections--
+		if il.connections == 0 {
+			delete(l.group.limiters, l.identity)
+		}
+	}
+}
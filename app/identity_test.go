@@ -0,0 +1,108 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// identityConnections returns the number of connections of a client in a
+// group
+func (g *IdentityGroups) identityConnections(name, identity string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if l, ok := g.groups[name].limiters[identity]; ok {
+		return l.connections
+	}
+	return 0
+}
+
+func TestIdentityGroups(t *testing.T) {
+	groups := NewIdentityGroups()
+	groups.Configure(map[string]IdentityGroupConfigJSON{
+		"byIP":   {By: IdentityIP, Limit: 1000},
+		"byUser": {By: IdentityLabelPrefix + "user", Limit: 2000},
+	})
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5678}
+
+	a := groups.acquire("byIP", client, nil)
+	b := groups.acquire("byIP", other, nil)
+	if a == nil || b == nil || a.limiter != b.limiter {
+		t.Fatalf("Expected connections from the same IP to share a limiter")
+	}
+	if groups.acquire("byUser", client, nil) != nil {
+		t.Errorf("Expected connection without a label not to be grouped")
+	}
+	if groups.acquire("unknown", client, nil) != nil {
+		t.Errorf("Expected connection in unknown group not to be grouped")
+	}
+	alice := groups.acquire("byUser", client, Labels{"user": "alice"})
+	bob := groups.acquire("byUser", client, Labels{"user": "bob"})
+	if alice == nil || bob == nil || alice.limiter == bob.limiter {
+		t.Errorf("Expected different users to have different limiters")
+	}
+
+	// Limit change applies to limiters in use
+	groups.Configure(map[string]IdentityGroupConfigJSON{
+		"byIP": {By: IdentityIP, Limit: 3000},
+	})
+	if a.limiter.Limit() != 3000 {
+		t.Errorf("Expected limiter to follow group limit, got %v", a.limiter.Limit())
+	}
+	if c := groups.acquire("byIP", client, nil); c == nil || c.limiter != a.limiter {
+		t.Errorf("Expected limiter to survive reconfiguration")
+	} else {
+		c.release()
+	}
+
+	a.release()
+	b.release()
+	if n := groups.identityConnections("byIP", "10.0.0.1"); n != 0 {
+		t.Errorf("Expected client limiter to be forgotten, got %d connections", n)
+	}
+}
+
+func TestTunnelIdentityGroup(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	groups := NewIdentityGroups()
+	groups.Configure(map[string]IdentityGroupConfigJSON{
+		"customers": {By: IdentityIP, Limit: 1000},
+	})
+	var tunnels []*Tunnel
+	for i := 0; i < 2; i++ {
+		tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+			TunnelLimits{IdentityGroup: "customers"}, TunnelOptions{IdentityGroups: groups})
+		if err != nil {
+			t.Fatalf("Failed to create tunnel: %v", err)
+		}
+		defer tunnel.Shutdown()
+		tunnels = append(tunnels, tunnel)
+	}
+
+	var clients []net.Conn
+	for _, tunnel := range tunnels {
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	waitIdentityConnections := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for groups.identityConnections("customers", "127.0.0.1") != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d connections to share client limit, got %d", n,
+					groups.identityConnections("customers", "127.0.0.1"))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitIdentityConnections(2)
+	for _, client := range clients {
+		client.Close()
+	}
+	waitIdentityConnections(0)
+}
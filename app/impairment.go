@@ -0,0 +1,79 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// errSimulatedReset ends connections reset to simulate a faulty network
+var errSimulatedReset = errors.New("Connection reset to simulate network failure")
+
+// impairment describes simulated network conditions chunks of data a tunnel
+// forwards are subject to
+type impairment struct {
+	latency      time.Duration
+	jitter       time.Duration
+	distribution string
+	// Probabilities of a chunk to be dropped and of connection to be reset
+	// instead of forwarding a chunk
+	loss  float64
+	reset float64
+}
+
+// impairment returns network impairment chunks forwarded with given limits are
+// subject to
+func (l TunnelLimits) impairment() impairment {
+	return impairment{
+		latency:      time.Duration(l.Latency),
+		jitter:       time.Duration(l.Jitter),
+		distribution: l.JitterDistribution,
+		loss:         l.LossProbability,
+		reset:        l.ResetProbability,
+	}
+}
+
+// validateLoss checks loss and reset probabilities of limits for errors
+func (l TunnelLimits) validateLoss() error {
+	if l.LossProbability < 0 || l.LossProbability > 1 ||
+		l.ResetProbability < 0 || l.ResetProbability > 1 {
+		return fmt.Errorf("Loss and reset probabilities must be between 0 and 1")
+	}
+	return nil
+}
+
+// drops tells whether the next chunk should be dropped
+func (i impairment) drops() bool {
+	return i.loss > 0 && rand.Float64() < i.loss
+}
+
+// resets tells whether connection should be reset instead of forwarding the
+// next chunk
+func (i impairment) resets() bool {
+	return i.reset > 0 && rand.Float64() < i.reset
+}
+
+// resetOnClose makes closing a connection send RST to its peer instead of
+// FIN. Connections other than TCP ones are left intact.
+func resetOnClose(conn net.Conn) {
+	if c, ok := rawConn(conn).(*net.TCPConn); ok {
+		c.SetLinger(0)
+	}
+}
+
+// rawConn returns the innermost connection wrapped by a connection (the
+// connection itself if it doesn't wrap one)
+func rawConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case interface{ Inner() net.Conn }:
+			conn = c.Inner()
+		case *prefixedConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
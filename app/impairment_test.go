@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwarderLoss(t *testing.T) {
+	client, from := net.Pipe()
+	to, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	impaired := new(atomic.Value)
+	impaired.Store(impairment{loss: 1})
+	f := CreateForwarder(from, to)
+	f.setImpairment(impaired)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Run(ctx)
+
+	client.Write([]byte("lost"))
+	buf := make([]byte, 16)
+	upstream.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := upstream.Read(buf); !isTimeout(err) {
+		t.Fatalf("Expected chunk to be dropped, got %q, %v", buf[:n], err)
+	}
+	impaired.Store(impairment{})
+	go client.Write([]byte("kept"))
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := upstream.Read(buf)
+	if err != nil || string(buf[:n]) != "kept" {
+		t.Errorf("Expected chunk to be forwarded once loss is off, got %q, %v", buf[:n],
+			err)
+	}
+}
+
+func TestSimulatedReset(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{ResetProbability: 1}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("hello"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !isConnectionClosed(err) {
+		t.Errorf("Expected connection to be reset, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Stats().Closed[CloseSimulatedReset] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected reset to be counted, got %v", tunnel.Stats().Closed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := (TunnelLimits{LossProbability: 1.5}).validate(); err == nil {
+		t.Errorf("Expected loss probability above 1 to be rejected")
+	}
+}
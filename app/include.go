@@ -0,0 +1,173 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxIncludeDepth limits nesting of included configuration files
+const maxIncludeDepth = 8
+
+// mergedConfigFields are top-level configuration fields that are maps.
+// Entries of included files are merged key by key, entries of including file
+// overriding included ones. Other fields of including file replace included
+// ones as a whole.
+var mergedConfigFields = map[string]bool{
+	"tenants":        true,
+	"profiles":       true,
+	"identityGroups": true,
+	"workerPools":    true,
+	"tunnels":        true,
+	"dns":            true,
+}
+
+// configVariable matches ${NAME} references to variables in configuration
+// files
+var configVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// readConfiguration reads configuration file at a given path along with files
+// it includes and returns top-level fields of the merged result. Variables are
+// expanded before parsing.
+func readConfiguration(path string) (map[string]json.RawMessage, error) {
+	return readConfigurationFragment(path, nil)
+}
+
+func readConfigurationFragment(path string, including []string) (map[string]json.RawMessage, error) {
+	for _, p := range including {
+		if p == path {
+			return nil, fmt.Errorf("Configuration file %q includes itself", path)
+		}
+	}
+	if len(including) >= maxIncludeDepth {
+		return nil, fmt.Errorf("Configuration files are included more than %d levels deep",
+			maxIncludeDepth)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err = expandVariables(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+
+	patterns, err := includePatterns(raw["include"])
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+	delete(raw, "include")
+	if len(patterns) == 0 {
+		return raw, nil
+	}
+
+	result := make(map[string]json.RawMessage)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%q: Invalid include pattern %q: %v", path, pattern, err)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			fragment, err := readConfigurationFragment(m, append(including, path))
+			if err != nil {
+				return nil, err
+			}
+			if result, err = mergeConfiguration(result, fragment); err != nil {
+				return nil, fmt.Errorf("%q: %v", m, err)
+			}
+		}
+	}
+	if result, err = mergeConfiguration(result, raw); err != nil {
+		return nil, fmt.Errorf("%q: %v", path, err)
+	}
+	return result, nil
+}
+
+// includePatterns parses include field of a configuration file: a path or a
+// list of paths, either of them possibly a glob pattern
+func includePatterns(include json.RawMessage) ([]string, error) {
+	if include == nil {
+		return nil, nil
+	}
+	var single string
+	if err := json.Unmarshal(include, &single); err == nil {
+		return []string{single}, nil
+	}
+	var result []string
+	if err := json.Unmarshal(include, &result); err != nil {
+		return nil, fmt.Errorf("Include must be a path or a list of paths")
+	}
+	return result, nil
+}
+
+// mergeConfiguration overrides top-level fields of base configuration with
+// the ones of override (see mergedConfigFields)
+func mergeConfiguration(base, override map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	for k, v := range override {
+		if !mergedConfigFields[k] || base[k] == nil {
+			base[k] = v
+			continue
+		}
+		var merged, entries map[string]json.RawMessage
+		if err := json.Unmarshal(base[k], &merged); err != nil {
+			return nil, fmt.Errorf("Invalid %q: %v", k, err)
+		}
+		if err := json.Unmarshal(v, &entries); err != nil {
+			return nil, fmt.Errorf("Invalid %q: %v", k, err)
+		}
+		if merged == nil {
+			merged = entries
+		} else {
+			for name, entry := range entries {
+				merged[name] = entry
+			}
+		}
+		encoded, err := json.Marshal(merged)
+		if err != nil {
+			return nil, err
+		}
+		base[k] = encoded
+	}
+	return base, nil
+}
+
+// expandVariables replaces ${NAME} references in configuration file contents
+// with values of environment variables. HOSTNAME defaults to the name of the
+// host if it's not set in the environment. Values are escaped as JSON string
+// contents, so references could be placed within strings.
+func expandVariables(contents []byte) ([]byte, error) {
+	var err error
+	result := configVariable.ReplaceAllFunc(contents, func(ref []byte) []byte {
+		name := string(configVariable.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok && name == "HOSTNAME" {
+			value, err = os.Hostname()
+			ok = err == nil
+		}
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("Undefined variable %q", name)
+			}
+			return ref
+		}
+		escaped, _ := json.Marshal(value)
+		return []byte(strings.TrimSuffix(strings.TrimPrefix(string(escaped), `"`), `"`))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
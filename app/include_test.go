@@ -0,0 +1,70 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigurationIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "include")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("Failed to write %q: %v", name, err)
+		}
+		return path
+	}
+
+	os.Setenv("THROTTLE_TEST_UPSTREAM", "backend")
+	defer os.Unsetenv("THROTTLE_TEST_UPSTREAM")
+	write("base.d/1.json", `{"version": 1, "tunnels": {
+		":1000": {"connectTo": "${THROTTLE_TEST_UPSTREAM}:80", "tunnelLimit": 100},
+		":1001": {"connectTo": "localhost:81"}}}`)
+	write("base.d/2.json", `{"profiles": {"slow": {"tunnelLimit": 10}}}`)
+	path := write("host.json", `{"include": "base.d/*.json", "tunnels": {
+		":1000": {"connectTo": "localhost:82", "tunnelLimit": 200}}}`)
+
+	config, err := load(path)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	if len(config.Tunnels) != 2 || config.Tunnels[":1000"].TunnelLimit != 200 ||
+		config.Tunnels[":1001"].ConnectTo != "localhost:81" {
+		t.Errorf("Expected including file to override tunnels, got %v", config.Tunnels)
+	}
+	if config.Profiles["slow"].TunnelLimit != 10 {
+		t.Errorf("Expected profiles to be included, got %v", config.Profiles)
+	}
+
+	path = write("vars.json", `{"include": ["base.d/1.json"]}`)
+	if config, err = load(path); err != nil ||
+		config.Tunnels[":1000"].ConnectTo != "backend:80" {
+		t.Errorf("Expected variables to be expanded, got %v (%v)", config.Tunnels, err)
+	}
+
+	path = write("loop.json", `{"include": "loop.json"}`)
+	if _, err := load(path); err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("Expected include loop to be reported, got %v", err)
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	os.Setenv("THROTTLE_TEST_VALUE", `a"b`)
+	defer os.Unsetenv("THROTTLE_TEST_VALUE")
+	result, err := expandVariables([]byte(`"${THROTTLE_TEST_VALUE}" $HOME`))
+	if err != nil || string(result) != `"a\"b" $HOME` {
+		t.Errorf("Expected value to be escaped, got %s (%v)", result, err)
+	}
+
+	if _, err := expandVariables([]byte(`${THROTTLE_TEST_UNDEFINED}`)); err == nil {
+		t.Errorf("Expected undefined variable to be reported")
+	}
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"time"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+)
+
+// Bucket is a point-in-time view of a token bucket limiter
+type Bucket struct {
+	Limit Limit `json:"limit"`
+	Burst int   `json:"burst"`
+	// Bytes that could be transferred right away. Negative if transfers wait
+	// for tokens to be replenished.
+	Tokens float64 `json:"tokens"`
+}
+
+// Buckets describes limiters in effect for a tunnel or a connection
+type Buckets struct {
+	// Tunnel limit (nil if tunnel isn't limited as a whole)
+	Tunnel *Bucket `json:"tunnel,omitempty"`
+	// Limits shared with other tunnels or connections (e.g. tenant aggregate
+	// or identity group limits)
+	Shared []Bucket `json:"shared,omitempty"`
+	// Per-connection limit (connections only, nil if connection isn't limited
+	// individually)
+	Connection *Bucket `json:"connection,omitempty"`
+}
+
+// Waits describes time transfers spent waiting for limiters
+type Waits struct {
+	// Number of times transfers had to wait and bytes they delayed
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+	// Total time spent waiting
+	Time Duration `json:"time"`
+	// Average number of transfers waiting for limiters over the last 10
+	// seconds (each connection has two: ingress and egress)
+	Waiting float64 `json:"waiting"`
+}
+
+// Add returns a sum of two sets of waits
+func (w Waits) Add(other Waits) Waits {
+	return Waits{
+		Count:   w.Count + other.Count,
+		Bytes:   w.Bytes + other.Bytes,
+		Time:    w.Time + other.Time,
+		Waiting: w.Waiting + other.Waiting,
+	}
+}
+
+// loadWaits atomically loads waits accounted by limiter. Meter tracks total
+// time spent waiting.
+func loadWaits(w *limiter.WaitStats, meter *rateMeter) Waits {
+	v := w.Load()
+	return Waits{
+		Count:   v.Waits,
+		Bytes:   v.Bytes,
+		Time:    Duration(v.Time),
+		Waiting: meter.throughput().Rate10s / float64(time.Second),
+	}
+}
+
+// bucket converts limiter bucket state
+func bucket(state *limiter.BucketState) *Bucket {
+	if state == nil {
+		return nil
+	}
+	return &Bucket{
+		Limit:  Limit(state.Limit),
+		Burst:  state.Burst,
+		Tokens: state.Tokens,
+	}
+}
+
+// sharedBuckets converts states of shared limiters
+func sharedBuckets(states []limiter.BucketState) []Bucket {
+	var result []Bucket
+	for i := range states {
+		result = append(result, *bucket(&states[i]))
+	}
+	return result
+}
+
+// inspectBuckets takes a snapshot of tunnel limiters reported by Stats. Must
+// be called on the tunnel goroutine.
+func (t *Tunnel) inspectBuckets() {
+	b := t.listener.Buckets()
+	t.buckets.Store(&Buckets{
+		Tunnel: bucket(b.Global),
+		Shared: sharedBuckets(b.Shared),
+	})
+}
+
+// loadBuckets returns the latest snapshot of tunnel limiters
+func (t *Tunnel) loadBuckets() *Buckets {
+	b, _ := t.buckets.Load().(*Buckets)
+	return b
+}
+
+// connectionBuckets describes limiters of an active connection. Must be
+// called on the tunnel goroutine.
+func (t *Tunnel) connectionBuckets(c *Connection) *Buckets {
+	b := c.listener.ConnectionBuckets(c.ingress)
+	result := &Buckets{Connection: bucket(b.Connection), Shared: sharedBuckets(b.Shared)}
+	if tunnel := t.loadBuckets(); tunnel != nil {
+		result.Tunnel = tunnel.Tunnel
+		result.Shared = append(append([]Bucket(nil), tunnel.Shared...), result.Shared...)
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterInspection(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{TunnelLimit: 100000, ConnectionLimit: 10000},
+		TunnelOptions{Settings: TunnelSettings{BandwidthTest: true}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte(TestPreambleMagic + TestDiscard + "\n"))
+	go client.Write(make([]byte, 20000))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		if len(connections) == 1 && connections[0].Stats.Waits.Count > 0 {
+			buckets := connections[0].Stats.Buckets
+			if buckets == nil || buckets.Connection == nil || buckets.Connection.Limit != 10000 ||
+				buckets.Tunnel == nil || buckets.Tunnel.Limit != 100000 {
+				t.Errorf("Unexpected connection buckets %+v", buckets)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection to wait for limiters, got %+v", connections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := tunnel.Stats()
+	if stats.Waits.Count == 0 || stats.Buckets == nil || stats.Buckets.Tunnel == nil {
+		t.Errorf("Expected tunnel stats to include waits and buckets, got %+v", stats)
+	}
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Distributions of jitter added to forwarded chunks
+const (
+	// Delays are spread evenly within Latency ± Jitter
+	JitterUniform = "uniform"
+	// Delays are normally distributed around Latency with standard deviation
+	// of Jitter
+	JitterNormal = "normal"
+)
+
+// validateJitter checks latency and jitter settings of limits for errors
+func (l TunnelLimits) validateJitter() error {
+	if l.Latency < 0 || l.Jitter < 0 {
+		return fmt.Errorf("Latency and jitter must not be negative")
+	}
+	switch l.JitterDistribution {
+	case "", JitterUniform, JitterNormal:
+		return nil
+	default:
+		return fmt.Errorf("Unknown jitter distribution %q", l.JitterDistribution)
+	}
+}
+
+// delay returns the delay of the next chunk, which is never negative
+func (i impairment) delay() time.Duration {
+	result := i.latency
+	if i.jitter > 0 {
+		var deviation float64
+		if i.distribution == JitterNormal {
+			deviation = rand.NormFloat64()
+		} else {
+			deviation = 2*rand.Float64() - 1
+		}
+		result += time.Duration(deviation * float64(i.jitter))
+	}
+	if result < 0 {
+		return 0
+	}
+	return result
+}
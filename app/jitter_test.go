@@ -0,0 +1,48 @@
+package app
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	const samples = 10000
+	uniform := impairment{latency: 80 * time.Millisecond, jitter: 20 * time.Millisecond}
+	normal := uniform
+	normal.distribution = JitterNormal
+	var sum, squares float64
+	for i := 0; i < samples; i++ {
+		if d := uniform.delay(); d < 60*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatalf("Expected uniform delay within 80ms ± 20ms, got %v", d)
+		}
+		d := float64(normal.delay())
+		sum += d
+		squares += d * d
+	}
+	mean := sum / samples
+	deviation := math.Sqrt(squares/samples - mean*mean)
+	if math.Abs(mean-float64(80*time.Millisecond)) > float64(2*time.Millisecond) ||
+		math.Abs(deviation-float64(20*time.Millisecond)) > float64(2*time.Millisecond) {
+		t.Errorf("Expected normal delay around 80ms with deviation of 20ms, got %v and %v",
+			time.Duration(mean), time.Duration(deviation))
+	}
+
+	wide := impairment{latency: time.Millisecond, jitter: time.Second}
+	for i := 0; i < samples; i++ {
+		if d := wide.delay(); d < 0 {
+			t.Fatalf("Expected delay not to be negative, got %v", d)
+		}
+	}
+
+	invalid := []TunnelLimits{
+		{Latency: Duration(-time.Millisecond)},
+		{Jitter: Duration(-time.Millisecond)},
+		{JitterDistribution: "pareto"},
+	}
+	for _, limits := range invalid {
+		if err := limits.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", limits)
+		}
+	}
+}
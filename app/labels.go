@@ -0,0 +1,164 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels are arbitrary name-value pairs attached to a connection (e.g.
+// customer, class or region). Names must be valid Prometheus label names.
+type Labels map[string]string
+
+// labelNameRe matches valid label names
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// names returns label names in a stable order
+func (l Labels) names() []string {
+	result := make([]string, 0, len(l))
+	for k := range l {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// String formats labels as "name=value" pairs ordered by name
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for _, k := range l.names() {
+		pairs = append(pairs, k+"="+l[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// sanitize returns a copy of labels without ones having invalid names
+func (l Labels) sanitize() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+	result := make(Labels, len(l))
+	for k, v := range l {
+		if !labelNameRe.MatchString(k) {
+			log.Printf("Ignored connection label with invalid name %q", k)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// Admission is a decision on an accepted connection
+type Admission struct {
+	// Connection gets closed right away if set
+	Reject bool
+	// Labels attached to an admitted connection
+	Labels Labels
+	// Priority of an admitted connection overriding priority rules (see
+	// PriorityRules). Zero leaves it to the rules.
+	Priority int
+	// Context carried by an admitted connection until it ends, e.g. with
+	// request-scoped values. Should be derived from the context given to
+	// AdmitFunc. Nil stands for that context.
+	Context context.Context
+}
+
+// AdmitFunc decides whether a connection from a given client is admitted and
+// labels it. It's called on the tunnel goroutine, so it must not block.
+type AdmitFunc func(ctx context.Context, client net.Addr) Admission
+
+// ClosedConnection describes an admitted connection that has ended
+type ClosedConnection struct {
+	ID     uint64
+	Client string
+	Labels Labels
+	Reason CloseReason
+	// Traffic forwarded by the connection
+	Counters TunnelCounters
+	// Error connection ended with, if any
+	Err error
+}
+
+// CloseFunc is notified about an admitted connection that has ended. Context
+// is the one connection carried (already cancelled, so only its values are
+// of use). It's called on the tunnel goroutine, so it must not block.
+type CloseFunc func(ctx context.Context, c ClosedConnection)
+
+// LabeledCounters holds traffic of connections having the same labels
+type LabeledCounters struct {
+	Labels   Labels         `json:"labels"`
+	Counters TunnelCounters `json:"counters"`
+}
+
+// addLabeled returns a sum of two sets of labeled counters. Counters of the
+// same labels are summed up.
+func addLabeled(a, b []LabeledCounters) []LabeledCounters {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	byLabels := make(map[string]int)
+	result := make([]LabeledCounters, 0, len(a)+len(b))
+	for _, list := range [][]LabeledCounters{a, b} {
+		for _, v := range list {
+			key := v.Labels.String()
+			if i, ok := byLabels[key]; ok {
+				result[i].Counters = result[i].Counters.Add(v.Counters)
+				continue
+			}
+			byLabels[key] = len(result)
+			result = append(result, v)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Labels.String() < result[j].Labels.String()
+	})
+	return result
+}
+
+// labeledTraffic accounts traffic of tunnel connections by their labels
+type labeledTraffic struct {
+	mu       *sync.Mutex
+	counters map[string]*LabeledCounters
+}
+
+func newLabeledTraffic() *labeledTraffic {
+	return &labeledTraffic{
+		mu:       new(sync.Mutex),
+		counters: make(map[string]*LabeledCounters),
+	}
+}
+
+// countersFor returns counters traffic of connections with given labels is
+// added to (atomically). Returns nil for connections without labels.
+func (l *labeledTraffic) countersFor(labels Labels) *TunnelCounters {
+	if len(labels) == 0 {
+		return nil
+	}
+	key := labels.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counters[key]
+	if !ok {
+		c = &LabeledCounters{Labels: labels}
+		l.counters[key] = c
+	}
+	return &c.Counters
+}
+
+// load returns current labeled counters
+func (l *labeledTraffic) load() []LabeledCounters {
+	l.mu.Lock()
+	result := make([]LabeledCounters, 0, len(l.counters))
+	for _, c := range l.counters {
+		result = append(result, LabeledCounters{
+			Labels:   c.Labels,
+			Counters: loadCounters(&c.Counters),
+		})
+	}
+	l.mu.Unlock()
+	return addLabeled(result, nil)
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Latency describes how fast upstream responds, so that slow upstreams could
+// be told apart from throttling
+type Latency struct {
+	// Number of upstream connections made and total time making them took
+	// (including TLS handshake and greeting). Reused upstream connections are
+	// not counted.
+	Dials    int64    `json:"dials"`
+	DialTime Duration `json:"dialTime"`
+	// Number of connections upstream sent data to and total time to first
+	// byte: from client data first forwarded to upstream (or from connecting
+	// if upstream speaks first) to first data received from upstream
+	FirstBytes    int64    `json:"firstBytes"`
+	FirstByteTime Duration `json:"firstByteTime"`
+}
+
+// Add returns a sum of two sets of latencies
+func (l Latency) Add(other Latency) Latency {
+	return Latency{
+		Dials:         l.Dials + other.Dials,
+		DialTime:      l.DialTime + other.DialTime,
+		FirstBytes:    l.FirstBytes + other.FirstBytes,
+		FirstByteTime: l.FirstByteTime + other.FirstByteTime,
+	}
+}
+
+// latencyStats accumulates latencies. Fields are updated atomically.
+type latencyStats struct {
+	dials         int64
+	dialTime      int64
+	firstBytes    int64
+	firstByteTime int64
+}
+
+// load atomically loads latencies
+func (s *latencyStats) load() Latency {
+	return Latency{
+		Dials:         atomic.LoadInt64(&s.dials),
+		DialTime:      Duration(atomic.LoadInt64(&s.dialTime)),
+		FirstBytes:    atomic.LoadInt64(&s.firstBytes),
+		FirstByteTime: Duration(atomic.LoadInt64(&s.firstByteTime)),
+	}
+}
+
+// recordDial accounts an upstream connection made in a given time
+func (s *latencyStats) recordDial(d time.Duration) {
+	atomic.AddInt64(&s.dials, 1)
+	atomic.AddInt64(&s.dialTime, int64(d))
+}
+
+// recordFirstByte accounts time to first byte of a connection
+func (s *latencyStats) recordFirstByte(d time.Duration) {
+	atomic.AddInt64(&s.firstBytes, 1)
+	atomic.AddInt64(&s.firstByteTime, int64(d))
+}
+
+// clientSent records the moment client data was first forwarded to upstream
+func (c *Connection) clientSent() {
+	atomic.CompareAndSwapInt64(&c.firstSent, 0, time.Now().UnixNano())
+}
+
+// upstreamSent accounts time to first byte once upstream sent data
+func (c *Connection) upstreamSent() {
+	now := time.Now()
+	from := c.connected
+	if sent := atomic.LoadInt64(&c.firstSent); sent != 0 {
+		from = time.Unix(0, sent)
+	}
+	d := now.Sub(from)
+	c.latency.recordFirstByte(d)
+	if c.tunnelLatency != nil {
+		c.tunnelLatency.recordFirstByte(d)
+	}
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamLatency(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		time.Sleep(delay)
+		conn.Write(buf)
+		io.Copy(conn, conn)
+	}()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("hello"))
+	if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+		t.Fatalf("Failed to receive reply: %v", err)
+	}
+
+	connections := tunnel.Connections()
+	if len(connections) != 1 {
+		t.Fatalf("Expected a single connection, got %+v", connections)
+	}
+	for name, latency := range map[string]Latency{
+		"connection": connections[0].Stats.Latency,
+		"tunnel":     tunnel.Stats().Latency,
+	} {
+		if latency.Dials != 1 || latency.DialTime <= 0 || latency.FirstBytes != 1 ||
+			time.Duration(latency.FirstByteTime) < delay ||
+			time.Duration(latency.FirstByteTime) > 5*time.Second {
+			t.Errorf("Unexpected %s latency: %+v", name, latency)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"time"
+)
+
+// DefaultListenRetries is the number of failed attempts to listen again after
+// which a tunnel publishes EventListenRetriesExhausted
+const DefaultListenRetries = 12
+
+// Tunnel is saturated once its throughput reaches saturationThreshold of its
+// limit, saturation is reported once it lasts for saturationPeriod
+const saturationThreshold = 0.9
+
+var saturationPeriod = time.Minute
+
+// listenRetries returns the number of failed attempts to listen again that
+// are tolerated
+func (s TunnelSettings) listenRetries() int {
+	if s.ListenRetries == 0 {
+		return DefaultListenRetries
+	}
+	return s.ListenRetries
+}
+
+// publishTunnel publishes an event about the tunnel itself. Must be called on
+// the tunnel goroutine.
+func (t *Tunnel) publishTunnel(eventType EventType, err error) {
+	e := &TunnelEvent{
+		ConnectTo: t.connectTo,
+		Limits:    t.currentLimits,
+		Draining:  t.Draining(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.events.Publish(Event{
+		Type:     eventType,
+		ListenAt: t.listenAt,
+		Tenant:   t.tenant.Load().(string),
+		Tunnel:   e,
+	})
+}
+
+// checkSaturation publishes EventTunnelSaturated once tunnel uses most of its
+// limit for saturationPeriod. It's published again only after saturation ends.
+// Must be called on the tunnel goroutine.
+func (t *Tunnel) checkSaturation(now time.Time) {
+	limit := t.tunnelLimit(t.currentLimits)
+	if limit <= 0 || t.meter.throughput().Rate1s < saturationThreshold*float64(limit) {
+		t.saturatedSince = time.Time{}
+		t.saturationReported = false
+		return
+	}
+	if t.saturatedSince.IsZero() {
+		t.saturatedSince = now
+	}
+	if !t.saturationReported && now.Sub(t.saturatedSince) >= saturationPeriod {
+		t.saturationReported = true
+		t.logf(LogWarn, "Tunnel at %q is saturated since %v", t.listenAt,
+			t.saturatedSince.Format(time.RFC3339))
+		t.publishTunnel(EventTunnelSaturated, nil)
+	}
+}
@@ -0,0 +1,24 @@
+package app
+
+import (
+	"time"
+)
+
+// closeExpired closes connections that lived for longer than MaxLifetime of
+// tunnel limits. Must be called on the tunnel goroutine.
+func (t *Tunnel) closeExpired(activeConnections *connectionRegistry, now time.Time) {
+	maxLifetime := time.Duration(t.currentLimits.MaxLifetime)
+	if maxLifetime == 0 {
+		return
+	}
+	for _, conn := range activeConnections.all() {
+		if now.Sub(conn.opened) < maxLifetime {
+			continue
+		}
+		activeConnections.remove(conn)
+		conn.Close()
+		t.logf(LogInfo, "Connection %d at %q closed after living for %v", conn.ID(),
+			t.listenAt, now.Sub(conn.opened).Round(time.Second))
+		t.connectionClosed(conn, CloseMaxLifetime, loadCounters(&conn.counters), nil)
+	}
+}
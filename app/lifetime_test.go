@@ -0,0 +1,32 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnelMaxLifetime(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{MaxLifetime: Duration(500 * time.Millisecond)}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected connection to be closed")
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseMaxLifetime] != 1 {
+		t.Errorf("Expected connection to be closed for its lifetime, got %v", closed)
+	}
+}
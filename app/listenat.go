@@ -0,0 +1,107 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// ListenConflictError is returned when a tunnel can't listen at its address
+// because another tunnel (or another process) listens there
+type ListenConflictError struct {
+	ListenAt ListenAt
+	// Tunnel listening at the same address. Empty if address is occupied by
+	// something else.
+	Other ListenAt
+}
+
+// Is tells that conflicts are ErrListenFailed errors (used by errors.Is)
+func (e *ListenConflictError) Is(target error) bool {
+	return target == ErrListenFailed
+}
+
+func (e *ListenConflictError) Error() string {
+	if e.Other == "" {
+		return fmt.Sprintf("Address %q is already in use", e.ListenAt)
+	}
+	return fmt.Sprintf("Tunnels %q and %q listen at the same address", e.Other, e.ListenAt)
+}
+
+// listenAddress is a ListenAt broken into parts to tell whether two tunnels
+// would compete for the same socket
+type listenAddress struct {
+	host string
+	// Nil if host is not an IP address
+	ip   net.IP
+	zone string
+	port int
+}
+
+func parseListenAddress(listenAt ListenAt) (listenAddress, error) {
+	addr, err := parseAddress(string(listenAt), "")
+	if err != nil {
+		return listenAddress{}, err
+	}
+	return listenAddress{
+		host: strings.ToLower(addr.host),
+		ip:   addr.ip,
+		zone: addr.zone,
+		port: addr.port,
+	}, nil
+}
+
+// covers tells whether listening at a address occupies another one, i.e. if
+// address is a wildcard of the same address family or the same host
+func (a listenAddress) covers(other listenAddress) bool {
+	switch {
+	case a.host == "" || (a.ip != nil && a.ip.Equal(net.IPv6unspecified)):
+		return true
+	case a.ip != nil && a.ip.Equal(net.IPv4zero):
+		// Host names may resolve to IPv4 addresses
+		return other.ip == nil || other.ip.To4() != nil
+	case a.ip != nil && other.ip != nil:
+		return a.ip.Equal(other.ip) && a.zone == other.zone
+	}
+	return a.host == other.host
+}
+
+// conflicts tells whether two addresses could not be listened at
+// simultaneously. Addresses with zero port never conflict since they get
+// distinct ephemeral ports.
+func (a listenAddress) conflicts(other listenAddress) bool {
+	if a.port == 0 || a.port != other.port {
+		return false
+	}
+	return a.covers(other) || other.covers(a)
+}
+
+// listenConflict returns an error if a given address conflicts with any of
+// the others. Any of them may be a port range. Addresses that couldn't be
+// parsed are left for listening to report.
+func listenConflict(listenAt ListenAt, others []ListenAt) error {
+	a, err := listenPortRange(listenAt)
+	if err != nil {
+		return nil
+	}
+	for _, other := range others {
+		if other == listenAt {
+			continue
+		}
+		if a.conflicts(other) {
+			return &ListenConflictError{ListenAt: listenAt, Other: other}
+		}
+	}
+	return nil
+}
+
+// isAddrInUse tells whether listening failed because address is occupied
+func isAddrInUse(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if syscallErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return syscallErr.Err == syscall.EADDRINUSE
+		}
+	}
+	return false
+}
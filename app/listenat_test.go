@@ -0,0 +1,46 @@
+package app
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenConflict(t *testing.T) {
+	for _, c := range []struct {
+		a, b     ListenAt
+		conflict bool
+	}{
+		{":8080", "0.0.0.0:8080", true},
+		{":8080", "127.0.0.1:8080", true},
+		{":80", ":http", true},
+		{"[::]:8080", "[::1]:8080", true},
+		{"0.0.0.0:8080", "localhost:8080", true},
+		{"0.0.0.0:8080", "[::1]:8080", false},
+		{"127.0.0.1:8080", "127.0.0.2:8080", false},
+		{"LocalHost:8080", "localhost:8080", true},
+		{":8080", ":8081", false},
+		{"127.0.0.1:0", "127.0.0.1:0", false},
+		{"[fe80::1%eth0]:8080", "[fe80::1%eth1]:8080", false},
+		{"[fe80::1%eth0]:8080", "[::]:8080", true},
+	} {
+		err := listenConflict(c.a, []ListenAt{c.b})
+		if (err != nil) != c.conflict {
+			t.Errorf("Expected conflict between %q and %q to be %v, got %v", c.a, c.b,
+				c.conflict, err)
+		}
+	}
+}
+
+func TestNewTunnelAddressInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	_, err = NewTunnel(ListenAt(l.Addr().String()), "127.0.0.1:1", TunnelLimits{},
+		TunnelOptions{})
+	if _, ok := err.(*ListenConflictError); !ok {
+		t.Errorf("Expected listen conflict error, got %v", err)
+	}
+}
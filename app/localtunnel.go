@@ -0,0 +1,101 @@
+package app
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LocalTunnel is a tunnel listening at an ephemeral loopback port, meant for
+// tests of programs talking through throttle. It remembers its limits, so
+// that tests could change one of them at a time.
+type LocalTunnel struct {
+	*Tunnel
+	// Port tunnel listens at
+	Port int
+
+	mutex  *sync.Mutex
+	limits TunnelLimits
+}
+
+// NewLocalTunnel creates a tunnel listening at a port of 127.0.0.1 picked by
+// the kernel
+func NewLocalTunnel(connectTo ConnectTo, limits TunnelLimits,
+	opts TunnelOptions) (*LocalTunnel, error) {
+	tunnel, err := NewTunnel("127.0.0.1:0", connectTo, limits, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalTunnel{
+		Tunnel: tunnel,
+		Port:   tunnel.listener.Addr().(*net.TCPAddr).Port,
+		mutex:  new(sync.Mutex),
+		limits: limits,
+	}, nil
+}
+
+// Addr returns address clients should connect to
+func (l *LocalTunnel) Addr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Port))
+}
+
+// Limits returns limits the tunnel was last given
+func (l *LocalTunnel) Limits() TunnelLimits {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limits
+}
+
+// SetLimits validates limits and applies them to the tunnel
+func (l *LocalTunnel) SetLimits(limits TunnelLimits) error {
+	return l.change(func(current *TunnelLimits) {
+		*current = limits
+	})
+}
+
+// SetTunnelLimit changes tunnel limit leaving other limits as they are
+func (l *LocalTunnel) SetTunnelLimit(limit Limit) error {
+	return l.change(func(current *TunnelLimits) {
+		current.TunnelLimit = limit
+	})
+}
+
+// SetConnectionLimit changes connection limit leaving other limits as they are
+func (l *LocalTunnel) SetConnectionLimit(limit Limit) error {
+	return l.change(func(current *TunnelLimits) {
+		current.ConnectionLimit = limit
+	})
+}
+
+// SetLatency changes latency injected into forwarded data and its jitter,
+// emulating a remote upstream over loopback
+func (l *LocalTunnel) SetLatency(latency, jitter time.Duration) error {
+	return l.change(func(current *TunnelLimits) {
+		current.Latency = Duration(latency)
+		current.Jitter = Duration(jitter)
+	})
+}
+
+// UpdateLimits applies limits without validating them, just as
+// Tunnel.UpdateLimits does, and remembers them
+func (l *LocalTunnel) UpdateLimits(limits TunnelLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits = limits
+	l.Tunnel.UpdateLimits(limits)
+}
+
+// change applies limits modified by a given function unless they are invalid
+func (l *LocalTunnel) change(modify func(*TunnelLimits)) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limits := l.limits
+	modify(&limits)
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	l.limits = limits
+	l.Tunnel.UpdateLimits(limits)
+	return nil
+}
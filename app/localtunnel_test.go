@@ -0,0 +1,58 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLocalTunnel(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewLocalTunnel(ConnectTo(upstream.Addr().String()),
+		TunnelLimits{ConnectionLimit: 1000}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	if tunnel.Port == 0 {
+		t.Fatalf("Expected tunnel to listen at an ephemeral port")
+	}
+
+	conn, err := net.Dial("tcp", tunnel.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if err := tunnel.SetConnectionLimit(2000); err != nil {
+		t.Fatalf("Failed to set connection limit: %v", err)
+	}
+	if err := tunnel.SetLatency(10*time.Millisecond, time.Millisecond); err != nil {
+		t.Fatalf("Failed to set latency: %v", err)
+	}
+	expected := TunnelLimits{ConnectionLimit: 2000, Latency: Duration(10 * time.Millisecond),
+		Jitter: Duration(time.Millisecond)}
+	if limits := tunnel.Limits(); limits != expected {
+		t.Errorf("Expected limits %+v, got %+v", expected, limits)
+	}
+	if err := tunnel.SetLatency(-time.Second, 0); err == nil {
+		t.Errorf("Expected negative latency to be rejected")
+	}
+	if limits := tunnel.Limits(); limits != expected {
+		t.Errorf("Expected rejected limits to be left out, got %+v", limits)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		if len(connections) == 1 && connections[0].Limit == 2000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection to get new limit, got %+v", connections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel is the severity of a log message
+type LogLevel string
+
+// Levels of tunnel log messages from the least to the most severe
+const (
+	// Per-connection messages (accepted and closed connections, their
+	// limits and classes)
+	LogDebug LogLevel = "debug"
+	// Changes of tunnel state and settings
+	LogInfo LogLevel = "info"
+	// Rejected connections and failures to reach upstream
+	LogWarn LogLevel = "warn"
+	// Failures of the tunnel itself (e.g. listening socket errors)
+	LogError LogLevel = "error"
+)
+
+// severity returns an ordinal of a level. Empty level stands for LogInfo.
+func (l LogLevel) severity() int {
+	switch l {
+	case LogDebug:
+		return 0
+	case LogWarn:
+		return 2
+	case LogError:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// validate checks that a level is known
+func (l LogLevel) validate() error {
+	switch l {
+	case "", LogDebug, LogInfo, LogWarn, LogError:
+		return nil
+	default:
+		return fmt.Errorf("Unknown log level %q", l)
+	}
+}
+
+// logAt logs a message of a given level unless it's less severe than a
+// threshold
+func logAt(threshold, level LogLevel, format string, v ...interface{}) {
+	if level.severity() >= threshold.severity() {
+		log.Printf(format, v...)
+	}
+}
+
+// logf logs a message of a given level unless it's less severe than tunnel
+// log level. Safe to call concurrently.
+func (t *Tunnel) logf(level LogLevel, format string, v ...interface{}) {
+	threshold, _ := t.logLevel.Load().(LogLevel)
+	logAt(threshold, level, format, v...)
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	cases := []struct {
+		threshold LogLevel
+		level     LogLevel
+		logged    bool
+	}{
+		{"", LogDebug, false},
+		{"", LogInfo, true},
+		{LogDebug, LogDebug, true},
+		{LogWarn, LogInfo, false},
+		{LogWarn, LogError, true},
+		{LogError, LogWarn, false},
+	}
+	for _, c := range cases {
+		out.Reset()
+		logAt(c.threshold, c.level, "message")
+		if logged := strings.Contains(out.String(), "message"); logged != c.logged {
+			t.Errorf("Expected %q message logged at %q threshold to be logged: %v",
+				c.level, c.threshold, c.logged)
+		}
+	}
+
+	if err := (TunnelSettings{LogLevel: "verbose"}).validate(); err == nil {
+		t.Errorf("Expected unknown log level to be rejected")
+	}
+	if err := (TunnelSettings{LogLevel: LogWarn}).validate(); err != nil {
+		t.Errorf("Expected known log level to be accepted, got %v", err)
+	}
+}
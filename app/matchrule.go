@@ -0,0 +1,184 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MatchRule selects connections by their clients and by metadata of PROXY
+// protocol header or TLS handshake they came with (see
+// TunnelSettings.ProxyProtocol and TunnelSettings.InspectTLS). All of specified
+// conditions must hold, empty rule matches all connections. Connections
+// without metadata a condition asks for don't match it.
+type MatchRule struct {
+	// IP addresses or CIDRs of clients as tunnel sees them (e.g. a load
+	// balancer sending PROXY protocol headers)
+	Clients []string `json:"clients,omitempty"`
+	// IP addresses or CIDRs of original sources told by PROXY protocol
+	// headers. Clients are their own sources if they send none.
+	Sources []string `json:"sources,omitempty"`
+	// Server names clients asked for in TLS handshakes (SNI), told by PROXY
+	// protocol headers otherwise. "*.example.com" matches any subdomain.
+	ServerNames []string `json:"serverNames,omitempty"`
+	// Identities (common names) of client certificates verified by a load
+	// balancer terminating TLS and told by PROXY protocol headers
+	Identities []string `json:"identities,omitempty"`
+	// Labels connection must have (see Admission)
+	Labels Labels `json:"labels,omitempty"`
+}
+
+// connectionMeta is what match rules know about a connection
+type connectionMeta struct {
+	client net.Addr
+	// Original source of connection (client itself if there's no PROXY
+	// header)
+	source     net.Addr
+	serverName string
+	identity   string
+	labels     Labels
+}
+
+// meta returns what match rules know about a connection. Metadata is read
+// before upstream is dialed, so it's safe to call on the tunnel goroutine once
+// connection is dialed.
+func (c *Connection) meta() connectionMeta {
+	result := connectionMeta{
+		client:     c.ingress.RemoteAddr(),
+		source:     c.source,
+		serverName: c.serverName,
+		identity:   c.certIdentity,
+		labels:     c.labels,
+	}
+	if result.source == nil {
+		result.source = result.client
+	}
+	return result
+}
+
+// readMetadata reads what client sends ahead of its traffic: PROXY protocol
+// header, preamble and TLS ClientHello, whichever tunnel expects. Access
+// rules are checked once metadata is known. Returns an error if connection
+// is to be rejected.
+func (c *Connection) readMetadata() error {
+	if c.proxyProtocol {
+		if err := c.readProxyHeader(); err != nil {
+			return err
+		}
+	}
+	if c.ratePreamble || c.bandwidthTest {
+		if err := c.readPreamble(); err != nil {
+			return err
+		}
+	}
+	if c.inspectTLS && c.testMode == "" {
+		if err := c.peekServerName(); err != nil {
+			return err
+		}
+	}
+	return c.access.check(c.meta())
+}
+
+// equal tells whether two rules are the same
+func (r MatchRule) equal(other MatchRule) bool {
+	return sameStrings(r.Clients, other.Clients) && sameStrings(r.Sources, other.Sources) &&
+		sameStrings(r.ServerNames, other.ServerNames) &&
+		sameStrings(r.Identities, other.Identities) &&
+		r.Labels.String() == other.Labels.String()
+}
+
+// ruleMatcher is a match rule with its networks parsed
+type ruleMatcher struct {
+	MatchRule
+	clients []*net.IPNet
+	sources []*net.IPNet
+}
+
+// matcher parses a rule
+func (r MatchRule) matcher() (*ruleMatcher, error) {
+	result := &ruleMatcher{MatchRule: r}
+	for _, v := range r.Clients {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client: %v", err)
+		}
+		result.clients = append(result.clients, network)
+	}
+	for _, v := range r.Sources {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source: %v", err)
+		}
+		result.sources = append(result.sources, network)
+	}
+	for _, v := range r.ServerNames {
+		if name := strings.TrimPrefix(v, "*."); name == "" || strings.Contains(name, "*") {
+			return nil, fmt.Errorf("Invalid server name %q", v)
+		}
+	}
+	for _, v := range r.Identities {
+		if v == "" {
+			return nil, fmt.Errorf("Identity must not be empty")
+		}
+	}
+	for k := range r.Labels {
+		if !labelNameRe.MatchString(k) {
+			return nil, fmt.Errorf("Invalid label name %q", k)
+		}
+	}
+	return result, nil
+}
+
+// match tells whether a connection matches the rule
+func (m *ruleMatcher) match(c connectionMeta) bool {
+	if len(m.clients) > 0 && !containsAddr(m.clients, c.client.String()) {
+		return false
+	}
+	if len(m.sources) > 0 && !containsAddr(m.sources, c.source.String()) {
+		return false
+	}
+	if len(m.ServerNames) > 0 && !matchServerName(m.ServerNames, c.serverName) {
+		return false
+	}
+	if len(m.Identities) > 0 && !containsString(m.Identities, c.identity) {
+		return false
+	}
+	for k, v := range m.Labels {
+		if value, ok := c.labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matchServerName tells whether a server name matches one of patterns. Names
+// are case-insensitive, "*.example.com" matches any subdomain of example.com.
+func matchServerName(patterns []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, "*.") {
+			if strings.HasSuffix(name, p[1:]) && len(name) > len(p)-1 {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	lb := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	source := &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 50000}
+	cases := []struct {
+		rule     MatchRule
+		meta     connectionMeta
+		expected bool
+	}{
+		{MatchRule{}, connectionMeta{client: lb, source: lb}, true},
+		{MatchRule{Clients: []string{"10.0.0.0/8"}}, connectionMeta{client: lb, source: source},
+			true},
+		{MatchRule{Sources: []string{"10.0.0.0/8"}}, connectionMeta{client: lb, source: source},
+			false},
+		{MatchRule{Sources: []string{"203.0.113.0/24"}},
+			connectionMeta{client: lb, source: source}, true},
+		{MatchRule{ServerNames: []string{"*.example.com"}},
+			connectionMeta{client: lb, source: lb, serverName: "DB.Example.com"}, true},
+		{MatchRule{ServerNames: []string{"*.example.com"}},
+			connectionMeta{client: lb, source: lb, serverName: "example.com"}, false},
+		{MatchRule{ServerNames: []string{"example.com"}},
+			connectionMeta{client: lb, source: lb}, false},
+		{MatchRule{Identities: []string{"billing"}},
+			connectionMeta{client: lb, source: lb, identity: "billing"}, true},
+		{MatchRule{Identities: []string{"billing"}, Labels: Labels{"plan": "vip"}},
+			connectionMeta{client: lb, source: lb, identity: "billing"}, false},
+	}
+	for _, c := range cases {
+		m, err := c.rule.matcher()
+		if err != nil {
+			t.Fatalf("Failed to parse %+v: %v", c.rule, err)
+		}
+		if m.match(c.meta) != c.expected {
+			t.Errorf("Expected %+v matching %+v to be %v", c.rule, c.meta, c.expected)
+		}
+	}
+
+	invalid := []MatchRule{
+		{Sources: []string{"somewhere"}},
+		{ServerNames: []string{"*"}},
+		{ServerNames: []string{"db.*.com"}},
+		{Identities: []string{""}},
+		{Labels: Labels{"bad-name": "x"}},
+	}
+	for _, rule := range invalid {
+		if _, err := rule.matcher(); err == nil {
+			t.Errorf("Expected %+v to be invalid", rule)
+		}
+	}
+}
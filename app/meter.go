@@ -0,0 +1,80 @@
+package app
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Throughput holds exponentially weighted moving averages of throughput
+// (ingress and egress combined) in bytes per second over several windows.
+type Throughput struct {
+	Rate1s  float64 `json:"1s"`
+	Rate10s float64 `json:"10s"`
+	Rate1m  float64 `json:"1m"`
+}
+
+// Add returns a sum of two throughputs
+func (t Throughput) Add(other Throughput) Throughput {
+	return Throughput{
+		Rate1s:  t.Rate1s + other.Rate1s,
+		Rate10s: t.Rate10s + other.Rate10s,
+		Rate1m:  t.Rate1m + other.Rate1m,
+	}
+}
+
+// meterInterval is how often rate meters are sampled
+const meterInterval = time.Second
+
+// meterWindows are the averaging windows of Throughput fields
+var meterWindows = [...]time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// rateMeter turns a growing total of bytes into moving averages of throughput.
+// Safe for concurrent use.
+type rateMeter struct {
+	mu          *sync.Mutex
+	lastTotal   int64
+	lastSample  time.Time
+	rates       [len(meterWindows)]float64
+	initialized bool
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{
+		mu: new(sync.Mutex),
+	}
+}
+
+// sample updates averages given a total number of bytes transferred so far
+func (m *rateMeter) sample(now time.Time, total int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.initialized {
+		m.lastTotal = total
+		m.lastSample = now
+		m.initialized = true
+		return
+	}
+	elapsed := now.Sub(m.lastSample)
+	if elapsed <= 0 {
+		return
+	}
+	current := float64(total-m.lastTotal) / elapsed.Seconds()
+	for i, window := range meterWindows {
+		alpha := 1 - math.Exp(-float64(elapsed)/float64(window))
+		m.rates[i] += alpha * (current - m.rates[i])
+	}
+	m.lastTotal = total
+	m.lastSample = now
+}
+
+// throughput returns current averages
+func (m *rateMeter) throughput() Throughput {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Throughput{
+		Rate1s:  m.rates[0],
+		Rate10s: m.rates[1],
+		Rate1m:  m.rates[2],
+	}
+}
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	m := newRateMeter()
+	now := time.Now()
+	var total int64
+	m.sample(now, total)
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Second)
+		total += 1000
+		m.sample(now, total)
+	}
+	tp := m.throughput()
+	if math.Abs(tp.Rate1s-1000) > 1 || math.Abs(tp.Rate10s-1000) > 3 {
+		t.Errorf("Expected short averages to converge to 1000, got %v", tp)
+	}
+	// After one window, long average reaches 1 - 1/e of the rate
+	if math.Abs(tp.Rate1m-632) > 2 {
+		t.Errorf("Expected one minute average to be about 632, got %v", tp.Rate1m)
+	}
+}
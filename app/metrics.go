@@ -0,0 +1,222 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// handleMetrics exposes stats of tunnels visible to the caller in Prometheus
+// text format. Connection stats are left out to keep the number of series
+// bounded, they are available via connections endpoint.
+func (s *adminServer) handleMetrics(w http.ResponseWriter, r *http.Request, c caller) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var tunnels []TunnelInfo
+	for _, t := range s.manager.ListTunnels() {
+		if c.canAccess(t.Tenant) {
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	writeMetricHeader(out, "throttle_tunnel_bytes_total", "counter",
+		"Bytes forwarded by a tunnel")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_bytes_total{%s,direction=\"ingress\"} %d\n",
+			tunnelLabels(t), t.Stats.Counters.IngressBytes)
+		fmt.Fprintf(out, "throttle_tunnel_bytes_total{%s,direction=\"egress\"} %d\n",
+			tunnelLabels(t), t.Stats.Counters.EgressBytes)
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_throughput_bytes", "gauge",
+		"Moving average of tunnel throughput in bytes per second")
+	for _, t := range tunnels {
+		for _, v := range []struct {
+			window string
+			rate   float64
+		}{
+			{"1s", t.Stats.Throughput.Rate1s},
+			{"10s", t.Stats.Throughput.Rate10s},
+			{"1m", t.Stats.Throughput.Rate1m},
+		} {
+			fmt.Fprintf(out, "throttle_tunnel_throughput_bytes{%s,window=%q} %g\n",
+				tunnelLabels(t), v.window, v.rate)
+		}
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_fairness", "gauge",
+		"Moving average of Jain's fairness index of tunnel connection throughput")
+	for _, t := range tunnels {
+		if t.Stats.Fairness == nil {
+			continue
+		}
+		for _, v := range []struct {
+			window string
+			index  float64
+		}{
+			{"1s", t.Stats.Fairness.Index1s},
+			{"10s", t.Stats.Fairness.Index10s},
+			{"1m", t.Stats.Fairness.Index1m},
+		} {
+			fmt.Fprintf(out, "throttle_tunnel_fairness{%s,window=%q} %g\n",
+				tunnelLabels(t), v.window, v.index)
+		}
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_limit_bytes", "gauge",
+		"Tunnel bandwidth limit in bytes per second (0 means unlimited)")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_limit_bytes{%s,scope=\"tunnel\"} %d\n",
+			tunnelLabels(t), t.Limits.TunnelLimit)
+		fmt.Fprintf(out, "throttle_tunnel_limit_bytes{%s,scope=\"connection\"} %d\n",
+			tunnelLabels(t), t.Limits.ConnectionLimit)
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_observed_bytes_total", "counter",
+		"Bytes that would have been throttled if observed limits were enforced")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_observed_bytes_total{%s,action=\"delayed\"} %d\n",
+			tunnelLabels(t), t.Stats.Observed.DelayedBytes)
+		fmt.Fprintf(out, "throttle_tunnel_observed_bytes_total{%s,action=\"blocked\"} %d\n",
+			tunnelLabels(t), t.Stats.Observed.BlockedBytes)
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_observed_delay_seconds_total", "counter",
+		"Total delay that observed limits would have introduced")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_observed_delay_seconds_total{%s} %g\n",
+			tunnelLabels(t), time.Duration(t.Stats.Observed.Delay).Seconds())
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_shadow_bytes_total", "counter",
+		"Bytes that exceeded shadow limits of a tunnel")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_shadow_bytes_total{%s,action=\"delayed\"} %d\n",
+			tunnelLabels(t), t.Stats.Shadow.DelayedBytes)
+		fmt.Fprintf(out, "throttle_tunnel_shadow_bytes_total{%s,action=\"blocked\"} %d\n",
+			tunnelLabels(t), t.Stats.Shadow.BlockedBytes)
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_shadow_delay_seconds_total", "counter",
+		"Total delay that shadow limits would have introduced")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_shadow_delay_seconds_total{%s} %g\n",
+			tunnelLabels(t), time.Duration(t.Stats.Shadow.Delay).Seconds())
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_limiter_wait_seconds_total", "counter",
+		"Total time tunnel connections spent waiting for limiters")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_limiter_wait_seconds_total{%s} %g\n",
+			tunnelLabels(t), time.Duration(t.Stats.Waits.Time).Seconds())
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_upstream_dials_total", "counter",
+		"Upstream connections made by a tunnel")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_upstream_dials_total{%s} %d\n",
+			tunnelLabels(t), t.Stats.Latency.Dials)
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_upstream_dial_seconds_total", "counter",
+		"Total time making upstream connections took")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_upstream_dial_seconds_total{%s} %g\n",
+			tunnelLabels(t), time.Duration(t.Stats.Latency.DialTime).Seconds())
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_upstream_first_bytes_total", "counter",
+		"Tunnel connections upstream sent data to")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_upstream_first_bytes_total{%s} %d\n",
+			tunnelLabels(t), t.Stats.Latency.FirstBytes)
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_upstream_first_byte_seconds_total", "counter",
+		"Total time to first byte from upstream of tunnel connections")
+	for _, t := range tunnels {
+		fmt.Fprintf(out, "throttle_tunnel_upstream_first_byte_seconds_total{%s} %g\n",
+			tunnelLabels(t), time.Duration(t.Stats.Latency.FirstByteTime).Seconds())
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_connections_closed_total", "counter",
+		"Connections ended by a tunnel by reason")
+	for _, t := range tunnels {
+		for _, reason := range t.Stats.Closed.reasons() {
+			fmt.Fprintf(out, "throttle_tunnel_connections_closed_total{%s,reason=%q} %d\n",
+				tunnelLabels(t), reason, t.Stats.Closed[reason])
+		}
+	}
+
+	writeMetricHeader(out, "throttle_tunnel_labeled_bytes_total", "counter",
+		"Bytes forwarded by tunnel connections having given labels")
+	for _, t := range tunnels {
+		for _, v := range t.Stats.Labeled {
+			labels := tunnelLabels(t)
+			for _, name := range v.Labels.names() {
+				labels += fmt.Sprintf(",label_%s=%s", name, labelValue(v.Labels[name]))
+			}
+			fmt.Fprintf(out, "throttle_tunnel_labeled_bytes_total{%s,direction=\"ingress\"} %d\n",
+				labels, v.Counters.IngressBytes)
+			fmt.Fprintf(out, "throttle_tunnel_labeled_bytes_total{%s,direction=\"egress\"} %d\n",
+				labels, v.Counters.EgressBytes)
+		}
+	}
+
+	// DNS tunnels aren't assigned to tenants
+	if c.isOperator() {
+		writeDNSMetrics(out, s.manager.ListDNS())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
+
+// writeDNSMetrics writes stats of DNS tunnels
+func writeDNSMetrics(out *bytes.Buffer, tunnels []DNSInfo) {
+	writeMetricHeader(out, "throttle_dns_queries_total", "counter",
+		"UDP queries handled by a DNS tunnel by result")
+	for _, t := range tunnels {
+		labels := "listen_at=" + labelValue(string(t.ListenAt))
+		fmt.Fprintf(out, "throttle_dns_queries_total{%s,result=\"forwarded\"} %d\n",
+			labels, t.Stats.Forwarded)
+		fmt.Fprintf(out, "throttle_dns_queries_total{%s,result=\"refused\"} %d\n",
+			labels, t.Stats.Refused)
+		fmt.Fprintf(out, "throttle_dns_queries_total{%s,result=\"failed\"} %d\n",
+			labels, t.Stats.Failed)
+	}
+
+	writeMetricHeader(out, "throttle_dns_bytes_total", "counter",
+		"Bytes forwarded by a DNS tunnel over UDP and TCP")
+	for _, t := range tunnels {
+		labels := "listen_at=" + labelValue(string(t.ListenAt))
+		fmt.Fprintf(out, "throttle_dns_bytes_total{%s,direction=\"ingress\"} %d\n",
+			labels, t.Stats.Counters.IngressBytes)
+		fmt.Fprintf(out, "throttle_dns_bytes_total{%s,direction=\"egress\"} %d\n",
+			labels, t.Stats.Counters.EgressBytes)
+	}
+}
+
+func writeMetricHeader(out *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// tunnelLabels returns Prometheus labels identifying a tunnel
+func tunnelLabels(t TunnelInfo) string {
+	return fmt.Sprintf("listen_at=%s,tenant=%s", labelValue(string(t.ListenAt)),
+		labelValue(t.Tenant))
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes and escapes a Prometheus label value
+func labelValue(s string) string {
+	return `"` + labelValueReplacer.Replace(s) + `"`
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// configMigration transforms configuration of some version into the next one.
+// Configuration is represented as a set of raw top-level JSON fields.
+type configMigration func(map[string]json.RawMessage) (map[string]json.RawMessage, error)
+
+// configMigrations[i] migrates configuration from version i to version i+1.
+// When configuration format changes in incompatible way, bump the version by
+// appending a migration here.
+var configMigrations = []configMigration{
+	// Version 0 stands for configuration files written before versioning was
+	// introduced. Version 1 is the same format with an explicit version field.
+	func(c map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+		return c, nil
+	},
+}
+
+// CurrentConfigVersion is the version of configuration format understood by
+// this build. Configuration files of older versions are migrated upon load.
+var CurrentConfigVersion = len(configMigrations)
+
+// parseConfiguration parses configuration file contents of any supported
+// version, migrates them to the current version and strictly decodes the
+// result, failing on any unknown fields.
+func parseConfiguration(contents []byte) (ConfigurationJSON, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return ConfigurationJSON{}, err
+	}
+	return parseRawConfiguration(raw)
+}
+
+// parseRawConfiguration is like parseConfiguration, but takes configuration
+// split into top-level fields
+func parseRawConfiguration(raw map[string]json.RawMessage) (ConfigurationJSON, error) {
+	version := 0
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return ConfigurationJSON{}, fmt.Errorf("Invalid configuration version %s", v)
+		}
+		if version < 1 || version > CurrentConfigVersion {
+			return ConfigurationJSON{}, fmt.Errorf(
+				"Unsupported configuration version %d (supported versions are 1 to %d)",
+				version, CurrentConfigVersion)
+		}
+	}
+
+	if version < CurrentConfigVersion {
+		for v := version; v < CurrentConfigVersion; v++ {
+			var err error
+			raw, err = configMigrations[v](raw)
+			if err != nil {
+				return ConfigurationJSON{}, fmt.Errorf(
+					"Failed to migrate configuration from version %d to %d: %v", v, v+1, err)
+			}
+		}
+		log.Printf("Migrated configuration from version %d to %d. Consider updating "+
+			"configuration file", version, CurrentConfigVersion)
+		raw["version"] = json.RawMessage(fmt.Sprint(CurrentConfigVersion))
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return ConfigurationJSON{}, err
+	}
+
+	var result ConfigurationJSON
+	if err = unmarshalStrict(migrated, &result); err != nil {
+		return ConfigurationJSON{}, locateConfigError(raw, err)
+	}
+	return result, nil
+}
+
+// unmarshalStrict is like json.Unmarshal, but fails on unknown fields
+func unmarshalStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// locateConfigError makes a decoding error more helpful by finding out which
+// tunnel it belongs to. Unknown field errors coming from encoding/json don't
+// mention the path to the offending field.
+func locateConfigError(raw map[string]json.RawMessage, err error) error {
+	if !strings.Contains(err.Error(), "unknown field") {
+		return err
+	}
+
+	var tunnels map[ListenAt]json.RawMessage
+	if json.Unmarshal(raw["tunnels"], &tunnels) != nil {
+		return err
+	}
+	for k, v := range tunnels {
+		var tunnel TunnelConfigJSON
+		if tunnelErr := unmarshalStrict(v, &tunnel); tunnelErr != nil {
+			return fmt.Errorf("Tunnel %q: %v", k, tunnelErr)
+		}
+	}
+
+	return err
+}
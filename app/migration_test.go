@@ -0,0 +1,42 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUnversionedConfiguration(t *testing.T) {
+	config, err := parseConfiguration([]byte(`{"tunnels": {":1000": {
+		"connectTo": "localhost:2000", "tunnelLimit": "8bps"}}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse unversioned configuration: %v", err)
+	}
+	if config.Version != CurrentConfigVersion {
+		t.Errorf("Expected configuration to be migrated to version %d, got %d",
+			CurrentConfigVersion, config.Version)
+	}
+	if config.Tunnels[":1000"].TunnelLimit != Limit(1) {
+		t.Errorf("Unexpected tunnel configuration: %v", config.Tunnels)
+	}
+}
+
+func TestParseUnsupportedVersion(t *testing.T) {
+	_, err := parseConfiguration([]byte(`{"version": 1000, "tunnels": {}}`))
+	if err == nil || !strings.Contains(err.Error(), "Unsupported configuration version") {
+		t.Errorf("Expected unsupported version error, got %v", err)
+	}
+}
+
+func TestParseUnknownField(t *testing.T) {
+	_, err := parseConfiguration([]byte(`{"version": 1, "tunnels": {":1000": {
+		"connectTo": "localhost:2000", "tunelLimit": "8bps"}}}`))
+	if err == nil || !strings.Contains(err.Error(), `":1000"`) ||
+		!strings.Contains(err.Error(), "tunelLimit") {
+		t.Errorf("Expected error pointing at unknown tunnel field, got %v", err)
+	}
+
+	_, err = parseConfiguration([]byte(`{"version": 1, "tunels": {}}`))
+	if err == nil || !strings.Contains(err.Error(), "tunels") {
+		t.Errorf("Expected error pointing at unknown top-level field, got %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// AcceptHook decides what tunnel to create for a port of an on-demand port
+// range once the first connection to that port arrives. It is given the
+// listening specification of the port, ListenAt of the returned spec is
+// ignored. Returning an error rejects the connection, the port keeps waiting
+// for another one.
+type AcceptHook func(listenAt ListenAt) (TunnelSpec, error)
+
+// onDemandGroup is a range of ports tunnels are created for on first
+// connection
+type onDemandGroup struct {
+	ports portRange
+	hook  AcceptHook
+	// Configuration group was created from. Nil if it was added with
+	// AddOnDemand.
+	config *TunnelConfigJSON
+	// Listening sockets of ports that have no tunnel yet. Owned by the manager
+	// goroutine.
+	listeners map[ListenAt]net.Listener
+	// Closed once group is removed
+	removed chan struct{}
+}
+
+// onDemandHook returns a hook creating tunnels according to configuration. If
+// destination is a port range as well, ports are mapped one to one.
+func (c TunnelConfigJSON) onDemandHook(ports portRange) AcceptHook {
+	return func(listenAt ListenAt) (TunnelSpec, error) {
+		spec := c.spec(listenAt)
+		target, err := parsePortRange(string(c.ConnectTo))
+		if err != nil || target.size() == 1 {
+			return spec, nil
+		}
+		addr, err := parseAddress(string(listenAt), "")
+		if err != nil {
+			return TunnelSpec{}, err
+		}
+		mapping := &portMapping{listen: ports, target: target}
+		spec.ConnectTo = mapping.connectTo(addr.port)
+		return spec, nil
+	}
+}
+
+// validateOnDemand checks configuration of an on-demand port range
+func validateOnDemand(pattern ListenAt, c TunnelConfigJSON) error {
+	return validatePortRanges(pattern, c.ConnectTo)
+}
+
+// handoverListener is a listening socket along with a connection already
+// accepted from it. The connection is returned by the first Accept call.
+type handoverListener struct {
+	net.Listener
+	accepted chan net.Conn
+}
+
+func newHandoverListener(l net.Listener, conn net.Conn) *handoverListener {
+	accepted := make(chan net.Conn, 1)
+	accepted <- conn
+	return &handoverListener{
+		Listener: l,
+		accepted: accepted,
+	}
+}
+
+func (l *handoverListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+func (l *handoverListener) Close() error {
+	select {
+	case conn := <-l.accepted:
+		conn.Close()
+	default:
+	}
+	return l.Listener.Close()
+}
+
+// AddOnDemand listens at every port of a given range (e.g.
+// "0.0.0.0:30000-30099") and creates a tunnel for a port as described by hook
+// once the first connection to that port arrives. Ports that are never
+// connected to cost no more than an idle listening socket. Tunnels created on
+// demand keep running until the range is removed.
+func (m *TunnelManager) AddOnDemand(pattern ListenAt, hook AcceptHook) error {
+	ports, err := parsePortRange(string(pattern))
+	if err != nil {
+		return err
+	}
+	if !m.do(func() {
+		err = m.addOnDemand(pattern, ports, hook, nil)
+	}) {
+		return fmt.Errorf("Tunnel manager is shutting down")
+	}
+	return err
+}
+
+// RemoveOnDemand stops listening at a port range of on-demand tunnels and
+// shuts down tunnels created for its ports. Configured ranges come back upon
+// next configuration reload.
+func (m *TunnelManager) RemoveOnDemand(pattern ListenAt) error {
+	err := errTunnelNotFound
+	m.do(func() {
+		if g, ok := m.onDemand[pattern]; ok {
+			m.removeOnDemand(pattern, g)
+			err = nil
+		}
+	})
+	return err
+}
+
+// addOnDemand starts listening at a port range. Must be called on the manager
+// goroutine.
+func (m *TunnelManager) addOnDemand(pattern ListenAt, ports portRange, hook AcceptHook,
+	config *TunnelConfigJSON) error {
+	if _, ok := m.onDemand[pattern]; ok {
+		return fmt.Errorf("On-demand tunnels at %q already exist", pattern)
+	}
+	for other, g := range m.onDemand {
+		if ports.overlaps(g.ports) {
+			return &ListenConflictError{ListenAt: pattern, Other: other}
+		}
+	}
+	for k := range m.tunnels {
+		if ports.conflicts(k.listenAt) {
+			return &ListenConflictError{ListenAt: pattern, Other: k.listenAt}
+		}
+	}
+
+	g := &onDemandGroup{
+		ports:     ports,
+		hook:      hook,
+		config:    config,
+		listeners: make(map[ListenAt]net.Listener),
+		removed:   make(chan struct{}),
+	}
+	for port := ports.first; port <= ports.last; port++ {
+		listenAt := ListenAt(ports.port(port))
+		l, err := net.Listen("tcp", string(listenAt))
+		if err != nil {
+			for _, l := range g.listeners {
+				l.Close()
+			}
+			if isAddrInUse(err) {
+				return &ListenConflictError{ListenAt: listenAt}
+			}
+			return &Error{Kind: ErrListenFailed, Err: err}
+		}
+		g.listeners[listenAt] = l
+	}
+	m.onDemand[pattern] = g
+	for listenAt, l := range g.listeners {
+		m.gs.waitGroup.Add(1)
+		go m.serveOnDemand(pattern, g, listenAt, l)
+	}
+	log.Printf("Listening for on-demand tunnels at %q (%d ports)", pattern, ports.size())
+	return nil
+}
+
+// removeOnDemand stops listening at a port range and shuts down tunnels
+// created for it. Must be called on the manager goroutine.
+func (m *TunnelManager) removeOnDemand(pattern ListenAt, g *onDemandGroup) {
+	close(g.removed)
+	for _, l := range g.listeners {
+		l.Close()
+	}
+	for k, t := range m.tunnels {
+		if t.onDemand == pattern {
+			m.stopTunnel(k, t)
+		}
+	}
+	delete(m.onDemand, pattern)
+	log.Printf("Stopped listening for on-demand tunnels at %q", pattern)
+}
+
+// pruneOnDemand removes port ranges of on-demand tunnels that are no longer
+// configured or whose configuration changed. Ranges added with AddOnDemand are
+// left intact. Must be called on the manager goroutine.
+func (m *TunnelManager) pruneOnDemand(config map[ListenAt]TunnelConfigJSON) {
+	for pattern, g := range m.onDemand {
+		if g.config == nil {
+			continue
+		}
+		if c, ok := config[pattern]; !ok || !c.equal(*g.config) {
+			m.removeOnDemand(pattern, g)
+		}
+	}
+}
+
+// applyOnDemand starts listening at configured port ranges of on-demand
+// tunnels (see pruneOnDemand) and brings limits of tunnels created on demand
+// up to date. Must be called on the manager goroutine.
+func (m *TunnelManager) applyOnDemand(config map[ListenAt]TunnelConfigJSON) {
+	for pattern, c := range config {
+		if _, ok := m.onDemand[pattern]; ok {
+			continue
+		}
+		// Configuration is validated beforehand
+		ports, _ := parsePortRange(string(pattern))
+		c := c
+		if err := m.addOnDemand(pattern, ports, c.onDemandHook(ports), &c); err != nil {
+			log.Printf("Failed to listen for on-demand tunnels at %q: %v", pattern, err)
+		}
+	}
+
+	// Tunnels created on demand follow their profiles and tenants
+	for k, t := range m.tunnels {
+		if t.onDemand == "" || t.profile == "" {
+			continue
+		}
+		if limits := m.profiles[t.profile]; limits != t.lastLimits {
+			t.lastLimits = limits
+			m.applyLimits(t)
+			m.publishTunnelEvent(EventTunnelUpdated, k, t)
+		}
+	}
+	m.updateSharedLimiters()
+}
+
+// serveOnDemand waits for the first connection to a port of an on-demand range
+// and hands it over to a newly created tunnel along with the listening socket
+func (m *TunnelManager) serveOnDemand(pattern ListenAt, g *onDemandGroup, listenAt ListenAt,
+	l net.Listener) {
+	defer m.gs.waitGroup.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-g.removed:
+			default:
+				log.Printf("Failed to accept connection for on-demand tunnel at %q: %v",
+					listenAt, err)
+			}
+			return
+		}
+
+		spec, err := g.hook(listenAt)
+		if err != nil {
+			log.Printf("Rejected connection to on-demand tunnel at %q: %v", listenAt, err)
+			conn.Close()
+			continue
+		}
+		spec.ListenAt = listenAt
+
+		created := false
+		if !m.do(func() {
+			created = m.createOnDemand(pattern, g, spec, l, conn)
+		}) {
+			conn.Close()
+			l.Close()
+			return
+		}
+		if created {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// createOnDemand creates a tunnel for a port of an on-demand range taking over
+// its listening socket and first connection. Returns false if tunnel was not
+// created. Must be called on the manager goroutine.
+func (m *TunnelManager) createOnDemand(pattern ListenAt, g *onDemandGroup, spec TunnelSpec,
+	l net.Listener, conn net.Conn) bool {
+	if m.onDemand[pattern] != g {
+		// Range has been removed meanwhile
+		return false
+	}
+	if err := m.validateSpec(spec); err != nil {
+		log.Printf("Failed to create on-demand tunnel at %q: %v", spec.ListenAt, err)
+		return false
+	}
+	t, err := m.startTunnel(spec, newHandoverListener(l, conn))
+	if err != nil {
+		log.Printf("Failed to create on-demand tunnel at %q: %v", spec.ListenAt, err)
+		return false
+	}
+	t.onDemand = pattern
+	delete(g.listeners, spec.ListenAt)
+	log.Printf("Created on-demand tunnel at %q", spec.ListenAt)
+	return true
+}
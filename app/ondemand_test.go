@@ -0,0 +1,189 @@
+package app
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		spec        string
+		first, last int
+		ok          bool
+	}{
+		{"127.0.0.1:30000-30099", 30000, 30099, true},
+		{"[::1]:80-81", 80, 81, true},
+		{":8080", 8080, 8080, true},
+		{"localhost:81-80", 0, 0, false},
+		{"localhost:0-10", 0, 0, false},
+		{"localhost:1-65536", 0, 0, false},
+		{"localhost:1-10000", 0, 0, false},
+		{"localhost:http", 0, 0, false},
+		{"::1:80-81", 0, 0, false},
+		{"localhost", 0, 0, false},
+	}
+	for _, c := range cases {
+		r, err := parsePortRange(c.spec)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: unexpected error %v", c.spec, err)
+			continue
+		}
+		if c.ok && (r.first != c.first || r.last != c.last) {
+			t.Errorf("%q: expected ports %d-%d, got %d-%d", c.spec, c.first, c.last,
+				r.first, r.last)
+		}
+	}
+
+	r, _ := parsePortRange("127.0.0.1:30000-30099")
+	if !r.conflicts(":30050") || r.conflicts("127.0.0.1:30100") ||
+		r.conflicts("127.0.0.2:30050") {
+		t.Errorf("Unexpected conflicts of %v", r)
+	}
+	other, _ := parsePortRange("0.0.0.0:30099-30200")
+	if !r.overlaps(other) {
+		t.Errorf("Expected %v and %v to overlap", r, other)
+	}
+}
+
+func TestOnDemandHook(t *testing.T) {
+	ports, _ := parsePortRange("127.0.0.1:30000-30099")
+	hook := TunnelConfigJSON{ConnectTo: "backend:40000-40099"}.onDemandHook(ports)
+	if spec, err := hook("127.0.0.1:30005"); err != nil || spec.ConnectTo != "backend:40005" {
+		t.Errorf("Expected ports to be mapped one to one, got %v (%v)", spec, err)
+	}
+	hook = TunnelConfigJSON{ConnectTo: "backend:80"}.onDemandHook(ports)
+	if spec, err := hook("127.0.0.1:30005"); err != nil || spec.ConnectTo != "backend:80" {
+		t.Errorf("Expected all ports to go to the same destination, got %v (%v)", spec, err)
+	}
+	if err := validateOnDemand("127.0.0.1:30000-30099",
+		TunnelConfigJSON{ConnectTo: "backend:40000-40009"}); err == nil {
+		t.Errorf("Expected port ranges of different size to be rejected")
+	}
+}
+
+// freePort returns a listening specification of a port that is not in use
+func freePort(t *testing.T) ListenAt {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	return ListenAt(l.Addr().String())
+}
+
+func TestOnDemandTunnels(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.start()
+
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	listenAt := freePort(t)
+	config := ConfigurationJSON{
+		OnDemand: map[ListenAt]TunnelConfigJSON{
+			listenAt: {ConnectTo: ConnectTo(upstream.Addr().String())},
+		},
+	}
+	configUpdate <- config
+	if tunnels := manager.ListTunnels(); len(tunnels) != 0 {
+		t.Fatalf("Expected no tunnels before the first connection, got %v", tunnels)
+	}
+
+	client, err := net.Dial("tcp", string(listenAt))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	connections := func() int {
+		for _, info := range manager.ListTunnels() {
+			if info.ListenAt == listenAt && info.OnDemand == listenAt {
+				conns, _ := manager.ListConnections(listenAt)
+				return len(conns)
+			}
+		}
+		return -1
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for connections() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := connections(); c != 1 {
+		t.Fatalf("Expected on-demand tunnel to serve the first connection, got %d", c)
+	}
+
+	// Tunnels created on demand survive configuration reload
+	configUpdate <- config
+	if c := connections(); c != 1 {
+		t.Errorf("Expected on-demand tunnel to keep running, got %d connections", c)
+	}
+	configUpdate <- ConfigurationJSON{}
+	if tunnels := manager.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("Expected on-demand tunnels to be shut down along with their range, got %v",
+			tunnels)
+	}
+}
+
+func TestOnDemandHookReject(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	manager := newTunnelManager(make(chan ConfigurationJSON), persistence, gs)
+	manager.start()
+
+	listenAt := freePort(t)
+	err = manager.AddOnDemand(listenAt, func(ListenAt) (TunnelSpec, error) {
+		return TunnelSpec{}, errors.New("Not now")
+	})
+	if err != nil {
+		t.Fatalf("Failed to add on-demand tunnels: %v", err)
+	}
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: listenAt, ConnectTo: "127.0.0.1:1"},
+	}); err == nil {
+		t.Errorf("Expected tunnel conflicting with on-demand range to be rejected")
+	}
+
+	client, err := net.Dial("tcp", string(listenAt))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected rejected connection to be closed")
+	}
+	if tunnels := manager.ListTunnels(); len(tunnels) != 0 {
+		t.Errorf("Expected no tunnels to be created, got %v", tunnels)
+	}
+
+	if err := manager.RemoveOnDemand(listenAt); err != nil {
+		t.Errorf("Failed to remove on-demand tunnels: %v", err)
+	}
+	if err := manager.RemoveOnDemand(listenAt); err == nil {
+		t.Errorf("Expected removed range to be gone")
+	}
+}
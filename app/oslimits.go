@@ -0,0 +1,119 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// somaxconnPath is where Linux keeps the maximum length of listen backlog
+const somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+// MinListenBacklog is the shortest listen backlog that doesn't get reported as
+// too short to absorb bursts of connections
+const MinListenBacklog = 1024
+
+// OSLimits describes limits of the operating system relevant to tunnels and
+// how configuration fits into them
+type OSLimits struct {
+	// Soft and hard limits of open file descriptors (RLIMIT_NOFILE)
+	OpenFiles    uint64 `json:"openFiles"`
+	MaxOpenFiles uint64 `json:"maxOpenFiles"`
+	// Maximum length of listen backlog (net.core.somaxconn, zero if unknown)
+	ListenBacklog int `json:"listenBacklog,omitempty"`
+	// File descriptors tunnels could use at most given their MaxConnections
+	// and ConnectionQueue. Tunnels without MaxConnections aren't counted.
+	TunnelFiles uint64 `json:"tunnelFiles"`
+	// Discrepancies between configuration and the limits
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// loadOSLimits reads limits of the operating system, raising soft limit of
+// open files to the hard one if asked to
+func loadOSLimits(raiseOpenFiles bool) (OSLimits, error) {
+	var result OSLimits
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return result, fmt.Errorf("Failed to get open file limit: %v", err)
+	}
+	if raiseOpenFiles && rlimit.Cur < rlimit.Max {
+		raised := rlimit
+		raised.Cur = rlimit.Max
+		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+			log.Printf("Failed to raise open file limit from %d to %d: %v", rlimit.Cur,
+				raised.Cur, err)
+		} else {
+			log.Printf("Raised open file limit from %d to %d", rlimit.Cur, raised.Cur)
+			rlimit = raised
+		}
+	}
+	result.OpenFiles = uint64(rlimit.Cur)
+	result.MaxOpenFiles = uint64(rlimit.Max)
+	if data, err := ioutil.ReadFile(somaxconnPath); err == nil {
+		result.ListenBacklog, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	return result, nil
+}
+
+// tunnelFiles returns the number of file descriptors a tunnel could use at
+// most: a listening socket, both sides of connections it serves and clients
+// waiting in connection queue. Returns zero if there's no such number.
+func tunnelFiles(limits TunnelLimits) uint64 {
+	if limits.MaxConnections == 0 {
+		return 0
+	}
+	return 1 + 2*uint64(limits.MaxConnections) + uint64(limits.ConnectionQueue)
+}
+
+// check returns the limits along with discrepancies between them and limits
+// of given tunnels
+func (o OSLimits) check(tunnels []TunnelLimits) OSLimits {
+	result := o
+	result.TunnelFiles = 0
+	result.Warnings = nil
+	for _, limits := range tunnels {
+		result.TunnelFiles += tunnelFiles(limits)
+	}
+	if result.OpenFiles > 0 && result.TunnelFiles > result.OpenFiles {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Tunnels could use up "+
+			"to %d file descriptors given their maxConnections, which is more than "+
+			"open file limit of %d", result.TunnelFiles, result.OpenFiles))
+	}
+	if result.ListenBacklog > 0 && result.ListenBacklog < MinListenBacklog {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("Listen backlog is "+
+			"limited to %d connections (net.core.somaxconn), bursts of connections "+
+			"beyond that are dropped", result.ListenBacklog))
+	}
+	for _, limits := range tunnels {
+		if result.ListenBacklog > 0 && limits.ListenBacklog > result.ListenBacklog {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Listen backlog of "+
+				"%d connections is capped to %d (net.core.somaxconn)",
+				limits.ListenBacklog, result.ListenBacklog))
+			break
+		}
+	}
+	return result
+}
+
+// checkOSLimits compares OS limits with running tunnels. Must be called on the
+// manager goroutine.
+func (m *TunnelManager) checkOSLimits() OSLimits {
+	tunnels := make([]TunnelLimits, 0, len(m.tunnels))
+	for _, t := range m.tunnels {
+		tunnels = append(tunnels, t.appliedLimits)
+	}
+	return m.osLimits.check(tunnels)
+}
+
+// OSLimits returns limits of the operating system relevant to tunnels and
+// discrepancies between them and tunnel limits
+func (m *TunnelManager) OSLimits() OSLimits {
+	var result OSLimits
+	m.do(func() {
+		result = m.checkOSLimits()
+	})
+	return result
+}
@@ -0,0 +1,36 @@
+package app
+
+import "testing"
+
+func TestOSLimits(t *testing.T) {
+	limits, err := loadOSLimits(false)
+	if err != nil {
+		t.Fatalf("Failed to load OS limits: %v", err)
+	}
+	if limits.OpenFiles == 0 || limits.OpenFiles > limits.MaxOpenFiles {
+		t.Errorf("Expected open file limits to make sense, got %+v", limits)
+	}
+
+	host := OSLimits{OpenFiles: 1024, MaxOpenFiles: 4096, ListenBacklog: 4096}
+	cases := []struct {
+		name     string
+		host     OSLimits
+		tunnels  []TunnelLimits
+		files    uint64
+		warnings int
+	}{
+		{"unbounded", host, []TunnelLimits{{}}, 0, 0},
+		{"fits", host, []TunnelLimits{{MaxConnections: 100, ConnectionQueue: 10}}, 211, 0},
+		{"too many", host, []TunnelLimits{{MaxConnections: 300}, {MaxConnections: 300}},
+			1202, 1},
+		{"short backlog", OSLimits{OpenFiles: 1024, ListenBacklog: 128}, nil, 0, 1},
+		{"capped backlog", host, []TunnelLimits{{ListenBacklog: 8192}}, 0, 1},
+	}
+	for _, c := range cases {
+		checked := c.host.check(c.tunnels)
+		if checked.TunnelFiles != c.files || len(checked.Warnings) != c.warnings {
+			t.Errorf("%s: expected %d files and %d warnings, got %+v", c.name, c.files,
+				c.warnings, checked)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultUpstreamIdleTimeout is how long an idle upstream connection is kept
+// for reuse unless configured otherwise
+const DefaultUpstreamIdleTimeout = 30 * time.Second
+
+// upstreamIdleTimeout returns how long limits allow to keep idle upstream
+// connections for
+func (l TunnelLimits) upstreamIdleTimeout() time.Duration {
+	if l.UpstreamIdleTimeout == 0 {
+		return DefaultUpstreamIdleTimeout
+	}
+	return time.Duration(l.UpstreamIdleTimeout)
+}
+
+// aliveCheckTimeout is how long an idle upstream connection is probed for
+// unexpected data or EOF before reuse
+const aliveCheckTimeout = time.Millisecond
+
+// upstreamQuietPeriod is how long upstream must be silent after it last sent
+// data for its connection to be reused by another client
+const upstreamQuietPeriod = 100 * time.Millisecond
+
+type idleUpstream struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// upstreamPool keeps upstream connections of finished client connections for
+// reuse by the following ones. Safe for concurrent use.
+type upstreamPool struct {
+	mu          *sync.Mutex
+	idle        []idleUpstream
+	size        int
+	idleTimeout time.Duration
+	closed      bool
+}
+
+func newUpstreamPool() *upstreamPool {
+	return &upstreamPool{
+		mu: new(sync.Mutex),
+	}
+}
+
+// configure applies pool size and idle timeout of given limits
+func (p *upstreamPool) configure(limits TunnelLimits) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size = limits.UpstreamPool
+	p.idleTimeout = limits.upstreamIdleTimeout()
+	p.trim(time.Now())
+}
+
+// enabled tells whether upstream connections are kept for reuse
+func (p *upstreamPool) enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size > 0 && !p.closed
+}
+
+// put keeps an upstream connection for reuse. Connection is closed if pool is
+// full. Nil connections are ignored.
+func (p *upstreamPool) put(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.trim(now)
+	if p.closed || len(p.idle) >= p.size {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleUpstream{conn: conn, since: now})
+}
+
+// get returns an idle upstream connection that is still alive or nil if there
+// is none
+func (p *upstreamPool) get() net.Conn {
+	for {
+		p.mu.Lock()
+		p.trim(time.Now())
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		last := len(p.idle) - 1
+		conn := p.idle[last].conn
+		p.idle[last] = idleUpstream{}
+		p.idle = p.idle[:last]
+		p.mu.Unlock()
+
+		if alive(conn) {
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+// flush closes all idle connections
+func (p *upstreamPool) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.idle {
+		v.conn.Close()
+	}
+	p.idle = nil
+}
+
+// close flushes the pool and makes it close connections put afterwards
+func (p *upstreamPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.flush()
+}
+
+// trim closes connections that have been idle for too long or don't fit into
+// the pool. Must be called with mu held.
+func (p *upstreamPool) trim(now time.Time) {
+	kept := p.idle[:0]
+	for i, v := range p.idle {
+		if now.Sub(v.since) >= p.idleTimeout || len(p.idle)-i > p.size {
+			v.conn.Close()
+			continue
+		}
+		kept = append(kept, v)
+	}
+	for i := len(kept); i < len(p.idle); i++ {
+		p.idle[i] = idleUpstream{}
+	}
+	p.idle = kept
+}
+
+// alive tells whether an idle upstream connection could be reused, i.e.
+// upstream hasn't closed it or sent anything since it was put into the pool
+func alive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(aliveCheckTimeout))
+	n, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	return n == 0 && isTimeout(err)
+}
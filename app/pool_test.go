@@ -0,0 +1,178 @@
+package app
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idleConnections returns the number of connections kept in a pool
+func (p *upstreamPool) idleConnections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+func TestUpstreamReuse(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					conn.Write([]byte("pong\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{UpstreamPool: 2}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte("ping\n"))
+		if reply, err := bufio.NewReader(client).ReadString('\n'); err != nil || reply != "pong\n" {
+			t.Fatalf("Unexpected reply %q, %v", reply, err)
+		}
+		client.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for tunnel.pool.idleConnections() != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Upstream connection wasn't returned to the pool")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("Expected upstream connection to be reused, got %d connections", n)
+	}
+}
+
+func TestUpstreamPoolDropsDeadConnections(t *testing.T) {
+	pool := newUpstreamPool()
+	pool.configure(TunnelLimits{UpstreamPool: 1})
+
+	busy, upstream := net.Pipe()
+	defer upstream.Close()
+	go upstream.Write([]byte("unsolicited"))
+	time.Sleep(10 * time.Millisecond)
+	pool.put(busy)
+	if conn := pool.get(); conn != nil {
+		t.Errorf("Expected connection with pending data not to be reused")
+	}
+
+	closed, upstream := net.Pipe()
+	upstream.Close()
+	pool.put(closed)
+	if conn := pool.get(); conn != nil {
+		t.Errorf("Expected connection closed by upstream not to be reused")
+	}
+
+	idle, upstream := net.Pipe()
+	defer upstream.Close()
+	pool.put(idle)
+	if conn := pool.get(); conn != idle {
+		t.Errorf("Expected idle connection to be reused")
+	}
+}
+
+func TestUpstreamPoolLateResponse(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					request, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch request {
+					case "slow\n":
+						time.Sleep(200 * time.Millisecond)
+						conn.Write([]byte("late\n"))
+					case "split\n":
+						conn.Write([]byte("first\n"))
+						time.Sleep(50 * time.Millisecond)
+						conn.Write([]byte("late\n"))
+					default:
+						conn.Write([]byte("pong\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{UpstreamPool: 2}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	// Client leaves before upstream responds or while it is in the middle of a
+	// response, the rest of which must not reach the next client
+	for _, request := range []string{"slow\n", "split\n"} {
+		client, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte(request))
+		if request == "split\n" {
+			bufio.NewReader(client).ReadString('\n')
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+		client.Close()
+		time.Sleep(20 * time.Millisecond)
+
+		next, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		next.SetDeadline(time.Now().Add(5 * time.Second))
+		next.Write([]byte("ping\n"))
+		reply, err := bufio.NewReader(next).ReadString('\n')
+		next.Close()
+		if err != nil || reply != "pong\n" {
+			t.Errorf("After %q, expected next client to get its own reply, got %q (%v)",
+				request, reply, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxRangePorts limits the number of ports in a port range tunnels listen
+// at. Every port of a range holds a listening socket.
+const maxRangePorts = 4096
+
+// portRange is a host and port specification with a range of ports (e.g.
+// "127.0.0.1:30000-30099"). A single port is a range too.
+type portRange struct {
+	// Host part as given (IPv6 addresses are enclosed in brackets)
+	host  string
+	first int
+	last  int
+}
+
+func parsePortRange(spec string) (portRange, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return portRange{}, &AddressError{Address: spec, Reason: "missing port range"}
+	}
+	result := portRange{host: spec[:i]}
+	ports := strings.SplitN(spec[i+1:], "-", 2)
+	var err error
+	if result.first, err = strconv.Atoi(ports[0]); err == nil {
+		result.last = result.first
+		if len(ports) > 1 {
+			result.last, err = strconv.Atoi(ports[1])
+		}
+	}
+	if err != nil || result.first < 1 || result.last > 65535 || result.first > result.last {
+		return portRange{}, &AddressError{
+			Address: spec,
+			Reason:  fmt.Sprintf("invalid port range %q", spec[i+1:]),
+		}
+	}
+	if result.size() > maxRangePorts {
+		return portRange{}, &AddressError{
+			Address: spec,
+			Reason:  fmt.Sprintf("port range is larger than %d ports", maxRangePorts),
+		}
+	}
+	if _, err := parseAddress(result.port(result.first), ""); err != nil {
+		return portRange{}, err
+	}
+	return result, nil
+}
+
+// listenPortRange parses an address a tunnel listens at as a port range.
+// Unlike parsePortRange, it accepts a single port given by name or zero port.
+func listenPortRange(listenAt ListenAt) (portRange, error) {
+	if result, err := parsePortRange(string(listenAt)); err == nil {
+		return result, nil
+	}
+	a, err := parseListenAddress(listenAt)
+	if err != nil {
+		return portRange{}, err
+	}
+	host := string(listenAt[:strings.LastIndex(string(listenAt), ":")])
+	return portRange{host: host, first: a.port, last: a.port}, nil
+}
+
+// isPortRange tells whether an address specifies more than one port
+func isPortRange(spec string) bool {
+	r, err := parsePortRange(spec)
+	return err == nil && r.size() > 1
+}
+
+func (r portRange) size() int {
+	return r.last - r.first + 1
+}
+
+// port returns specification of an individual port of a range
+func (r portRange) port(port int) string {
+	return r.host + ":" + strconv.Itoa(port)
+}
+
+// conflicts tells whether listening at a port range competes with listening
+// at a given address, which may be a port range too
+func (r portRange) conflicts(listenAt ListenAt) bool {
+	other, err := listenPortRange(listenAt)
+	return err == nil && r.overlaps(other)
+}
+
+// overlaps tells whether two port ranges could not be listened at
+// simultaneously
+func (r portRange) overlaps(other portRange) bool {
+	if r.last < other.first || other.last < r.first {
+		return false
+	}
+	first := r.first
+	if other.first > first {
+		first = other.first
+	}
+	a, err := parseListenAddress(ListenAt(r.port(first)))
+	if err != nil {
+		return false
+	}
+	b, err := parseListenAddress(ListenAt(other.port(first)))
+	return err == nil && a.conflicts(b)
+}
+
+// portMapping maps ports of a range a tunnel listens at one to one to ports
+// of a destination range
+type portMapping struct {
+	listen portRange
+	target portRange
+}
+
+// newPortMapping returns a mapping of ports for a tunnel or nil if all of its
+// ports are forwarded to the same destination
+func newPortMapping(listenAt ListenAt, connectTo ConnectTo) *portMapping {
+	listen, err := parsePortRange(string(listenAt))
+	if err != nil || listen.size() == 1 {
+		return nil
+	}
+	target, err := parsePortRange(string(connectTo))
+	if err != nil || target.size() != listen.size() {
+		return nil
+	}
+	return &portMapping{listen: listen, target: target}
+}
+
+// connectTo returns destination of a connection accepted at a given local
+// port
+func (m *portMapping) connectTo(port int) ConnectTo {
+	return ConnectTo(m.target.port(m.target.first + port - m.listen.first))
+}
+
+// validatePortRanges checks that a tunnel listening at a port range forwards
+// it to a single destination or to a port range of the same size
+func validatePortRanges(listenAt ListenAt, connectTo ConnectTo) error {
+	listen, err := parsePortRange(string(listenAt))
+	if err != nil {
+		return err
+	}
+	target, err := parsePortRange(string(connectTo))
+	if err == nil && target.size() > 1 {
+		if target.size() != listen.size() {
+			return fmt.Errorf("Port ranges of %q and %q differ in size", listenAt, connectTo)
+		}
+		return nil
+	}
+	_, err = parseAddress(string(connectTo), "")
+	return err
+}
+
+var errListenerClosed = errors.New("Listener is closed")
+
+// rangeListener accepts connections at every port of a range
+type rangeListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// listenRange listens at every port of a range. Sockets already listening are
+// closed if listening at one of the ports fails.
+func listenRange(listen func(address string) (net.Listener, error),
+	ports portRange) (*rangeListener, error) {
+	listeners := make([]net.Listener, 0, ports.size())
+	for port := ports.first; port <= ports.last; port++ {
+		l, err := listen(ports.port(port))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	result := &rangeListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	for _, l := range listeners {
+		go result.serve(l)
+	}
+	return result, nil
+}
+
+// serve passes connections accepted at a port on to Accept until listening
+// fails
+func (r *rangeListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case r.accepted <- acceptResult{conn: conn, err: err}:
+		case <-r.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *rangeListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-r.accepted:
+		return result.conn, result.err
+	case <-r.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (r *rangeListener) Close() error {
+	var result error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		for _, l := range r.listeners {
+			if err := l.Close(); err != nil && result == nil {
+				result = err
+			}
+		}
+	})
+	return result
+}
+
+// Addr returns address of the first port of a range
+func (r *rangeListener) Addr() net.Addr {
+	return r.listeners[0].Addr()
+}
+
+// connectionTarget returns destination of a connection accepted at a given
+// local address
+func (t *Tunnel) connectionTarget(local net.Addr) ConnectTo {
+	if addr, ok := local.(*net.TCPAddr); ok && t.ports != nil {
+		return t.ports.connectTo(addr.Port)
+	}
+	return t.connectTo
+}
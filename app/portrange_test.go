@@ -0,0 +1,126 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPortRangeAddresses(t *testing.T) {
+	for _, c := range []struct {
+		listenAt  ListenAt
+		connectTo ConnectTo
+		ok        bool
+	}{
+		{"127.0.0.1:30000-30009", "backend:40000-40009", true},
+		{"127.0.0.1:30000-30009", "backend:80", true},
+		{"127.0.0.1:30000-30009", "backend:40000-40008", false},
+		{"127.0.0.1:30000", "backend:40000-40009", false},
+		{"127.0.0.1:30000-70000", "backend:80", false},
+	} {
+		if err := validateAddresses(c.listenAt, c.connectTo); (err == nil) != c.ok {
+			t.Errorf("%q -> %q: unexpected error %v", c.listenAt, c.connectTo, err)
+		}
+	}
+
+	ranges := []ListenAt{"127.0.0.1:30000-30009", ":8080"}
+	for _, c := range []struct {
+		listenAt ListenAt
+		conflict bool
+	}{
+		{"0.0.0.0:30009-30020", true},
+		{"127.0.0.1:30010-30020", false},
+		{"127.0.0.1:8080", true},
+		{"127.0.0.1:30005", true},
+		{"127.0.0.2:30005", false},
+	} {
+		if err := listenConflict(c.listenAt, ranges); (err != nil) != c.conflict {
+			t.Errorf("%q: unexpected conflict %v", c.listenAt, err)
+		}
+	}
+
+	mapping := newPortMapping("127.0.0.1:30000-30009", "backend:40000-40009")
+	if to := mapping.connectTo(30005); to != "backend:40005" {
+		t.Errorf("Expected ports to be mapped one to one, got %q", to)
+	}
+	if newPortMapping("127.0.0.1:30000-30009", "backend:80") != nil {
+		t.Errorf("Expected no mapping for a single destination")
+	}
+}
+
+// listenPortPair listens at two consecutive ports
+func listenPortPair(t *testing.T) (net.Listener, net.Listener) {
+	for i := 0; i < 100; i++ {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		port := first.Addr().(*net.TCPAddr).Port
+		second, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port+1))
+		if err == nil {
+			return first, second
+		}
+		first.Close()
+	}
+	t.Fatalf("Failed to find two consecutive free ports")
+	return nil, nil
+}
+
+// pairRange returns a port range of two listeners
+func pairRange(first, second net.Listener) string {
+	return fmt.Sprintf("127.0.0.1:%d-%d", first.Addr().(*net.TCPAddr).Port,
+		second.Addr().(*net.TCPAddr).Port)
+}
+
+func TestPortRangeTunnel(t *testing.T) {
+	// Every backend greets clients with its name
+	first, second := listenPortPair(t)
+	defer first.Close()
+	defer second.Close()
+	for name, l := range map[string]net.Listener{"a": first, "b": second} {
+		name, l := name, l
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name))
+				defer conn.Close()
+			}
+		}()
+	}
+
+	a, b := listenPortPair(t)
+	listenAt := ListenAt(pairRange(a, b))
+	a.Close()
+	b.Close()
+	tunnel, err := NewTunnel(listenAt, ConnectTo(pairRange(first, second)),
+		TunnelLimits{TunnelLimit: 1000000}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	ports, _ := parsePortRange(string(listenAt))
+	for i, expected := range []string{"a", "b"} {
+		client, err := net.Dial("tcp", ports.port(ports.first+i))
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		greeting := make([]byte, 1)
+		if _, err := io.ReadFull(client, greeting); err != nil || string(greeting) != expected {
+			t.Errorf("Expected port %d to be forwarded to backend %q, got %q (%v)",
+				ports.first+i, expected, greeting, err)
+		}
+	}
+	if conns := tunnel.Connections(); len(conns) != 2 {
+		t.Errorf("Expected connections to both ports to share the tunnel, got %d",
+			len(conns))
+	}
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// preamblePrefix starts every preamble cooperating clients could send before
+// their traffic
+const preamblePrefix = "THROTTLE "
+
+// PreambleMagic starts a preamble requesting a connection limit, e.g.
+// "THROTTLE RATE 10Mbps\n". Limit is given in the same format as in
+// configuration.
+const PreambleMagic = preamblePrefix + "RATE "
+
+// TestPreambleMagic starts a preamble asking tunnel to run a bandwidth test
+// instead of connecting to upstream, e.g. "THROTTLE TEST echo\n"
+const TestPreambleMagic = preamblePrefix + "TEST "
+
+// preambleTimeout is how long tunnel waits for a client to start sending a
+// preamble before forwarding its connection as is
+const preambleTimeout = 100 * time.Millisecond
+
+// maxPreambleSize limits the length of a preamble line
+const maxPreambleSize = 64
+
+// preambleRate returns the maximum rate a client is allowed to request in a
+// preamble by limits (zero if any rate is allowed)
+func (l TunnelLimits) preambleRate() Limit {
+	if l.PreambleMaxRate == 0 {
+		return l.ConnectionLimit
+	}
+	return l.PreambleMaxRate
+}
+
+// readPreamble reads a preamble from connection client if it sent one and
+// records a limit or a bandwidth test it requested. Data client sent instead
+// of a preamble is kept to be forwarded first.
+func (c *Connection) readPreamble() error {
+	c.ingress.SetReadDeadline(time.Now().Add(preambleTimeout))
+	defer c.ingress.SetReadDeadline(time.Time{})
+
+	head := make([]byte, len(preamblePrefix))
+	n, err := io.ReadFull(c.ingress, head)
+	if err != nil && !isTimeout(err) && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if n < len(head) || !bytes.Equal(head, []byte(preamblePrefix)) {
+		c.pending = head[:n]
+		return nil
+	}
+
+	// Client is cooperating, so it's given time to finish the line
+	c.ingress.SetReadDeadline(time.Now().Add(preambleTimeout))
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxPreambleSize {
+		if _, err := c.ingress.Read(b); err != nil {
+			return fmt.Errorf("Failed to read preamble: %v", err)
+		}
+		if b[0] == '\n' {
+			return c.parsePreamble(preamblePrefix + strings.TrimSuffix(string(line), "\r"))
+		}
+		line = append(line, b[0])
+	}
+	return fmt.Errorf("Preamble is too long")
+}
+
+// parsePreamble records what client asked for in a preamble line
+func (c *Connection) parsePreamble(line string) error {
+	switch {
+	case c.ratePreamble && strings.HasPrefix(line, PreambleMagic):
+		limit, err := ParseLimit(strings.TrimPrefix(line, PreambleMagic))
+		if err != nil {
+			return fmt.Errorf("Invalid preamble: %v", err)
+		}
+		if limit == 0 {
+			return fmt.Errorf("Invalid preamble: zero rate requested")
+		}
+		if c.maxPreambleRate != 0 && limit > c.maxPreambleRate {
+			limit = c.maxPreambleRate
+		}
+		c.requestedLimit = &limit
+		return nil
+	case c.bandwidthTest && strings.HasPrefix(line, TestPreambleMagic):
+		mode := strings.TrimPrefix(line, TestPreambleMagic)
+		switch mode {
+		case TestEcho, TestDiscard, TestSource:
+			c.testMode = mode
+			return nil
+		default:
+			return fmt.Errorf("Unknown bandwidth test %q", mode)
+		}
+	default:
+		return fmt.Errorf("Unsupported preamble %q", line)
+	}
+}
+
+// prefixedConn is a net.Conn that returns given data before reading from the
+// underlying connection
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// Read is an implementation of net.Conn.Read
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startRecordingUpstream starts a listener sending the first bytes of data
+// received on each connection to a channel
+func startRecordingUpstream(t *testing.T, size int) (net.Listener, chan string) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, size)
+				n, _ := io.ReadFull(conn, buf)
+				received <- string(buf[:n])
+			}(conn)
+		}
+	}()
+	return upstream, received
+}
+
+func TestRatePreamble(t *testing.T) {
+	upstream, received := startRecordingUpstream(t, 5)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{RatePreamble: true, PreambleMaxRate: 1000}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	cases := []struct {
+		name  string
+		sent  string
+		limit Limit
+	}{
+		{"preamble", PreambleMagic + "800Bps\r\nhello", 800},
+		{"capped", PreambleMagic + "1MBps\nhello", 1000},
+		{"no preamble", "hello", 0},
+	}
+	for _, c := range cases {
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		client.Write([]byte(c.sent))
+		select {
+		case data := <-received:
+			if data != "hello" {
+				t.Errorf("%s: expected upstream to receive client data only, got %q",
+					c.name, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: upstream received nothing", c.name)
+		}
+		connections := tunnel.Connections()
+		if len(connections) != 1 || connections[0].OwnLimit != (c.limit != 0) ||
+			(c.limit != 0 && connections[0].Limit != c.limit) {
+			t.Errorf("%s: expected connection limit %v, got %+v", c.name, c.limit, connections)
+		}
+		client.Close()
+		for len(tunnel.Connections()) != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestInvalidRatePreamble(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{RatePreamble: true}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte(PreambleMagic + "fast\n"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected connection with invalid preamble to be closed, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseRejected] != 1 {
+		t.Errorf("Expected connection to be rejected, got %v", closed)
+	}
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
+)
+
+// PriorityRule gives a priority to connections matching it. All of specified
+// conditions must hold, rule without conditions matches all connections.
+type PriorityRule struct {
+	// Connections of higher priority are served from tunnel limit first.
+	// Connections matching no rule have priority 0.
+	Priority int `json:"priority"`
+	// IP addresses or CIDRs of clients
+	Clients []string `json:"clients,omitempty"`
+	// Ports clients connected to (useful with tunnels listening at several
+	// addresses)
+	Ports []int `json:"ports,omitempty"`
+}
+
+// PriorityRules tell priorities of connections. Connection gets priority of
+// the first rule it matches unless admission gave it one (see
+// Admission.Priority). When tunnel is saturated, connections of lower
+// priorities only get bandwidth higher priorities leave unused.
+type PriorityRules []PriorityRule
+
+// priorityHeadroom is the fraction of tunnel limit kept for each priority above
+// its current rate, so that it could take bandwidth back from lower priorities
+const priorityHeadroom = 0.1
+
+// validate checks rules for errors
+func (r PriorityRules) validate() error {
+	_, err := r.set()
+	return err
+}
+
+// equal tells whether two sets of rules are the same
+func (r PriorityRules) equal(other PriorityRules) bool {
+	if len(r) != len(other) {
+		return false
+	}
+	for i := range r {
+		a, b := r[i], other[i]
+		if a.Priority != b.Priority || !sameStrings(a.Clients, b.Clients) ||
+			len(a.Ports) != len(b.Ports) {
+			return false
+		}
+		for j := range a.Ports {
+			if a.Ports[j] != b.Ports[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// priorityRule is a rule with its clients parsed
+type priorityRule struct {
+	PriorityRule
+	clients []*net.IPNet
+}
+
+// prioritySet is a parsed set of priority rules
+type prioritySet struct {
+	rules []priorityRule
+}
+
+// set parses rules. Returns nil if there are none.
+func (r PriorityRules) set() (*prioritySet, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	result := new(prioritySet)
+	for i, v := range r {
+		rule := priorityRule{PriorityRule: v}
+		for _, c := range v.Clients {
+			network, err := parseNetwork(c)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid client of priority rule %d: %v", i, err)
+			}
+			rule.clients = append(rule.clients, network)
+		}
+		for _, port := range v.Ports {
+			if port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("Invalid port %d of priority rule %d", port, i)
+			}
+		}
+		result.rules = append(result.rules, rule)
+	}
+	return result, nil
+}
+
+// match returns priority of a connection from a given client to a given local
+// address. Safe to call on nil set.
+func (s *prioritySet) match(client, local net.Addr) int {
+	if s == nil {
+		return 0
+	}
+	for _, r := range s.rules {
+		if len(r.clients) > 0 && !containsAddr(r.clients, client.String()) {
+			continue
+		}
+		if len(r.Ports) > 0 && !containsPort(r.Ports, local) {
+			continue
+		}
+		return r.Priority
+	}
+	return 0
+}
+
+// containsPort tells whether port of an address is one of given ports
+func containsPort(ports []int, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, port := range ports {
+		if port == tcpAddr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// priorityLevel is a limiter shared by connections of the same priority. It
+// caps them to the bandwidth higher priorities leave unused.
+type priorityLevel struct {
+	priority int
+	limiter  *rate.Limiter
+}
+
+// priorityLimits returns limits of priority levels ordered from the highest
+// priority to the lowest given tunnel limit and current rates of levels. The
+// highest priority isn't limited beyond tunnel limit, so its limit is zero.
+func priorityLimits(total float64, used []float64) []float64 {
+	limits := make([]float64, len(used))
+	var reserved float64
+	for i := range used {
+		if i > 0 {
+			limits[i] = total - reserved
+			if limits[i] < 1 {
+				limits[i] = 1
+			}
+		}
+		reserved += used[i] + priorityHeadroom*total
+	}
+	return limits
+}
+
+// UpdatePriorities changes priority rules of a tunnel. Active connections get
+// new priorities right away unless admission gave them ones.
+func (t *Tunnel) UpdatePriorities(rules PriorityRules) error {
+	set, err := rules.set()
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updatePriorities <- set:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// applyPriority sets priority of a connection according to its admission or
+// priority rules. Must be called on the tunnel goroutine.
+func (t *Tunnel) applyPriority(conn *Connection) {
+	priority := conn.admittedPriority
+	if priority == 0 {
+		priority = t.priorities.match(conn.ingress.RemoteAddr(), conn.ingress.LocalAddr())
+	}
+	if int(atomic.SwapInt32(&conn.priority, int32(priority))) != priority {
+		t.logf(LogDebug, "Connection %d at %q has priority %d", conn.ID(), t.listenAt,
+			priority)
+	}
+}
+
+// balancePriorities limits connections of each priority to the bandwidth
+// higher priorities leave unused. Connections of the highest priority present
+// are only subject to tunnel limit. Must be called on the tunnel goroutine.
+func (t *Tunnel) balancePriorities(activeConnections *connectionRegistry) {
+	connections := activeConnections.all()
+	used := make(map[int]float64)
+	for _, conn := range connections {
+		used[conn.loadPriority()] += conn.meter.throughput().Rate1s
+	}
+	priorities := make([]int, 0, len(used))
+	for p := range used {
+		priorities = append(priorities, p)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	levels := make(map[int]*priorityLevel, len(priorities))
+	total := float64(t.tunnelLimit(t.currentLimits))
+	if total > 0 && len(priorities) > 1 {
+		rates := make([]float64, len(priorities))
+		for i, p := range priorities {
+			rates[i] = used[p]
+		}
+		for i, limit := range priorityLimits(total, rates) {
+			if i == 0 {
+				continue
+			}
+			level := t.priorityLevels[priorities[i]]
+			if level == nil {
+				level = &priorityLevel{
+					priority: priorities[i],
+					limiter:  rate.NewLimiter(rate.Inf, limiter.MaxBurstSize),
+				}
+			}
+			level.limiter.SetLimit(rate.Limit(limit))
+			levels[priorities[i]] = level
+		}
+	}
+	t.priorityLevels = levels
+
+	for _, conn := range connections {
+		level := levels[conn.loadPriority()]
+		if level == conn.priorityLevel {
+			continue
+		}
+		if t.updateConnectionShared(conn, conn.identity, conn.class, level, conn.subnet,
+			conn.backend) {
+			conn.priorityLevel = level
+		}
+	}
+}
+
+// loadPriority returns priority of a connection. Safe to call concurrently.
+func (c *Connection) loadPriority() int {
+	return int(atomic.LoadInt32(&c.priority))
+}
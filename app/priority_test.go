@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPriorityLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		used     []float64
+		expected []float64
+	}{
+		{"single", []float64{1000}, []float64{0}},
+		{"high idle", []float64{0, 900}, []float64{0, 900}},
+		{"high busy", []float64{600, 400}, []float64{0, 300}},
+		{"saturated", []float64{1000, 10}, []float64{0, 1}},
+		{"three", []float64{200, 300, 500}, []float64{0, 700, 300}},
+	}
+	for _, c := range cases {
+		limits := priorityLimits(1000, c.used)
+		for i := range limits {
+			if math.Abs(limits[i]-c.expected[i]) > 1e-6 {
+				t.Errorf("%s: expected limits %v, got %v", c.name, c.expected, limits)
+				break
+			}
+		}
+	}
+}
+
+func TestPriorityRules(t *testing.T) {
+	set, err := PriorityRules{
+		{Priority: 10, Clients: []string{"10.0.0.0/8"}},
+		{Priority: -1, Ports: []int{8081}},
+	}.set()
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	office := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1000}
+	client := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1000}
+	bulk := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8081}
+	web := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	cases := []struct {
+		client, local net.Addr
+		expected      int
+	}{
+		{office, bulk, 10},
+		{client, bulk, -1},
+		{client, web, 0},
+	}
+	for _, c := range cases {
+		if priority := set.match(c.client, c.local); priority != c.expected {
+			t.Errorf("Expected %v to %v to have priority %d, got %d", c.client, c.local,
+				c.expected, priority)
+		}
+	}
+
+	invalid := []PriorityRules{
+		{{Priority: 1, Clients: []string{"office"}}},
+		{{Priority: 1, Ports: []int{0}}},
+		{{Priority: 1, Ports: []int{70000}}},
+	}
+	for _, rules := range invalid {
+		if err := rules.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", rules)
+		}
+	}
+}
+
+func TestTunnelPriorities(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	admitted := 0
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{TunnelLimit: 1000}, TunnelOptions{
+			Priorities: PriorityRules{{Priority: 5, Clients: []string{"127.0.0.1"}}},
+			Admit: func(ctx context.Context, client net.Addr) Admission {
+				admitted++
+				if admitted == 1 {
+					return Admission{Priority: 20}
+				}
+				return Admission{}
+			},
+		})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+	}
+
+	waitPriorities := func(expected ...int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			connections := tunnel.Connections()
+			matched := len(connections) == len(expected)
+			for i := 0; matched && i < len(expected); i++ {
+				matched = connections[i].Priority == expected[i]
+			}
+			if matched {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected connections of priorities %v, got %+v", expected,
+					connections)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitPriorities(20, 5)
+
+	if err := tunnel.UpdatePriorities(nil); err != nil {
+		t.Fatalf("Failed to update priorities: %v", err)
+	}
+	waitPriorities(20, 0)
+}
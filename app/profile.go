@@ -0,0 +1,111 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+var errProfileNotFound = errors.New("Profile not found")
+
+// ProfileInfo describes a bandwidth profile - a named set of tunnel limits
+// that could be shared by any number of tunnels. Changing a profile changes
+// limits of all tunnels using it at once.
+type ProfileInfo struct {
+	Name    string       `json:"name"`
+	Limits  TunnelLimits `json:"limits"`
+	Tunnels int          `json:"tunnels"`
+}
+
+// validateProfile checks profile limits for errors
+func validateProfile(name string, limits TunnelLimits) error {
+	if name == "" {
+		return fmt.Errorf("Profile name must not be empty")
+	}
+	if err := limits.validate(); err != nil {
+		return withContext(err, "Profile %q", name)
+	}
+	return nil
+}
+
+// resolveLimits returns limits a tunnel with a given spec should run with.
+// Must be called on the manager goroutine with a spec referencing a known
+// profile (if any).
+func (m *TunnelManager) resolveLimits(spec TunnelSpec) TunnelLimits {
+	if spec.Profile != "" {
+		return m.profiles[spec.Profile]
+	}
+	return spec.Limits
+}
+
+// ListProfiles returns all defined profiles ordered by name.
+func (m *TunnelManager) ListProfiles() []ProfileInfo {
+	var result []ProfileInfo
+	m.do(func() {
+		for name, limits := range m.profiles {
+			info := ProfileInfo{
+				Name:   name,
+				Limits: limits,
+			}
+			for _, t := range m.tunnels {
+				if t.profile == name {
+					info.Tunnels++
+				}
+			}
+			result = append(result, info)
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// PutProfile defines a new profile or changes an existing one. All tunnels
+// using the profile switch to new limits together. The change lasts until
+// configuration defines the profile differently.
+func (m *TunnelManager) PutProfile(name string, limits TunnelLimits) error {
+	if err := validateProfile(name, limits); err != nil {
+		return err
+	}
+	m.do(func() {
+		m.profiles[name] = limits
+		for k, t := range m.tunnels {
+			if t.profile != name || t.lastLimits == limits {
+				continue
+			}
+			t.lastLimits = limits
+			m.applyLimits(t)
+			m.publishTunnelEvent(EventTunnelUpdated, k, t)
+		}
+		log.Printf("Profile %q set to %v", name, limits)
+	})
+	return nil
+}
+
+// ApplyProfile makes a tunnel use limits of a given profile and follow its
+// changes. The change lasts until configuration sets different limits for the
+// tunnel.
+func (m *TunnelManager) ApplyProfile(listenAt ListenAt, name string) error {
+	err := errTunnelNotFound
+	m.do(func() {
+		limits, ok := m.profiles[name]
+		if !ok {
+			err = errProfileNotFound
+			return
+		}
+		k, t, ok := m.findTunnel(listenAt)
+		if !ok {
+			return
+		}
+		err = nil
+		t.profile = name
+		if t.lastLimits != limits {
+			t.lastLimits = limits
+			m.applyLimits(t)
+		}
+		m.publishTunnelEvent(EventTunnelUpdated, k, t)
+	})
+	return err
+}
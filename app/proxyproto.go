@@ -0,0 +1,171 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is how long tunnel waits for a client to send PROXY
+// protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts version 2 (binary) PROXY protocol headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Size limits the length of version 1 (text) PROXY protocol header
+// line including CRLF
+const maxProxyV1Size = 107
+
+// Types of PROXY protocol version 2 TLVs tunnel understands
+const (
+	proxyTLVAuthority = 0x02
+	proxyTLVSSL       = 0x20
+	proxySubTLVSSLCN  = 0x22
+	// Client connected over TLS
+	proxySSLClient = 0x01
+)
+
+// readProxyHeader reads PROXY protocol header (version 1 or 2) client must
+// start with and records original source, server name and client certificate
+// identity it tells. Header isn't forwarded to upstream.
+func (c *Connection) readProxyHeader() error {
+	c.ingress.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.ingress.SetReadDeadline(time.Time{})
+
+	head := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(c.ingress, head); err != nil {
+		return fmt.Errorf("Failed to read PROXY header: %v", err)
+	}
+	if bytes.Equal(head, proxyV2Signature) {
+		return c.readProxyV2()
+	}
+	if !bytes.HasPrefix(head, []byte("PROXY ")) {
+		return fmt.Errorf("Connection doesn't start with PROXY header")
+	}
+	line := head
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Size {
+			return fmt.Errorf("PROXY header is too long")
+		}
+		n, err := c.ingress.Read(b)
+		if err != nil {
+			return fmt.Errorf("Failed to read PROXY header: %v", err)
+		}
+		line = append(line, b[:n]...)
+	}
+	return c.parseProxyV1(string(line[:len(line)-2]))
+}
+
+// parseProxyV1 records original source told by a version 1 header line, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443"
+func (c *Connection) parseProxyV1(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("Invalid PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("Invalid PROXY header %q", line)
+	}
+	c.source = &net.TCPAddr{IP: ip, Port: port}
+	return nil
+}
+
+// readProxyV2 reads the rest of a version 2 header following its signature
+func (c *Connection) readProxyV2() error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c.ingress, head); err != nil {
+		return fmt.Errorf("Failed to read PROXY header: %v", err)
+	}
+	if head[0]>>4 != 2 {
+		return fmt.Errorf("Unsupported PROXY protocol version %d", head[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(c.ingress, body); err != nil {
+		return fmt.Errorf("Failed to read PROXY header: %v", err)
+	}
+	// Addresses of unknown families are skipped along with their TLVs
+	var addrLen int
+	switch head[1] >> 4 {
+	case 0:
+	case 1:
+		addrLen = 2*net.IPv4len + 4
+	case 2:
+		addrLen = 2*net.IPv6len + 4
+	case 3:
+		addrLen = 216
+	default:
+		return nil
+	}
+	if len(body) < addrLen {
+		return fmt.Errorf("PROXY header is truncated")
+	}
+	// Only TCP connections proxied on behalf of clients have a source. Local
+	// command is sent by proxy on its own behalf, e.g. for health checks.
+	if head[0]&0x0f == 1 && head[1]&0x0f == 1 {
+		switch ipLen := (addrLen - 4) / 2; ipLen {
+		case net.IPv4len, net.IPv6len:
+			ip := make(net.IP, ipLen)
+			copy(ip, body[:ipLen])
+			port := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+			c.source = &net.TCPAddr{IP: ip, Port: port}
+		}
+	}
+	return c.parseProxyTLVs(body[addrLen:])
+}
+
+// parseProxyTLVs records server name and client certificate identity told by
+// TLVs of a version 2 header
+func (c *Connection) parseProxyTLVs(data []byte) error {
+	return eachProxyTLV(data, func(kind byte, value []byte) error {
+		switch kind {
+		case proxyTLVAuthority:
+			c.serverName = string(value)
+		case proxyTLVSSL:
+			// Client flags and verification result precede sub-TLVs. Identity
+			// only counts if certificate was verified.
+			if len(value) < 5 {
+				return fmt.Errorf("PROXY header has truncated SSL TLV")
+			}
+			if value[0]&proxySSLClient == 0 || binary.BigEndian.Uint32(value[1:]) != 0 {
+				return nil
+			}
+			return eachProxyTLV(value[5:], func(kind byte, value []byte) error {
+				if kind == proxySubTLVSSLCN {
+					c.certIdentity = string(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// eachProxyTLV calls f for every TLV of PROXY protocol header data
+func eachProxyTLV(data []byte, f func(kind byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return fmt.Errorf("PROXY header has truncated TLV")
+		}
+		size := 3 + int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < size {
+			return fmt.Errorf("PROXY header has truncated TLV")
+		}
+		if err := f(data[0], data[3:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// proxyTLV encodes a TLV of PROXY protocol version 2 header
+func proxyTLV(kind byte, value []byte) []byte {
+	result := []byte{kind, 0, 0}
+	binary.BigEndian.PutUint16(result[1:], uint16(len(value)))
+	return append(result, value...)
+}
+
+// proxyV2Header encodes a version 2 header of a TCP over IPv4 connection
+func proxyV2Header(source *net.TCPAddr, tlvs ...[]byte) []byte {
+	body := append([]byte(nil), source.IP.To4()...)
+	body = append(body, 127, 0, 0, 1, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(body[8:], uint16(source.Port))
+	binary.BigEndian.PutUint16(body[10:], 443)
+	for _, tlv := range tlvs {
+		body = append(body, tlv...)
+	}
+	header := append(append([]byte(nil), proxyV2Signature...), 0x21, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(body)))
+	return append(header, body...)
+}
+
+// readHeader passes data to a new connection and reads PROXY header from it
+func readHeader(data []byte) (*Connection, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(data)
+	conn := NewConnection(server, "127.0.0.1:1", new(TunnelCounters))
+	return conn, conn.readProxyHeader()
+}
+
+func TestProxyHeader(t *testing.T) {
+	conn, err := readHeader([]byte("PROXY TCP4 203.0.113.5 10.0.0.1 50000 443\r\nhello"))
+	if err != nil {
+		t.Fatalf("Failed to read version 1 header: %v", err)
+	}
+	if conn.source.String() != "203.0.113.5:50000" {
+		t.Errorf("Expected original source to be read, got %v", conn.source)
+	}
+
+	source := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 41000}
+	ssl := append([]byte{proxySSLClient | 0x02, 0, 0, 0, 0},
+		proxyTLV(proxySubTLVSSLCN, []byte("billing"))...)
+	conn, err = readHeader(proxyV2Header(source,
+		proxyTLV(proxyTLVAuthority, []byte("db.example.com")),
+		proxyTLV(proxyTLVSSL, ssl)))
+	if err != nil {
+		t.Fatalf("Failed to read version 2 header: %v", err)
+	}
+	if conn.source.String() != source.String() || conn.serverName != "db.example.com" ||
+		conn.certIdentity != "billing" {
+		t.Errorf("Unexpected metadata %v %q %q", conn.source, conn.serverName,
+			conn.certIdentity)
+	}
+
+	// Identity of a certificate that failed verification doesn't count
+	ssl[1] = 1
+	conn, err = readHeader(proxyV2Header(source, proxyTLV(proxyTLVSSL, ssl)))
+	if err != nil {
+		t.Fatalf("Failed to read version 2 header: %v", err)
+	}
+	if conn.certIdentity != "" {
+		t.Errorf("Expected unverified identity to be ignored, got %q", conn.certIdentity)
+	}
+
+	invalid := [][]byte{
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+		[]byte("PROXY TCP4 somewhere 10.0.0.1 50000 443\r\n"),
+		// TLV claims more data than there is
+		proxyV2Header(source, []byte{proxyTLVAuthority, 0, 10}),
+	}
+	for _, data := range invalid {
+		if _, err := readHeader(data); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+}
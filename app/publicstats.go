@@ -0,0 +1,119 @@
+package app
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PublicStats are aggregate numbers of all tunnels that are safe to expose
+// without authentication. They don't tell tunnels, tenants or peers apart.
+type PublicStats struct {
+	// Number of tunnels and how many of them are suspended or draining
+	Tunnels   int `json:"tunnels"`
+	Suspended int `json:"suspended"`
+	Draining  int `json:"draining"`
+	// Number of active connections
+	Connections int            `json:"connections"`
+	Counters    TunnelCounters `json:"counters"`
+	Throughput  Throughput     `json:"throughput"`
+	// Number of connections ended for each reason
+	Closed CloseReasonCounts `json:"closed,omitempty"`
+}
+
+// publicStatsInterval is how long public stats are cached for, so that
+// scraping them doesn't keep the manager busy
+const publicStatsInterval = time.Second
+
+// PublicStats returns aggregate stats of all tunnels
+func (m *TunnelManager) PublicStats() PublicStats {
+	var result PublicStats
+	m.do(func() {
+		for _, v := range m.tunnels {
+			stats := v.tunnel.Stats()
+			result.Tunnels++
+			if v.suspended != notSuspended {
+				result.Suspended++
+			}
+			if v.tunnel.Draining() {
+				result.Draining++
+			}
+			result.Connections += v.tunnel.connections.len()
+			result.Counters = result.Counters.Add(stats.Counters)
+			result.Throughput = result.Throughput.Add(stats.Throughput)
+			result.Closed = result.Closed.Add(stats.Closed)
+		}
+	})
+	return result
+}
+
+// publicStatsServer serves cached public stats at GET /stats
+type publicStatsServer struct {
+	manager *TunnelManager
+	mu      *sync.Mutex
+	stats   PublicStats
+	expires time.Time
+}
+
+func newPublicStatsServer(manager *TunnelManager) *publicStatsServer {
+	return &publicStatsServer{
+		manager: manager,
+		mu:      new(sync.Mutex),
+	}
+}
+
+func (s *publicStatsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/stats" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.load(time.Now()))
+}
+
+// load returns public stats, refreshing them if cached ones expired
+func (s *publicStatsServer) load(now time.Time) PublicStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.expires) {
+		s.stats = s.manager.PublicStats()
+		s.expires = now.Add(publicStatsInterval)
+	}
+	return s.stats
+}
+
+// startPublicStatsServer serves public stats at a given address until graceful
+// shutdown is requested
+func startPublicStatsServer(address string, manager *TunnelManager,
+	gs *gracefulShutdown) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler: newPublicStatsServer(manager),
+	}
+
+	gs.waitGroup.Add(1)
+	go func() {
+		defer gs.waitGroup.Done()
+		log.Printf("Serving public stats at %q", address)
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("Public stats server at %q failed: %v", address, err)
+		}
+	}()
+
+	go func() {
+		<-gs.quit
+		server.Close()
+	}()
+
+	return nil
+}
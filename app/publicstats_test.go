@@ -0,0 +1,64 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublicStats(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	manager := newTunnelManager(make(chan ConfigurationJSON), persistence, gs)
+	manager.start()
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1"},
+		{ListenAt: freePort(t), ConnectTo: "127.0.0.1:1"},
+	}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+
+	server := newPublicStatsServer(manager)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected stats to be served, got %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "127.0.0.1") {
+		t.Errorf("Expected no addresses in public stats, got %s", rec.Body)
+	}
+	var stats PublicStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.Tunnels != 2 || stats.Connections != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, "/stats", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v1/tunnels", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Periods tunnel quotas are reset every. Periods start at midnight local time
+// on the first day of a month or on Monday.
+const (
+	QuotaMonth = ""
+	QuotaWeek  = "week"
+	QuotaDay   = "day"
+)
+
+// QuotaUsage tells how much of its quota a tunnel used within current period
+type QuotaUsage struct {
+	// Start of current quota period
+	Since time.Time `json:"since"`
+	// Bytes forwarded in both directions since then
+	Used int64 `json:"used"`
+	// Tunnel used up its quota and either trickles traffic or rejects
+	// connections until the period ends
+	Exhausted bool `json:"exhausted,omitempty"`
+}
+
+// validateQuota checks quota settings of limits for errors
+func (l TunnelLimits) validateQuota() error {
+	switch l.QuotaPeriod {
+	case QuotaMonth, QuotaWeek, QuotaDay:
+	default:
+		return fmt.Errorf("Unknown quota period %q", l.QuotaPeriod)
+	}
+	if l.Quota < 0 || l.QuotaTrickle < 0 {
+		return fmt.Errorf("Quota and quota trickle rate must not be negative")
+	}
+	return nil
+}
+
+// quotaPeriodStart returns the start of a quota period a given time falls into
+func quotaPeriodStart(now time.Time, period string) time.Time {
+	year, month, day := now.Date()
+	switch period {
+	case QuotaDay:
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	case QuotaWeek:
+		day -= (int(now.Weekday()) + 6) % 7
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	default:
+		return time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+	}
+}
+
+// tunnelQuota keeps track of data a tunnel forwards against its quota. All
+// fields are accessed atomically.
+type tunnelQuota struct {
+	// Bytes forwarded within current period, added to by forwarders
+	used int64
+	// Start of current period (unix nanoseconds)
+	since int64
+	// Size of the quota (zero if tunnel has none)
+	size int64
+	// Non-zero once quota is used up
+	exhausted int32
+}
+
+// newTunnelQuota creates a quota tracker for given limits carrying over usage
+// of a previous run (if not nil) unless it belongs to a past period
+func newTunnelQuota(now time.Time, limits TunnelLimits, restored *QuotaUsage) *tunnelQuota {
+	result := &tunnelQuota{
+		since: quotaPeriodStart(now, limits.QuotaPeriod).UnixNano(),
+		size:  int64(limits.Quota),
+	}
+	if restored != nil && restored.Since.UnixNano() == result.since {
+		result.used = restored.Used
+	}
+	return result
+}
+
+func (q *tunnelQuota) isExhausted() bool {
+	return atomic.LoadInt32(&q.exhausted) != 0
+}
+
+// load returns quota usage. Returns nil if tunnel has no quota.
+func (q *tunnelQuota) load() *QuotaUsage {
+	if atomic.LoadInt64(&q.size) == 0 {
+		return nil
+	}
+	return &QuotaUsage{
+		Since:     time.Unix(0, atomic.LoadInt64(&q.since)),
+		Used:      atomic.LoadInt64(&q.used),
+		Exhausted: q.isExhausted(),
+	}
+}
+
+// tunnelLimit returns tunnel limit in effect, which is lowered to trickle rate
+// once quota is exhausted
+func (t *Tunnel) tunnelLimit(limits TunnelLimits) Limit {
+	if !t.quota.isExhausted() || limits.QuotaTrickle == 0 {
+		return limits.TunnelLimit
+	}
+	if limits.TunnelLimit == 0 || limits.TunnelLimit > limits.QuotaTrickle {
+		return limits.QuotaTrickle
+	}
+	return limits.TunnelLimit
+}
+
+// quotaBlocked tells whether tunnel rejects connections because of exhausted
+// quota. Must be called on the tunnel goroutine.
+func (t *Tunnel) quotaBlocked() bool {
+	return t.quota.isExhausted() && t.currentLimits.QuotaTrickle == 0
+}
+
+// checkQuota starts a new quota period when it's time to and tells whether
+// quota is exhausted. Once it is, tunnel limit drops to trickle rate or, if
+// there is none, active connections are closed. Must be called on the tunnel
+// goroutine.
+func (t *Tunnel) checkQuota(now time.Time, activeConnections *connectionRegistry) {
+	q := t.quota
+	limits := t.currentLimits
+	atomic.StoreInt64(&q.size, int64(limits.Quota))
+	since := quotaPeriodStart(now, limits.QuotaPeriod).UnixNano()
+	if atomic.SwapInt64(&q.since, since) != since {
+		atomic.StoreInt64(&q.used, 0)
+	}
+	exhausted := limits.Quota > 0 && atomic.LoadInt64(&q.used) >= int64(limits.Quota)
+	if exhausted == q.isExhausted() {
+		return
+	}
+	if exhausted {
+		atomic.StoreInt32(&q.exhausted, 1)
+		t.logf(LogWarn, "Tunnel at %q used up its quota of %d bytes", t.listenAt,
+			limits.Quota)
+		t.publishTunnel(EventQuotaExhausted, nil)
+	} else {
+		atomic.StoreInt32(&q.exhausted, 0)
+		t.logf(LogInfo, "Tunnel at %q quota is available again", t.listenAt)
+	}
+	t.listener.UpdateLimits(int(t.tunnelLimit(limits)), int(limits.ConnectionLimit))
+	if !t.quotaBlocked() {
+		return
+	}
+	for _, conn := range activeConnections.all() {
+		activeConnections.remove(conn)
+		conn.Close()
+		t.logf(LogInfo, "Connection %d at %q closed since tunnel quota is exhausted",
+			conn.ID(), t.listenAt)
+		t.connectionClosed(conn, CloseQuotaExhausted, loadCounters(&conn.counters), nil)
+	}
+}
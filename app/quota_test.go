@@ -0,0 +1,134 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	// 2021-03-03 is a Wednesday
+	now := time.Date(2021, 3, 3, 15, 30, 0, 0, time.Local)
+	cases := []struct {
+		period   string
+		expected time.Time
+	}{
+		{QuotaMonth, time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local)},
+		{QuotaWeek, time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local)},
+		{QuotaDay, time.Date(2021, 3, 3, 0, 0, 0, 0, time.Local)},
+	}
+	for _, c := range cases {
+		if start := quotaPeriodStart(now, c.period); !start.Equal(c.expected) {
+			t.Errorf("Expected %q period to start at %v, got %v", c.period, c.expected, start)
+		}
+	}
+	// Weeks start on Monday
+	sunday := time.Date(2021, 3, 7, 12, 0, 0, 0, time.Local)
+	if start := quotaPeriodStart(sunday, QuotaWeek); start.Day() != 1 {
+		t.Errorf("Expected week of Sunday to start on Monday before it, got %v", start)
+	}
+}
+
+func TestDataSize(t *testing.T) {
+	cases := []struct {
+		json     string
+		expected DataSize
+	}{
+		{`1024`, 1024},
+		{`"1024"`, 1024},
+		{`"50GiB"`, 50 << 30},
+		{`"10MB"`, 10 << 20},
+		{`"1.5KiB"`, 1536},
+	}
+	for _, c := range cases {
+		var size DataSize
+		if err := json.Unmarshal([]byte(c.json), &size); err != nil {
+			t.Errorf("Failed to parse %s: %v", c.json, err)
+		} else if size != c.expected {
+			t.Errorf("Expected %s to be %d bytes, got %d", c.json, c.expected, size)
+		}
+	}
+	var size DataSize
+	if err := json.Unmarshal([]byte(`"50 parsecs"`), &size); err == nil {
+		t.Errorf("Expected invalid amount of data to be rejected")
+	}
+
+	if err := (TunnelLimits{QuotaPeriod: "year"}).validate(); err == nil {
+		t.Errorf("Expected unknown quota period to be rejected")
+	}
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{Quota: 1000}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection to be closed once quota is used up, got %v", err)
+	}
+	stats := tunnel.Stats()
+	if stats.Quota == nil || !stats.Quota.Exhausted || stats.Quota.Used < 1000 {
+		t.Errorf("Expected quota to be exhausted, got %+v", stats.Quota)
+	}
+	if stats.Closed[CloseQuotaExhausted] != 1 {
+		t.Errorf("Expected closed connection to be counted, got %v", stats.Closed)
+	}
+
+	rejected, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer rejected.Close()
+	rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected new connection to be rejected, got %v", err)
+	}
+
+	// Trickle rate lets connections through again
+	tunnel.UpdateLimits(TunnelLimits{Quota: 1000, QuotaTrickle: 1000})
+	if stats := tunnel.Stats(); stats.Quota == nil || !stats.Quota.Exhausted {
+		t.Errorf("Expected quota to stay exhausted, got %+v", stats.Quota)
+	}
+	trickling, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trickling.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tunnel.Connections()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection to be accepted at trickle rate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Shapes of limit ramps
+const (
+	// Limit changes by the same amount every step
+	RampLinear = "linear"
+	// Limit changes by the same factor every step, so that it moves slowly
+	// where it's low and fast where it's high
+	RampExponential = "exponential"
+)
+
+// rampInterval is how often a ramping limit moves towards its target
+const rampInterval = 100 * time.Millisecond
+
+// validateRamp checks ramp settings of limits for errors
+func (l TunnelLimits) validateRamp() error {
+	if l.LimitRamp < 0 {
+		return fmt.Errorf("Limit ramp must not be negative")
+	}
+	switch l.LimitRampShape {
+	case "", RampLinear, RampExponential:
+		return nil
+	default:
+		return fmt.Errorf("Unknown limit ramp shape %q", l.LimitRampShape)
+	}
+}
+
+// limitRamp is a gradual transition of tunnel and connection limits to the
+// current ones
+type limitRamp struct {
+	shape    string
+	start    time.Time
+	duration time.Duration
+	// Limits in effect when ramp started
+	tunnel, connection Limit
+}
+
+// newLimitRamp starts a ramp from given limits to ones that ramp over a
+// duration. Returns nil if limits should change right away.
+func newLimitRamp(now time.Time, tunnel, connection Limit,
+	limits TunnelLimits) *limitRamp {
+	if limits.LimitRamp <= 0 {
+		return nil
+	}
+	return &limitRamp{
+		shape:      limits.LimitRampShape,
+		start:      now,
+		duration:   time.Duration(limits.LimitRamp),
+		tunnel:     tunnel,
+		connection: connection,
+	}
+}
+
+// done tells whether ramp is over at a given moment
+func (r *limitRamp) done(now time.Time) bool {
+	return now.Sub(r.start) >= r.duration
+}
+
+// step returns a limit ramping from a given one to a target at a given moment.
+// Only limits between positive rates ramp, unlimited and blocked ones change
+// right away.
+func (r *limitRamp) step(now time.Time, from, to Limit) Limit {
+	if from <= 0 || to <= 0 || r.done(now) {
+		return to
+	}
+	progress := float64(now.Sub(r.start)) / float64(r.duration)
+	if r.shape == RampExponential {
+		return Limit(float64(from) * math.Pow(float64(to)/float64(from), progress))
+	}
+	return from + Limit(float64(to-from)*progress)
+}
+
+// rampLimits returns tunnel and connection limits the listener should have at
+// a given moment given a ramp (may be nil). Must be called on the tunnel
+// goroutine.
+func (t *Tunnel) rampLimits(ramp *limitRamp, now time.Time) (tunnel, connection Limit) {
+	tunnel, connection = t.tunnelLimit(t.currentLimits), t.currentLimits.ConnectionLimit
+	if ramp == nil {
+		return tunnel, connection
+	}
+	return ramp.step(now, ramp.tunnel, tunnel), ramp.step(now, ramp.connection, connection)
+}
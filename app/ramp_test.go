@@ -0,0 +1,59 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitRamp(t *testing.T) {
+	start := time.Unix(1000, 0)
+	linear := newLimitRamp(start, 1000, 0, TunnelLimits{LimitRamp: Duration(time.Second)})
+	exponential := newLimitRamp(start, 1000, 0, TunnelLimits{
+		LimitRamp:      Duration(time.Second),
+		LimitRampShape: RampExponential,
+	})
+	half := start.Add(500 * time.Millisecond)
+	cases := []struct {
+		ramp     *limitRamp
+		now      time.Time
+		from, to Limit
+		expected Limit
+	}{
+		{linear, half, 1000, 3000, 2000},
+		{linear, half, 3000, 1000, 2000},
+		{exponential, half, 1000, 4000, 2000},
+		{linear, start.Add(time.Second), 1000, 3000, 3000},
+		{linear, half, 0, 3000, 3000},
+		{linear, half, 1000, Blocked, Blocked},
+	}
+	for _, c := range cases {
+		if limit := c.ramp.step(c.now, c.from, c.to); limit != c.expected {
+			t.Errorf("Expected ramp from %v to %v to be at %v, got %v", c.from, c.to,
+				c.expected, limit)
+		}
+	}
+	if newLimitRamp(start, 1000, 0, TunnelLimits{}) != nil {
+		t.Errorf("Expected limits without ramp to change right away")
+	}
+	if err := (TunnelLimits{LimitRampShape: "cubic"}).validate(); err == nil {
+		t.Errorf("Expected unknown ramp shape to be rejected")
+	}
+}
+
+func TestTunnelLimitRamp(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{})
+	defer tunnel.Shutdown()
+	defer client.Close()
+	tunnel.UpdateLimits(TunnelLimits{ConnectionLimit: 1000})
+	waitConnectionLimit(t, tunnel, 1000, false)
+
+	tunnel.UpdateLimits(TunnelLimits{ConnectionLimit: 100000,
+		LimitRamp: Duration(time.Second)})
+	time.Sleep(300 * time.Millisecond)
+	if limit := tunnel.Connections()[0].Limit; limit <= 1000 || limit >= 100000 {
+		t.Errorf("Expected connection limit to ramp, got %v", limit)
+	}
+	waitConnectionLimit(t, tunnel, 100000, false)
+}
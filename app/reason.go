@@ -0,0 +1,122 @@
+package app
+
+import (
+	"sort"
+)
+
+// CloseReason tells why a connection ended
+type CloseReason string
+
+const (
+	// CloseClientEOF means that client closed the connection
+	CloseClientEOF CloseReason = "clientEOF"
+	// CloseClientError means that communication with client failed
+	CloseClientError CloseReason = "clientError"
+	// CloseUpstreamEOF means that upstream closed the connection
+	CloseUpstreamEOF CloseReason = "upstreamEOF"
+	// CloseUpstreamError means that communication with upstream failed
+	CloseUpstreamError CloseReason = "upstreamError"
+	// CloseKilled means that connection was closed upon request
+	CloseKilled CloseReason = "killed"
+	// CloseTunnelShutdown means that connection was closed because its tunnel
+	// was shut down
+	CloseTunnelShutdown CloseReason = "tunnelShutdown"
+	// CloseDialFailure means that connection to upstream couldn't be
+	// established
+	CloseDialFailure CloseReason = "dialFailure"
+	// CloseRejected means that connection was rejected by a draining or
+	// suspended tunnel or one having too many connections
+	CloseRejected CloseReason = "rejected"
+	// CloseDrained means that connection was closed to bring its tunnel
+	// within a lowered limit
+	CloseDrained CloseReason = "drained"
+	// CloseQuotaExhausted means that connection was closed or rejected since
+	// its tunnel used up its transfer quota
+	CloseQuotaExhausted CloseReason = "quotaExhausted"
+	// CloseWorkerPoolFull means that connection was rejected since worker
+	// pool of its tunnel had no room for it
+	CloseWorkerPoolFull CloseReason = "workerPoolFull"
+	// CloseSimulatedReset means that connection was reset to simulate a
+	// faulty network (see TunnelLimits.ResetProbability)
+	CloseSimulatedReset CloseReason = "simulatedReset"
+	// CloseMaxLifetime means that connection was closed since it lived for
+	// longer than TunnelLimits.MaxLifetime
+	CloseMaxLifetime CloseReason = "maxLifetime"
+	// CloseSuperseded means that connection held for
+	// TunnelLimits.ReconnectDelay was replaced with a newer connection of the
+	// same client to the same destination
+	CloseSuperseded CloseReason = "superseded"
+)
+
+// closeReason returns a reason of a connection ended by a given side with a
+// given error (nil if connection was closed normally)
+func closeReason(closedBy ConnectionSide, err error) CloseReason {
+	switch {
+	case err == errSimulatedReset:
+		return CloseSimulatedReset
+	case closedBy == ClosedByClient && err == nil:
+		return CloseClientEOF
+	case closedBy == ClosedByClient:
+		return CloseClientError
+	case closedBy == ClosedByUpstream && err == nil:
+		return CloseUpstreamEOF
+	default:
+		return CloseUpstreamError
+	}
+}
+
+// side returns the side that ended a connection for a given reason
+func (r CloseReason) side() ConnectionSide {
+	switch r {
+	case CloseClientEOF, CloseClientError:
+		return ClosedByClient
+	case CloseUpstreamEOF, CloseUpstreamError, CloseDialFailure:
+		return ClosedByUpstream
+	default:
+		return ClosedByTunnel
+	}
+}
+
+// CloseReasonCounts holds numbers of connections ended for each reason
+type CloseReasonCounts map[CloseReason]int64
+
+// Add returns a sum of two sets of counts
+func (c CloseReasonCounts) Add(other CloseReasonCounts) CloseReasonCounts {
+	if len(c) == 0 && len(other) == 0 {
+		return nil
+	}
+	result := make(CloseReasonCounts, len(c))
+	for k, v := range c {
+		result[k] = v
+	}
+	for k, v := range other {
+		result[k] += v
+	}
+	return result
+}
+
+// reasons returns reasons having counts in a stable order
+func (c CloseReasonCounts) reasons() []CloseReason {
+	result := make([]CloseReason, 0, len(c))
+	for k := range c {
+		result = append(result, k)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// countClose accounts a connection ended for a given reason
+func (t *Tunnel) countClose(reason CloseReason) {
+	t.closedMu.Lock()
+	defer t.closedMu.Unlock()
+	t.closed[reason]++
+}
+
+// closeCounts returns numbers of connections ended for each reason
+func (t *Tunnel) closeCounts() CloseReasonCounts {
+	t.closedMu.Lock()
+	defer t.closedMu.Unlock()
+	return CloseReasonCounts(nil).Add(t.closed)
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RecordingMagic starts every connection recording file
+const RecordingMagic = "THROTTLE RECORDING 1\n"
+
+// Recordings are written to throttle host, so only operator could enable them
+var errRecordingForbidden = errors.New("Only operator is allowed to record connections")
+
+// Directions of data in a recording
+const (
+	// RecordedClient marks data client sent to upstream
+	RecordedClient byte = 'C'
+	// RecordedUpstream marks data upstream sent to client
+	RecordedUpstream byte = 'U'
+)
+
+// RecordingHeader describes a recorded connection. It follows RecordingMagic
+// as a single line of JSON.
+type RecordingHeader struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	ListenAt string    `json:"listenAt"`
+	Upstream string    `json:"upstream"`
+	Start    time.Time `json:"start"`
+}
+
+// RecordedChunk is data forwarded in one direction at once. In a file every
+// chunk is a direction byte followed by big endian int64 offset (nanoseconds
+// since recording start), uint32 length and data itself.
+type RecordedChunk struct {
+	Direction byte
+	Offset    time.Duration
+	Data      []byte
+}
+
+// Recording is a parsed connection recording
+type Recording struct {
+	Header RecordingHeader
+	Chunks []RecordedChunk
+}
+
+// maxRecordedChunk limits the size of a chunk read from a recording file
+const maxRecordedChunk = 16 * 1024 * 1024
+
+// recorder writes data forwarded by a connection into a recording file. Safe
+// for concurrent use. Recording stops at the first write error.
+type recorder struct {
+	mu     *sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	start  time.Time
+	failed bool
+}
+
+// startRecording creates a recording file for a connection in its recording
+// directory. Greetings connection exchanged are recorded first.
+func (c *Connection) startRecording(upstream net.Addr) error {
+	start := time.Now()
+	_, localPort := splitAddr(c.ingress.LocalAddr())
+	name := fmt.Sprintf("%s-%s-%d.rec", start.UTC().Format("20060102T150405.000"),
+		localPort, c.ID())
+	file, err := os.OpenFile(filepath.Join(c.recordDir, name),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create recording: %v", err)
+	}
+	r := &recorder{
+		mu:    new(sync.Mutex),
+		file:  file,
+		w:     bufio.NewWriter(file),
+		start: start,
+	}
+	header, err := json.Marshal(RecordingHeader{
+		ID:       c.ID(),
+		Client:   c.ingress.RemoteAddr().String(),
+		ListenAt: c.ingress.LocalAddr().String(),
+		Upstream: upstream.String(),
+		Start:    start,
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.w.WriteString(RecordingMagic)
+	r.w.Write(header)
+	r.w.WriteByte('\n')
+	if c.upstreamGreeting != "" {
+		r.record(RecordedClient, expandGreeting(c.upstreamGreeting,
+			c.ingress.RemoteAddr(), c.ingress.LocalAddr()))
+	}
+	if c.clientGreeting != "" {
+		r.record(RecordedUpstream, expandGreeting(c.clientGreeting,
+			c.ingress.RemoteAddr(), c.ingress.LocalAddr()))
+	}
+	c.recorder = r
+	return nil
+}
+
+// record appends forwarded data to recording
+func (r *recorder) record(direction byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+	var head [13]byte
+	head[0] = direction
+	binary.BigEndian.PutUint64(head[1:9], uint64(time.Since(r.start)))
+	binary.BigEndian.PutUint32(head[9:], uint32(len(data)))
+	r.w.Write(head[:])
+	if _, err := r.w.Write(data); err != nil {
+		log.Printf("Failed to write recording %q: %v", r.file.Name(), err)
+		r.failed = true
+	}
+}
+
+// close flushes and closes recording file
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil && !r.failed {
+		log.Printf("Failed to write recording %q: %v", r.file.Name(), err)
+	}
+	r.file.Close()
+}
+
+// ReadRecording parses a connection recording
+func ReadRecording(r io.Reader) (*Recording, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(RecordingMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != RecordingMagic {
+		return nil, fmt.Errorf("Not a connection recording")
+	}
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recording header: %v", err)
+	}
+	var result Recording
+	if err := json.Unmarshal(line, &result.Header); err != nil {
+		return nil, fmt.Errorf("Failed to parse recording header: %v", err)
+	}
+	var head [13]byte
+	for {
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			if err == io.EOF {
+				return &result, nil
+			}
+			return nil, fmt.Errorf("Failed to read recording: %v", err)
+		}
+		size := binary.BigEndian.Uint32(head[9:])
+		if size > maxRecordedChunk {
+			return nil, fmt.Errorf("Recorded chunk is too big (%d bytes)", size)
+		}
+		chunk := RecordedChunk{
+			Direction: head[0],
+			Offset:    time.Duration(binary.BigEndian.Uint64(head[1:9])),
+			Data:      make([]byte, size),
+		}
+		if _, err := io.ReadFull(br, chunk.Data); err != nil {
+			return nil, fmt.Errorf("Failed to read recording: %v", err)
+		}
+		result.Chunks = append(result.Chunks, chunk)
+	}
+}
+
+// Sent returns data recorded in a given direction
+func (r *Recording) Sent(direction byte) []byte {
+	var result []byte
+	for _, chunk := range r.Chunks {
+		if chunk.Direction == direction {
+			result = append(result, chunk.Data...)
+		}
+	}
+	return result
+}
+
+// ReplayOptions control how a recording is replayed
+type ReplayOptions struct {
+	// Replay speed relative to recording, e.g. 2 replays twice as fast (zero
+	// sends everything right away)
+	Speed float64
+	// How long upstream could stay silent after all the data is sent before
+	// replay ends (zero waits for upstream to close connection)
+	Timeout time.Duration
+}
+
+// ReplayResult is an outcome of replaying a recording
+type ReplayResult struct {
+	// Data upstream sent in response
+	Received []byte
+	// Whether upstream responded exactly as it did when recorded
+	Matches bool
+}
+
+// Replay sends data client sent in a recording to upstream, preserving timing
+// if asked to, and collects what upstream sends back until it closes the
+// connection or stays silent for timeout after all the data is sent.
+func (r *Recording) Replay(upstream net.Conn, opts ReplayOptions) (ReplayResult, error) {
+	var result ReplayResult
+	var received bytes.Buffer
+	readDone := make(chan error, 1)
+	sent := make(chan struct{})
+	waitSilence := func() {
+		if opts.Timeout > 0 {
+			upstream.SetReadDeadline(time.Now().Add(opts.Timeout))
+		}
+	}
+	go func() {
+		buf := make([]byte, BufSize)
+		for {
+			select {
+			case <-sent:
+				waitSilence()
+			default:
+			}
+			n, err := upstream.Read(buf)
+			received.Write(buf[:n])
+			if err != nil {
+				readDone <- err
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for _, chunk := range r.Chunks {
+		if chunk.Direction != RecordedClient {
+			continue
+		}
+		if opts.Speed > 0 {
+			at := start.Add(time.Duration(float64(chunk.Offset) / opts.Speed))
+			time.Sleep(time.Until(at))
+		}
+		if _, err := upstream.Write(chunk.Data); err != nil {
+			upstream.Close()
+			<-readDone
+			return result, fmt.Errorf("Failed to send data to upstream: %v", err)
+		}
+	}
+	close(sent)
+	waitSilence()
+	err := <-readDone
+	if err != nil && err != io.EOF && !isTimeout(err) && !isConnectionClosed(err) {
+		return result, fmt.Errorf("Failed to receive data from upstream: %v", err)
+	}
+	result.Received = received.Bytes()
+	result.Matches = bytes.Equal(result.Received, r.Sent(RecordedUpstream))
+	return result, nil
+}
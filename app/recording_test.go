@@ -0,0 +1,109 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startUppercaseUpstream starts a listener replying to every chunk of data
+// with the same chunk in upper case
+func startUppercaseUpstream(t *testing.T) net.Listener {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(bytes.ToUpper(buf[:n]))
+				}
+			}(conn)
+		}
+	}()
+	return upstream
+}
+
+func TestRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := startUppercaseUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{},
+		TunnelOptions{Settings: TunnelSettings{RecordDir: dir}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, s := range []string{"hello", "world"} {
+		client.Write([]byte(s))
+		reply := make([]byte, len(s))
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatalf("Failed to receive reply: %v", err)
+		}
+	}
+	client.Close()
+	for len(tunnel.Connections()) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var recording *Recording
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.rec"))
+		if len(files) == 1 {
+			data, _ := ioutil.ReadFile(files[0])
+			if recording, err = ReadRecording(bytes.NewReader(data)); err == nil &&
+				len(recording.Chunks) == 4 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if recording == nil || len(recording.Chunks) != 4 {
+		t.Fatalf("Expected recording with 4 chunks, got %+v, %v", recording, err)
+	}
+	if string(recording.Sent(RecordedClient)) != "helloworld" ||
+		string(recording.Sent(RecordedUpstream)) != "HELLOWORLD" {
+		t.Errorf("Unexpected recorded data: %+v", recording.Chunks)
+	}
+	if recording.Header.Upstream != upstream.Addr().String() {
+		t.Errorf("Expected upstream %q to be recorded, got %q", upstream.Addr(),
+			recording.Header.Upstream)
+	}
+
+	conn, err := net.Dial("tcp", upstream.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	result, err := recording.Replay(conn, ReplayOptions{Timeout: 200 * time.Millisecond})
+	if err != nil || !result.Matches {
+		t.Errorf("Expected replayed response to match, got %q, %v", result.Received, err)
+	}
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"sort"
+	"sync"
+)
+
+// registryShards is the number of shards active connections of a tunnel are
+// spread across
+const registryShards = 16
+
+// connectionRegistry holds active connections of a tunnel. Connections are
+// added and removed on the tunnel goroutine only, while other goroutines
+// (stats and admin API) read them concurrently. Connections are spread across
+// shards by their IDs, so that readers contend for a lock with neither each
+// other nor the tunnel goroutine handling connections of other shards.
+type connectionRegistry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mu          *sync.RWMutex
+	connections map[*Connection]struct{}
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	result := new(connectionRegistry)
+	for i := range result.shards {
+		result.shards[i] = registryShard{
+			mu:          new(sync.RWMutex),
+			connections: make(map[*Connection]struct{}),
+		}
+	}
+	return result
+}
+
+func (r *connectionRegistry) shard(id uint64) *registryShard {
+	return &r.shards[id%registryShards]
+}
+
+// add registers an active connection
+func (r *connectionRegistry) add(conn *Connection) {
+	s := r.shard(conn.ID())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connections[conn] = struct{}{}
+}
+
+// remove forgets a connection. Returns false if it wasn't registered.
+func (r *connectionRegistry) remove(conn *Connection) bool {
+	s := r.shard(conn.ID())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.connections[conn]; !ok {
+		return false
+	}
+	delete(s.connections, conn)
+	return true
+}
+
+// find returns a registered connection with a given ID (nil if there is none)
+func (r *connectionRegistry) find(id uint64) *Connection {
+	s := r.shard(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for conn := range s.connections {
+		if conn.ID() == id {
+			return conn
+		}
+	}
+	return nil
+}
+
+// len returns the number of registered connections
+func (r *connectionRegistry) len() int {
+	result := 0
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.RLock()
+		result += len(s.connections)
+		s.mu.RUnlock()
+	}
+	return result
+}
+
+// all returns registered connections sorted by ID
+func (r *connectionRegistry) all() []*Connection {
+	var result []*Connection
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.RLock()
+		for conn := range s.connections {
+			result = append(result, conn)
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID() < result[j].ID()
+	})
+	return result
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConnectionRegistry(t *testing.T) {
+	r := newConnectionRegistry()
+	var connections []*Connection
+	for i := 0; i < 100; i++ {
+		conn := &Connection{id: uint64(100 - i)}
+		connections = append(connections, conn)
+		r.add(conn)
+	}
+
+	// Readers don't need the owner to list connections
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.all()
+				r.find(uint64(j))
+			}
+		}()
+	}
+	for _, conn := range connections[:50] {
+		if !r.remove(conn) {
+			t.Errorf("Expected connection %d to be removed", conn.ID())
+		}
+	}
+	wg.Wait()
+
+	if r.remove(connections[0]) {
+		t.Errorf("Expected removed connection to be gone")
+	}
+	if n := r.len(); n != 50 {
+		t.Errorf("Expected 50 connections, got %d", n)
+	}
+	all := r.all()
+	for i, conn := range all {
+		if conn.ID() != uint64(i+1) {
+			t.Fatalf("Expected connections sorted by ID, got %d at %d", conn.ID(), i)
+		}
+	}
+	if conn := r.find(42); conn == nil || conn.ID() != 42 {
+		t.Errorf("Expected to find connection 42, got %v", conn)
+	}
+	if conn := r.find(77); conn != nil {
+		t.Errorf("Expected removed connection not to be found")
+	}
+}
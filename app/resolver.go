@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Resolver looks up IP addresses of upstream hosts, e.g. in a service
+// discovery system or split-horizon DNS. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+// Resolvers is a set of named resolvers tunnels pick from by
+// TunnelSettings.Resolver. Safe for concurrent use.
+type Resolvers struct {
+	mu        *sync.Mutex
+	resolvers map[string]Resolver
+}
+
+// NewResolvers creates an empty set of resolvers
+func NewResolvers() *Resolvers {
+	return &Resolvers{
+		mu:        new(sync.Mutex),
+		resolvers: make(map[string]Resolver),
+	}
+}
+
+// Set registers a resolver by a name, replacing the one registered by it
+// before. Nil resolver removes it. New connections of tunnels pick it up.
+func (r *Resolvers) Set(name string, resolver Resolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resolver == nil {
+		delete(r.resolvers, name)
+	} else {
+		r.resolvers[name] = resolver
+	}
+}
+
+// get returns resolver registered by a name, nil for empty name. Resolver
+// that isn't registered fails every lookup, so that connections don't go to
+// whatever system resolver says.
+func (r *Resolvers) get(name string) Resolver {
+	if name == "" {
+		return nil
+	}
+	if r != nil {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if resolver, ok := r.resolvers[name]; ok {
+			return resolver
+		}
+	}
+	return missingResolver(name)
+}
+
+// missingResolver stands for a resolver that isn't registered
+type missingResolver string
+
+func (r missingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
+	error) {
+	return nil, fmt.Errorf("Resolver %q isn't registered", string(r))
+}
+
+// resolve returns upstream addresses connectTo resolves to. IP addresses are
+// returned as is.
+func (c *Connection) resolve(ctx context.Context) ([]string, error) {
+	host, port, err := net.SplitHostPort(string(c.connectTo))
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{string(c.connectTo)}, nil
+	}
+	var resolver Resolver = net.DefaultResolver
+	if c.resolver != nil {
+		resolver = c.resolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No addresses found for %q", host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// dialAddrs dials given addresses in order until one of them connects
+func dialAddrs(ctx context.Context, addrs []string) (net.Conn, error) {
+	var dialer net.Dialer
+	var err error
+	for _, addr := range addrs {
+		var egress net.Conn
+		egress, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return egress, nil
+		}
+	}
+	return nil, err
+}
+
+// SetResolver registers a resolver tunnels setting TunnelSettings.Resolver to a
+// given name look upstream addresses up with. Nil resolver removes it.
+func (m *TunnelManager) SetResolver(name string, resolver Resolver) {
+	m.resolvers.Set(name, resolver)
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// staticResolver resolves every host to loopback address and remembers hosts
+// it was asked for
+type staticResolver struct {
+	mu    *sync.Mutex
+	hosts []string
+}
+
+func (r *staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr,
+	error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, host)
+	return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func TestTunnelResolver(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(upstream.Addr().(*net.TCPAddr).Port)
+
+	resolver := &staticResolver{mu: new(sync.Mutex)}
+	resolvers := NewResolvers()
+	resolvers.Set("discovery", resolver)
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo("db.service.internal:"+port),
+		TunnelLimits{}, TunnelOptions{Resolvers: resolvers,
+			Settings: TunnelSettings{Resolver: "discovery"}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	read := func() string {
+		client, err := net.Dial("tcp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, _ := ioutil.ReadAll(client)
+		return string(data)
+	}
+	if data := read(); data != "hello" {
+		t.Fatalf("Expected upstream to be reached through resolver, got %q", data)
+	}
+	resolver.mu.Lock()
+	if len(resolver.hosts) != 1 || resolver.hosts[0] != "db.service.internal" {
+		t.Errorf("Expected resolver to look upstream up, got %v", resolver.hosts)
+	}
+	resolver.mu.Unlock()
+
+	// Connections of a tunnel naming a resolver that's gone fail to dial
+	resolvers.Set("discovery", nil)
+	if data := read(); data != "" {
+		t.Fatalf("Expected connection to fail without resolver, got %q", data)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Stats().Closed[CloseDialFailure] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected dial failure, got %v", tunnel.Stats().Closed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
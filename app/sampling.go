@@ -0,0 +1,14 @@
+package app
+
+// sampleTelemetry tells whether the next connection accepted by a tunnel gets
+// deep telemetry (e.g. a recording), which is collected for one in
+// TelemetrySampling connections. Must be called on the tunnel goroutine.
+func (t *Tunnel) sampleTelemetry() bool {
+	every := t.settings.TelemetrySampling
+	if every <= 1 {
+		return true
+	}
+	sampled := t.telemetrySeq%every == 0
+	t.telemetrySeq++
+	return sampled
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTelemetrySampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sampling")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{},
+		TunnelOptions{Settings: TunnelSettings{RecordDir: dir, TelemetrySampling: 2}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	for i := 0; i < 4; i++ {
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		files, _ := filepath.Glob(filepath.Join(dir, "*.rec"))
+		if len(connections) == 4 && len(files) == 2 {
+			for i, conn := range connections {
+				if conn.Sampled != (i%2 == 0) {
+					t.Errorf("Expected every other connection to be sampled, got %+v",
+						connections)
+					break
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 of 4 connections to be recorded, got %d recordings",
+				len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := (TunnelSettings{TelemetrySampling: -1}).validate(); err == nil {
+		t.Errorf("Expected negative sampling to be rejected")
+	}
+}
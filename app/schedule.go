@@ -0,0 +1,134 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// ScheduleRule makes a tunnel use different limits during a daily time window
+type ScheduleRule struct {
+	// Start and end of the window in local time ("HH:MM"). Window ends the
+	// next day if end is not after start, equal times stand for a whole day.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Days of week window starts on ("Mon", "Tue", ...). Every day if empty.
+	Days []string `json:"days,omitempty"`
+	// Limits in effect during the window instead of tunnel's own ones
+	Limits TunnelLimits `json:"limits"`
+}
+
+// Schedule is a list of rules switching tunnel limits by wall-clock time. The
+// first rule whose window includes current time wins, outside of all windows
+// tunnel has its own limits.
+type Schedule []ScheduleRule
+
+// parseClock parses time of day given as "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q (expected HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWeekday parses an abbreviated day of week (e.g. "Mon")
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if d.String()[:3] == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid day of week %q (expected Mon, Tue, ...)", s)
+}
+
+// window returns the time window of a rule
+func (r ScheduleRule) window() ActiveWindow {
+	return ActiveWindow{From: r.From, To: r.To, Days: r.Days}
+}
+
+func (r ScheduleRule) validate() error {
+	if err := r.window().validate(); err != nil {
+		return err
+	}
+	return r.Limits.validate()
+}
+
+// active tells whether a given time falls within rule window. Rule is
+// expected to be valid.
+func (r ScheduleRule) active(now time.Time) bool {
+	return r.window().includes(now)
+}
+
+func (s Schedule) validate() error {
+	for i, r := range s {
+		if err := r.validate(); err != nil {
+			return withContext(err, "Schedule rule %d", i+1)
+		}
+	}
+	return nil
+}
+
+// limits returns limits in effect at a given time for a tunnel with given
+// limits of its own
+func (s Schedule) limits(now time.Time, own TunnelLimits) TunnelLimits {
+	for _, r := range s {
+		if r.active(now) {
+			return r.Limits
+		}
+	}
+	return own
+}
+
+// equal tells whether two schedules are the same
+func (s Schedule) equal(other Schedule) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for i := range s {
+		if s[i].From != other[i].From || s[i].To != other[i].To ||
+			!sameStrings(s[i].Days, other[i].Days) || s[i].Limits != other[i].Limits {
+			return false
+		}
+	}
+	return true
+}
+
+// untilNextMinute returns time left till the start of the next minute, when
+// schedules could switch limits
+func untilNextMinute(now time.Time) time.Duration {
+	return now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+}
+
+// applyLimits makes a tunnel run with its own limits or the ones its schedule
+// sets at the moment. Returns false if limits didn't change. Must be called on
+// the manager goroutine.
+func (m *TunnelManager) applyLimits(t *dispatchTunnel) bool {
+	limits := t.schedule.limits(time.Now(), t.lastLimits)
+	if limits == t.appliedLimits {
+		return false
+	}
+	t.tunnel.UpdateLimits(limits)
+	t.appliedLimits = limits
+	return true
+}
+
+// applySchedules switches limits of tunnels having schedules and suspends or
+// resumes tunnels having active windows. Must be called on the manager
+// goroutine.
+func (m *TunnelManager) applySchedules() {
+	for k, t := range m.tunnels {
+		changed := false
+		if len(t.schedule) > 0 && m.applyLimits(t) {
+			log.Printf("Tunnel at %q switched to scheduled limits: %v", k.listenAt,
+				t.appliedLimits)
+			changed = true
+		}
+		if m.applyWindows(t) {
+			changed = true
+		}
+		if changed {
+			m.publishTunnelEvent(EventTunnelUpdated, k, t)
+		}
+	}
+}
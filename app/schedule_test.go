@@ -0,0 +1,107 @@
+package app
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduleRuleActive(t *testing.T) {
+	// 2021-03-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 3, day, hour, minute, 0, 0, time.Local)
+	}
+	cases := []struct {
+		rule   ScheduleRule
+		now    time.Time
+		active bool
+	}{
+		{ScheduleRule{From: "09:00", To: "18:00"}, at(1, 9, 0), true},
+		{ScheduleRule{From: "09:00", To: "18:00"}, at(1, 17, 59), true},
+		{ScheduleRule{From: "09:00", To: "18:00"}, at(1, 18, 0), false},
+		{ScheduleRule{From: "09:00", To: "18:00"}, at(1, 8, 59), false},
+		{ScheduleRule{From: "18:00", To: "09:00"}, at(1, 23, 0), true},
+		{ScheduleRule{From: "18:00", To: "09:00"}, at(2, 3, 0), true},
+		{ScheduleRule{From: "18:00", To: "09:00"}, at(2, 12, 0), false},
+		{ScheduleRule{From: "00:00", To: "00:00"}, at(2, 12, 0), true},
+		{ScheduleRule{From: "09:00", To: "18:00", Days: []string{"Mon"}}, at(1, 12, 0), true},
+		{ScheduleRule{From: "09:00", To: "18:00", Days: []string{"Mon"}}, at(2, 12, 0), false},
+		// Overnight window belongs to the day it starts on
+		{ScheduleRule{From: "18:00", To: "09:00", Days: []string{"Mon"}}, at(2, 3, 0), true},
+		{ScheduleRule{From: "18:00", To: "09:00", Days: []string{"Mon"}}, at(1, 3, 0), false},
+	}
+	for _, c := range cases {
+		if active := c.rule.active(c.now); active != c.active {
+			t.Errorf("%v at %v: expected active to be %v", c.rule, c.now, c.active)
+		}
+	}
+
+	invalid := []ScheduleRule{
+		{From: "9am", To: "18:00"},
+		{From: "09:00", To: "24:00"},
+		{From: "09:00", To: "18:00", Days: []string{"Monday"}},
+		{From: "09:00", To: "18:00", Limits: TunnelLimits{TunnelLimit: -2}},
+	}
+	for _, r := range invalid {
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected %v to be rejected", r)
+		}
+	}
+}
+
+func TestApplySchedule(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	manager := newTunnelManager(make(chan ConfigurationJSON), persistence, gs)
+	manager.start()
+
+	allDay := Schedule{
+		{From: "00:00", To: "00:00", Limits: TunnelLimits{TunnelLimit: 1000}},
+	}
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1", Schedule: allDay},
+	}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	tunnels := manager.ListTunnels()
+	if len(tunnels) != 1 || tunnels[0].ScheduledLimits == nil ||
+		tunnels[0].ScheduledLimits.TunnelLimit != 1000 || tunnels[0].Limits.TunnelLimit != 0 {
+		t.Fatalf("Expected tunnel to run with scheduled limits, got %v", tunnels)
+	}
+
+	// Scheduled limits take precedence over limits set at runtime
+	if err := manager.UpdateTunnelLimits("127.0.0.1:0",
+		TunnelLimits{TunnelLimit: 2000}); err != nil {
+		t.Fatalf("Failed to update limits: %v", err)
+	}
+	if tunnels = manager.ListTunnels(); tunnels[0].ScheduledLimits == nil ||
+		tunnels[0].ScheduledLimits.TunnelLimit != 1000 {
+		t.Errorf("Expected tunnel to keep running with scheduled limits, got %v", tunnels)
+	}
+
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1"},
+	}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	if tunnels = manager.ListTunnels(); tunnels[0].ScheduledLimits != nil {
+		t.Errorf("Expected tunnel to run with its own limits, got %v", tunnels)
+	}
+
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1",
+			Schedule: Schedule{{From: "09:00", To: "25:00"}}},
+	}); err == nil {
+		t.Errorf("Expected invalid schedule to be rejected")
+	}
+}
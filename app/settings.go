@@ -0,0 +1,73 @@
+package app
+
+import "errors"
+
+// TunnelSettings are operational settings of a tunnel. Unlike TunnelLimits,
+// they aren't taken from profiles, so every tunnel has settings of its own.
+type TunnelSettings struct {
+	// Directory to record data forwarded by every connection into (see
+	// ReadRecording). Recording is disabled if empty.
+	RecordDir string `json:"recordDir,omitempty"`
+	// Deep telemetry (connection recordings) is only collected for one in
+	// this many connections, for every connection if zero
+	TelemetrySampling int `json:"telemetrySampling,omitempty"`
+	// Least severe tunnel messages that are logged (LogInfo if empty)
+	LogLevel LogLevel `json:"logLevel,omitempty"`
+	// If set, clients (e.g. load balancers) must start connections with a
+	// PROXY protocol header telling original source and, in version 2, server
+	// name and client certificate identity (see MatchRule). Header isn't
+	// forwarded to upstream.
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+	// If set, server name clients ask for in TLS handshakes is read from
+	// their ClientHello (see MatchRule). Handshake is forwarded as is.
+	InspectTLS bool `json:"inspectTLS,omitempty"`
+	// If set, clients could ask tunnel to run a bandwidth test with a
+	// preamble (see TestPreambleMagic) instead of connecting to upstream
+	BandwidthTest bool `json:"bandwidthTest,omitempty"`
+	// Data sent to upstream right after connecting to it and to client once
+	// upstream is connected, before any forwarded data (e.g. a header
+	// upstream expects). Placeholders {clientIP}, {clientPort}, {localIP} and
+	// {localPort} are replaced with connection addresses. Upstream
+	// connections aren't reused if upstream greeting is set.
+	UpstreamGreeting string `json:"upstreamGreeting,omitempty"`
+	ClientGreeting   string `json:"clientGreeting,omitempty"`
+	// How upstream address is chosen among the ones connectTo resolves to:
+	// BalanceDefault or BalanceSourceIP
+	Balance string `json:"balance,omitempty"`
+	// Name of a resolver registered by embedding application that looks up
+	// connectTo instead of the system one (see Resolvers). Not used if
+	// upstream is dialed through hops.
+	Resolver string `json:"resolver,omitempty"`
+	// Number of failed attempts to listen again after losing listening socket
+	// that tunnel publishes EventListenRetriesExhausted after
+	// (DefaultListenRetries if zero). Tunnel keeps retrying after that.
+	ListenRetries int `json:"listenRetries,omitempty"`
+}
+
+// validate checks settings for errors
+func (s TunnelSettings) validate() error {
+	if s.TelemetrySampling < 0 {
+		return errors.New("Telemetry sampling must not be negative")
+	}
+	if s.ListenRetries < 0 {
+		return errors.New("Listen retries must not be negative")
+	}
+	if err := s.validateBalance(); err != nil {
+		return err
+	}
+	return s.LogLevel.validate()
+}
+
+// UpdateSettings changes settings of a tunnel. Connections accepted
+// afterwards follow new settings.
+func (t *Tunnel) UpdateSettings(settings TunnelSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	select {
+	case t.updateSettings <- settings:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
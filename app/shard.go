@@ -0,0 +1,86 @@
+package app
+
+import (
+	"runtime"
+)
+
+// completionShardBuffer is the number of completions a shard holds before
+// connections ending have to wait for the tunnel goroutine
+const completionShardBuffer = 64
+
+// completionShards collects completions of connections in shards (one per CPU
+// by default) and delivers them to the tunnel goroutine in batches, so that
+// connections ending at once on different cores don't contend for a single
+// channel and the tunnel goroutine wakes up once for many of them
+type completionShards struct {
+	shards  []chan connectionComplete
+	batches chan []connectionComplete
+	// Closed once tunnel goroutine stops receiving completions
+	done chan struct{}
+}
+
+// newCompletionShards starts a given number of shards. Zero stands for
+// GOMAXPROCS.
+func newCompletionShards(n int) *completionShards {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	result := &completionShards{
+		shards: make([]chan connectionComplete, n),
+		// Every shard could have a batch ready without waiting for the tunnel
+		// goroutine to take the previous one
+		batches: make(chan []connectionComplete, n),
+		done:    make(chan struct{}),
+	}
+	for i := range result.shards {
+		result.shards[i] = make(chan connectionComplete, completionShardBuffer)
+		go result.collect(result.shards[i])
+	}
+	return result
+}
+
+// collect passes completions of a shard on in batches of whatever piled up
+// while the previous batch was being delivered
+func (s *completionShards) collect(shard chan connectionComplete) {
+	for {
+		var batch []connectionComplete
+		select {
+		case c := <-shard:
+			batch = append(batch, c)
+		case <-s.done:
+			return
+		}
+	drain:
+		for len(batch) < completionShardBuffer {
+			select {
+			case c := <-shard:
+				batch = append(batch, c)
+			default:
+				break drain
+			}
+		}
+		select {
+		case s.batches <- batch:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// complete hands a completion over to the shard of its connection. Returns
+// false if shards were stopped.
+func (s *completionShards) complete(c connectionComplete) bool {
+	shard := s.shards[c.connection.ID()%uint64(len(s.shards))]
+	select {
+	case shard <- c:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// stop makes shards drop completions. Must be called once tunnel goroutine
+// no longer receives them.
+func (s *completionShards) stop() {
+	close(s.done)
+}
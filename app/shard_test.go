@@ -0,0 +1,152 @@
+package app
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompletionShards(t *testing.T) {
+	shards := newCompletionShards(4)
+	const n = 1000
+	go func() {
+		for i := 0; i < n; i++ {
+			shards.complete(connectionComplete{connection: &Connection{id: uint64(i)}})
+		}
+	}()
+	seen := make(map[uint64]bool)
+	for len(seen) < n {
+		select {
+		case batch := <-shards.batches:
+			for _, c := range batch {
+				if seen[c.connection.ID()] {
+					t.Fatalf("Connection %d completed twice", c.connection.ID())
+				}
+				seen[c.connection.ID()] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d completions, got %d", n, len(seen))
+		}
+	}
+
+	shards.stop()
+	for i := 0; i < completionShardBuffer+1; i++ {
+		if shards.complete(connectionComplete{connection: &Connection{id: 0}}) {
+			continue
+		}
+		return
+	}
+	t.Errorf("Expected stopped shards not to block connections")
+}
+
+func TestCompletionShardsBatching(t *testing.T) {
+	shards := newCompletionShards(2)
+	defer shards.stop()
+	const n = 10000
+	for i := 0; i < 10; i++ {
+		go func(first int) {
+			for id := first; id < n; id += 10 {
+				shards.complete(connectionComplete{connection: &Connection{id: uint64(id)}})
+			}
+		}(i)
+	}
+	// Tunnel goroutine busy with other work gets completions piled up while it
+	// was away in a few batches instead of one at a time
+	received, batches := 0, 0
+	for received < n {
+		select {
+		case batch := <-shards.batches:
+			received += len(batch)
+			batches++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d completions, got %d", n, received)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if batches > n/10 {
+		t.Errorf("Expected completions to be batched, got %d batches", batches)
+	}
+}
+
+func TestConnectionChurn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Connection churn takes a while")
+	}
+	// Upstream resets connections right away, so that neither side is left
+	// with sockets in TIME_WAIT
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{MaxDials: 256}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	// Logging every connection would take longer than handling it
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const n = 10000
+	const clients = 64
+	// Connections per second tunnel must handle at least. It handles a few
+	// thousands on a laptop, the floor leaves room for loaded CI machines.
+	const minRate = 500
+	address := tunnel.Addr().String()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n/clients; j++ {
+				conn, err := net.Dial("tcp", address)
+				if err != nil {
+					t.Errorf("Failed to connect: %v", err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				ioutil.ReadAll(conn)
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	total := n / clients * clients
+	select {
+	case <-tunnel.idle():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected tunnel to close all connections, %d are active",
+			len(tunnel.Connections()))
+	}
+	elapsed := time.Since(start)
+	var closed int64
+	for _, count := range tunnel.Stats().Closed {
+		closed += count
+	}
+	if closed != int64(total) {
+		t.Errorf("Expected %d connections to be closed, got %d", total, closed)
+	}
+	rate := float64(total) / elapsed.Seconds()
+	t.Logf("%d connections in %v (%.0f per second)", total, elapsed, rate)
+	if rate < minRate {
+		t.Errorf("Expected at least %d connections per second, got %.0f", minRate, rate)
+	}
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// forceCloseGrace is how long forwarders are given to stop once shutdown is
+// forced before they are given up on
+const forceCloseGrace = time.Second
+
+// deadliner is a listener whose Accept could be interrupted with a deadline
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// stopAccepting makes Accept of tunnel listener return an error without
+// closing listening socket. Closes it if listener doesn't support deadlines.
+func (t *Tunnel) stopAccepting() {
+	if l, ok := t.listener.Inner().(deadliner); ok {
+		if err := l.SetDeadline(time.Unix(1, 0)); err == nil {
+			return
+		}
+	}
+	t.listener.Close()
+}
+
+// closeConnections closes connections of a tunnel that stops serving and
+// waits for forwarders of active ones to stop
+func (t *Tunnel) closeConnections(activeConnections *connectionRegistry,
+	waiting []*Connection, dials *dialScheduler) {
+	active := activeConnections.all()
+	for _, conn := range active {
+		activeConnections.remove(conn)
+		conn.Close()
+		t.connectionClosed(conn, CloseTunnelShutdown, loadCounters(&conn.counters), nil)
+	}
+	for _, conn := range waiting {
+		conn.Close()
+		t.countClose(CloseTunnelShutdown)
+		t.notifyClosed(conn, CloseTunnelShutdown, TunnelCounters{}, nil)
+	}
+	for _, conn := range dials.stop() {
+		t.countClose(CloseTunnelShutdown)
+		t.notifyClosed(conn, CloseTunnelShutdown, TunnelCounters{}, nil)
+	}
+	for _, conn := range t.dedup.stop() {
+		conn.Close()
+		t.countClose(CloseTunnelShutdown)
+		t.notifyClosed(conn, CloseTunnelShutdown, TunnelCounters{}, nil)
+	}
+	t.stopForwarders(active)
+}
+
+// stopForwarders waits for forwarders of closed connections to stop. Once
+// shutdown is forced (see ShutdownContext), connections whose forwarders are
+// still running are closed forcibly (all of them if it was forced before they
+// were closed) and the ones whose forwarders don't stop within forceCloseGrace
+// are given up on.
+func (t *Tunnel) stopForwarders(conns []*Connection) {
+	stopped := make([]chan struct{}, len(conns))
+	for i, conn := range conns {
+		stopped[i] = make(chan struct{})
+		go func(conn *Connection, stopped chan struct{}) {
+			conn.forwarding.Wait()
+			close(stopped)
+		}(conn, stopped[i])
+	}
+	force := t.force
+	var grace <-chan time.Time
+	forceClose := func(from int, all bool) {
+		force = nil
+		grace = time.After(forceCloseGrace)
+		forced := 0
+		for i := from; i < len(conns); i++ {
+			select {
+			case <-stopped[i]:
+				if !all {
+					continue
+				}
+			default:
+			}
+			conns[i].forceClose()
+			forced++
+		}
+		t.shutdownMu.Lock()
+		t.forced += forced
+		t.shutdownMu.Unlock()
+	}
+	select {
+	case <-force:
+		// Context expired before connections were closed, none of them had a
+		// chance to stop cleanly
+		forceClose(0, true)
+	default:
+	}
+	for i := 0; i < len(conns); {
+		select {
+		case <-stopped[i]:
+			i++
+		case <-force:
+			forceClose(i, false)
+		case <-grace:
+			var stuck []uint64
+			for j := i; j < len(conns); j++ {
+				select {
+				case <-stopped[j]:
+				default:
+					stuck = append(stuck, conns[j].ID())
+					t.logf(LogError, "Forwarders of connection %d at %q didn't stop",
+						conns[j].ID(), t.listenAt)
+				}
+			}
+			t.shutdownMu.Lock()
+			t.stuck = append(t.stuck, stuck...)
+			t.shutdownMu.Unlock()
+			return
+		}
+	}
+}
+
+// forceClose resets and closes sockets underlying a connection whose
+// forwarders closing it didn't stop (e.g. a wrapper ignoring deadlines)
+func (c *Connection) forceClose() {
+	for _, conn := range []net.Conn{c.ingress, c.egress} {
+		if conn == nil {
+			continue
+		}
+		resetOnClose(conn)
+		rawConn(conn).Close()
+	}
+}
+
+// ShutdownError describes what failed to stop cleanly when a tunnel was shut
+// down with ShutdownContext
+type ShutdownError struct {
+	ListenAt ListenAt
+	// Number of connections closed forcibly since they were still active or
+	// their forwarders didn't stop when context expired
+	Forced int
+	// IDs of connections whose forwarders didn't stop even after that
+	Stuck []uint64
+	// Whether tunnel goroutine didn't stop (e.g. it's blocked in a hook)
+	Abandoned bool
+}
+
+func (e *ShutdownError) Error() string {
+	var failures []string
+	if e.Forced > 0 {
+		failures = append(failures, fmt.Sprintf("%d connections closed forcibly", e.Forced))
+	}
+	if len(e.Stuck) > 0 {
+		ids := make([]string, len(e.Stuck))
+		for i, id := range e.Stuck {
+			ids[i] = fmt.Sprint(id)
+		}
+		failures = append(failures, fmt.Sprintf("forwarders of connections %s didn't stop",
+			strings.Join(ids, ", ")))
+	}
+	if e.Abandoned {
+		failures = append(failures, "tunnel goroutine didn't stop")
+	}
+	return fmt.Sprintf("Tunnel %q didn't shut down cleanly: %s", e.ListenAt,
+		strings.Join(failures, "; "))
+}
+
+// shutdownError returns what failed to stop cleanly during shutdown (nil if
+// everything did)
+func (t *Tunnel) shutdownError(abandoned bool) error {
+	t.shutdownMu.Lock()
+	defer t.shutdownMu.Unlock()
+	if t.forced == 0 && len(t.stuck) == 0 && !abandoned {
+		return nil
+	}
+	return &ShutdownError{
+		ListenAt:  t.listenAt,
+		Forced:    t.forced,
+		Stuck:     append([]uint64(nil), t.stuck...),
+		Abandoned: abandoned,
+	}
+}
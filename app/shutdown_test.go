@@ -0,0 +1,44 @@
+package app
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	var addr string
+	// Whether clients could still connect while OnClose is notified
+	listening := make(chan bool, 1)
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{
+		OnClose: func(ctx context.Context, c ClosedConnection) {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			listening <- err == nil
+		},
+	})
+	defer client.Close()
+	addr = tunnel.listener.Addr().String()
+
+	tunnel.Shutdown()
+	select {
+	case v := <-listening:
+		if !v {
+			t.Errorf("Expected listener to stay open while connections are closed")
+		}
+	default:
+		t.Fatalf("Expected OnClose to be called before Shutdown returns")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Expected listener to be closed once Shutdown returns")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected client connection to be closed")
+	}
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileSinkJSON appends usage records to local files
+type FileSinkJSON struct {
+	// Template of file paths (see exportPlaceholders), e.g.
+	// "/var/log/throttle/usage-{date}.jsonl". Missing directories are
+	// created.
+	Path string `json:"path"`
+}
+
+func (s *FileSinkJSON) validate() error {
+	if s.Path == "" {
+		return errors.New("File sink path must be specified")
+	}
+	return validateTemplate(s.Path)
+}
+
+func (s *FileSinkJSON) template() string {
+	return s.Path
+}
+
+func (s *FileSinkJSON) write(ctx context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HTTPSinkJSON POSTs usage records to a URL, one request per part
+type HTTPSinkJSON struct {
+	URL string `json:"url"`
+	// If set, requests carry HMAC-SHA256 of their body keyed with it in
+	// WebhookSignatureHeader
+	Secret string `json:"secret,omitempty"`
+}
+
+func (s *HTTPSinkJSON) validate() error {
+	return WebhookConfigJSON{URL: s.URL}.validate()
+}
+
+// httpSink is an HTTP sink along with the client it makes requests with
+type httpSink struct {
+	config HTTPSinkJSON
+	client *http.Client
+}
+
+// template of an HTTP sink has no placeholders, so that all records of a
+// rotation period are sent at once
+func (s *httpSink) template() string {
+	return ""
+}
+
+func (s *httpSink) write(ctx context.Context, name string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader,
+			WebhookConfigJSON{Secret: s.config.Secret}.sign(data))
+	}
+	return doRequest(s.client, req)
+}
+
+// S3SinkJSON uploads usage records to S3-compatible object storage, one
+// object per part
+type S3SinkJSON struct {
+	// Base URL of the storage, e.g. "https://s3.eu-west-1.amazonaws.com".
+	// Objects are addressed path-style (endpoint/bucket/key).
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// Template of object keys (DefaultS3Key if empty). Must include {time},
+	// so that parts don't overwrite each other.
+	Key       string `json:"key,omitempty"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// DefaultS3Key is the template of object keys unless configured otherwise
+const DefaultS3Key = "{node}/{date}/{time}.jsonl"
+
+func (s *S3SinkJSON) validate() error {
+	if err := (WebhookConfigJSON{URL: s.Endpoint}).validate(); err != nil {
+		return fmt.Errorf("Invalid S3 endpoint: %v", err)
+	}
+	if s.Region == "" || s.Bucket == "" {
+		return errors.New("S3 region and bucket must be specified")
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return errors.New("S3 access and secret keys must be specified")
+	}
+	if err := validateTemplate(s.key()); err != nil {
+		return err
+	}
+	if !strings.Contains(s.key(), "{time}") {
+		return fmt.Errorf("S3 key %q must include {time}", s.Key)
+	}
+	return nil
+}
+
+func (s *S3SinkJSON) key() string {
+	if s.Key == "" {
+		return DefaultS3Key
+	}
+	return s.Key
+}
+
+// s3Sink is an S3 sink along with the client it makes requests with
+type s3Sink struct {
+	config S3SinkJSON
+	client *http.Client
+}
+
+func (s *s3Sink) template() string {
+	return s.config.key()
+}
+
+// write PUTs an object signed with AWS Signature Version 4
+func (s *s3Sink) write(ctx context.Context, name string, data []byte) error {
+	u, err := url.Parse(strings.TrimRight(s.config.Endpoint, "/"))
+	if err != nil {
+		return err
+	}
+	u.Path += "/" + s.config.Bucket + "/" + name
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	s.config.sign(req, data, time.Now())
+	return doRequest(s.client, req)
+}
+
+// sign adds AWS Signature Version 4 headers to a request
+func (s *S3SinkJSON) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(canonicalHash[:])
+	signature := hex.EncodeToString(
+		hmacSHA256(signingKey(s.SecretKey, date, s.Region, "s3"), toSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// signingKey derives AWS Signature Version 4 signing key
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape encodes a path the way S3 expects it in canonical requests:
+// everything but unreserved characters and slashes is percent-encoded
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// doRequest makes a request failing on non-2xx responses
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Server responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// State is the part of application runtime state that survives restarts. It is
+// periodically saved to a state file and loaded back upon startup.
+type State struct {
+	// Admin API and tenants configuration in effect when state was saved
+	Admin    AdminConfigJSON             `json:"admin"`
+	Tenants  map[string]TenantConfigJSON `json:"tenants,omitempty"`
+	Profiles map[string]TunnelLimits     `json:"profiles,omitempty"`
+	// Identity groups configuration in effect when state was saved
+	IdentityGroups map[string]IdentityGroupConfigJSON `json:"identityGroups,omitempty"`
+	WorkerPools    map[string]WorkerPoolConfigJSON    `json:"workerPools,omitempty"`
+	Webhooks       map[string]WebhookConfigJSON       `json:"webhooks,omitempty"`
+	Exports        map[string]ExportConfigJSON        `json:"exports,omitempty"`
+	Registries     map[string]RegistryConfigJSON      `json:"registries,omitempty"`
+	Tunnels        map[ListenAt]TunnelState           `json:"tunnels"`
+	// DNS tunnels running when state was saved
+	DNS map[ListenAt]DNSConfigJSON `json:"dns,omitempty"`
+	// Global limit in effect when state was saved
+	GlobalLimit Limit `json:"globalLimit,omitempty"`
+	// Configured port ranges of on-demand tunnels
+	OnDemand map[ListenAt]TunnelConfigJSON `json:"onDemand,omitempty"`
+}
+
+// TunnelState is the persistent state of an individual tunnel
+type TunnelState struct {
+	// Tunnel definition and limits in effect when state was saved. Nil for
+	// tunnels that were not running at that moment.
+	Config   *TunnelConfigJSON `json:"config,omitempty"`
+	Counters TunnelCounters    `json:"counters"`
+	// Transfer quota usage of tunnels having a quota
+	Quota *QuotaUsage `json:"quota,omitempty"`
+}
+
+// statePersistence keeps track of where and how often state should be saved
+// and of state loaded on startup that haven't yet been claimed by tunnels.
+type statePersistence struct {
+	path     string
+	interval time.Duration
+	// Counters of tunnels that are not running at the moment. These include
+	// counters loaded from the state file until a tunnel with the same
+	// listening specification starts, as well as counters of tunnels that were
+	// shut down because of configuration change.
+	retired map[ListenAt]TunnelCounters
+	// Quota usage of tunnels that are not running at the moment, kept the same
+	// way as their counters
+	retiredQuotas map[ListenAt]QuotaUsage
+	// Tunnels that were running and tenants that were configured when state
+	// was saved by a previous run
+	restored           map[ListenAt]TunnelConfigJSON
+	restoredTenants    map[string]TenantConfigJSON
+	restoredProfiles   map[string]TunnelLimits
+	restoredGroups     map[string]IdentityGroupConfigJSON
+	restoredPools      map[string]WorkerPoolConfigJSON
+	restoredWebhooks   map[string]WebhookConfigJSON
+	restoredExports    map[string]ExportConfigJSON
+	restoredRegistries map[string]RegistryConfigJSON
+	restoredDNS        map[ListenAt]DNSConfigJSON
+	restoredAdmin      AdminConfigJSON
+	restoredGlobal     Limit
+	restoredOnDemand   map[ListenAt]TunnelConfigJSON
+}
+
+// newStatePersistence loads state from a given path and returns a
+// statePersistence that saves it back there. Missing state file is not an
+// error. If path is empty, persistence is disabled.
+func newStatePersistence(path string, interval time.Duration) (*statePersistence, error) {
+	result := &statePersistence{
+		path:     path,
+		interval: interval,
+		retired:  make(map[ListenAt]TunnelCounters),
+		restored: make(map[ListenAt]TunnelConfigJSON),
+
+		retiredQuotas: make(map[ListenAt]QuotaUsage),
+	}
+	if path == "" {
+		return result, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("State saving interval must be positive (%v)", interval)
+	}
+
+	state, err := loadState(path)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range state.Tunnels {
+		result.retired[k] = v.Counters
+		if v.Quota != nil {
+			result.retiredQuotas[k] = *v.Quota
+		}
+		if v.Config != nil {
+			result.restored[k] = *v.Config
+		}
+	}
+	result.restoredTenants = state.Tenants
+	result.restoredProfiles = state.Profiles
+	result.restoredGroups = state.IdentityGroups
+	result.restoredPools = state.WorkerPools
+	result.restoredWebhooks = state.Webhooks
+	result.restoredExports = state.Exports
+	result.restoredRegistries = state.Registries
+	result.restoredDNS = state.DNS
+	result.restoredAdmin = state.Admin
+	result.restoredGlobal = state.GlobalLimit
+	result.restoredOnDemand = state.OnDemand
+
+	return result, nil
+}
+
+// enabled returns true if state should be saved at all
+func (p *statePersistence) enabled() bool {
+	return p.path != ""
+}
+
+// restoredConfiguration returns configuration made of tunnels that were
+// running when state was saved. Returns false if there were none.
+func (p *statePersistence) restoredConfiguration() (ConfigurationJSON, bool) {
+	if len(p.restored) == 0 && len(p.restoredOnDemand) == 0 {
+		return ConfigurationJSON{}, false
+	}
+	result := ConfigurationJSON{
+		Version:  CurrentConfigVersion,
+		Admin:    p.restoredAdmin,
+		Tenants:  p.restoredTenants,
+		Profiles: p.restoredProfiles,
+		Tunnels:  make(map[ListenAt]TunnelConfigJSON),
+
+		IdentityGroups: p.restoredGroups,
+		WorkerPools:    p.restoredPools,
+		Webhooks:       p.restoredWebhooks,
+		Exports:        p.restoredExports,
+		Registries:     p.restoredRegistries,
+		DNS:            p.restoredDNS,
+		GlobalLimit:    p.restoredGlobal,
+		OnDemand:       p.restoredOnDemand,
+	}
+	for k, v := range p.restored {
+		result.Tunnels[k] = v
+	}
+	return result, true
+}
+
+// claim returns counters previously accounted for a tunnel listening at a given
+// spec and forgets about them (since from now on they are going to be tracked
+// by a running tunnel).
+func (p *statePersistence) claim(listenAt ListenAt) TunnelCounters {
+	result := p.retired[listenAt]
+	delete(p.retired, listenAt)
+	return result
+}
+
+// retire remembers counters of a tunnel that is being shut down.
+func (p *statePersistence) retire(listenAt ListenAt, counters TunnelCounters) {
+	p.retired[listenAt] = p.retired[listenAt].Add(counters)
+}
+
+// claimQuota returns quota usage of a tunnel that previously listened at a
+// given spec (nil if there is none) and forgets about it
+func (p *statePersistence) claimQuota(listenAt ListenAt) *QuotaUsage {
+	result, ok := p.retiredQuotas[listenAt]
+	if !ok {
+		return nil
+	}
+	delete(p.retiredQuotas, listenAt)
+	return &result
+}
+
+// retireQuota remembers quota usage of a tunnel that is being shut down (nil
+// if it has no quota)
+func (p *statePersistence) retireQuota(listenAt ListenAt, usage *QuotaUsage) {
+	if usage == nil {
+		delete(p.retiredQuotas, listenAt)
+		return
+	}
+	p.retiredQuotas[listenAt] = *usage
+}
+
+// save writes state combined from retired counters and configuration,
+// definitions, limits and counters of everything a manager runs. Tunnels
+// created on demand or by CreateTunnel only have their counters saved. Must
+// be called on the manager goroutine.
+func (p *statePersistence) save(m *TunnelManager) {
+	if !p.enabled() {
+		return
+	}
+
+	state := State{
+		Admin:    m.admin,
+		Tenants:  make(map[string]TenantConfigJSON),
+		Profiles: m.profiles,
+		Tunnels:  make(map[ListenAt]TunnelState),
+
+		IdentityGroups: m.identityGroups.config(),
+		WorkerPools:    m.workerPools.config(),
+		Webhooks:       m.webhooks.config(),
+		Exports:        m.exports.config(),
+		Registries:     m.registries.config(),
+		GlobalLimit:    m.globalLimit,
+	}
+	for k, v := range m.dns {
+		if state.DNS == nil {
+			state.DNS = make(map[ListenAt]DNSConfigJSON)
+		}
+		state.DNS[k] = v.Config()
+	}
+	for k, v := range m.onDemand {
+		if v.config == nil {
+			continue
+		}
+		if state.OnDemand == nil {
+			state.OnDemand = make(map[ListenAt]TunnelConfigJSON)
+		}
+		state.OnDemand[k] = *v.config
+	}
+	for k, v := range m.tenants {
+		state.Tenants[k] = v.config
+	}
+	for k, v := range p.retired {
+		state.Tunnels[k] = TunnelState{Counters: v}
+	}
+	for k, v := range p.retiredQuotas {
+		ts := state.Tunnels[k]
+		usage := v
+		ts.Quota = &usage
+		state.Tunnels[k] = ts
+	}
+	for k, v := range m.tunnels {
+		ts := state.Tunnels[k.listenAt]
+		stats := v.tunnel.Stats()
+		ts.Counters = ts.Counters.Add(stats.Counters)
+		ts.Quota = stats.Quota
+		if v.onDemand != "" || v.ephemeral {
+			state.Tunnels[k.listenAt] = ts
+			continue
+		}
+		ts.Config = &TunnelConfigJSON{
+			ConnectTo:      k.connectTo,
+			Tenant:         v.tenant,
+			Profile:        v.profile,
+			Exemptions:     v.exemptions,
+			TunnelSettings: v.settings,
+			UpstreamTLS:    v.upstreamTLS,
+			Via:            v.via,
+			Schedule:       v.schedule,
+			Classes:        v.classes,
+			Access:         v.access,
+			Priorities:     v.priorities,
+			Subnets:        v.subnets,
+			Backends:       v.backends,
+			Active:         v.active,
+			Service:        v.service,
+		}
+		if v.profile == "" {
+			ts.Config.TunnelLimits = v.lastLimits
+		}
+		state.Tunnels[k.listenAt] = ts
+	}
+
+	if err := saveState(p.path, state); err != nil {
+		log.Printf("Failed to save state to %q: %v", p.path, err)
+	}
+}
+
+func loadState(path string) (State, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return State{}, nil
+		}
+		log.Printf("Failed to read state file at %q: %v\n", path, err)
+		return State{}, err
+	}
+
+	temp := new(State)
+	if err = json.Unmarshal(contents, temp); err != nil {
+		log.Printf("Failed to parse state file at %q: %v\n", path, err)
+		return State{}, err
+	}
+
+	return *temp, nil
+}
+
+// saveState writes state to a temporary file first and then renames it to
+// a given path so that a crash in the middle of writing never leaves a
+// truncated state file behind.
+func saveState(path string, state State) error {
+	contents, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	// State contains admin API tokens, so it's not for everyone to read
+	if err = ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	p, err := newStatePersistence(path, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to initialize with missing state file: %v", err)
+	}
+	p.retire(":1000", TunnelCounters{IngressBytes: 1, EgressBytes: 2})
+	p.retire(":1000", TunnelCounters{IngressBytes: 10, EgressBytes: 20})
+	p.save(&TunnelManager{})
+
+	p, err = newStatePersistence(path, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to load state file: %v", err)
+	}
+	c := p.claim(":1000")
+	if c != (TunnelCounters{IngressBytes: 11, EgressBytes: 22}) {
+		t.Errorf("Unexpected counters loaded: %v", c)
+	}
+	c = p.claim(":1000")
+	if c != (TunnelCounters{}) {
+		t.Errorf("Counters were claimed twice: %v", c)
+	}
+}
+
+func TestStateRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	onDemand := freePort(t)
+
+	// The first run applies configuration and changes it at runtime
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	p, err := newStatePersistence(path, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	configUpdate := make(chan ConfigurationJSON)
+	manager := newTunnelManager(configUpdate, p, gs)
+	manager.start()
+	configUpdate <- ConfigurationJSON{
+		Tenants:  map[string]TenantConfigJSON{"a": {Token: "ta", Limit: 1000}},
+		Profiles: map[string]TunnelLimits{"gold": {TunnelLimit: 2000}},
+		Tunnels: map[ListenAt]TunnelConfigJSON{
+			"127.0.0.1:0": {ConnectTo: "127.0.0.1:1", Tenant: "a",
+				TunnelLimits: TunnelLimits{TunnelLimit: 100}},
+			"localhost:0": {ConnectTo: "127.0.0.1:1", Profile: "gold"},
+		},
+		OnDemand: map[ListenAt]TunnelConfigJSON{
+			onDemand: {ConnectTo: ConnectTo(upstream.Addr().String())},
+		},
+	}
+	if err = manager.UpdateTunnelLimits("127.0.0.1:0", TunnelLimits{TunnelLimit: 300}); err != nil {
+		t.Fatalf("Failed to update limits: %v", err)
+	}
+	if err = manager.PutProfile("gold", TunnelLimits{TunnelLimit: 3000}); err != nil {
+		t.Fatalf("Failed to change profile: %v", err)
+	}
+	if _, err = manager.CreateTunnel(TunnelSpec{ListenAt: freePort(t),
+		ConnectTo: "127.0.0.1:1"}); err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	client, err := net.Dial("tcp", string(onDemand))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.ListTunnels()) != 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tunnels := manager.ListTunnels(); len(tunnels) != 4 {
+		t.Fatalf("Expected configured, ephemeral and on-demand tunnels, got %v", tunnels)
+	}
+	// State is saved on shutdown
+	close(quit)
+	gs.waitGroup.Wait()
+
+	// The next run restores configuration with a fresh manager
+	quit = make(chan struct{})
+	gs = &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+	if p, err = newStatePersistence(path, time.Minute); err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	restored, ok := p.restoredConfiguration()
+	if !ok {
+		t.Fatalf("Expected configuration to be restored")
+	}
+	if _, ok := restored.OnDemand[onDemand]; !ok {
+		t.Errorf("Expected port range of on-demand tunnels to be restored")
+	}
+	configUpdate = make(chan ConfigurationJSON)
+	manager = newTunnelManager(configUpdate, p, gs)
+	manager.start()
+	configUpdate <- restored
+
+	tunnels := make(map[ListenAt]TunnelInfo)
+	for _, info := range manager.ListTunnels() {
+		tunnels[info.ListenAt] = info
+	}
+	if len(tunnels) != 2 {
+		t.Errorf("Expected only configured tunnels to come back, got %v", tunnels)
+	}
+	if info := tunnels["127.0.0.1:0"]; info.Tenant != "a" || info.Limits.TunnelLimit != 300 {
+		t.Errorf("Expected tunnel limits changed at runtime to be restored, got %+v", info)
+	}
+	if info := tunnels["localhost:0"]; info.Profile != "gold" ||
+		info.Limits.TunnelLimit != 3000 {
+		t.Errorf("Expected tunnel to be restored with its profile, got %+v", info)
+	}
+	if profiles := manager.ListProfiles(); len(profiles) != 1 ||
+		profiles[0].Limits.TunnelLimit != 3000 {
+		t.Errorf("Expected profile changed at runtime to be restored, got %v", profiles)
+	}
+	if tenants := manager.ListTenants(); len(tenants) != 1 || tenants[0].Name != "a" ||
+		tenants[0].Limit != 1000 {
+		t.Errorf("Expected tenant to be restored, got %v", tenants)
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
+)
+
+// SubnetLimit caps aggregate bandwidth of all connections made to a tunnel
+// from clients within a subnet
+type SubnetLimit struct {
+	// CIDR or a single IP address
+	Subnet string `json:"subnet"`
+	Limit  Limit  `json:"limit"`
+}
+
+// SubnetLimits are limits of subnets of a tunnel. Connection is subject to the
+// limit of the most specific subnet its client belongs to (if any).
+type SubnetLimits []SubnetLimit
+
+// validate checks subnet limits for errors
+func (s SubnetLimits) validate() error {
+	_, err := s.trie()
+	return err
+}
+
+// equal tells whether two sets of subnet limits are the same
+func (s SubnetLimits) equal(other SubnetLimits) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for i := range s {
+		if s[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// subnetLimit is a limiter shared by connections from a subnet
+type subnetLimit struct {
+	// Subnet in canonical form
+	subnet  string
+	limiter *rate.Limiter
+}
+
+// subnetNode is a node of a binary trie of IP address bits
+type subnetNode struct {
+	children [2]*subnetNode
+	// Limit of the subnet ending at this node (nil if there's none)
+	limit *subnetLimit
+}
+
+// subnetTrie finds the most specific subnet of an address. IPv4 addresses are
+// kept as IPv4-mapped IPv6 ones.
+type subnetTrie struct {
+	root   subnetNode
+	limits []*subnetLimit
+}
+
+// trie parses subnet limits. Returns nil if there are none.
+func (s SubnetLimits) trie() (*subnetTrie, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	result := new(subnetTrie)
+	for _, v := range s {
+		network, err := parseNetwork(v.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid subnet: %v", err)
+		}
+		if v.Limit <= 0 {
+			return nil, fmt.Errorf("Limit of subnet %q must be positive", v.Subnet)
+		}
+		ones, bits := network.Mask.Size()
+		ip := network.IP.To16()
+		if bits == 8*net.IPv4len {
+			ones += 8 * (net.IPv6len - net.IPv4len)
+		}
+		node := &result.root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> uint(7-i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = new(subnetNode)
+			}
+			node = node.children[bit]
+		}
+		if node.limit != nil {
+			return nil, fmt.Errorf("Subnet %q is limited more than once", v.Subnet)
+		}
+		node.limit = &subnetLimit{
+			subnet:  network.String(),
+			limiter: limiter.CreateLimiter(rate.Limit(v.Limit)),
+		}
+		result.limits = append(result.limits, node.limit)
+	}
+	return result, nil
+}
+
+// match returns limit of the most specific subnet a client belongs to (nil if
+// there's none). Safe to call on nil trie.
+func (t *subnetTrie) match(client net.Addr) *subnetLimit {
+	if t == nil {
+		return nil
+	}
+	ip := addrIP(client.String()).To16()
+	if ip == nil {
+		return nil
+	}
+	var result *subnetLimit
+	node := &t.root
+	for i := 0; node != nil; i++ {
+		if node.limit != nil {
+			result = node.limit
+		}
+		if i == 8*net.IPv6len {
+			break
+		}
+		node = node.children[ip[i/8]>>uint(7-i%8)&1]
+	}
+	return result
+}
+
+// inherit makes subnets of a trie share limiters of the same subnets of an old
+// one, so that changing a limit doesn't reset its bucket. Safe to call with
+// nil tries.
+func (t *subnetTrie) inherit(old *subnetTrie) {
+	if t == nil || old == nil {
+		return
+	}
+	limiters := make(map[string]*rate.Limiter, len(old.limits))
+	for _, l := range old.limits {
+		limiters[l.subnet] = l.limiter
+	}
+	for _, l := range t.limits {
+		if inherited, ok := limiters[l.subnet]; ok {
+			inherited.SetLimit(l.limiter.Limit())
+			l.limiter = inherited
+		}
+	}
+}
+
+// UpdateSubnetLimits changes limits of subnets of a tunnel. Active connections
+// become subject to new limits right away.
+func (t *Tunnel) UpdateSubnetLimits(limits SubnetLimits) error {
+	trie, err := limits.trie()
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateSubnets <- trie:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// applySubnet makes connection share the limiter of its subnet. Must be called
+// on the tunnel goroutine.
+func (t *Tunnel) applySubnet(conn *Connection) {
+	subnet := t.subnets.match(conn.ingress.RemoteAddr())
+	if subnet == conn.subnet {
+		return
+	}
+	if !t.updateConnectionShared(conn, conn.identity, conn.class, conn.priorityLevel,
+		subnet, conn.backend) {
+		return
+	}
+	conn.subnet = subnet
+	if subnet == nil {
+		conn.subnetName.Store("")
+	} else {
+		conn.subnetName.Store(subnet.subnet)
+		t.logf(LogDebug, "Connection %d at %q shares limit of subnet %s", conn.ID(),
+			t.listenAt, subnet.subnet)
+	}
+}
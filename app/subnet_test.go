@@ -0,0 +1,112 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubnetTrie(t *testing.T) {
+	trie, err := SubnetLimits{
+		{Subnet: "10.0.0.0/8", Limit: 5000},
+		{Subnet: "10.1.0.0/16", Limit: 1000},
+		{Subnet: "192.168.1.1", Limit: 100},
+		{Subnet: "fd00::/8", Limit: 2000},
+	}.trie()
+	if err != nil {
+		t.Fatalf("Failed to parse subnet limits: %v", err)
+	}
+	cases := []struct {
+		client   string
+		expected string
+	}{
+		{"10.2.3.4", "10.0.0.0/8"},
+		{"10.1.2.3", "10.1.0.0/16"},
+		{"192.168.1.1", "192.168.1.1/32"},
+		{"192.168.1.2", ""},
+		{"fd12::1", "fd00::/8"},
+		{"fe80::1", ""},
+	}
+	for _, c := range cases {
+		client := &net.TCPAddr{IP: net.ParseIP(c.client), Port: 1000}
+		subnet := ""
+		if limit := trie.match(client); limit != nil {
+			subnet = limit.subnet
+		}
+		if subnet != c.expected {
+			t.Errorf("Expected %s to match subnet %q, got %q", c.client, c.expected, subnet)
+		}
+	}
+
+	updated, err := SubnetLimits{{Subnet: "10.0.0.0/8", Limit: 3000}}.trie()
+	if err != nil {
+		t.Fatalf("Failed to parse subnet limits: %v", err)
+	}
+	updated.inherit(trie)
+	if updated.limits[0].limiter != trie.limits[0].limiter {
+		t.Errorf("Expected updated subnet to keep its limiter")
+	}
+	if limit := updated.limits[0].limiter.Limit(); limit != 3000 {
+		t.Errorf("Expected inherited limiter to have limit 3000, got %v", limit)
+	}
+
+	invalid := []SubnetLimits{
+		{{Subnet: "office", Limit: 1000}},
+		{{Subnet: "10.0.0.0/8", Limit: 0}},
+		{{Subnet: "10.0.0.0/8", Limit: Blocked}},
+		{{Subnet: "10.0.0.0/8", Limit: 1000}, {Subnet: "10.0.0.0/8", Limit: 2000}},
+	}
+	for _, limits := range invalid {
+		if err := limits.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", limits)
+		}
+	}
+}
+
+func TestTunnelSubnetLimits(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{
+			Subnets: SubnetLimits{{Subnet: "127.0.0.0/8", Limit: 1000}},
+		})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	waitSubnet := func(expected string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			connections := tunnel.Connections()
+			if len(connections) == 1 && connections[0].Subnet == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected connection of subnet %q, got %+v", expected,
+					connections)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitSubnet("127.0.0.0/8")
+
+	if err := tunnel.UpdateSubnetLimits(SubnetLimits{
+		{Subnet: "127.0.0.0/8", Limit: 1000},
+		{Subnet: "127.0.0.1", Limit: 500},
+	}); err != nil {
+		t.Fatalf("Failed to update subnet limits: %v", err)
+	}
+	waitSubnet("127.0.0.1/32")
+
+	if err := tunnel.UpdateSubnetLimits(nil); err != nil {
+		t.Fatalf("Failed to update subnet limits: %v", err)
+	}
+	waitSubnet("")
+}
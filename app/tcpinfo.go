@@ -0,0 +1,52 @@
+package app
+
+import (
+	"net"
+
+	"github.com/anton-dessiatov/throttle/limiter"
+)
+
+// TCPInfo is what the kernel knows about the path of a TCP connection. Only
+// available on Linux.
+type TCPInfo struct {
+	// Smoothed round trip time, its variance and the lowest one observed
+	RTT    Duration `json:"rtt"`
+	RTTVar Duration `json:"rttVar"`
+	MinRTT Duration `json:"minRtt,omitempty"`
+	// Number of segments retransmitted over connection lifetime
+	Retransmits uint32 `json:"retransmits"`
+	// Congestion window in segments
+	Cwnd uint32 `json:"cwnd"`
+	// Recent delivery rate in bytes per second (Linux 4.9 and later)
+	DeliveryRate int64 `json:"deliveryRate,omitempty"`
+	// Delivery rate was bound by the sender not having data to send (e.g. by
+	// throttling) rather than by the path
+	AppLimited bool `json:"appLimited,omitempty"`
+}
+
+// tcpConn returns TCP connection underlying a given one (nil if there's none,
+// e.g. for connections through SSH hops or over TLS)
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *limiter.LimitedConnection:
+			conn = c.Inner()
+		case *prefixedConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// loadTCPInfo samples TCP_INFO of a connection. Returns nil if it's not
+// available.
+func loadTCPInfo(conn net.Conn) *TCPInfo {
+	c := tcpConn(conn)
+	if c == nil {
+		return nil
+	}
+	return readTCPInfo(c)
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpInfo is the beginning of struct tcp_info of linux/tcp.h. Older kernels
+// fill in less of it, leaving the rest zero.
+type tcpInfo struct {
+	state       uint8
+	caState     uint8
+	retransmits uint8
+	probes      uint8
+	backoff     uint8
+	options     uint8
+	wscale      uint8
+	// Lowest bit is tcpi_delivery_rate_app_limited
+	appLimited uint8
+
+	rto          uint32
+	ato          uint32
+	sndMss       uint32
+	rcvMss       uint32
+	unacked      uint32
+	sacked       uint32
+	lost         uint32
+	retrans      uint32
+	fackets      uint32
+	lastDataSent uint32
+	lastAckSent  uint32
+	lastDataRecv uint32
+	lastAckRecv  uint32
+	pmtu         uint32
+	rcvSsthresh  uint32
+	rtt          uint32
+	rttvar       uint32
+	sndSsthresh  uint32
+	sndCwnd      uint32
+	advmss       uint32
+	reordering   uint32
+	rcvRtt       uint32
+	rcvSpace     uint32
+	totalRetrans uint32
+
+	pacingRate    uint64
+	maxPacingRate uint64
+	bytesAcked    uint64
+	bytesReceived uint64
+	segsOut       uint32
+	segsIn        uint32
+	notsentBytes  uint32
+	minRtt        uint32
+	dataSegsIn    uint32
+	dataSegsOut   uint32
+	deliveryRate  uint64
+}
+
+// readTCPInfo gets TCP_INFO of a connection. Returns nil on failure.
+func readTCPInfo(conn *net.TCPConn) *TCPInfo {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info tcpInfo
+	size := uint32(unsafe.Sizeof(info))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP,
+			syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)),
+			0)
+	})
+	if err != nil || errno != 0 {
+		return nil
+	}
+	// Times are in microseconds
+	return &TCPInfo{
+		RTT:          Duration(time.Duration(info.rtt) * time.Microsecond),
+		RTTVar:       Duration(time.Duration(info.rttvar) * time.Microsecond),
+		MinRTT:       Duration(time.Duration(info.minRtt) * time.Microsecond),
+		Retransmits:  info.totalRetrans,
+		Cwnd:         info.sndCwnd,
+		DeliveryRate: int64(info.deliveryRate),
+		AppLimited:   info.appLimited&1 != 0,
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package app
+
+import (
+	"net"
+)
+
+// readTCPInfo is not supported outside of Linux
+func readTCPInfo(conn *net.TCPConn) *TCPInfo {
+	return nil
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConnectionTCPInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only sampled on Linux")
+	}
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		if len(connections) == 1 {
+			c := connections[0]
+			if c.ClientTCP == nil || c.UpstreamTCP == nil {
+				t.Fatalf("Expected TCP info of both paths, got %+v", c)
+			}
+			if c.ClientTCP.Cwnd == 0 || c.UpstreamTCP.Cwnd == 0 {
+				t.Errorf("Expected congestion windows to be known, got %+v and %+v",
+					*c.ClientTCP, *c.UpstreamTCP)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
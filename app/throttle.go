@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 )
 
 // Everything needed by components for a graceful shutdown (e.g. to stop
@@ -14,20 +15,89 @@ type gracefulShutdown struct {
 	waitGroup *sync.WaitGroup
 }
 
+// Options are the parameters application is run with
+type Options struct {
+	// Path to the configuration file
+	ConfigPath string
+	// Path to the file used to persist runtime state (e.g. traffic counters)
+	// across restarts. Empty value disables persistence.
+	StatePath string
+	// How often runtime state gets saved to StatePath. State is saved upon
+	// graceful shutdown as well.
+	StateInterval time.Duration
+	// If set, tunnels are started as they were defined when state was last
+	// saved instead of being loaded from the configuration file. Configuration
+	// file is still reloaded upon SIGUSR2.
+	Restore bool
+	// Admin API parameters
+	Admin AdminOptions
+	// Path to a unix socket to serve admin API at with operator privileges
+	// (disabled if empty)
+	ControlPath string
+	// Address to serve aggregate stats at without authentication (disabled if
+	// empty)
+	PublicStatsAddress string
+	// If set, soft limit of open files is raised to the hard one at startup
+	RaiseOpenFiles bool
+}
+
 // Run gets the party started
-func Run(configPath string) {
+func Run(opts Options) {
+	configPath := opts.ConfigPath
+	if opts.Restore && opts.StatePath == "" {
+		log.Fatalf("Unable to restore runtime state without a state file")
+	}
+	persistence, err := newStatePersistence(opts.StatePath, opts.StateInterval)
+	if err != nil {
+		log.Fatalf("Failed to load state file at %q: %v", opts.StatePath, err)
+	}
+
 	quit := make(chan struct{})
 	gs := &gracefulShutdown{
 		quit:      quit,
 		waitGroup: new(sync.WaitGroup),
 	}
 
+	osLimits, err := loadOSLimits(opts.RaiseOpenFiles)
+	if err != nil {
+		log.Printf("Failed to check OS limits: %v", err)
+	}
+	log.Printf("Open file limit is %d (at most %d), listen backlog is limited to %d",
+		osLimits.OpenFiles, osLimits.MaxOpenFiles, osLimits.ListenBacklog)
+
 	configUpdate := make(chan ConfigurationJSON)
-	go dispatch(configUpdate, gs)
+	manager := newTunnelManager(configUpdate, persistence, gs)
+	manager.osLimits = osLimits
+	manager.start()
 
-	err := LoadAndWatch(configPath, configUpdate, gs)
-	if err != nil {
-		log.Fatalf("Failed to load config file at %q: %v", configPath, err)
+	if opts.Admin.Address != "" {
+		if err = startAdminServer(opts.Admin, manager, gs); err != nil {
+			log.Fatalf("Failed to start admin API at %q: %v", opts.Admin.Address, err)
+		}
+	}
+
+	if opts.ControlPath != "" {
+		if err = startControlServer(opts.ControlPath, manager, gs); err != nil {
+			log.Fatalf("Failed to start control socket at %q: %v", opts.ControlPath, err)
+		}
+	}
+
+	if opts.PublicStatsAddress != "" {
+		if err = startPublicStatsServer(opts.PublicStatsAddress, manager, gs); err != nil {
+			log.Fatalf("Failed to start public stats at %q: %v",
+				opts.PublicStatsAddress, err)
+		}
+	}
+
+	if restored, ok := persistence.restoredConfiguration(); opts.Restore && ok {
+		log.Printf("Restoring runtime configuration from %q", opts.StatePath)
+		configUpdate <- restored
+		Watch(configPath, configUpdate, gs)
+	} else {
+		err = LoadAndWatch(configPath, configUpdate, gs)
+		if err != nil {
+			log.Fatalf("Failed to load config file at %q: %v", configPath, err)
+		}
 	}
 
 	c := make(chan os.Signal, 1)
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Policies of treating active connections when tunnel limit gets lowered
+const (
+	// TightenThrottle only throttles active connections to the new limit
+	TightenThrottle = ""
+	// TightenDrain closes the most bandwidth-hungry connections until the
+	// rest fit into the new limit
+	TightenDrain = "drain"
+)
+
+// validateTightenPolicy checks tighten policy of limits for errors
+func (l TunnelLimits) validateTightenPolicy() error {
+	switch l.TightenPolicy {
+	case TightenThrottle, TightenDrain:
+	default:
+		return fmt.Errorf("Unknown tighten policy %q", l.TightenPolicy)
+	}
+	if l.DrainThreshold < 0 {
+		return fmt.Errorf("Drain threshold must not be negative")
+	}
+	return nil
+}
+
+// tightened tells whether new limits lower tunnel limit of old ones
+func tightened(old, new TunnelLimits) bool {
+	return new.TunnelLimit > 0 &&
+		(old.TunnelLimit == 0 || new.TunnelLimit < old.TunnelLimit)
+}
+
+// drainHungry closes connections with throughput above drain threshold, most
+// hungry first, until throughput of the rest fits into tunnel limit. Exempt
+// connections aren't subject to tunnel limit and are left alone.
+func (t *Tunnel) drainHungry(activeConnections *connectionRegistry,
+	limits TunnelLimits) {
+	type candidate struct {
+		conn *Connection
+		rate float64
+	}
+	var candidates []candidate
+	var total float64
+	for _, conn := range activeConnections.all() {
+		if t.listener.ConnectionExempt(conn.ingress) {
+			continue
+		}
+		rate := conn.meter.throughput().Rate10s
+		total += rate
+		if rate > float64(limits.DrainThreshold) {
+			candidates = append(candidates, candidate{conn: conn, rate: rate})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+	for _, c := range candidates {
+		if total <= float64(limits.TunnelLimit) {
+			break
+		}
+		total -= c.rate
+		activeConnections.remove(c.conn)
+		c.conn.Close()
+		t.logf(LogInfo, "Connection %d at %q closed to fit into lowered limit (%.0f Bps)",
+			c.conn.ID(), t.listenAt, c.rate)
+		t.connectionClosed(c.conn, CloseDrained, loadCounters(&c.conn.counters), nil)
+	}
+}
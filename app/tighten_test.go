@@ -0,0 +1,97 @@
+package app
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTightened(t *testing.T) {
+	cases := []struct {
+		old, new Limit
+		expected bool
+	}{
+		{0, 1000, true},
+		{2000, 1000, true},
+		{1000, 1000, false},
+		{1000, 2000, false},
+		{1000, 0, false},
+	}
+	for _, c := range cases {
+		if tightened(TunnelLimits{TunnelLimit: c.old}, TunnelLimits{TunnelLimit: c.new}) != c.expected {
+			t.Errorf("Expected change from %v to %v tightened = %v", c.old, c.new, c.expected)
+		}
+	}
+}
+
+func TestDrainOnTighten(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	tunnel, idle := startTunnelConnection(t, upstream, TunnelOptions{})
+	defer tunnel.Shutdown()
+	defer idle.Close()
+	idleID := tunnel.Connections()[0].ID
+
+	hungry, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer hungry.Close()
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for {
+			if _, err := hungry.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	const threshold = 64 * 1024
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		if len(connections) == 2 && connections[1].Stats.Throughput.Rate10s > threshold {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Hungry connection didn't pick up speed: %+v", connections)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	tunnel.UpdateLimits(TunnelLimits{
+		TunnelLimit:    threshold,
+		TightenPolicy:  TightenDrain,
+		DrainThreshold: threshold,
+	})
+	// Connections are listed without waiting for the tunnel to apply limits
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		connections := tunnel.Connections()
+		if len(connections) == 1 && connections[0].ID == idleID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected only idle connection to remain, got %+v", connections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseDrained] != 1 {
+		t.Errorf("Expected drained connection to be counted, got %v", closed)
+	}
+}
@@ -2,274 +2,2153 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anton-dessiatov/throttle/limiter"
+	"golang.org/x/time/rate"
 )
 
 // TunnelLimits encapsulates bandwidth limits for a given tunnel.
 type TunnelLimits struct {
 	// Overall tunnel bandwidth limit. Total bandwidth usage by a tunnel never
 	// exceeds this value
-	TunnelLimit Limit
+	TunnelLimit Limit `json:"tunnelLimit"`
 	// Bandwidth limit for individual connections of this tunnel. No single
 	// connection made as a part of this tunnel is allowed to exceed this limit.
-	ConnectionLimit Limit
+	ConnectionLimit Limit `json:"connectionLimit"`
+	// If set, changes of tunnel and connection limits to these limits are
+	// spread over this time. RampLinear (default) or RampExponential.
+	LimitRamp      Duration `json:"limitRamp,omitempty"`
+	LimitRampShape string   `json:"limitRampShape,omitempty"`
+	// Bandwidth limit shared by all connections made from a single client IP
+	// address to this tunnel. Limits of clients are kept for a minute after
+	// their last connection closes.
+	ClientLimit Limit `json:"clientLimit,omitempty"`
+	// Limits of data clients upload (forwarded to upstream) and download
+	// (forwarded back to clients) applied on top of tunnel and connection
+	// limits, so that directions could be limited differently (e.g. to
+	// simulate an asymmetric link). Zero disables a limit.
+	UploadLimit             Limit `json:"uploadLimit,omitempty"`
+	DownloadLimit           Limit `json:"downloadLimit,omitempty"`
+	ConnectionUploadLimit   Limit `json:"connectionUploadLimit,omitempty"`
+	ConnectionDownloadLimit Limit `json:"connectionDownloadLimit,omitempty"`
+	// If set, tunnel and connection limits let through traffic of this
+	// duration at once, so bursts scale along with limits. By default bursts
+	// are 1/20 of a second worth of traffic capped at 64KiB, which throttles
+	// high limits in tiny steps.
+	BurstDuration Duration `json:"burstDuration,omitempty"`
+	// If set, tunnel and connection limits let through this many bytes at
+	// once regardless of limits and BurstDuration. Small bursts pace traffic
+	// smoothly, big ones deliver it in bursts.
+	TunnelBurst     int `json:"tunnelBurst,omitempty"`
+	ConnectionBurst int `json:"connectionBurst,omitempty"`
+	// How limiters let traffic through: AlgorithmTokenBucket (default),
+	// AlgorithmLeakyBucket, AlgorithmFairQueue, AlgorithmFairShare or
+	// AlgorithmSlidingWindow. Could be changed on a running tunnel without
+	// interrupting connections.
+	Algorithm string `json:"algorithm,omitempty"`
+	// If set, small reads are held for up to this time to be forwarded
+	// together with following ones, trading latency for fewer writes on
+	// chatty low-rate connections
+	CoalesceDelay Duration `json:"coalesceDelay,omitempty"`
+	// Delay added to every chunk of data forwarded in either direction, e.g.
+	// to simulate a WAN link. Applies to active connections once changed.
+	Latency Duration `json:"latency,omitempty"`
+	// Random deviation of the delay: JitterUniform (default) spreads it within
+	// Latency ± Jitter, JitterNormal uses Jitter as standard deviation
+	Jitter             Duration `json:"jitter,omitempty"`
+	JitterDistribution string   `json:"jitterDistribution,omitempty"`
+	// Probability of every forwarded chunk to be dropped and probability of
+	// connection to be reset instead of forwarding a chunk, for chaos testing
+	LossProbability  float64 `json:"lossProbability,omitempty"`
+	ResetProbability float64 `json:"resetProbability,omitempty"`
+	// If set, new connections start at SlowStartFraction of ConnectionLimit
+	// and ramp up to full ConnectionLimit over this time
+	SlowStartWindow Duration `json:"slowStartWindow,omitempty"`
+	// Fraction of ConnectionLimit new connections start with during slow
+	// start. Zero stands for DefaultSlowStartFraction.
+	SlowStartFraction float64 `json:"slowStartFraction,omitempty"`
+	// Bandwidth each connection is allowed to spend on small (interactive)
+	// chunks of data without waiting behind bulk traffic. Interactive traffic
+	// still counts towards limits. Zero disables the boost.
+	InteractiveBoost Limit `json:"interactiveBoost,omitempty"`
+	// If set, limits are observed rather than enforced: traffic is forwarded
+	// unthrottled and throttling that would have happened is recorded in
+	// tunnel and connection stats
+	ObserveOnly bool `json:"observeOnly,omitempty"`
+	// Shadow limits are evaluated alongside the enforced ones, but never
+	// enforced. Traffic exceeding them is logged and recorded in stats, which
+	// helps to evaluate a planned limit reduction. Zero disables a shadow limit.
+	ShadowTunnelLimit     Limit `json:"shadowTunnelLimit,omitempty"`
+	ShadowConnectionLimit Limit `json:"shadowConnectionLimit,omitempty"`
+	// What happens to active connections when tunnel limit gets lowered:
+	// TightenThrottle (default) or TightenDrain
+	TightenPolicy string `json:"tightenPolicy,omitempty"`
+	// Connections with throughput at or below this are never closed by
+	// TightenDrain policy
+	DrainThreshold Limit `json:"drainThreshold,omitempty"`
+	// Maximum number of simultaneous dials to upstream and number of
+	// connections allowed to wait for a dial slot (connections beyond that
+	// are rejected). Zero values stand for DefaultMaxDials and
+	// DefaultDialQueue.
+	MaxDials  int `json:"maxDials,omitempty"`
+	DialQueue int `json:"dialQueue,omitempty"`
+	// If set, connections accepted within this time after a failed dial fail
+	// right away instead of dialing a likely dead upstream again
+	DialFailureCache Duration `json:"dialFailureCache,omitempty"`
+	// Number of idle upstream connections kept for reuse by following client
+	// connections and how long they are kept for (zero stands for
+	// DefaultUpstreamIdleTimeout). Only suits tunnels carrying short
+	// request/response flows where upstream connection is idle once client
+	// closes its side. Zero pool size disables reuse.
+	UpstreamPool        int      `json:"upstreamPool,omitempty"`
+	UpstreamIdleTimeout Duration `json:"upstreamIdleTimeout,omitempty"`
+	// If set, connections living for longer than that are closed (checked
+	// once a second), e.g. to make clients rebalance across backends
+	MaxLifetime Duration `json:"maxLifetime,omitempty"`
+	// If set, clients could request their connection limit with a preamble
+	// (see PreambleMagic) capped at PreambleMaxRate or, if it's zero, at
+	// ConnectionLimit
+	RatePreamble    bool  `json:"ratePreamble,omitempty"`
+	PreambleMaxRate Limit `json:"preambleMaxRate,omitempty"`
+	// Name of an identity group whose per-client limits connections share
+	// with connections of the same client to other tunnels
+	IdentityGroup string `json:"identityGroup,omitempty"`
+	// Amount of data tunnel is allowed to forward in both directions within
+	// a QuotaPeriod (QuotaMonth by default). Once it's used up, tunnel is
+	// limited to QuotaTrickle or, if it's zero, closes its connections and
+	// rejects new ones until the next period. Zero disables the quota.
+	Quota        DataSize `json:"quota,omitempty"`
+	QuotaPeriod  string   `json:"quotaPeriod,omitempty"`
+	QuotaTrickle Limit    `json:"quotaTrickle,omitempty"`
+	// Name of a worker pool whose goroutine and memory budgets connections
+	// share with connections of other tunnels in the pool
+	WorkerPool string `json:"workerPool,omitempty"`
+	// Maximum number of connections tunnel serves at once (unlimited if zero)
+	// and number of accepted connections allowed to wait for one of them to
+	// end. Connections beyond that are refused.
+	MaxConnections  int `json:"maxConnections,omitempty"`
+	ConnectionQueue int `json:"connectionQueue,omitempty"`
+	// Maximum number of simultaneous connections from a single client IP
+	// address to the same destination (unlimited if zero). Connections beyond
+	// that are refused.
+	MaxDuplicateConnections int `json:"maxDuplicateConnections,omitempty"`
+	// Maximum number of simultaneous connections from a single client IP
+	// address to any destination of the tunnel (unlimited if zero).
+	// Connections beyond that are refused.
+	MaxClientConnections int `json:"maxClientConnections,omitempty"`
+	// If set, a connection from a client IP address to the same destination
+	// as its previous connection started less than this time ago is held
+	// until that time passes. A newer connection of the client supersedes the
+	// held one, so a reconnect storm reaches upstream once per delay.
+	ReconnectDelay Duration `json:"reconnectDelay,omitempty"`
+	// Maximum number of new connections accepted per second (unlimited if
+	// zero) and number of them accepted at once after a quiet period (1 if
+	// zero). Connections beyond that wait in the listen backlog.
+	AcceptRate  float64 `json:"acceptRate,omitempty"`
+	AcceptBurst int     `json:"acceptBurst,omitempty"`
+	// Number of connections kernel queues for tunnel to accept
+	// (net.core.somaxconn, which also caps it, if zero)
+	ListenBacklog int `json:"listenBacklog,omitempty"`
+	// Number of accepted connections allowed to wait for tunnel to handle
+	// them. Beyond that connections are left in listen backlog. Takes effect
+	// once tunnel (re)starts listening.
+	AcceptQueue int `json:"acceptQueue,omitempty"`
+}
+
+// MaxCoalesceDelay is the maximum time small reads could be held for
+const MaxCoalesceDelay = 100 * time.Millisecond
+
+// DefaultSlowStartFraction is the fraction of a connection limit new
+// connections start with if slow start is enabled
+const DefaultSlowStartFraction = 0.1
+
+// validate checks limits for errors
+func (l TunnelLimits) validate() error {
+	if l.TunnelLimit < Blocked || l.ConnectionLimit < Blocked || l.ClientLimit < 0 ||
+		l.InteractiveBoost < 0 || l.ShadowTunnelLimit < 0 || l.ShadowConnectionLimit < 0 ||
+		l.PreambleMaxRate < 0 || l.UploadLimit < 0 || l.DownloadLimit < 0 ||
+		l.ConnectionUploadLimit < 0 || l.ConnectionDownloadLimit < 0 {
+		return invalidLimit("Limits must not be negative (only tunnel and connection " +
+			"limits could be blocked)")
+	}
+	if l.BurstDuration < 0 {
+		return invalidLimit("Burst duration must not be negative")
+	}
+	if l.TunnelBurst < 0 || l.TunnelBurst > limiter.MaxScaledBurstSize ||
+		l.ConnectionBurst < 0 || l.ConnectionBurst > limiter.MaxScaledBurstSize {
+		return invalidLimit("Bursts must be between 0 and %d", limiter.MaxScaledBurstSize)
+	}
+	if l.CoalesceDelay < 0 || time.Duration(l.CoalesceDelay) > MaxCoalesceDelay {
+		return invalidLimit("Coalescing delay must be between 0 and %v", MaxCoalesceDelay)
+	}
+	if l.MaxDials < 0 || l.DialQueue < 0 || l.DialFailureCache < 0 {
+		return invalidLimit("Dial concurrency limits must not be negative")
+	}
+	if l.AcceptRate < 0 || l.AcceptBurst < 0 {
+		return invalidLimit("Accept rate and burst must not be negative")
+	}
+	if l.MaxConnections < 0 || l.ConnectionQueue < 0 {
+		return invalidLimit("Maximum number of connections and connection queue must " +
+			"not be negative")
+	}
+	if l.UpstreamPool < 0 || l.UpstreamIdleTimeout < 0 {
+		return invalidLimit("Upstream pool size and idle timeout must not be negative")
+	}
+	if l.MaxLifetime < 0 {
+		return invalidLimit("Maximum connection lifetime must not be negative")
+	}
+	if l.SlowStartWindow < 0 || l.SlowStartFraction < 0 || l.SlowStartFraction > 1 {
+		return invalidLimit("Slow start window must not be negative and fraction must be " +
+			"between 0 and 1")
+	}
+	if err := l.validateTightenPolicy(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateAlgorithm(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateQuota(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateJitter(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateLoss(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateBacklog(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateRamp(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	if err := l.validateDedup(); err != nil {
+		return &Error{Kind: ErrLimitInvalid, Err: err}
+	}
+	return nil
+}
+
+// slowStart returns slow start settings for tunnel listener
+func (l TunnelLimits) slowStart() limiter.SlowStart {
+	fraction := l.SlowStartFraction
+	if fraction == 0 {
+		fraction = DefaultSlowStartFraction
+	}
+	return limiter.SlowStart{
+		Fraction: fraction,
+		Window:   time.Duration(l.SlowStartWindow),
+	}
+}
+
+// TunnelCounters holds amounts of traffic forwarded by a tunnel.
+type TunnelCounters struct {
+	// Number of bytes forwarded from clients to the upstream
+	IngressBytes int64 `json:"ingressBytes"`
+	// Number of bytes forwarded from the upstream to clients
+	EgressBytes int64 `json:"egressBytes"`
+}
+
+// Add returns a sum of two sets of counters
+func (c TunnelCounters) Add(other TunnelCounters) TunnelCounters {
+	return TunnelCounters{
+		IngressBytes: c.IngressBytes + other.IngressBytes,
+		EgressBytes:  c.EgressBytes + other.EgressBytes,
+	}
+}
+
+// ObservedThrottling describes throttling that would have been applied to
+// traffic if limits observed in observe-only mode were enforced
+type ObservedThrottling struct {
+	// Number of bytes that would have been delayed
+	DelayedBytes int64 `json:"delayedBytes"`
+	// Total time transfers would have been delayed for
+	Delay Duration `json:"delay"`
+	// Number of bytes that would have been blocked by a zero limit
+	BlockedBytes int64 `json:"blockedBytes"`
+}
+
+// Add returns a sum of two observations
+func (o ObservedThrottling) Add(other ObservedThrottling) ObservedThrottling {
+	return ObservedThrottling{
+		DelayedBytes: o.DelayedBytes + other.DelayedBytes,
+		Delay:        o.Delay + other.Delay,
+		BlockedBytes: o.BlockedBytes + other.BlockedBytes,
+	}
+}
+
+// loadObserved atomically loads observations made by limiter
+func loadObserved(o *limiter.ObservedThrottling) ObservedThrottling {
+	v := o.Load()
+	return ObservedThrottling{
+		DelayedBytes: v.DelayedBytes,
+		Delay:        Duration(v.Delay),
+		BlockedBytes: v.BlockedBytes,
+	}
+}
+
+// TunnelStats is a point-in-time view of tunnel activity
+type TunnelStats struct {
+	Counters   TunnelCounters     `json:"counters"`
+	Throughput Throughput         `json:"throughput"`
+	Observed   ObservedThrottling `json:"observed"`
+	// Throttling that shadow limits would have applied
+	Shadow ObservedThrottling `json:"shadow"`
+	// Number of connections ended for each reason (tunnels only)
+	Closed CloseReasonCounts `json:"closed,omitempty"`
+	// Traffic of labeled connections by their labels (tunnels only)
+	Labeled []LabeledCounters `json:"labeled,omitempty"`
+	// Time transfers spent waiting for limiters
+	Waits Waits `json:"waits"`
+	// Upstream dial and response latencies
+	Latency Latency `json:"latency"`
+	// Limiters in effect (tunnels and connections only). Tunnel limiters are
+	// sampled once a second.
+	Buckets *Buckets `json:"buckets,omitempty"`
+	// Transfer quota usage (tunnels having a quota only)
+	Quota *QuotaUsage `json:"quota,omitempty"`
+	// Limit classes and their traffic (tunnels having classes only), sampled
+	// once a second
+	Classes []ClassStats `json:"classes,omitempty"`
+	// Fairness of throughput of connections (tunnels only), sampled once a
+	// second
+	Fairness *Fairness `json:"fairness,omitempty"`
+}
+
+// Add returns a sum of two sets of stats
+func (s TunnelStats) Add(other TunnelStats) TunnelStats {
+	return TunnelStats{
+		Counters:   s.Counters.Add(other.Counters),
+		Throughput: s.Throughput.Add(other.Throughput),
+		Observed:   s.Observed.Add(other.Observed),
+		Shadow:     s.Shadow.Add(other.Shadow),
+		Closed:     s.Closed.Add(other.Closed),
+		Labeled:    addLabeled(s.Labeled, other.Labeled),
+		Waits:      s.Waits.Add(other.Waits),
+		Latency:    s.Latency.Add(other.Latency),
+	}
+}
+
+// total returns the number of bytes forwarded in both directions
+func (c TunnelCounters) total() int64 {
+	return c.IngressBytes + c.EgressBytes
+}
+
+// loadCounters atomically reads counters updated by forwarders
+func loadCounters(c *TunnelCounters) TunnelCounters {
+	return TunnelCounters{
+		IngressBytes: atomic.LoadInt64(&c.IngressBytes),
+		EgressBytes:  atomic.LoadInt64(&c.EgressBytes),
+	}
+}
+
+// TunnelOptions are optional parameters of a tunnel
+type TunnelOptions struct {
+	// Events receives events of tunnel connections. May be nil.
+	Events *EventBus
+	// Tenant this tunnel belongs to. Only used to tag events.
+	Tenant string
+	// Clients and upstreams bypassing throttling
+	Exemptions Exemptions
+	// Classes splitting tunnel limit between connections
+	Classes LimitClasses
+	// Rules deciding which connections reach upstream
+	Access AccessRules
+	// Operational settings that aren't limits
+	Settings TunnelSettings
+	// Rules telling priorities of connections
+	Priorities PriorityRules
+	// Aggregate limits of connections from subnets
+	Subnets SubnetLimits
+	// Aggregate limits of connections to backends
+	Backends BackendLimits
+	// Used to create the listening socket, e.g. to set socket options in its
+	// Control hook. Nil stands for default settings.
+	ListenConfig *net.ListenConfig
+	// Decides whether accepted connections are admitted and labels them. Nil
+	// admits all connections without labels.
+	Admit AdmitFunc
+	// Called for every admitted connection once it ends. Nil if not needed.
+	OnClose CloseFunc
+	// If set, traffic to upstream is encrypted with TLS
+	UpstreamTLS *UpstreamTLS
+	// Hops upstream connections are made through, in order
+	Via []Hop
+	// Groups connections could share per-client limits across tunnels in
+	// (see TunnelLimits.IdentityGroup). May be nil.
+	IdentityGroups *IdentityGroups
+	// Pools connections take goroutines and memory from (see
+	// TunnelLimits.WorkerPool). May be nil.
+	WorkerPools *WorkerPools
+	// Bounds simultaneous upstream dials of all tunnels sharing it. May be
+	// nil.
+	Dials *DialGate
+	// Resolvers tunnel picks one from (see TunnelSettings.Resolver). May be
+	// nil.
+	Resolvers *Resolvers
+	// Number of shards completions of connections are collected in before
+	// tunnel handles them. Zero stands for GOMAXPROCS.
+	CompletionShards int
+	// Already listening socket to take over instead of creating one. Tunnel
+	// creates its own socket if it ever has to listen again.
+	Listener net.Listener
+	// Quota usage to carry over from a previous run of the tunnel. May be nil.
+	Quota *QuotaUsage
+}
+
+// listen creates a listening socket for a tunnel
+func (o TunnelOptions) listen(listenAt ListenAt) (net.Listener, error) {
+	if o.Listener != nil {
+		return o.Listener, nil
+	}
+	lc := o.ListenConfig
+	if lc == nil {
+		lc = new(net.ListenConfig)
+	}
+	listen := func(address string) (net.Listener, error) {
+		return lc.Listen(context.Background(), "tcp", address)
+	}
+	if ports, err := parsePortRange(string(listenAt)); err == nil && ports.size() > 1 {
+		l, err := listenRange(listen, ports)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	return listen(string(listenAt))
 }
 
 // Tunnel is a structure that contains everything you might need to manage an
 // existing TCP tunnel
 type Tunnel struct {
-	listenAt      ListenAt
-	connectTo     ConnectTo
+	listenAt  ListenAt
+	connectTo ConnectTo
+	// Maps ports of a range tunnel listens at to ports of a destination range
+	// (nil if connections go to connectTo)
+	ports         *portMapping
 	shutdown      chan struct{}
 	listener      *limiter.RateLimitingListener
 	currentLimits TunnelLimits
 	updateLimits  chan TunnelLimits
-	waitGroup     *sync.WaitGroup
+	// Limiters shared with other tunnels (e.g. tenant aggregate limit)
+	currentShared []*rate.Limiter
+	updateShared  chan []*rate.Limiter
+	// Requests to move individual connections to different limits
+	updateConnection chan connectionLimitUpdate
+	closeConnection  chan connectionClose
+	boostConnection  chan connectionBoostRequest
+	// Owned by the tunnel goroutine
+	exemptions       *exemptionMatcher
+	updateExemptions chan *exemptionMatcher
+	// Limit classes (nil if there are none). Owned by the tunnel goroutine.
+	classes       *classSet
+	updateClasses chan *classSet
+	// Access rules (nil if there are none). Owned by the tunnel goroutine.
+	access       *accessSet
+	updateAccess chan *accessSet
+	// Receives channels to close once tunnel has no active connections
+	waitIdle chan chan struct{}
+	// Settings of the tunnel. Owned by the tunnel goroutine.
+	settings       TunnelSettings
+	updateSettings chan TunnelSettings
+	// Priority rules (nil if there are none) and limiters of priority levels
+	// below the highest one present. Owned by the tunnel goroutine.
+	priorities       *prioritySet
+	updatePriorities chan *prioritySet
+	priorityLevels   map[int]*priorityLevel
+	// Limits of subnets (nil if there are none). Owned by the tunnel goroutine.
+	subnets       *subnetTrie
+	updateSubnets chan *subnetTrie
+	// Limits of backends (nil if there are none). Owned by the tunnel
+	// goroutine.
+	backends       backendSet
+	updateBackends chan backendSet
+	// Number of connections considered for telemetry sampling. Owned by the
+	// tunnel goroutine.
+	telemetrySeq int
+	// TLS configuration to connect to upstream with (nil if upstream isn't
+	// encrypted). Owned by the tunnel goroutine.
+	upstreamTLS       *tls.Config
+	updateUpstreamTLS chan *tls.Config
+	// Hops to dial upstream through (nil if it's dialed directly). Owned by
+	// the tunnel goroutine.
+	via       *hopChain
+	updateVia chan *hopChain
+	// Idle upstream connections kept for reuse
+	pool           *upstreamPool
+	identityGroups *IdentityGroups
+	workerPools    *WorkerPools
+	dials          *DialGate
+	resolvers      *Resolvers
+	// Connections of clients to destinations, created anew whenever tunnel
+	// starts serving. Owned by the tunnel goroutine.
+	dedup *dedupGuard
+	// Active connections, read concurrently by stats and admin API
+	connections *connectionRegistry
+	waitGroup   *sync.WaitGroup
+	// Counters are updated atomically by forwarders of all tunnel connections
+	counters *TunnelCounters
+	meter    *rateMeter
+	// Throttling observed in observe-only mode, updated atomically
+	observed *limiter.ObservedThrottling
+	// Traffic exceeding shadow limits, updated atomically
+	shadowed *limiter.ObservedThrottling
+	// Time connections spent waiting for limiters, updated atomically
+	waits     *limiter.WaitStats
+	waitMeter *rateMeter
+	// Upstream latencies of all tunnel connections, updated atomically
+	latency *latencyStats
+	// Data forwarded against transfer quota
+	quota *tunnelQuota
+	// Latest snapshot of limit classes ([]ClassStats)
+	classStats atomic.Value
+	// Fairness of connection throughput, averaged by fairnessMeter (Fairness)
+	fairness      atomic.Value
+	fairnessMeter fairnessMeter
+	// Least severe messages tunnel logs (LogLevel)
+	logLevel atomic.Value
+	// Simulated network impairment of forwarded chunks (impairment)
+	impairment *atomic.Value
+	// Listen backlog set on listening socket (zero if it's the default one).
+	// Owned by the tunnel goroutine.
+	listenBacklog int
+	// Latest snapshot of tunnel limiters (*Buckets)
+	buckets atomic.Value
+	// Address tunnel listens at (net.Addr), which tells the port kernel picked
+	// if listenAt has zero port
+	addr   atomic.Value
+	events *EventBus
+	// Name of a tenant tunnel belongs to (string)
+	tenant atomic.Value
+	// Non-zero if tunnel rejects new connections (accessed atomically)
+	draining int32
+	// Whether tunnel is suspended outside of its active windows. Owned by the
+	// tunnel goroutine.
+	suspended        suspension
+	updateSuspension chan suspension
+	// Since when tunnel uses most of its limit (zero if it doesn't) and
+	// whether that was reported. Owned by the tunnel goroutine.
+	saturatedSince     time.Time
+	saturationReported bool
+	shutdownOnce       sync.Once
+	// Closed to force shutdown once context of ShutdownContext expires
+	force     chan struct{}
+	forceOnce sync.Once
+	// What failed to stop cleanly during forced shutdown
+	shutdownMu *sync.Mutex
+	forced     int
+	stuck      []uint64
+	// Numbers of connections ended for each reason
+	closedMu *sync.Mutex
+	closed   CloseReasonCounts
+	admit    AdmitFunc
+	onClose  CloseFunc
+	labeled  *labeledTraffic
+
+	// Number of shards to collect completions of connections in
+	completionShards int
+	// Limiter pacing accepts of new connections (*rate.Limiter, nil if
+	// accept rate isn't limited)
+	acceptLimiter atomic.Value
+}
+
+// StatsSource is implemented by anything that reports traffic statistics in
+// the form of TunnelStats (e.g. Tunnel)
+type StatsSource interface {
+	Stats() TunnelStats
+}
+
+var _ StatsSource = (*Tunnel)(nil)
+
+// Stats returns current statistics of a tunnel. Safe to call concurrently.
+func (t *Tunnel) Stats() TunnelStats {
+	return TunnelStats{
+		Counters:   loadCounters(t.counters),
+		Throughput: t.meter.throughput(),
+		Observed:   loadObserved(t.observed),
+		Shadow:     loadObserved(t.shadowed),
+		Closed:     t.closeCounts(),
+		Labeled:    t.labeled.load(),
+		Waits:      loadWaits(t.waits, t.waitMeter),
+		Latency:    t.latency.load(),
+		Buckets:    t.loadBuckets(),
+		Quota:      t.quota.load(),
+		Classes:    t.loadClassStats(),
+		Fairness:   t.loadFairness(),
+	}
+}
+
+// shadowLogInterval is how often tunnels log traffic exceeding their shadow
+// limits
+const shadowLogInterval = time.Minute
+
+// shadowViolationLog keeps track of shadow limit violations that were already
+// logged
+type shadowViolationLog struct {
+	next   time.Time
+	logged ObservedThrottling
+}
+
+// report logs violations of shadow limits that happened since the last report
+func (s *shadowViolationLog) report(t *Tunnel, current ObservedThrottling) {
+	delayed := current.DelayedBytes - s.logged.DelayedBytes
+	blocked := current.BlockedBytes - s.logged.BlockedBytes
+	if delayed == 0 && blocked == 0 {
+		return
+	}
+	t.logf(LogWarn, "Tunnel at %q exceeded shadow limits: %d bytes would have been "+
+		"delayed by %v in total, %d bytes blocked", t.listenAt, delayed,
+		time.Duration(current.Delay-s.logged.Delay), blocked)
+	s.logged = current
+}
+
+// addCounters adds given values to tunnel counters. This is used to carry
+// accounting over from a previous run.
+func (t *Tunnel) addCounters(c TunnelCounters) {
+	atomic.AddInt64(&t.counters.IngressBytes, c.IngressBytes)
+	atomic.AddInt64(&t.counters.EgressBytes, c.EgressBytes)
 }
 
 // UpdateLimits sets new bandwidth limits for a tunnel. All active connections
 // of given tunnel are notified and have their limits updated as well.
-func (t Tunnel) UpdateLimits(newLimits TunnelLimits) {
+func (t *Tunnel) UpdateLimits(newLimits TunnelLimits) {
 	select {
 	case t.updateLimits <- newLimits:
 	case <-t.shutdown:
 	}
 }
 
+// UpdateSharedLimiters sets limiters that this tunnel shares with other tunnels.
+// All active connections of given tunnel have their limits updated as well.
+func (t *Tunnel) UpdateSharedLimiters(shared []*rate.Limiter) {
+	select {
+	case t.updateShared <- shared:
+	case <-t.shutdown:
+	}
+}
+
+// UpdateExemptions changes clients and upstreams bypassing throttling. Active
+// connections are exempted or get throttled again according to new
+// exemptions.
+func (t *Tunnel) UpdateExemptions(e Exemptions) error {
+	matcher, err := e.matcher()
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateExemptions <- matcher:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// UpdateUpstreamTLS changes TLS settings of connections to upstream (nil
+// disables TLS). Active connections are not affected.
+func (t *Tunnel) UpdateUpstreamTLS(u *UpstreamTLS) error {
+	config, err := u.config(t.connectTo)
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateUpstreamTLS <- config:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// UpdateVia changes hops connections to upstream are made through (none if
+// empty). Active connections are not affected.
+func (t *Tunnel) UpdateVia(hops []Hop) error {
+	chain, err := newHopChain(hops)
+	if err != nil {
+		return err
+	}
+	select {
+	case t.updateVia <- chain:
+		return nil
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// errConnectionNotFound is returned when there is no active tunnel connection
+// with a given identifier
+var errConnectionNotFound = errors.New("Connection not found")
+
+type connectionLimitUpdate struct {
+	id uint64
+	// Nil limit moves connection back to the tunnel connection limit
+	limit *Limit
+	done  chan error
+}
+
+// UpdateConnectionLimit moves an active connection to a different
+// per-connection limit without interrupting it. Nil limit makes connection
+// subject to the tunnel connection limit again. Connection keeps its own limit
+// when tunnel limits are updated.
+func (t *Tunnel) UpdateConnectionLimit(id uint64, limit *Limit) error {
+	done := make(chan error, 1)
+	select {
+	case t.updateConnection <- connectionLimitUpdate{
+		id:    id,
+		limit: limit,
+		done:  done,
+	}:
+		return <-done
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+type connectionClose struct {
+	id   uint64
+	done chan error
+}
+
+// CloseConnection forcibly closes an active tunnel connection
+func (t *Tunnel) CloseConnection(id uint64) error {
+	done := make(chan error, 1)
+	select {
+	case t.closeConnection <- connectionClose{
+		id:   id,
+		done: done,
+	}:
+		return <-done
+	case <-t.shutdown:
+		return ErrTunnelClosed
+	}
+}
+
+// SetDraining makes tunnel reject new connections (or accept them again)
+// while letting active connections run to completion
+func (t *Tunnel) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	if atomic.SwapInt32(&t.draining, v) != v {
+		if draining {
+			t.logf(LogInfo, "Tunnel at %q is draining", t.listenAt)
+		} else {
+			t.logf(LogInfo, "Tunnel at %q is accepting connections again", t.listenAt)
+		}
+	}
+}
+
+// Draining tells whether tunnel rejects new connections
+func (t *Tunnel) Draining() bool {
+	return atomic.LoadInt32(&t.draining) != 0
+}
+
+// Addr returns the address tunnel listens at. Unlike listenAt, it tells the
+// port kernel picked for a tunnel listening at zero port. Safe to call
+// concurrently.
+func (t *Tunnel) Addr() net.Addr {
+	return t.addr.Load().(net.Addr)
+}
+
+// ConnectionInfo describes an active tunnel connection
+type ConnectionInfo struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream"`
+	Opened   time.Time `json:"opened"`
+	// Per-connection limit currently in effect (lower than configured one
+	// during slow start) and whether it was set for this connection
+	// specifically
+	Limit    Limit `json:"limit"`
+	OwnLimit bool  `json:"ownLimit,omitempty"`
+	// Connection bypasses throttling
+	Exempt bool `json:"exempt,omitempty"`
+	// Labels attached to connection upon admission
+	Labels Labels `json:"labels,omitempty"`
+	// Original source told by PROXY protocol header, server name client asked
+	// for and identity of its certificate (see MatchRule)
+	Source     string `json:"source,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	// Deep telemetry (e.g. a recording) is collected for connection
+	Sampled bool `json:"sampled,omitempty"`
+	// Limit class connection belongs to
+	Class string `json:"class,omitempty"`
+	// Subnet connection shares the limit of
+	Subnet string `json:"subnet,omitempty"`
+	// Backend connection shares the limit of
+	Backend string `json:"backend,omitempty"`
+	// Paths to client and upstream as seen by the kernel (Linux only)
+	ClientTCP   *TCPInfo `json:"clientTcp,omitempty"`
+	UpstreamTCP *TCPInfo `json:"upstreamTcp,omitempty"`
+	// Connections of higher priority are served from tunnel limit first
+	Priority int            `json:"priority,omitempty"`
+	Stats    TunnelStats    `json:"stats"`
+	Traffic  TrafficPattern `json:"traffic"`
+}
+
+// TrafficPattern describes recent traffic of a connection
+type TrafficPattern struct {
+	// One of "idle", "interactive" or "bulk"
+	Class limiter.TrafficClass `json:"class"`
+	// Moving averages of the size of chunks of data connection transfers and of
+	// time between them
+	AverageChunkSize int      `json:"averageChunkSize"`
+	AverageInterval  Duration `json:"averageInterval"`
+}
+
+// Connections returns active connections of a tunnel ordered by identifier
+func (t *Tunnel) Connections() []ConnectionInfo {
+	connections := t.connections.all()
+	result := make([]ConnectionInfo, 0, len(connections))
+	for _, conn := range connections {
+		result = append(result, t.connectionInfo(conn))
+	}
+	return result
+}
+
+// connectionInfo describes an active connection. Safe to call concurrently.
+func (t *Tunnel) connectionInfo(c *Connection) ConnectionInfo {
+	limit, own := c.listener.ConnectionLimit(c.ingress)
+	result := ConnectionInfo{
+		ID:         c.ID(),
+		Client:     c.ingress.RemoteAddr().String(),
+		Upstream:   c.egress.RemoteAddr().String(),
+		Opened:     c.opened,
+		Limit:      Limit(limit),
+		OwnLimit:   own,
+		Exempt:     c.listener.ConnectionExempt(c.ingress),
+		Labels:     c.labels,
+		Sampled:    c.sampled,
+		ServerName: c.serverName,
+		Identity:   c.certIdentity,
+		Stats: TunnelStats{
+			Counters:   loadCounters(&c.counters),
+			Throughput: c.meter.throughput(),
+			Latency:    c.latency.load(),
+		},
+	}
+	if c.source != nil {
+		result.Source = c.source.String()
+	}
+	result.Class, _ = c.className.Load().(string)
+	result.Subnet, _ = c.subnetName.Load().(string)
+	result.Backend, _ = c.backendName.Load().(string)
+	result.Priority = c.loadPriority()
+	result.ClientTCP = loadTCPInfo(c.ingress)
+	result.UpstreamTCP = loadTCPInfo(c.egress)
+	if limConn, ok := c.ingress.(*limiter.LimitedConnection); ok {
+		pattern := limConn.TrafficPattern()
+		observed := limConn.Observed()
+		result.Stats.Observed = loadObserved(&observed)
+		shadowed := limConn.Shadowed()
+		result.Stats.Shadow = loadObserved(&shadowed)
+		waits := limConn.Waits()
+		result.Stats.Waits = loadWaits(&waits, c.waitMeter)
+		result.Stats.Buckets = t.connectionBuckets(c)
+		result.Traffic = TrafficPattern{
+			Class:            pattern.Class,
+			AverageChunkSize: int(pattern.AverageChunkSize),
+			AverageInterval:  Duration(pattern.AverageInterval),
+		}
+	}
+	return result
+}
+
+// configureListener applies limit settings beyond tunnel and connection
+// limits to tunnel listener
+func (t *Tunnel) configureListener(limits TunnelLimits) {
+	t.listener.UpdateSlowStart(limits.slowStart())
+	t.listener.UpdateInteractiveBoost(int(limits.InteractiveBoost))
+	t.listener.UpdateObserveOnly(limits.ObserveOnly, t.observed)
+	t.listener.UpdateShadowLimits(int(limits.ShadowTunnelLimit),
+		int(limits.ShadowConnectionLimit), t.shadowed)
+	t.listener.UpdateWaitTotals(t.waits)
+	t.listener.UpdateBurstDuration(time.Duration(limits.BurstDuration))
+	t.listener.UpdateBursts(limits.TunnelBurst, limits.ConnectionBurst)
+	t.listener.UpdateDirectionLimits(int(limits.UploadLimit), int(limits.DownloadLimit),
+		int(limits.ConnectionUploadLimit), int(limits.ConnectionDownloadLimit))
+	t.listener.UpdateClientLimit(int(limits.ClientLimit))
+	t.listener.UpdateAlgorithm(limiter.Algorithm(limits.Algorithm))
+	t.applyListenBacklog(limits)
+}
+
+// setTenant changes the tenant tunnel events are tagged with
+func (t *Tunnel) setTenant(tenant string) {
+	t.tenant.Store(tenant)
+}
+
+// connectionClosed logs, accounts and publishes completion of a connection
+// that is no longer active
+func (t *Tunnel) connectionClosed(conn *Connection, reason CloseReason,
+	counters TunnelCounters, err error) {
+	cause := string(reason)
+	if err != nil {
+		cause += ": " + err.Error()
+	}
+	if len(conn.labels) > 0 {
+		cause += ", labels " + conn.labels.String()
+	}
+	t.logf(LogDebug, "Closed connection %d at %q (%s): %d bytes ingress, %d bytes egress",
+		conn.ID(), t.listenAt, cause, counters.IngressBytes, counters.EgressBytes)
+	conn.identity.release()
+	conn.worker.release()
+	t.countClose(reason)
+	e := &ConnectionEvent{
+		ID:           conn.ID(),
+		Client:       conn.ingress.RemoteAddr().String(),
+		Labels:       conn.labels,
+		Reason:       reason,
+		ClosedBy:     reason.side(),
+		IngressBytes: counters.IngressBytes,
+		EgressBytes:  counters.EgressBytes,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.publish(EventConnectionClosed, e)
+	t.notifyClosed(conn, reason, counters, err)
+}
+
+// notifyClosed passes a closed connection to OnClose hook
+func (t *Tunnel) notifyClosed(conn *Connection, reason CloseReason, counters TunnelCounters,
+	err error) {
+	t.dedup.ended(conn)
+	if t.onClose == nil {
+		return
+	}
+	t.onClose(conn.ctx, ClosedConnection{
+		ID:       conn.ID(),
+		Client:   conn.ingress.RemoteAddr().String(),
+		Labels:   conn.labels,
+		Reason:   reason,
+		Counters: counters,
+		Err:      err,
+	})
+}
+
+// publish publishes an event about a given tunnel connection
+func (t *Tunnel) publish(eventType EventType, e *ConnectionEvent) {
+	t.events.Publish(Event{
+		Type:       eventType,
+		ListenAt:   t.listenAt,
+		Tenant:     t.tenant.Load().(string),
+		Connection: e,
+	})
+}
+
 // Shutdown shuts the tunnel down and blocks until shutdown process is complete.
 // This means waiting until all connections and listening socket get close.
-func (t Tunnel) Shutdown() {
-	close(t.shutdown)
-	t.waitGroup.Wait()
+// Calling Shutdown more than once is harmless.
+//
+// Steps of shutdown always go in this order:
+//  1. Tunnel stops accepting connections. Clients connecting meanwhile wait in
+//     listen backlog.
+//  2. Active connections, connections waiting for a slot and connections
+//     being dialed are closed, OnClose hook is notified about each of them.
+//  3. Tunnel waits for forwarders of active connections to stop, so no data
+//     is forwarded after that.
+//  4. Listening socket is closed, refusing clients left in listen backlog.
+//
+// Shutdown blocks forever if a forwarder hangs, see ShutdownContext.
+func (t *Tunnel) Shutdown() {
+	t.ShutdownContext(context.Background())
+}
+
+// ShutdownContext shuts the tunnel down like Shutdown, but once a given
+// context expires, connections whose forwarders are still running are closed
+// forcibly (all active connections if it has expired already). Returns
+// *ShutdownError describing what failed to stop cleanly, nil if everything
+// did.
+func (t *Tunnel) ShutdownContext(ctx context.Context) error {
+	if ctx.Err() != nil {
+		t.forceOnce.Do(func() {
+			close(t.force)
+		})
+	}
+	t.shutdownOnce.Do(func() {
+		close(t.shutdown)
+	})
+	stopped := make(chan struct{})
+	go func() {
+		t.waitGroup.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return t.shutdownError(false)
+	case <-ctx.Done():
+	}
+	t.forceOnce.Do(func() {
+		close(t.force)
+	})
+	// Tunnel goroutine gives forwarders forceCloseGrace to stop after forcing
+	timer := time.NewTimer(2 * forceCloseGrace)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		return t.shutdownError(false)
+	case <-timer.C:
+		t.logf(LogError, "Tunnel at %q didn't stop in time", t.listenAt)
+		return t.shutdownError(true)
+	}
+}
+
+// Closed tells whether tunnel was shut down. Safe to call concurrently.
+func (t *Tunnel) Closed() bool {
+	select {
+	case <-t.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultCloseTimeout is how long Close waits for active connections to
+// complete before closing them
+const DefaultCloseTimeout = 30 * time.Second
+
+var _ io.Closer = (*Tunnel)(nil)
+
+// Close is an implementation of io.Closer. It shuts the tunnel down
+// gracefully with DefaultCloseTimeout.
+func (t *Tunnel) Close() error {
+	return t.ShutdownGracefully(DefaultCloseTimeout)
+}
+
+// ShutdownGracefully stops accepting connections, waits up to a given timeout
+// for active connections to complete and then shuts the tunnel down with
+// ShutdownContext. Connections still active by then are closed forcibly and
+// reported by *ShutdownError.
+func (t *Tunnel) ShutdownGracefully(timeout time.Duration) error {
+	t.SetDraining(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case <-t.idle():
+	case <-ctx.Done():
+	}
+	return t.ShutdownContext(ctx)
+}
+
+// idle returns a channel closed once tunnel has no active connections
+func (t *Tunnel) idle() <-chan struct{} {
+	result := make(chan struct{})
+	select {
+	case t.waitIdle <- result:
+	case <-t.shutdown:
+		close(result)
+	}
+	return result
 }
 
 // NewTunnel creates a traffic forwarding tunnel with a given listen port
 // spec and configuration. Inbound connection listening begins immediately.
-func NewTunnel(listenAt ListenAt, connectTo ConnectTo, limits TunnelLimits) (*Tunnel, error) {
+func NewTunnel(listenAt ListenAt, connectTo ConnectTo, limits TunnelLimits,
+	opts TunnelOptions) (*Tunnel, error) {
+	return NewTunnelContext(context.Background(), listenAt, connectTo, limits, opts)
+}
+
+// NewTunnelContext is like NewTunnel, but the tunnel is shut down once a given
+// context is cancelled: it stops listening or retrying to listen and closes
+// its connections.
+func NewTunnelContext(ctx context.Context, listenAt ListenAt, connectTo ConnectTo,
+	limits TunnelLimits, opts TunnelOptions) (*Tunnel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.Settings.validate(); err != nil {
+		return nil, err
+	}
 	shutdown := make(chan struct{})
 	updateLimitsChan := make(chan TunnelLimits)
 	wg := new(sync.WaitGroup)
 
-	log.Printf("Starting tunnel at %q", listenAt)
-
-	l, err := net.Listen("tcp", string(listenAt))
+	exemptions, err := opts.Exemptions.matcher()
+	if err != nil {
+		return nil, err
+	}
+	classes, err := opts.Classes.set()
+	if err != nil {
+		return nil, err
+	}
+	access, err := opts.Access.set()
+	if err != nil {
+		return nil, err
+	}
+	priorities, err := opts.Priorities.set()
 	if err != nil {
-		log.Printf("Failed to listen at %q: %v", listenAt, err)
 		return nil, err
 	}
+	subnets, err := opts.Subnets.trie()
+	if err != nil {
+		return nil, err
+	}
+	backends, err := opts.Backends.set()
+	if err != nil {
+		return nil, err
+	}
+	upstreamTLS, err := opts.UpstreamTLS.config(connectTo)
+	if err != nil {
+		return nil, err
+	}
+	via, err := newHopChain(opts.Via)
+	if err != nil {
+		return nil, err
+	}
+
+	logAt(opts.Settings.LogLevel, LogInfo, "Starting tunnel at %q", listenAt)
+
+	l, err := opts.listen(listenAt)
+	if err != nil {
+		logAt(opts.Settings.LogLevel, LogError, "Failed to listen at %q: %v", listenAt, err)
+		if isAddrInUse(err) {
+			return nil, &ListenConflictError{ListenAt: listenAt}
+		}
+		return nil, &Error{Kind: ErrListenFailed, Err: err}
+	}
+	opts.Listener = nil
 	// It's internal Tunnel's run() responsibility to close the listener
 	result := &Tunnel{
 		listenAt:  listenAt,
 		connectTo: connectTo,
+		ports:     newPortMapping(listenAt, connectTo),
 		shutdown:  shutdown,
 		listener: limiter.NewRateLimitingListener(
 			l, int(limits.TunnelLimit), int(limits.ConnectionLimit)),
 		currentLimits: limits,
 		updateLimits:  updateLimitsChan,
+		updateShared:  make(chan []*rate.Limiter),
 		waitGroup:     wg,
+
+		updateConnection: make(chan connectionLimitUpdate),
+		boostConnection:  make(chan connectionBoostRequest),
+		closeConnection:  make(chan connectionClose),
+		exemptions:       exemptions,
+		updateExemptions: make(chan *exemptionMatcher),
+		classes:          classes,
+		updateClasses:    make(chan *classSet),
+		access:           access,
+		updateAccess:     make(chan *accessSet),
+		waitIdle:         make(chan chan struct{}),
+		settings:         opts.Settings,
+		updateSettings:   make(chan TunnelSettings),
+		priorities:       priorities,
+		updatePriorities: make(chan *prioritySet),
+		subnets:          subnets,
+		updateSubnets:    make(chan *subnetTrie),
+		backends:         backends,
+		updateBackends:   make(chan backendSet),
+
+		upstreamTLS:       upstreamTLS,
+		updateUpstreamTLS: make(chan *tls.Config),
+		via:               via,
+		updateVia:         make(chan *hopChain),
+		updateSuspension:  make(chan suspension),
+		connections:       newConnectionRegistry(),
+		counters:          new(TunnelCounters),
+		meter:             newRateMeter(),
+		observed:          new(limiter.ObservedThrottling),
+		shadowed:          new(limiter.ObservedThrottling),
+		waits:             new(limiter.WaitStats),
+		waitMeter:         newRateMeter(),
+		latency:           new(latencyStats),
+		quota:             newTunnelQuota(time.Now(), limits, opts.Quota),
+		force:             make(chan struct{}),
+		shutdownMu:        new(sync.Mutex),
+		closedMu:          new(sync.Mutex),
+		closed:            make(CloseReasonCounts),
+		admit:             opts.Admit,
+		onClose:           opts.OnClose,
+		labeled:           newLabeledTraffic(),
+		events:            opts.Events,
+		pool:              newUpstreamPool(),
+		identityGroups:    opts.IdentityGroups,
+		workerPools:       opts.WorkerPools,
+		dials:             opts.Dials,
+		resolvers:         opts.Resolvers,
+		completionShards:  opts.CompletionShards,
 	}
+	result.setTenant(opts.Tenant)
+	result.addr.Store(l.Addr())
+	result.logLevel.Store(opts.Settings.LogLevel)
+	result.impairment = new(atomic.Value)
+	result.impairment.Store(limits.impairment())
+	result.acceptLimiter.Store(limits.acceptLimiter())
+	result.configureListener(limits)
+	result.pool.configure(limits)
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-
-		retry := make(chan struct{})
+		defer result.pool.close()
 
 		for {
-			if result.listener != nil {
-				err := result.run()
-				if err == nil {
-					return
-				}
-				// err is not nil, which means that there was an error trying to accept
-				// connection. This means that listening socket is no longer in a valid
-				// state. Retry listening
-				err = result.listener.Close()
-				if err != nil {
-					log.Printf("Failed to close listening socket for %q after discovering "+
-						"accept failure: %v", listenAt, err)
+			err := result.run()
+			if err == nil || result.Closed() {
+				return
+			}
+			if err != errTunnelSuspended {
+				// err is not nil, which means that there was an error trying to
+				// accept connection. This means that listening socket is no longer
+				// in a valid state. Retry listening
+				result.logf(LogError, "Failed to accept connection on listener %q: %v",
+					listenAt, err)
+				if err := result.listener.Close(); err != nil {
+					result.logf(LogError, "Failed to close listening socket for %q after "+
+						"discovering accept failure: %v", listenAt, err)
 					// Don't exit, try to recover anyways.
 				}
-				result.listener = nil
-				log.Printf("Failed to accept connection on listener %q: %v", listenAt, err)
+				result.publishTunnel(EventListenerFailed, err)
 			}
-
-			// Wait a bit before trying to recreate listener socket
-			go func() {
-				time.Sleep(5 * time.Second)
-				retry <- struct{}{}
-			}()
-
-			select {
-			case <-retry:
-				l, err := net.Listen("tcp", string(listenAt))
-				if err != nil {
-					log.Printf("Failed to listen at %q: %v", listenAt, err)
-				} else {
-					result.listener = limiter.NewRateLimitingListener(
-						l, int(result.currentLimits.TunnelLimit),
-						int(result.currentLimits.ConnectionLimit))
-				}
-			case <-shutdown:
-				log.Printf("Detected tunnel shutdown while retrying listening at %q", listenAt)
+			result.listener = nil
+			if !result.retryListen(opts) {
 				return
-			} // select
-		} // for
+			}
+		}
 	}()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				result.logf(LogInfo, "Shutting down tunnel at %q since its context is done",
+					listenAt)
+				result.Shutdown()
+			case <-shutdown:
+			}
+		}()
+	}
 
 	return result, nil
 }
 
+// listenRetryInterval is how long a tunnel waits before trying to recreate
+// its listening socket after a failure
+var listenRetryInterval = 5 * time.Second
+
+// retryListen recreates listening socket of a tunnel, retrying every
+// listenRetryInterval. Requests to a tunnel are served meanwhile: limit
+// updates are remembered to be applied to the new listener and there are no
+// connections to list, update or close. Tunnel suspended with its listener
+// closed doesn't listen until it is resumed. Returns false if tunnel got shut
+// down before it could listen again.
+func (t *Tunnel) retryListen(opts TunnelOptions) bool {
+	timer := time.NewTimer(listenRetryInterval)
+	defer timer.Stop()
+	failures := 0
+	for {
+		select {
+		case <-timer.C:
+			if t.suspended == suspendClose {
+				continue
+			}
+			l, err := opts.listen(t.listenAt)
+			if err != nil {
+				t.logf(LogError, "Failed to listen at %q: %v", t.listenAt, err)
+				failures++
+				if failures == t.settings.listenRetries() {
+					t.logf(LogError, "Tunnel at %q failed to listen again %d times",
+						t.listenAt, failures)
+					t.publishTunnel(EventListenRetriesExhausted, err)
+				}
+				timer.Reset(listenRetryInterval)
+				continue
+			}
+			t.addr.Store(l.Addr())
+			t.listener = limiter.NewRateLimitingListener(
+				l, int(t.tunnelLimit(t.currentLimits)), int(t.currentLimits.ConnectionLimit))
+			t.listenBacklog = 0
+			t.listener.UpdateSharedLimiters(t.currentShared)
+			t.configureListener(t.currentLimits)
+			t.logf(LogInfo, "Tunnel at %q is listening again", t.listenAt)
+			t.publishTunnel(EventListenerRestored, nil)
+			return true
+
+		case limits := <-t.updateLimits:
+			t.updateAcceptRate(t.currentLimits, limits)
+			t.currentLimits = limits
+			t.impairment.Store(limits.impairment())
+			t.pool.configure(limits)
+			t.logf(LogInfo, "Tunnel at %q limits updated: %v", t.listenAt, limits)
+
+		case shared := <-t.updateShared:
+			t.currentShared = shared
+
+		case update := <-t.updateConnection:
+			update.done <- errConnectionNotFound
+
+		case request := <-t.boostConnection:
+			request.done <- errConnectionNotFound
+
+		case exemptions := <-t.updateExemptions:
+			t.exemptions = exemptions
+			t.logf(LogInfo, "Tunnel at %q exemptions updated", t.listenAt)
+
+		case classes := <-t.updateClasses:
+			t.classes = classes
+			t.logf(LogInfo, "Tunnel at %q limit classes updated", t.listenAt)
+
+		case access := <-t.updateAccess:
+			t.access = access
+			t.logf(LogInfo, "Tunnel at %q access rules updated", t.listenAt)
+
+		case settings := <-t.updateSettings:
+			t.settings = settings
+			t.logLevel.Store(settings.LogLevel)
+			t.logf(LogInfo, "Tunnel at %q settings updated", t.listenAt)
+
+		case priorities := <-t.updatePriorities:
+			t.priorities = priorities
+			t.logf(LogInfo, "Tunnel at %q priority rules updated", t.listenAt)
+
+		case subnets := <-t.updateSubnets:
+			subnets.inherit(t.subnets)
+			t.subnets = subnets
+			t.logf(LogInfo, "Tunnel at %q subnet limits updated", t.listenAt)
+
+		case backends := <-t.updateBackends:
+			backends.inherit(t.backends)
+			t.backends = backends
+			t.logf(LogInfo, "Tunnel at %q backend limits updated", t.listenAt)
+
+		case config := <-t.updateUpstreamTLS:
+			t.upstreamTLS = config
+			// Pooled connections were established with previous settings
+			t.pool.flush()
+			t.logf(LogInfo, "Tunnel at %q upstream TLS settings updated", t.listenAt)
+
+		case chain := <-t.updateVia:
+			t.via = chain
+			t.pool.flush()
+			t.logf(LogInfo, "Tunnel at %q hops updated", t.listenAt)
+
+		case s := <-t.updateSuspension:
+			if s == t.suspended {
+				continue
+			}
+			if t.suspended == suspendClose {
+				// Listen right away
+				timer.Reset(0)
+			}
+			t.suspended = s
+			t.logSuspension(s)
+
+		case request := <-t.closeConnection:
+			request.done <- errConnectionNotFound
+
+		case idle := <-t.waitIdle:
+			close(idle)
+
+		case <-t.shutdown:
+			t.logf(LogInfo, "Detected tunnel shutdown while retrying listening at %q",
+				t.listenAt)
+			return false
+		}
+	}
+}
+
 type acceptedConnection struct {
 	connection net.Conn
 	err        error
 }
 
 func (t *Tunnel) run() error {
-	pendingConnection := make(chan acceptedConnection)
-	// In the very worst case we might find ourselves with an accepted connection
-	// in the pendingConnection channel that haven't been read out of it. That's
-	// why we are first deferring pendingConnection cleanup and only then
-	// deferring listener close (we want to have listener closed and acceptor
-	// thread failed with an error before we initiate pendingConnection wipe)
-	defer func() {
-		select {
-		case c := <-pendingConnection:
-			if c.connection != nil {
-				c.connection.Close()
-			}
-		default:
-		}
-	}()
-	defer t.listener.Close()
+	pendingConnection := make(chan acceptedConnection, t.currentLimits.AcceptQueue)
+	// Closed once we stop reading pendingConnection, so that acceptor doesn't
+	// block forever handing over a connection (or an error caused by closing
+	// the listener) nobody is going to take
+	stopAccept := make(chan struct{})
+	acceptorDone := make(chan struct{})
 
 	// Start acceptor goroutine. It accepts incoming connections and sends them
 	// to pendingConnection channel.
 	go func() {
+		defer close(acceptorDone)
 		for {
+			if !t.paceAccept() {
+				return
+			}
 			conn, err := t.listener.Accept()
-			if err != nil {
-				pendingConnection <- acceptedConnection{
-					connection: nil,
-					err:        err,
+			select {
+			case pendingConnection <- acceptedConnection{
+				connection: conn,
+				err:        err,
+			}:
+			case <-stopAccept:
+				if conn != nil {
+					conn.Close()
 				}
 				return
 			}
-			pendingConnection <- acceptedConnection{
-				connection: conn,
-				err:        nil,
+			if err != nil {
+				return
 			}
 		}
 	}()
 
-	activeConnections := make(map[*Connection]struct{})
-	completeChan := make(chan connectionComplete)
+	activeConnections := t.connections
+	completions := newCompletionShards(t.completionShards)
+	defer completions.stop()
+	meterTicker := time.NewTicker(meterInterval)
+	defer meterTicker.Stop()
+	shadowLog := shadowViolationLog{next: time.Now().Add(shadowLogInterval)}
+	t.inspectBuckets()
+	t.checkQuota(time.Now(), activeConnections)
+	dials := newDialScheduler()
+	t.dedup = newDedupGuard()
+	// Connections waiting for the number of connections to drop below maximum
+	var waiting []*Connection
+	// Channels to close once there are no active connections
+	var idleWaiters []chan struct{}
+	// Receives when a boost of one of connections expires
+	var boostExpiry <-chan time.Time
+	// Limits ramping towards current ones (nil if there are none) and ticks
+	// while they do
+	var ramp *limitRamp
+	var rampTick <-chan time.Time
+	var rampTicker *time.Ticker
 	defer func() {
-		for conn := range activeConnections {
-			conn.Close()
+		if rampTicker != nil {
+			rampTicker.Stop()
 		}
 	}()
+	defer func() {
+		// See Shutdown for the order of these steps
+		t.stopAccepting()
+		close(stopAccept)
+		<-acceptorDone
+		// Connections accepted, but never handled
+		for len(pendingConnection) > 0 {
+			if netConn := <-pendingConnection; netConn.connection != nil {
+				netConn.connection.Close()
+			}
+		}
+		t.closeConnections(activeConnections, waiting, dials)
+		t.listener.Close()
+	}()
 
 	for {
+		waiting = t.admitWaiting(waiting, activeConnections.len(), dials)
+		if len(idleWaiters) > 0 && activeConnections.len() == 0 {
+			for _, idle := range idleWaiters {
+				close(idle)
+			}
+			idleWaiters = nil
+		}
 		select {
 		case netConn := <-pendingConnection:
+			if netConn.err != nil && t.Closed() {
+				// Listener got closed because tunnel is shutting down, which
+				// isn't a reason to listen again
+				t.logf(LogInfo, "Tunnel at %q shutting down", t.listenAt)
+				return nil
+			}
 			if netConn.err != nil {
 				// We were unable to accept connection. I believe it's safe to assume
 				// that listening socket is no longer alive and therefore all
 				// connections previously accepted on that socket are dead as well.
 				// Which means it's probably safe to return (shutdown all active
 				// connections and try to reestablish the listener)
-				log.Printf("Detected that we are unable to accept connection at %q: %v",
-					t.listenAt, netConn.err)
+				t.logf(LogError, "Detected that we are unable to accept connection at "+
+					"%q: %v", t.listenAt, netConn.err)
 				return netConn.err
 			}
 
-			log.Printf("Accepted connection at %q", t.listenAt)
+			if t.Draining() {
+				t.logf(LogWarn, "Rejected connection at %q since tunnel is draining",
+					t.listenAt)
+				netConn.connection.Close()
+				t.countClose(CloseRejected)
+				continue
+			}
+			if t.suspended != notSuspended {
+				t.logf(LogWarn, "Rejected connection at %q since tunnel is suspended",
+					t.listenAt)
+				netConn.connection.Close()
+				t.countClose(CloseRejected)
+				continue
+			}
+			if t.quotaBlocked() {
+				t.logf(LogWarn, "Rejected connection at %q since tunnel quota is exhausted",
+					t.listenAt)
+				netConn.connection.Close()
+				t.countClose(CloseQuotaExhausted)
+				continue
+			}
 
-			conn := NewConnection(netConn.connection, t.connectTo)
-			connDone, err := conn.Run()
-			if err != nil {
-				log.Printf("Failed to connect to %q: %v", t.connectTo, err)
+			admission := Admission{Context: context.Background()}
+			if t.admit != nil {
+				admission = t.admit(admission.Context, netConn.connection.RemoteAddr())
+				if admission.Context == nil {
+					admission.Context = context.Background()
+				}
+			}
+			if admission.Reject {
+				t.logf(LogWarn, "Rejected connection at %q by admission", t.listenAt)
 				netConn.connection.Close()
-			} else {
-				activeConnections[conn] = struct{}{}
-				go func(conn *Connection, connDone chan error) {
-					for v := range connDone {
-						select {
-						case completeChan <- connectionComplete{
-							connection: conn,
-							err:        v,
-						}:
-						case <-t.shutdown:
-							return
-						}
-					}
-				}(conn, connDone)
+				t.countClose(CloseRejected)
+				continue
 			}
 
-		case complete := <-completeChan:
-			if complete.err != nil {
-				log.Printf("Connection completed with failure: %v", complete.err)
+			t.logf(LogDebug, "Accepted connection at %q", t.listenAt)
+
+			conn := NewConnectionContext(admission.Context, netConn.connection,
+				t.connectionTarget(netConn.connection.LocalAddr()), t.counters)
+			conn.labels = admission.Labels.sanitize()
+			conn.admittedPriority = admission.Priority
+			conn.labeledCounters = t.labeled.countersFor(conn.labels)
+			conn.quotaUsed = &t.quota.used
+			conn.listener = t.listener
+			conn.tlsConfig = t.upstreamTLS
+			conn.via = t.via
+			conn.dials = t.dials
+			if t.via == nil && t.settings.UpstreamGreeting == "" && t.ports == nil {
+				// Forwarding through SSH hops can't be interrupted without
+				// closing the connection, so it can't be released to the pool.
+				// Upstream connections greeted on behalf of one client can't
+				// serve another one either, nor can connections to another
+				// port of a range.
+				conn.pool = t.pool
+			}
+			conn.balance = t.settings.Balance
+			conn.resolver = t.resolvers.get(t.settings.Resolver)
+			conn.coalesce = time.Duration(t.currentLimits.CoalesceDelay)
+			conn.upstreamGreeting = t.settings.UpstreamGreeting
+			conn.clientGreeting = t.settings.ClientGreeting
+			conn.sampled = t.sampleTelemetry()
+			if conn.sampled {
+				conn.recordDir = t.settings.RecordDir
+			}
+			conn.tunnelLatency = t.latency
+			conn.impairment = t.impairment
+			conn.ratePreamble = t.currentLimits.RatePreamble
+			conn.bandwidthTest = t.settings.BandwidthTest
+			conn.proxyProtocol = t.settings.ProxyProtocol
+			conn.inspectTLS = t.settings.InspectTLS
+			conn.access = t.access
+			conn.maxPreambleRate = t.currentLimits.preambleRate()
+			decision, superseded := t.dedup.admit(conn, time.Now(), t.currentLimits)
+			if superseded != nil {
+				t.logf(LogDebug, "Connection %d at %q superseded by connection %d of the "+
+					"same client", superseded.ID(), t.listenAt, conn.ID())
+				t.countClose(CloseSuperseded)
+				superseded.Close()
+				t.notifyClosed(superseded, CloseSuperseded, TunnelCounters{}, nil)
+			}
+			switch decision {
+			case dedupReject:
+				t.logf(LogWarn, "Rejected connection at %q since client %s has too many "+
+					"connections to %q", t.listenAt, conn.ingress.RemoteAddr(), conn.connectTo)
+				t.countClose(CloseRejected)
+				conn.Close()
+				t.notifyClosed(conn, CloseRejected, TunnelCounters{}, nil)
+				continue
+			case dedupRejectClient:
+				t.logf(LogWarn, "Rejected connection at %q since client %s has too many "+
+					"connections", t.listenAt, conn.ingress.RemoteAddr())
+				t.countClose(CloseRejected)
+				conn.Close()
+				t.notifyClosed(conn, CloseRejected, TunnelCounters{}, nil)
+				continue
+			case dedupHold:
+				t.logf(LogDebug, "Connection %d at %q waits for reconnect delay", conn.ID(),
+					t.listenAt)
+				continue
 			}
-			_, ok := activeConnections[complete.connection]
-			if ok {
-				delete(activeConnections, complete.connection)
-				complete.connection.Close()
-				log.Printf("Closed connection at %q", t.listenAt)
+			waiting = t.queueConnection(conn, waiting, activeConnections.len(), dials)
+
+		case key := <-t.dedup.released:
+			if conn := t.dedup.ready(key, time.Now()); conn != nil {
+				waiting = t.queueConnection(conn, waiting, activeConnections.len(), dials)
+			}
+
+		case dialed := <-dials.results:
+			if dialed.rejectErr == nil {
+				for _, queued := range dials.dialed(time.Now(), dialed.conn.connectTo,
+					dialed.err, t.currentLimits) {
+					t.dialFailed(queued, dials.recentFailure(time.Now(), queued.connectTo,
+						t.currentLimits))
+				}
+			}
+			dials.complete(dialed.conn, t.currentLimits)
+			conn := dialed.conn
+			if dialed.rejectErr != nil {
+				t.logf(LogWarn, "Rejected connection %d at %q: %v", conn.ID(), t.listenAt,
+					dialed.rejectErr)
+				t.countClose(CloseRejected)
+				conn.Close()
+				t.notifyClosed(conn, CloseRejected, TunnelCounters{}, dialed.rejectErr)
+				continue
+			}
+			if dialed.err != nil {
+				t.dialFailed(conn, dialed.err)
+				continue
+			}
+			conn.egress = dialed.egress
+			worker, ok := t.workerPools.acquire(t.currentLimits.WorkerPool)
+			if !ok {
+				t.logf(LogWarn, "Rejected connection %d at %q since worker pool %q is full",
+					conn.ID(), t.listenAt, t.currentLimits.WorkerPool)
+				t.countClose(CloseWorkerPoolFull)
+				conn.Close()
+				t.notifyClosed(conn, CloseWorkerPoolFull, TunnelCounters{}, nil)
+				continue
+			}
+			conn.worker = worker
+			if conn.dialTime > 0 {
+				conn.latency.recordDial(conn.dialTime)
+				t.latency.recordDial(conn.dialTime)
+			}
+			connDone := conn.forward()
+			activeConnections.add(conn)
+			t.applyExemption(conn)
+			t.applyIdentity(conn)
+			t.applyClass(conn)
+			t.applyPriority(conn)
+			t.applySubnet(conn)
+			t.applyBackend(conn)
+			if conn.testMode != "" {
+				// Test responder isn't an upstream connection to reuse
+				conn.pool = nil
+				t.logf(LogDebug, "Connection %d at %q runs %s bandwidth test", conn.ID(),
+					t.listenAt, conn.testMode)
+			}
+			if conn.requestedLimit != nil &&
+				t.listener.UpdateConnectionLimit(conn.ingress, int(*conn.requestedLimit)) {
+				t.logf(LogDebug, "Connection %d at %q requested limit %v", conn.ID(),
+					t.listenAt, *conn.requestedLimit)
+			}
+			t.publish(EventConnectionOpened, &ConnectionEvent{
+				ID:     conn.ID(),
+				Client: conn.ingress.RemoteAddr().String(),
+				Labels: conn.labels,
+			})
+			go func(conn *Connection, connDone chan connectionResult) {
+				for v := range connDone {
+					if !completions.complete(connectionComplete{
+						connection: conn,
+						err:        v.err,
+						closedBy:   v.closedBy,
+						counters:   loadCounters(&conn.counters),
+					}) {
+						return
+					}
+				}
+			}(conn, connDone)
+
+		case batch := <-completions.batches:
+			for _, complete := range batch {
+				t.connectionCompleted(activeConnections, complete)
 			}
 
 		case limits := <-t.updateLimits:
-			t.listener.UpdateLimits(int(limits.TunnelLimit), int(limits.ConnectionLimit))
-			log.Printf("Tunnel at %q limits updated: %v", t.listenAt, limits)
+			now := time.Now()
+			tunnelLimit, connectionLimit := t.rampLimits(ramp, now)
+			ramp = newLimitRamp(now, tunnelLimit, connectionLimit, limits)
+			if ramp == nil {
+				t.listener.UpdateLimits(int(t.tunnelLimit(limits)), int(limits.ConnectionLimit))
+			} else if rampTicker == nil {
+				rampTicker = time.NewTicker(rampInterval)
+				rampTick = rampTicker.C
+			}
+			t.configureListener(limits)
+			drain := limits.TightenPolicy == TightenDrain && tightened(t.currentLimits, limits)
+			regroup := limits.IdentityGroup != t.currentLimits.IdentityGroup
+			t.updateAcceptRate(t.currentLimits, limits)
+			t.currentLimits = limits
+			t.impairment.Store(limits.impairment())
+			t.pool.configure(limits)
+			dials.fill(limits)
+			t.logf(LogInfo, "Tunnel at %q limits updated: %v", t.listenAt, limits)
+			if regroup {
+				for _, conn := range activeConnections.all() {
+					t.applyIdentity(conn)
+				}
+			}
+			if drain {
+				t.drainHungry(activeConnections, limits)
+			}
+			t.checkQuota(time.Now(), activeConnections)
+
+		case shared := <-t.updateShared:
+			t.listener.UpdateSharedLimiters(shared)
+			t.currentShared = shared
+
+		case update := <-t.updateConnection:
+			update.done <- t.updateConnectionLimit(activeConnections, update)
+			boostExpiry = t.endBoosts(activeConnections, time.Now())
+
+		case request := <-t.boostConnection:
+			request.done <- t.boost(activeConnections, request)
+			boostExpiry = t.endBoosts(activeConnections, time.Now())
+
+		case now := <-rampTick:
+			tunnelLimit, connectionLimit := t.rampLimits(ramp, now)
+			t.listener.UpdateLimits(int(tunnelLimit), int(connectionLimit))
+			if ramp == nil || ramp.done(now) {
+				ramp = nil
+				rampTicker.Stop()
+				rampTicker, rampTick = nil, nil
+			}
+
+		case now := <-boostExpiry:
+			boostExpiry = t.endBoosts(activeConnections, now)
+
+		case exemptions := <-t.updateExemptions:
+			t.exemptions = exemptions
+			for _, conn := range activeConnections.all() {
+				t.applyExemption(conn)
+			}
+			t.logf(LogInfo, "Tunnel at %q exemptions updated", t.listenAt)
+
+		case classes := <-t.updateClasses:
+			t.classes = classes
+			for _, conn := range activeConnections.all() {
+				t.applyClass(conn)
+			}
+			t.balanceClasses(activeConnections)
+			t.logf(LogInfo, "Tunnel at %q limit classes updated", t.listenAt)
+
+		case access := <-t.updateAccess:
+			t.access = access
+			t.enforceAccess(activeConnections)
+			t.logf(LogInfo, "Tunnel at %q access rules updated", t.listenAt)
+
+		case settings := <-t.updateSettings:
+			t.settings = settings
+			t.logLevel.Store(settings.LogLevel)
+			t.logf(LogInfo, "Tunnel at %q settings updated", t.listenAt)
+
+		case priorities := <-t.updatePriorities:
+			t.priorities = priorities
+			for _, conn := range activeConnections.all() {
+				t.applyPriority(conn)
+			}
+			t.balancePriorities(activeConnections)
+			t.logf(LogInfo, "Tunnel at %q priority rules updated", t.listenAt)
+
+		case subnets := <-t.updateSubnets:
+			subnets.inherit(t.subnets)
+			t.subnets = subnets
+			for _, conn := range activeConnections.all() {
+				t.applySubnet(conn)
+			}
+			t.logf(LogInfo, "Tunnel at %q subnet limits updated", t.listenAt)
+
+		case backends := <-t.updateBackends:
+			backends.inherit(t.backends)
+			t.backends = backends
+			for _, conn := range activeConnections.all() {
+				t.applyBackend(conn)
+			}
+			t.logf(LogInfo, "Tunnel at %q backend limits updated", t.listenAt)
+
+		case config := <-t.updateUpstreamTLS:
+			t.upstreamTLS = config
+			// Pooled connections were established with previous settings
+			t.pool.flush()
+			t.logf(LogInfo, "Tunnel at %q upstream TLS settings updated", t.listenAt)
+
+		case chain := <-t.updateVia:
+			t.via = chain
+			t.pool.flush()
+			t.logf(LogInfo, "Tunnel at %q hops updated", t.listenAt)
+
+		case s := <-t.updateSuspension:
+			if s == t.suspended {
+				continue
+			}
+			t.suspended = s
+			t.logSuspension(s)
+			if s == suspendClose {
+				return errTunnelSuspended
+			}
+
+		case request := <-t.closeConnection:
+			request.done <- t.closeActiveConnection(activeConnections, request.id)
+
+		case idle := <-t.waitIdle:
+			idleWaiters = append(idleWaiters, idle)
+
+		case now := <-meterTicker.C:
+			t.meter.sample(now, loadCounters(t.counters).total())
+			t.waitMeter.sample(now, t.waits.Load().Time)
+			t.inspectBuckets()
+			t.checkQuota(now, activeConnections)
+			t.checkSaturation(now)
+			t.closeExpired(activeConnections, now)
+			t.dedup.prune(now, t.currentLimits)
+			for _, conn := range activeConnections.all() {
+				conn.meter.sample(now, loadCounters(&conn.counters).total())
+				if limConn, ok := conn.ingress.(*limiter.LimitedConnection); ok {
+					conn.waitMeter.sample(now, limConn.Waits().Time)
+				}
+			}
+			t.sampleFairness(now, activeConnections)
+			t.balanceClasses(activeConnections)
+			t.balancePriorities(activeConnections)
+			if !now.Before(shadowLog.next) {
+				shadowLog.report(t, loadObserved(t.shadowed))
+				shadowLog.next = now.Add(shadowLogInterval)
+			}
 
 		case <-t.shutdown:
-			log.Printf("Tunnel at %q shutting down", t.listenAt)
+			t.logf(LogInfo, "Tunnel at %q shutting down", t.listenAt)
 			return nil
 		} // select
 	} // for
 }
 
+// dialFailed closes a connection that couldn't be connected to upstream
+func (t *Tunnel) dialFailed(conn *Connection, err error) {
+	t.logf(LogWarn, "Failed to connect to %q (%s): %v", conn.connectTo, CloseDialFailure, err)
+	t.countClose(CloseDialFailure)
+	t.publish(EventConnectionFailed, &ConnectionEvent{
+		ID:     conn.ID(),
+		Client: conn.ingress.RemoteAddr().String(),
+		Labels: conn.labels,
+		Error:  err.Error(),
+		Reason: CloseDialFailure,
+	})
+	conn.Close()
+	t.notifyClosed(conn, CloseDialFailure, TunnelCounters{}, err)
+}
+
+// updateConnectionLimit applies a new limit to one of active connections
+func (t *Tunnel) updateConnectionLimit(activeConnections *connectionRegistry,
+	update connectionLimitUpdate) error {
+	conn := activeConnections.find(update.id)
+	if conn == nil {
+		return errConnectionNotFound
+	}
+	var ok bool
+	if update.limit != nil {
+		ok = t.listener.UpdateConnectionLimit(conn.ingress, int(*update.limit))
+	} else {
+		ok = t.listener.ResetConnectionLimit(conn.ingress)
+	}
+	if !ok {
+		return errConnectionNotFound
+	}
+	conn.boost = nil
+	if update.limit != nil {
+		t.logf(LogInfo, "Connection %d at %q limit updated: %v", update.id, t.listenAt,
+			*update.limit)
+	} else {
+		t.logf(LogInfo, "Connection %d at %q limit reset to tunnel connection limit",
+			update.id, t.listenAt)
+	}
+	t.events.Publish(Event{
+		Type:     EventConnectionUpdated,
+		ListenAt: t.listenAt,
+		Tenant:   t.tenant.Load().(string),
+		Connection: &ConnectionEvent{
+			ID:     conn.ID(),
+			Client: conn.ingress.RemoteAddr().String(),
+			Limit:  update.limit,
+		},
+	})
+	return nil
+}
+
+// applyExemption makes connection bypass throttling if it's exempt or makes
+// it subject to throttling otherwise
+func (t *Tunnel) applyExemption(conn *Connection) {
+	exempt := t.exemptions.match(conn.ingress.RemoteAddr(), conn.egress.RemoteAddr())
+	if exempt != t.listener.ConnectionExempt(conn.ingress) {
+		t.listener.SetConnectionExempt(conn.ingress, exempt)
+		if exempt {
+			t.logf(LogDebug, "Connection %d at %q is exempt from throttling", conn.ID(),
+				t.listenAt)
+		}
+	}
+}
+
+// applyIdentity makes connection share a limit with other connections of the
+// same client in tunnel identity group (if any)
+func (t *Tunnel) applyIdentity(conn *Connection) {
+	lease := t.identityGroups.acquire(t.currentLimits.IdentityGroup,
+		conn.ingress.RemoteAddr(), conn.labels)
+	if lease == nil && conn.identity == nil {
+		return
+	}
+	if !t.updateConnectionShared(conn, lease, conn.class, conn.priorityLevel, conn.subnet,
+		conn.backend) {
+		lease.release()
+		return
+	}
+	conn.identity.release()
+	conn.identity = lease
+	if lease != nil {
+		t.logf(LogDebug, "Connection %d at %q shares limit of %q in identity group %q",
+			conn.ID(), t.listenAt, lease.identity, t.currentLimits.IdentityGroup)
+	}
+}
+
+// updateConnectionShared makes connection share limiters of its identity,
+// limit class, priority level, subnet and backend (any of which may be nil)
+func (t *Tunnel) updateConnectionShared(conn *Connection, identity *identityLease,
+	class *limitClass, level *priorityLevel, subnet *subnetLimit,
+	backend *backendLimit) bool {
+	var limiters []*rate.Limiter
+	if identity != nil {
+		limiters = append(limiters, identity.limiter)
+	}
+	if class != nil {
+		limiters = append(limiters, class.limiter)
+	}
+	if level != nil {
+		limiters = append(limiters, level.limiter)
+	}
+	if subnet != nil {
+		limiters = append(limiters, subnet.limiter)
+	}
+	if backend != nil {
+		limiters = append(limiters, backend.limiter)
+	}
+	return t.listener.UpdateConnectionSharedLimiters(conn.ingress, limiters)
+}
+
+// connectionCompleted handles a connection that ended on its own
+func (t *Tunnel) connectionCompleted(activeConnections *connectionRegistry,
+	complete connectionComplete) {
+	if !activeConnections.remove(complete.connection) {
+		return
+	}
+	if complete.closedBy == ClosedByClient && complete.err == nil &&
+		complete.connection.pool != nil && t.pool.enabled() {
+		// Client is done, upstream connection might serve another one
+		go func(conn *Connection) {
+			t.pool.put(conn.release())
+		}(complete.connection)
+	} else {
+		complete.connection.Close()
+	}
+	t.connectionClosed(complete.connection,
+		closeReason(complete.closedBy, complete.err), complete.counters, complete.err)
+}
+
+// closeActiveConnection closes one of active connections
+func (t *Tunnel) closeActiveConnection(activeConnections *connectionRegistry,
+	id uint64) error {
+	conn := activeConnections.find(id)
+	if conn == nil {
+		return errConnectionNotFound
+	}
+	// Forwarders don't report completion of a cancelled connection, so it's
+	// forgotten right away
+	activeConnections.remove(conn)
+	conn.Close()
+	t.logf(LogInfo, "Connection %d at %q closed on request", id, t.listenAt)
+	t.connectionClosed(conn, CloseKilled, loadCounters(&conn.counters), nil)
+	return nil
+}
+
 // Connection ensapsulates a single traffic forwarding connection within a
 // tunnel.
 type Connection struct {
+	id        uint64
+	opened    time.Time
 	ctx       context.Context
 	ctxCancel func()
 
 	ingress   net.Conn
 	connectTo ConnectTo
 	egress    net.Conn
+	// Traffic of a connection is accounted both in its own counters and in
+	// counters of a tunnel
+	tunnelCounters *TunnelCounters
+	counters       TunnelCounters
+	meter          *rateMeter
+	// Tracks time connection spent waiting for limiters
+	waitMeter *rateMeter
+	// Upstream latencies are accounted both for connection and for its tunnel
+	// (if any). Dial time is zero if upstream connection was reused.
+	latency       latencyStats
+	tunnelLatency *latencyStats
+	// Simulated network impairment of forwarded chunks (impairment). Nil if
+	// connection doesn't belong to a tunnel.
+	impairment *atomic.Value
+	dialTime   time.Duration
+	// Time upstream got connected and time client data was first forwarded to
+	// it (unix nanoseconds, accessed atomically)
+	connected time.Time
+	firstSent int64
+	labels    Labels
+	// Counters of connections with the same labels (nil if there are no
+	// labels)
+	labeledCounters *TunnelCounters
+	// Data used against tunnel quota (nil if connection isn't accounted)
+	quotaUsed *int64
+	// Nil if upstream isn't encrypted
+	tlsConfig *tls.Config
+	// Pool of idle upstream connections to try before dialing (nil if there
+	// is none)
+	pool *upstreamPool
+	// Taken by the previous fairness sample of the tunnel
+	fairnessLast fairnessSample
+	// Whether connection is counted by the duplicate connection guard
+	deduplicated bool
+	// Hops to dial upstream through (nil if it's dialed directly)
+	via *hopChain
+	// Bounds dials of all tunnels together (nil if they aren't bounded)
+	dials *DialGate
+	// Upstream balancing mode
+	balance string
+	// Looks up upstream addresses (nil for system resolver)
+	resolver Resolver
+	// Whether client could send a preamble and the maximum rate it could
+	// request there
+	ratePreamble    bool
+	maxPreambleRate Limit
+	// Whether client could ask for a bandwidth test and the test it asked for
+	bandwidthTest bool
+	testMode      string
+	// Limit requested by client in a preamble (nil if it sent none)
+	requestedLimit *Limit
+	// Temporary limit of connection (nil if it isn't boosted). Owned by the
+	// tunnel goroutine.
+	boost *connectionBoost
+	// Limiter shared with other connections of the same client (nil if
+	// connection isn't in an identity group)
+	identity *identityLease
+	// Limit class connection belongs to (nil if none) and its name (string)
+	class     *limitClass
+	className atomic.Value
+	// Priority admission gave connection (zero if none), priority in effect
+	// (accessed atomically) and limiter of its priority level (nil if
+	// connection is of the highest priority present)
+	admittedPriority int
+	priority         int32
+	priorityLevel    *priorityLevel
+	// Limiter of the subnet client belongs to (nil if none) and the subnet
+	// (string)
+	subnet     *subnetLimit
+	subnetName atomic.Value
+	// Limiter of the backend connection was dialed to (nil if none) and the
+	// backend (string)
+	backend     *backendLimit
+	backendName atomic.Value
+	// Share of a worker pool connection forwards with (nil if tunnel isn't in
+	// a worker pool)
+	worker *workerLease
+	// Listener connection was accepted by
+	listener *limiter.RateLimitingListener
+	// Data client sent instead of a preamble or read to inspect TLS
+	// handshake, forwarded first
+	pending []byte
+	// Whether client starts with PROXY protocol header and whether its TLS
+	// handshake is inspected
+	proxyProtocol bool
+	inspectTLS    bool
+	// Original source told by PROXY protocol header (nil if none), server name
+	// client asked for and identity of its certificate (empty if unknown).
+	// Set before upstream is dialed.
+	source       net.Addr
+	serverName   string
+	certIdentity string
+	// Rules deciding whether connection reaches upstream (nil if none)
+	access *accessSet
+	// Time small reads are held for to be forwarded together
+	coalesce time.Duration
+	// Sent to upstream and to client before forwarding starts (see
+	// expandGreeting)
+	upstreamGreeting string
+	clientGreeting   string
+	// Deep telemetry is collected for connection
+	sampled bool
+	// Directory to record connection to and its recording once started
+	recordDir string
+	recorder  *recorder
+	// Forwarders running for a connection
+	forwarding       *sync.WaitGroup
+	ingressForwarder *Forwarder
+	egressForwarder  *Forwarder
+}
+
+// lastConnectionID is the identifier given to the most recently created
+// connection
+var lastConnectionID uint64
+
+// ID returns identifier of a connection which is unique within the process
+func (c *Connection) ID() uint64 {
+	return c.id
 }
 
 type connectionComplete struct {
 	connection *Connection
 	err        error
+	// Side that ended the connection
+	closedBy ConnectionSide
+	// Traffic forwarded by the time connection completed
+	counters TunnelCounters
+}
+
+// ConnectionSide identifies a party that ended a connection
+type ConnectionSide string
+
+const (
+	// ClosedByClient means that client closed the connection (or failed)
+	ClosedByClient ConnectionSide = "client"
+	// ClosedByUpstream means that upstream closed the connection (or failed)
+	ClosedByUpstream ConnectionSide = "upstream"
+	// ClosedByTunnel means that connection was closed by the tunnel, e.g.
+	// upon request or because tunnel was shut down
+	ClosedByTunnel ConnectionSide = "tunnel"
+)
+
+// connectionResult is reported by a connection when one of its forwarders
+// ends
+type connectionResult struct {
+	err      error
+	closedBy ConnectionSide
 }
 
 // NewConnection creates a connection with given ingress, destination and
 // limits. In order to actually start forwarding traffic, call Run() on a
-// created connection.
+// created connection. Forwarded traffic is accounted in given counters.
 //
 // Beware that created Connection takes ownership of an ingress net.Conn and
 // closes it when gets closed.
-func NewConnection(ingress net.Conn, connectTo ConnectTo) *Connection {
-	ctx, ctxCancel := context.WithCancel(context.Background())
+func NewConnection(ingress net.Conn, connectTo ConnectTo, counters *TunnelCounters) *Connection {
+	return NewConnectionContext(context.Background(), ingress, connectTo, counters)
+}
+
+// NewConnectionContext is like NewConnection, but connection carries values of
+// a given context. Connection context is cancelled when connection gets
+// closed.
+func NewConnectionContext(ctx context.Context, ingress net.Conn, connectTo ConnectTo,
+	counters *TunnelCounters) *Connection {
+	ctx, ctxCancel := context.WithCancel(ctx)
 	return &Connection{
+		id:        atomic.AddUint64(&lastConnectionID, 1),
+		opened:    time.Now(),
 		ctx:       ctx,
 		ctxCancel: ctxCancel,
 
 		ingress:   ingress,
 		connectTo: connectTo,
+
+		tunnelCounters: counters,
+		meter:          newRateMeter(),
+		waitMeter:      newRateMeter(),
+		forwarding:     new(sync.WaitGroup),
 	}
 }
 
 // Close closes Connection. This results in canceling all pending operations and
 // closing both ingress and egress network connections.
-func (c Connection) Close() {
+func (c *Connection) Close() {
 	c.ctxCancel()
 	if c.egress != nil {
 		err := c.egress.Close()
@@ -283,6 +2162,35 @@ func (c Connection) Close() {
 	}
 }
 
+// release ends a connection whose client has finished and returns its upstream
+// connection if it could be reused by another client (nil otherwise). Blocks
+// until forwarding stops and upstream has been silent for upstreamQuietPeriod.
+func (c *Connection) release() net.Conn {
+	c.ctxCancel()
+	err := c.ingress.Close()
+	if err != nil {
+		log.Printf("Failed to close ingress connection: %v", err)
+	}
+	c.forwarding.Wait()
+	// Data upstream sends later would reach the next client, so upstream must
+	// have responded to everything client sent and have nothing in flight
+	egress := c.egressForwarder
+	if !egress.cancelled || egress.dropped ||
+		egress.lastRead.Before(c.ingressForwarder.lastRead) {
+		c.egress.Close()
+		return nil
+	}
+	// Upstream might be in the middle of a response
+	if wait := upstreamQuietPeriod - time.Since(egress.lastRead); wait > 0 {
+		time.Sleep(wait)
+	}
+	if !alive(c.egress) {
+		c.egress.Close()
+		return nil
+	}
+	return c.egress
+}
+
 // Run performs traffic tunneling for a connection. It creates a socket
 // connected to an address given in connectTo argument and starts forwarding
 // traffic between ingress and destination.
@@ -290,31 +2198,148 @@ func (c Connection) Close() {
 // For each Connection, Run might only be invoked on a single goroutine
 // simultaneously. Attempts to Run single connection multiple times
 // concurrently will fail.
-func (c *Connection) Run() (chan error, error) {
-	resultChan := make(chan error)
+func (c *Connection) Run() (chan connectionResult, error) {
+	egress, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.egress = egress
+	return c.forward(), nil
+}
+
+// dial establishes a connection to upstream and records time it took. Doesn't
+// touch connection state otherwise, so it's safe to call concurrently with
+// Close.
+func (c *Connection) dial() (net.Conn, error) {
+	// Pooled connections could lead to any upstream, which breaks stickiness
+	if c.pool != nil && c.balance != BalanceSourceIP {
+		if egress := c.pool.get(); egress != nil {
+			return egress, nil
+		}
+	}
+	start := time.Now()
+	if c.dials != nil {
+		if err := c.dials.acquire(c.ctx); err != nil {
+			return nil, fmt.Errorf("Gave up waiting for a dial slot: %v", err)
+		}
+		defer c.dials.release()
+	}
+	var egress net.Conn
 	var err error
-	c.egress, err = net.Dial("tcp", string(c.connectTo))
+	if c.via != nil {
+		// The last hop resolves upstream address
+		egress, err = c.via.dial(c.ctx, string(c.connectTo))
+	} else if c.balance == BalanceSourceIP {
+		egress, err = c.dialSticky(c.ctx)
+	} else if c.resolver != nil {
+		var addrs []string
+		if addrs, err = c.resolve(c.ctx); err == nil {
+			egress, err = dialAddrs(c.ctx, addrs)
+		}
+	} else {
+		var dialer net.Dialer
+		egress, err = dialer.DialContext(c.ctx, "tcp", string(c.connectTo))
+	}
 	if err != nil {
+		return nil, dialError(err, err)
+	}
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(egress, c.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			egress.Close()
+			return nil, dialError(err, fmt.Errorf("TLS handshake with upstream failed: %v", err))
+		}
+		tlsConn.SetDeadline(time.Time{})
+		egress = tlsConn
+	}
+	if err = c.greetUpstream(egress); err != nil {
+		egress.Close()
 		return nil, err
 	}
+	c.dialTime = time.Since(start)
+	return egress, nil
+}
+
+// dialError marks an error of a dial that failed because of a given cause with
+// ErrDialTimeout if cause is a timeout
+func dialError(cause, err error) error {
+	if isTimeout(cause) {
+		return &Error{Kind: ErrDialTimeout, Err: err}
+	}
+	return err
+}
 
-	ingressForwarder := CreateForwarder(c.ingress, c.egress)
+// forward starts forwarding traffic between ingress and established egress
+func (c *Connection) forward() chan connectionResult {
+	resultChan := make(chan connectionResult)
+	ingressCounters := []*int64{&c.tunnelCounters.IngressBytes, &c.counters.IngressBytes}
+	egressCounters := []*int64{&c.tunnelCounters.EgressBytes, &c.counters.EgressBytes}
+	if c.labeledCounters != nil {
+		ingressCounters = append(ingressCounters, &c.labeledCounters.IngressBytes)
+		egressCounters = append(egressCounters, &c.labeledCounters.EgressBytes)
+	}
+	if c.quotaUsed != nil {
+		ingressCounters = append(ingressCounters, c.quotaUsed)
+		egressCounters = append(egressCounters, c.quotaUsed)
+	}
+
+	c.forwarding.Add(2)
+	var ingress net.Conn = c.ingress
+	if len(c.pending) > 0 {
+		ingress = &prefixedConn{Conn: c.ingress, prefix: c.pending}
+	}
+	c.connected = time.Now()
+	ingressForwarder := CreateForwarder(ingress, c.egress, ingressCounters...)
+	ingressForwarder.SetCoalesceDelay(c.coalesce)
+	ingressForwarder.setImpairment(c.impairment)
+	if c.recorder != nil {
+		ingressForwarder.setRecorder(c.recorder, RecordedClient)
+	}
+	if c.testMode == "" {
+		// Bandwidth test responder isn't an upstream to measure
+		ingressForwarder.firstRead = c.clientSent
+	}
+	c.ingressForwarder = &ingressForwarder
 	go func() {
 		err := ingressForwarder.Run(c.ctx)
+		c.forwarding.Done()
+		result := connectionResult{err: err, closedBy: ClosedByClient}
+		if ingressForwarder.writeEnded {
+			result.closedBy = ClosedByUpstream
+		}
 		select {
-		case resultChan <- err:
+		case resultChan <- result:
 		case <-c.ctx.Done():
 		}
 	}()
 
-	egressForwarder := CreateForwarder(c.egress, c.ingress)
+	egressForwarder := CreateForwarder(c.egress, c.ingress, egressCounters...)
+	egressForwarder.SetCoalesceDelay(c.coalesce)
+	egressForwarder.setImpairment(c.impairment)
+	if c.testMode == "" {
+		egressForwarder.firstRead = c.upstreamSent
+	}
+	if c.recorder != nil {
+		egressForwarder.setRecorder(c.recorder, RecordedUpstream)
+		go func() {
+			c.forwarding.Wait()
+			c.recorder.close()
+		}()
+	}
+	c.egressForwarder = &egressForwarder
 	go func() {
 		err := egressForwarder.Run(c.ctx)
+		c.forwarding.Done()
+		result := connectionResult{err: err, closedBy: ClosedByUpstream}
+		if egressForwarder.writeEnded {
+			result.closedBy = ClosedByClient
+		}
 		select {
-		case resultChan <- err:
+		case resultChan <- result:
 		case <-c.ctx.Done():
 		}
 	}()
 
-	return resultChan, nil
+	return resultChan
 }
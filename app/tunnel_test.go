@@ -0,0 +1,582 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startUpstream starts a listener accepting connections and keeping them open
+func startUpstream(t *testing.T) net.Listener {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return upstream
+}
+
+// startTunnelConnection creates a tunnel to a given upstream and makes a
+// connection through it
+func startTunnelConnection(t *testing.T, upstream net.Listener,
+	opts TunnelOptions) (*Tunnel, net.Conn) {
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, opts)
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	for len(tunnel.Connections()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return tunnel, client
+}
+
+func TestTunnelClose(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{})
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- tunnel.ShutdownGracefully(time.Minute)
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("Expected tunnel to wait for active connection, got %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if !tunnel.Draining() {
+		t.Errorf("Expected tunnel to drain while closing")
+	}
+
+	client.Close()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Expected graceful shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Tunnel didn't shut down after connection completed")
+	}
+
+	// Closing again is harmless
+	if err := tunnel.Close(); err != nil {
+		t.Errorf("Expected repeated Close to succeed, got %v", err)
+	}
+}
+
+func TestTunnelCloseTimeout(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{})
+	defer client.Close()
+
+	err := tunnel.ShutdownGracefully(200 * time.Millisecond)
+	if shutdownErr, ok := err.(*ShutdownError); !ok || shutdownErr.Forced != 1 {
+		t.Errorf("Expected an error about connections closed forcibly, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseTunnelShutdown] != 1 {
+		t.Errorf("Expected connection to be counted as closed by shutdown, got %v", closed)
+	}
+}
+
+func TestTunnelContext(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel, err := NewTunnelContext(ctx, "127.0.0.1:0",
+		ConnectTo(upstream.Addr().String()), TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	for len(tunnel.Connections()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection to be closed with context, got %v", err)
+	}
+	tunnel.waitGroup.Wait()
+	if !tunnel.Closed() {
+		t.Errorf("Expected tunnel to shut down with context")
+	}
+	if _, err := net.Dial("tcp", tunnel.Addr().String()); err == nil {
+		t.Errorf("Expected tunnel to stop listening")
+	}
+
+	if _, err := NewTunnelContext(ctx, "127.0.0.1:0", "127.0.0.1:1", TunnelLimits{},
+		TunnelOptions{}); err != context.Canceled {
+		t.Errorf("Expected cancelled context to be reported, got %v", err)
+	}
+}
+
+func TestTunnelShutdownDuringAccept(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		admitting := make(chan struct{})
+		release := make(chan struct{})
+		tunnel, err := NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{},
+			TunnelOptions{
+				// Keeps tunnel goroutine busy until accept fails and shutdown
+				// begins, so that it sees both at once
+				Admit: func(ctx context.Context, client net.Addr) Admission {
+					close(admitting)
+					<-release
+					return Admission{Reject: true}
+				},
+			})
+		if err != nil {
+			t.Fatalf("Failed to create tunnel: %v", err)
+		}
+		if tunnel.Closed() {
+			t.Fatalf("Expected running tunnel not to be closed")
+		}
+		client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		client.Close()
+		<-admitting
+		tunnel.shutdownOnce.Do(func() {
+			close(tunnel.shutdown)
+		})
+		tunnel.listener.Close()
+		// Give acceptor time to fail
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		tunnel.Shutdown()
+		if !tunnel.Closed() {
+			t.Errorf("Expected tunnel to be closed")
+		}
+		if tunnel.listener == nil {
+			t.Fatalf("Expected tunnel not to try listening again after shutdown")
+		}
+	}
+}
+
+func TestTunnelListenConfig(t *testing.T) {
+	controlled := false
+	tunnel, err := NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{}, TunnelOptions{
+		ListenConfig: &net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				controlled = true
+				return nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	if !controlled {
+		t.Errorf("Expected listening socket to be passed to Control hook")
+	}
+
+	_, err = NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{}, TunnelOptions{
+		ListenConfig: &net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				return errors.New("rejected")
+			},
+		},
+	})
+	if err == nil {
+		t.Errorf("Expected Control hook error to fail tunnel creation")
+	}
+}
+
+func TestConnectionClosedEvent(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	events := NewEventBus(16)
+	sub, err := events.Subscribe(0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{Events: events})
+	defer tunnel.Shutdown()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	for tunnel.Stats().Counters.IngressBytes < 5 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-sub.Events():
+			if e.Type != EventConnectionClosed {
+				continue
+			}
+			if e.Connection.ClosedBy != ClosedByClient || e.Connection.Reason != CloseClientEOF {
+				t.Errorf("Expected connection to be closed by client, got %q (%s)",
+					e.Connection.ClosedBy, e.Connection.Reason)
+			}
+			if closed := tunnel.Stats().Closed; closed[CloseClientEOF] != 1 {
+				t.Errorf("Expected connection to be counted as ended by client, got %v",
+					closed)
+			}
+			if e.Connection.IngressBytes != 5 || e.Connection.EgressBytes != 0 {
+				t.Errorf("Unexpected byte counts in %+v", e.Connection)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Connection closed event wasn't published")
+		}
+	}
+}
+
+// startRetryingTunnel creates a tunnel and breaks its listening socket, so
+// that tunnel has to retry listening
+func startRetryingTunnel(t *testing.T, listenAt ListenAt) *Tunnel {
+	tunnel, err := NewTunnel(listenAt, "127.0.0.1:1", TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	tunnel.listener.Close()
+	// Give tunnel a moment to discover the failure
+	time.Sleep(100 * time.Millisecond)
+	return tunnel
+}
+
+func TestTunnelShutdownWhileRetrying(t *testing.T) {
+	tunnel := startRetryingTunnel(t, "127.0.0.1:0")
+
+	done := make(chan struct{})
+	go func() {
+		tunnel.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Tunnel didn't shut down while retrying to listen")
+	}
+}
+
+func TestTunnelServesRequestsWhileRetrying(t *testing.T) {
+	tunnel := startRetryingTunnel(t, "127.0.0.1:0")
+	defer tunnel.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunnel.UpdateLimits(TunnelLimits{TunnelLimit: 1024})
+		tunnel.UpdateSharedLimiters(nil)
+		if err := tunnel.UpdateExemptions(Exemptions{}); err != nil {
+			t.Errorf("Failed to update exemptions: %v", err)
+		}
+		if conns := tunnel.Connections(); len(conns) != 0 {
+			t.Errorf("Expected no connections, got %v", conns)
+		}
+		if err := tunnel.CloseConnection(1); err != errConnectionNotFound {
+			t.Errorf("Expected connection not to be found, got %v", err)
+		}
+		if err := tunnel.UpdateConnectionLimit(1, nil); err != errConnectionNotFound {
+			t.Errorf("Expected connection not to be found, got %v", err)
+		}
+		if err := tunnel.BoostConnection(1, 1024, time.Second); err != errConnectionNotFound {
+			t.Errorf("Expected connection not to be found, got %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Tunnel requests blocked while retrying to listen")
+	}
+}
+
+func TestTunnelListensAgainAfterRetry(t *testing.T) {
+	defer func(interval time.Duration) {
+		listenRetryInterval = interval
+	}(listenRetryInterval)
+	listenRetryInterval = 200 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tunnel := startRetryingTunnel(t, ListenAt(addr))
+	defer tunnel.Shutdown()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Tunnel didn't listen again: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTunnelAdmitLabels(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{
+		Admit: func(ctx context.Context, client net.Addr) Admission {
+			return Admission{Labels: Labels{"customer": "acme", "bad-name": "x"}}
+		},
+	})
+	defer tunnel.Shutdown()
+	defer client.Close()
+
+	conns := tunnel.Connections()
+	if len(conns) != 1 || conns[0].Labels.String() != "customer=acme" {
+		t.Fatalf("Expected connection to be labeled, got %v", conns)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	for tunnel.Stats().Counters.IngressBytes < 5 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	labeled := tunnel.Stats().Labeled
+	if len(labeled) != 1 || labeled[0].Counters.IngressBytes != 5 {
+		t.Errorf("Expected traffic to be accounted by labels, got %v", labeled)
+	}
+}
+
+func TestTunnelAdmitReject(t *testing.T) {
+	tunnel, err := NewTunnel("127.0.0.1:0", "127.0.0.1:1", TunnelLimits{}, TunnelOptions{
+		Admit: func(ctx context.Context, client net.Addr) Admission {
+			return Admission{Reject: true}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Stats().Closed[CloseRejected] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected connection to be rejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type customerKey struct{}
+
+func TestTunnelConnectionContext(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+	closed := make(chan string, 1)
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{
+		Admit: func(ctx context.Context, client net.Addr) Admission {
+			return Admission{Context: context.WithValue(ctx, customerKey{}, "acme")}
+		},
+		OnClose: func(ctx context.Context, c ClosedConnection) {
+			customer, _ := ctx.Value(customerKey{}).(string)
+			closed <- customer + " " + string(c.Reason)
+		},
+	})
+	defer tunnel.Shutdown()
+
+	client.Close()
+	select {
+	case v := <-closed:
+		if v != "acme clientEOF" {
+			t.Errorf("Expected context value and reason in OnClose, got %q", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnClose wasn't called")
+	}
+}
+
+func TestTunnelDirectionLimits(t *testing.T) {
+	upstream := startUppercaseUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{ConnectionUploadLimit: 20000}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	// 10000 bytes take half a second to upload, while downloading them back
+	// isn't limited
+	start := time.Now()
+	go client.Write(make([]byte, 10000))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, make([]byte, 10000)); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Expected upload to be limited, took %v", elapsed)
+	}
+}
+
+func TestTunnelBlockedLimit(t *testing.T) {
+	upstream := startUppercaseUpstream(t)
+	defer upstream.Close()
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{ConnectionLimit: Blocked}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 5)); err == nil {
+		t.Fatalf("Expected blocked connection to pause, got %d bytes", n)
+	}
+
+	tunnel.UpdateLimits(TunnelLimits{ConnectionLimit: Unlimited})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response := make([]byte, 5)
+	if _, err := io.ReadFull(client, response); err != nil || string(response) != "HELLO" {
+		t.Fatalf("Expected connection to resume once unblocked, got %q: %v", response, err)
+	}
+}
+
+// hangingConn is a connection whose Close and deadlines don't interrupt reads
+// and writes
+type hangingConn struct {
+	net.Conn
+}
+
+func (c *hangingConn) Close() error {
+	return nil
+}
+
+func (c *hangingConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *hangingConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *hangingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// wrappingConn is a hangingConn exposing the connection it wraps
+type wrappingConn struct {
+	hangingConn
+}
+
+func (c *wrappingConn) Inner() net.Conn {
+	return c.Conn
+}
+
+// hangingListener accepts hangingConns, passing their underlying connections
+// on
+type hangingListener struct {
+	net.Listener
+	wrapping bool
+	accepted chan net.Conn
+}
+
+func (l *hangingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.accepted <- conn
+	if l.wrapping {
+		return &wrappingConn{hangingConn{Conn: conn}}, nil
+	}
+	return &hangingConn{Conn: conn}, nil
+}
+
+func TestTunnelShutdownContext(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	for _, wrapping := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		listener := &hangingListener{
+			Listener: l,
+			wrapping: wrapping,
+			accepted: make(chan net.Conn, 1),
+		}
+		tunnel, client := startTunnelConnection(t, upstream,
+			TunnelOptions{Listener: listener})
+		defer client.Close()
+		id := tunnel.Connections()[0].ID
+		accepted := <-listener.accepted
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err = tunnel.ShutdownContext(ctx)
+		cancel()
+		if elapsed := time.Since(start); elapsed > 3*forceCloseGrace {
+			t.Errorf("Expected shutdown to give up on hanging connection, took %v",
+				elapsed)
+		}
+		shutdownErr, ok := err.(*ShutdownError)
+		if !ok || shutdownErr.Forced != 1 || shutdownErr.Abandoned {
+			t.Fatalf("Expected connection to be closed forcibly, got %v", err)
+		}
+		if wrapping {
+			if len(shutdownErr.Stuck) != 0 {
+				t.Errorf("Expected forced connection to stop, got %v", err)
+			}
+		} else if len(shutdownErr.Stuck) != 1 || shutdownErr.Stuck[0] != id {
+			t.Errorf("Expected connection %d to be reported stuck, got %v", id, err)
+		}
+		accepted.Close()
+	}
+
+	tunnel, client := startTunnelConnection(t, upstream, TunnelOptions{})
+	defer client.Close()
+	if err := tunnel.ShutdownContext(context.Background()); err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
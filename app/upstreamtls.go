@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// UpstreamTLS makes a tunnel encrypt traffic to its upstream with TLS
+type UpstreamTLS struct {
+	// Server name sent in SNI and verified against upstream certificate.
+	// Defaults to the host of connectTo, which is handy to override for
+	// upstreams addressed by IP.
+	ServerName string `json:"serverName,omitempty"`
+	// How upstream certificate is verified: "full" (default) verifies
+	// certificate chain and server name, "pin" only checks that certificate
+	// matches one of Pins, "none" disables verification.
+	Verify string `json:"verify,omitempty"`
+	// SHA-256 fingerprints of acceptable upstream certificates in hex (colons
+	// are allowed). If set, upstream certificate must match one of them
+	// regardless of verification mode.
+	Pins []string `json:"pins,omitempty"`
+	// PEM file with certificate authorities to verify upstream certificate
+	// against instead of system ones
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// Upstream certificate verification modes
+const (
+	VerifyFull = "full"
+	VerifyPin  = "pin"
+	VerifyNone = "none"
+)
+
+// upstreamHandshakeTimeout limits time TLS handshake with upstream could take
+const upstreamHandshakeTimeout = 10 * time.Second
+
+// equal tells whether two upstream TLS settings are the same
+func (u *UpstreamTLS) equal(other *UpstreamTLS) bool {
+	if u == nil || other == nil {
+		return u == other
+	}
+	return u.ServerName == other.ServerName && u.Verify == other.Verify &&
+		sameStrings(u.Pins, other.Pins) && u.CAFile == other.CAFile
+}
+
+// validate checks upstream TLS settings for errors
+func (u *UpstreamTLS) validate(connectTo ConnectTo) error {
+	_, err := u.config(connectTo)
+	return err
+}
+
+// config creates TLS configuration to connect to a given upstream with. Nil
+// settings stand for no TLS.
+func (u *UpstreamTLS) config(connectTo ConnectTo) (*tls.Config, error) {
+	if u == nil {
+		return nil, nil
+	}
+	serverName := u.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(string(connectTo))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid upstream address: %v", err)
+		}
+		serverName = host
+	}
+	result := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	pins := make([][]byte, 0, len(u.Pins))
+	for _, v := range u.Pins {
+		pin, err := hex.DecodeString(strings.Replace(v, ":", "", -1))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("Invalid certificate fingerprint %q", v)
+		}
+		pins = append(pins, pin)
+	}
+
+	switch u.Verify {
+	case "", VerifyFull:
+	case VerifyPin:
+		if len(pins) == 0 {
+			return nil, fmt.Errorf("Certificate pinning requires fingerprints")
+		}
+		result.InsecureSkipVerify = true
+	case VerifyNone:
+		result.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("Unknown upstream verification mode %q", u.Verify)
+	}
+
+	if u.CAFile != "" {
+		pem, err := ioutil.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read upstream CA file: %v", err)
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in upstream CA file %q", u.CAFile)
+		}
+	}
+
+	if len(pins) > 0 {
+		result.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("Upstream presented no certificate")
+			}
+			fingerprint := sha256.Sum256(rawCerts[0])
+			for _, pin := range pins {
+				if bytes.Equal(pin, fingerprint[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("Upstream certificate %x is not pinned", fingerprint)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	pin := hex.EncodeToString(make([]byte, sha256.Size))
+	cases := []struct {
+		name  string
+		tls   UpstreamTLS
+		valid bool
+	}{
+		{"default", UpstreamTLS{}, true},
+		{"pin", UpstreamTLS{Verify: VerifyPin, Pins: []string{pin}}, true},
+		{"pin with colons", UpstreamTLS{Verify: VerifyPin, Pins: []string{"00:" + pin[2:]}}, true},
+		{"pin without pins", UpstreamTLS{Verify: VerifyPin}, false},
+		{"short pin", UpstreamTLS{Pins: []string{"abcd"}}, false},
+		{"unknown mode", UpstreamTLS{Verify: "some"}, false},
+		{"missing CA file", UpstreamTLS{CAFile: "/nonexistent/ca.pem"}, false},
+	}
+	for _, c := range cases {
+		config, err := c.tls.config("10.0.0.5:443")
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		if err == nil && config.ServerName != "10.0.0.5" {
+			t.Errorf("%s: expected server name to default to upstream host, got %q",
+				c.name, config.ServerName)
+		}
+	}
+}
+
+// getThroughTunnel makes an HTTP request to upstream through a tunnel and
+// returns response status or an error
+func getThroughTunnel(tunnel *Tunnel) (int, error) {
+	client, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if err := req.Write(client); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+	fingerprint := sha256.Sum256(upstream.Certificate().Raw)
+
+	caFile, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("Failed to create CA file: %v", err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	caFile.Close()
+
+	cases := []struct {
+		name string
+		tls  UpstreamTLS
+		ok   bool
+	}{
+		{"pinned", UpstreamTLS{Verify: VerifyPin, Pins: []string{hex.EncodeToString(fingerprint[:])}}, true},
+		{"wrong pin", UpstreamTLS{Verify: VerifyPin, Pins: []string{hex.EncodeToString(make([]byte, sha256.Size))}}, false},
+		{"unverified", UpstreamTLS{Verify: VerifyNone}, true},
+		{"trusted CA", UpstreamTLS{ServerName: "example.com", CAFile: caFile.Name()}, true},
+		{"wrong server name", UpstreamTLS{ServerName: "other.org", CAFile: caFile.Name()}, false},
+		{"untrusted", UpstreamTLS{ServerName: "example.com"}, false},
+	}
+	for _, c := range cases {
+		settings := c.tls
+		tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Listener.Addr().String()),
+			TunnelLimits{}, TunnelOptions{UpstreamTLS: &settings})
+		if err != nil {
+			t.Fatalf("%s: failed to create tunnel: %v", c.name, err)
+		}
+		status, err := getThroughTunnel(tunnel)
+		if c.ok && (err != nil || status != http.StatusTeapot) {
+			t.Errorf("%s: expected request to succeed, got %d, %v", c.name, status, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: expected request to fail, got %d", c.name, status)
+		}
+		tunnel.Shutdown()
+	}
+}
+
+func TestUpdateUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Listener.Addr().String()),
+		TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+	if status, err := getThroughTunnel(tunnel); err == nil && status == http.StatusTeapot {
+		t.Errorf("Expected plain text request to TLS upstream to fail")
+	}
+
+	if err := tunnel.UpdateUpstreamTLS(&UpstreamTLS{Verify: VerifyNone}); err != nil {
+		t.Fatalf("Failed to update upstream TLS: %v", err)
+	}
+	if status, err := getThroughTunnel(tunnel); err != nil || status != http.StatusTeapot {
+		t.Errorf("Expected request to succeed after enabling TLS, got %d, %v", status, err)
+	}
+}
@@ -0,0 +1,311 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WebhookConfigJSON configures a URL events are POSTed to as JSON
+type WebhookConfigJSON struct {
+	URL string `json:"url"`
+	// If set, requests carry HMAC-SHA256 of their body keyed with it in
+	// WebhookSignatureHeader
+	Secret string `json:"secret,omitempty"`
+	// Types of events webhook is notified about (DefaultWebhookEvents if
+	// empty)
+	Events []EventType `json:"events,omitempty"`
+	// Number of times failed deliveries are retried (DefaultWebhookRetries if
+	// zero)
+	Retries int `json:"retries,omitempty"`
+}
+
+// DefaultWebhookEvents are lifecycle events webhooks are notified about
+// unless configured otherwise
+var DefaultWebhookEvents = []EventType{
+	EventTunnelCreated,
+	EventTunnelDeleted,
+	EventListenerFailed,
+	EventListenerRestored,
+	EventListenRetriesExhausted,
+	EventQuotaExhausted,
+	EventTunnelSaturated,
+}
+
+// DefaultWebhookRetries is the number of times failed deliveries are retried
+// unless configured otherwise
+const DefaultWebhookRetries = 3
+
+// Headers of webhook requests telling event type and signature of the body
+// ("sha256=" followed by hex-encoded HMAC)
+const (
+	WebhookEventHeader     = "X-Throttle-Event"
+	WebhookSignatureHeader = "X-Throttle-Signature"
+)
+
+// webhookTimeout is how long a webhook is given to respond
+const webhookTimeout = 10 * time.Second
+
+// webhookRetryDelay is the delay before the first retry of a failed delivery,
+// which doubles with each next one
+var webhookRetryDelay = time.Second
+
+// eventTypes are all types of events
+var eventTypes = []EventType{
+	EventTunnelCreated, EventTunnelUpdated, EventTunnelDeleted,
+	EventConnectionOpened, EventConnectionFailed, EventConnectionUpdated,
+	EventConnectionClosed, EventListenerFailed, EventListenerRestored,
+	EventListenRetriesExhausted, EventQuotaExhausted, EventTunnelSaturated,
+}
+
+// String is an implementation of fmt.Stringer that keeps secret out of logs
+func (c WebhookConfigJSON) String() string {
+	return fmt.Sprintf("{url: %s, events: %v, retries: %d}", c.URL, c.Events, c.Retries)
+}
+
+func (c WebhookConfigJSON) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL %q is not an absolute HTTP(S) URL", c.URL)
+	}
+	for _, e := range c.Events {
+		known := false
+		for _, t := range eventTypes {
+			known = known || e == t
+		}
+		if !known {
+			return fmt.Errorf("Unknown event type %q", e)
+		}
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("Number of retries must not be negative")
+	}
+	return nil
+}
+
+// equal tells whether two webhook configurations are the same
+func (c WebhookConfigJSON) equal(other WebhookConfigJSON) bool {
+	if c.URL != other.URL || c.Secret != other.Secret || c.Retries != other.Retries ||
+		len(c.Events) != len(other.Events) {
+		return false
+	}
+	for i := range c.Events {
+		if c.Events[i] != other.Events[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// notifies tells whether webhook is notified about events of a given type
+func (c WebhookConfigJSON) notifies(eventType EventType) bool {
+	events := c.Events
+	if len(events) == 0 {
+		events = DefaultWebhookEvents
+	}
+	for _, e := range events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns signature of a request body
+func (c WebhookConfigJSON) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks notify configured URLs about events published to an EventBus.
+// Safe for concurrent use.
+type Webhooks struct {
+	mu     *sync.Mutex
+	events *EventBus
+	client *http.Client
+	hooks  map[string]*webhook
+}
+
+// webhook delivers events to a single URL on a goroutine of its own
+type webhook struct {
+	name   string
+	config WebhookConfigJSON
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewWebhooks creates an empty set of webhooks notified about events
+// published to a given bus
+func NewWebhooks(events *EventBus) *Webhooks {
+	return &Webhooks{
+		mu:     new(sync.Mutex),
+		events: events,
+		client: &http.Client{Timeout: webhookTimeout},
+		hooks:  make(map[string]*webhook),
+	}
+}
+
+// Configure replaces the set of webhooks. Webhooks whose configuration
+// changed are restarted, dropping events they have yet to deliver.
+func (w *Webhooks) Configure(config map[string]WebhookConfigJSON) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, h := range w.hooks {
+		if c, ok := config[name]; !ok || !c.equal(h.config) {
+			h.stop()
+			delete(w.hooks, name)
+		}
+	}
+	for name, c := range config {
+		if _, ok := w.hooks[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		h := &webhook{
+			name:   name,
+			config: c,
+			ctx:    ctx,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		// Subscribing before Configure returns makes sure webhook doesn't miss
+		// events published after that
+		sub, _ := w.events.Subscribe(0)
+		go h.run(w.client, w.events, sub)
+		w.hooks[name] = h
+	}
+}
+
+// Close stops all webhooks
+func (w *Webhooks) Close() {
+	w.Configure(nil)
+}
+
+// config returns configuration of all webhooks
+func (w *Webhooks) config() map[string]WebhookConfigJSON {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.hooks) == 0 {
+		return nil
+	}
+	result := make(map[string]WebhookConfigJSON, len(w.hooks))
+	for name, h := range w.hooks {
+		result[name] = h.config
+	}
+	return result
+}
+
+// stop stops webhook and waits for its goroutine to exit
+func (h *webhook) stop() {
+	h.cancel()
+	<-h.done
+}
+
+// run delivers events of a subscription until webhook is stopped.
+// Subscription is resumed if webhook falls behind events.
+func (h *webhook) run(client *http.Client, bus *EventBus, sub *Subscription) {
+	defer close(h.done)
+	var cursor uint64
+	for {
+	receive:
+		for {
+			select {
+			case e, ok := <-sub.Events():
+				if !ok {
+					break receive
+				}
+				cursor = e.Cursor
+				if h.config.notifies(e.Type) && !h.deliver(client, e) {
+					sub.Close()
+					return
+				}
+			case <-h.ctx.Done():
+				sub.Close()
+				return
+			}
+		}
+		log.Printf("Webhook %q fell behind events: %v", h.name, sub.Err())
+		var err error
+		if sub, err = bus.Subscribe(cursor); err != nil {
+			log.Printf("Webhook %q missed events after %d: %v", h.name, cursor, err)
+			sub, _ = bus.Subscribe(0)
+		}
+	}
+}
+
+// deliver POSTs an event to webhook URL retrying failed attempts. Returns
+// false if webhook got stopped meanwhile.
+func (h *webhook) deliver(client *http.Client, e Event) bool {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode event %d for webhook %q: %v", e.Cursor, h.name, err)
+		return true
+	}
+	retries := h.config.Retries
+	if retries == 0 {
+		retries = DefaultWebhookRetries
+	}
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := h.post(client, e.Type, body)
+		if err == nil {
+			return true
+		}
+		if h.ctx.Err() != nil {
+			return false
+		}
+		if attempt == retries {
+			log.Printf("Failed to notify webhook %q of event %d: %v", h.name, e.Cursor, err)
+			return true
+		}
+		select {
+		case <-time.After(delay):
+		case <-h.ctx.Done():
+			return false
+		}
+		delay *= 2
+	}
+}
+
+// post makes a single attempt to deliver an event
+func (h *webhook) post(client *http.Client, eventType EventType, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(h.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(eventType))
+	if h.config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, h.config.sign(body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookConfigValidation(t *testing.T) {
+	valid := WebhookConfigJSON{URL: "https://alerts.example.com/throttle",
+		Events: []EventType{EventQuotaExhausted}}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Expected %v to be valid, got %v", valid, err)
+	}
+	invalid := []WebhookConfigJSON{
+		{URL: "alerts.example.com"},
+		{URL: "ftp://alerts.example.com"},
+		{URL: "https://alerts.example.com", Events: []EventType{"tunnelOnFire"}},
+		{URL: "https://alerts.example.com", Retries: -1},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected %v to be rejected", c)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	defer func(delay time.Duration) {
+		webhookRetryDelay = delay
+	}(webhookRetryDelay)
+	webhookRetryDelay = 10 * time.Millisecond
+
+	type request struct {
+		event     Event
+		eventType string
+		signature string
+	}
+	requests := make(chan request, 10)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "Try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("Failed to decode event: %v", err)
+		}
+		config := WebhookConfigJSON{Secret: "s3cret"}
+		if signature := r.Header.Get(WebhookSignatureHeader); signature != config.sign(body) {
+			t.Errorf("Unexpected signature %q", signature)
+		}
+		requests <- request{e, r.Header.Get(WebhookEventHeader),
+			r.Header.Get(WebhookSignatureHeader)}
+	}))
+	defer server.Close()
+
+	bus := NewEventBus(16)
+	webhooks := NewWebhooks(bus)
+	defer webhooks.Close()
+	webhooks.Configure(map[string]WebhookConfigJSON{
+		"oncall": {URL: server.URL, Secret: "s3cret"},
+	})
+
+	// Connection events aren't delivered by default
+	bus.Publish(Event{Type: EventConnectionOpened, ListenAt: ":8080"})
+	bus.Publish(Event{Type: EventQuotaExhausted, ListenAt: ":8080"})
+	select {
+	case r := <-requests:
+		if r.event.Type != EventQuotaExhausted || r.eventType != string(EventQuotaExhausted) {
+			t.Errorf("Expected quota exhaustion to be delivered, got %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Event wasn't delivered")
+	}
+	if attempts != 2 {
+		t.Errorf("Expected failed delivery to be retried once, got %d attempts", attempts)
+	}
+}
+
+func TestTunnelListenerEvents(t *testing.T) {
+	defer func(interval time.Duration) {
+		listenRetryInterval = interval
+	}(listenRetryInterval)
+	listenRetryInterval = 20 * time.Millisecond
+
+	bus := NewEventBus(16)
+	sub, _ := bus.Subscribe(0)
+	defer sub.Close()
+	listenAt := freePort(t)
+	tunnel, err := NewTunnel(listenAt, "127.0.0.1:1", TunnelLimits{},
+		TunnelOptions{Events: bus, Settings: TunnelSettings{ListenRetries: 2}})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	// Tunnel can't listen again while port is taken
+	tunnel.listener.Close()
+	taken, err := net.Listen("tcp", string(listenAt))
+	if err != nil {
+		t.Fatalf("Failed to take port: %v", err)
+	}
+	expectEvent := func(expected EventType) {
+		select {
+		case e := <-sub.Events():
+			if e.Type != expected || e.Tunnel == nil {
+				t.Fatalf("Expected %s event, got %+v", expected, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s event", expected)
+		}
+	}
+	expectEvent(EventListenerFailed)
+	expectEvent(EventListenRetriesExhausted)
+	taken.Close()
+	expectEvent(EventListenerRestored)
+}
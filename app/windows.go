@@ -0,0 +1,195 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ActiveWindow is a daily time window in the format of schedule rules
+type ActiveWindow struct {
+	// Start and end of the window in local time ("HH:MM"). Window ends the
+	// next day if end is not after start, equal times stand for a whole day.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Days of week window starts on ("Mon", "Tue", ...). Every day if empty.
+	Days []string `json:"days,omitempty"`
+}
+
+func (w ActiveWindow) validate() error {
+	if _, err := parseClock(w.From); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.To); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		if _, err := parseWeekday(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includes tells whether a given time falls within the window. Window is
+// expected to be valid.
+func (w ActiveWindow) includes(now time.Time) bool {
+	from, _ := parseClock(w.From)
+	to, _ := parseClock(w.To)
+	minute := now.Hour()*60 + now.Minute()
+	// Day window in question started on
+	day := now.Weekday()
+	switch {
+	case from < to:
+		if minute < from || minute >= to {
+			return false
+		}
+	case minute < to:
+		// Window started the day before
+		day = (day + 6) % 7
+	case minute < from:
+		return false
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if wd, _ := parseWeekday(d); wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// What a tunnel does outside of its active windows
+const (
+	// OutsideReject makes tunnel reject new connections
+	OutsideReject = "reject"
+	// OutsideClose makes tunnel close its listener along with active
+	// connections
+	OutsideClose = "close"
+)
+
+// ActiveWindows restrict access through a tunnel to time windows, e.g. to
+// open a path for maintenance only
+type ActiveWindows struct {
+	Windows []ActiveWindow `json:"windows"`
+	// OutsideReject (default) or OutsideClose
+	Outside string `json:"outside,omitempty"`
+}
+
+// validate checks active windows for errors. Nil windows are valid.
+func (a *ActiveWindows) validate() error {
+	if a == nil {
+		return nil
+	}
+	if len(a.Windows) == 0 {
+		return errors.New("Active windows must have at least one window")
+	}
+	for i, w := range a.Windows {
+		if err := w.validate(); err != nil {
+			return withContext(err, "Active window %d", i+1)
+		}
+	}
+	switch a.Outside {
+	case "", OutsideReject, OutsideClose:
+		return nil
+	}
+	return fmt.Errorf("Invalid outside %q of active windows (expected %q or %q)",
+		a.Outside, OutsideReject, OutsideClose)
+}
+
+// equal tells whether two sets of active windows are the same
+func (a *ActiveWindows) equal(other *ActiveWindows) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+	if len(a.Windows) != len(other.Windows) || a.Outside != other.Outside {
+		return false
+	}
+	for i, w := range a.Windows {
+		o := other.Windows[i]
+		if w.From != o.From || w.To != o.To || !sameStrings(w.Days, o.Days) {
+			return false
+		}
+	}
+	return true
+}
+
+// suspension returns how a tunnel is suspended at a given time. Tunnels
+// without active windows are never suspended.
+func (a *ActiveWindows) suspension(now time.Time) suspension {
+	if a == nil {
+		return notSuspended
+	}
+	for _, w := range a.Windows {
+		if w.includes(now) {
+			return notSuspended
+		}
+	}
+	if a.Outside == OutsideClose {
+		return suspendClose
+	}
+	return suspendReject
+}
+
+// suspension tells whether a tunnel is suspended and how
+type suspension int
+
+const (
+	notSuspended suspension = iota
+	// Tunnel rejects new connections
+	suspendReject
+	// Tunnel closes its listener
+	suspendClose
+)
+
+// errTunnelSuspended is returned by run when tunnel closes its listener since
+// it got suspended
+var errTunnelSuspended = errors.New("Tunnel is suspended")
+
+// Suspend makes a tunnel reject new connections or, if closeListener is set,
+// close its listener along with active connections until it is resumed
+func (t *Tunnel) Suspend(closeListener bool) {
+	s := suspendReject
+	if closeListener {
+		s = suspendClose
+	}
+	t.suspend(s)
+}
+
+// Resume makes a suspended tunnel accept connections again
+func (t *Tunnel) Resume() {
+	t.suspend(notSuspended)
+}
+
+func (t *Tunnel) suspend(s suspension) {
+	select {
+	case t.updateSuspension <- s:
+	case <-t.shutdown:
+	}
+}
+
+// logSuspension logs a change of tunnel suspension
+func (t *Tunnel) logSuspension(s suspension) {
+	switch s {
+	case notSuspended:
+		t.logf(LogInfo, "Tunnel at %q resumed", t.listenAt)
+	case suspendReject:
+		t.logf(LogInfo, "Tunnel at %q is suspended and rejects connections", t.listenAt)
+	case suspendClose:
+		t.logf(LogInfo, "Tunnel at %q is suspended and closes its listener", t.listenAt)
+	}
+}
+
+// applyWindows suspends or resumes a tunnel according to its active windows.
+// Returns false if nothing changed. Must be called on the manager goroutine.
+func (m *TunnelManager) applyWindows(t *dispatchTunnel) bool {
+	s := t.active.suspension(time.Now())
+	if s == t.suspended {
+		return false
+	}
+	t.tunnel.suspend(s)
+	t.suspended = s
+	return true
+}
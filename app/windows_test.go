@@ -0,0 +1,164 @@
+package app
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestActiveWindows(t *testing.T) {
+	// 2021-03-06 is a Saturday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 3, day, hour, minute, 0, 0, time.Local)
+	}
+	maintenance := &ActiveWindows{
+		Windows: []ActiveWindow{{From: "22:00", To: "02:00", Days: []string{"Sat"}}},
+		Outside: OutsideClose,
+	}
+	cases := []struct {
+		windows  *ActiveWindows
+		now      time.Time
+		expected suspension
+	}{
+		{nil, at(6, 12, 0), notSuspended},
+		{maintenance, at(6, 23, 0), notSuspended},
+		{maintenance, at(7, 1, 59), notSuspended},
+		{maintenance, at(7, 2, 0), suspendClose},
+		{maintenance, at(6, 21, 59), suspendClose},
+		{&ActiveWindows{Windows: []ActiveWindow{{From: "09:00", To: "18:00"}}},
+			at(1, 8, 0), suspendReject},
+	}
+	for _, c := range cases {
+		if s := c.windows.suspension(c.now); s != c.expected {
+			t.Errorf("%+v at %v: expected suspension %v, got %v", c.windows, c.now,
+				c.expected, s)
+		}
+	}
+
+	invalid := []*ActiveWindows{
+		{},
+		{Windows: []ActiveWindow{{From: "10pm", To: "02:00"}}},
+		{Windows: []ActiveWindow{{From: "22:00", To: "02:00", Days: []string{"Caturday"}}}},
+		{Windows: []ActiveWindow{{From: "22:00", To: "02:00"}}, Outside: "drop"},
+	}
+	for _, windows := range invalid {
+		if err := windows.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", windows)
+		}
+	}
+
+	if !maintenance.equal(&ActiveWindows{
+		Windows: []ActiveWindow{{From: "22:00", To: "02:00", Days: []string{"Sat"}}},
+		Outside: OutsideClose,
+	}) {
+		t.Errorf("Expected identical active windows to be equal")
+	}
+	if maintenance.equal(nil) || maintenance.equal(&ActiveWindows{
+		Windows: maintenance.Windows,
+	}) {
+		t.Errorf("Expected different active windows not to be equal")
+	}
+}
+
+func TestTunnelSuspend(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	listenAt := freePort(t)
+	tunnel, err := NewTunnel(listenAt, ConnectTo(upstream.Addr().String()),
+		TunnelLimits{}, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	// Suspended tunnel rejects new connections
+	tunnel.Suspend(false)
+	client, err := net.Dial("tcp", string(listenAt))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection to be rejected, got %v", err)
+	}
+	client.Close()
+
+	tunnel.Resume()
+	client, err = net.Dial("tcp", string(listenAt))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	waitFor := func(condition func() bool, what string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return len(tunnel.Connections()) == 1 }, "connection")
+
+	// Tunnel suspended with its listener closed drops its connections and
+	// doesn't listen until it is resumed
+	tunnel.Suspend(true)
+	waitFor(func() bool { return len(tunnel.Connections()) == 0 }, "connection to close")
+	waitFor(func() bool {
+		conn, err := net.Dial("tcp", string(listenAt))
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, "listener to close")
+
+	tunnel.Resume()
+	waitFor(func() bool {
+		conn, err := net.Dial("tcp", string(listenAt))
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, "tunnel to listen again")
+}
+
+func TestApplyActiveWindows(t *testing.T) {
+	quit := make(chan struct{})
+	gs := &gracefulShutdown{
+		quit:      quit,
+		waitGroup: new(sync.WaitGroup),
+	}
+	defer gs.waitGroup.Wait()
+	defer close(quit)
+
+	persistence, err := newStatePersistence("", 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize state persistence: %v", err)
+	}
+	manager := newTunnelManager(make(chan ConfigurationJSON), persistence, gs)
+	manager.start()
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Weekday().String()[:3]
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1", Active: &ActiveWindows{
+			Windows: []ActiveWindow{{From: "00:00", To: "00:00", Days: []string{tomorrow}}},
+		}},
+	}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	if tunnels := manager.ListTunnels(); len(tunnels) != 1 || !tunnels[0].Suspended {
+		t.Fatalf("Expected tunnel to be suspended outside of its windows, got %v", tunnels)
+	}
+
+	if _, err := manager.Apply([]TunnelSpec{
+		{ListenAt: "127.0.0.1:0", ConnectTo: "127.0.0.1:1"},
+	}); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	if tunnels := manager.ListTunnels(); tunnels[0].Suspended {
+		t.Errorf("Expected tunnel without active windows to be resumed, got %v", tunnels)
+	}
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Worker pools and identity groups are shared by all tenants, so only operator
+// could assign tunnels to them
+var errSharingForbidden = errors.New(
+	"Only operator is allowed to change worker pool and identity group of a tunnel")
+
+// Resources a forwarding connection takes from its worker pool: a forwarder
+// goroutine and a buffer for each direction
+const (
+	connectionGoroutines = 2
+	connectionMemory     = 2 * BufSize
+)
+
+// WorkerPoolConfigJSON encapsulates configuration of a worker pool: budgets of
+// goroutines and buffer memory shared by connections of all tunnels assigned
+// to the pool. Connections that don't fit into budgets are rejected, so that
+// a busy tunnel can't take resources from tunnels in other pools.
+type WorkerPoolConfigJSON struct {
+	// Maximum number of forwarding goroutines (unlimited if zero)
+	MaxGoroutines int `json:"maxGoroutines,omitempty"`
+	// Maximum amount of memory taken by forwarding buffers (unlimited if
+	// zero)
+	MaxMemory DataSize `json:"maxMemory,omitempty"`
+}
+
+// validate checks worker pool configuration for errors
+func (c WorkerPoolConfigJSON) validate() error {
+	if c.MaxGoroutines < 0 || c.MaxMemory < 0 {
+		return fmt.Errorf("Worker pool budgets must not be negative")
+	}
+	if c.MaxGoroutines == 0 && c.MaxMemory == 0 {
+		return fmt.Errorf("Worker pool must limit goroutines or memory")
+	}
+	return nil
+}
+
+// fits tells whether one more connection fits into budgets given resources
+// already in use
+func (c WorkerPoolConfigJSON) fits(goroutines int, memory int64) bool {
+	if c.MaxGoroutines > 0 && goroutines+connectionGoroutines > c.MaxGoroutines {
+		return false
+	}
+	if c.MaxMemory > 0 && memory+connectionMemory > int64(c.MaxMemory) {
+		return false
+	}
+	return true
+}
+
+// WorkerPoolInfo describes a worker pool and resources its connections use
+type WorkerPoolInfo struct {
+	Name string `json:"name"`
+	WorkerPoolConfigJSON
+	Goroutines int   `json:"goroutines"`
+	Memory     int64 `json:"memory"`
+	// Number of connections rejected since budgets were used up
+	Rejected int64 `json:"rejected"`
+}
+
+type workerPool struct {
+	config     WorkerPoolConfigJSON
+	goroutines int
+	memory     int64
+	rejected   int64
+}
+
+// workerLease is a share of a worker pool taken by a connection
+type workerLease struct {
+	pools *WorkerPools
+	pool  *workerPool
+}
+
+// WorkerPools is a set of named worker pools shared by tunnels. Safe for
+// concurrent use.
+type WorkerPools struct {
+	mu    *sync.Mutex
+	pools map[string]*workerPool
+}
+
+// NewWorkerPools creates an empty set of worker pools
+func NewWorkerPools() *WorkerPools {
+	return &WorkerPools{
+		mu:    new(sync.Mutex),
+		pools: make(map[string]*workerPool),
+	}
+}
+
+// Configure replaces the set of pools. Pools that stay keep track of
+// resources taken by their connections, even if new budgets are lower.
+func (p *WorkerPools) Configure(config map[string]WorkerPoolConfigJSON) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pools := make(map[string]*workerPool, len(config))
+	for name, c := range config {
+		pool, ok := p.pools[name]
+		if !ok {
+			pool = new(workerPool)
+		}
+		pool.config = c
+		pools[name] = pool
+	}
+	p.pools = pools
+}
+
+// config returns configuration of all pools
+func (p *WorkerPools) config() map[string]WorkerPoolConfigJSON {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pools) == 0 {
+		return nil
+	}
+	result := make(map[string]WorkerPoolConfigJSON, len(p.pools))
+	for name, pool := range p.pools {
+		result[name] = pool.config
+	}
+	return result
+}
+
+// Info returns worker pools sorted by name
+func (p *WorkerPools) Info() []WorkerPoolInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]WorkerPoolInfo, 0, len(p.pools))
+	for name, pool := range p.pools {
+		result = append(result, WorkerPoolInfo{
+			Name:                 name,
+			WorkerPoolConfigJSON: pool.config,
+			Goroutines:           pool.goroutines,
+			Memory:               pool.memory,
+			Rejected:             pool.rejected,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// acquire takes resources of a connection from a named pool. Returns false if
+// they don't fit into pool budgets. Returns nil lease if there's no such pool,
+// in which case connection isn't restricted. Lease must be released once
+// connection ends.
+func (p *WorkerPools) acquire(name string) (*workerLease, bool) {
+	if p == nil || name == "" {
+		return nil, true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[name]
+	if !ok {
+		return nil, true
+	}
+	if !pool.config.fits(pool.goroutines, pool.memory) {
+		pool.rejected++
+		return nil, false
+	}
+	pool.goroutines += connectionGoroutines
+	pool.memory += connectionMemory
+	return &workerLease{pools: p, pool: pool}, true
+}
+
+// release gives resources back to the pool. Safe to call on nil lease.
+func (l *workerLease) release() {
+	if l == nil {
+		return
+	}
+	l.pools.mu.Lock()
+	defer l.pools.mu.Unlock()
+	l.pool.goroutines -= connectionGoroutines
+	l.pool.memory -= connectionMemory
+}
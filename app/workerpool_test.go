@@ -0,0 +1,104 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWorkerPools(t *testing.T) {
+	pools := NewWorkerPools()
+	pools.Configure(map[string]WorkerPoolConfigJSON{
+		"small": {MaxGoroutines: 2 * connectionGoroutines},
+		"tiny":  {MaxMemory: connectionMemory},
+	})
+
+	var leases []*workerLease
+	for i := 0; i < 2; i++ {
+		lease, ok := pools.acquire("small")
+		if !ok || lease == nil {
+			t.Fatalf("Expected connection %d to fit into pool", i)
+		}
+		leases = append(leases, lease)
+	}
+	if _, ok := pools.acquire("small"); ok {
+		t.Errorf("Expected goroutine budget to be exhausted")
+	}
+	if _, ok := pools.acquire("tiny"); !ok {
+		t.Errorf("Expected pools not to share budgets")
+	}
+	if _, ok := pools.acquire("tiny"); ok {
+		t.Errorf("Expected memory budget to be exhausted")
+	}
+	if lease, ok := pools.acquire("unknown"); !ok || lease != nil {
+		t.Errorf("Expected connections outside of pools not to be restricted")
+	}
+
+	// Pools keep track of connections across configuration changes
+	pools.Configure(map[string]WorkerPoolConfigJSON{
+		"small": {MaxGoroutines: 3 * connectionGoroutines},
+	})
+	if _, ok := pools.acquire("small"); !ok {
+		t.Errorf("Expected raised budget to fit one more connection")
+	}
+	leases[0].release()
+	info := pools.Info()
+	if len(info) != 1 || info[0].Goroutines != 2*connectionGoroutines || info[0].Rejected != 1 {
+		t.Errorf("Unexpected worker pools: %+v", info)
+	}
+
+	for _, c := range []WorkerPoolConfigJSON{{}, {MaxGoroutines: -1}} {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestWorkerPoolRejects(t *testing.T) {
+	upstream := startUpstream(t)
+	defer upstream.Close()
+
+	pools := NewWorkerPools()
+	pools.Configure(map[string]WorkerPoolConfigJSON{
+		"single": {MaxGoroutines: connectionGoroutines},
+	})
+	tunnel, err := NewTunnel("127.0.0.1:0", ConnectTo(upstream.Addr().String()),
+		TunnelLimits{WorkerPool: "single"}, TunnelOptions{WorkerPools: pools})
+	if err != nil {
+		t.Fatalf("Failed to create tunnel: %v", err)
+	}
+	defer tunnel.Shutdown()
+
+	first, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer first.Close()
+	for len(tunnel.Connections()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection beyond pool budget to be rejected, got %v", err)
+	}
+	if closed := tunnel.Stats().Closed; closed[CloseWorkerPoolFull] != 1 {
+		t.Errorf("Expected rejected connection to be counted, got %v", closed)
+	}
+
+	// Closed connection gives its resources back
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for pools.Info()[0].Goroutines != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected closed connection to release its share of the pool")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
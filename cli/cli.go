@@ -0,0 +1,47 @@
+// Package cli implements command-line subcommands, mostly ones that talk to a
+// running throttle over its control socket (see -control command-line
+// argument).
+package cli
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultControlPath is the control socket path subcommands use by default
+const DefaultControlPath = "throttle.sock"
+
+// Commands maps subcommand names to their implementations. Each
+// implementation gets command-line arguments following subcommand name.
+var Commands = map[string]func(args []string) error{
+	"console": Console,
+	"replay":  Replay,
+	"ss":      SS,
+}
+
+// requestTimeout limits the time a single request to throttle may take
+const requestTimeout = 10 * time.Second
+
+// formatBytes formats a number of bytes in a human readable way
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	div, exp := float64(unit), 0
+	for n/div >= unit && exp < 3 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", n/div, "KMGT"[exp])
+}
+
+// formatRate formats bytes per second in a human readable way
+func formatRate(bytesPerSecond float64) string {
+	return formatBytes(bytesPerSecond) + "/s"
+}
+
+// formatAge formats time passed since a given moment rounded to seconds
+func formatAge(since time.Time) string {
+	return time.Since(since).Round(time.Second).String()
+}
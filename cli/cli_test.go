@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		n        float64
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1536, "1.5KB"},
+		{5 * 1024 * 1024, "5.0MB"},
+		{3 * 1024 * 1024 * 1024 * 1024 * 1024, "3072.0TB"},
+	}
+	for _, c := range cases {
+		if s := formatBytes(c.n); s != c.expected {
+			t.Errorf("Expected %v to be formatted as %q, got %q", c.n, c.expected, s)
+		}
+	}
+}
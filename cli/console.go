@@ -0,0 +1,433 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anton-dessiatov/throttle/app"
+	"github.com/anton-dessiatov/throttle/client"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// consolePrompt is shown by the console when it's waiting for a command
+const consolePrompt = "throttle> "
+
+// errExit is returned by exit command to stop the console
+var errExit = errors.New("Exit requested")
+
+// console is an interactive shell managing tunnels over the control socket
+type console struct {
+	client *client.Client
+	out    io.Writer
+}
+
+// consoleCommand is a command understood by the console
+type consoleCommand struct {
+	args string
+	help string
+	// Completion candidates for an argument given arguments preceding it. May
+	// be nil if command takes no arguments.
+	complete func(c *console, args []string) []string
+	run      func(c *console, args []string) error
+}
+
+var consoleCommands map[string]consoleCommand
+
+func init() {
+	// Initialized here since help command refers to the map
+	consoleCommands = map[string]consoleCommand{
+		"help": {
+			help: "Show available commands",
+			run:  (*console).help,
+		},
+		"tunnels": {
+			help: "List tunnels",
+			run:  (*console).tunnels,
+		},
+		"connections": {
+			args:     "<tunnel> [<filter>]",
+			help:     "List active connections of a tunnel, optionally matching a filter",
+			complete: completeTunnel,
+			run:      (*console).connections,
+		},
+		"limit": {
+			args:     "<tunnel> <tunnel limit> [<connection limit>]",
+			help:     "Change tunnel limits, e.g. \"limit :8080 10Mbps 1Mbps\" (0 is unlimited)",
+			complete: completeTunnel,
+			run:      (*console).limit,
+		},
+		"connection-limit": {
+			args:     "<tunnel> <connection>|<filter> <limit>|reset",
+			help:     "Change limit of connections or reset it to tunnel connection limit",
+			complete: completeConnection,
+			run:      (*console).connectionLimit,
+		},
+		"drain": {
+			args:     "<tunnel>",
+			help:     "Reject new connections while letting active ones complete",
+			complete: completeTunnel,
+			run: func(c *console, args []string) error {
+				return c.setDraining(args, true)
+			},
+		},
+		"undrain": {
+			args:     "<tunnel>",
+			help:     "Accept new connections again",
+			complete: completeTunnel,
+			run: func(c *console, args []string) error {
+				return c.setDraining(args, false)
+			},
+		},
+		"kill": {
+			args:     "<tunnel> <connection>|<filter>",
+			help:     "Close active connections",
+			complete: completeConnection,
+			run:      (*console).kill,
+		},
+		"exit": {
+			help: "Leave the console",
+			run: func(c *console, args []string) error {
+				return errExit
+			},
+		},
+	}
+}
+
+// Console runs an interactive shell that lists tunnels, adjusts their limits,
+// drains them and kills connections over the control socket. Commands and their
+// arguments are completed with Tab. If standard input is not a terminal,
+// commands are read from it one per line.
+func Console(args []string) error {
+	flags := flag.NewFlagSet("console", flag.ExitOnError)
+	controlPath := flags.String("control", DefaultControlPath, "Path to control socket")
+	flags.Parse(args)
+
+	c := &console{
+		client: client.NewUnix(*controlPath),
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		c.out = os.Stdout
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if c.execute(scanner.Text()) == errExit {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, consolePrompt)
+	term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		newLine, newPos, candidates := c.complete(line, pos)
+		if len(candidates) > 1 && newLine == line {
+			fmt.Fprintln(term, strings.Join(candidates, "  "))
+		}
+		return newLine, newPos, true
+	}
+	c.out = term
+	fmt.Fprintln(term, "Type \"help\" to list commands, Tab completes commands and arguments")
+	fmt.Fprintln(term, "Filters select connections, e.g. \"src=10.0.0.0/8 and rate>1MiB/s and age>5m\"")
+
+	for {
+		line, err := term.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c.execute(line) == errExit {
+			return nil
+		}
+	}
+}
+
+// execute runs a single command line printing an error if command fails.
+// Returns an error returned by a command.
+func (c *console) execute(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	command, ok := consoleCommands[fields[0]]
+	if !ok {
+		fmt.Fprintf(c.out, "Unknown command %q, type \"help\" to list commands\n", fields[0])
+		return nil
+	}
+	err := command.run(c, fields[1:])
+	if err != nil && err != errExit {
+		fmt.Fprintf(c.out, "Error: %v\n", err)
+	}
+	return err
+}
+
+// complete completes a word ending at a given position of a line. Returns new
+// line and position along with all candidates matching the word.
+func (c *console) complete(line string, pos int) (string, int, []string) {
+	head := line[:pos]
+	fields := strings.Fields(head)
+	// Word being completed is empty if cursor follows a space
+	word := ""
+	if len(fields) > 0 && !strings.HasSuffix(head, " ") {
+		word = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	var options []string
+	if len(fields) == 0 {
+		for name := range consoleCommands {
+			options = append(options, name)
+		}
+	} else if command, ok := consoleCommands[fields[0]]; ok && command.complete != nil {
+		options = command.complete(c, fields[1:])
+	}
+
+	var candidates []string
+	for _, option := range options {
+		if strings.HasPrefix(option, word) {
+			candidates = append(candidates, option)
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 0 {
+		return line, pos, nil
+	}
+
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasPrefix(line[pos:], " ") {
+		completion += " "
+	}
+	head = head[:len(head)-len(word)] + completion
+	return head + line[pos:], len(head), candidates
+}
+
+// commonPrefix returns the longest common prefix of given non-empty list of
+// strings
+func commonPrefix(s []string) string {
+	prefix := s[0]
+	for _, v := range s[1:] {
+		for !strings.HasPrefix(v, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// completeTunnel completes the first argument with tunnel listening specs
+func completeTunnel(c *console, args []string) []string {
+	if len(args) != 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	tunnels, err := c.client.ListTunnels(ctx)
+	if err != nil {
+		return nil
+	}
+	result := make([]string, 0, len(tunnels))
+	for _, t := range tunnels {
+		result = append(result, t.ListenAt)
+	}
+	return result
+}
+
+// completeConnection completes the first argument with tunnel listening specs
+// and the second one with identifiers of connections of that tunnel
+func completeConnection(c *console, args []string) []string {
+	if len(args) != 1 {
+		return completeTunnel(c, args)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	connections, err := c.client.ListConnections(ctx, args[0])
+	if err != nil {
+		return nil
+	}
+	result := make([]string, 0, len(connections))
+	for _, conn := range connections {
+		result = append(result, strconv.FormatUint(conn.ID, 10))
+	}
+	return result
+}
+
+func (c *console) help(args []string) error {
+	var names []string
+	for name := range consoleCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		command := consoleCommands[name]
+		fmt.Fprintf(w, "%s %s\t%s\n", name, command.args, command.help)
+	}
+	return w.Flush()
+}
+
+func (c *console) tunnels(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	tunnels, err := c.client.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Tunnel\tUpstream\tTenant\tProfile\tTunnel limit\tConnection limit\tRate(1s)\tState")
+	for _, t := range tunnels {
+		state := "accepting"
+		if t.Draining {
+			state = "draining"
+		} else if t.Suspended {
+			state = "suspended"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ListenAt, t.ConnectTo,
+			orDash(t.Tenant), orDash(t.Profile), formatLimit(t.Limits.TunnelLimit, false),
+			formatLimit(t.Limits.ConnectionLimit, false),
+			formatRate(t.Stats.Throughput.Rate1s), state)
+	}
+	return w.Flush()
+}
+
+func (c *console) connections(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: connections <tunnel> [<filter>]")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	connections, err := c.client.FilterConnections(ctx, args[0],
+		strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPeer\tUpstream\tClass\tRate(1s)\tLimit\tAge")
+	for _, conn := range connections {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", conn.ID, conn.Client, conn.Upstream,
+			conn.Traffic.Class, formatRate(conn.Stats.Throughput.Rate1s),
+			formatConnectionLimit(conn), formatAge(conn.Opened))
+	}
+	return w.Flush()
+}
+
+func (c *console) limit(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errors.New("Usage: limit <tunnel> <tunnel limit> [<connection limit>]")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	tunnel, err := c.client.GetTunnel(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	// Limits other than the ones given are kept as they are
+	limits := tunnel.Limits
+	if limits.TunnelLimit, err = parseLimit(args[1]); err != nil {
+		return err
+	}
+	if len(args) == 3 {
+		if limits.ConnectionLimit, err = parseLimit(args[2]); err != nil {
+			return err
+		}
+	}
+	return c.client.UpdateTunnelLimits(ctx, args[0], limits)
+}
+
+func (c *console) connectionLimit(args []string) error {
+	if len(args) < 3 {
+		return errors.New("Usage: connection-limit <tunnel> <connection>|<filter> <limit>|reset")
+	}
+	var limit *client.Limit
+	if last := args[len(args)-1]; last != "reset" {
+		l, err := parseLimit(last)
+		if err != nil {
+			return err
+		}
+		limit = &l
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	selector := args[1 : len(args)-1]
+	if id, ok := connectionID(selector); ok {
+		return c.client.UpdateConnectionLimit(ctx, args[0], id, limit)
+	}
+	ids, err := c.client.UpdateConnectionLimits(ctx, args[0], strings.Join(selector, " "), limit)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Updated %d connection(s)\n", len(ids))
+	return nil
+}
+
+func (c *console) setDraining(args []string, draining bool) error {
+	if len(args) != 1 {
+		return errors.New("Usage: drain|undrain <tunnel>")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return c.client.SetTunnelDraining(ctx, args[0], draining)
+}
+
+func (c *console) kill(args []string) error {
+	if len(args) < 2 {
+		return errors.New("Usage: kill <tunnel> <connection>|<filter>")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if id, ok := connectionID(args[1:]); ok {
+		return c.client.CloseConnection(ctx, args[0], id)
+	}
+	ids, err := c.client.CloseConnections(ctx, args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Closed %d connection(s)\n", len(ids))
+	return nil
+}
+
+// connectionID tells whether command arguments are a single connection
+// identifier rather than a filter
+func connectionID(args []string) (uint64, bool) {
+	if len(args) != 1 {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	return id, err == nil
+}
+
+// parseLimit parses a bandwidth limit the same way configuration file does
+// (e.g. "10Mbps" or "1000")
+func parseLimit(s string) (client.Limit, error) {
+	l, err := app.ParseLimit(s)
+	return client.Limit(l), err
+}
+
+// orDash returns a given string or "-" if it's empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"testing"
+)
+
+func TestConsoleCompleteCommand(t *testing.T) {
+	c := &console{}
+	cases := []struct {
+		line     string
+		pos      int
+		expected string
+	}{
+		{"dr", 2, "drain "},
+		{"co", 2, "connection"},
+		{"un", 2, "undrain "},
+		{"x", 1, "x"},
+		// Only the word under cursor is completed
+		{"ki :8080", 2, "kill :8080"},
+	}
+	for _, v := range cases {
+		line, pos, _ := c.complete(v.line, v.pos)
+		if line != v.expected {
+			t.Errorf("Expected %q completed at %d to be %q, got %q", v.line, v.pos,
+				v.expected, line)
+		}
+		if pos > len(line) {
+			t.Errorf("Position %d is beyond completed line %q", pos, line)
+		}
+	}
+}
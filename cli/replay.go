@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/anton-dessiatov/throttle/app"
+)
+
+// Replay sends data a client sent in a connection recording (see recordDir
+// tunnel setting) to an upstream and compares what upstream sends back to the
+// recorded response. Fails if responses differ.
+func Replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	upstream := flags.String("upstream", "", "Address to replay to (recorded upstream if empty)")
+	speed := flags.Float64("speed", 1, "Replay speed relative to recording, e.g. 2 replays "+
+		"twice as fast (0 sends all the data at once)")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long upstream could stay silent "+
+		"after all the data is sent")
+	output := flags.String("output", "", "Path to write data upstream sent back to")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: throttle replay [options] <recording>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("Recording file expected")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	recording, err := app.ReadRecording(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	address := *upstream
+	if address == "" {
+		address = recording.Header.Upstream
+	}
+	conn, err := net.DialTimeout("tcp", address, requestTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	result, err := recording.Replay(conn, app.ReplayOptions{Speed: *speed, Timeout: *timeout})
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		if err := ioutil.WriteFile(*output, result.Received, 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Sent %d bytes, received %d bytes (%d recorded)\n",
+		len(recording.Sent(app.RecordedClient)), len(result.Received),
+		len(recording.Sent(app.RecordedUpstream)))
+	if !result.Matches {
+		return fmt.Errorf("Upstream response differs from the recorded one")
+	}
+	return nil
+}
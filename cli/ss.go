@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/anton-dessiatov/throttle/client"
+)
+
+// SS prints the table of active connections of all tunnels, similar to
+// ss(8): tunnel, peer, upstream, traffic class, throughput, limit and amount
+// of traffic forwarded.
+func SS(args []string) error {
+	flags := flag.NewFlagSet("ss", flag.ExitOnError)
+	controlPath := flags.String("control", DefaultControlPath, "Path to control socket")
+	tunnel := flags.String("tunnel", "", "Only show connections of a tunnel listening at a "+
+		"given spec")
+	filter := flags.String("filter", "", "Only show connections matching a filter "+
+		"expression, e.g. \"src=10.0.0.0/8 and rate>1MiB/s and age>5m\"")
+	flags.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	c := client.NewUnix(*controlPath)
+
+	tunnels, err := c.ListTunnels(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Tunnel\tPeer\tUpstream\tClass\tRate(1s)\tRate(1m)\tLimit\tIn\tOut\tAge")
+	for _, t := range tunnels {
+		if *tunnel != "" && t.ListenAt != *tunnel {
+			continue
+		}
+		connections, err := c.FilterConnections(ctx, t.ListenAt, *filter)
+		if err != nil {
+			// Tunnel might have been shut down in the meantime
+			if apiErr, ok := err.(*client.Error); ok && apiErr.StatusCode == 404 {
+				continue
+			}
+			return err
+		}
+		for _, conn := range connections {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				t.ListenAt, conn.Client, conn.Upstream, conn.Traffic.Class,
+				formatRate(conn.Stats.Throughput.Rate1s),
+				formatRate(conn.Stats.Throughput.Rate1m),
+				formatConnectionLimit(conn),
+				formatBytes(float64(conn.Stats.Counters.IngressBytes)),
+				formatBytes(float64(conn.Stats.Counters.EgressBytes)),
+				formatAge(conn.Opened))
+		}
+	}
+	return w.Flush()
+}
+
+// formatLimit formats per-connection limit marking limits set for a
+// connection specifically with an asterisk
+func formatLimit(limit client.Limit, own bool) string {
+	result := "-"
+	if limit > 0 {
+		result = formatRate(float64(limit))
+	} else if limit == client.Blocked {
+		result = "blocked"
+	}
+	if own {
+		result += "*"
+	}
+	return result
+}
+
+// formatConnectionLimit formats limit of a connection, telling if connection
+// bypasses throttling
+func formatConnectionLimit(conn client.Connection) string {
+	if conn.Exempt {
+		return "exempt"
+	}
+	return formatLimit(conn.Limit, conn.OwnLimit)
+}
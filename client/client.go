@@ -0,0 +1,1061 @@
+// Package client is a Go client for throttle admin API. See api/openapi.yaml
+// for the API description.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a bandwidth limit expressed in bytes per second. Zero means no
+// limit.
+type Limit int64
+
+const (
+	// Unlimited limit doesn't throttle traffic
+	Unlimited Limit = 0
+	// Blocked limit pauses traffic until it's changed (only tunnel and
+	// connection limits could be blocked)
+	Blocked Limit = -1
+)
+
+// Duration is a time.Duration represented in JSON as a string (e.g. "1.5s")
+type Duration time.Duration
+
+// UnmarshalJSON is an implementation of json.Unmarshaler for Duration
+func (x *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*x = Duration(d)
+	return nil
+}
+
+// MarshalJSON is an implementation of json.Marshaler for Duration
+func (x Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(x).String())
+}
+
+// TunnelLimits encapsulates bandwidth limits for a given tunnel.
+type TunnelLimits struct {
+	TunnelLimit     Limit `json:"tunnelLimit"`
+	ConnectionLimit Limit `json:"connectionLimit"`
+	// Limit shared by all connections made from a single client IP address
+	ClientLimit Limit `json:"clientLimit,omitempty"`
+	// Limits of data clients upload and download applied on top of tunnel
+	// and connection limits
+	UploadLimit             Limit `json:"uploadLimit,omitempty"`
+	DownloadLimit           Limit `json:"downloadLimit,omitempty"`
+	ConnectionUploadLimit   Limit `json:"connectionUploadLimit,omitempty"`
+	ConnectionDownloadLimit Limit `json:"connectionDownloadLimit,omitempty"`
+	// If set, tunnel and connection limits let through traffic of this
+	// duration at once, so bursts scale along with limits
+	BurstDuration Duration `json:"burstDuration,omitempty"`
+	// If set, tunnel and connection limits let through this many bytes at
+	// once regardless of limits and BurstDuration
+	TunnelBurst     int `json:"tunnelBurst,omitempty"`
+	ConnectionBurst int `json:"connectionBurst,omitempty"`
+	// "leakyBucket" paces traffic at a constant rate, "slidingWindow" caps
+	// data within any second at the limit, "fairQueue" splits tunnel limit
+	// equally among connections, "fairShare" guarantees each connection an
+	// equal share lending unused ones (token bucket if empty)
+	Algorithm string `json:"algorithm,omitempty"`
+	// If set, small reads are held for up to this time to be forwarded
+	// together with following ones
+	CoalesceDelay Duration `json:"coalesceDelay,omitempty"`
+	// Delay added to every chunk of data forwarded in either direction and its
+	// random deviation, spread within Latency ± Jitter ("uniform", default)
+	// or with Jitter as standard deviation ("normal")
+	Latency            Duration `json:"latency,omitempty"`
+	Jitter             Duration `json:"jitter,omitempty"`
+	JitterDistribution string   `json:"jitterDistribution,omitempty"`
+	// Probability of every forwarded chunk to be dropped and of connection to
+	// be reset instead of forwarding a chunk
+	LossProbability  float64 `json:"lossProbability,omitempty"`
+	ResetProbability float64 `json:"resetProbability,omitempty"`
+	// If set, changes of tunnel and connection limits to these limits are
+	// spread over this time ("linear" or "exponential")
+	LimitRamp      Duration `json:"limitRamp,omitempty"`
+	LimitRampShape string   `json:"limitRampShape,omitempty"`
+	// If set, new connections start at SlowStartFraction of ConnectionLimit
+	// and ramp up to full ConnectionLimit over this time
+	SlowStartWindow   Duration `json:"slowStartWindow,omitempty"`
+	SlowStartFraction float64  `json:"slowStartFraction,omitempty"`
+	// Bandwidth each connection is allowed to spend on small (interactive)
+	// chunks of data without waiting behind bulk traffic
+	InteractiveBoost Limit `json:"interactiveBoost,omitempty"`
+	// If set, limits are only observed: traffic isn't throttled, but
+	// throttling that would have happened is reported in stats
+	ObserveOnly bool `json:"observeOnly,omitempty"`
+	// Limits evaluated alongside the enforced ones, but never enforced
+	ShadowTunnelLimit     Limit `json:"shadowTunnelLimit,omitempty"`
+	ShadowConnectionLimit Limit `json:"shadowConnectionLimit,omitempty"`
+	// "drain" closes the most bandwidth-hungry connections (above
+	// DrainThreshold) when tunnel limit gets lowered
+	TightenPolicy  string `json:"tightenPolicy,omitempty"`
+	DrainThreshold Limit  `json:"drainThreshold,omitempty"`
+	// Maximum number of simultaneous dials to upstream and number of
+	// connections allowed to wait for a dial slot
+	MaxDials  int `json:"maxDials,omitempty"`
+	DialQueue int `json:"dialQueue,omitempty"`
+	// Maximum number of connections served at once and number of connections
+	// allowed to wait for one of them to end
+	MaxConnections  int `json:"maxConnections,omitempty"`
+	ConnectionQueue int `json:"connectionQueue,omitempty"`
+	// Maximum number of simultaneous connections of a client IP address to
+	// the same destination and time a connection made sooner than that after
+	// the previous one of the client is held for
+	MaxDuplicateConnections int      `json:"maxDuplicateConnections,omitempty"`
+	ReconnectDelay          Duration `json:"reconnectDelay,omitempty"`
+	// Maximum number of simultaneous connections of a client IP address
+	MaxClientConnections int `json:"maxClientConnections,omitempty"`
+	// Maximum number of new connections accepted per second and number of
+	// them accepted at once after a quiet period
+	AcceptRate  float64 `json:"acceptRate,omitempty"`
+	AcceptBurst int     `json:"acceptBurst,omitempty"`
+	// Length of kernel accept queue and number of accepted connections
+	// allowed to wait for tunnel to handle them
+	ListenBacklog int `json:"listenBacklog,omitempty"`
+	AcceptQueue   int `json:"acceptQueue,omitempty"`
+	// If set, connections accepted within this time after a failed dial fail
+	// right away
+	DialFailureCache Duration `json:"dialFailureCache,omitempty"`
+	// Number of idle upstream connections kept for reuse and how long they
+	// are kept for
+	UpstreamPool        int      `json:"upstreamPool,omitempty"`
+	UpstreamIdleTimeout Duration `json:"upstreamIdleTimeout,omitempty"`
+	// If set, connections living for longer than that are closed
+	MaxLifetime Duration `json:"maxLifetime,omitempty"`
+	// If set, clients could request their connection limit with a preamble
+	// capped at PreambleMaxRate (ConnectionLimit if zero)
+	RatePreamble    bool  `json:"ratePreamble,omitempty"`
+	PreambleMaxRate Limit `json:"preambleMaxRate,omitempty"`
+	// Name of an identity group whose per-client limits connections share
+	// with connections of the same client to other tunnels
+	IdentityGroup string `json:"identityGroup,omitempty"`
+	// Bytes tunnel is allowed to forward within a quota period ("" for a
+	// month, "week" or "day"). Once they are used up, tunnel is limited to
+	// QuotaTrickle or, if it's zero, rejects connections until the next
+	// period.
+	Quota        int64  `json:"quota,omitempty"`
+	QuotaPeriod  string `json:"quotaPeriod,omitempty"`
+	QuotaTrickle Limit  `json:"quotaTrickle,omitempty"`
+	// Name of a worker pool connections share goroutine and memory budgets in
+	WorkerPool string `json:"workerPool,omitempty"`
+}
+
+// WorkerPool describes a worker pool and resources its connections use
+type WorkerPool struct {
+	Name          string `json:"name"`
+	MaxGoroutines int    `json:"maxGoroutines,omitempty"`
+	MaxMemory     int64  `json:"maxMemory,omitempty"`
+	Goroutines    int    `json:"goroutines"`
+	Memory        int64  `json:"memory"`
+	// Number of connections rejected since budgets were used up
+	Rejected int64 `json:"rejected"`
+}
+
+// OSLimits describes limits of the host relevant to tunnels
+type OSLimits struct {
+	// Soft and hard limits of open file descriptors
+	OpenFiles    uint64 `json:"openFiles"`
+	MaxOpenFiles uint64 `json:"maxOpenFiles"`
+	// Maximum length of listen backlog (zero if unknown)
+	ListenBacklog int `json:"listenBacklog,omitempty"`
+	// File descriptors tunnels could use at most given their MaxConnections
+	TunnelFiles uint64 `json:"tunnelFiles"`
+	// Discrepancies between tunnel limits and limits of the host
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// TunnelCounters holds amounts of traffic forwarded by a tunnel.
+type TunnelCounters struct {
+	IngressBytes int64 `json:"ingressBytes"`
+	EgressBytes  int64 `json:"egressBytes"`
+}
+
+// Throughput holds moving averages of throughput (ingress and egress
+// combined) in bytes per second over several windows
+type Throughput struct {
+	Rate1s  float64 `json:"1s"`
+	Rate10s float64 `json:"10s"`
+	Rate1m  float64 `json:"1m"`
+}
+
+// ObservedThrottling describes throttling that observed limits would have
+// applied if they were enforced
+type ObservedThrottling struct {
+	DelayedBytes int64    `json:"delayedBytes"`
+	Delay        Duration `json:"delay"`
+	BlockedBytes int64    `json:"blockedBytes"`
+}
+
+// TunnelStats is a point-in-time view of tunnel activity
+type TunnelStats struct {
+	Counters   TunnelCounters     `json:"counters"`
+	Throughput Throughput         `json:"throughput"`
+	Observed   ObservedThrottling `json:"observed"`
+	Shadow     ObservedThrottling `json:"shadow"`
+	// Number of connections ended for each reason (tunnels only)
+	Closed map[string]int64 `json:"closed,omitempty"`
+	// Traffic of labeled connections by their labels (tunnels only)
+	Labeled []LabeledCounters `json:"labeled,omitempty"`
+	// Time transfers spent waiting for limiters
+	Waits Waits `json:"waits"`
+	// Upstream dial and response latencies
+	Latency Latency `json:"latency"`
+	// Limiters in effect (tunnels and connections only)
+	Buckets *Buckets `json:"buckets,omitempty"`
+	// Transfer quota usage (tunnels having a quota only)
+	Quota *QuotaUsage `json:"quota,omitempty"`
+	// Limit classes and their traffic (tunnels having classes only)
+	Classes []ClassStats `json:"classes,omitempty"`
+	// Fairness of throughput of connections (tunnels only)
+	Fairness *Fairness `json:"fairness,omitempty"`
+}
+
+// Fairness holds moving averages of Jain's fairness index of throughput of
+// tunnel connections: 1 if connections get equal throughput, down to 1/n if
+// one of n connections takes everything
+type Fairness struct {
+	Index1s  float64 `json:"1s"`
+	Index10s float64 `json:"10s"`
+	Index1m  float64 `json:"1m"`
+}
+
+// ClassStats describes traffic of a limit class
+type ClassStats struct {
+	Name string `json:"name"`
+	// Limit class currently has (zero if tunnel isn't limited)
+	Limit       Limit   `json:"limit"`
+	Connections int     `json:"connections"`
+	Rate        float64 `json:"rate"`
+}
+
+// QuotaUsage tells how much of its quota a tunnel used within current period
+type QuotaUsage struct {
+	Since     time.Time `json:"since"`
+	Used      int64     `json:"used"`
+	Exhausted bool      `json:"exhausted,omitempty"`
+}
+
+// Waits describes time transfers spent waiting for limiters
+type Waits struct {
+	Count int64    `json:"count"`
+	Bytes int64    `json:"bytes"`
+	Time  Duration `json:"time"`
+	// Average number of transfers waiting over the last 10 seconds
+	Waiting float64 `json:"waiting"`
+}
+
+// Latency describes how fast upstream responds: number of upstream
+// connections made (reused ones aren't counted) and total time it took, and
+// number of connections upstream sent data to and total time to first byte
+type Latency struct {
+	Dials         int64    `json:"dials"`
+	DialTime      Duration `json:"dialTime"`
+	FirstBytes    int64    `json:"firstBytes"`
+	FirstByteTime Duration `json:"firstByteTime"`
+}
+
+// Bucket is a point-in-time view of a token bucket limiter
+type Bucket struct {
+	Limit  Limit   `json:"limit"`
+	Burst  int     `json:"burst"`
+	Tokens float64 `json:"tokens"`
+}
+
+// Buckets describes limiters in effect for a tunnel or a connection
+type Buckets struct {
+	Tunnel     *Bucket  `json:"tunnel,omitempty"`
+	Shared     []Bucket `json:"shared,omitempty"`
+	Connection *Bucket  `json:"connection,omitempty"`
+}
+
+// LabeledCounters holds traffic of connections having the same labels
+type LabeledCounters struct {
+	Labels   map[string]string `json:"labels"`
+	Counters TunnelCounters    `json:"counters"`
+}
+
+// Tunnel describes a running tunnel
+type Tunnel struct {
+	ListenAt  string       `json:"listenAt"`
+	ConnectTo string       `json:"connectTo"`
+	Tenant    string       `json:"tenant,omitempty"`
+	Profile   string       `json:"profile,omitempty"`
+	Limits    TunnelLimits `json:"limits"`
+	Exemptions
+	TunnelSettings
+	UpstreamTLS *UpstreamTLS `json:"upstreamTLS,omitempty"`
+	Via         []Hop        `json:"via,omitempty"`
+	Stats       TunnelStats  `json:"stats"`
+	// Tunnel rejects new connections
+	Draining bool `json:"draining,omitempty"`
+	// Port range tunnel was created on demand for
+	OnDemand string `json:"onDemand,omitempty"`
+	// Tunnel was made by CreateTunnel and lasts until deleted
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// Address tunnel listens at if listenAt has zero port
+	Address string `json:"address,omitempty"`
+	// Name tunnel is registered as in service registries
+	Service  string         `json:"service,omitempty"`
+	Schedule []ScheduleRule `json:"schedule,omitempty"`
+	// Limits tunnel runs with instead of Limits because of its schedule
+	ScheduledLimits *TunnelLimits  `json:"scheduledLimits,omitempty"`
+	Classes         []LimitClass   `json:"classes,omitempty"`
+	Access          []AccessRule   `json:"access,omitempty"`
+	Priorities      []PriorityRule `json:"priorities,omitempty"`
+	Subnets         []SubnetLimit  `json:"subnets,omitempty"`
+	Backends        []BackendLimit `json:"backends,omitempty"`
+	Active          *ActiveWindows `json:"active,omitempty"`
+	// Tunnel is outside of its active windows
+	Suspended bool `json:"suspended,omitempty"`
+}
+
+// Tenant describes a tenant and aggregate activity of its tunnels
+type Tenant struct {
+	Name    string      `json:"name"`
+	Limit   Limit       `json:"limit"`
+	Tunnels int         `json:"tunnels"`
+	Stats   TunnelStats `json:"stats"`
+}
+
+// TunnelSpec is a desired state of a tunnel
+type TunnelSpec struct {
+	ListenAt  string       `json:"listenAt"`
+	ConnectTo string       `json:"connectTo"`
+	Limits    TunnelLimits `json:"limits"`
+	Tenant    string       `json:"tenant,omitempty"`
+	// Name of a profile to take limits from instead of Limits
+	Profile string `json:"profile,omitempty"`
+	Exemptions
+	TunnelSettings
+	// If set, traffic to upstream is encrypted with TLS
+	UpstreamTLS *UpstreamTLS `json:"upstreamTLS,omitempty"`
+	// Hops upstream connections are made through, in order
+	Via []Hop `json:"via,omitempty"`
+	// Rules switching limits by time of day
+	Schedule []ScheduleRule `json:"schedule,omitempty"`
+	// Classes splitting tunnel limit between connections
+	Classes []LimitClass `json:"classes,omitempty"`
+	// Rules deciding which connections reach upstream
+	Access []AccessRule `json:"access,omitempty"`
+	// Rules telling priorities of connections
+	Priorities []PriorityRule `json:"priorities,omitempty"`
+	// Aggregate limits of connections from subnets
+	Subnets []SubnetLimit `json:"subnets,omitempty"`
+	// Aggregate limits of connections to backends connectTo resolves to
+	Backends []BackendLimit `json:"backends,omitempty"`
+	// Windows tunnel accepts connections in (always if nil)
+	Active *ActiveWindows `json:"active,omitempty"`
+	// Name tunnel is registered as in service registries (not registered if
+	// empty)
+	Service string `json:"service,omitempty"`
+}
+
+// LimitClass is a share of tunnel limit given to connections matching a rule.
+// Connection belongs to the first class it matches.
+type LimitClass struct {
+	Name string `json:"name"`
+	// Fraction of tunnel limit guaranteed to the class and fraction it could
+	// use borrowing from other classes (whole tunnel limit if zero)
+	Share float64    `json:"share"`
+	Ceil  float64    `json:"ceil,omitempty"`
+	Match ClassMatch `json:"match,omitempty"`
+}
+
+// ClassMatch tells which connections belong to a class. All of specified
+// conditions must hold, empty match takes all connections.
+type ClassMatch struct {
+	Clients     []string          `json:"clients,omitempty"`
+	Sources     []string          `json:"sources,omitempty"`
+	ServerNames []string          `json:"serverNames,omitempty"`
+	Identities  []string          `json:"identities,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// "idle", "interactive" or "bulk"
+	Traffic string `json:"traffic,omitempty"`
+}
+
+// AccessRule allows ("allow") or denies ("deny") connections matching it to
+// reach upstream. Connection is decided on by the first rule it matches,
+// connections matching none are allowed.
+type AccessRule struct {
+	Action string    `json:"action"`
+	Match  MatchRule `json:"match,omitempty"`
+}
+
+// MatchRule selects connections. All of specified conditions must hold,
+// empty rule matches all connections.
+type MatchRule struct {
+	// IP addresses or CIDRs of clients as tunnel sees them and of original
+	// sources told by PROXY protocol headers
+	Clients []string `json:"clients,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+	// Server names clients asked for ("*.example.com" matches subdomains)
+	// and identities of their certificates told by PROXY protocol headers
+	ServerNames []string          `json:"serverNames,omitempty"`
+	Identities  []string          `json:"identities,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// PriorityRule gives a priority to connections matching it. Connection gets
+// priority of the first rule it matches (0 if there's none).
+type PriorityRule struct {
+	Priority int `json:"priority"`
+	// IP addresses or CIDRs of clients and ports they connected to
+	Clients []string `json:"clients,omitempty"`
+	Ports   []int    `json:"ports,omitempty"`
+}
+
+// SubnetLimit caps aggregate bandwidth of connections from clients within a
+// subnet. Connection is subject to the limit of the most specific subnet it
+// belongs to.
+type SubnetLimit struct {
+	// CIDR or a single IP address
+	Subnet string `json:"subnet"`
+	Limit  Limit  `json:"limit"`
+}
+
+// BackendLimit caps aggregate bandwidth of connections to one of the backends
+// tunnel's connectTo resolves to
+type BackendLimit struct {
+	// IP address of the backend
+	Backend string `json:"backend"`
+	Limit   Limit  `json:"limit"`
+}
+
+// ActiveWindows restrict access through a tunnel to daily time windows
+type ActiveWindows struct {
+	Windows []ActiveWindow `json:"windows"`
+	// What tunnel does outside of windows: "reject" new connections (default)
+	// or "close" its listener along with active connections
+	Outside string `json:"outside,omitempty"`
+}
+
+// ActiveWindow is a daily time window in the format of schedule rules
+type ActiveWindow struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"`
+}
+
+// ScheduleRule makes a tunnel use different limits during a daily time window
+type ScheduleRule struct {
+	// Start and end of the window in local time of the server ("HH:MM")
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Days of week window starts on ("Mon", "Tue", ...). Every day if empty.
+	Days   []string     `json:"days,omitempty"`
+	Limits TunnelLimits `json:"limits"`
+}
+
+// Hop is an intermediate node upstream connections are made through
+type Hop struct {
+	// "socks5", "http" or "ssh"
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	// SSH hop credentials and SHA-256 fingerprint of its host key
+	User    string `json:"user,omitempty"`
+	KeyFile string `json:"keyFile,omitempty"`
+	HostKey string `json:"hostKey,omitempty"`
+}
+
+// UpstreamTLS configures TLS of connections to upstream
+type UpstreamTLS struct {
+	// Server name to send and verify instead of connectTo host
+	ServerName string `json:"serverName,omitempty"`
+	// Verification mode: "full" (default), "pin" or "none"
+	Verify string `json:"verify,omitempty"`
+	// SHA-256 fingerprints of acceptable upstream certificates (hex)
+	Pins []string `json:"pins,omitempty"`
+	// PEM file with CAs to verify upstream against instead of system ones
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// TunnelSettings are operational settings of a tunnel. Unlike TunnelLimits,
+// they aren't taken from profiles.
+type TunnelSettings struct {
+	// Directory to record data forwarded by every connection into
+	RecordDir string `json:"recordDir,omitempty"`
+	// Least severe tunnel messages that are logged ("debug", "info", "warn"
+	// or "error", "info" if empty)
+	LogLevel string `json:"logLevel,omitempty"`
+	// If set, clients must start with a PROXY protocol header, and server
+	// name clients ask for in TLS handshakes is inspected respectively
+	ProxyProtocol bool `json:"proxyProtocol,omitempty"`
+	InspectTLS    bool `json:"inspectTLS,omitempty"`
+	// If set, clients could ask for a bandwidth test ("echo", "discard" or
+	// "source") with a preamble instead of connecting to upstream
+	BandwidthTest bool `json:"bandwidthTest,omitempty"`
+	// Data sent to upstream right after connecting and to client once
+	// upstream is connected. {clientIP}, {clientPort}, {localIP} and
+	// {localPort} are replaced with connection addresses.
+	UpstreamGreeting string `json:"upstreamGreeting,omitempty"`
+	ClientGreeting   string `json:"clientGreeting,omitempty"`
+	// Deep telemetry (recordings) is only collected for one in this many
+	// connections, for every connection if zero
+	TelemetrySampling int `json:"telemetrySampling,omitempty"`
+	// "sourceIP" makes clients stick to the upstream address chosen by a
+	// hash of their IP address
+	Balance string `json:"balance,omitempty"`
+	// Name of a resolver registered by the embedding application that looks
+	// up connectTo
+	Resolver string `json:"resolver,omitempty"`
+	// Number of failed attempts to listen again that tunnel reports with
+	// "listenRetriesExhausted" event after
+	ListenRetries int `json:"listenRetries,omitempty"`
+}
+
+// Exemptions list clients and upstreams whose connections bypass throttling
+// on a tunnel entirely. Traffic of exempt connections is still accounted in
+// stats.
+type Exemptions struct {
+	// IP addresses or CIDRs of clients
+	ExemptClients []string `json:"exemptClients,omitempty"`
+	// IP addresses or CIDRs of upstreams
+	ExemptUpstreams []string `json:"exemptUpstreams,omitempty"`
+}
+
+// Connection describes an active tunnel connection
+type Connection struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream"`
+	Opened   time.Time `json:"opened"`
+	// Per-connection limit currently in effect (lower than configured one
+	// during slow start) and whether it was set for this connection
+	// specifically
+	Limit    Limit `json:"limit"`
+	OwnLimit bool  `json:"ownLimit,omitempty"`
+	// Connection bypasses throttling
+	Exempt bool `json:"exempt,omitempty"`
+	// Labels attached to connection upon admission
+	Labels map[string]string `json:"labels,omitempty"`
+	// Original source told by PROXY protocol header, server name client asked
+	// for and identity of its certificate
+	Source     string `json:"source,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	// Deep telemetry (e.g. a recording) is collected for connection
+	Sampled bool `json:"sampled,omitempty"`
+	// Limit class connection belongs to
+	Class string `json:"class,omitempty"`
+	// Subnet connection shares the limit of
+	Subnet string `json:"subnet,omitempty"`
+	// Backend connection shares the limit of
+	Backend string `json:"backend,omitempty"`
+	// Paths to client and upstream as seen by the kernel (Linux only)
+	ClientTCP   *TCPInfo `json:"clientTcp,omitempty"`
+	UpstreamTCP *TCPInfo `json:"upstreamTcp,omitempty"`
+	// Connections of higher priority are served from tunnel limit first
+	Priority int            `json:"priority,omitempty"`
+	Stats    TunnelStats    `json:"stats"`
+	Traffic  TrafficPattern `json:"traffic"`
+}
+
+// TCPInfo is what the kernel knows about the path of a TCP connection
+type TCPInfo struct {
+	RTT    Duration `json:"rtt"`
+	RTTVar Duration `json:"rttVar"`
+	MinRTT Duration `json:"minRtt,omitempty"`
+	// Number of segments retransmitted over connection lifetime
+	Retransmits uint32 `json:"retransmits"`
+	// Congestion window in segments
+	Cwnd uint32 `json:"cwnd"`
+	// Recent delivery rate in bytes per second
+	DeliveryRate int64 `json:"deliveryRate,omitempty"`
+	// Delivery rate was bound by throttling rather than by the path
+	AppLimited bool `json:"appLimited,omitempty"`
+}
+
+// TrafficPattern describes recent traffic of a connection
+type TrafficPattern struct {
+	// One of "idle", "interactive" or "bulk"
+	Class            string   `json:"class"`
+	AverageChunkSize int      `json:"averageChunkSize"`
+	AverageInterval  Duration `json:"averageInterval"`
+}
+
+// Profile is a named set of tunnel limits shared by any number of tunnels
+type Profile struct {
+	Name    string       `json:"name"`
+	Limits  TunnelLimits `json:"limits"`
+	Tunnels int          `json:"tunnels"`
+}
+
+// TunnelFailure describes a tunnel that could not be brought to its desired
+// state
+type TunnelFailure struct {
+	ListenAt string `json:"listenAt"`
+	Error    string `json:"error"`
+}
+
+// ChangeReport describes changes made by Apply
+type ChangeReport struct {
+	Created   []string        `json:"created"`
+	Updated   []string        `json:"updated"`
+	Deleted   []string        `json:"deleted"`
+	Unchanged []string        `json:"unchanged"`
+	Failed    []TunnelFailure `json:"failed"`
+}
+
+// Event describes a change in the set of tunnels or their connections. Type is
+// one of "tunnelCreated", "tunnelUpdated", "tunnelDeleted", "connectionOpened",
+// "connectionFailed", "connectionUpdated", "connectionClosed",
+// "listenerFailed", "listenerRestored", "listenRetriesExhausted",
+// "quotaExhausted" and "tunnelSaturated".
+type Event struct {
+	Cursor     uint64           `json:"cursor"`
+	Time       time.Time        `json:"time"`
+	Type       string           `json:"type"`
+	ListenAt   string           `json:"listenAt"`
+	Tenant     string           `json:"tenant,omitempty"`
+	Tunnel     *TunnelEvent     `json:"tunnel,omitempty"`
+	Connection *ConnectionEvent `json:"connection,omitempty"`
+}
+
+// TunnelEvent holds details of tunnel events
+type TunnelEvent struct {
+	ConnectTo string       `json:"connectTo"`
+	Limits    TunnelLimits `json:"limits"`
+	Draining  bool         `json:"draining,omitempty"`
+	// Reason of a listener failure for "listenerFailed" and
+	// "listenRetriesExhausted" events
+	Error string `json:"error,omitempty"`
+}
+
+// ConnectionEvent holds details of connection events
+type ConnectionEvent struct {
+	ID     uint64            `json:"id"`
+	Client string            `json:"client"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	// Connection's own limit for "connectionUpdated" events
+	Limit *Limit `json:"limit,omitempty"`
+	// Why connection ended for "connectionClosed" and "connectionFailed"
+	// events (e.g. "clientEOF" or "dialFailure")
+	Reason string `json:"reason,omitempty"`
+	// Side that ended the connection ("client", "upstream" or "tunnel") and
+	// bytes forwarded in each direction for "connectionClosed" events
+	ClosedBy     string `json:"closedBy,omitempty"`
+	IngressBytes int64  `json:"ingressBytes,omitempty"`
+	EgressBytes  int64  `json:"egressBytes,omitempty"`
+}
+
+// ErrStreamClosed is returned by Watch when server ends the event stream, e.g.
+// because the watcher didn't keep up with events. Watching could be resumed
+// after the last received event.
+var ErrStreamClosed = errors.New("Event stream closed by server")
+
+// Error is returned when admin API responds with an error status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Admin API responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// Client makes requests to throttle admin API
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// New creates a Client for admin API served at baseURL (e.g.
+// "http://localhost:6061"). Token is sent with every request unless empty. If
+// httpClient is nil, http.DefaultClient is used (pass a client with custom
+// transport to use TLS client certificates).
+func New(baseURL, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// NewUnix creates a Client for admin API served over a unix socket at a given
+// path (see -control command-line argument).
+func NewUnix(path string) *Client {
+	return New("http://throttle", "", &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	})
+}
+
+// ListTunnels returns running tunnels visible to the caller
+func (c *Client) ListTunnels(ctx context.Context) ([]Tunnel, error) {
+	var result []Tunnel
+	err := c.do(ctx, http.MethodGet, "/v1/tunnels", nil, &result)
+	return result, err
+}
+
+// GetTunnel returns a tunnel listening at a given spec
+func (c *Client) GetTunnel(ctx context.Context, listenAt string) (Tunnel, error) {
+	var result Tunnel
+	err := c.do(ctx, http.MethodGet, "/v1/tunnels/"+url.PathEscape(listenAt), nil, &result)
+	return result, err
+}
+
+// CreateTunnel starts a tunnel that lasts until DeleteTunnel regardless of
+// configuration and Apply. If spec listens at zero port (e.g. "127.0.0.1:0"),
+// tunnel gets an ephemeral port and returned tunnel listens at the address it
+// was assigned.
+func (c *Client) CreateTunnel(ctx context.Context, spec TunnelSpec) (Tunnel, error) {
+	var result Tunnel
+	err := c.do(ctx, http.MethodPost, "/v1/tunnels", spec, &result)
+	return result, err
+}
+
+// DeleteTunnel shuts down a tunnel started by CreateTunnel
+func (c *Client) DeleteTunnel(ctx context.Context, listenAt string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/tunnels/"+url.PathEscape(listenAt), nil, nil)
+}
+
+// UpdateTunnelLimits changes limits of a tunnel listening at a given spec
+func (c *Client) UpdateTunnelLimits(ctx context.Context, listenAt string,
+	limits TunnelLimits) error {
+	return c.do(ctx, http.MethodPut, "/v1/tunnels/"+url.PathEscape(listenAt)+"/limits",
+		limits, nil)
+}
+
+// ListConnections returns active connections of a tunnel listening at a given
+// spec
+func (c *Client) ListConnections(ctx context.Context, listenAt string) ([]Connection, error) {
+	var result []Connection
+	err := c.do(ctx, http.MethodGet, "/v1/tunnels/"+url.PathEscape(listenAt)+"/connections",
+		nil, &result)
+	return result, err
+}
+
+// FilterConnections returns active connections of a tunnel matching a filter
+// expression like "src=10.0.0.0/8 and rate>1MiB/s and age>5m". See
+// api/openapi.yaml for filter syntax.
+func (c *Client) FilterConnections(ctx context.Context, listenAt,
+	filter string) ([]Connection, error) {
+	var result []Connection
+	err := c.do(ctx, http.MethodGet, connectionsPath(listenAt, filter), nil, &result)
+	return result, err
+}
+
+// CloseConnections forcibly closes active connections of a tunnel matching a
+// filter expression. Returns identifiers of closed connections.
+func (c *Client) CloseConnections(ctx context.Context, listenAt,
+	filter string) ([]uint64, error) {
+	var result struct {
+		Connections []uint64 `json:"connections"`
+	}
+	err := c.do(ctx, http.MethodDelete, connectionsPath(listenAt, filter), nil, &result)
+	return result.Connections, err
+}
+
+// UpdateConnectionLimits moves active connections of a tunnel matching a filter
+// expression to a different per-connection limit. Nil limit makes connections
+// subject to the tunnel connection limit again. Returns identifiers of updated
+// connections.
+func (c *Client) UpdateConnectionLimits(ctx context.Context, listenAt, filter string,
+	limit *Limit) ([]uint64, error) {
+	body := struct {
+		Limit *Limit `json:"limit"`
+	}{
+		Limit: limit,
+	}
+	var result struct {
+		Connections []uint64 `json:"connections"`
+	}
+	err := c.do(ctx, http.MethodPut, connectionsPath(listenAt, filter), body, &result)
+	return result.Connections, err
+}
+
+// connectionsPath returns path of connections of a tunnel selected by a filter
+func connectionsPath(listenAt, filter string) string {
+	return "/v1/tunnels/" + url.PathEscape(listenAt) + "/connections?" +
+		url.Values{"filter": {filter}}.Encode()
+}
+
+// UpdateConnectionLimit moves an active connection of a tunnel to a different
+// per-connection limit without interrupting it. Nil limit makes connection
+// subject to the tunnel connection limit again. Connection identifiers are
+// reported in events.
+func (c *Client) UpdateConnectionLimit(ctx context.Context, listenAt string, id uint64,
+	limit *Limit) error {
+	body := struct {
+		Limit *Limit `json:"limit"`
+	}{
+		Limit: limit,
+	}
+	return c.do(ctx, http.MethodPut, "/v1/tunnels/"+url.PathEscape(listenAt)+
+		"/connections/"+strconv.FormatUint(id, 10)+"/limit", body, nil)
+}
+
+// BoostConnection moves an active connection of a tunnel to a different limit
+// for a given time, after which connection gets the limit it had before
+func (c *Client) BoostConnection(ctx context.Context, listenAt string, id uint64,
+	limit Limit, duration time.Duration) error {
+	body := struct {
+		Limit    Limit    `json:"limit"`
+		Duration Duration `json:"duration"`
+	}{
+		Limit:    limit,
+		Duration: Duration(duration),
+	}
+	return c.do(ctx, http.MethodPost, "/v1/tunnels/"+url.PathEscape(listenAt)+
+		"/connections/"+strconv.FormatUint(id, 10)+"/boost", body, nil)
+}
+
+// CloseConnection forcibly closes an active connection of a tunnel
+func (c *Client) CloseConnection(ctx context.Context, listenAt string, id uint64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/tunnels/"+url.PathEscape(listenAt)+
+		"/connections/"+strconv.FormatUint(id, 10), nil, nil)
+}
+
+// SetTunnelDraining makes a tunnel reject new connections while letting active
+// ones run to completion, or makes it accept connections again
+func (c *Client) SetTunnelDraining(ctx context.Context, listenAt string, draining bool) error {
+	body := struct {
+		Draining bool `json:"draining"`
+	}{
+		Draining: draining,
+	}
+	return c.do(ctx, http.MethodPut, "/v1/tunnels/"+url.PathEscape(listenAt)+"/draining",
+		body, nil)
+}
+
+// Apply makes the set of tunnels visible to the caller match a desired one.
+// Tunnels missing from desired set are shut down, new ones are created and
+// existing ones are updated.
+func (c *Client) Apply(ctx context.Context, desired []TunnelSpec) (ChangeReport, error) {
+	var result ChangeReport
+	if desired == nil {
+		desired = []TunnelSpec{}
+	}
+	err := c.do(ctx, http.MethodPut, "/v1/tunnels", desired, &result)
+	return result, err
+}
+
+// ListProfiles returns all defined profiles
+func (c *Client) ListProfiles(ctx context.Context) ([]Profile, error) {
+	var result []Profile
+	err := c.do(ctx, http.MethodGet, "/v1/profiles", nil, &result)
+	return result, err
+}
+
+// PutProfile defines a new profile or changes an existing one. All tunnels
+// using the profile switch to new limits together.
+func (c *Client) PutProfile(ctx context.Context, name string, limits TunnelLimits) error {
+	return c.do(ctx, http.MethodPut, "/v1/profiles/"+url.PathEscape(name), limits, nil)
+}
+
+// ApplyProfile makes a tunnel take its limits from a given profile
+func (c *Client) ApplyProfile(ctx context.Context, listenAt, profile string) error {
+	body := struct {
+		Profile string `json:"profile"`
+	}{
+		Profile: profile,
+	}
+	return c.do(ctx, http.MethodPut, "/v1/tunnels/"+url.PathEscape(listenAt)+"/profile",
+		body, nil)
+}
+
+// ListTenants returns tenants visible to the caller
+func (c *Client) ListTenants(ctx context.Context) ([]Tenant, error) {
+	var result []Tenant
+	err := c.do(ctx, http.MethodGet, "/v1/tenants", nil, &result)
+	return result, err
+}
+
+// UpdateTenantLimit changes aggregate limit of a tenant
+func (c *Client) UpdateTenantLimit(ctx context.Context, name string, limit Limit) error {
+	body := struct {
+		Limit Limit `json:"limit"`
+	}{
+		Limit: limit,
+	}
+	return c.do(ctx, http.MethodPut, "/v1/tenants/"+url.PathEscape(name)+"/limit", body, nil)
+}
+
+// GlobalLimit returns bandwidth limit of all tunnels together (operator only)
+func (c *Client) GlobalLimit(ctx context.Context) (Limit, error) {
+	var result struct {
+		Limit Limit `json:"limit"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/limit", nil, &result)
+	return result.Limit, err
+}
+
+// UpdateGlobalLimit changes bandwidth limit of all tunnels together
+// (operator only)
+func (c *Client) UpdateGlobalLimit(ctx context.Context, limit Limit) error {
+	body := struct {
+		Limit Limit `json:"limit"`
+	}{
+		Limit: limit,
+	}
+	return c.do(ctx, http.MethodPut, "/v1/limit", body, nil)
+}
+
+// WorkerPools lists worker pools sorted by name (operator only)
+func (c *Client) WorkerPools(ctx context.Context) ([]WorkerPool, error) {
+	var result []WorkerPool
+	err := c.do(ctx, http.MethodGet, "/v1/workerPools", nil, &result)
+	return result, err
+}
+
+// OSLimits returns limits of the host relevant to tunnels (operator only)
+func (c *Client) OSLimits(ctx context.Context) (OSLimits, error) {
+	var result OSLimits
+	err := c.do(ctx, http.MethodGet, "/v1/osLimits", nil, &result)
+	return result, err
+}
+
+// Watch streams events visible to the caller published after an event with a
+// given cursor (zero means new events only) and calls handler for each of them
+// until ctx is done, handler returns an error or stream ends. If events after
+// a given cursor are no longer retained by server, *Error with status 410 is
+// returned and caller should list tunnels anew before watching new events.
+func (c *Client) Watch(ctx context.Context, after uint64, handler func(Event) error) error {
+	path := "/v1/events"
+	if after != 0 {
+		path += "?cursor=" + strconv.FormatUint(after, 10)
+	}
+	resp, err := c.send(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var eventType string
+	var data []byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// Blank line dispatches an event
+			if eventType == "error" {
+				var streamErr struct {
+					Error string `json:"error"`
+				}
+				if json.Unmarshal(data, &streamErr) == nil && streamErr.Error != "" {
+					return fmt.Errorf("%v: %s", ErrStreamClosed, streamErr.Error)
+				}
+				return ErrStreamClosed
+			}
+			if len(data) > 0 {
+				var e Event
+				if err := json.Unmarshal(data, &e); err != nil {
+					return err
+				}
+				if err := handler(e); err != nil {
+					return err
+				}
+			}
+			eventType = ""
+			data = data[:0]
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrStreamClosed
+}
+
+// do makes a request with optional JSON body and decodes JSON response into
+// result unless it is nil.
+func (c *Client) do(ctx context.Context, method, path string, body interface{},
+	result interface{}) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// send makes a request with optional JSON body. Returns *Error if server
+// responds with an error status.
+func (c *Client) send(ctx context.Context, method, path string,
+	body interface{}) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		contents, _ := ioutil.ReadAll(resp.Body)
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(contents, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = strings.TrimSpace(string(contents))
+		}
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Message:    apiErr.Error,
+		}
+	}
+	return resp, nil
+}
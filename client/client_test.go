@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "Invalid token"}`))
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/tunnels/[::1]:80":
+			w.Write([]byte(`{"listenAt": "[::1]:80", "limits": {"tunnelLimit": 1000}}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/tenants/a/limit":
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"limit":125000}` {
+				t.Errorf("Unexpected request body: %s", body)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "Not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := New(server.URL, "secret", nil)
+
+	tunnel, err := c.GetTunnel(ctx, "[::1]:80")
+	if err != nil || tunnel.ListenAt != "[::1]:80" || tunnel.Limits.TunnelLimit != 1000 {
+		t.Errorf("Unexpected result of GetTunnel: %v, %v", tunnel, err)
+	}
+
+	if err = c.UpdateTenantLimit(ctx, "a", 125000); err != nil {
+		t.Errorf("UpdateTenantLimit failed: %v", err)
+	}
+
+	_, err = c.ListTenants(ctx)
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusNotFound ||
+		apiErr.Message != "Not found" {
+		t.Errorf("Expected API error, got %v", err)
+	}
+
+	_, err = New(server.URL, "wrong", nil).ListTunnels(ctx)
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected authentication error, got %v", err)
+	}
+}
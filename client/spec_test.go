@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// specOperations maps operations of api/openapi.yaml whose client methods
+// aren't named after them to the methods. Empty name marks operations client
+// doesn't cover.
+var specOperations = map[string]string{
+	// Prometheus scrapes metrics on its own
+	"metrics":         "",
+	"applyTunnels":    "Apply",
+	"watchEvents":     "Watch",
+	"getGlobalLimit":  "GlobalLimit",
+	"listWorkerPools": "WorkerPools",
+	"getOSLimits":     "OSLimits",
+}
+
+// extraMethods are client methods sharing an operation with another method
+var extraMethods = map[string]string{
+	"FilterConnections": "listConnections",
+}
+
+var operationRe = regexp.MustCompile(`^\s+operationId:\s*(\w+)\s*$`)
+
+// readOperations returns IDs of operations of API specification
+func readOperations(t *testing.T) []string {
+	f, err := os.Open("../api/openapi.yaml")
+	if err != nil {
+		t.Fatalf("Failed to open API specification: %v", err)
+	}
+	defer f.Close()
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := operationRe.FindStringSubmatch(scanner.Text()); m != nil {
+			result = append(result, m[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read API specification: %v", err)
+	}
+	return result
+}
+
+// TestClientCoversSpec checks that client and API specification stay in sync:
+// every operation has a client method and every method has an operation
+func TestClientCoversSpec(t *testing.T) {
+	clientType := reflect.TypeOf(new(Client))
+	covered := make(map[string]bool)
+	for _, op := range readOperations(t) {
+		method, ok := specOperations[op]
+		if !ok {
+			method = strings.ToUpper(op[:1]) + op[1:]
+		}
+		if method == "" {
+			continue
+		}
+		if _, ok := clientType.MethodByName(method); !ok {
+			t.Errorf("Operation %q has no client method %s", op, method)
+		}
+		covered[method] = true
+	}
+	for i := 0; i < clientType.NumMethod(); i++ {
+		name := clientType.Method(i).Name
+		if covered[name] {
+			continue
+		}
+		if op, ok := extraMethods[name]; ok {
+			if method := strings.ToUpper(op[:1]) + op[1:]; !covered[method] {
+				t.Errorf("Client method %s belongs to unknown operation %q", name, op)
+			}
+			continue
+		}
+		t.Errorf("Client method %s has no operation in API specification", name)
+	}
+}
@@ -3,7 +3,7 @@ module github.com/anton-dessiatov/throttle
 go 1.12
 
 require (
-	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284 // indirect
+	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284
 	golang.org/x/lint v0.0.0-20190409202823-959b441ac422 // indirect
 	golang.org/x/net v0.0.0-20190503192946-f4e77d36d62c // indirect
 	golang.org/x/sys v0.0.0-20190509141414-a5b02f93d862 // indirect
@@ -0,0 +1,228 @@
+package limiter
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Algorithm chooses how listener limiters let traffic through
+type Algorithm string
+
+const (
+	// TokenBucket lets traffic through in bursts as long as it fits into
+	// limits on average (see UpdateBurstDuration and UpdateBursts)
+	TokenBucket Algorithm = ""
+	// LeakyBucket paces traffic at a constant rate: configured bursts are
+	// ignored and limiters let through no more than a single pacing chunk
+	// (see GetGoodBurst) at once. Chunks of a connection are spaced strictly,
+	// so it doesn't save up allowance while idle.
+	LeakyBucket Algorithm = "leakyBucket"
+	// SlidingWindow lets traffic through in bursts like TokenBucket, but no
+	// connection transfers more within any SlidingWindowDuration than its
+	// limits allow over it
+	SlidingWindow Algorithm = "slidingWindow"
+	// FairQueue splits listener limit equally among active connections on top
+	// of their own limits, so that a single connection can't take it all
+	FairQueue Algorithm = "fairQueue"
+	// FairShare guarantees each active connection an equal share of listener
+	// limit like FairQueue does, but lets connections that need more borrow
+	// what others leave unused. Shares are rebalanced every FairShareInterval.
+	FairShare Algorithm = "fairShare"
+)
+
+// FairShareInterval is how often FairShare algorithm measures traffic of
+// connections and rebalances their shares
+const FairShareInterval = 500 * time.Millisecond
+
+// fairSaturation is the fraction of its share a connection has to use to be
+// considered held back by it
+const fairSaturation = 0.9
+
+// fairDemand is recent traffic of a connection under FairShare algorithm
+type fairDemand struct {
+	// Bytes connection transferred as of the last sample
+	transferred int64
+	rate        float64
+	// Connection used (almost) all of its share
+	saturated bool
+}
+
+// UpdateAlgorithm switches limiters of the listener and of connections that
+// were accepted (or will be accepted in future) to a given algorithm.
+// Connections are not interrupted and new limiters start with as many
+// tokens as old ones had, so switching doesn't grant an extra burst.
+func (l *RateLimitingListener) UpdateAlgorithm(a Algorithm) {
+	select {
+	case l.updateAlgorithm <- a:
+	case <-l.close:
+	}
+}
+
+// switchAlgorithm replaces limiters according to a given algorithm
+// migrating their state. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) switchAlgorithm(a Algorithm) {
+	if a == l.algorithm {
+		return
+	}
+	now := time.Now()
+	oldGlobal := l.globalLimiter
+	oldConn := make(map[*LimitedConnection]*rate.Limiter, len(l.connectionLimiters))
+	for conn, lim := range l.connectionLimiters {
+		oldConn[conn] = lim
+	}
+
+	l.algorithm = a
+	if l.currentLimits.GlobalLimit > 0 {
+		l.globalLimiter = l.createGlobalLimiter(l.currentLimits.GlobalLimit)
+		migrateLimiter(oldGlobal, l.globalLimiter, now)
+	}
+	l.createDirectionLimiters()
+	l.createClientLimiters()
+	l.updateConnectionLimiters()
+	for conn, old := range oldConn {
+		if lim, ok := l.connectionLimiters[conn]; ok {
+			migrateLimiter(old, lim, now)
+		}
+	}
+}
+
+// migrateLimiter takes tokens from a new limiter, so that it has no more of
+// them than an old one had at a given moment. Debt of the old limiter beyond
+// a single burst is forgiven.
+func migrateLimiter(old, new *rate.Limiter, now time.Time) {
+	if old == nil || new.Limit() == 0 || new.Limit() == rate.Inf {
+		return
+	}
+	burst := new.Burst()
+	deficit := float64(burst) - InspectLimiter(old, now).Tokens
+	if deficit > float64(2*burst) {
+		deficit = float64(2 * burst)
+	}
+	for deficit >= 1 {
+		n := burst
+		if deficit < float64(n) {
+			n = int(deficit)
+		}
+		new.ReserveN(now, n)
+		deficit -= float64(n)
+	}
+}
+
+// fairShare returns a limit of each connection under FairQueue algorithm.
+// Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) fairShare() rate.Limit {
+	n := len(l.activeConnections) - len(l.exemptConnections)
+	if n < 1 {
+		n = 1
+	}
+	return l.currentLimits.GlobalLimit / rate.Limit(n)
+}
+
+// createFairLimiter creates a limiter of a connection's fair share of the
+// listener limit. Returns nil unless FairQueue or FairShare algorithm is in
+// effect and
+// listener is limited. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) createFairLimiter(conn *LimitedConnection) *rate.Limiter {
+	delete(l.fairLimiters, conn)
+	if (l.algorithm != FairQueue && l.algorithm != FairShare) ||
+		l.currentLimits.GlobalLimit <= 0 {
+		return nil
+	}
+	result := l.createLimiter(l.fairShare())
+	l.fairLimiters[conn] = result
+	return result
+}
+
+// rebalanceFairShares adjusts fair share limiters of connections to their
+// current number. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) rebalanceFairShares() {
+	if len(l.fairLimiters) == 0 {
+		return
+	}
+	now := time.Now()
+	if l.algorithm == FairShare {
+		conns := make([]*LimitedConnection, 0, len(l.fairLimiters))
+		used := make([]float64, 0, len(l.fairLimiters))
+		saturated := make([]bool, 0, len(l.fairLimiters))
+		for conn := range l.fairLimiters {
+			conns = append(conns, conn)
+			// Connections that weren't sampled yet are given an equal share
+			var demand fairDemand
+			if d, ok := l.fairDemands[conn]; ok {
+				demand = *d
+			}
+			used = append(used, demand.rate)
+			saturated = append(saturated, demand.saturated)
+		}
+		shares := fairShares(float64(l.currentLimits.GlobalLimit), used, saturated)
+		for i, conn := range conns {
+			l.fairLimiters[conn].SetLimitAt(now, rate.Limit(shares[i]))
+		}
+		return
+	}
+	share := l.fairShare()
+	for _, lim := range l.fairLimiters {
+		lim.SetLimitAt(now, share)
+	}
+}
+
+// sampleFairDemands measures traffic of connections since the previous sample
+// and rebalances their shares. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) sampleFairDemands(now time.Time) {
+	elapsed := now.Sub(l.fairSampledAt).Seconds()
+	l.fairSampledAt = now
+	for conn, lim := range l.fairLimiters {
+		transferred := atomic.LoadInt64(&conn.transferred)
+		d, ok := l.fairDemands[conn]
+		if !ok {
+			l.fairDemands[conn] = &fairDemand{transferred: transferred}
+			continue
+		}
+		if elapsed > 0 {
+			d.rate = float64(transferred-d.transferred) / elapsed
+			d.saturated = d.rate >= fairSaturation*float64(lim.Limit())
+		}
+		d.transferred = transferred
+	}
+	l.rebalanceFairShares()
+}
+
+// fairShares splits total limit between connections max-min fairly given
+// their recent rates and whether they were held back by their shares.
+// Connections that weren't get room for what they use, the rest split what's
+// left equally. No connection gets less than an equal share of total.
+func fairShares(total float64, used []float64, saturated []bool) []float64 {
+	result := make([]float64, len(used))
+	if len(used) == 0 {
+		return result
+	}
+	floor := total / float64(len(used))
+	remaining := total
+	rest := make([]int, len(used))
+	for i := range rest {
+		rest[i] = i
+	}
+	for len(rest) > 0 {
+		share := remaining / float64(len(rest))
+		var next []int
+		for _, i := range rest {
+			if !saturated[i] && used[i] < share {
+				result[i] = math.Max(used[i]/fairSaturation, floor)
+				remaining -= used[i]
+			} else {
+				next = append(next, i)
+			}
+		}
+		if len(next) == len(rest) {
+			for _, i := range next {
+				result[i] = share
+			}
+			break
+		}
+		rest = next
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package limiter
+
+import (
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestMigrateLimiter(t *testing.T) {
+	now := time.Now()
+	old := rate.NewLimiter(1000, 100)
+	old.AllowN(now, 60)
+	new := rate.NewLimiter(2000, 200)
+	migrateLimiter(old, new, now)
+	if tokens := InspectLimiter(new, now).Tokens; tokens < 39 || tokens > 41 {
+		t.Errorf("Expected new limiter to have 40 tokens, got %v", tokens)
+	}
+
+	// Debt is carried over up to a burst
+	old.ReserveN(now, 100)
+	old.ReserveN(now, 100)
+	new = rate.NewLimiter(2000, 50)
+	migrateLimiter(old, new, now)
+	if tokens := InspectLimiter(new, now).Tokens; tokens < -51 || tokens > -49 {
+		t.Errorf("Expected new limiter to owe a burst, got %v", tokens)
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	l := listenLimited(t, 1000, 0)
+	defer l.Close()
+	l.UpdateAlgorithm(FairQueue)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conns = append(conns, accept(t, l))
+	}
+
+	share := func(conn net.Conn) rate.Limit {
+		// Makes sure that previous updates were processed by listener
+		l.UpdateConnectionSharedLimiters(conn, nil)
+		l.currentLimitsMu.RLock()
+		defer l.currentLimitsMu.RUnlock()
+		if lim, ok := l.fairLimiters[conn.(*LimitedConnection)]; ok {
+			return lim.Limit()
+		}
+		return 0
+	}
+	if s := share(conns[1]); s != 500 {
+		t.Errorf("Expected listener limit to be split in halves, got %v", s)
+	}
+
+	conns[0].Close()
+	if s := share(conns[1]); s != 1000 {
+		t.Errorf("Expected the remaining connection to get the whole limit, got %v", s)
+	}
+
+	l.UpdateAlgorithm(TokenBucket)
+	if s := share(conns[1]); s != 0 {
+		t.Errorf("Expected fair shares to be dropped, got %v", s)
+	}
+}
+
+func TestFairShares(t *testing.T) {
+	third := 1000.0 / 3
+	cases := []struct {
+		used      []float64
+		saturated []bool
+		expected  []float64
+	}{
+		{[]float64{500, 500}, []bool{true, true}, []float64{500, 500}},
+		{[]float64{0, 500}, []bool{false, true}, []float64{500, 1000}},
+		{[]float64{100, 300, 400}, []bool{false, false, true}, []float64{third, third, 600}},
+		{[]float64{400, 700}, []bool{false, false}, []float64{500, 600}},
+	}
+	for _, c := range cases {
+		shares := fairShares(1000, c.used, c.saturated)
+		for i := range shares {
+			if math.Abs(shares[i]-c.expected[i]) > 1e-6 {
+				t.Errorf("Expected %v (saturated: %v) to get %v, got %v", c.used,
+					c.saturated, c.expected, shares)
+				break
+			}
+		}
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	l := listenLimited(t, 1000, 0)
+	defer l.Close()
+	l.UpdateAlgorithm(FairShare)
+
+	var conns []*LimitedConnection
+	for i := 0; i < 2; i++ {
+		conn := accept(t, l)
+		defer conn.Close()
+		conns = append(conns, conn.(*LimitedConnection))
+	}
+
+	l.currentLimitsMu.Lock()
+	defer l.currentLimitsMu.Unlock()
+	for _, conn := range conns {
+		if s := l.fairLimiters[conn].Limit(); s != 500 {
+			t.Errorf("Expected each connection to start with half of the limit, got %v", s)
+		}
+	}
+	// The first connection uses its whole share, the second one is idle
+	now := time.Now()
+	l.sampleFairDemands(now)
+	atomic.AddInt64(&conns[0].transferred, 500)
+	l.sampleFairDemands(now.Add(time.Second))
+	if s := l.fairLimiters[conns[0]].Limit(); s != 1000 {
+		t.Errorf("Expected busy connection to borrow unused share, got %v", s)
+	}
+	if s := l.fairLimiters[conns[1]].Limit(); s != 500 {
+		t.Errorf("Expected idle connection to keep its guaranteed share, got %v", s)
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	l := listenLimited(t, 10000000, 0)
+	defer l.Close()
+
+	l.UpdateBursts(1000000, 0)
+	flush(t, l)
+	if burst := l.Buckets().Global.Burst; burst != 1000000 {
+		t.Errorf("Expected fixed burst, got %d", burst)
+	}
+	l.UpdateAlgorithm(LeakyBucket)
+	flush(t, l)
+	if burst := l.Buckets().Global.Burst; burst != MaxBurstSize {
+		t.Errorf("Expected a single pacing chunk burst, got %d", burst)
+	}
+}
@@ -1,6 +1,8 @@
 package limiter
 
 import (
+	"time"
+
 	"golang.org/x/time/rate"
 )
 
@@ -10,9 +12,24 @@ const MinBurstSize = 1
 // MaxBurstSize defines maximum size for a limiter burst
 const MaxBurstSize = 64 * 1024
 
+// Blocked is a bandwidth limit letting no traffic through until it's changed.
+// Listener treats any negative limit as blocked, while zero limit stands for
+// no limit at all.
+const Blocked = -1
+
+// blockedLimiter creates a limiter letting no traffic through. MultiLimiter
+// blocks on limiters of zero limit until wait is aborted.
+func blockedLimiter() *rate.Limiter {
+	return rate.NewLimiter(0, MaxBurstSize)
+}
+
 // CreateLimiter creates rate.Limiter for a given bandwidth limit with a burst
 // size equal to buffer size returned by GetBufferSize for a bandwidth limit.
+// Negative limit gets a limiter letting no traffic through.
 func CreateLimiter(limit rate.Limit) *rate.Limiter {
+	if limit < 0 {
+		return blockedLimiter()
+	}
 	return rate.NewLimiter(limit, GetGoodBurst(limit))
 }
 
@@ -34,3 +51,31 @@ func GetGoodBurst(l rate.Limit) int {
 	}
 	return int(burstSize)
 }
+
+// MaxScaledBurstSize defines maximum size for a burst returned by ScaledBurst
+const MaxScaledBurstSize = 1 << 30
+
+// ScaledBurst returns burst size letting through traffic that a given limit
+// allows over a given duration at once, so that burst grows and shrinks along
+// with the limit. Zero duration stands for GetGoodBurst.
+func ScaledBurst(l rate.Limit, d time.Duration) int {
+	if d <= 0 || l == rate.Limit(0) {
+		return GetGoodBurst(l)
+	}
+	burstSize := float64(l) * d.Seconds()
+	if burstSize < MinBurstSize {
+		return MinBurstSize
+	} else if burstSize > MaxScaledBurstSize {
+		return MaxScaledBurstSize
+	}
+	return int(burstSize)
+}
+
+// CreateScaledLimiter creates rate.Limiter for a given bandwidth limit with a
+// burst size returned by ScaledBurst for a given duration
+func CreateScaledLimiter(limit rate.Limit, d time.Duration) *rate.Limiter {
+	if limit < 0 {
+		return blockedLimiter()
+	}
+	return rate.NewLimiter(limit, ScaledBurst(limit, d))
+}
@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiterIdle is how long a limiter of a client is kept after its last
+// connection closes, so that reconnecting doesn't grant a fresh burst
+const clientLimiterIdle = time.Minute
+
+// clientLimiter is a limiter shared by all connections of a single client
+type clientLimiter struct {
+	limiter     *rate.Limiter
+	connections int
+	// Time the last connection of a client closed at
+	idleSince time.Time
+}
+
+// UpdateClientLimit sets bandwidth that all connections made from a single IP
+// address are not allowed to exceed when summed up together. It applies to
+// connections that were accepted (or will be accepted in future) on top of
+// listener and per-connection limits. Zero disables the limit.
+func (l *RateLimitingListener) UpdateClientLimit(perClient int) {
+	select {
+	case l.updateClientLimit <- rate.Limit(perClient):
+	case <-l.close:
+	}
+}
+
+// clientKey returns the key connections of the same client share a limiter
+// under
+func clientKey(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// acquireClientLimiter returns a limiter shared by connections of a client
+// an accepted connection comes from. Must be called with currentLimitsMu
+// locked.
+func (l *RateLimitingListener) acquireClientLimiter(conn *LimitedConnection) {
+	key := clientKey(conn)
+	l.connectionClients[conn] = key
+	c, ok := l.clientLimiters[key]
+	if !ok {
+		c = &clientLimiter{}
+		if l.clientLimit > 0 {
+			c.limiter = l.createLimiter(l.clientLimit)
+		}
+		l.clientLimiters[key] = c
+	}
+	c.connections++
+}
+
+// releaseClientLimiter accounts a closed connection in the limiter of its
+// client and forgets limiters of clients that have been idle for long
+// enough. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) releaseClientLimiter(conn *LimitedConnection) {
+	now := time.Now()
+	if key, ok := l.connectionClients[conn]; ok {
+		delete(l.connectionClients, conn)
+		if c, ok := l.clientLimiters[key]; ok {
+			c.connections--
+			if c.connections == 0 {
+				c.idleSince = now
+			}
+		}
+	}
+	for key, c := range l.clientLimiters {
+		if c.connections == 0 && now.Sub(c.idleSince) >= clientLimiterIdle {
+			delete(l.clientLimiters, key)
+		}
+	}
+}
+
+// clientLimiterOf returns a limiter of a client connection comes from (nil if
+// clients are not limited). Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) clientLimiterOf(conn *LimitedConnection) *rate.Limiter {
+	if c, ok := l.clientLimiters[l.connectionClients[conn]]; ok {
+		return c.limiter
+	}
+	return nil
+}
+
+// createClientLimiters replaces limiters of all clients according to current
+// client limit. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) createClientLimiters() {
+	for _, c := range l.clientLimiters {
+		c.limiter = nil
+		if l.clientLimit > 0 {
+			c.limiter = l.createLimiter(l.clientLimit)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package limiter
+
+import (
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestClientLimit(t *testing.T) {
+	l := listenLimited(t, 0, 0)
+	defer l.Close()
+	l.UpdateClientLimit(1000)
+
+	var conns []*LimitedConnection
+	for i := 0; i < 2; i++ {
+		conns = append(conns, accept(t, l).(*LimitedConnection))
+	}
+
+	limiters := func(conn *LimitedConnection) []*rate.Limiter {
+		// Makes sure that previous updates were processed by listener
+		l.UpdateConnectionSharedLimiters(conn, nil)
+		conn.limiterMu.RLock()
+		defer conn.limiterMu.RUnlock()
+		return conn.limiter.limiters
+	}
+	first, second := limiters(conns[0]), limiters(conns[1])
+	if len(first) != 1 || len(second) != 1 || first[0] != second[0] ||
+		first[0].Limit() != 1000 {
+		t.Errorf("Expected connections of a client to share a limiter")
+	}
+
+	// Limiter of a client survives its connections closing for a while
+	conns[0].Close()
+	conns[1].Close()
+	flush(t, l)
+	l.currentLimitsMu.RLock()
+	kept := l.clientLimiters["127.0.0.1"]
+	l.currentLimitsMu.RUnlock()
+	if kept == nil || kept.limiter != first[0] || kept.connections != 0 {
+		t.Errorf("Expected idle client limiter to be kept")
+	}
+}
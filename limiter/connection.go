@@ -4,7 +4,10 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // LimitedConnection is a wrapper around net.Conn that limits the rate of its
@@ -12,8 +15,15 @@ import (
 type LimitedConnection struct {
 	inner net.Conn
 
-	limiterMu      *sync.RWMutex
-	limiter        *MultiLimiter
+	limiterMu *sync.RWMutex
+	limiter   *MultiLimiter
+	// Limiters replacing limiter for reads or writes only (nil unless
+	// directions are limited differently)
+	readLimiter  *MultiLimiter
+	writeLimiter *MultiLimiter
+	// Allowance for small (interactive) chunks of data to go through without
+	// waiting for limiter. Nil if interactive traffic is not boosted.
+	boost          *rate.Limiter
 	readNotBefore  time.Time
 	writeNotBefore time.Time
 	abortWait      chan struct{}
@@ -23,6 +33,23 @@ type LimitedConnection struct {
 	close         chan struct{}
 	whenClosed    func(*LimitedConnection)
 	updateLimiter chan *MultiLimiter
+	// Time connection was accepted at (zero if it wasn't accepted by
+	// RateLimitingListener)
+	acceptedAt time.Time
+	pattern    *patternTracker
+	// Bytes transferred in both directions (accessed atomically)
+	transferred int64
+	// In observe-only mode limiter is consulted, but never waited for
+	observeOnly    bool
+	observed       ObservedThrottling
+	observedTotals *ObservedThrottling
+	// Limiter evaluated alongside the enforced one, but never waited for
+	shadow       *MultiLimiter
+	shadowed     ObservedThrottling
+	shadowTotals *ObservedThrottling
+	// Time spent waiting for limiter
+	waits      WaitStats
+	waitTotals *WaitStats
 }
 
 // NewLimitedConnection creates a LimitedConnection from net.Conn and a
@@ -41,14 +68,31 @@ func NewLimitedConnection(inner net.Conn, limiter *MultiLimiter) *LimitedConnect
 
 		close:         make(chan struct{}),
 		updateLimiter: make(chan *MultiLimiter),
+		pattern:       newPatternTracker(),
 	}
 }
 
+// TrafficPattern returns recent traffic pattern of a connection (both
+// directions combined). Safe to call concurrently.
+func (c *LimitedConnection) TrafficPattern() TrafficPattern {
+	return c.pattern.pattern(time.Now())
+}
+
 // UpdateLimiter changes the limiter in effect for a given connection. May be
 // called concurrently with Read or Write.
 func (c *LimitedConnection) UpdateLimiter(newLimiter *MultiLimiter) {
+	c.UpdateDirectionLimiters(newLimiter, nil, nil)
+}
+
+// UpdateDirectionLimiters changes limiters in effect for a given connection
+// with reads and writes limited differently. Read or write limiter replaces
+// the common one for its direction, nil leaves direction subject to the
+// common limiter. May be called concurrently with Read or Write.
+func (c *LimitedConnection) UpdateDirectionLimiters(common, read, write *MultiLimiter) {
 	c.limiterMu.Lock()
-	c.limiter = newLimiter
+	c.limiter = common
+	c.readLimiter = read
+	c.writeLimiter = write
 	oldAbortWait := c.abortWait
 	c.abortWait = make(chan struct{})
 	c.readNotBefore = time.Time{}
@@ -57,6 +101,35 @@ func (c *LimitedConnection) UpdateLimiter(newLimiter *MultiLimiter) {
 	c.limiterMu.Unlock()
 }
 
+// InteractiveChunkSize is the maximum size of a chunk of data considered to be
+// interactive traffic (e.g. SSH keystrokes or game packets)
+const InteractiveChunkSize = 512
+
+// interactiveBoostBurst is the amount of interactive traffic a connection
+// could send at once without waiting for limiter
+const interactiveBoostBurst = 4 * InteractiveChunkSize
+
+// SetInteractiveBoost lets small chunks of data (no bigger than
+// InteractiveChunkSize) go through without waiting for limiter as long as
+// they fit into a given rate (bytes per second) and connection isn't
+// classified as bulk by its traffic pattern. Such chunks are still accounted by
+// limiter, so they delay bulk traffic sharing the same limits rather than
+// exceed them. Zero rate disables the boost. May be called
+// concurrently with Read or Write.
+func (c *LimitedConnection) SetInteractiveBoost(boost rate.Limit) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	if boost <= 0 {
+		c.boost = nil
+		return
+	}
+	if c.boost != nil {
+		c.boost.SetLimit(boost)
+		return
+	}
+	c.boost = rate.NewLimiter(boost, interactiveBoostBurst)
+}
+
 // LocalAddr is an implementation of net.Conn.LocalAddr
 func (c *LimitedConnection) LocalAddr() net.Addr {
 	return c.inner.LocalAddr()
@@ -69,12 +142,13 @@ func (c *LimitedConnection) RemoteAddr() net.Addr {
 
 // Read is an implementation of net.Conn.Read
 func (c *LimitedConnection) Read(b []byte) (read int, err error) {
-	return c.rateLimitLoop(&c.readNotBefore, &c.readDeadline, c.inner.Read, b)
+	return c.rateLimitLoop(&c.readLimiter, &c.readNotBefore, &c.readDeadline, c.inner.Read, b)
 }
 
 // Write is an implementation of net.Conn.Write
 func (c *LimitedConnection) Write(b []byte) (written int, err error) {
-	return c.rateLimitLoop(&c.writeNotBefore, &c.writeDeadline, c.inner.Write, b)
+	return c.rateLimitLoop(&c.writeLimiter, &c.writeNotBefore, &c.writeDeadline,
+		c.inner.Write, b)
 }
 
 // The idea is that we read in chunks equal to max burst allowed by multilimiter
@@ -82,8 +156,8 @@ func (c *LimitedConnection) Write(b []byte) (written int, err error) {
 // we go on. If not, we check what happens before - operation deadline or wait
 // time. If that's wait time then simply wait and repeat. If it's a deadline
 // then set 'not before' timestamp and wait for it upon next invocation.
-func (c *LimitedConnection) rateLimitLoop(notBefore *time.Time,
-	deadline *time.Time, innerAct func([]byte) (int, error),
+func (c *LimitedConnection) rateLimitLoop(directionLimiter **MultiLimiter,
+	notBefore *time.Time, deadline *time.Time, innerAct func([]byte) (int, error),
 	b []byte) (cntr int, err error) {
 	if len(b) == 0 {
 		return
@@ -95,20 +169,53 @@ func (c *LimitedConnection) rateLimitLoop(notBefore *time.Time,
 	// Grab the limiter and abortwait until end of operation.
 	c.limiterMu.RLock()
 	limiter := c.limiter
+	if *directionLimiter != nil {
+		limiter = *directionLimiter
+	}
+	boost := c.boost
+	observeOnly, observedTotals := c.observeOnly, c.observedTotals
+	shadow, shadowTotals := c.shadow, c.shadowTotals
+	waitTotals := c.waitTotals
 	abortWait := c.abortWait
+	// Deadline could be changed concurrently, so operation sticks to the one
+	// in effect when it started
+	opDeadline := *deadline
 	if now.Before(*notBefore) {
 		until = *notBefore
-		if !deadline.IsZero() && deadline.Before(until) {
-			until = *deadline
+		if !opDeadline.IsZero() && opDeadline.Before(until) {
+			until = opDeadline
 		}
 	}
 	c.limiterMu.RUnlock()
 
 	if !until.IsZero() {
-		if c.waitUntil(abortWait, until) {
+		if c.recordedWait(abortWait, until, 0, waitTotals) {
+			err = io.ErrClosedPipe
+			return
+		}
+	}
+
+	// Blocked connection doesn't even read or write until its limits change
+	for !observeOnly && limiter.blocked() {
+		until = opDeadline
+		if until.IsZero() {
+			until = time.Now().Add(rate.InfDuration)
+		}
+		if c.recordedWait(abortWait, until, 0, waitTotals) {
 			err = io.ErrClosedPipe
 			return
 		}
+		if !opDeadline.IsZero() && !time.Now().Before(opDeadline) {
+			err = timeoutError{}
+			return
+		}
+		c.limiterMu.RLock()
+		limiter = c.limiter
+		if *directionLimiter != nil {
+			limiter = *directionLimiter
+		}
+		abortWait = c.abortWait
+		c.limiterMu.RUnlock()
 	}
 
 	burst := limiter.Burst()
@@ -126,10 +233,29 @@ func (c *LimitedConnection) rateLimitLoop(notBefore *time.Time,
 		until = time.Time{}
 
 		now = time.Now()
+		c.pattern.observe(now, n)
+		atomic.AddInt64(&c.transferred, int64(n))
 		r := limiter.ReserveN(now, n)
 		act := now.Add(r.DelayFrom(now))
+		if shadow != nil {
+			c.evaluateShadow(shadow, shadowTotals, now, n)
+		}
+		if boost != nil && n <= InteractiveChunkSize &&
+			c.pattern.pattern(now).Class != TrafficBulk && boost.AllowN(now, n) {
+			// Interactive chunk is accounted in limiter, but doesn't wait
+			act = now
+		}
+		if observeOnly && now.Before(act) {
+			delay := r.DelayFrom(now)
+			c.observed.record(n, delay)
+			if observedTotals != nil {
+				observedTotals.record(n, delay)
+			}
+			r.CancelAt(now)
+			act = now
+		}
 		if now.Before(act) {
-			if !deadline.IsZero() && deadline.Before(act) {
+			if !opDeadline.IsZero() && opDeadline.Before(act) {
 				c.limiterMu.RLock()
 				// What I want to avoid here is the case when limiter got updated and
 				// "Not before"s got reset during limiter update, but we don't know
@@ -142,13 +268,18 @@ func (c *LimitedConnection) rateLimitLoop(notBefore *time.Time,
 					*notBefore = act
 				}
 				c.limiterMu.RUnlock()
+				// Wait itself is accounted upon the next operation
+				c.waits.record(n, 0)
+				if waitTotals != nil {
+					waitTotals.record(n, 0)
+				}
 				err = timeoutError{}
 				return
 			}
 			until = act
 		}
 		if !until.IsZero() {
-			if c.waitUntil(abortWait, act) {
+			if c.recordedWait(abortWait, act, n, waitTotals) {
 				err = io.ErrClosedPipe
 				return
 			}
@@ -176,13 +307,17 @@ func (c *LimitedConnection) SetDeadline(t time.Time) error {
 
 // SetReadDeadline is an implementation of net.Conn.SetReadDeadline
 func (c *LimitedConnection) SetReadDeadline(t time.Time) error {
+	c.limiterMu.Lock()
 	c.readDeadline = t
+	c.limiterMu.Unlock()
 	return c.inner.SetReadDeadline(t)
 }
 
 // SetWriteDeadline is an implementation of net.Conn.SetWriteDeadline
 func (c *LimitedConnection) SetWriteDeadline(t time.Time) error {
+	c.limiterMu.Lock()
 	c.writeDeadline = t
+	c.limiterMu.Unlock()
 	return c.inner.SetWriteDeadline(t)
 }
 
@@ -196,6 +331,20 @@ func (c *LimitedConnection) Close() error {
 	return res
 }
 
+// recordedWait waits like waitUntil accounting the wait delaying n bytes in
+// connection waits and given totals (may be nil)
+func (c *LimitedConnection) recordedWait(abortWait chan struct{}, t time.Time, n int,
+	totals *WaitStats) bool {
+	started := time.Now()
+	closed := c.waitUntil(abortWait, t)
+	waited := time.Since(started)
+	c.waits.record(n, waited)
+	if totals != nil {
+		totals.record(n, waited)
+	}
+	return closed
+}
+
 // Waits until given time or until connection is closed. Returns
 // true if connection was closed and false if time has elapsed
 // or if wait was aborted by closing or sending on 'abortWait'
@@ -211,3 +360,8 @@ func (c *LimitedConnection) waitUntil(abortWait chan struct{}, t time.Time) bool
 		return true
 	}
 }
+
+// Inner returns connection wrapped by a LimitedConnection
+func (c *LimitedConnection) Inner() net.Conn {
+	return c.inner
+}
@@ -2,6 +2,7 @@ package limiter
 
 import (
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"reflect"
@@ -156,3 +157,109 @@ func TestReadDeadline(t *testing.T) {
 		t.Error("Read buffer doesn't match beginning of write buffer")
 	}
 }
+
+func TestInteractiveBoost(t *testing.T) {
+	c1, unwrapped := net.Pipe()
+	defer unwrapped.Close()
+	wrapped := NewLimitedConnection(c1, NewMultiLimiter([]*rate.Limiter{
+		rate.NewLimiter(rate.Limit(100), 100),
+	}))
+	defer wrapped.Close()
+	go io.Copy(ioutil.Discard, unwrapped)
+
+	// Drain initial burst
+	if _, err := wrapped.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	// Keystrokes
+	wrapped.SetInteractiveBoost(rate.Limit(10 * InteractiveChunkSize))
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		start := time.Now()
+		if _, err := wrapped.Write(make([]byte, 50)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("Expected small write to go through without waiting, took %v", elapsed)
+		}
+	}
+
+	// Without boost, small writes have to wait for the debt to be paid off
+	wrapped.SetInteractiveBoost(0)
+	start := time.Now()
+	if _, err := wrapped.Write(make([]byte, 50)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected small write to be limited, took %v", elapsed)
+	}
+}
+
+func TestObserveOnly(t *testing.T) {
+	c1, unwrapped := net.Pipe()
+	defer c1.Close()
+	defer unwrapped.Close()
+	limit := rate.Limit(10 * 1024)
+	wrapped := NewLimitedConnection(c1, NewMultiLimiter([]*rate.Limiter{
+		CreateLimiter(limit),
+	}))
+	defer wrapped.Close()
+	totals := new(ObservedThrottling)
+	wrapped.SetObserveOnly(true, totals)
+
+	go io.Copy(ioutil.Discard, unwrapped)
+
+	// Ten seconds worth of traffic goes through without waiting
+	buf := make([]byte, 10*int(limit))
+	start := time.Now()
+	if _, err := wrapped.Write(buf); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected observe-only connection not to wait, took %v", elapsed)
+	}
+
+	observed := wrapped.Observed()
+	if observed.DelayedBytes == 0 || observed.Delay == 0 {
+		t.Errorf("Expected delays to be observed, got %+v", observed)
+	}
+	if observed != totals.Load() {
+		t.Errorf("Expected totals %+v to match connection observations %+v",
+			totals.Load(), observed)
+	}
+}
+
+func TestShadowLimiter(t *testing.T) {
+	c1, unwrapped := net.Pipe()
+	defer c1.Close()
+	defer unwrapped.Close()
+	wrapped := NewLimitedConnection(c1, NewMultiLimiter(nil))
+	defer wrapped.Close()
+	limit := rate.Limit(10 * 1024)
+	totals := new(ObservedThrottling)
+	wrapped.SetShadowLimiter(NewMultiLimiter([]*rate.Limiter{CreateLimiter(limit)}), totals)
+
+	go io.Copy(ioutil.Discard, unwrapped)
+
+	buf := make([]byte, 10*int(limit))
+	start := time.Now()
+	if _, err := wrapped.Write(buf); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected shadow limits not to be enforced, took %v", elapsed)
+	}
+
+	shadowed := wrapped.Shadowed()
+	if shadowed.DelayedBytes == 0 || shadowed.Delay == 0 {
+		t.Errorf("Expected shadow limit violations to be recorded, got %+v", shadowed)
+	}
+	if shadowed != totals.Load() {
+		t.Errorf("Expected totals %+v to match connection observations %+v",
+			totals.Load(), shadowed)
+	}
+	if observed := wrapped.Observed(); observed != (ObservedThrottling{}) {
+		t.Errorf("Expected no observe-only records, got %+v", observed)
+	}
+}
@@ -0,0 +1,139 @@
+package limiter
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BucketState is a point-in-time view of a token bucket limiter
+type BucketState struct {
+	Limit rate.Limit
+	Burst int
+	// Tokens currently available. Negative if transfers have reserved tokens
+	// that are yet to be replenished (i.e. they are waiting).
+	Tokens float64
+}
+
+// InspectLimiter returns state of a limiter at a given moment. Tokens are
+// found by reserving the whole burst and cancelling the reservation right
+// away, so the state is approximate if limiter is used concurrently.
+func InspectLimiter(l *rate.Limiter, now time.Time) BucketState {
+	result := BucketState{
+		Limit: l.Limit(),
+		Burst: l.Burst(),
+	}
+	if result.Limit == rate.Inf || result.Limit == 0 {
+		result.Tokens = float64(result.Burst)
+		return result
+	}
+	r := l.ReserveN(now, result.Burst)
+	if !r.OK() {
+		return result
+	}
+	delay := r.DelayFrom(now)
+	r.CancelAt(now)
+	result.Tokens = float64(result.Burst) - delay.Seconds()*float64(result.Limit)
+	return result
+}
+
+// WaitStats counts time transfers spent waiting for limiters. Fields are
+// updated atomically.
+type WaitStats struct {
+	// Number of times transfers had to wait
+	Waits int64
+	// Bytes that were delayed
+	Bytes int64
+	// Total time spent waiting (nanoseconds)
+	Time int64
+}
+
+// Load atomically loads counters
+func (w *WaitStats) Load() WaitStats {
+	return WaitStats{
+		Waits: atomic.LoadInt64(&w.Waits),
+		Bytes: atomic.LoadInt64(&w.Bytes),
+		Time:  atomic.LoadInt64(&w.Time),
+	}
+}
+
+// record accounts a wait for limiters delaying n bytes. Zero n stands for
+// continuation of a wait that was already accounted.
+func (w *WaitStats) record(n int, d time.Duration) {
+	if n > 0 {
+		atomic.AddInt64(&w.Waits, 1)
+		atomic.AddInt64(&w.Bytes, int64(n))
+	}
+	atomic.AddInt64(&w.Time, int64(d))
+}
+
+// Waits returns time connection spent waiting for its limiters. Safe to call
+// concurrently.
+func (c *LimitedConnection) Waits() WaitStats {
+	return c.waits.Load()
+}
+
+// SetWaitTotals makes connection add its waits to given totals as well as to
+// its own counters (nil totals stop that). May be called concurrently with
+// Read or Write.
+func (c *LimitedConnection) SetWaitTotals(totals *WaitStats) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	c.waitTotals = totals
+}
+
+// ListenerBuckets is a point-in-time view of limiters of a listener
+type ListenerBuckets struct {
+	// Nil if listener isn't limited as a whole
+	Global *BucketState
+	Shared []BucketState
+}
+
+// Buckets returns state of limiters shared by all connections of this
+// listener
+func (l *RateLimitingListener) Buckets() ListenerBuckets {
+	now := time.Now()
+	l.currentLimitsMu.RLock()
+	defer l.currentLimitsMu.RUnlock()
+	var result ListenerBuckets
+	if l.globalLimiter != nil {
+		state := InspectLimiter(l.globalLimiter, now)
+		result.Global = &state
+	}
+	for _, shared := range l.sharedLimiters {
+		result.Shared = append(result.Shared, InspectLimiter(shared, now))
+	}
+	return result
+}
+
+// ConnectionBuckets is a point-in-time view of limiters of a single connection
+type ConnectionBuckets struct {
+	// Nil if connection isn't limited individually
+	Connection *BucketState
+	// Limiters connection shares with others beyond listener ones (see
+	// UpdateConnectionSharedLimiters)
+	Shared []BucketState
+}
+
+// ConnectionBuckets returns state of limiters of a connection accepted on
+// this listener besides the ones shared by all of its connections
+func (l *RateLimitingListener) ConnectionBuckets(conn net.Conn) ConnectionBuckets {
+	var result ConnectionBuckets
+	limConn, ok := conn.(*LimitedConnection)
+	if !ok {
+		return result
+	}
+	now := time.Now()
+	l.currentLimitsMu.RLock()
+	defer l.currentLimitsMu.RUnlock()
+	if perConn, ok := l.connectionLimiters[limConn]; ok {
+		state := InspectLimiter(perConn, now)
+		result.Connection = &state
+	}
+	for _, shared := range l.connectionShared[limConn] {
+		result.Shared = append(result.Shared, InspectLimiter(shared, now))
+	}
+	return result
+}
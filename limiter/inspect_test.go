@@ -0,0 +1,58 @@
+package limiter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestInspectLimiter(t *testing.T) {
+	l := rate.NewLimiter(1000, 100)
+	now := time.Now()
+	if state := InspectLimiter(l, now); state.Limit != 1000 || state.Burst != 100 ||
+		state.Tokens != 100 {
+		t.Errorf("Expected full bucket, got %+v", state)
+	}
+	// Inspection doesn't consume tokens
+	if state := InspectLimiter(l, now); state.Tokens != 100 {
+		t.Errorf("Expected bucket to stay full, got %+v", state)
+	}
+
+	l.ReserveN(now, 100)
+	l.ReserveN(now, 50)
+	if state := InspectLimiter(l, now); state.Tokens < -50.1 || state.Tokens > -49.9 {
+		t.Errorf("Expected 50 tokens to be owed, got %+v", state)
+	}
+}
+
+func TestConnectionWaits(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn := NewLimitedConnection(client, NewMultiLimiter([]*rate.Limiter{
+		rate.NewLimiter(10000, 1000),
+	}))
+	defer conn.Close()
+	totals := new(WaitStats)
+	conn.SetWaitTotals(totals)
+
+	if _, err := conn.Write(make([]byte, 3000)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	waits := conn.Waits()
+	if waits.Waits == 0 || waits.Bytes == 0 || time.Duration(waits.Time) < 100*time.Millisecond {
+		t.Errorf("Expected connection to wait for limiter, got %+v", waits)
+	}
+	if *totals != waits {
+		t.Errorf("Expected totals %+v to match connection waits %+v", *totals, waits)
+	}
+}
@@ -3,6 +3,7 @@ package limiter
 import (
 	"net"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -21,9 +22,112 @@ type RateLimitingListener struct {
 	connectionClosed chan *LimitedConnection
 
 	globalLimiter   *rate.Limiter
+	sharedLimiters  []*rate.Limiter
 	currentLimits   rateLimits
 	currentLimitsMu *sync.RWMutex
 	updateLimits    chan rateLimits
+	updateShared    chan []*rate.Limiter
+	// Per-connection limits overriding ConnectionLimit of currentLimits
+	connectionLimits      map[*LimitedConnection]rate.Limit
+	updateConnectionLimit chan connectionLimit
+	// Limiters of connections limited individually
+	connectionLimiters map[*LimitedConnection]*rate.Limiter
+	// Limiters individual connections share with others on top of listener
+	// ones (e.g. a limit of a client spanning several listeners)
+	connectionShared       map[*LimitedConnection][]*rate.Limiter
+	updateConnectionShared chan connectionShared
+	// Connections bypassing all limiters
+	exemptConnections      map[*LimitedConnection]struct{}
+	updateExemptConnection chan connectionExemption
+
+	interactiveBoost       rate.Limit
+	updateInteractiveBoost chan rate.Limit
+
+	observeOnly       observeOnly
+	updateObserveOnly chan observeOnly
+
+	// Limits that are evaluated, but not enforced
+	shadow              shadowLimits
+	shadowGlobalLimiter *rate.Limiter
+	updateShadow        chan shadowLimits
+
+	slowStart          SlowStart
+	updateSlowStart    chan SlowStart
+	rampingConnections map[*LimitedConnection]*rampingConnection
+
+	waitTotals       *WaitStats
+	updateWaitTotals chan *WaitStats
+
+	// Limiters allow traffic of this duration at once (see ScaledBurst)
+	burstDuration       time.Duration
+	updateBurstDuration chan time.Duration
+	// Fixed bursts overriding burst duration (zero if not set)
+	bursts       bursts
+	updateBursts chan bursts
+
+	algorithm       Algorithm
+	updateAlgorithm chan Algorithm
+	// Limiters of connections' fair shares of listener limit (FairQueue and
+	// FairShare only)
+	fairLimiters map[*LimitedConnection]*rate.Limiter
+	// Recent traffic of connections and time it was sampled (FairShare only)
+	fairDemands   map[*LimitedConnection]*fairDemand
+	fairSampledAt time.Time
+
+	// Limiters shared by connections of the same client by its IP address
+	// and clients connections come from
+	clientLimit       rate.Limit
+	clientLimiters    map[string]*clientLimiter
+	connectionClients map[*LimitedConnection]string
+	updateClientLimit chan rate.Limit
+
+	// Limits of reads from (upload) and writes to (download) connections
+	// applied on top of limits of both directions
+	directionLimits       directionLimits
+	uploadLimiter         *rate.Limiter
+	downloadLimiter       *rate.Limiter
+	updateDirectionLimits chan directionLimits
+}
+
+type bursts struct {
+	global  int
+	perConn int
+}
+
+type directionLimits struct {
+	Upload             rate.Limit
+	Download           rate.Limit
+	ConnectionUpload   rate.Limit
+	ConnectionDownload rate.Limit
+}
+
+type connectionLimit struct {
+	conn *LimitedConnection
+	// Nil limit means that connection gets back to the listener's limit
+	limit *rate.Limit
+	done  chan bool
+}
+
+type connectionShared struct {
+	conn     *LimitedConnection
+	limiters []*rate.Limiter
+	done     chan bool
+}
+
+type connectionExemption struct {
+	conn   *LimitedConnection
+	exempt bool
+	done   chan bool
+}
+
+type observeOnly struct {
+	enabled bool
+	totals  *ObservedThrottling
+}
+
+type shadowLimits struct {
+	limits rateLimits
+	totals *ObservedThrottling
 }
 
 type rateLimits struct {
@@ -41,7 +145,7 @@ type rateLimits struct {
 // exceed
 func NewRateLimitingListener(listener net.Listener, global, perConn int) *RateLimitingListener {
 	var globalLimiter *rate.Limiter
-	if global > 0 {
+	if global != 0 {
 		globalLimiter = CreateLimiter(rate.Limit(global))
 	}
 	result := &RateLimitingListener{
@@ -58,6 +162,39 @@ func NewRateLimitingListener(listener net.Listener, global, perConn int) *RateLi
 		},
 		currentLimitsMu: new(sync.RWMutex),
 		updateLimits:    make(chan rateLimits),
+		updateShared:    make(chan []*rate.Limiter),
+
+		connectionLimits:      make(map[*LimitedConnection]rate.Limit),
+		updateConnectionLimit: make(chan connectionLimit),
+		connectionLimiters:    make(map[*LimitedConnection]*rate.Limiter),
+
+		connectionShared:       make(map[*LimitedConnection][]*rate.Limiter),
+		updateConnectionShared: make(chan connectionShared),
+
+		exemptConnections:      make(map[*LimitedConnection]struct{}),
+		updateExemptConnection: make(chan connectionExemption),
+
+		updateInteractiveBoost: make(chan rate.Limit),
+		updateObserveOnly:      make(chan observeOnly),
+		updateShadow:           make(chan shadowLimits),
+
+		updateSlowStart:    make(chan SlowStart),
+		rampingConnections: make(map[*LimitedConnection]*rampingConnection),
+
+		updateWaitTotals: make(chan *WaitStats),
+
+		updateBurstDuration: make(chan time.Duration),
+		updateBursts:        make(chan bursts),
+
+		updateAlgorithm: make(chan Algorithm),
+		fairLimiters:    make(map[*LimitedConnection]*rate.Limiter),
+		fairDemands:     make(map[*LimitedConnection]*fairDemand),
+
+		clientLimiters:    make(map[string]*clientLimiter),
+		connectionClients: make(map[*LimitedConnection]string),
+		updateClientLimit: make(chan rate.Limit),
+
+		updateDirectionLimits: make(chan directionLimits),
 	}
 
 	go result.dispatcher()
@@ -77,6 +214,239 @@ func (l *RateLimitingListener) UpdateLimits(newGlobal, newPerConn int) {
 	}
 }
 
+// UpdateSharedLimiters replaces the set of limiters this listener shares with
+// others (e.g. an aggregate limit for a group of listeners). Shared limiters
+// apply to all connections that were accepted (or will be accepted in future)
+// on top of the listener's own limits.
+func (l *RateLimitingListener) UpdateSharedLimiters(limiters []*rate.Limiter) {
+	select {
+	case l.updateShared <- limiters:
+	case <-l.close:
+	}
+}
+
+// UpdateSlowStart changes slow start settings for connections accepted from
+// now on. Connections that are already ramping up continue to do so at the
+// new pace.
+func (l *RateLimitingListener) UpdateSlowStart(s SlowStart) {
+	select {
+	case l.updateSlowStart <- s:
+	case <-l.close:
+	}
+}
+
+// UpdateInteractiveBoost sets the rate (bytes per second) at which small
+// chunks of data of each connection are let through without waiting for
+// limiters. See LimitedConnection.SetInteractiveBoost. Zero disables the
+// boost.
+func (l *RateLimitingListener) UpdateInteractiveBoost(perConn int) {
+	select {
+	case l.updateInteractiveBoost <- rate.Limit(perConn):
+	case <-l.close:
+	}
+}
+
+// UpdateObserveOnly makes connections that were accepted (or will be accepted
+// in future) forward traffic without waiting for limiters, only accounting
+// throttling that would have happened. See LimitedConnection.SetObserveOnly.
+// Observations of all connections are added to given totals (may be nil).
+func (l *RateLimitingListener) UpdateObserveOnly(observe bool, totals *ObservedThrottling) {
+	select {
+	case l.updateObserveOnly <- observeOnly{enabled: observe, totals: totals}:
+	case <-l.close:
+	}
+}
+
+// UpdateShadowLimits sets limits that are evaluated for connections that were
+// accepted (or will be accepted in future) alongside the enforced ones, but
+// never enforced. See LimitedConnection.SetShadowLimiter. Traffic exceeding
+// shadow limits is added to given totals (may be nil). Zero limits disable
+// shadow evaluation.
+func (l *RateLimitingListener) UpdateShadowLimits(global, perConn int, totals *ObservedThrottling) {
+	select {
+	case l.updateShadow <- shadowLimits{
+		limits: rateLimits{
+			GlobalLimit:     rate.Limit(global),
+			ConnectionLimit: rate.Limit(perConn),
+		},
+		totals: totals,
+	}:
+	case <-l.close:
+	}
+}
+
+// UpdateBurstDuration makes bursts of listener and per-connection limiters
+// equal to traffic their limits allow over a given duration, so that they
+// scale along with limits. Zero duration brings back default bursts (see
+// GetGoodBurst). Limiters of all connections are replaced right away.
+func (l *RateLimitingListener) UpdateBurstDuration(d time.Duration) {
+	select {
+	case l.updateBurstDuration <- d:
+	case <-l.close:
+	}
+}
+
+// UpdateDirectionLimits sets limits of data read from connections (uploaded
+// by clients) and written to them (downloaded by clients) that were accepted
+// (or will be accepted in future). upload and download apply to all
+// connections together, perConnUpload and perConnDownload to each individual
+// one. They apply on top of limits set with UpdateLimits, so directions could
+// be limited differently (e.g. to simulate an asymmetric link). Zero disables
+// a limit.
+func (l *RateLimitingListener) UpdateDirectionLimits(upload, download, perConnUpload,
+	perConnDownload int) {
+	select {
+	case l.updateDirectionLimits <- directionLimits{
+		Upload:             rate.Limit(upload),
+		Download:           rate.Limit(download),
+		ConnectionUpload:   rate.Limit(perConnUpload),
+		ConnectionDownload: rate.Limit(perConnDownload),
+	}:
+	case <-l.close:
+	}
+}
+
+// UpdateBursts sets burst sizes (in bytes) of the listener limiter and of
+// per-connection limiters regardless of their limits, trading smooth pacing
+// for bursty delivery or vice versa. Zero brings back bursts according to
+// burst duration (see UpdateBurstDuration). Limiters of all connections are
+// replaced right away.
+func (l *RateLimitingListener) UpdateBursts(global, perConn int) {
+	select {
+	case l.updateBursts <- bursts{global: global, perConn: perConn}:
+	case <-l.close:
+	}
+}
+
+// UpdateWaitTotals makes connections that were accepted (or will be accepted
+// in future) add time they wait for limiters to given totals (may be nil).
+// See LimitedConnection.SetWaitTotals.
+func (l *RateLimitingListener) UpdateWaitTotals(totals *WaitStats) {
+	select {
+	case l.updateWaitTotals <- totals:
+	case <-l.close:
+	}
+}
+
+// ConnectionLimit returns per-connection limit currently in effect for a
+// connection accepted on this listener (lower than the configured one while
+// connection is in slow start) and whether connection has a limit of its own
+// set with UpdateConnectionLimit. Zero limit means connection is not limited
+// individually.
+func (l *RateLimitingListener) ConnectionLimit(conn net.Conn) (limit int, own bool) {
+	limConn, ok := conn.(*LimitedConnection)
+	if !ok {
+		return 0, false
+	}
+	l.currentLimitsMu.RLock()
+	defer l.currentLimitsMu.RUnlock()
+	perConn, own := l.connectionLimits[limConn]
+	if !own {
+		perConn = l.currentLimits.ConnectionLimit
+	}
+	if r, ok := l.rampingConnections[limConn]; ok {
+		perConn = r.limiter.Limit()
+	}
+	if _, exempt := l.exemptConnections[limConn]; exempt {
+		perConn = 0
+	}
+	return int(perConn), own
+}
+
+// UpdateConnectionLimit moves a connection accepted on this listener to a
+// different per-connection limit. Connection keeps it regardless of subsequent
+// UpdateLimits calls until ResetConnectionLimit is called. Limiters are
+// replaced in place, connection is not interrupted. Returns false if
+// connection doesn't belong to this listener or is already closed.
+func (l *RateLimitingListener) UpdateConnectionLimit(conn net.Conn, perConn int) bool {
+	limit := rate.Limit(perConn)
+	return l.setConnectionLimit(conn, &limit)
+}
+
+// ResetConnectionLimit makes a connection accepted on this listener subject to
+// the listener's per-connection limit again. Returns false if connection
+// doesn't belong to this listener or is already closed.
+func (l *RateLimitingListener) ResetConnectionLimit(conn net.Conn) bool {
+	return l.setConnectionLimit(conn, nil)
+}
+
+func (l *RateLimitingListener) setConnectionLimit(conn net.Conn, limit *rate.Limit) bool {
+	limConn, ok := conn.(*LimitedConnection)
+	if !ok {
+		return false
+	}
+	done := make(chan bool, 1)
+	select {
+	case l.updateConnectionLimit <- connectionLimit{
+		conn:  limConn,
+		limit: limit,
+		done:  done,
+	}:
+		return <-done
+	case <-l.close:
+		return false
+	}
+}
+
+// UpdateConnectionSharedLimiters replaces the set of limiters a single
+// connection accepted on this listener shares with others (e.g. a limit of a
+// client spanning several listeners). They apply on top of the listener's own
+// and shared limiters. Returns false if connection doesn't belong to this
+// listener or is already closed.
+func (l *RateLimitingListener) UpdateConnectionSharedLimiters(conn net.Conn,
+	limiters []*rate.Limiter) bool {
+	limConn, ok := conn.(*LimitedConnection)
+	if !ok {
+		return false
+	}
+	done := make(chan bool, 1)
+	select {
+	case l.updateConnectionShared <- connectionShared{
+		conn:     limConn,
+		limiters: limiters,
+		done:     done,
+	}:
+		return <-done
+	case <-l.close:
+		return false
+	}
+}
+
+// SetConnectionExempt makes a connection accepted on this listener bypass all
+// limiters (listener, shared and per-connection ones) or makes it subject to
+// them again. Returns false if connection doesn't belong to this listener or
+// is already closed.
+func (l *RateLimitingListener) SetConnectionExempt(conn net.Conn, exempt bool) bool {
+	limConn, ok := conn.(*LimitedConnection)
+	if !ok {
+		return false
+	}
+	done := make(chan bool, 1)
+	select {
+	case l.updateExemptConnection <- connectionExemption{
+		conn:   limConn,
+		exempt: exempt,
+		done:   done,
+	}:
+		return <-done
+	case <-l.close:
+		return false
+	}
+}
+
+// ConnectionExempt tells whether a connection accepted on this listener
+// bypasses limiters
+func (l *RateLimitingListener) ConnectionExempt(conn net.Conn) bool {
+	limConn, ok := conn.(*LimitedConnection)
+	if !ok {
+		return false
+	}
+	l.currentLimitsMu.RLock()
+	defer l.currentLimitsMu.RUnlock()
+	_, exempt := l.exemptConnections[limConn]
+	return exempt
+}
+
 // Accept is an implementation of net.Listener.Accept
 func (l *RateLimitingListener) Accept() (net.Conn, error) {
 	innerConn, err := l.inner.Accept()
@@ -84,11 +454,20 @@ func (l *RateLimitingListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	l.currentLimitsMu.RLock()
-	multiLimiter := l.createMultiLimiter()
-	l.currentLimitsMu.RUnlock()
+	l.currentLimitsMu.Lock()
+	defer l.currentLimitsMu.Unlock()
 
-	limConn := NewLimitedConnection(innerConn, multiLimiter)
+	limConn := NewLimitedConnection(innerConn, NewMultiLimiter(nil))
+	limConn.acceptedAt = time.Now()
+	l.activeConnections[limConn] = struct{}{}
+	l.acquireClientLimiter(limConn)
+	limConn.limiter, limConn.readLimiter, limConn.writeLimiter =
+		l.createConnectionMultiLimiters(limConn)
+	l.rebalanceFairShares()
+	limConn.SetInteractiveBoost(l.interactiveBoost)
+	limConn.SetObserveOnly(l.observeOnly.enabled, l.observeOnly.totals)
+	limConn.SetShadowLimiter(l.createShadowMultiLimiter(limConn), l.shadow.totals)
+	limConn.SetWaitTotals(l.waitTotals)
 
 	// This is a bit of a hack, but it works fine for our needs
 	limConn.whenClosed = func(c *LimitedConnection) {
@@ -98,7 +477,6 @@ func (l *RateLimitingListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	l.activeConnections[limConn] = struct{}{}
 	return limConn, nil
 }
 
@@ -125,26 +503,219 @@ func (l *RateLimitingListener) Addr() net.Addr {
 }
 
 func (l *RateLimitingListener) dispatcher() {
+	// Ticks only while slow start is enabled
+	var rampTick <-chan time.Time
+	var rampTicker *time.Ticker
+	// Ticks only while FairShare algorithm is in effect
+	var fairTick <-chan time.Time
+	var fairTicker *time.Ticker
+	defer func() {
+		if rampTicker != nil {
+			rampTicker.Stop()
+		}
+		if fairTicker != nil {
+			fairTicker.Stop()
+		}
+	}()
+
 	for {
 		select {
-		case newLimits := <-l.updateLimits:
+		case s := <-l.updateSlowStart:
+			l.currentLimitsMu.Lock()
+			l.slowStart = s
+			l.rampUp()
+			l.currentLimitsMu.Unlock()
+			if s.enabled() && rampTicker == nil {
+				rampTicker = time.NewTicker(slowStartStep)
+				rampTick = rampTicker.C
+			} else if !s.enabled() && rampTicker != nil {
+				rampTicker.Stop()
+				rampTicker = nil
+				rampTick = nil
+			}
+
+		case boost := <-l.updateInteractiveBoost:
+			l.currentLimitsMu.Lock()
+			l.interactiveBoost = boost
+			for conn := range l.activeConnections {
+				conn.SetInteractiveBoost(boost)
+			}
+			l.currentLimitsMu.Unlock()
+
+		case observe := <-l.updateObserveOnly:
+			l.currentLimitsMu.Lock()
+			l.observeOnly = observe
+			for conn := range l.activeConnections {
+				conn.SetObserveOnly(observe.enabled, observe.totals)
+			}
+			l.currentLimitsMu.Unlock()
 
+		case shadow := <-l.updateShadow:
+			l.currentLimitsMu.Lock()
+			l.shadow = shadow
+			l.shadowGlobalLimiter = nil
+			if shadow.limits.GlobalLimit > 0 {
+				l.shadowGlobalLimiter = l.createLimiter(shadow.limits.GlobalLimit)
+			}
+			for conn := range l.activeConnections {
+				conn.SetShadowLimiter(l.createShadowMultiLimiter(conn), shadow.totals)
+			}
+			l.currentLimitsMu.Unlock()
+
+		case d := <-l.updateBurstDuration:
+			l.currentLimitsMu.Lock()
+			if d != l.burstDuration {
+				l.burstDuration = d
+				if l.currentLimits.GlobalLimit != 0 {
+					l.globalLimiter = l.createGlobalLimiter(l.currentLimits.GlobalLimit)
+				}
+				if l.shadow.limits.GlobalLimit > 0 {
+					l.shadowGlobalLimiter = l.createLimiter(l.shadow.limits.GlobalLimit)
+				}
+				l.createDirectionLimiters()
+				l.createClientLimiters()
+				l.updateConnectionLimiters()
+				for conn := range l.activeConnections {
+					conn.SetShadowLimiter(l.createShadowMultiLimiter(conn), l.shadow.totals)
+				}
+			}
+			l.currentLimitsMu.Unlock()
+
+		case b := <-l.updateBursts:
+			l.currentLimitsMu.Lock()
+			if b != l.bursts {
+				l.bursts = b
+				if l.currentLimits.GlobalLimit != 0 {
+					l.globalLimiter = l.createGlobalLimiter(l.currentLimits.GlobalLimit)
+				}
+				l.updateConnectionLimiters()
+			}
+			l.currentLimitsMu.Unlock()
+
+		case limit := <-l.updateClientLimit:
+			l.currentLimitsMu.Lock()
+			if limit != l.clientLimit {
+				l.clientLimit = limit
+				l.createClientLimiters()
+				l.updateConnectionLimiters()
+			}
+			l.currentLimitsMu.Unlock()
+
+		case a := <-l.updateAlgorithm:
+			l.currentLimitsMu.Lock()
+			l.switchAlgorithm(a)
+			if a != FairShare {
+				l.fairDemands = make(map[*LimitedConnection]*fairDemand)
+			}
+			l.currentLimitsMu.Unlock()
+			if a == FairShare && fairTicker == nil {
+				fairTicker = time.NewTicker(FairShareInterval)
+				fairTick = fairTicker.C
+			} else if a != FairShare && fairTicker != nil {
+				fairTicker.Stop()
+				fairTicker = nil
+				fairTick = nil
+			}
+
+		case limits := <-l.updateDirectionLimits:
+			l.currentLimitsMu.Lock()
+			l.directionLimits = limits
+			l.createDirectionLimiters()
+			l.updateConnectionLimiters()
+			l.currentLimitsMu.Unlock()
+
+		case totals := <-l.updateWaitTotals:
+			l.currentLimitsMu.Lock()
+			l.waitTotals = totals
+			for conn := range l.activeConnections {
+				conn.SetWaitTotals(totals)
+			}
+			l.currentLimitsMu.Unlock()
+
+		case <-rampTick:
+			l.currentLimitsMu.Lock()
+			l.rampUp()
+			l.currentLimitsMu.Unlock()
+
+		case now := <-fairTick:
+			l.currentLimitsMu.Lock()
+			l.sampleFairDemands(now)
+			l.currentLimitsMu.Unlock()
+
+		case newLimits := <-l.updateLimits:
 			l.currentLimitsMu.Lock()
 			l.globalLimiter = nil
-			if newLimits.GlobalLimit > 0 {
-				l.globalLimiter = CreateLimiter(rate.Limit(newLimits.GlobalLimit))
+			if newLimits.GlobalLimit != 0 {
+				l.globalLimiter = l.createGlobalLimiter(newLimits.GlobalLimit)
 			}
 			l.currentLimits = newLimits
+			l.updateConnectionLimiters()
 			l.currentLimitsMu.Unlock()
 
-			// No need to read-lock because we are the only ones capable of modifying
-			// limits and we've already done it.
-			for conn := range l.activeConnections {
-				multiLimiter := l.createMultiLimiter()
-				conn.UpdateLimiter(multiLimiter)
+		case shared := <-l.updateShared:
+			l.currentLimitsMu.Lock()
+			l.sharedLimiters = shared
+			l.updateConnectionLimiters()
+			l.currentLimitsMu.Unlock()
+
+		case update := <-l.updateConnectionLimit:
+			l.currentLimitsMu.Lock()
+			_, ok := l.activeConnections[update.conn]
+			if ok {
+				if update.limit != nil {
+					l.connectionLimits[update.conn] = *update.limit
+				} else {
+					delete(l.connectionLimits, update.conn)
+				}
+				l.updateConnectionLimiter(update.conn)
 			}
+			l.currentLimitsMu.Unlock()
+			update.done <- ok
+
+		case update := <-l.updateConnectionShared:
+			l.currentLimitsMu.Lock()
+			_, ok := l.activeConnections[update.conn]
+			if ok {
+				if len(update.limiters) > 0 {
+					l.connectionShared[update.conn] = update.limiters
+				} else {
+					delete(l.connectionShared, update.conn)
+				}
+				l.updateConnectionLimiter(update.conn)
+			}
+			l.currentLimitsMu.Unlock()
+			update.done <- ok
+
+		case update := <-l.updateExemptConnection:
+			l.currentLimitsMu.Lock()
+			_, ok := l.activeConnections[update.conn]
+			if ok {
+				if update.exempt {
+					l.exemptConnections[update.conn] = struct{}{}
+				} else {
+					delete(l.exemptConnections, update.conn)
+				}
+				l.updateConnectionLimiter(update.conn)
+				update.conn.SetShadowLimiter(l.createShadowMultiLimiter(update.conn),
+					l.shadow.totals)
+				l.rebalanceFairShares()
+			}
+			l.currentLimitsMu.Unlock()
+			update.done <- ok
+
 		case closedConn := <-l.connectionClosed:
+			l.currentLimitsMu.Lock()
 			delete(l.activeConnections, closedConn)
+			delete(l.connectionLimits, closedConn)
+			delete(l.connectionShared, closedConn)
+			delete(l.connectionLimiters, closedConn)
+			delete(l.exemptConnections, closedConn)
+			delete(l.rampingConnections, closedConn)
+			delete(l.fairLimiters, closedConn)
+			delete(l.fairDemands, closedConn)
+			l.releaseClientLimiter(closedConn)
+			l.rebalanceFairShares()
+			l.currentLimitsMu.Unlock()
 
 		case <-l.close:
 			return
@@ -152,13 +723,164 @@ func (l *RateLimitingListener) dispatcher() {
 	}
 }
 
-func (l *RateLimitingListener) createMultiLimiter() *MultiLimiter {
-	limiters := make([]*rate.Limiter, 0, 2)
+// createLimiter creates a limiter for a given limit with a burst according to
+// burst duration and algorithm. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) createLimiter(limit rate.Limit) *rate.Limiter {
+	if l.algorithm == LeakyBucket {
+		return CreateLimiter(limit)
+	}
+	return CreateScaledLimiter(limit, l.burstDuration)
+}
+
+// createGlobalLimiter creates the listener limiter for a given limit. Must be
+// called with currentLimitsMu locked.
+func (l *RateLimitingListener) createGlobalLimiter(limit rate.Limit) *rate.Limiter {
+	if limit > 0 && l.bursts.global > 0 && l.algorithm != LeakyBucket {
+		return rate.NewLimiter(limit, l.bursts.global)
+	}
+	return l.createLimiter(limit)
+}
+
+// connectionBurst returns burst of a per-connection limiter for a given
+// limit. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) connectionBurst(limit rate.Limit) int {
+	if l.algorithm == LeakyBucket {
+		return GetGoodBurst(limit)
+	}
+	if l.bursts.perConn > 0 {
+		return l.bursts.perConn
+	}
+	return ScaledBurst(limit, l.burstDuration)
+}
+
+// createDirectionLimiters creates limiters of all connections for upload and
+// download according to current limits. Must be called with currentLimitsMu
+// locked.
+func (l *RateLimitingListener) createDirectionLimiters() {
+	l.uploadLimiter = nil
+	if l.directionLimits.Upload > 0 {
+		l.uploadLimiter = l.createLimiter(l.directionLimits.Upload)
+	}
+	l.downloadLimiter = nil
+	if l.directionLimits.Download > 0 {
+		l.downloadLimiter = l.createLimiter(l.directionLimits.Download)
+	}
+}
+
+// updateConnectionLimiters gives every active connection a new limiter
+// according to current limits. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) updateConnectionLimiters() {
+	for conn := range l.activeConnections {
+		l.updateConnectionLimiter(conn)
+	}
+}
+
+// updateConnectionLimiter gives a connection new limiters according to
+// current limits. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) updateConnectionLimiter(conn *LimitedConnection) {
+	conn.UpdateDirectionLimiters(l.createConnectionMultiLimiters(conn))
+}
+
+// createConnectionMultiLimiters creates limiters for an accepted connection:
+// the one of both directions and, if directions are limited differently, the
+// ones of reads and writes. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) createConnectionMultiLimiters(
+	conn *LimitedConnection) (common, read, write *MultiLimiter) {
+	common = l.createConnectionMultiLimiter(conn)
+	if _, exempt := l.exemptConnections[conn]; exempt {
+		return common, nil, nil
+	}
+	read = l.createDirectionMultiLimiter(common, l.uploadLimiter,
+		l.directionLimits.ConnectionUpload)
+	write = l.createDirectionMultiLimiter(common, l.downloadLimiter,
+		l.directionLimits.ConnectionDownload)
+	return common, read, write
+}
+
+// createDirectionMultiLimiter adds a listener limiter of a direction (may be
+// nil) and a per-connection limiter for a given limit (if non-zero) to common
+// limiters of a connection. Returns nil if direction isn't limited. Must be
+// called with currentLimitsMu locked.
+func (l *RateLimitingListener) createDirectionMultiLimiter(common *MultiLimiter,
+	global *rate.Limiter, perConn rate.Limit) *MultiLimiter {
+	if global == nil && perConn <= 0 {
+		return nil
+	}
+	limiters := append(make([]*rate.Limiter, 0, len(common.limiters)+2), common.limiters...)
+	if global != nil {
+		limiters = append(limiters, global)
+	}
+	if perConn > 0 {
+		limiters = append(limiters, l.createLimiter(perConn))
+	}
+	return l.newMultiLimiter(limiters)
+}
+
+// newMultiLimiter creates a MultiLimiter of a connection out of given
+// limiters adding a pacer according to algorithm. Must be called with
+// currentLimitsMu locked.
+func (l *RateLimitingListener) newMultiLimiter(limiters []*rate.Limiter) *MultiLimiter {
+	switch l.algorithm {
+	case LeakyBucket:
+		return NewShapedMultiLimiter(limiters, []Shaper{newLeakyPacer(limiters)})
+	case SlidingWindow:
+		return NewShapedMultiLimiter(limiters,
+			[]Shaper{newSlidingWindow(limiters, SlidingWindowDuration)})
+	default:
+		return NewMultiLimiter(limiters)
+	}
+}
+
+// createConnectionMultiLimiter creates a limiter for an accepted connection
+// taking its own limit into account. Must be called with currentLimitsMu
+// locked.
+func (l *RateLimitingListener) createConnectionMultiLimiter(conn *LimitedConnection) *MultiLimiter {
+	delete(l.connectionLimiters, conn)
+	if _, exempt := l.exemptConnections[conn]; exempt {
+		delete(l.rampingConnections, conn)
+		delete(l.fairLimiters, conn)
+		return NewMultiLimiter(nil)
+	}
+
+	perConn, ok := l.connectionLimits[conn]
+	if !ok {
+		perConn = l.currentLimits.ConnectionLimit
+	}
+
+	connShared := l.connectionShared[conn]
+	limiters := make([]*rate.Limiter, 0, 4+len(l.sharedLimiters)+len(connShared))
 	if l.globalLimiter != nil {
 		limiters = append(limiters, l.globalLimiter)
 	}
-	if l.currentLimits.ConnectionLimit > 0 {
-		limiters = append(limiters, CreateLimiter(l.currentLimits.ConnectionLimit))
+	if fair := l.createFairLimiter(conn); fair != nil {
+		limiters = append(limiters, fair)
+	}
+	if client := l.clientLimiterOf(conn); client != nil {
+		limiters = append(limiters, client)
 	}
-	return NewMultiLimiter(limiters)
+	limiters = append(limiters, l.sharedLimiters...)
+	limiters = append(limiters, connShared...)
+	delete(l.rampingConnections, conn)
+	if perConn < 0 {
+		l.connectionLimiters[conn] = blockedLimiter()
+		limiters = append(limiters, l.connectionLimiters[conn])
+	} else if perConn > 0 {
+		if ramping := l.createRampingLimiter(conn.acceptedAt, perConn); ramping != nil {
+			l.rampingConnections[conn] = &rampingConnection{
+				limiter: ramping,
+				target:  perConn,
+			}
+			limiters = append(limiters, ramping)
+			l.connectionLimiters[conn] = ramping
+		} else {
+			l.connectionLimiters[conn] = rate.NewLimiter(perConn, l.connectionBurst(perConn))
+			limiters = append(limiters, l.connectionLimiters[conn])
+		}
+	}
+	return l.newMultiLimiter(limiters)
+}
+
+// Inner returns listener wrapped by a RateLimitingListener
+func (l *RateLimitingListener) Inner() net.Listener {
+	return l.inner
 }
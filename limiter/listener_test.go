@@ -1,10 +1,59 @@
 package limiter
 
 import (
+	"io"
+	"io/ioutil"
 	"net"
 	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
+// listenLimited returns a listener with given limits at a local address
+func listenLimited(t *testing.T, global, perConn int) *RateLimitingListener {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	return NewRateLimitingListener(inner, global, perConn)
+}
+
+// accept connects to a listener and returns the connection it accepted.
+// Client side of the connection is closed once the accepted one is.
+func accept(t *testing.T, l *RateLimitingListener) net.Conn {
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	go func() {
+		defer client.Close()
+		io.Copy(ioutil.Discard, client)
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	return conn
+}
+
+// acceptLimited returns a listener with given limits along with a
+// connection it accepted
+func acceptLimited(t *testing.T, global, perConn int) (*RateLimitingListener, net.Conn) {
+	l := listenLimited(t, global, perConn)
+	return l, accept(t, l)
+}
+
+// flush returns once listener processed updates made before. It updates a
+// connection that doesn't belong to the listener, which must fail.
+func flush(t *testing.T, l *RateLimitingListener) {
+	inner, _ := net.Pipe()
+	defer inner.Close()
+	if l.UpdateConnectionLimit(NewLimitedConnection(inner, NewMultiLimiter(nil)), 1) {
+		t.Errorf("Expected foreign connection update to fail")
+	}
+}
+
 func TestDoubleClose(t *testing.T) {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -15,3 +64,223 @@ func TestDoubleClose(t *testing.T) {
 	l.Close()
 	l.Close()
 }
+
+func TestUpdateConnectionLimit(t *testing.T) {
+	l, conn := acceptLimited(t, 0, 100)
+	defer l.Close()
+
+	connectionLimit := func() rate.Limit {
+		limConn := conn.(*LimitedConnection)
+		limConn.limiterMu.RLock()
+		defer limConn.limiterMu.RUnlock()
+		if len(limConn.limiter.limiters) != 1 {
+			t.Fatalf("Expected a single limiter, got %d", len(limConn.limiter.limiters))
+		}
+		return limConn.limiter.limiters[0].Limit()
+	}
+
+	if !l.UpdateConnectionLimit(conn, 1000) || connectionLimit() != 1000 {
+		t.Errorf("Expected connection limit to be updated to 1000")
+	}
+
+	l.UpdateLimits(0, 50)
+	flush(t, l)
+	if connectionLimit() != 1000 {
+		t.Errorf("Expected connection limit to survive listener update, got %v",
+			connectionLimit())
+	}
+
+	if !l.ResetConnectionLimit(conn) || connectionLimit() != 50 {
+		t.Errorf("Expected connection limit to be reset to 50, got %v", connectionLimit())
+	}
+
+	conn.Close()
+	if l.UpdateConnectionLimit(conn, 1000) {
+		t.Errorf("Expected closed connection update to fail")
+	}
+}
+
+func TestConnectionExempt(t *testing.T) {
+	l, conn := acceptLimited(t, 1000, 100)
+	defer l.Close()
+	defer conn.Close()
+
+	limiters := func() int {
+		limConn := conn.(*LimitedConnection)
+		limConn.limiterMu.RLock()
+		defer limConn.limiterMu.RUnlock()
+		return len(limConn.limiter.limiters)
+	}
+
+	if !l.SetConnectionExempt(conn, true) || limiters() != 0 || !l.ConnectionExempt(conn) {
+		t.Errorf("Expected exempt connection to have no limiters, got %d", limiters())
+	}
+	if limit, _ := l.ConnectionLimit(conn); limit != 0 {
+		t.Errorf("Expected exempt connection to be unlimited, got %d", limit)
+	}
+
+	// Exemption survives listener limits update
+	l.UpdateLimits(2000, 200)
+	if !l.SetConnectionExempt(conn, true) || limiters() != 0 {
+		t.Errorf("Expected connection to stay exempt after limits update")
+	}
+
+	if !l.SetConnectionExempt(conn, false) || limiters() != 2 || l.ConnectionExempt(conn) {
+		t.Errorf("Expected connection to get listener and connection limiters back, got %d",
+			limiters())
+	}
+}
+
+func TestUpdateConnectionSharedLimiters(t *testing.T) {
+	l, conn := acceptLimited(t, 0, 100)
+	defer l.Close()
+	defer conn.Close()
+
+	limiters := func() []*rate.Limiter {
+		limConn := conn.(*LimitedConnection)
+		limConn.limiterMu.RLock()
+		defer limConn.limiterMu.RUnlock()
+		return limConn.limiter.limiters
+	}
+
+	shared := rate.NewLimiter(1000, 1000)
+	if !l.UpdateConnectionSharedLimiters(conn, []*rate.Limiter{shared}) ||
+		len(limiters()) != 2 || limiters()[0] != shared {
+		t.Errorf("Expected connection to get a shared limiter, got %v", limiters())
+	}
+
+	// Shared limiters survive listener limits update
+	l.UpdateLimits(0, 50)
+	if !l.UpdateConnectionLimit(conn, 10) || len(limiters()) != 2 {
+		t.Errorf("Expected connection to keep its shared limiter, got %v", limiters())
+	}
+
+	if !l.UpdateConnectionSharedLimiters(conn, nil) || len(limiters()) != 1 {
+		t.Errorf("Expected shared limiter to be removed, got %v", limiters())
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	l := listenLimited(t, 0, 1000)
+	defer l.Close()
+	l.UpdateSlowStart(SlowStart{Fraction: 0.1, Window: 300 * time.Millisecond})
+	conn := accept(t, l)
+	defer conn.Close()
+
+	connectionLimit := func() rate.Limit {
+		limConn := conn.(*LimitedConnection)
+		limConn.limiterMu.RLock()
+		defer limConn.limiterMu.RUnlock()
+		l.currentLimitsMu.RLock()
+		defer l.currentLimitsMu.RUnlock()
+		return limConn.limiter.limiters[0].Limit()
+	}
+
+	if limit := connectionLimit(); limit < 100 || limit > 200 {
+		t.Errorf("Expected connection to start at a fraction of its limit, got %v", limit)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if limit := connectionLimit(); limit != 1000 {
+		t.Errorf("Expected connection to ramp up to its full limit, got %v", limit)
+	}
+}
+
+func TestUpdateBurstDuration(t *testing.T) {
+	l, conn := acceptLimited(t, 10000000, 1000000)
+	defer l.Close()
+	defer conn.Close()
+
+	bursts := func() (int, int) {
+		l.UpdateConnectionLimit(conn, 1000000)
+		buckets := l.ConnectionBuckets(conn)
+		return l.Buckets().Global.Burst, buckets.Connection.Burst
+	}
+	if global, perConn := bursts(); global != MaxBurstSize || perConn != 50000 {
+		t.Errorf("Expected default bursts, got %d and %d", global, perConn)
+	}
+
+	l.UpdateBurstDuration(100 * time.Millisecond)
+	if global, perConn := bursts(); global != 1000000 || perConn != 100000 {
+		t.Errorf("Expected bursts of 100ms worth of traffic, got %d and %d", global, perConn)
+	}
+
+	// Bursts follow limit changes
+	l.UpdateLimits(100000000, 0)
+	if global, _ := bursts(); global != 10000000 {
+		t.Errorf("Expected burst to be rescaled along with the limit, got %d", global)
+	}
+}
+
+func TestUpdateBursts(t *testing.T) {
+	l, conn := acceptLimited(t, 10000000, 1000000)
+	defer l.Close()
+	defer conn.Close()
+
+	bursts := func() (int, int) {
+		l.UpdateConnectionLimit(conn, 1000000)
+		buckets := l.ConnectionBuckets(conn)
+		return l.Buckets().Global.Burst, buckets.Connection.Burst
+	}
+
+	l.UpdateBurstDuration(100 * time.Millisecond)
+	l.UpdateBursts(1000, 0)
+	if global, perConn := bursts(); global != 1000 || perConn != 100000 {
+		t.Errorf("Expected fixed listener burst only, got %d and %d", global, perConn)
+	}
+
+	// Fixed bursts survive limit changes
+	l.UpdateBursts(1000, 2000)
+	l.UpdateLimits(100000000, 0)
+	if global, perConn := bursts(); global != 1000 || perConn != 2000 {
+		t.Errorf("Expected fixed bursts, got %d and %d", global, perConn)
+	}
+
+	l.UpdateBursts(0, 0)
+	if global, perConn := bursts(); global != 10000000 || perConn != 100000 {
+		t.Errorf("Expected bursts of 100ms worth of traffic, got %d and %d", global, perConn)
+	}
+}
+
+func TestUpdateDirectionLimits(t *testing.T) {
+	l, conn := acceptLimited(t, 0, 100)
+	defer l.Close()
+	defer conn.Close()
+	limiters := func() (read, write []*rate.Limiter) {
+		limConn := conn.(*LimitedConnection)
+		limConn.limiterMu.RLock()
+		defer limConn.limiterMu.RUnlock()
+		if limConn.readLimiter != nil {
+			read = limConn.readLimiter.limiters
+		}
+		if limConn.writeLimiter != nil {
+			write = limConn.writeLimiter.limiters
+		}
+		return read, write
+	}
+
+	l.UpdateDirectionLimits(1000, 0, 0, 50)
+	flush(t, l)
+	read, write := limiters()
+	if len(read) != 2 || read[0].Limit() != 100 || read[1].Limit() != 1000 {
+		t.Errorf("Expected reads to be limited by connection and upload limits, got %d limiters",
+			len(read))
+	}
+	if len(write) != 2 || write[0].Limit() != 100 || write[1].Limit() != 50 {
+		t.Errorf("Expected writes to be limited by connection and download limits, got %d "+
+			"limiters", len(write))
+	}
+
+	if !l.SetConnectionExempt(conn, true) {
+		t.Fatalf("Expected connection to be exempted")
+	}
+	if read, write := limiters(); read != nil || write != nil {
+		t.Errorf("Expected exempt connection to have no direction limiters")
+	}
+	l.SetConnectionExempt(conn, false)
+
+	l.UpdateDirectionLimits(0, 0, 0, 0)
+	flush(t, l)
+	if read, write := limiters(); read != nil || write != nil {
+		t.Errorf("Expected direction limiters to be removed")
+	}
+}
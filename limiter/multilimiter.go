@@ -5,57 +5,83 @@ import (
 	"time"
 )
 
-// MultiLimiter is a set of rate limiters with an option to reserve time slots
-// from all of them simultaneously.
+// MultiLimiter is a set of shapers (rate limiters and, depending on
+// algorithm, pacers) with an option to reserve time slots from all of them
+// simultaneously.
 type MultiLimiter struct {
+	// Token buckets, combined with other limiters when directions are limited
+	// differently
 	limiters []*rate.Limiter
+	shapers  []Shaper
 	burst    int
 }
 
 // NewMultiLimiter creates MultiLimiters structure from a slice of rate limiters
 func NewMultiLimiter(limiters []*rate.Limiter) *MultiLimiter {
-	if len(limiters) == 0 {
+	return NewShapedMultiLimiter(limiters, nil)
+}
+
+// NewShapedMultiLimiter creates MultiLimiter reserving time slots from rate
+// limiters and then from given shapers
+func NewShapedMultiLimiter(limiters []*rate.Limiter, shapers []Shaper) *MultiLimiter {
+	all := make([]Shaper, 0, len(limiters)+len(shapers))
+	for _, lim := range limiters {
+		all = append(all, BucketShaper(lim))
+	}
+	all = append(all, shapers...)
+	if len(all) == 0 {
 		return &MultiLimiter{
 			burst: int(^uint(0) >> 1),
 		}
 	}
 
-	var burst = limiters[0].Burst()
-	for _, lim := range limiters {
-		if lim.Burst() < burst {
-			burst = lim.Burst()
+	var burst = all[0].Burst()
+	for _, s := range all {
+		if s.Burst() < burst {
+			burst = s.Burst()
 		}
 	}
 
 	return &MultiLimiter{
 		limiters: limiters,
+		shapers:  all,
 		burst:    burst,
 	}
 }
 
-// Burst returns minimal burst size of rate limiters that belong to this
+// Burst returns minimal burst size of shapers that belong to this
 // MultiLimiter
 func (ml *MultiLimiter) Burst() int {
 	return ml.burst
 }
 
-// ReserveN allocates 'n' tokens at 'now' moment of time from all rate limiters
+// blocked tells whether one of shapers lets no traffic through
+func (ml *MultiLimiter) blocked() bool {
+	for _, s := range ml.shapers {
+		if s.Limit() == rate.Limit(0) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReserveN allocates 'n' tokens at 'now' moment of time from all shapers
 // belonging to this MultiLimiter simultaneously
 func (ml *MultiLimiter) ReserveN(now time.Time, n int) *MultiReservation {
-	res := make([]*rate.Reservation, 0, len(ml.limiters))
+	res := make([]Reservation, 0, len(ml.shapers))
 	defer func() {
 		for _, r := range res {
-			r.Cancel()
+			r.CancelAt(now)
 		}
 	}()
-	for _, lim := range ml.limiters {
+	for _, s := range ml.shapers {
 		// A special case is required because rate.Limiter with zero limit, but
 		// non-zero burst, still allows for events. We, however, in case of zero
 		// limit would like to block until either aborted or canceled by context.
-		if lim.Limit() == rate.Limit(0) {
+		if s.Limit() == rate.Limit(0) {
 			return &MultiReservation{infinite: true}
 		}
-		r := lim.ReserveN(now, n)
+		r := s.ReserveN(now, n)
 		if !r.OK() {
 			return &MultiReservation{failed: true}
 		}
@@ -68,12 +94,20 @@ func (ml *MultiLimiter) ReserveN(now time.Time, n int) *MultiReservation {
 	return result
 }
 
-// MultiReservation is token bucket reservation obtained from multiple rate
-// limiters (with the help of MultiLimiter)
+// MultiReservation is a reservation obtained from multiple shapers (with the
+// help of MultiLimiter)
 type MultiReservation struct {
 	infinite bool
 	failed   bool
-	res      []*rate.Reservation
+	res      []Reservation
+}
+
+// CancelAt returns reserved tokens to the limiters as if reservation never
+// happened (as much as possible given reservations made since then)
+func (mr *MultiReservation) CancelAt(now time.Time) {
+	for _, r := range mr.res {
+		r.CancelAt(now)
+	}
 }
 
 // DelayFrom calculates a wait duration starting from 'now' to not exceed
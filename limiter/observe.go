@@ -0,0 +1,57 @@
+package limiter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ObservedThrottling counts traffic that would have been throttled by limits
+// that are observed rather than enforced. Fields are updated atomically.
+type ObservedThrottling struct {
+	// Bytes that would have been delayed
+	DelayedBytes int64
+	// Total time transfers would have been delayed for (nanoseconds)
+	Delay int64
+	// Bytes that would have been blocked entirely by a zero limit
+	BlockedBytes int64
+}
+
+// Load atomically loads counters
+func (o *ObservedThrottling) Load() ObservedThrottling {
+	return ObservedThrottling{
+		DelayedBytes: atomic.LoadInt64(&o.DelayedBytes),
+		Delay:        atomic.LoadInt64(&o.Delay),
+		BlockedBytes: atomic.LoadInt64(&o.BlockedBytes),
+	}
+}
+
+// record accounts n bytes that would have been delayed by a given duration
+func (o *ObservedThrottling) record(n int, delay time.Duration) {
+	if delay == rate.InfDuration {
+		atomic.AddInt64(&o.BlockedBytes, int64(n))
+		return
+	}
+	atomic.AddInt64(&o.DelayedBytes, int64(n))
+	atomic.AddInt64(&o.Delay, int64(delay))
+}
+
+// SetObserveOnly makes connection forward traffic without waiting for its
+// limiter. Limiter is still consulted and throttling that would have happened
+// is accounted in connection's own counters (see Observed) and in given totals
+// (may be nil). Traffic let through this way doesn't consume limiter tokens,
+// so observations reflect what enforced limits would have allowed. May be
+// called concurrently with Read or Write.
+func (c *LimitedConnection) SetObserveOnly(observe bool, totals *ObservedThrottling) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	c.observeOnly = observe
+	c.observedTotals = totals
+}
+
+// Observed returns throttling that would have been applied to connection
+// while it was in observe-only mode. Safe to call concurrently.
+func (c *LimitedConnection) Observed() ObservedThrottling {
+	return c.observed.Load()
+}
@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// TrafficClass tells what kind of traffic a connection carries
+type TrafficClass string
+
+// Traffic classes assigned to connections by their traffic pattern
+const (
+	// Connection haven't transferred anything for IdleThreshold
+	TrafficIdle TrafficClass = "idle"
+	// Connection transfers small chunks of data at a low rate (e.g. SSH
+	// keystrokes, game packets)
+	TrafficInteractive TrafficClass = "interactive"
+	// Connection transfers large chunks of data or transfers at a high rate
+	TrafficBulk TrafficClass = "bulk"
+)
+
+// IdleThreshold is the time without any traffic after which a connection is
+// considered idle
+const IdleThreshold = 5 * time.Second
+
+// BulkRateThreshold is the average rate (bytes per second) above which a
+// connection transferring small chunks is considered bulk anyways
+const BulkRateThreshold = 64 * 1024
+
+// patternWeight is the weight of the most recent chunk in moving averages
+const patternWeight = 0.1
+
+// TrafficPattern describes recent traffic of a connection
+type TrafficPattern struct {
+	Class TrafficClass
+	// Exponentially weighted moving averages of chunk size and of time
+	// between consecutive chunks
+	AverageChunkSize float64
+	AverageInterval  time.Duration
+	// Time of the last transferred chunk (zero if there were none)
+	LastActivity time.Time
+}
+
+// patternTracker keeps track of sizes and inter-arrival times of chunks of
+// data transferred by a connection
+type patternTracker struct {
+	mu        *sync.Mutex
+	chunkSize float64
+	interval  float64
+	last      time.Time
+	// Number of chunks observed so far (saturates at 2, since it's only needed
+	// to tell if averages are initialized)
+	chunks int
+}
+
+func newPatternTracker() *patternTracker {
+	return &patternTracker{
+		mu: new(sync.Mutex),
+	}
+}
+
+// observe accounts a chunk of n bytes transferred at a given time
+func (p *patternTracker) observe(now time.Time, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.chunks {
+	case 0:
+		p.chunkSize = float64(n)
+		p.chunks++
+	case 1:
+		p.chunkSize += patternWeight * (float64(n) - p.chunkSize)
+		p.interval = float64(now.Sub(p.last))
+		p.chunks++
+	default:
+		p.chunkSize += patternWeight * (float64(n) - p.chunkSize)
+		p.interval += patternWeight * (float64(now.Sub(p.last)) - p.interval)
+	}
+	p.last = now
+}
+
+// pattern returns traffic pattern as of a given time
+func (p *patternTracker) pattern(now time.Time) TrafficPattern {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := TrafficPattern{
+		Class:            TrafficIdle,
+		AverageChunkSize: p.chunkSize,
+		AverageInterval:  time.Duration(p.interval),
+		LastActivity:     p.last,
+	}
+	if p.chunks == 0 || now.Sub(p.last) >= IdleThreshold {
+		return result
+	}
+	// Rate is unknown until there are at least two chunks
+	if p.chunkSize > InteractiveChunkSize || (p.chunks > 1 &&
+		p.chunkSize*float64(time.Second) > BulkRateThreshold*p.interval) {
+		result.Class = TrafficBulk
+	} else {
+		result.Class = TrafficInteractive
+	}
+	return result
+}
@@ -0,0 +1,36 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficPattern(t *testing.T) {
+	now := time.Now()
+	p := newPatternTracker()
+	if c := p.pattern(now).Class; c != TrafficIdle {
+		t.Errorf("Expected new connection to be idle, got %v", c)
+	}
+
+	// Keystrokes
+	for i := 0; i < 20; i++ {
+		now = now.Add(200 * time.Millisecond)
+		p.observe(now, 40)
+	}
+	if c := p.pattern(now).Class; c != TrafficInteractive {
+		t.Errorf("Expected keystrokes to be interactive, got %v", c)
+	}
+
+	// Small chunks at a high rate
+	for i := 0; i < 50; i++ {
+		now = now.Add(time.Millisecond)
+		p.observe(now, 400)
+	}
+	if c := p.pattern(now).Class; c != TrafficBulk {
+		t.Errorf("Expected high rate transfer to be bulk, got %v", c)
+	}
+
+	if c := p.pattern(now.Add(IdleThreshold)).Class; c != TrafficIdle {
+		t.Errorf("Expected silent connection to be idle, got %v", c)
+	}
+}
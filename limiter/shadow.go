@@ -0,0 +1,78 @@
+package limiter
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// SetShadowLimiter attaches a limiter that is evaluated alongside the enforced
+// one, but never waited for. Traffic exceeding shadow limits is accounted in
+// connection's own counters (see Shadowed) and in given totals (may be nil).
+// Nil limiter disables shadow evaluation. May be called concurrently with Read
+// or Write.
+func (c *LimitedConnection) SetShadowLimiter(shadow *MultiLimiter, totals *ObservedThrottling) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	c.shadow = shadow
+	c.shadowTotals = totals
+}
+
+// Shadowed returns throttling that shadow limits would have applied to
+// connection if they were enforced. Safe to call concurrently.
+func (c *LimitedConnection) Shadowed() ObservedThrottling {
+	return c.shadowed.Load()
+}
+
+// evaluateShadow reserves n bytes from a shadow limiter and records the delay
+// it would have caused. Reservations that would have been delayed are
+// canceled, so shadow limiter is only charged for traffic it would have let
+// through.
+func (c *LimitedConnection) evaluateShadow(shadow *MultiLimiter, totals *ObservedThrottling,
+	now time.Time, n int) {
+	var reservations []*MultiReservation
+	var delay time.Duration
+	// Shadow limiter may have smaller burst than the enforced one
+	for left := n; left > 0; {
+		chunk := shadow.Burst()
+		if chunk > left {
+			chunk = left
+		}
+		r := shadow.ReserveN(now, chunk)
+		reservations = append(reservations, r)
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+		left -= chunk
+	}
+	if delay == 0 {
+		return
+	}
+	c.shadowed.record(n, delay)
+	if totals != nil {
+		totals.record(n, delay)
+	}
+	for i := len(reservations) - 1; i >= 0; i-- {
+		reservations[i].CancelAt(now)
+	}
+}
+
+// createShadowMultiLimiter creates a shadow limiter for an accepted
+// connection. Returns nil if shadow limits are not set or connection is
+// exempt. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) createShadowMultiLimiter(conn *LimitedConnection) *MultiLimiter {
+	if _, exempt := l.exemptConnections[conn]; exempt {
+		return nil
+	}
+	var limiters []*rate.Limiter
+	if l.shadowGlobalLimiter != nil {
+		limiters = append(limiters, l.shadowGlobalLimiter)
+	}
+	if l.shadow.limits.ConnectionLimit > 0 {
+		limiters = append(limiters, l.createLimiter(l.shadow.limits.ConnectionLimit))
+	}
+	if len(limiters) == 0 {
+		return nil
+	}
+	return NewMultiLimiter(limiters)
+}
@@ -0,0 +1,259 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Shaper decides when data passing through a connection may go on.
+// MultiLimiter reserves every chunk of data from all shapers of a connection.
+type Shaper interface {
+	// Limit returns the rate shaper lets data through at. Zero limit lets no
+	// data through.
+	Limit() rate.Limit
+	// Burst returns the largest chunk of data shaper lets through at once
+	Burst() int
+	// ReserveN accounts n bytes passing at a given moment and tells how long
+	// they have to wait for
+	ReserveN(now time.Time, n int) Reservation
+}
+
+// Reservation is data accounted by a Shaper
+type Reservation interface {
+	OK() bool
+	DelayFrom(now time.Time) time.Duration
+	// CancelAt returns reserved data to the shaper as if reservation never
+	// happened (as much as possible given reservations made since then)
+	CancelAt(now time.Time)
+}
+
+// SlidingWindowDuration is the window SlidingWindow algorithm caps traffic
+// within
+const SlidingWindowDuration = time.Second
+
+// bucketShaper is a token bucket used as a Shaper
+type bucketShaper struct {
+	*rate.Limiter
+}
+
+// BucketShaper returns a Shaper reserving data from a token bucket
+func BucketShaper(lim *rate.Limiter) Shaper {
+	return bucketShaper{lim}
+}
+
+func (s bucketShaper) ReserveN(now time.Time, n int) Reservation {
+	return s.Limiter.ReserveN(now, n)
+}
+
+// lowestLimit returns the lowest limit of given limiters (rate.Inf if there
+// are none)
+func lowestLimit(limiters []*rate.Limiter) rate.Limit {
+	result := rate.Inf
+	for _, lim := range limiters {
+		if lim.Limit() < result {
+			result = lim.Limit()
+		}
+	}
+	return result
+}
+
+// immediate is a reservation that doesn't wait
+type immediate struct{}
+
+func (immediate) OK() bool                          { return true }
+func (immediate) DelayFrom(time.Time) time.Duration { return 0 }
+func (immediate) CancelAt(time.Time)                {}
+
+// leakyPacer paces data of a connection at the lowest limit of its limiters:
+// every chunk waits until the previous one would have drained. Unlike token
+// buckets, it doesn't accumulate allowance while connection is idle.
+type leakyPacer struct {
+	limiters []*rate.Limiter
+	mu       *sync.Mutex
+	// Time the last reserved chunk drains at
+	next time.Time
+}
+
+func newLeakyPacer(limiters []*rate.Limiter) *leakyPacer {
+	return &leakyPacer{
+		limiters: limiters,
+		mu:       new(sync.Mutex),
+	}
+}
+
+func (p *leakyPacer) Limit() rate.Limit {
+	return lowestLimit(p.limiters)
+}
+
+func (p *leakyPacer) Burst() int {
+	limit := p.Limit()
+	if limit == rate.Inf {
+		return MaxBurstSize
+	}
+	return GetGoodBurst(limit)
+}
+
+func (p *leakyPacer) ReserveN(now time.Time, n int) Reservation {
+	limit := p.Limit()
+	if limit == rate.Inf {
+		return immediate{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at := now
+	if p.next.After(at) {
+		at = p.next
+	}
+	p.next = at.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	return &pacedReservation{pacer: p, at: at, drained: p.next}
+}
+
+// pacedReservation is a chunk of data reserved from leakyPacer
+type pacedReservation struct {
+	pacer *leakyPacer
+	// Time chunk goes at and time it drains at
+	at      time.Time
+	drained time.Time
+}
+
+func (r *pacedReservation) OK() bool {
+	return true
+}
+
+func (r *pacedReservation) DelayFrom(now time.Time) time.Duration {
+	if now.After(r.at) {
+		return 0
+	}
+	return r.at.Sub(now)
+}
+
+func (r *pacedReservation) CancelAt(now time.Time) {
+	r.pacer.mu.Lock()
+	defer r.pacer.mu.Unlock()
+	// Only the last chunk could be taken back
+	if r.pacer.next.Equal(r.drained) {
+		r.pacer.next = r.at
+	}
+}
+
+// slidingWindow lets no more data of a connection through within any
+// SlidingWindowDuration than the lowest limit of its limiters allows over it,
+// which caps bursts token buckets would let through
+type slidingWindow struct {
+	limiters []*rate.Limiter
+	window   time.Duration
+	mu       *sync.Mutex
+	// Chunks of data that went within the last window or are to go, ordered
+	// by time
+	entries []windowEntry
+	seq     uint64
+}
+
+// windowEntry is a chunk of data reserved from slidingWindow
+type windowEntry struct {
+	seq uint64
+	at  time.Time
+	n   int
+}
+
+func newSlidingWindow(limiters []*rate.Limiter, window time.Duration) *slidingWindow {
+	return &slidingWindow{
+		limiters: limiters,
+		window:   window,
+		mu:       new(sync.Mutex),
+	}
+}
+
+func (w *slidingWindow) Limit() rate.Limit {
+	return lowestLimit(w.limiters)
+}
+
+// capacity returns the amount of data window lets through for a given limit
+func (w *slidingWindow) capacity(limit rate.Limit) int {
+	result := float64(limit) * w.window.Seconds()
+	if result < MinBurstSize {
+		return MinBurstSize
+	} else if result > MaxScaledBurstSize {
+		return MaxScaledBurstSize
+	}
+	return int(result)
+}
+
+func (w *slidingWindow) Burst() int {
+	limit := w.Limit()
+	if limit == rate.Inf {
+		return MaxScaledBurstSize
+	}
+	return w.capacity(limit)
+}
+
+func (w *slidingWindow) ReserveN(now time.Time, n int) Reservation {
+	limit := w.Limit()
+	if limit == rate.Inf {
+		return immediate{}
+	}
+	capacity := w.capacity(limit)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Chunks that left the window are forgotten
+	expired := 0
+	for expired < len(w.entries) && !w.entries[expired].at.After(now.Add(-w.window)) {
+		expired++
+	}
+	w.entries = w.entries[expired:]
+
+	// Chunks go in order, so a chunk goes once enough of earlier ones leave
+	// its window. A chunk bigger than window capacity waits for all of them.
+	at := now
+	sum := 0
+	for _, e := range w.entries {
+		sum += e.n
+	}
+	if len(w.entries) > 0 && w.entries[len(w.entries)-1].at.After(at) {
+		at = w.entries[len(w.entries)-1].at
+	}
+	for i := 0; ; {
+		for i < len(w.entries) && !w.entries[i].at.After(at.Add(-w.window)) {
+			sum -= w.entries[i].n
+			i++
+		}
+		if sum+n <= capacity || i == len(w.entries) {
+			break
+		}
+		at = w.entries[i].at.Add(w.window)
+	}
+	w.seq++
+	w.entries = append(w.entries, windowEntry{seq: w.seq, at: at, n: n})
+	return &windowReservation{window: w, seq: w.seq, at: at}
+}
+
+// windowReservation is a chunk of data reserved from slidingWindow
+type windowReservation struct {
+	window *slidingWindow
+	seq    uint64
+	at     time.Time
+}
+
+func (r *windowReservation) OK() bool {
+	return true
+}
+
+func (r *windowReservation) DelayFrom(now time.Time) time.Duration {
+	if now.After(r.at) {
+		return 0
+	}
+	return r.at.Sub(now)
+}
+
+func (r *windowReservation) CancelAt(now time.Time) {
+	r.window.mu.Lock()
+	defer r.window.mu.Unlock()
+	for i, e := range r.window.entries {
+		if e.seq == r.seq {
+			r.window.entries = append(r.window.entries[:i], r.window.entries[i+1:]...)
+			return
+		}
+	}
+}
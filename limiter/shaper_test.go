@@ -0,0 +1,72 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestLeakyPacer(t *testing.T) {
+	// Bucket allows a big burst, but pacer spaces chunks anyway
+	ml := NewShapedMultiLimiter([]*rate.Limiter{rate.NewLimiter(1000, 10000)},
+		[]Shaper{newLeakyPacer([]*rate.Limiter{rate.NewLimiter(1000, 10000)})})
+	if burst := ml.Burst(); burst != GetGoodBurst(1000) {
+		t.Errorf("Expected pacing chunk of %d, got %d", GetGoodBurst(1000), burst)
+	}
+	now := time.Now()
+	for i, expected := range []time.Duration{0, 100 * time.Millisecond,
+		200 * time.Millisecond} {
+		if delay := ml.ReserveN(now, 100).DelayFrom(now); delay != expected {
+			t.Errorf("Expected chunk %d to wait for %v, got %v", i, expected, delay)
+		}
+	}
+
+	// Cancelled chunk gives its slot back
+	r := ml.ReserveN(now, 100)
+	r.CancelAt(now)
+	if delay := ml.ReserveN(now, 100).DelayFrom(now); delay != 300*time.Millisecond {
+		t.Errorf("Expected cancelled slot to be reused, got delay %v", delay)
+	}
+
+	// Idle time isn't saved up
+	later := now.Add(time.Minute)
+	ml.ReserveN(later, 100)
+	if delay := ml.ReserveN(later, 100).DelayFrom(later); delay != 100*time.Millisecond {
+		t.Errorf("Expected pacer not to save up allowance, got delay %v", delay)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	w := newSlidingWindow([]*rate.Limiter{rate.NewLimiter(1000, 1000000)}, time.Second)
+	if burst := w.Burst(); burst != 1000 {
+		t.Errorf("Expected window capacity of 1000, got %d", burst)
+	}
+	now := time.Now()
+	cases := []struct {
+		at       time.Duration
+		n        int
+		expected time.Duration
+	}{
+		// Window fills up right away
+		{0, 600, 0},
+		{100 * time.Millisecond, 400, 0},
+		// Next chunk waits for the first one to leave the window
+		{200 * time.Millisecond, 500, 800 * time.Millisecond},
+		// And the one after that waits for the second one
+		{300 * time.Millisecond, 300, 800 * time.Millisecond},
+	}
+	for i, c := range cases {
+		at := now.Add(c.at)
+		if delay := w.ReserveN(at, c.n).DelayFrom(at); delay != c.expected {
+			t.Errorf("Expected chunk %d to wait for %v, got %v", i, c.expected, delay)
+		}
+	}
+
+	// Cancelled chunk leaves the window
+	w = newSlidingWindow([]*rate.Limiter{rate.NewLimiter(1000, 1000000)}, time.Second)
+	w.ReserveN(now, 1000).CancelAt(now)
+	if delay := w.ReserveN(now, 1000).DelayFrom(now); delay != 0 {
+		t.Errorf("Expected cancelled chunk to leave the window, got delay %v", delay)
+	}
+}
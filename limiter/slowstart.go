@@ -0,0 +1,70 @@
+package limiter
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// SlowStart makes new connections start at a fraction of their per-connection
+// limit and ramp up to the full limit over a given window. Zero window
+// disables slow start.
+type SlowStart struct {
+	// Fraction of a per-connection limit new connections start with (0..1]
+	Fraction float64
+	// Time it takes for a connection to ramp up to its full limit
+	Window time.Duration
+}
+
+// slowStartStep is how often limits of ramping connections are raised
+const slowStartStep = 100 * time.Millisecond
+
+func (s SlowStart) enabled() bool {
+	return s.Window > 0
+}
+
+// factor returns a fraction of a full limit a connection accepted at a given
+// time is allowed to use now. Returns false once ramp up is complete.
+func (s SlowStart) factor(acceptedAt, now time.Time) (float64, bool) {
+	elapsed := now.Sub(acceptedAt)
+	if !s.enabled() || elapsed >= s.Window {
+		return 1, false
+	}
+	return s.Fraction + (1-s.Fraction)*float64(elapsed)/float64(s.Window), true
+}
+
+// rampingConnection is a connection that haven't yet reached its full
+// per-connection limit
+type rampingConnection struct {
+	limiter *rate.Limiter
+	target  rate.Limit
+}
+
+// createRampingLimiter creates a per-connection limiter for a connection
+// accepted at a given time. Limiter starts with an empty bucket, so that a
+// connection doesn't get a full burst right away. Returns nil if connection is
+// past its slow start. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) createRampingLimiter(acceptedAt time.Time,
+	perConn rate.Limit) *rate.Limiter {
+	now := time.Now()
+	factor, ramping := l.slowStart.factor(acceptedAt, now)
+	if !ramping {
+		return nil
+	}
+	result := rate.NewLimiter(perConn*rate.Limit(factor), l.connectionBurst(perConn))
+	result.AllowN(now, result.Burst())
+	return result
+}
+
+// rampUp raises limits of ramping connections according to slow start
+// settings. Must be called with currentLimitsMu locked.
+func (l *RateLimitingListener) rampUp() {
+	now := time.Now()
+	for conn, r := range l.rampingConnections {
+		factor, ramping := l.slowStart.factor(conn.acceptedAt, now)
+		r.limiter.SetLimitAt(now, r.target*rate.Limit(factor))
+		if !ramping {
+			delete(l.rampingConnections, conn)
+		}
+	}
+}
@@ -3,19 +3,57 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"time"
 
 	"github.com/anton-dessiatov/throttle/app"
+	"github.com/anton-dessiatov/throttle/cli"
 	"net/http"
 	_ "net/http/pprof"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := cli.Commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
-	var configPath string
-	flag.StringVar(&configPath, "config", "config.json", "Path to configuration file")
+	var opts app.Options
+	flag.StringVar(&opts.ConfigPath, "config", "config.json", "Path to configuration file")
+	flag.StringVar(&opts.StatePath, "state", "",
+		"Path to a file to persist runtime state in (disabled if empty)")
+	flag.DurationVar(&opts.StateInterval, "stateInterval", time.Minute,
+		"How often to save state file")
+	flag.BoolVar(&opts.Restore, "restore", false,
+		"Start tunnels as they were when state was last saved instead of "+
+			"loading them from configuration file")
+	flag.StringVar(&opts.Admin.Address, "admin", "",
+		"Address to serve admin API at, e.g. localhost:6061 (disabled if empty)")
+	flag.StringVar(&opts.Admin.CertFile, "adminCert", "",
+		"Path to PEM encoded certificate to serve admin API over TLS with")
+	flag.StringVar(&opts.Admin.KeyFile, "adminKey", "",
+		"Path to PEM encoded private key to serve admin API over TLS with")
+	flag.StringVar(&opts.Admin.ClientCAFile, "adminClientCA", "",
+		"Path to PEM encoded CA certificates to verify admin API client "+
+			"certificates with (client certificates are not required if empty)")
+	flag.StringVar(&opts.Admin.AuditLogPath, "adminAuditLog", "",
+		"Path to a file to append admin API audit log to (standard log if empty)")
+	flag.StringVar(&opts.ControlPath, "control", "",
+		"Path to unix socket to serve admin API at with operator privileges "+
+			"for local tools like \"throttle ss\" (disabled if empty)")
+	flag.StringVar(&opts.PublicStatsAddress, "publicStats", "",
+		"Address to serve read-only aggregate stats at without authentication, "+
+			"e.g. :6062 (disabled if empty)")
+	flag.BoolVar(&opts.RaiseOpenFiles, "raiseOpenFiles", false,
+		"Raise soft limit of open files to the hard one at startup")
 	flag.Parse()
 
-	app.Run(configPath)
+	app.Run(opts)
 }